@@ -0,0 +1,77 @@
+package sandbox_test
+
+import (
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const modulePath = "github.com/margo/sandbox/"
+
+// importBoundaries lists, per top level directory, the directories of this module its packages may
+// import. Keeping shared-lib and the generated standard code free of imports from the rest of the
+// repository is what allows them to be published as modules of their own.
+var importBoundaries = map[string][]string{
+	"shared-lib":   {"shared-lib"},
+	"standard":     {"standard"},
+	"non-standard": {"non-standard", "standard", "shared-lib"},
+}
+
+func TestModuleBoundaries(t *testing.T) {
+	err := filepath.WalkDir(".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			// nested modules (test artefacts) have boundaries of their own
+			if path != "." {
+				if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+
+		file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.ImportsOnly)
+		if err != nil {
+			return err
+		}
+		topLevel := strings.Split(filepath.ToSlash(path), "/")[0]
+		allowed, bounded := importBoundaries[topLevel]
+		for _, spec := range file.Imports {
+			imported, _ := strconv.Unquote(spec.Path.Value)
+			if strings.HasPrefix(imported, "github.com/margo/") && !strings.HasPrefix(imported, modulePath) {
+				t.Errorf("%s imports %s, use the canonical %s paths", path, imported, modulePath)
+				continue
+			}
+			if !bounded || !strings.HasPrefix(imported, modulePath) {
+				continue
+			}
+			target := strings.Split(strings.TrimPrefix(imported, modulePath), "/")[0]
+			if !containsDir(allowed, target) {
+				t.Errorf("%s imports %s, packages under %s/ may only import %v", path, imported, topLevel, allowed)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to check the imports: %v", err)
+	}
+}
+
+func containsDir(dirs []string, dir string) bool {
+	for _, candidate := range dirs {
+		if candidate == dir {
+			return true
+		}
+	}
+	return false
+}
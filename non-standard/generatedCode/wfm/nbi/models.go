@@ -157,6 +157,9 @@ type AppDescription struct {
 	ApiVersion    string                  `json:"apiVersion" yaml:"apiVersion"`
 	Configuration *AppConfigurationSchema `json:"configuration,omitempty"`
 
+	// Dependencies Applications that must be deployed on the device before this one
+	Dependencies *[]AppDescriptionDependency `json:"dependencies,omitempty" yaml:"dependencies,omitempty"`
+
 	// DeploymentProfiles Available deployment profiles for the application
 	DeploymentProfiles []AppDeploymentProfile `json:"deploymentProfiles" yaml:"deploymentProfiles"`
 
@@ -166,6 +169,15 @@ type AppDescription struct {
 	Parameters *AppDescriptionParametersMap `json:"parameters,omitempty"`
 }
 
+// AppDescriptionDependency An application that must be deployed on the device first
+type AppDescriptionDependency struct {
+	// Id Application id (metadata.id of its application description)
+	Id string `json:"id" yaml:"id"`
+
+	// Version Semver constraint on the application version, e.g. "^1.2", any version when omitted
+	Version *string `json:"version,omitempty" yaml:"version,omitempty"`
+}
+
 // AppDescriptionCatalogInfo defines model for AppDescriptionCatalogInfo.
 type AppDescriptionCatalogInfo struct {
 	Application *struct {
@@ -318,6 +330,9 @@ type ApplicationDeploymentRecentOperation struct {
 // ApplicationDeploymentSpec Application Deployment specification
 type ApplicationDeploymentSpec struct {
 	AppPackageRef struct {
+		// Digest Pins the deployment to this package content digest, the request is rejected if the package changed
+		Digest *string `json:"digest,omitempty"`
+
 		// Id ID of the ApplicationPackage
 		Id string `json:"id"`
 	} `json:"appPackageRef"`
@@ -445,6 +460,9 @@ type ApplicationPackageSpecSourceType string
 type ApplicationPackageStatus struct {
 	ContextualInfo *ContextualInfo `json:"contextualInfo,omitempty"`
 
+	// Digest Content digest of the package computed at onboarding (sha256 of the deterministic package tarball)
+	Digest *string `json:"digest,omitempty"`
+
 	// LastUpdateTime Last update time
 	LastUpdateTime *time.Time `json:"lastUpdateTime,omitempty"`
 
@@ -660,6 +678,9 @@ type GitRepo struct {
 	// Branch Git branch to use
 	Branch *string `json:"branch,omitempty"`
 
+	// DescriptorPath Path of the application description yaml relative to subPath, when it is not margo.yaml or margo.yml in the package root
+	DescriptorPath *string `json:"descriptorPath,omitempty"`
+
 	// SubPath Subdirectory within the repository containing the application description yaml (ex margo.yaml)
 	SubPath *string `json:"subPath,omitempty"`
 
@@ -761,6 +782,9 @@ type OciAuthenticationType string
 type OciRepo struct {
 	Authentication *OciAuthentication `json:"authentication,omitempty"`
 
+	// DescriptorPath Path of the application description yaml within the artefact, when it is not margo.yaml or margo.yml in its root
+	DescriptorPath *string `json:"descriptorPath,omitempty"`
+
 	// Digest Artefact digest (mutually exclusive with tag)
 	Digest *string `json:"digest,omitempty"`
 
@@ -1234,6 +1258,13 @@ func (t GitRepo) MarshalJSON() ([]byte, error) {
 		}
 	}
 
+	if t.DescriptorPath != nil {
+		object["descriptorPath"], err = json.Marshal(t.DescriptorPath)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling 'descriptorPath': %w", err)
+		}
+	}
+
 	if t.SubPath != nil {
 		object["subPath"], err = json.Marshal(t.SubPath)
 		if err != nil {
@@ -1288,6 +1319,13 @@ func (t *GitRepo) UnmarshalJSON(b []byte) error {
 		}
 	}
 
+	if raw, found := object["descriptorPath"]; found {
+		err = json.Unmarshal(raw, &t.DescriptorPath)
+		if err != nil {
+			return fmt.Errorf("error reading 'descriptorPath': %w", err)
+		}
+	}
+
 	if raw, found := object["subPath"]; found {
 		err = json.Unmarshal(raw, &t.SubPath)
 		if err != nil {
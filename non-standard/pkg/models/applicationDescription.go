@@ -1,11 +1,13 @@
 package models
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 
 	"github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+	"github.com/margo/sandbox/shared-lib/dependency"
 	"gopkg.in/yaml.v3"
 )
 
@@ -20,7 +22,14 @@ func ParseApplicationDescription(r io.Reader, format ApplicationDescriptionForma
 	description := nbi.AppDescription{}
 	switch format {
 	case ApplicationDescriptionFormatYAML:
-		if err := yaml.NewDecoder(r).Decode(&description); err != nil {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return description, err
+		}
+		if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&description); err != nil {
+			return description, err
+		}
+		if err := decodeYAMLComponents(data, &description); err != nil {
 			return description, err
 		}
 	case ApplicationDescriptionFormatJSON:
@@ -32,3 +41,112 @@ func ParseApplicationDescription(r io.Reader, format ApplicationDescriptionForma
 	}
 	return description, nil
 }
+
+// MarshalApplicationDescription encodes a description in the format ParseApplicationDescription
+// reads. The YAML is converted from the JSON encoding, yaml leaves out the components of the
+// deployment profiles as they are json unions.
+func MarshalApplicationDescription(description nbi.AppDescription, format ApplicationDescriptionFormat) ([]byte, error) {
+	data, err := json.Marshal(description)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case ApplicationDescriptionFormatJSON:
+		return data, nil
+	case ApplicationDescriptionFormatYAML:
+		// JSON is YAML, decoding it into a node keeps the order of the fields
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return nil, err
+		}
+		blockStyle(&node)
+		return yaml.Marshal(&node)
+	default:
+		return nil, fmt.Errorf("unknown format: %s", format)
+	}
+}
+
+// blockStyle drops the flow style and the quotes of the JSON a node was decoded from, strings that
+// would read as another type stay quoted. The null fields of the JSON are left out.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	if node.Kind == yaml.MappingNode {
+		content := node.Content[:0]
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Tag != "!!null" {
+				content = append(content, node.Content[i], node.Content[i+1])
+			}
+		}
+		node.Content = content
+	}
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// decodeYAMLComponents fills the components of the deployment profiles, yaml leaves them empty as
+// they are json unions
+func decodeYAMLComponents(data []byte, description *nbi.AppDescription) error {
+	var profiles struct {
+		DeploymentProfiles []struct {
+			Components []interface{} `yaml:"components"`
+		} `yaml:"deploymentProfiles"`
+	}
+	if err := yaml.Unmarshal(data, &profiles); err != nil {
+		return err
+	}
+	for i, profile := range profiles.DeploymentProfiles {
+		if i >= len(description.DeploymentProfiles) {
+			break
+		}
+		components := description.DeploymentProfiles[i].Components
+		for j, component := range profile.Components {
+			if j >= len(components) {
+				break
+			}
+			raw, err := json.Marshal(component)
+			if err != nil {
+				return fmt.Errorf("deploymentProfiles[%d].components[%d]: %w", i, j, err)
+			}
+			if err := components[j].UnmarshalJSON(raw); err != nil {
+				return fmt.Errorf("deploymentProfiles[%d].components[%d]: %w", i, j, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DependenciesOf returns the applications the description declares as dependencies
+func DependenciesOf(description nbi.AppDescription) []dependency.Requirement {
+	if description.Dependencies == nil {
+		return nil
+	}
+	requirements := make([]dependency.Requirement, 0, len(*description.Dependencies))
+	for _, declared := range *description.Dependencies {
+		requirement := dependency.Requirement{ID: declared.Id}
+		if declared.Version != nil {
+			requirement.Version = *declared.Version
+		}
+		requirements = append(requirements, requirement)
+	}
+	return requirements
+}
+
+// ValidateDependencies checks that every dependency names an application once, that its version
+// constraint parses and that the application does not depend on itself
+func ValidateDependencies(description nbi.AppDescription) error {
+	seen := map[string]bool{}
+	for _, requirement := range DependenciesOf(description) {
+		if err := requirement.Validate(); err != nil {
+			return err
+		}
+		if requirement.ID == description.Metadata.Id {
+			return fmt.Errorf("application %s cannot depend on itself", requirement.ID)
+		}
+		if seen[requirement.ID] {
+			return fmt.Errorf("dependency %s is declared more than once", requirement.ID)
+		}
+		seen[requirement.ID] = true
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"fmt"
+	"maps"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+)
+
+// applicationIdPattern is the syntax of metadata.id: lower case letters, numbers and dashes, at most
+// 200 characters, starting and ending with a letter or a number
+var applicationIdPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,198}[a-z0-9])?$`)
+
+// ValidationError is a problem of an application description
+type ValidationError struct {
+	// Field is the path of the offending field in the description, e.g. deploymentProfiles[0].type
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Message)
+}
+
+// ValidationErrors are all the problems of an application description
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// add records a problem of the field
+func (e *ValidationErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// required records a problem when the value is blank
+func (e *ValidationErrors) required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		e.add(field, "is required")
+	}
+}
+
+// ValidateApplicationDescription checks the description against the constraints of the
+// application description schema and the references between its parts. All the problems are
+// returned at once as ValidationErrors, nil means the description is valid.
+func ValidateApplicationDescription(description nbi.AppDescription) error {
+	var errs ValidationErrors
+	errs.required("apiVersion", description.ApiVersion)
+	errs.required("kind", description.Kind)
+	validateMetadata(&errs, description.Metadata)
+	components := validateDeploymentProfiles(&errs, description.DeploymentProfiles)
+	parameters := validateParameters(&errs, description.Parameters, components)
+	validateConfiguration(&errs, description.Configuration, parameters)
+	if err := ValidateDependencies(description); err != nil {
+		errs.add("dependencies", "%s", err.Error())
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validateMetadata(errs *ValidationErrors, metadata nbi.AppDescriptionMetadata) {
+	if metadata.Id == "" {
+		errs.add("metadata.id", "is required")
+	} else if !applicationIdPattern.MatchString(metadata.Id) {
+		errs.add("metadata.id", "%q must be at most 200 lower case letters, numbers or '-', starting and ending with a letter or a number", metadata.Id)
+	}
+	errs.required("metadata.name", metadata.Name)
+	errs.required("metadata.version", metadata.Version)
+
+	if metadata.Catalog == nil {
+		return
+	}
+	if metadata.Catalog.Organization != nil {
+		for i, organization := range *metadata.Catalog.Organization {
+			if organization.Name == nil || strings.TrimSpace(*organization.Name) == "" {
+				errs.add(fmt.Sprintf("metadata.catalog.organization[%d].name", i), "is required")
+			}
+		}
+	}
+	if metadata.Catalog.Author != nil {
+		for i, author := range *metadata.Catalog.Author {
+			if author.Email == nil {
+				continue
+			}
+			email := string(*author.Email)
+			if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+				errs.add(fmt.Sprintf("metadata.catalog.author[%d].email", i), "%q is not an email address", email)
+			}
+		}
+	}
+}
+
+// validateDeploymentProfiles returns the names of the components of all the profiles
+func validateDeploymentProfiles(errs *ValidationErrors, profiles []nbi.AppDeploymentProfile) map[string]bool {
+	components := map[string]bool{}
+	if len(profiles) == 0 {
+		errs.add("deploymentProfiles", "needs at least one deployment profile")
+	}
+	for i, profile := range profiles {
+		field := fmt.Sprintf("deploymentProfiles[%d]", i)
+		switch profile.Type {
+		case nbi.AppDeploymentProfileTypeHelmV3, nbi.AppDeploymentProfileTypeCompose:
+		case "":
+			errs.add(field+".type", "is required")
+		default:
+			errs.add(field+".type", "%q must be %s or %s", profile.Type, nbi.AppDeploymentProfileTypeHelmV3, nbi.AppDeploymentProfileTypeCompose)
+		}
+		if len(profile.Components) == 0 {
+			errs.add(field+".components", "needs at least one component")
+		}
+
+		seen := map[string]bool{}
+		for j, component := range profile.Components {
+			componentField := fmt.Sprintf("%s.components[%d]", field, j)
+			name, location, locationField := componentOf(profile.Type, component)
+			if name == "" {
+				errs.add(componentField+".name", "is required")
+			} else if seen[name] {
+				errs.add(componentField+".name", "%q is declared more than once in the profile", name)
+			}
+			seen[name] = true
+			components[name] = true
+			if locationField != "" {
+				errs.required(componentField+".properties."+locationField, location)
+			}
+		}
+	}
+	return components
+}
+
+// componentOf returns the name of the component and where it is pulled from, the field of the
+// location is empty when the profile type is unknown
+func componentOf(profileType nbi.AppDeploymentProfileType, component nbi.AppDeploymentProfile_Components_Item) (name, location, locationField string) {
+	switch profileType {
+	case nbi.AppDeploymentProfileTypeHelmV3:
+		helm, _ := component.AsHelmApplicationDeploymentProfileComponent()
+		return strings.TrimSpace(helm.Name), helm.Properties.Repository, "repository"
+	case nbi.AppDeploymentProfileTypeCompose:
+		compose, _ := component.AsComposeApplicationDeploymentProfileComponent()
+		return strings.TrimSpace(compose.Name), compose.Properties.PackageLocation, "packageLocation"
+	default:
+		helm, _ := component.AsHelmApplicationDeploymentProfileComponent()
+		return strings.TrimSpace(helm.Name), "", ""
+	}
+}
+
+// validateParameters returns the names of the parameters
+func validateParameters(errs *ValidationErrors, parameters *nbi.AppDescriptionParametersMap, components map[string]bool) map[string]bool {
+	names := map[string]bool{}
+	if parameters == nil {
+		return names
+	}
+	for _, name := range slices.Sorted(maps.Keys(*parameters)) {
+		names[name] = true
+		field := "parameters." + name
+		parameter := (*parameters)[name]
+		if len(parameter.Targets) == 0 {
+			errs.add(field+".targets", "needs at least one target")
+		}
+		for i, target := range parameter.Targets {
+			targetField := fmt.Sprintf("%s.targets[%d]", field, i)
+			errs.required(targetField+".pointer", target.Pointer)
+			if len(target.Components) == 0 {
+				errs.add(targetField+".components", "needs at least one component")
+			}
+			for j, component := range target.Components {
+				if !components[component] {
+					errs.add(fmt.Sprintf("%s.components[%d]", targetField, j), "%q is not a component of the deployment profiles", component)
+				}
+			}
+		}
+	}
+	return names
+}
+
+func validateConfiguration(errs *ValidationErrors, configuration *nbi.AppConfigurationSchema, parameters map[string]bool) {
+	if configuration == nil {
+		return
+	}
+
+	schemas := map[string]bool{}
+	if configuration.Schema != nil {
+		for i, schema := range *configuration.Schema {
+			field := fmt.Sprintf("configuration.schema[%d]", i)
+			if strings.TrimSpace(schema.Name) == "" {
+				errs.add(field+".name", "is required")
+			} else if schemas[schema.Name] {
+				errs.add(field+".name", "%q is declared more than once", schema.Name)
+			}
+			schemas[schema.Name] = true
+			errs.required(field+".dataType", string(schema.DataType))
+			if schema.RegexMatch != nil {
+				if _, err := regexp.Compile(*schema.RegexMatch); err != nil {
+					errs.add(field+".regexMatch", "is not a valid regular expression: %v", err)
+				}
+			}
+		}
+	}
+
+	if configuration.Sections == nil {
+		return
+	}
+	for i, section := range *configuration.Sections {
+		field := fmt.Sprintf("configuration.sections[%d]", i)
+		errs.required(field+".name", section.Name)
+		for j, setting := range section.Settings {
+			settingField := fmt.Sprintf("%s.settings[%d]", field, j)
+			errs.required(settingField+".name", setting.Name)
+			if setting.Parameter == "" {
+				errs.add(settingField+".parameter", "is required")
+			} else if !parameters[setting.Parameter] {
+				errs.add(settingField+".parameter", "%q is not a declared parameter", setting.Parameter)
+			}
+			if setting.Schema == "" {
+				errs.add(settingField+".schema", "is required")
+			} else if !schemas[setting.Schema] {
+				errs.add(settingField+".schema", "%q is not a declared schema", setting.Schema)
+			}
+		}
+	}
+}
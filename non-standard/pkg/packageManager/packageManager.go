@@ -3,11 +3,11 @@ package packageManager
 import (
 	"archive/tar"
 	"compress/gzip"
-	//"context"
+	"context"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -15,8 +15,11 @@ import (
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
 	"github.com/margo/sandbox/non-standard/pkg/models"
+	"github.com/margo/sandbox/shared-lib/archive"
+	"github.com/margo/sandbox/shared-lib/digest"
+	"github.com/margo/sandbox/shared-lib/file"
 	"github.com/margo/sandbox/shared-lib/git"
-	//"github.com/margo/sandbox/shared-lib/oci"
+	"github.com/margo/sandbox/shared-lib/oci"
 	"gopkg.in/yaml.v3"
 )
 
@@ -37,6 +40,57 @@ const (
 	ExpectedApplicationDescriptionFileName = "margo.yaml"
 )
 
+// The annotations oras puts on the layers of the files it pushes: the name of the file, and whether
+// the layer is a directory packed as tar.gz rather than the file itself
+const (
+	orasTitleAnnotation  = "org.opencontainers.image.title"
+	orasUnpackAnnotation = "io.deis.oras.content.unpack"
+)
+
+// DefaultApplicationDescriptionFileNames are the filenames looked for in the package root when
+// LoadOptions does not name others. Packages created by the PackageManager always use
+// ExpectedApplicationDescriptionFileName.
+var DefaultApplicationDescriptionFileNames = []string{ExpectedApplicationDescriptionFileName, "margo.yml"}
+
+// LoadOptions controls how the application description of a package is found. The zero value
+// looks for one of the DefaultApplicationDescriptionFileNames in the package root.
+type LoadOptions struct {
+	// DescriptorFileNames are the filenames accepted in the package root, matched case-insensitively
+	DescriptorFileNames []string
+	// DescriptorPath is the path of the description relative to the package root, e.g.
+	// "deploy/application.yaml". It skips the discovery and must stay within the package.
+	DescriptorPath string
+	// SkipChecksums loads the package without verifying it against its ChecksumsFileName manifest
+	SkipChecksums bool
+	// ExpectedDigest is the "sha256:<hex>" ComputePackageDigest of the description the package must
+	// hold, the package is not loaded when it holds another one. Empty skips the verification.
+	ExpectedDigest string
+}
+
+// loadOptionsOf returns the options passed to a Load function, at most one is used
+func loadOptionsOf(opts []LoadOptions) LoadOptions {
+	var options LoadOptions
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	if len(options.DescriptorFileNames) == 0 {
+		options.DescriptorFileNames = DefaultApplicationDescriptionFileNames
+	}
+	return options
+}
+
+// AmbiguousDescriptionError is returned when the package root holds more than one valid
+// application description, none is picked over the others
+type AmbiguousDescriptionError struct {
+	PkgPath    string
+	Candidates []string
+}
+
+func (e *AmbiguousDescriptionError) Error() string {
+	return fmt.Sprintf("multiple ApplicationDescription files found in package root %s: %s, set the descriptor path to choose one",
+		e.PkgPath, strings.Join(e.Candidates, ", "))
+}
+
 // PackageManager handles application package operations for Margo applications.
 //
 // This struct provides functionality to load, parse, and manage application packages
@@ -46,6 +100,7 @@ const (
 // The PackageManager supports:
 //   - Loading packages from local directories
 //   - Loading packages from Git repositories (with optional authentication)
+//   - Loading packages from tarballs created by PackageToTarball
 //   - Parsing Margo application description files
 //   - Loading associated resources (icons, documentation, etc.)
 //
@@ -80,6 +135,7 @@ func NewPackageManager() *PackageManager {
 //   - branchName: The name of the branch to clone (e.g., "main", "develop")
 //   - subPath: If the app description file is not present at root level, then provide its path within the repo (e.g., "app-pkgs/pkg1")
 //   - auth: Optional authentication credentials for private repositories (can be nil)
+//   - opts: Optional LoadOptions, the descriptor path is relative to subPath
 //
 // Returns:
 //   - pkgPath: The absolute path to the cloned package directory
@@ -89,7 +145,8 @@ func NewPackageManager() *PackageManager {
 // Important Notes:
 //   - The caller is responsible for cleaning up the returned pkgPath directory
 //   - Only HTTPS-based Git URLs are supported; SSH URLs are not supported
-//   - The repository must contain a valid margo.yaml file in its root directory
+//   - The repository must contain a valid margo.yaml (or margo.yml) file in its root directory,
+//     unless the options name another descriptor
 //   - Resources directory is optional and will be loaded if present
 //
 // Example:
@@ -106,7 +163,7 @@ func NewPackageManager() *PackageManager {
 //   - Returns error if Git clone operation fails
 //   - Returns error if package loading from directory fails
 //   - Returns error if margo.yaml file is missing or invalid
-func (pm *PackageManager) LoadPackageFromGit(url, branchName, subPath string, auth *git.Auth) (pkgPath string, pkg *models.AppPkg, err error) {
+func (pm *PackageManager) LoadPackageFromGit(url, branchName, subPath string, auth *git.Auth, opts ...LoadOptions) (pkgPath string, pkg *models.AppPkg, err error) {
 	// Clone repository to temporary directory
 	gitClient, err := git.NewClient(auth, url, branchName, nil)
 	if err != nil {
@@ -123,7 +180,7 @@ func (pm *PackageManager) LoadPackageFromGit(url, branchName, subPath string, au
 	}
 
 	// Load package from cloned directory
-	appPackage, err := pm.LoadPackageFromDir(dirPath)
+	appPackage, err := pm.LoadPackageFromDir(dirPath, opts...)
 	if err != nil {
 		// Clean up on failure
 		os.RemoveAll(dirPath)
@@ -140,10 +197,15 @@ func (pm *PackageManager) LoadPackageFromGit(url, branchName, subPath string, au
 // both public and private registries through optional authentication.
 //
 // Parameters:
-//   - registryUrl: The OCI registry URL and repository path (e.g., "docker.io/myuser/myapp", "ghcr.io/org/app")
-//   - tag: The tag of the artifact to pull (e.g., "latest", "v1.0.0", "stable")
+//   - registryUrl: The OCI registry host, optionally with a scheme (e.g., "ghcr.io", "http://localhost:5000")
+//   - repository: The repository of the artifact in the registry (e.g., "myuser/myapp")
+//   - tag: The tag of the artifact to pull (e.g., "latest", "v1.0.0", "stable"), or its digest
+//     (e.g., "sha256:<hex>") to pull exactly that artifact
 //   - username: Optional username for registry authentication (can be empty string for public registries)
-//   - token: Optional access token or password for registry authentication (can be empty string for public registries)
+//   - passwordOrToken: Optional access token or password for registry authentication (can be empty string for public registries)
+//   - insecure: Allows plain HTTP and skips the TLS verification, implied by an http:// registryUrl
+//   - timeout: Bounds the whole pull and extraction, 0 for no bound
+//   - opts: Optional LoadOptions to find the application description in the artifact
 //
 // Returns:
 //   - pkgPath: The absolute path to the extracted package directory
@@ -152,7 +214,8 @@ func (pm *PackageManager) LoadPackageFromGit(url, branchName, subPath string, au
 //
 // Important Notes:
 //   - The caller is responsible for cleaning up the returned pkgPath directory
-//   - The OCI artifact must contain a valid margo.yaml file in its root layer
+//   - The OCI artifact must contain a valid margo.yaml file, either as a file pushed with oras or
+//     in the root of a tar layer
 //   - Resources directory is optional and will be loaded if present in the artifact
 //   - Authentication is optional; leave username and token empty for public registries
 //   - The artifact is extracted layer by layer to reconstruct the package structure
@@ -161,10 +224,13 @@ func (pm *PackageManager) LoadPackageFromGit(url, branchName, subPath string, au
 //
 //	pm := NewPackageManager()
 //	pkgPath, pkg, err := pm.LoadPackageFromOci(
-//	    "docker.io/myuser/myapp",
+//	    "ghcr.io",
+//	    "myuser/myapp",
 //	    "v1.0.0",
 //	    "myusername",
 //	    "mytoken",
+//	    false,
+//	    time.Minute,
 //	)
 //	if err != nil {
 //	    log.Fatal(err)
@@ -173,121 +239,111 @@ func (pm *PackageManager) LoadPackageFromGit(url, branchName, subPath string, au
 //
 // Errors:
 //   - Returns error if OCI client initialization fails
+//   - Returns error if tag is a digest that is malformed or of an unsupported algorithm
 //   - Returns error if artifact pull operation fails
 //   - Returns error if temporary directory creation fails
 //   - Returns error if artifact extraction fails
 //   - Returns error if package loading from extracted directory fails
 //   - Returns error if margo.yaml file is missing or invalid in the artifact
-// func (pm *PackageManager) LoadPackageFromOci(registryUrl, repository, tag string, username, passwordOrToken string, insecure bool, timeout time.Duration) (pkgPath string, pkg *models.AppPkg, err error) {
-// 	// Initialize OCI client with authentication
-// 	var ociClient *oci.Client
-// 	if username != "" && passwordOrToken != "" {
-// 		ociClient, err = oci.NewClient(&oci.Config{
-// 			Registry: registryUrl,
-// 			Username: username,
-// 			Password: passwordOrToken,
-// 			Insecure: insecure,
-// 			Timeout:  timeout,
-// 		})
-// 	} else {
-// 		ociClient, err = oci.NewClient(&oci.Config{
-// 			Registry: registryUrl,
-// 			Insecure: insecure,
-// 			Timeout:  timeout,
-// 		})
-// 	}
-
-// 	if err != nil {
-// 		return "", nil, fmt.Errorf("failed to initialize OCI client: %w", err)
-// 	}
-
-// 	// Construct full reference with tag
-// 	reference := fmt.Sprintf("%s/%s:%s", registryUrl, repository, tag)
-
-// 	// Pull the image/artifact from OCI registry
-// 	image, _, err := ociClient.PullImage(context.Background(), reference)
-// 	if err != nil {
-// 		return "", nil, fmt.Errorf("failed to pull OCI artifact from %s: %w", reference, err)
-// 	}
-
-// 	// Create temporary directory for extraction
-// 	tempDir, err := os.MkdirTemp("", "margo-oci-pkg-*")
-// 	if err != nil {
-// 		return "", nil, fmt.Errorf("failed to create temporary directory: %w", err)
-// 	}
-
-// 	// Extract image layers to temporary directory
-// 	if err := extractImageToDir(image, tempDir); err != nil {
-// 		os.RemoveAll(tempDir)
-// 		return "", nil, fmt.Errorf("failed to extract OCI artifact: %w", err)
-// 	}
-
-// 	// Load package from extracted directory
-// 	appPackage, err := pm.LoadPackageFromDir(tempDir)
-// 	if err != nil {
-// 		// Clean up on failure
-// 		os.RemoveAll(tempDir)
-// 		return "", nil, fmt.Errorf("failed to load package from extracted OCI artifact: %w", err)
-// 	}
-
-// 	return tempDir, appPackage, nil
-// }
-
-// LoadPackageFromOci loads an application package from an OCI registry. USING ORAS CLI.
-func (pm *PackageManager) LoadPackageFromOci(registryUrl, repository, tag string, username, passwordOrToken string, insecure bool, timeout time.Duration) (pkgPath string, pkg *models.AppPkg, err error) {
-    // Create temporary directory for extraction
-    tempDir, err := os.MkdirTemp("", "margo-oci-pkg-*")
-    if err != nil {
-        return "", nil, fmt.Errorf("failed to create temporary directory: %w", err)
-    }
-
-    // Strip http:// or https:// from registryUrl for ORAS compatibility
-    cleanRegistryUrl := strings.TrimPrefix(registryUrl, "http://")
-    cleanRegistryUrl = strings.TrimPrefix(cleanRegistryUrl, "https://")
-    
-    // Construct OCI reference (without protocol)
-    reference := fmt.Sprintf("%s/%s:%s", cleanRegistryUrl, repository, tag)
-    
-    // Add authentication if provided
-    if username != "" && passwordOrToken != "" {
-        // Login first (use clean registry URL)
-        loginCmd := exec.Command("oras", "login", cleanRegistryUrl,
-            "-u", username,
-            "-p", passwordOrToken,
-            "--plain-http")
-        if err := loginCmd.Run(); err != nil {
-            os.RemoveAll(tempDir)
-            return "", nil, fmt.Errorf("failed to login to OCI registry: %w", err)
-        }
-    }
-    
-    // Pull artifact to temp directory
-    pullCmd := exec.Command("oras", "pull", reference, "--plain-http")
-    pullCmd.Dir = tempDir
-    output, err := pullCmd.CombinedOutput()
-    if err != nil {
-        os.RemoveAll(tempDir)
-        return "", nil, fmt.Errorf("failed to pull OCI artifact: %w, output: %s", err, string(output))
-    }
-
-    // Load package from extracted directory
-    appPackage, err := pm.LoadPackageFromDir(tempDir)
-    if err != nil {
-        os.RemoveAll(tempDir)
-        return "", nil, fmt.Errorf("failed to load package from extracted OCI artifact: %w", err)
-    }
-
-    return tempDir, appPackage, nil
+func (pm *PackageManager) LoadPackageFromOci(registryUrl, repository, tag string, username, passwordOrToken string, insecure bool, timeout time.Duration, opts ...LoadOptions) (pkgPath string, pkg *models.AppPkg, err error) {
+	ociClient, registry, err := newOciClient(registryUrl, username, passwordOrToken, insecure, timeout)
+	if err != nil {
+		return "", nil, err
+	}
+	defer ociClient.Close()
+
+	// The layers are only fetched while they are extracted, the timeout covers both
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	reference, err := ociReference(registry, repository, tag)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Pull the image/artifact from OCI registry
+	image, _, err := ociClient.PullImage(ctx, reference)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to pull OCI artifact from %s: %w", reference, err)
+	}
+
+	// Create temporary directory for extraction
+	tempDir, err := os.MkdirTemp("", "margo-oci-pkg-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+
+	// Extract image layers to temporary directory
+	if err := extractImageToDir(image, tempDir); err != nil {
+		os.RemoveAll(tempDir)
+		return "", nil, fmt.Errorf("failed to extract OCI artifact %s: %w", reference, err)
+	}
+
+	// Load package from extracted directory
+	appPackage, err := pm.LoadPackageFromDir(tempDir, opts...)
+	if err != nil {
+		// Clean up on failure
+		os.RemoveAll(tempDir)
+		return "", nil, fmt.Errorf("failed to load package from extracted OCI artifact: %w", err)
+	}
+
+	return tempDir, appPackage, nil
 }
 
+// ociReference returns the reference of the artifact, by digest when tag is one, e.g.
+// "sha256:<hex>" or "@sha256:<hex>", and by tag otherwise
+func ociReference(registry, repository, tag string) (string, error) {
+	tag = strings.TrimPrefix(tag, "@")
+	if tag == "" {
+		return "", fmt.Errorf("tag or digest of the OCI artifact cannot be empty")
+	}
+	if !strings.Contains(tag, ":") {
+		return fmt.Sprintf("%s/%s:%s", registry, repository, tag), nil
+	}
+	d, err := digest.ParseVerifiable(tag)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest reference of the OCI artifact: %w", err)
+	}
+	return fmt.Sprintf("%s/%s@%s", registry, repository, d), nil
+}
 
+// newOciClient returns a client of the registry and the registry without its scheme. The scheme only
+// tells whether the registry talks plain HTTP, the client is anonymous unless both credentials are
+// given.
+func newOciClient(registryUrl, username, passwordOrToken string, insecure bool, timeout time.Duration) (*oci.Client, string, error) {
+	registry := strings.TrimPrefix(registryUrl, "https://")
+	if strings.HasPrefix(registry, "http://") {
+		registry = strings.TrimPrefix(registry, "http://")
+		insecure = true
+	}
+	registry = strings.TrimSuffix(registry, "/")
+	if registry == "" {
+		return nil, "", fmt.Errorf("failed to initialize OCI client: registry cannot be empty")
+	}
 
+	ociClient, err := oci.NewClient(&oci.Config{
+		Registry: registry,
+		Username: username,
+		Password: passwordOrToken,
+		Insecure: insecure,
+		Timeout:  timeout,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to initialize OCI client: %w", err)
+	}
+	return ociClient, registry, nil
+}
 
 // extractImageToDir extracts all layers of an OCI image to a directory.
 //
 // This method processes each layer of an OCI image sequentially, extracting
 // the tar archive contents to the destination directory. It handles directories,
 // regular files, and symbolic links, preserving file permissions and structure.
+// Layers of files pushed with oras are written to the file named by their title.
 //
 // Parameters:
 //   - image: The OCI image to extract
@@ -302,6 +358,7 @@ func (pm *PackageManager) LoadPackageFromOci(registryUrl, repository, tag string
 //   - Writes regular files with original permissions
 //   - Creates symbolic links preserving link targets
 //   - Skips special file types (block devices, character devices, etc.)
+//   - Rejects entries and symbolic link targets outside the destination directory
 //
 // Example:
 //
@@ -314,94 +371,262 @@ func (pm *PackageManager) LoadPackageFromOci(registryUrl, repository, tag string
 //   - Returns error if image layers cannot be accessed
 //   - Returns error if layer decompression fails
 //   - Returns error if tar reading fails
+//   - Returns error if an entry or a symbolic link escapes the destination directory, symbolic
+//     links already extracted or present on disk included
 //   - Returns error if directory creation fails
 //   - Returns error if file writing fails
 func extractImageToDir(image v1.Image, destDir string) error {
+	// the entries are checked against the real destination, the symbolic links on disk resolved
+	destDir, err := filepath.EvalSymlinks(destDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the destination directory: %w", err)
+	}
+
 	// Get image layers
 	layers, err := image.Layers()
 	if err != nil {
 		return fmt.Errorf("failed to get image layers: %w", err)
 	}
+	manifest, err := image.Manifest()
+	if err != nil {
+		return fmt.Errorf("failed to get image manifest: %w", err)
+	}
 
 	// Extract each layer
 	for i, layer := range layers {
-		// Get uncompressed layer content
-		layerReader, err := layer.Uncompressed()
+		var annotations map[string]string
+		if i < len(manifest.Layers) {
+			annotations = manifest.Layers[i].Annotations
+		}
+		// oras pushes every file as a layer of its own, directories as a tar.gz to unpack
+		if title := annotations[orasTitleAnnotation]; title != "" && annotations[orasUnpackAnnotation] != "true" {
+			if err := writeLayerFile(i, layer, destDir, title); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := extractTarLayer(i, layer, destDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLayerFile writes the content of a layer pushed as a file to name, the content is written as
+// it is, a compressed file is not decompressed
+func writeLayerFile(i int, layer v1.Layer, destDir, name string) error {
+	targetPath, err := extractTargetPath(destDir, name)
+	if err != nil {
+		return fmt.Errorf("invalid file in layer %d: %w", i, err)
+	}
+	layerReader, err := layer.Compressed()
+	if err != nil {
+		return fmt.Errorf("failed to get layer %d: %w", i, err)
+	}
+	defer layerReader.Close()
+
+	outFile, err := createFileWithin(destDir, targetPath, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", targetPath, err)
+	}
+	defer outFile.Close()
+	if _, err := io.Copy(outFile, layerReader); err != nil {
+		return fmt.Errorf("failed to write file %s: %w", targetPath, err)
+	}
+	return nil
+}
+
+// extractTarLayer extracts the tar archive of a layer to destDir
+func extractTarLayer(i int, layer v1.Layer, destDir string) error {
+	// Get uncompressed layer content
+	layerReader, err := layer.Uncompressed()
+	if err != nil {
+		return fmt.Errorf("failed to get uncompressed layer %d: %w", i, err)
+	}
+	defer layerReader.Close()
+
+	// Create tar reader
+	tarReader := tar.NewReader(layerReader)
+
+	// Extract all files from the layer
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			return fmt.Errorf("failed to get uncompressed layer %d: %w", i, err)
+			return fmt.Errorf("failed to read tar header in layer %d: %w", i, err)
 		}
-		defer layerReader.Close()
 
-		// Create tar reader
-		tarReader := tar.NewReader(layerReader)
+		// Construct target path, a layer must not write outside of destDir
+		targetPath, err := extractTargetPath(destDir, header.Name)
+		if err != nil {
+			return fmt.Errorf("invalid entry in layer %d: %w", i, err)
+		}
 
-		// Extract all files from the layer
-		for {
-			header, err := tarReader.Next()
-			if err == io.EOF {
-				break
+		// Handle different file types
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// Create directory
+			if _, err := mkdirWithin(destDir, targetPath, os.FileMode(header.Mode)); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
 			}
+
+		case tar.TypeReg:
+			// Create and write file, its parent directories are created if needed
+			outFile, err := createFileWithin(destDir, targetPath, os.FileMode(header.Mode))
 			if err != nil {
-				return fmt.Errorf("failed to read tar header in layer %d: %w", i, err)
+				return fmt.Errorf("failed to create file %s: %w", targetPath, err)
 			}
 
-			// Construct target path
-			targetPath := filepath.Join(destDir, header.Name)
-
-			// Handle different file types
-			switch header.Typeflag {
-			case tar.TypeDir:
-				// Create directory
-				if err := os.MkdirAll(targetPath, os.FileMode(header.Mode)); err != nil {
-					return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
-				}
-
-			case tar.TypeReg:
-				// Create parent directory if needed
-				if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-					return fmt.Errorf("failed to create parent directory for %s: %w", targetPath, err)
-				}
-
-				// Create and write file
-				outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
-				if err != nil {
-					return fmt.Errorf("failed to create file %s: %w", targetPath, err)
-				}
-
-				if _, err := io.Copy(outFile, tarReader); err != nil {
-					outFile.Close()
-					return fmt.Errorf("failed to write file %s: %w", targetPath, err)
-				}
+			if _, err := io.Copy(outFile, tarReader); err != nil {
 				outFile.Close()
+				return fmt.Errorf("failed to write file %s: %w", targetPath, err)
+			}
+			outFile.Close()
 
-			case tar.TypeSymlink:
-				// Create parent directory if needed
-				if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-					return fmt.Errorf("failed to create parent directory for symlink %s: %w", targetPath, err)
-				}
-
-				// Create symlink
-				if err := os.Symlink(header.Linkname, targetPath); err != nil {
-					return fmt.Errorf("failed to create symlink %s: %w", targetPath, err)
-				}
+		case tar.TypeSymlink:
+			// Create parent directory if needed
+			parent, err := mkdirWithin(destDir, filepath.Dir(targetPath), 0755)
+			if err != nil {
+				return fmt.Errorf("failed to create parent directory for symlink %s: %w", targetPath, err)
+			}
 
-			default:
-				// Skip other types (block devices, character devices, etc.)
-				continue
+			// Create symlink, it must not point outside of destDir either, it is resolved from the
+			// real directory it is created in
+			linkPath := filepath.Join(parent, filepath.Base(targetPath))
+			if err := checkSymlinkTarget(destDir, linkPath, header.Linkname); err != nil {
+				return fmt.Errorf("invalid entry in layer %d: %w", i, err)
+			}
+			if err := os.Symlink(header.Linkname, linkPath); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %w", targetPath, err)
 			}
+
+		default:
+			// Skip other types (block devices, character devices, etc.)
+			continue
 		}
 	}
 	return nil
 }
 
+// extractTargetPath returns where the entry name of a layer is extracted to, an error when it
+// escapes destDir, e.g. with "../"
+func extractTargetPath(destDir, name string) (string, error) {
+	targetPath := filepath.Join(destDir, name)
+	if !withinDir(destDir, targetPath) {
+		return "", fmt.Errorf("entry %q escapes the destination directory", name)
+	}
+	return targetPath, nil
+}
+
+// checkSymlinkTarget rejects a symbolic link at targetPath whose target is outside destDir, a
+// relative target is resolved against the directory of the link, through the links on disk
+func checkSymlinkTarget(destDir, targetPath, linkname string) error {
+	target := linkname
+	if !filepath.IsAbs(linkname) {
+		// not joined, the .. after a symlink already extracted is resolved on disk
+		target = filepath.Dir(targetPath) + string(os.PathSeparator) + linkname
+	}
+	resolved, err := resolveExisting(target)
+	if err != nil {
+		return fmt.Errorf("symlink %s points to %q that cannot be resolved: %w", targetPath, linkname, err)
+	}
+	if !withinDir(destDir, resolved) {
+		return fmt.Errorf("symlink %s points to %q outside the destination directory", targetPath, linkname)
+	}
+	return nil
+}
+
+// resolveExisting evaluates the symbolic links of path like filepath.EvalSymlinks, the part of
+// path that does not exist yet is appended to its longest existing prefix
+func resolveExisting(path string) (string, error) {
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		i := strings.LastIndex(path, string(os.PathSeparator))
+		if !os.IsNotExist(err) || i <= 0 {
+			return "", err
+		}
+		rest = filepath.Join(path[i+1:], rest)
+		path = path[:i]
+	}
+}
+
+// mkdirWithin creates dir and its missing parents like os.MkdirAll and returns its real path. The
+// symbolic links on the way are followed as long as they stay inside destDir, destDir must be a
+// real path.
+func mkdirWithin(destDir, dir string, perm os.FileMode) (string, error) {
+	rel, err := filepath.Rel(destDir, dir)
+	if err != nil || !withinDir(destDir, dir) {
+		return "", fmt.Errorf("%s is outside the destination directory", dir)
+	}
+	current := destDir
+	if rel == "." {
+		return current, nil
+	}
+	for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(next)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(next, perm); err != nil {
+				return "", err
+			}
+		case err != nil:
+			return "", err
+		case info.Mode()&os.ModeSymlink != 0:
+			resolved, err := filepath.EvalSymlinks(next)
+			if err != nil {
+				return "", err
+			}
+			if !withinDir(destDir, resolved) {
+				return "", fmt.Errorf("%s is a symlink to %s outside the destination directory", next, resolved)
+			}
+			next = resolved
+		case !info.IsDir():
+			return "", fmt.Errorf("%s is not a directory", next)
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// createFileWithin creates or truncates the file at targetPath below destDir, see mkdirWithin. A
+// symbolic link in place of the file is replaced, the file is not written through it.
+func createFileWithin(destDir, targetPath string, perm os.FileMode) (*os.File, error) {
+	parent, err := mkdirWithin(destDir, filepath.Dir(targetPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+	filePath := filepath.Join(parent, filepath.Base(targetPath))
+	if info, err := os.Lstat(filePath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(filePath); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, perm)
+}
+
+// withinDir reports whether path is dir or inside of it
+func withinDir(dir, path string) bool {
+	dir = filepath.Clean(dir)
+	path = filepath.Clean(path)
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
 // LoadPackageFromDir loads an application package from a local directory.
 //
 // This method loads a Margo application package from the specified directory path.
-// It searches for the application description file (margo.yaml), parses it, and
-// loads any associated resources from the resources subdirectory.
+// It searches for the application description file (margo.yaml or margo.yml), parses it, and
+// loads any associated resources from the resources subdirectory next to it.
 //
 // Parameters:
 //   - pkgPath: The absolute or relative path to the package directory
+//   - opts: Optional LoadOptions with other descriptor filenames or an explicit descriptor path
 //
 // Returns:
 //   - *models.AppPkg: The loaded application package with description and resources
@@ -417,10 +642,16 @@ func extractImageToDir(image v1.Image, destDir string) error {
 //	    └── license.txt     // Optional: License file
 //
 // Loading behavior:
-//   - The margo.yaml file is required and must be valid
+//   - The margo.yaml file is required and must be valid, more than one valid candidate is an
+//     *AmbiguousDescriptionError
 //   - The resources directory is optional; if present, all files are loaded
 //   - Resource files are loaded as byte arrays and stored in the package
 //   - Subdirectories within resources are not recursively processed
+//   - With a margo.sha256 checksums manifest in the package root, the description and every
+//     resource must match it, otherwise a *ChecksumError lists the files that do not. Without
+//     one a warning is logged. LoadOptions.SkipChecksums turns the verification off.
+//   - With LoadOptions.ExpectedDigest the ComputePackageDigest of the description must equal it,
+//     otherwise a *digest.IntegrityMismatch is returned
 //
 // Example:
 //
@@ -435,7 +666,8 @@ func extractImageToDir(image v1.Image, destDir string) error {
 //   - Returns error if pkgPath does not exist or is not accessible
 //   - Returns error if margo.yaml file is missing, unreadable, or invalid
 //   - Returns error if resources directory exists but cannot be read
-func (pm *PackageManager) LoadPackageFromDir(pkgPath string) (*models.AppPkg, error) {
+//   - Returns error if LoadOptions.ExpectedDigest is malformed or does not match
+func (pm *PackageManager) LoadPackageFromDir(pkgPath string, opts ...LoadOptions) (*models.AppPkg, error) {
 	// Validate package path exists
 	if _, err := os.Stat(pkgPath); os.IsNotExist(err) {
 		return nil, fmt.Errorf("package directory does not exist: %s", pkgPath)
@@ -443,9 +675,10 @@ func (pm *PackageManager) LoadPackageFromDir(pkgPath string) (*models.AppPkg, er
 
 	// Initialize package with empty resources map
 	pkg := &models.AppPkg{Resources: make(map[string][]byte)}
+	options := loadOptionsOf(opts)
 
 	// Find and load application description
-	descFile, err := pm.findAppDescription(pkgPath)
+	descFile, err := pm.findAppDescription(pkgPath, options)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find application description: %w", err)
 	}
@@ -455,82 +688,136 @@ func (pm *PackageManager) LoadPackageFromDir(pkgPath string) (*models.AppPkg, er
 		return nil, fmt.Errorf("failed to load application description: %w", err)
 	}
 
-	// Load resources if directory exists
-	resourcesPath := filepath.Join(pkgPath, "resources")
+	// Load resources if directory exists, it is kept next to the description
+	resourcesPath := filepath.Join(filepath.Dir(descFile), "resources")
 	if info, err := os.Stat(resourcesPath); err == nil && info.IsDir() {
 		if err := pm.loadAppResources(resourcesPath, pkg.Resources); err != nil {
 			return nil, fmt.Errorf("failed to load resources: %w", err)
 		}
 	}
 
+	if !options.SkipChecksums {
+		if err := pm.verifyPackageChecksums(pkgPath, descFile, resourcesPath, pkg.Resources); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.ExpectedDigest != "" {
+		if err := verifyPackageDigest(pkg, options.ExpectedDigest); err != nil {
+			return nil, fmt.Errorf("application description %s failed digest verification: %w", descFile, err)
+		}
+	}
+
 	return pkg, nil
 }
 
-// findAppDescription finds the application description file in the package root directory.
+// verifyPackageChecksums verifies the description and the loaded resources against the checksums
+// manifest of the package, see verifyChecksums
+func (pm *PackageManager) verifyPackageChecksums(pkgPath, descFile, resourcesPath string, resources map[string][]byte) error {
+	descData, err := os.ReadFile(descFile)
+	if err != nil {
+		return fmt.Errorf("failed to read application description %s: %w", descFile, err)
+	}
+	descRel, err := filepath.Rel(pkgPath, descFile)
+	if err != nil {
+		return fmt.Errorf("failed to calculate relative path for %s: %w", descFile, err)
+	}
+	resourcesRel, err := filepath.Rel(pkgPath, resourcesPath)
+	if err != nil {
+		return fmt.Errorf("failed to calculate relative path for %s: %w", resourcesPath, err)
+	}
+
+	files := map[string][]byte{filepath.ToSlash(descRel): descData}
+	for name, content := range resources {
+		files[filepath.ToSlash(filepath.Join(resourcesRel, name))] = content
+	}
+	return verifyChecksums(pkgPath, files)
+}
+
+// findAppDescription finds the application description file of a package.
 //
 // Parameters:
 //   - pkgPath: The absolute or relative path to the package directory to search
+//   - options: The accepted filenames, or the explicit descriptor path
 //
 // Returns:
-//   - string: The absolute path to the valid application description file
-//   - error: An error if no valid application description file is found or if directory traversal fails
+//   - string: The path to the valid application description file
+//   - error: An error if no single valid application description file is found
 //
 // Search behavior:
-//   - Only searches files in the root directory (not subdirectories)
-//   - Looks for files matching the expected filename (case-insensitive)
+//   - An explicit descriptor path is used as is, it must contain 'kind: ApplicationDescription'
+//   - Otherwise only the files in the root directory are considered (not subdirectories)
+//   - Looks for files matching one of the accepted filenames (case-insensitive)
 //   - Validates that found files contain 'kind: ApplicationDescription'
-//   - Returns the first valid application description file found
+//   - More than one valid file, e.g. margo.yaml next to margo.yml, is an *AmbiguousDescriptionError
 //
 // Example:
 //
-//	descPath, err := pm.findAppDescription("/path/to/package")
+//	descPath, err := pm.findAppDescription("/path/to/package", loadOptionsOf(nil))
 //	if err != nil {
 //	    log.Fatal("No valid application description found:", err)
 //	}
 //
 // Errors:
-//   - Returns error if directory traversal fails
+//   - Returns error if the explicit descriptor path leaves the package or is not a valid description
+//   - Returns error if the root directory cannot be read
 //   - Returns error if no ApplicationDescription file is found in package root
-func (pm *PackageManager) findAppDescription(pkgPath string) (string, error) {
-	var candidates []string
-
-	// Walk only the root directory to find application description files
-	err := filepath.Walk(pkgPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return fmt.Errorf("failed to access path %s: %w", path, err)
-		}
-
-		// Skip directories
-		if info.IsDir() {
-			return nil
+//   - Returns *AmbiguousDescriptionError if several are found
+func (pm *PackageManager) findAppDescription(pkgPath string, options LoadOptions) (string, error) {
+	if options.DescriptorPath != "" {
+		descriptorPath := filepath.FromSlash(options.DescriptorPath)
+		if !filepath.IsLocal(descriptorPath) {
+			return "", fmt.Errorf("descriptor path %s must be relative to the package root and stay within it", options.DescriptorPath)
 		}
-
-		// Only check files in the root directory
-		if filepath.Dir(path) != pkgPath {
-			return nil
+		descFile := filepath.Join(pkgPath, descriptorPath)
+		if info, err := os.Stat(descFile); err != nil || info.IsDir() {
+			return "", fmt.Errorf("descriptor path %s not found in package: %s", options.DescriptorPath, pkgPath)
 		}
-
-		// Check for expected application description filename (case-insensitive)
-		if strings.EqualFold(info.Name(), ExpectedApplicationDescriptionFileName) {
-			candidates = append(candidates, path)
+		if !pm.isValidAppDescription(descFile) {
+			return "", fmt.Errorf("descriptor path %s is not a valid ApplicationDescription file", options.DescriptorPath)
 		}
+		return descFile, nil
+	}
 
-		return nil
-	})
-
+	entries, err := os.ReadDir(pkgPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to search package directory: %w", err)
 	}
 
 	// Validate each candidate file contains ApplicationDescription
-	for _, candidate := range candidates {
+	var found []string
+	for _, entry := range entries {
+		if entry.IsDir() || !matchesAnyFold(entry.Name(), options.DescriptorFileNames) {
+			continue
+		}
+		candidate := filepath.Join(pkgPath, entry.Name())
 		if pm.isValidAppDescription(candidate) {
-			return candidate, nil
+			found = append(found, candidate)
 		}
 	}
 
-	return "", fmt.Errorf("no valid ApplicationDescription file (%s) found in package root: %s",
-		ExpectedApplicationDescriptionFileName, pkgPath)
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no valid ApplicationDescription file (%s) found in package root: %s",
+			strings.Join(options.DescriptorFileNames, ", "), pkgPath)
+	case 1:
+		return found[0], nil
+	}
+	names := make([]string, 0, len(found))
+	for _, candidate := range found {
+		names = append(names, filepath.Base(candidate))
+	}
+	return "", &AmbiguousDescriptionError{PkgPath: pkgPath, Candidates: names}
+}
+
+// matchesAnyFold reports whether name equals one of the names, ignoring case
+func matchesAnyFold(name string, names []string) bool {
+	for _, candidate := range names {
+		if strings.EqualFold(name, candidate) {
+			return true
+		}
+	}
+	return false
 }
 
 // isValidAppDescription checks if a YAML file contains a valid ApplicationDescription.
@@ -591,8 +878,8 @@ func (pm *PackageManager) isValidAppDescription(filePath string) bool {
 // Loading process:
 //   - Opens the file for reading
 //   - Uses models.ParseApplicationDescription with YAML format
+//   - Validates it with models.ValidateApplicationDescription
 //   - Returns structured ApplicationDescription object
-//   - Future: Will include validation of required fields
 //
 // Example:
 //
@@ -606,7 +893,7 @@ func (pm *PackageManager) isValidAppDescription(filePath string) bool {
 //   - Returns error if file cannot be opened or read
 //   - Returns error if YAML parsing fails
 //   - Returns error if application description format is invalid
-//   - Future: Will return validation errors for missing required fields
+//   - Returns models.ValidationErrors listing every problem of an invalid description
 func (pm *PackageManager) loadAppDescription(filePath string) (*nbi.AppDescription, error) {
 	// Open file for reading
 	reader, err := os.Open(filePath)
@@ -621,11 +908,10 @@ func (pm *PackageManager) loadAppDescription(filePath string) (*nbi.AppDescripti
 		return nil, fmt.Errorf("failed to parse application description from %s: %w", filePath, err)
 	}
 
-	// TODO: Add comprehensive validation
-	// Validate required fields and structure
-	// if err := pm.validateApplicationDescription(&desc); err != nil {
-	// 	return nil, fmt.Errorf("application description validation failed: %w", err)
-	// }
+	// whether the dependencies are onboarded is up to the WFM, a malformed declaration is rejected here
+	if err := models.ValidateApplicationDescription(desc); err != nil {
+		return nil, fmt.Errorf("invalid application description %s: %w", filePath, err)
+	}
 
 	return &desc, nil
 }
@@ -704,6 +990,7 @@ func (pm *PackageManager) loadAppResources(resourcesPath string, resources map[s
 //   - desc: The application description to write as margo.yaml
 //   - resources: A map of resource files (key: relative path, value: file content)
 //   - outputPath: The directory path where the package should be created
+//   - opts: Optional CreateOptions, WriteChecksums adds the margo.sha256 checksums manifest
 //
 // Returns:
 //   - error: An error if package creation fails at any step
@@ -722,7 +1009,8 @@ func (pm *PackageManager) loadAppResources(resourcesPath string, resources map[s
 //   - Writes application description as YAML to margo.yaml
 //   - Creates resources directory only if resources are provided
 //   - Creates subdirectories for resources as needed
-//   - Overwrites existing files if they exist
+//   - Overwrites existing files if they exist, each file is replaced atomically so a crash
+//     leaves either the previous or the new content
 //
 // Example:
 //
@@ -742,20 +1030,25 @@ func (pm *PackageManager) loadAppResources(resourcesPath string, resources map[s
 //   - Returns error if margo.yaml file cannot be written
 //   - Returns error if resources directory cannot be created
 //   - Returns error if any resource file cannot be written
-func (pm *PackageManager) CreatePackage(desc nbi.AppDescription, resources map[string][]byte, outputPath string) error {
+func (pm *PackageManager) CreatePackage(desc nbi.AppDescription, resources map[string][]byte, outputPath string, opts ...CreateOptions) error {
 	// Create package directory
 	if err := os.MkdirAll(outputPath, 0755); err != nil {
 		return fmt.Errorf("failed to create package directory %s: %w", outputPath, err)
 	}
 
+	// Remove what an earlier, interrupted creation of the package left behind
+	if _, err := file.RemoveStaleTemps(outputPath); err != nil {
+		return fmt.Errorf("failed to clean up package directory %s: %w", outputPath, err)
+	}
+
 	// Write application description
-	descData, err := yaml.Marshal(desc)
+	descData, err := models.MarshalApplicationDescription(desc, models.ApplicationDescriptionFormatYAML)
 	if err != nil {
 		return fmt.Errorf("failed to marshal application description: %w", err)
 	}
 
 	descFile := filepath.Join(outputPath, ExpectedApplicationDescriptionFileName)
-	if err := os.WriteFile(descFile, descData, 0644); err != nil {
+	if err := file.WriteFileAtomic(descFile, descData, 0644); err != nil {
 		return fmt.Errorf("failed to write application description to %s: %w", descFile, err)
 	}
 
@@ -776,15 +1069,32 @@ func (pm *PackageManager) CreatePackage(desc nbi.AppDescription, resources map[s
 				return fmt.Errorf("failed to create resource subdirectory %s: %w", resourceDir, err)
 			}
 
-			if err := os.WriteFile(resourcePath, content, 0644); err != nil {
+			if err := file.WriteFileAtomic(resourcePath, content, 0644); err != nil {
 				return fmt.Errorf("failed to write resource file %s: %w", filename, err)
 			}
 		}
 	}
 
+	if createOptionsOf(opts).WriteChecksums {
+		checksumsFile := filepath.Join(outputPath, ChecksumsFileName)
+		if err := file.WriteFileAtomic(checksumsFile, packageChecksums(descData, resources), 0644); err != nil {
+			return fmt.Errorf("failed to write checksums to %s: %w", checksumsFile, err)
+		}
+	}
+
 	return nil
 }
 
+// packageChecksums returns the checksums manifest of a package created from the description and
+// the resources
+func packageChecksums(descData []byte, resources map[string][]byte) []byte {
+	files := map[string][]byte{ExpectedApplicationDescriptionFileName: descData}
+	for filename, content := range resources {
+		files[path.Join("resources", filepath.ToSlash(filename))] = content
+	}
+	return checksumsManifest(files)
+}
+
 // PackageToTarball creates a compressed tarball (.tar.gz) from an application package.
 //
 // This method creates a gzip-compressed tar archive containing the application description
@@ -795,6 +1105,7 @@ func (pm *PackageManager) CreatePackage(desc nbi.AppDescription, resources map[s
 // Parameters:
 //   - pkg: The application package to archive
 //   - outputPath: The file path where the tarball should be created (should end with .tar.gz)
+//   - opts: Optional CreateOptions, WriteChecksums adds the margo.sha256 checksums manifest
 //
 // Returns:
 //   - error: An error if tarball creation fails at any step
@@ -827,63 +1138,259 @@ func (pm *PackageManager) CreatePackage(desc nbi.AppDescription, resources map[s
 //   - Returns error if tar header writing fails
 //   - Returns error if file content writing fails
 //
-// Note: The caller should ensure the output directory exists and is writable.
-func (pm *PackageManager) PackageToTarball(pkg *models.AppPkg, outputPath string) error {
-	// Create output file
-	file, err := os.Create(outputPath)
+// Note: The caller should ensure the output directory exists and is writable. The tarball is
+// written to a temp file next to outputPath and only replaces it once complete.
+func (pm *PackageManager) PackageToTarball(pkg *models.AppPkg, outputPath string, opts ...CreateOptions) error {
+	if pkg == nil || pkg.Description == nil {
+		return fmt.Errorf("package has no application description")
+	}
+
+	// Add application description
+	descData, err := models.MarshalApplicationDescription(*pkg.Description, models.ApplicationDescriptionFormatYAML)
 	if err != nil {
-		return fmt.Errorf("failed to create tarball file %s: %w", outputPath, err)
+		return fmt.Errorf("failed to marshal application description: %w", err)
 	}
-	defer file.Close()
 
-	// Create gzip writer
-	gzWriter := gzip.NewWriter(file)
-	defer gzWriter.Close()
+	// Remove what an earlier, interrupted creation of the tarball left behind
+	if _, err := file.RemoveStaleTempsOf(outputPath); err != nil {
+		return fmt.Errorf("failed to clean up tarball file %s: %w", outputPath, err)
+	}
 
-	// Create tar writer
-	tarWriter := tar.NewWriter(gzWriter)
-	defer tarWriter.Close()
+	// The tarball replaces outputPath only once it is complete
+	return file.WriteAtomic(outputPath, 0644, func(w io.Writer) error {
+		// Create gzip writer
+		gzWriter := gzip.NewWriter(w)
 
-	// Add application description
-	descData, err := yaml.Marshal(pkg.Description)
+		// Create tar writer
+		tarWriter := tar.NewWriter(gzWriter)
+
+		descHeader := &tar.Header{
+			Name: ExpectedApplicationDescriptionFileName,
+			Mode: 0644,
+			Size: int64(len(descData)),
+		}
+
+		if err := tarWriter.WriteHeader(descHeader); err != nil {
+			return fmt.Errorf("failed to write application description header: %w", err)
+		}
+
+		if _, err := tarWriter.Write(descData); err != nil {
+			return fmt.Errorf("failed to write application description content: %w", err)
+		}
+
+		// Add resources
+		for filename, content := range pkg.Resources {
+			resourceHeader := &tar.Header{
+				Name: filepath.Join("resources", filename),
+				Mode: 0644,
+				Size: int64(len(content)),
+			}
+
+			if err := tarWriter.WriteHeader(resourceHeader); err != nil {
+				return fmt.Errorf("failed to write resource header for %s: %w", filename, err)
+			}
+
+			if _, err := tarWriter.Write(content); err != nil {
+				return fmt.Errorf("failed to write resource content for %s: %w", filename, err)
+			}
+		}
+
+		if createOptionsOf(opts).WriteChecksums {
+			checksums := packageChecksums(descData, pkg.Resources)
+			checksumsHeader := &tar.Header{
+				Name: ChecksumsFileName,
+				Mode: 0644,
+				Size: int64(len(checksums)),
+			}
+			if err := tarWriter.WriteHeader(checksumsHeader); err != nil {
+				return fmt.Errorf("failed to write checksums header: %w", err)
+			}
+			if _, err := tarWriter.Write(checksums); err != nil {
+				return fmt.Errorf("failed to write checksums content: %w", err)
+			}
+		}
+
+		if err := tarWriter.Close(); err != nil {
+			return fmt.Errorf("failed to finish tarball %s: %w", outputPath, err)
+		}
+		if err := gzWriter.Close(); err != nil {
+			return fmt.Errorf("failed to finish tarball %s: %w", outputPath, err)
+		}
+		return nil
+	})
+}
+
+// MaxTarballSize caps the total uncompressed size of the files LoadPackageFromTarball extracts, so
+// a small compressed tarball cannot fill the disk
+var MaxTarballSize int64 = 512 << 20
+
+// LoadPackageFromTarball loads an application package from a compressed tarball (.tar.gz), the
+// inverse of PackageToTarball.
+//
+// The tarball is extracted to a temporary directory which is loaded with LoadPackageFromDir, so the
+// description is found, parsed and validated and the checksums are verified the same way, and which
+// is removed again before returning.
+//
+// Parameters:
+//   - tarballPath: Path of the .tar.gz file holding the package
+//   - opts: Optional LoadOptions, see LoadPackageFromDir
+//
+// Returns:
+//   - *models.AppPkg: The loaded application package with description and resources
+//   - error: An error if the tarball cannot be extracted or the package cannot be loaded
+//
+// Errors:
+//   - Returns error if the tarball cannot be opened or is not a gzip compressed tar archive
+//   - Returns error if an entry escapes the package root, e.g. with "../"
+//   - Returns error if an entry is neither a regular file nor a directory
+//   - Returns error if the uncompressed files exceed MaxTarballSize
+//   - Returns error if the extracted package cannot be loaded
+func (pm *PackageManager) LoadPackageFromTarball(tarballPath string, opts ...LoadOptions) (*models.AppPkg, error) {
+	pkgPath, err := os.MkdirTemp("", "margo-pkg-")
 	if err != nil {
-		return fmt.Errorf("failed to marshal application description: %w", err)
+		return nil, fmt.Errorf("failed to create temporary package directory: %w", err)
 	}
+	defer os.RemoveAll(pkgPath)
 
-	descHeader := &tar.Header{
-		Name: ExpectedApplicationDescriptionFileName,
-		Mode: 0644,
-		Size: int64(len(descData)),
+	if err := extractTarball(tarballPath, pkgPath, MaxTarballSize); err != nil {
+		return nil, err
 	}
+	return pm.LoadPackageFromDir(pkgPath, opts...)
+}
 
-	if err := tarWriter.WriteHeader(descHeader); err != nil {
-		return fmt.Errorf("failed to write application description header: %w", err)
+// extractTarball extracts the regular files and directories of a .tar.gz file to destDir, at most
+// maxSize bytes of them
+func extractTarball(tarballPath, destDir string, maxSize int64) error {
+	f, err := os.Open(tarballPath)
+	if err != nil {
+		return fmt.Errorf("failed to open tarball %s: %w", tarballPath, err)
 	}
+	defer f.Close()
 
-	if _, err := tarWriter.Write(descData); err != nil {
-		return fmt.Errorf("failed to write application description content: %w", err)
+	gzReader, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read tarball %s: %w", tarballPath, err)
 	}
+	defer gzReader.Close()
 
-	// Add resources
-	for filename, content := range pkg.Resources {
-		resourceHeader := &tar.Header{
-			Name: filepath.Join("resources", filename),
-			Mode: 0644,
-			Size: int64(len(content)),
+	tarReader := tar.NewReader(gzReader)
+	remaining := maxSize
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header in %s: %w", tarballPath, err)
 		}
 
-		if err := tarWriter.WriteHeader(resourceHeader); err != nil {
-			return fmt.Errorf("failed to write resource header for %s: %w", filename, err)
+		targetPath, err := extractTargetPath(destDir, header.Name)
+		if err != nil {
+			return fmt.Errorf("invalid entry in tarball %s: %w", tarballPath, err)
 		}
 
-		if _, err := tarWriter.Write(content); err != nil {
-			return fmt.Errorf("failed to write resource content for %s: %w", filename, err)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(targetPath, 0755); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+				return fmt.Errorf("failed to create parent directory for %s: %w", targetPath, err)
+			}
+			outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to create file %s: %w", targetPath, err)
+			}
+			// the size of the header is not trusted, the content is counted as it is written
+			written, err := io.Copy(outFile, io.LimitReader(tarReader, remaining+1))
+			outFile.Close()
+			if err != nil {
+				return fmt.Errorf("failed to write file %s: %w", targetPath, err)
+			}
+			remaining -= written
+			if remaining < 0 {
+				return fmt.Errorf("tarball %s exceeds the maximum uncompressed size of %d bytes", tarballPath, maxSize)
+			}
+
+		default:
+			return fmt.Errorf("invalid entry in tarball %s: %q is not a regular file or directory", tarballPath, header.Name)
 		}
 	}
+}
 
-	return nil
+// ComputePackageDigest returns the "sha256:<hex>" digest of the canonical YAML encoding of the
+// application description of the package, the one CreatePackage writes. It does not depend on how
+// the description file was formatted, so it can be computed ahead of time from the description
+// alone and passed as LoadOptions.ExpectedDigest. The resources are not part of it, see
+// PackageDigest for the digest of the whole package.
+//
+// Returns "" when the package has no description or it cannot be encoded.
+func ComputePackageDigest(pkg *models.AppPkg) string {
+	if pkg == nil || pkg.Description == nil {
+		return ""
+	}
+	descData, err := models.MarshalApplicationDescription(*pkg.Description, models.ApplicationDescriptionFormatYAML)
+	if err != nil {
+		return ""
+	}
+	return digest.FromBytes(descData).String()
 }
 
-func (pm *PackageManager) checkPkgUpdates(pkg *models.AppPkg) error {
-	return nil
+// verifyPackageDigest checks the description of the package against the expected digest
+func verifyPackageDigest(pkg *models.AppPkg, expected string) error {
+	expectedDigest, err := digest.ParseVerifiable(expected)
+	if err != nil {
+		return err
+	}
+	descData, err := models.MarshalApplicationDescription(*pkg.Description, models.ApplicationDescriptionFormatYAML)
+	if err != nil {
+		return fmt.Errorf("failed to marshal application description: %w", err)
+	}
+	return expectedDigest.Verify(descData)
+}
+
+// PackageDigest computes the content digest of an application package.
+//
+// The digest is the sha256 of a deterministic tarball of the package (sorted entries, fixed
+// timestamps), so the same description and resources always produce the same digest regardless
+// of where the package was loaded from. It is the value the WFM reports as the package digest,
+// which lets a client compare a package it onboarded from a source it controls against the
+// server's view of it.
+//
+// Parameters:
+//   - pkg: The application package to digest
+//
+// Returns:
+//   - string: The digest in the form "sha256:<hex>"
+//   - error: An error if the package has no description or the tarball cannot be created
+func (pm *PackageManager) PackageDigest(pkg *models.AppPkg) (string, error) {
+	if pkg == nil || pkg.Description == nil {
+		return "", fmt.Errorf("package has no application description")
+	}
+
+	descData, err := yaml.Marshal(pkg.Description)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal application description: %w", err)
+	}
+
+	archiver := archive.NewArchiver(archive.ArchiveFormatTarGZ)
+	if _, _, err := archiver.AppendContent(descData, ExpectedApplicationDescriptionFileName); err != nil {
+		return "", fmt.Errorf("failed to add application description: %w", err)
+	}
+	for filename, content := range pkg.Resources {
+		if _, _, err := archiver.AppendContent(content, filepath.Join("resources", filename)); err != nil {
+			return "", fmt.Errorf("failed to add resource %s: %w", filename, err)
+		}
+	}
+
+	archiveFile, digest, _, _, err := archiver.CreateArchive()
+	if err != nil {
+		return "", fmt.Errorf("failed to create package tarball: %w", err)
+	}
+	archiveFile.Close()
+	defer archiver.Cleanup()
+
+	return digest, nil
 }
@@ -1,44 +1,152 @@
 package packageManager
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+	"github.com/margo/sandbox/non-standard/pkg/models"
+	"github.com/margo/sandbox/shared-lib/dependency"
+	"github.com/margo/sandbox/shared-lib/digest"
+	"github.com/margo/sandbox/shared-lib/file"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-// TestLoadPackageFromOci_Success tests successful package loading from OCI registry
-// Note: This test requires a real OCI registry or mock implementation
-// TODO: Introduce mock OCI registry for isolated testing
+// newTestRegistry starts an in-memory OCI registry, with basic authentication when username is set
+func newTestRegistry(t *testing.T, username, password string) string {
+	t.Helper()
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); username != "" && (!ok || user != username || pass != password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// pushTestArtifact pushes image to the registry as repository:tag
+func pushTestArtifact(t *testing.T, registryURL, repository, tag string, image v1.Image, auth authn.Authenticator) {
+	t.Helper()
+	ref, err := name.ParseReference(fmt.Sprintf("%s/%s:%s", strings.TrimPrefix(registryURL, "http://"), repository, tag), name.Insecure)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, image, remote.WithAuth(auth)))
+}
+
+// orasArtifact returns an artifact like oras pushes it, every file in a layer of its own
+func orasArtifact(t *testing.T, files map[string]string) v1.Image {
+	t.Helper()
+	image := empty.Image
+	for name, content := range files {
+		var err error
+		image, err = mutate.Append(image, mutate.Addendum{
+			Layer:       static.NewLayer([]byte(content), "application/vnd.oci.image.layer.v1.tar"),
+			Annotations: map[string]string{orasTitleAnnotation: name},
+		})
+		require.NoError(t, err)
+	}
+	return image
+}
+
+// TestLoadPackageFromOci_Success loads a package pushed with oras from a local registry
 func TestLoadPackageFromOci_Success(t *testing.T) {
-	t.Skip("Skipping integration test - requires OCI registry setup or mocks")
+	registryURL := newTestRegistry(t, "", "")
+	// a compressed file is kept as it is
+	chart := string([]byte{0x1f, 0x8b, 0x08, 0x00})
+	pushTestArtifact(t, registryURL, "acme/app", "1.0.0", orasArtifact(t, map[string]string{
+		"margo.yaml":          testDescription,
+		"resources/readme.md": "readme",
+		"resources/chart.tgz": chart,
+	}), authn.Anonymous)
 
 	pm := NewPackageManager()
-	pkgPath, pkg, err := pm.LoadPackageFromOci(
-		"docker.io",
-		"testuser/testapp",
-		"v1.0.0",
-		"testuser",
-		"testtoken",
-		false,
-		time.Second*30,
-	)
-
+	pkgPath, pkg, err := pm.LoadPackageFromOci(registryURL, "acme/app", "1.0.0", "", "", false, time.Second*30)
 	require.NoError(t, err)
 	require.NotNil(t, pkg)
-	require.NotEmpty(t, pkgPath)
 	defer os.RemoveAll(pkgPath) // Cleanup temporary directory
 
-	// Verify package path exists
-	_, err = os.Stat(pkgPath)
-	assert.NoError(t, err, "package path should exist")
+	assert.Equal(t, "app", pkg.Description.Metadata.Id)
+	assert.Equal(t, "1.0.0", pkg.Description.Metadata.Version)
+	assert.Equal(t, []byte("readme"), pkg.Resources["readme.md"])
+	assert.Equal(t, []byte(chart), pkg.Resources["chart.tgz"])
 
-	// Verify package content
-	assert.NotNil(t, pkg.Description)
-	assert.NotEmpty(t, pkg.Description.Metadata.Name)
-	assert.NotEmpty(t, pkg.Description.Metadata.Version)
+	_, _, err = pm.LoadPackageFromOci(registryURL, "acme/app", "2.0.0", "", "", false, time.Second*30)
+	assert.ErrorContains(t, err, "failed to pull OCI artifact")
+}
+
+func TestLoadPackageFromOci_DigestReference(t *testing.T) {
+	registryURL := newTestRegistry(t, "", "")
+	image := orasArtifact(t, map[string]string{"margo.yaml": testDescription})
+	pushTestArtifact(t, registryURL, "acme/app", "1.0.0", image, authn.Anonymous)
+	imageDigest, err := image.Digest()
+	require.NoError(t, err)
+
+	pm := NewPackageManager()
+	for _, reference := range []string{imageDigest.String(), "@" + imageDigest.String()} {
+		pkgPath, pkg, err := pm.LoadPackageFromOci(registryURL, "acme/app", reference, "", "", false, time.Second*30)
+		require.NoError(t, err, reference)
+		assert.Equal(t, "app", pkg.Description.Metadata.Id)
+		os.RemoveAll(pkgPath)
+	}
+
+	_, _, err = pm.LoadPackageFromOci(registryURL, "acme/app", "sha256:"+strings.Repeat("0", 64), "", "", false, time.Second*30)
+	assert.ErrorContains(t, err, "failed to pull OCI artifact")
+	_, _, err = pm.LoadPackageFromOci(registryURL, "acme/app", "sha256:abc", "", "", false, time.Second*30)
+	assert.ErrorIs(t, err, digest.ErrInvalid)
+
+	// an artifact without an application description is not a package
+	pushTestArtifact(t, registryURL, "acme/empty", "1.0.0", orasArtifact(t, map[string]string{"readme.md": "readme"}), authn.Anonymous)
+	pkgPath, _, err := pm.LoadPackageFromOci(registryURL, "acme/empty", "1.0.0", "", "", false, time.Second*30)
+	assert.ErrorContains(t, err, "failed to find application description")
+	assert.Empty(t, pkgPath)
+}
+
+func TestLoadPackageFromOci_BasicAuth(t *testing.T) {
+	registryURL := newTestRegistry(t, "deployer", "s3cret")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "margo.yaml", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(testDescription))}))
+	_, err := tw.Write([]byte(testDescription))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	image, err := mutate.AppendLayers(empty.Image, static.NewLayer(buf.Bytes(), types.OCIUncompressedLayer))
+	require.NoError(t, err)
+	pushTestArtifact(t, registryURL, "acme/private", "1.0.0", image, &authn.Basic{Username: "deployer", Password: "s3cret"})
+
+	pm := NewPackageManager()
+	pkgPath, pkg, err := pm.LoadPackageFromOci(registryURL, "acme/private", "1.0.0", "deployer", "s3cret", false, time.Second*30)
+	require.NoError(t, err)
+	defer os.RemoveAll(pkgPath)
+	assert.Equal(t, "app", pkg.Description.Metadata.Id)
+
+	_, _, err = pm.LoadPackageFromOci(registryURL, "acme/private", "1.0.0", "", "", false, time.Second*30)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401 Unauthorized")
 }
 
 // TestLoadPackageFromOci_InvalidRegistry tests error handling for invalid registry
@@ -84,3 +192,635 @@ func TestLoadPackageFromOci_CleanupOnFailure(t *testing.T) {
 	// Verify no temporary directories are left behind
 	// This would be properly tested with mocks
 }
+
+func TestPackageDigest(t *testing.T) {
+	pm := NewPackageManager()
+	newPkg := func(readme string) *models.AppPkg {
+		return &models.AppPkg{
+			Description: &nbi.AppDescription{ApiVersion: "margo.org/v1-alpha1", Kind: "ApplicationDescription"},
+			Resources: map[string][]byte{
+				"readme.md": []byte(readme),
+				"icon.png":  []byte("icon"),
+			},
+		}
+	}
+
+	digest, err := pm.PackageDigest(newPkg("hello"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(digest, "sha256:"))
+
+	// map iteration order and load time must not change the digest
+	again, err := pm.PackageDigest(newPkg("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, digest, again)
+
+	changed, err := pm.PackageDigest(newPkg("hello, world"))
+	require.NoError(t, err)
+	assert.NotEqual(t, digest, changed)
+
+	_, err = pm.PackageDigest(&models.AppPkg{})
+	assert.Error(t, err)
+}
+
+// crashBeforeRename fails every atomic write between writing the temp file and renaming it,
+// the temp files seen are returned
+func crashBeforeRename(t *testing.T) *[]string {
+	t.Helper()
+	var temps []string
+	restore := file.SetBeforeRenameHook(func(tempPath, finalPath string) error {
+		temps = append(temps, tempPath)
+		return errors.New("simulated crash")
+	})
+	t.Cleanup(restore)
+	return &temps
+}
+
+func newTestPkg(version string) *models.AppPkg {
+	return &models.AppPkg{
+		Description: &nbi.AppDescription{ApiVersion: "margo.org/v1-alpha1", Kind: "ApplicationDescription",
+			Metadata: nbi.AppDescriptionMetadata{Id: "app", Name: "app", Version: version}},
+		Resources: map[string][]byte{"readme.md": []byte("readme " + version)},
+	}
+}
+
+func TestCreatePackage_CrashBeforeRename(t *testing.T) {
+	pm := NewPackageManager()
+	outputPath := t.TempDir()
+	require.NoError(t, pm.CreatePackage(*newTestPkg("1.0.0").Description, newTestPkg("1.0.0").Resources, outputPath))
+
+	temps := crashBeforeRename(t)
+	next := newTestPkg("2.0.0")
+	require.Error(t, pm.CreatePackage(*next.Description, next.Resources, outputPath))
+
+	descData, err := os.ReadFile(filepath.Join(outputPath, ExpectedApplicationDescriptionFileName))
+	require.NoError(t, err)
+	assert.Contains(t, string(descData), "1.0.0", "the previous description survives")
+	readme, err := os.ReadFile(filepath.Join(outputPath, "resources", "readme.md"))
+	require.NoError(t, err)
+	assert.Equal(t, "readme 1.0.0", string(readme))
+	require.NotEmpty(t, *temps)
+	for _, temp := range *temps {
+		assert.NoFileExists(t, temp)
+	}
+}
+
+func TestCreatePackage_RemovesStaleTemps(t *testing.T) {
+	pm := NewPackageManager()
+	outputPath := t.TempDir()
+	stale := filepath.Join(outputPath, "."+ExpectedApplicationDescriptionFileName+".123"+file.TempSuffix)
+	require.NoError(t, os.WriteFile(stale, []byte("apiVers"), 0644))
+
+	pkg := newTestPkg("1.0.0")
+	require.NoError(t, pm.CreatePackage(*pkg.Description, pkg.Resources, outputPath))
+	assert.NoFileExists(t, stale)
+}
+
+func TestPackageToTarball_CrashBeforeRename(t *testing.T) {
+	pm := NewPackageManager()
+	tarball := filepath.Join(t.TempDir(), "app.tar.gz")
+	require.NoError(t, pm.PackageToTarball(newTestPkg("1.0.0"), tarball))
+	good, err := os.ReadFile(tarball)
+	require.NoError(t, err)
+
+	temps := crashBeforeRename(t)
+	require.Error(t, pm.PackageToTarball(newTestPkg("2.0.0"), tarball))
+
+	current, err := os.ReadFile(tarball)
+	require.NoError(t, err)
+	assert.Equal(t, good, current, "the previous tarball survives")
+	require.Len(t, *temps, 1)
+	assert.NoFileExists(t, (*temps)[0])
+}
+
+func TestPackageToTarball_RemovesStaleTemps(t *testing.T) {
+	pm := NewPackageManager()
+	tarball := filepath.Join(t.TempDir(), "app.tar.gz")
+	stale := filepath.Join(filepath.Dir(tarball), ".app.tar.gz.123"+file.TempSuffix)
+	require.NoError(t, os.WriteFile(stale, []byte{0x1f, 0x8b}, 0644))
+
+	require.NoError(t, pm.PackageToTarball(newTestPkg("1.0.0"), tarball))
+	assert.NoFileExists(t, stale)
+	assert.FileExists(t, tarball)
+}
+
+const testDescription = `apiVersion: margo.org/v1-alpha1
+kind: ApplicationDescription
+metadata:
+  id: app
+  name: app
+  version: 1.0.0
+deploymentProfiles:
+  - type: compose
+    components:
+      - name: app
+        properties:
+          packageLocation: https://example.com/compose.yaml
+`
+
+// writePkgFiles creates the files of a package, keyed by their slash separated path
+func writePkgFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	pkgPath := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(pkgPath, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	return pkgPath
+}
+
+// caseSensitiveFS reports whether dir can hold files whose names differ only in case
+func caseSensitiveFS(t *testing.T, dir string) bool {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "probe"), nil, 0644))
+	defer os.Remove(filepath.Join(dir, "probe"))
+	_, err := os.Stat(filepath.Join(dir, "PROBE"))
+	return os.IsNotExist(err)
+}
+
+func TestLoadPackageFromDir_YmlFixture(t *testing.T) {
+	pkg, err := NewPackageManager().LoadPackageFromDir(filepath.Join("testdata", "yml-package"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello-world", pkg.Description.Metadata.Id)
+	assert.Contains(t, string(pkg.Resources["readme.md"]), "named margo.yml")
+}
+
+func TestLoadPackageFromDir_DescriptorDiscovery(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        map[string]string
+		options      []LoadOptions
+		wantDesc     string
+		wantResource string
+		wantErr      string
+		wantAmbig    []string
+	}{
+		{
+			name:     "margo.yaml",
+			files:    map[string]string{"margo.yaml": testDescription},
+			wantDesc: "margo.yaml",
+		},
+		{
+			name:     "margo.yml",
+			files:    map[string]string{"margo.yml": testDescription, "resources/readme.md": "readme"},
+			wantDesc: "margo.yml", wantResource: "readme.md",
+		},
+		{
+			name:     "upper case",
+			files:    map[string]string{"Margo.YML": testDescription},
+			wantDesc: "Margo.YML",
+		},
+		{
+			name: "other yaml files are ignored",
+			files: map[string]string{
+				"margo.yaml":       testDescription,
+				"values.yaml":      "kind: ApplicationDescription\n",
+				"nested/margo.yml": testDescription,
+			},
+			wantDesc: "margo.yaml",
+		},
+		{
+			name:    "only nested",
+			files:   map[string]string{"deploy/margo.yaml": testDescription},
+			wantErr: "no valid ApplicationDescription file (margo.yaml, margo.yml) found in package root",
+		},
+		{
+			name:      "ambiguous",
+			files:     map[string]string{"margo.yaml": testDescription, "margo.yml": testDescription},
+			wantAmbig: []string{"margo.yaml", "margo.yml"},
+		},
+		{
+			name:     "invalid candidate is not ambiguous",
+			files:    map[string]string{"margo.yaml": testDescription, "margo.yml": "kind: Something\n"},
+			wantDesc: "margo.yaml",
+		},
+		{
+			name:     "configured filenames",
+			files:    map[string]string{"application.yaml": testDescription, "margo.yaml": testDescription},
+			options:  []LoadOptions{{DescriptorFileNames: []string{"application.yaml"}}},
+			wantDesc: "application.yaml",
+		},
+		{
+			name: "explicit nested path",
+			files: map[string]string{
+				"margo.yaml":                testDescription,
+				"deploy/app.yaml":           testDescription,
+				"deploy/resources/icon.png": "icon",
+				"resources/readme.md":       "readme",
+			},
+			options:  []LoadOptions{{DescriptorPath: "deploy/app.yaml"}},
+			wantDesc: "deploy/app.yaml", wantResource: "icon.png",
+		},
+		{
+			name:    "explicit path missing",
+			files:   map[string]string{"margo.yaml": testDescription},
+			options: []LoadOptions{{DescriptorPath: "deploy/app.yaml"}},
+			wantErr: "descriptor path deploy/app.yaml not found in package",
+		},
+		{
+			name:    "explicit path outside the package",
+			files:   map[string]string{"margo.yaml": testDescription},
+			options: []LoadOptions{{DescriptorPath: "../margo.yaml"}},
+			wantErr: "must be relative to the package root",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkgPath := writePkgFiles(t, tt.files)
+			pm := NewPackageManager()
+
+			pkg, err := pm.LoadPackageFromDir(pkgPath, tt.options...)
+			if tt.wantAmbig != nil {
+				var ambiguous *AmbiguousDescriptionError
+				require.ErrorAs(t, err, &ambiguous)
+				assert.Equal(t, tt.wantAmbig, ambiguous.Candidates)
+				return
+			}
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "app", pkg.Description.Metadata.Name)
+
+			descFile, err := pm.findAppDescription(pkgPath, loadOptionsOf(tt.options))
+			require.NoError(t, err)
+			assert.Equal(t, filepath.Join(pkgPath, filepath.FromSlash(tt.wantDesc)), descFile)
+			if tt.wantResource != "" {
+				assert.Len(t, pkg.Resources, 1)
+				assert.Contains(t, pkg.Resources, tt.wantResource)
+			}
+		})
+	}
+}
+
+func TestLoadPackageFromDir_CaseVariantsAreAmbiguous(t *testing.T) {
+	pkgPath := t.TempDir()
+	if !caseSensitiveFS(t, pkgPath) {
+		t.Skip("the filesystem is not case-sensitive")
+	}
+	for _, name := range []string{"margo.yaml", "MARGO.yaml"} {
+		require.NoError(t, os.WriteFile(filepath.Join(pkgPath, name), []byte(testDescription), 0644))
+	}
+
+	_, err := NewPackageManager().LoadPackageFromDir(pkgPath)
+
+	var ambiguous *AmbiguousDescriptionError
+	require.ErrorAs(t, err, &ambiguous)
+	assert.ElementsMatch(t, []string{"margo.yaml", "MARGO.yaml"}, ambiguous.Candidates)
+	assert.Contains(t, err.Error(), "set the descriptor path to choose one")
+}
+
+func TestLoadPackageFromDir_Dependencies(t *testing.T) {
+	withDependencies := func(dependencies string) map[string]string {
+		return map[string]string{"margo.yaml": testDescription + "dependencies:\n" + dependencies}
+	}
+
+	pkg, err := NewPackageManager().LoadPackageFromDir(writePkgFiles(t, withDependencies(
+		"  - id: mqtt-broker\n    version: \"^1.2\"\n  - id: device-db\n")))
+	require.NoError(t, err)
+	require.NotNil(t, pkg.Description.Dependencies)
+	assert.Equal(t, []dependency.Requirement{{ID: "mqtt-broker", Version: "^1.2"}, {ID: "device-db"}},
+		models.DependenciesOf(*pkg.Description))
+
+	for dependencies, wantErr := range map[string]string{
+		"  - version: \"1.0\"\n":                                "dependency id cannot be empty",
+		"  - id: mqtt-broker\n    version: \"not a version\"\n": "invalid version constraint",
+		"  - id: app\n":                                         "cannot depend on itself",
+		"  - id: device-db\n  - id: device-db\n":                "declared more than once",
+	} {
+		_, err := NewPackageManager().LoadPackageFromDir(writePkgFiles(t, withDependencies(dependencies)))
+		assert.ErrorContains(t, err, wantErr)
+	}
+}
+
+func TestLoadPackageFromDir_ExpectedDigest(t *testing.T) {
+	pm := NewPackageManager()
+	pkg, err := pm.LoadPackageFromDir(writePkgFiles(t, map[string]string{"margo.yaml": testDescription}))
+	require.NoError(t, err)
+	expected := ComputePackageDigest(pkg)
+	require.True(t, strings.HasPrefix(expected, "sha256:"))
+	assert.Empty(t, ComputePackageDigest(&models.AppPkg{}))
+
+	// the digest is of the canonical description, not of the bytes of the file
+	reformatted := strings.ReplaceAll(testDescription, "\n", "  \n")
+	_, err = pm.LoadPackageFromDir(writePkgFiles(t, map[string]string{"margo.yaml": reformatted}), LoadOptions{ExpectedDigest: expected})
+	require.NoError(t, err)
+	_, err = pm.LoadPackageFromDir(writePkgFiles(t, map[string]string{"margo.yaml": testDescription}), LoadOptions{ExpectedDigest: strings.ToUpper(expected)})
+	require.NoError(t, err)
+
+	tampered := strings.Replace(testDescription, "id: app", "id: other-app", 1)
+	_, err = pm.LoadPackageFromDir(writePkgFiles(t, map[string]string{"margo.yaml": tampered}), LoadOptions{ExpectedDigest: expected})
+	var mismatch *digest.IntegrityMismatch
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, expected, mismatch.Expected.String())
+
+	_, err = pm.LoadPackageFromDir(writePkgFiles(t, map[string]string{"margo.yaml": testDescription}), LoadOptions{ExpectedDigest: "sha256:abc"})
+	assert.ErrorIs(t, err, digest.ErrInvalid)
+}
+
+func TestLoadPackageFromDir_InvalidDescription(t *testing.T) {
+	description := `apiVersion: margo.org/v1-alpha1
+kind: ApplicationDescription
+metadata:
+  id: My_App
+  version: 1.0.0
+  catalog:
+    author:
+      - name: Jane
+        email: not-an-email
+deploymentProfiles:
+  - type: foobar
+    components:
+      - name: app
+parameters:
+  port:
+    value: 80
+    targets:
+      - pointer: ENV.PORT
+        components: [web]
+configuration:
+  sections:
+    - name: Network
+      settings:
+        - name: Port
+          parameter: prot
+          schema: port
+`
+	_, err := NewPackageManager().LoadPackageFromDir(writePkgFiles(t, map[string]string{"margo.yaml": description}))
+
+	var validationErrs models.ValidationErrors
+	require.ErrorAs(t, err, &validationErrs)
+	fields := make([]string, 0, len(validationErrs))
+	for _, validationErr := range validationErrs {
+		fields = append(fields, validationErr.Field)
+	}
+	assert.Equal(t, []string{
+		"metadata.id",
+		"metadata.name",
+		"metadata.catalog.author[0].email",
+		"deploymentProfiles[0].type",
+		"parameters.port.targets[0].components[0]",
+		"configuration.sections[0].settings[0].parameter",
+		"configuration.sections[0].settings[0].schema",
+	}, fields, "every problem is reported at once")
+	assert.ErrorContains(t, err, `"foobar" must be helm.v3 or compose`)
+}
+
+func TestLoadPackageFromDir_MalformedDescription(t *testing.T) {
+	for name, tc := range map[string]struct {
+		description string
+		field       string
+		message     string
+	}{
+		"missing deploymentProfiles": {
+			description: testDescription[:strings.Index(testDescription, "deploymentProfiles:")],
+			field:       "deploymentProfiles",
+			message:     "needs at least one deployment profile",
+		},
+		"invalid profile type": {
+			description: strings.Replace(testDescription, "type: compose", "type: helm", 1),
+			field:       "deploymentProfiles[0].type",
+			message:     `"helm" must be helm.v3 or compose`,
+		},
+		"bad metadata id": {
+			description: strings.Replace(testDescription, "id: app", "id: -app", 1),
+			field:       "metadata.id",
+			message:     `"-app" must be at most 200 lower case letters`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewPackageManager().LoadPackageFromDir(writePkgFiles(t, map[string]string{"margo.yaml": tc.description}))
+
+			var validationErrs models.ValidationErrors
+			require.ErrorAs(t, err, &validationErrs)
+			require.Len(t, validationErrs, 1)
+			assert.Equal(t, tc.field, validationErrs[0].Field)
+			assert.Contains(t, validationErrs[0].Message, tc.message)
+		})
+	}
+}
+
+// imageWithLayer returns an image with a single layer holding the given tar entries
+func imageWithLayer(t *testing.T, headers ...*tar.Header) v1.Image {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range headers {
+		require.NoError(t, tw.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write(make([]byte, header.Size))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+
+	image, err := mutate.AppendLayers(empty.Image, static.NewLayer(buf.Bytes(), types.OCIUncompressedLayer))
+	require.NoError(t, err)
+	return image
+}
+
+func TestExtractImageToDir(t *testing.T) {
+	destDir := t.TempDir()
+	image := imageWithLayer(t,
+		&tar.Header{Name: "resources/", Typeflag: tar.TypeDir, Mode: 0o755},
+		&tar.Header{Name: "margo.yaml", Typeflag: tar.TypeReg, Mode: 0o644, Size: 4},
+		&tar.Header{Name: "resources/icon.png", Typeflag: tar.TypeSymlink, Linkname: "../margo.yaml"},
+	)
+
+	require.NoError(t, extractImageToDir(image, destDir))
+	assert.FileExists(t, filepath.Join(destDir, "margo.yaml"))
+	link, err := os.Readlink(filepath.Join(destDir, "resources", "icon.png"))
+	require.NoError(t, err)
+	assert.Equal(t, "../margo.yaml", link)
+}
+
+func TestExtractImageToDir_PathTraversal(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+		// onDisk prepares destDir before the extraction, outside is a directory that must stay empty
+		onDisk  func(t *testing.T, destDir, outside string)
+		wantErr string
+	}{
+		{
+			name:    "file escaping with ../",
+			headers: []*tar.Header{{Name: "../../evil.sh", Typeflag: tar.TypeReg, Mode: 0o755, Size: 4}},
+			wantErr: `entry "../../evil.sh" escapes the destination directory`,
+		},
+		{
+			name:    "directory escaping with ../",
+			headers: []*tar.Header{{Name: "resources/../../outside/", Typeflag: tar.TypeDir, Mode: 0o755}},
+			wantErr: "escapes the destination directory",
+		},
+		{
+			name:    "symlink to a relative path outside",
+			headers: []*tar.Header{{Name: "resources/passwd", Typeflag: tar.TypeSymlink, Linkname: "../../../etc/passwd"}},
+			wantErr: `points to "../../../etc/passwd" outside the destination directory`,
+		},
+		{
+			name:    "symlink to an absolute path",
+			headers: []*tar.Header{{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}},
+			wantErr: `points to "/etc/passwd" outside the destination directory`,
+		},
+		{
+			// every entry looks inside on its own, d/e is destDir/e pointing to the parent
+			name: "chain of symlinks",
+			headers: []*tar.Header{
+				{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "."},
+				{Name: "d/e", Typeflag: tar.TypeSymlink, Linkname: ".."},
+				{Name: "e/evil", Typeflag: tar.TypeReg, Mode: 0o644, Size: 4},
+			},
+			wantErr: `points to ".." outside the destination directory`,
+		},
+		{
+			name: "symlink resolved through an extracted symlink",
+			headers: []*tar.Header{
+				{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "."},
+				{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "d/../outside"},
+			},
+			wantErr: `points to "d/../outside" outside the destination directory`,
+		},
+		{
+			name:    "file through a symlink present on disk",
+			headers: []*tar.Header{{Name: "link/evil", Typeflag: tar.TypeReg, Mode: 0o644, Size: 4}},
+			onDisk: func(t *testing.T, destDir, outside string) {
+				require.NoError(t, os.Symlink(outside, filepath.Join(destDir, "link")))
+			},
+			wantErr: "outside the destination directory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			destDir := filepath.Join(parent, "package", "extracted")
+			require.NoError(t, os.MkdirAll(destDir, 0o755))
+			outside := t.TempDir()
+			if tt.onDisk != nil {
+				tt.onDisk(t, destDir, outside)
+			}
+
+			err := extractImageToDir(imageWithLayer(t, tt.headers...), destDir)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+
+			for _, dir := range []string{parent, filepath.Join(parent, "package")} {
+				entries, err := os.ReadDir(dir)
+				require.NoError(t, err)
+				assert.Len(t, entries, 1, "nothing is written outside the destination directory")
+			}
+			entries, err := os.ReadDir(outside)
+			require.NoError(t, err)
+			assert.Empty(t, entries, "nothing is written through a symlink")
+			_, err = os.Lstat(filepath.Join(destDir, filepath.Base(tt.headers[len(tt.headers)-1].Name)))
+			assert.True(t, os.IsNotExist(err), "the rejected entry is not created")
+		})
+	}
+}
+
+func TestExtractImageToDir_ReplacesASymlinkPresentOnDisk(t *testing.T) {
+	destDir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "target")
+	require.NoError(t, os.WriteFile(outside, []byte("keep"), 0o644))
+	require.NoError(t, os.Symlink(outside, filepath.Join(destDir, "margo.yaml")))
+
+	image := imageWithLayer(t, &tar.Header{Name: "margo.yaml", Typeflag: tar.TypeReg, Mode: 0o644, Size: 4})
+	require.NoError(t, extractImageToDir(image, destDir))
+
+	info, err := os.Lstat(filepath.Join(destDir, "margo.yaml"))
+	require.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular(), "the file replaces the symlink")
+	data, err := os.ReadFile(outside)
+	require.NoError(t, err)
+	assert.Equal(t, "keep", string(data), "the symlink target is not written")
+}
+
+// writeTestTarball writes a .tar.gz holding the given entries, the content of regular files is
+// given by name
+func writeTestTarball(t *testing.T, headers []*tar.Header, contents map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(contents[header.Name]))
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(contents[header.Name]))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+
+	tarball := filepath.Join(t.TempDir(), "app.tar.gz")
+	require.NoError(t, os.WriteFile(tarball, buf.Bytes(), 0o644))
+	return tarball
+}
+
+func TestLoadPackageFromTarball_RoundTrip(t *testing.T) {
+	pm := NewPackageManager()
+	desc, err := models.ParseApplicationDescription(strings.NewReader(testDescription), models.ApplicationDescriptionFormatYAML)
+	require.NoError(t, err)
+	resources := map[string][]byte{
+		"readme.md":                       []byte("# app"),
+		filepath.Join("docs", "guide.md"): []byte("guide"),
+	}
+
+	pkgPath := t.TempDir()
+	require.NoError(t, pm.CreatePackage(desc, resources, pkgPath))
+	created, err := pm.LoadPackageFromDir(pkgPath)
+	require.NoError(t, err)
+
+	tarball := filepath.Join(t.TempDir(), "app.tar.gz")
+	require.NoError(t, pm.PackageToTarball(created, tarball, CreateOptions{WriteChecksums: true}))
+	loaded, err := pm.LoadPackageFromTarball(tarball)
+	require.NoError(t, err)
+
+	assert.Equal(t, desc, *created.Description, "the components of the deployment profiles survive")
+	assert.Equal(t, created.Description, loaded.Description)
+	assert.Equal(t, resources, loaded.Resources)
+
+	createdDigest, err := pm.PackageDigest(created)
+	require.NoError(t, err)
+	loadedDigest, err := pm.PackageDigest(loaded)
+	require.NoError(t, err)
+	assert.Equal(t, createdDigest, loadedDigest)
+}
+
+func TestLoadPackageFromTarball_Invalid(t *testing.T) {
+	pm := NewPackageManager()
+
+	tarball := writeTestTarball(t, []*tar.Header{
+		{Name: "margo.yaml", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "resources/../../evil.sh", Typeflag: tar.TypeReg, Mode: 0o755},
+	}, map[string]string{"margo.yaml": testDescription, "resources/../../evil.sh": "boom"})
+	_, err := pm.LoadPackageFromTarball(tarball)
+	assert.ErrorContains(t, err, `entry "resources/../../evil.sh" escapes the destination directory`)
+
+	tarball = writeTestTarball(t, []*tar.Header{
+		{Name: "margo.yaml", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "resources/passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+	}, map[string]string{"margo.yaml": testDescription})
+	_, err = pm.LoadPackageFromTarball(tarball)
+	assert.ErrorContains(t, err, `"resources/passwd" is not a regular file or directory`)
+
+	restore := MaxTarballSize
+	MaxTarballSize = int64(len(testDescription)) + 10
+	t.Cleanup(func() { MaxTarballSize = restore })
+	tarball = writeTestTarball(t, []*tar.Header{
+		{Name: "margo.yaml", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "resources/big.bin", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"margo.yaml": testDescription, "resources/big.bin": strings.Repeat("0", 64)})
+	_, err = pm.LoadPackageFromTarball(tarball)
+	assert.ErrorContains(t, err, "exceeds the maximum uncompressed size")
+
+	notGzip := filepath.Join(t.TempDir(), "app.tar.gz")
+	require.NoError(t, os.WriteFile(notGzip, []byte("not a tarball"), 0o644))
+	_, err = pm.LoadPackageFromTarball(notGzip)
+	assert.ErrorContains(t, err, "failed to read tarball")
+}
@@ -0,0 +1,128 @@
+package packageManager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/margo/sandbox/non-standard/pkg/models"
+	"github.com/margo/sandbox/shared-lib/git"
+)
+
+// ErrNoNewerVersion is returned by checkPkgUpdates when the package is at the latest version of its
+// source. It is not a failure, the PackageUpdate returned with it tells the latest version.
+var ErrNoNewerVersion = errors.New("no newer version available")
+
+// PackageSource is where the versions of a package are looked up, exactly one of Git and OCI is set
+type PackageSource struct {
+	Git *GitPackageSource
+	OCI *OCIPackageSource
+}
+
+// GitPackageSource is a git repository whose tags are the versions of the package, e.g. "v1.2.0"
+type GitPackageSource struct {
+	URL  string
+	Auth *git.Auth
+}
+
+// OCIPackageSource is an OCI repository whose tags are the versions of the package, the fields are
+// the ones of LoadPackageFromOci
+type OCIPackageSource struct {
+	RegistryUrl     string
+	Repository      string
+	Username        string
+	PasswordOrToken string
+	Insecure        bool
+	Timeout         time.Duration
+}
+
+// PackageUpdate is the outcome of an update check
+type PackageUpdate struct {
+	CurrentVersion string
+	// LatestVersion is the highest version of the source and LatestTag the tag it was read from,
+	// e.g. "1.2.0" and "v1.2.0"
+	LatestVersion   string
+	LatestTag       string
+	UpdateAvailable bool
+}
+
+// checkPkgUpdates compares the version of the package with the highest version tagged at its
+// source. Tags that are not semantic versions are ignored, pre-releases only count when the package
+// is a pre-release itself.
+//
+// Returns:
+//   - *PackageUpdate: The current and the latest version, UpdateAvailable when the latest is newer
+//   - error: ErrNoNewerVersion when the package is up to date, or an error if the version of the
+//     package is not a semantic version, the source cannot be listed or tags no version at all
+func (pm *PackageManager) checkPkgUpdates(pkg *models.AppPkg, source PackageSource) (*PackageUpdate, error) {
+	if pkg == nil || pkg.Description == nil {
+		return nil, fmt.Errorf("package has no application description")
+	}
+	currentVersion := pkg.Description.Metadata.Version
+	current, err := semver.NewVersion(currentVersion)
+	if err != nil {
+		return nil, fmt.Errorf("package version %q is not a semantic version: %w", currentVersion, err)
+	}
+
+	tags, err := sourceTags(source)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *semver.Version
+	var latestTag string
+	for _, tag := range tags {
+		version, err := semver.NewVersion(tag)
+		if err != nil || (version.Prerelease() != "" && current.Prerelease() == "") {
+			continue
+		}
+		if latest == nil || version.GreaterThan(latest) {
+			latest, latestTag = version, tag
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no semantic version tag found at the package source")
+	}
+
+	update := &PackageUpdate{
+		CurrentVersion:  currentVersion,
+		LatestVersion:   latest.String(),
+		LatestTag:       latestTag,
+		UpdateAvailable: latest.GreaterThan(current),
+	}
+	if !update.UpdateAvailable {
+		return update, ErrNoNewerVersion
+	}
+	return update, nil
+}
+
+// sourceTags lists the tags of the git or OCI repository of the source
+func sourceTags(source PackageSource) ([]string, error) {
+	switch {
+	case source.Git != nil && source.OCI != nil:
+		return nil, fmt.Errorf("package source must be either git or OCI, not both")
+
+	case source.Git != nil:
+		return git.ListRemoteTags(source.Git.URL, source.Git.Auth)
+
+	case source.OCI != nil:
+		ociClient, _, err := newOciClient(source.OCI.RegistryUrl, source.OCI.Username, source.OCI.PasswordOrToken, source.OCI.Insecure, source.OCI.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		defer ociClient.Close()
+
+		ctx := context.Background()
+		if source.OCI.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, source.OCI.Timeout)
+			defer cancel()
+		}
+		return ociClient.ListTags(ctx, source.OCI.Repository)
+
+	default:
+		return nil, fmt.Errorf("package source has neither git nor OCI set")
+	}
+}
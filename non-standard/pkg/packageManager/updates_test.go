@@ -0,0 +1,90 @@
+package packageManager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	goGit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTaggedGitRepo creates a local git repository with a commit carrying every tag
+func newTaggedGitRepo(t *testing.T, tags ...string) string {
+	t.Helper()
+	repoPath := t.TempDir()
+	repo, err := goGit.PlainInit(repoPath, false)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "margo.yaml"), []byte(testDescription), 0o644))
+	worktree, err := repo.Worktree()
+	require.NoError(t, err)
+	_, err = worktree.Add("margo.yaml")
+	require.NoError(t, err)
+	commit, err := worktree.Commit("package", &goGit.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	require.NoError(t, err)
+	for _, tag := range tags {
+		_, err := repo.CreateTag(tag, commit, nil)
+		require.NoError(t, err)
+	}
+	return repoPath
+}
+
+func TestCheckPkgUpdates_Git(t *testing.T) {
+	pm := NewPackageManager()
+	source := PackageSource{Git: &GitPackageSource{URL: newTaggedGitRepo(t, "v1.0.0", "v1.2.0", "v1.10.0", "v2.0.0-rc.1", "stable")}}
+
+	update, err := pm.checkPkgUpdates(newTestPkg("1.2.0"), source)
+	require.NoError(t, err)
+	assert.Equal(t, &PackageUpdate{CurrentVersion: "1.2.0", LatestVersion: "1.10.0", LatestTag: "v1.10.0", UpdateAvailable: true}, update)
+
+	update, err = pm.checkPkgUpdates(newTestPkg("1.10.0"), source)
+	assert.ErrorIs(t, err, ErrNoNewerVersion)
+	require.NotNil(t, update)
+	assert.False(t, update.UpdateAvailable)
+	assert.Equal(t, "1.10.0", update.LatestVersion)
+
+	// pre-releases only count for a pre-release
+	update, err = pm.checkPkgUpdates(newTestPkg("2.0.0-beta.1"), source)
+	require.NoError(t, err)
+	assert.Equal(t, "v2.0.0-rc.1", update.LatestTag)
+}
+
+func TestCheckPkgUpdates_OCI(t *testing.T) {
+	registryURL := newTestRegistry(t, "", "")
+	for _, tag := range []string{"1.0.0", "1.1.0", "latest", "2.0.0-beta"} {
+		pushTestArtifact(t, registryURL, "acme/app", tag, empty.Image, authn.Anonymous)
+	}
+	pm := NewPackageManager()
+	source := PackageSource{OCI: &OCIPackageSource{RegistryUrl: registryURL, Repository: "acme/app", Timeout: 30 * time.Second}}
+
+	update, err := pm.checkPkgUpdates(newTestPkg("1.0.0"), source)
+	require.NoError(t, err)
+	assert.Equal(t, &PackageUpdate{CurrentVersion: "1.0.0", LatestVersion: "1.1.0", LatestTag: "1.1.0", UpdateAvailable: true}, update)
+
+	_, err = pm.checkPkgUpdates(newTestPkg("1.1.0"), source)
+	assert.ErrorIs(t, err, ErrNoNewerVersion)
+
+	_, err = pm.checkPkgUpdates(newTestPkg("1.0.0"), PackageSource{OCI: &OCIPackageSource{RegistryUrl: registryURL, Repository: "acme/missing"}})
+	assert.ErrorContains(t, err, "failed to list tags")
+}
+
+func TestCheckPkgUpdates_Invalid(t *testing.T) {
+	pm := NewPackageManager()
+	source := PackageSource{Git: &GitPackageSource{URL: newTaggedGitRepo(t, "stable")}}
+
+	_, err := pm.checkPkgUpdates(newTestPkg("1.0.0"), source)
+	assert.ErrorContains(t, err, "no semantic version tag found")
+
+	_, err = pm.checkPkgUpdates(newTestPkg("latest"), source)
+	assert.ErrorContains(t, err, `package version "latest" is not a semantic version`)
+
+	_, err = pm.checkPkgUpdates(newTestPkg("1.0.0"), PackageSource{})
+	assert.ErrorContains(t, err, "neither git nor OCI")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/margo/sandbox/poc/device/agent/health"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+)
+
+// apiVersionHealth reports the outcome of the SBI API version negotiation with the WFM
+type apiVersionHealth struct {
+	check wfm.APIVersionCheck
+	err   error
+}
+
+// refused reports whether the agent must not operate against the WFM
+func (h *apiVersionHealth) refused() bool {
+	return h != nil && !h.check.Compatible()
+}
+
+func (h *apiVersionHealth) Name() string {
+	return health.ComponentAPIVersion
+}
+
+// Health is unhealthy when the WFM speaks another major version, the agent then does not sync or
+// deploy anything. A failed negotiation only degrades it, the versions are unknown but may match.
+func (h *apiVersionHealth) Health() health.Report {
+	report := health.OK(nil)
+	switch {
+	case h.refused():
+		report.Fail(fmt.Sprintf("refusing to operate: %s", h.check.Detail))
+	case h.err != nil:
+		report.Degrade(fmt.Sprintf("api version negotiation failed: %v", h.err))
+	}
+	return report
+}
@@ -0,0 +1,369 @@
+// Package breaker keeps the agent from hammering a container runtime that is down. Every runtime
+// client gets a circuit breaker that counts consecutive failures indicating the runtime itself is
+// unavailable; once the circuit opens, operations against the runtime fail fast until a cheap
+// probe succeeds again.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/health"
+)
+
+// CodeRuntimeUnavailable is the transient error code of operations rejected by an open circuit
+const CodeRuntimeUnavailable = "RUNTIME_UNAVAILABLE"
+
+const (
+	DefaultFailureThreshold  = 3
+	DefaultWarmCheckInterval = 30 * time.Second
+	DefaultProbeInterval     = 5 * time.Second
+	DefaultMaxProbeInterval  = 2 * time.Minute
+	defaultProbeTimeout      = 5 * time.Second
+)
+
+// State of a circuit
+type State string
+
+const (
+	// StateClosed lets operations through
+	StateClosed State = "closed"
+	// StateOpen rejects operations until a probe succeeds
+	StateOpen State = "open"
+)
+
+// Config of a breaker, zero values use the defaults
+type Config struct {
+	// FailureThreshold is the number of consecutive unavailability failures that open the circuit
+	FailureThreshold int
+	// WarmCheckInterval is how often the runtime is probed while the circuit is closed, so an
+	// outage is noticed before a deployment runs into it. A negative interval disables warm checks.
+	WarmCheckInterval time.Duration
+	// ProbeInterval is the first wait between probes while the circuit is open, it doubles after
+	// every failed probe up to MaxProbeInterval
+	ProbeInterval    time.Duration
+	MaxProbeInterval time.Duration
+}
+
+// WithDefaults returns the config with the unset values filled in
+func (c Config) WithDefaults() Config {
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = DefaultFailureThreshold
+	}
+	if c.WarmCheckInterval == 0 {
+		c.WarmCheckInterval = DefaultWarmCheckInterval
+	}
+	if c.ProbeInterval <= 0 {
+		c.ProbeInterval = DefaultProbeInterval
+	}
+	if c.MaxProbeInterval <= 0 {
+		c.MaxProbeInterval = DefaultMaxProbeInterval
+	}
+	if c.MaxProbeInterval < c.ProbeInterval {
+		c.MaxProbeInterval = c.ProbeInterval
+	}
+	return c
+}
+
+// UnavailableError is returned instead of running an operation while the circuit is open
+type UnavailableError struct {
+	Runtime string
+	Since   time.Time
+	// Cause is the failure that opened the circuit
+	Cause error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("%s: %s unavailable since %s: %v", CodeRuntimeUnavailable, e.Runtime, e.Since.Format(time.RFC3339), e.Cause)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Cause
+}
+
+// Code returns the error code reported for the rejected operation
+func (e *UnavailableError) Code() string {
+	return CodeRuntimeUnavailable
+}
+
+// IsOpenCircuit reports whether err was returned because a circuit is open
+func IsOpenCircuit(err error) bool {
+	var unavailable *UnavailableError
+	return errors.As(err, &unavailable)
+}
+
+// Transition is a change of the circuit state
+type Transition struct {
+	Runtime string
+	From    State
+	To      State
+	Time    time.Time
+	// Err is the failure that opened the circuit, nil when it closed
+	Err error
+}
+
+// Option configures a breaker
+type Option func(*Breaker)
+
+// WithClassifier replaces the function deciding whether an error means the runtime is unavailable
+func WithClassifier(isUnavailable func(error) bool) Option {
+	return func(b *Breaker) {
+		b.isUnavailable = isUnavailable
+	}
+}
+
+// WithClock replaces the clock, for tests
+func WithClock(now func() time.Time) Option {
+	return func(b *Breaker) {
+		b.now = now
+	}
+}
+
+// Breaker is the circuit breaker of one runtime. It implements health.ComponentHealth with the
+// outcome of its own probes, so the health endpoints never call the runtime themselves.
+type Breaker struct {
+	name          string
+	probe         func(ctx context.Context) error
+	isUnavailable func(error) bool
+	config        Config
+	now           func() time.Time
+	// wake interrupts the wait of Run when the circuit opens
+	wake chan struct{}
+
+	mu            sync.Mutex
+	state         State
+	failures      int
+	lastErr       error
+	openedAt      time.Time
+	checkedAt     time.Time
+	nextProbeAt   time.Time
+	probeInterval time.Duration
+	listeners     []func(Transition)
+}
+
+// New creates a closed breaker for the named runtime, probe must be a cheap check that the
+// runtime answers, e.g. docker version or the kubernetes version endpoint
+func New(name string, probe func(ctx context.Context) error, config Config, opts ...Option) *Breaker {
+	b := &Breaker{
+		name:          name,
+		probe:         probe,
+		isUnavailable: IsRuntimeUnavailable,
+		config:        config.WithDefaults(),
+		now:           time.Now,
+		wake:          make(chan struct{}, 1),
+		state:         StateClosed,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.probeInterval = b.config.ProbeInterval
+	if b.config.WarmCheckInterval > 0 {
+		b.nextProbeAt = b.now()
+	}
+	return b
+}
+
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// OnTransition registers a listener called after every state change, outside the breaker lock
+func (b *Breaker) OnTransition(listener func(Transition)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listeners = append(b.listeners, listener)
+}
+
+// State returns the current circuit state
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow returns an *UnavailableError while the circuit is open, callers must not start any work
+// against the runtime then
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == StateOpen {
+		return &UnavailableError{Runtime: b.name, Since: b.openedAt, Cause: b.lastErr}
+	}
+	return nil
+}
+
+// Do runs op unless the circuit is open and records its outcome
+func (b *Breaker) Do(ctx context.Context, op func(ctx context.Context) error) error {
+	if err := b.Allow(); err != nil {
+		return err
+	}
+	err := op(ctx)
+	b.Record(err)
+	return err
+}
+
+// Record counts the outcome of an operation against the runtime. Only failures indicating that the
+// runtime is unavailable count, a successful operation resets the count. Operations never close an
+// open circuit, only probes do.
+func (b *Breaker) Record(err error) {
+	if err != nil && !b.isUnavailable(err) {
+		return
+	}
+	b.mu.Lock()
+	if err == nil {
+		if b.state == StateClosed {
+			b.failures = 0
+			b.lastErr = nil
+		}
+		b.mu.Unlock()
+		return
+	}
+	transition := b.failLocked(err)
+	b.mu.Unlock()
+	b.emit(transition)
+}
+
+// failLocked counts a failure and opens the circuit at the threshold
+func (b *Breaker) failLocked(err error) *Transition {
+	b.failures++
+	b.lastErr = err
+	if b.state == StateOpen || b.failures < b.config.FailureThreshold {
+		return nil
+	}
+	b.state = StateOpen
+	b.openedAt = b.now()
+	b.probeInterval = b.config.ProbeInterval
+	b.nextProbeAt = b.openedAt.Add(b.probeInterval)
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return &Transition{Runtime: b.name, From: StateClosed, To: StateOpen, Time: b.openedAt, Err: err}
+}
+
+// NextProbeAt returns when the next probe is due, zero when none is scheduled
+func (b *Breaker) NextProbeAt() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nextProbeAt
+}
+
+// ProbeIfDue probes the runtime when a probe is due and reports whether it did. While the circuit
+// is open a failed probe doubles the wait for the next one, a successful probe closes the circuit.
+func (b *Breaker) ProbeIfDue(ctx context.Context) bool {
+	b.mu.Lock()
+	if b.nextProbeAt.IsZero() || b.now().Before(b.nextProbeAt) {
+		b.mu.Unlock()
+		return false
+	}
+	b.mu.Unlock()
+
+	probeCtx, cancel := context.WithTimeout(ctx, defaultProbeTimeout)
+	err := b.probe(probeCtx)
+	cancel()
+
+	b.mu.Lock()
+	now := b.now()
+	b.checkedAt = now
+	var transition *Transition
+	switch {
+	case err == nil && b.state == StateOpen:
+		transition = &Transition{Runtime: b.name, From: StateOpen, To: StateClosed, Time: now}
+		b.state = StateClosed
+		b.failures = 0
+		b.lastErr = nil
+		b.probeInterval = b.config.ProbeInterval
+	case err == nil:
+		b.failures = 0
+		b.lastErr = nil
+	case b.state == StateOpen:
+		b.failures++
+		b.lastErr = err
+		b.probeInterval *= 2
+		if b.probeInterval > b.config.MaxProbeInterval {
+			b.probeInterval = b.config.MaxProbeInterval
+		}
+	default:
+		// a failed warm check counts like a failed operation, whatever the error is
+		transition = b.failLocked(err)
+	}
+	b.scheduleLocked(now)
+	b.mu.Unlock()
+
+	b.emit(transition)
+	return true
+}
+
+// scheduleLocked plans the next probe after one ran or the circuit opened
+func (b *Breaker) scheduleLocked(now time.Time) {
+	switch {
+	case b.state == StateOpen:
+		if !b.nextProbeAt.After(now) {
+			b.nextProbeAt = now.Add(b.probeInterval)
+		}
+	case b.config.WarmCheckInterval > 0:
+		b.nextProbeAt = now.Add(b.config.WarmCheckInterval)
+	default:
+		b.nextProbeAt = time.Time{}
+	}
+}
+
+// Run probes the runtime on schedule until stop is closed
+func (b *Breaker) Run(stop <-chan struct{}) {
+	for {
+		wait := time.Hour
+		if next := b.NextProbeAt(); !next.IsZero() {
+			wait = max(next.Sub(b.now()), 0)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-b.wake:
+			timer.Stop()
+		case <-timer.C:
+			b.ProbeIfDue(context.Background())
+		}
+	}
+}
+
+func (b *Breaker) emit(transition *Transition) {
+	if transition == nil {
+		return
+	}
+	b.mu.Lock()
+	listeners := append([]func(Transition){}, b.listeners...)
+	b.mu.Unlock()
+	for _, listener := range listeners {
+		listener(*transition)
+	}
+}
+
+// Health is unhealthy while the circuit is open and degraded while failures are counted towards
+// opening it
+func (b *Breaker) Health() health.Report {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	metrics := map[string]float64{
+		"consecutiveFailures": float64(b.failures),
+		"circuitOpen":         0,
+	}
+	if !b.checkedAt.IsZero() {
+		metrics["secondsSinceCheck"] = b.now().Sub(b.checkedAt).Seconds()
+	}
+	report := health.OK(metrics)
+	switch {
+	case b.state == StateOpen:
+		metrics["circuitOpen"] = 1
+		metrics["secondsUntilProbe"] = max(b.nextProbeAt.Sub(b.now()), 0).Seconds()
+		report.Fail(fmt.Sprintf("circuit open since %s: %v", b.openedAt.Format(time.RFC3339), b.lastErr))
+	case b.failures > 0:
+		report.Degrade(fmt.Sprintf("%d consecutive failures: %v", b.failures, b.lastErr))
+	}
+	return report
+}
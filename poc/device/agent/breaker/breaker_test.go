@@ -0,0 +1,242 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRuntime flips between available and unavailable and counts the calls made against it
+type fakeRuntime struct {
+	mu         sync.Mutex
+	available  bool
+	probes     int
+	operations int
+}
+
+var errDaemonDown = errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?")
+
+func (f *fakeRuntime) setAvailable(available bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.available = available
+}
+
+func (f *fakeRuntime) probe(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probes++
+	if !f.available {
+		return errDaemonDown
+	}
+	return nil
+}
+
+func (f *fakeRuntime) deploy(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.operations++
+	if !f.available {
+		return fmt.Errorf("docker compose operation failed: %w", errDaemonDown)
+	}
+	return nil
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestBreaker(runtime *fakeRuntime, config Config) (*Breaker, *fakeClock, *[]Transition) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := New(health.ComponentRuntimeCompose, runtime.probe, config, WithClock(clock.Now))
+	var transitions []Transition
+	b.OnTransition(func(transition Transition) {
+		transitions = append(transitions, transition)
+	})
+	return b, clock, &transitions
+}
+
+func TestBreaker_OpensAfterThresholdAndFailsFast(t *testing.T) {
+	runtime := &fakeRuntime{}
+	b, _, transitions := newTestBreaker(runtime, Config{FailureThreshold: 3, WarmCheckInterval: -1})
+
+	for i := 0; i < 3; i++ {
+		err := b.Do(context.Background(), runtime.deploy)
+		require.Error(t, err)
+		assert.False(t, IsOpenCircuit(err), "attempt %d runs against the runtime", i+1)
+	}
+	assert.Equal(t, StateOpen, b.State())
+	require.Len(t, *transitions, 1)
+	assert.Equal(t, StateOpen, (*transitions)[0].To)
+
+	err := b.Do(context.Background(), runtime.deploy)
+	var unavailable *UnavailableError
+	require.ErrorAs(t, err, &unavailable)
+	assert.Equal(t, CodeRuntimeUnavailable, unavailable.Code())
+	assert.ErrorIs(t, err, errDaemonDown)
+	assert.Equal(t, 3, runtime.operations, "no work is spawned while the circuit is open")
+
+	report := b.Health()
+	assert.Equal(t, health.StatusUnhealthy, report.Status)
+	assert.Equal(t, float64(1), report.Metrics["circuitOpen"])
+}
+
+func TestBreaker_OperationFailuresThatAreNotUnavailability(t *testing.T) {
+	runtime := &fakeRuntime{available: true}
+	b, _, _ := newTestBreaker(runtime, Config{FailureThreshold: 1, WarmCheckInterval: -1})
+
+	b.Record(errors.New("chart not found"))
+	b.Record(context.DeadlineExceeded)
+	assert.Equal(t, StateClosed, b.State())
+	assert.Equal(t, health.StatusOK, b.Health().Status)
+
+	b.Record(fmt.Errorf("dial tcp 10.0.0.1:6443: %w", syscall.ECONNREFUSED))
+	assert.Equal(t, StateOpen, b.State())
+}
+
+func TestBreaker_SuccessResetsTheCount(t *testing.T) {
+	runtime := &fakeRuntime{}
+	b, _, _ := newTestBreaker(runtime, Config{FailureThreshold: 2, WarmCheckInterval: -1})
+
+	b.Record(errDaemonDown)
+	assert.Equal(t, health.StatusDegraded, b.Health().Status)
+	b.Record(nil)
+	b.Record(errDaemonDown)
+	assert.Equal(t, StateClosed, b.State())
+}
+
+func TestBreaker_ProbeScheduleAndRecovery(t *testing.T) {
+	runtime := &fakeRuntime{}
+	b, clock, transitions := newTestBreaker(runtime, Config{
+		FailureThreshold:  1,
+		WarmCheckInterval: -1,
+		ProbeInterval:     5 * time.Second,
+		MaxProbeInterval:  15 * time.Second,
+	})
+	ctx := context.Background()
+
+	assert.False(t, b.ProbeIfDue(ctx), "no probe is scheduled while closed without warm checks")
+	b.Record(errDaemonDown)
+	require.Equal(t, StateOpen, b.State())
+
+	// the waits double after every failed probe, up to the maximum
+	for _, wait := range []time.Duration{5 * time.Second, 10 * time.Second, 15 * time.Second, 15 * time.Second} {
+		clock.Advance(wait - time.Second)
+		assert.False(t, b.ProbeIfDue(ctx), "probe before %s", wait)
+		clock.Advance(time.Second)
+		assert.True(t, b.ProbeIfDue(ctx), "probe after %s", wait)
+		assert.Equal(t, StateOpen, b.State())
+	}
+	assert.Equal(t, 4, runtime.probes)
+	assert.Equal(t, 0, runtime.operations)
+
+	runtime.setAvailable(true)
+	clock.Advance(15 * time.Second)
+	require.True(t, b.ProbeIfDue(ctx))
+	assert.Equal(t, StateClosed, b.State())
+	assert.NoError(t, b.Allow())
+	assert.Equal(t, health.StatusOK, b.Health().Status)
+	assert.True(t, b.NextProbeAt().IsZero())
+
+	require.Len(t, *transitions, 2)
+	assert.Equal(t, StateClosed, (*transitions)[1].To)
+	assert.NoError(t, (*transitions)[1].Err)
+
+	// a new outage starts the schedule over
+	runtime.setAvailable(false)
+	require.Error(t, b.Do(ctx, runtime.deploy))
+	assert.Equal(t, clock.Now().Add(5*time.Second), b.NextProbeAt())
+}
+
+func TestBreaker_WarmChecksOpenTheCircuit(t *testing.T) {
+	runtime := &fakeRuntime{}
+	b, clock, transitions := newTestBreaker(runtime, Config{FailureThreshold: 2, WarmCheckInterval: 30 * time.Second})
+	ctx := context.Background()
+
+	assert.True(t, b.ProbeIfDue(ctx), "the first warm check runs right away")
+	assert.Equal(t, StateClosed, b.State())
+	assert.False(t, b.ProbeIfDue(ctx))
+	clock.Advance(30 * time.Second)
+	assert.True(t, b.ProbeIfDue(ctx))
+	assert.Equal(t, StateOpen, b.State())
+	require.Len(t, *transitions, 1)
+	assert.Equal(t, 0, runtime.operations)
+}
+
+func TestBreaker_RunProbesUntilRecovery(t *testing.T) {
+	runtime := &fakeRuntime{}
+	b := New(health.ComponentRuntimeHelm, runtime.probe, Config{
+		FailureThreshold:  1,
+		WarmCheckInterval: -1,
+		ProbeInterval:     10 * time.Millisecond,
+		MaxProbeInterval:  20 * time.Millisecond,
+	})
+	closed := make(chan struct{})
+	b.OnTransition(func(transition Transition) {
+		if transition.To == StateClosed {
+			close(closed)
+		}
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go b.Run(stop)
+
+	b.Record(errDaemonDown)
+	require.Eventually(t, func() bool {
+		runtime.mu.Lock()
+		defer runtime.mu.Unlock()
+		return runtime.probes >= 2
+	}, time.Second, 5*time.Millisecond)
+
+	runtime.setAvailable(true)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the circuit did not close after the runtime recovered")
+	}
+	assert.NoError(t, b.Allow())
+}
+
+func TestIsRuntimeUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"docker daemon down", errDaemonDown, true},
+		{"connection refused", fmt.Errorf("Get \"https://10.0.0.1:6443/version\": %w", syscall.ECONNREFUSED), true},
+		{"refused in cli output", errors.New("dial unix /var/run/docker.sock: connect: connection refused"), true},
+		{"api server overloaded", errors.New("the server is currently unable to handle the request"), true},
+		{"failed probe", errors.New("kubernetes api server not reachable: EOF"), true},
+		{"install deadline", context.DeadlineExceeded, false},
+		{"broken chart", errors.New("failed to load chart: no Chart.yaml"), false},
+		{"missing image", errors.New("manifest for nginx:nope not found"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsRuntimeUnavailable(tt.err))
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package breaker
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+// unavailableMessages are what the docker cli and the kubernetes client print when they cannot
+// reach the daemon or the api server, the cli only gives us its output
+var unavailableMessages = []string{
+	"connection refused",
+	"cannot connect to the docker daemon",
+	"is the docker daemon running",
+	"error during connect",
+	"no such host",
+	"no route to host",
+	"network is unreachable",
+	"i/o timeout",
+	"tls handshake timeout",
+	"the server is currently unable to handle the request",
+	"docker daemon not reachable",
+	"kubernetes api server not reachable",
+}
+
+// IsRuntimeUnavailable reports whether err indicates that the runtime itself cannot be reached, as
+// opposed to a failure of the operation, e.g. a broken chart or a missing image. A deadline is not
+// counted here, an install waiting for its pods may legitimately run out of time; the probes count
+// every failure, including deadlines of the version checks.
+func IsRuntimeUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, unavailable := range unavailableMessages {
+		if strings.Contains(message, unavailable) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/health"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"go.uber.org/zap"
+)
+
+// cacheReconcileBudget bounds the time spent re-hashing cached entries, the entries left over are
+// verified when they are first used
+const cacheReconcileBudget = 5 * time.Second
+
+// cacheReconciler is implemented by sbi clients that keep local caches of the fetched deployments
+type cacheReconciler interface {
+	ReconcileCaches(ctx context.Context, expected wfm.CacheExpectations) (wfm.CacheReconcileSummary, error)
+}
+
+// cacheStatsSource is implemented by sbi clients that can describe their caches
+type cacheStatsSource interface {
+	CacheStats() (wfm.CacheStats, error)
+}
+
+// runCacheStatsLog logs the size and the hit rate of the sbi client caches every interval until
+// stop is closed
+func (a *Agent) runCacheStatsLog(interval time.Duration, stop <-chan struct{}) {
+	source, ok := a.cacheReconciler.(cacheStatsSource)
+	if !ok {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			logCacheStats(source, a.log)
+		}
+	}
+}
+
+func logCacheStats(source cacheStatsSource, log *zap.SugaredLogger) {
+	stats, err := source.CacheStats()
+	if err != nil {
+		log.Warnw("Failed to read the cache statistics", "error", err)
+		return
+	}
+	log.Infow("Cache statistics",
+		"deploymentEntries", stats.Deployments.Entries,
+		"deploymentBytes", stats.Deployments.Bytes,
+		"deploymentHits", stats.Deployments.Hits,
+		"deploymentMisses", stats.Deployments.Misses,
+		"deploymentsEvicted", stats.Deployments.Evicted,
+		"bundleEntries", stats.Bundles.Entries,
+		"bundleBytes", stats.Bundles.Bytes,
+		"bundleHits", stats.Bundles.Hits,
+		"bundleMisses", stats.Bundles.Misses,
+		"bundlesEvicted", stats.Bundles.Evicted,
+	)
+}
+
+// isDeploymentTombstone tells whether the record only remains to remember a removal, its cache
+// entry is kept as it is and not expected to be servable
+func isDeploymentTombstone(record *database.DeploymentRecord) bool {
+	// a blocked removal keeps the workload running, the deployment may come back
+	if isRemovalBlocked(record) {
+		return false
+	}
+	if record.Phase == "REMOVING" || record.Phase == "REMOVED" {
+		return true
+	}
+	if record.DesiredState == nil {
+		return false
+	}
+	state := record.DesiredState.Status.Status.State
+	return state == sbi.DeploymentStatusManifestStatusStateRemoving || state == sbi.DeploymentStatusManifestStatusStateRemoved
+}
+
+// reconcileCaches cross-checks the sbi client caches against the digests recorded in the database.
+// Cache entries of deployments the database no longer knows are removed, entries the database
+// expects but the cache cannot serve are invalidated so the first sync fetches them unconditionally,
+// and the recorded bundle digest is dropped when the bundle is no longer cached.
+func reconcileCaches(db database.DatabaseIfc, client cacheReconciler, budget time.Duration, log *zap.SugaredLogger) (wfm.CacheReconcileSummary, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+	defer cancel()
+
+	expected := wfm.CacheExpectations{Deployments: map[string]string{}}
+	if settings, err := db.GetDeviceSettings(); err == nil && settings != nil {
+		expected.DeviceClientId = settings.DeviceClientId
+		expected.BundleDigest = settings.LastSyncedBundleDigest
+	}
+	for _, record := range db.ListDeployments() {
+		if isDeploymentTombstone(record) {
+			expected.Deployments[record.DeploymentID] = ""
+			continue
+		}
+		expected.Deployments[record.DeploymentID] = record.Digest
+	}
+
+	startedAt := time.Now()
+	summary, err := client.ReconcileCaches(ctx, expected)
+	if err != nil {
+		return summary, fmt.Errorf("failed to reconcile caches: %w", err)
+	}
+
+	if len(summary.Bundles.Missing) > 0 {
+		if err := db.SetLastSyncedBundleDigest(""); err != nil {
+			return summary, fmt.Errorf("failed to reset the bundle digest: %w", err)
+		}
+	}
+
+	log.Infow("Reconciled local caches with the database",
+		"duration", time.Since(startedAt),
+		"deploymentsValidated", summary.Deployments.Validated,
+		"deploymentsDeferred", summary.Deployments.Deferred,
+		"deploymentsInvalidated", summary.Deployments.Invalidated,
+		"deploymentsNotCached", len(summary.Deployments.Missing),
+		"deploymentOrphansRemoved", summary.Deployments.OrphansRemoved,
+		"bundlesValidated", summary.Bundles.Validated,
+		"bundlesInvalidated", summary.Bundles.Invalidated,
+		"bundlesNotCached", len(summary.Bundles.Missing),
+		"bundleOrphansRemoved", summary.Bundles.OrphansRemoved,
+	)
+	return summary, nil
+}
+
+// ReconcileCaches runs the cache consistency pass on demand, e.g. after the cache directory was
+// cleaned up by hand while the agent is running
+func (a *Agent) ReconcileCaches() (wfm.CacheReconcileSummary, error) {
+	summary, err := reconcileCaches(a.database, a.cacheReconciler, cacheReconcileBudget, a.log)
+	a.cacheHealth.record(summary, err)
+	return summary, err
+}
+
+// cacheHealth reports the outcome of the last cache reconciliation
+type cacheHealth struct {
+	mu         sync.Mutex
+	reconciled bool
+	summary    wfm.CacheReconcileSummary
+	err        error
+}
+
+func (c *cacheHealth) record(summary wfm.CacheReconcileSummary, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconciled = true
+	c.summary = summary
+	c.err = err
+}
+
+func (c *cacheHealth) Name() string {
+	return health.ComponentCache
+}
+
+// Health is degraded when the caches could not be reconciled, the client then falls back to
+// unconditional fetches. Invalidated entries are only shown in the metrics, they are refetched.
+func (c *cacheHealth) Health() health.Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.reconciled {
+		return health.OK(nil)
+	}
+	report := health.OK(map[string]float64{
+		"entriesValidated":   float64(c.summary.Deployments.Validated + c.summary.Bundles.Validated),
+		"entriesDeferred":    float64(c.summary.Deployments.Deferred + c.summary.Bundles.Deferred),
+		"entriesInvalidated": float64(c.summary.Deployments.Invalidated + c.summary.Bundles.Invalidated),
+		"orphansRemoved":     float64(c.summary.Deployments.OrphansRemoved + c.summary.Bundles.OrphansRemoved),
+	})
+	if c.err != nil {
+		report.Degrade(fmt.Sprintf("cache reconciliation failed: %v", c.err))
+	}
+	return report
+}
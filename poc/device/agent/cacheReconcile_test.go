@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/margo/sandbox/shared-lib/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const (
+	testDeviceId     = "device-1234567890"
+	testDeploymentId = "deployment-1234567890"
+)
+
+var testDeploymentYAML = []byte("apiVersion: application.margo.org/v1alpha1\nkind: ApplicationDeployment\n")
+
+func testDigest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// conditionalServer serves deployment YAMLs and bundles by digest like the WFM does, answering 304
+// when the If-None-Match header matches, and records the conditional headers it received
+type conditionalServer struct {
+	t           *testing.T
+	mu          sync.Mutex
+	content     map[string][]byte
+	ifNoneMatch []string
+}
+
+func (s *conditionalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ifNoneMatch = append(s.ifNoneMatch, r.Header.Get("If-None-Match"))
+
+	digest, err := url.PathUnescape(path.Base(r.URL.EscapedPath()))
+	require.NoError(s.t, err)
+	data, found := s.content[digest]
+	switch {
+	case !found:
+		w.WriteHeader(http.StatusNotFound)
+	case r.Header.Get("If-None-Match") == fmt.Sprintf("%q", digest):
+		w.WriteHeader(http.StatusNotModified)
+	default:
+		w.Write(data)
+	}
+}
+
+func (s *conditionalServer) lastIfNoneMatch() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ifNoneMatch[len(s.ifNoneMatch)-1]
+}
+
+type cacheTestEnv struct {
+	server *conditionalServer
+	client *wfm.SbiHttpClient
+	db     *database.Database
+	cache  *cache.DeploymentCache
+}
+
+func newCacheTestEnv(t *testing.T) *cacheTestEnv {
+	t.Helper()
+	// the sbi client and database keep their files under a relative data/ directory
+	t.Chdir(t.TempDir())
+
+	server := &conditionalServer{t: t, content: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML}}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	client, err := wfm.NewSbiHTTPClient(httpServer.URL)
+	require.NoError(t, err)
+	deploymentCache, err := cache.NewDeploymentCache("data/cache")
+	require.NoError(t, err)
+
+	db := newTestDatabase(t, "data")
+	require.NoError(t, db.SetDeviceSettings(database.DeviceSettingsRecord{DeviceClientId: testDeviceId}))
+
+	return &cacheTestEnv{server: server, client: client, db: db, cache: deploymentCache}
+}
+
+func (env *cacheTestEnv) addDeployment(t *testing.T, deploymentId string) {
+	t.Helper()
+	digest := testDigest(testDeploymentYAML)
+	require.NoError(t, env.db.SetDesiredState(deploymentId, database.AppDeploymentState{Digest: &digest}))
+}
+
+func (env *cacheTestEnv) fetch(t *testing.T) {
+	t.Helper()
+	data, err := env.client.FetchDeploymentYAML(context.Background(), testDeviceId, testDeploymentId, testDigest(testDeploymentYAML))
+	require.NoError(t, err)
+	assert.Equal(t, testDeploymentYAML, data)
+}
+
+func (env *cacheTestEnv) reconcile(t *testing.T, budget time.Duration) wfm.CacheReconcileSummary {
+	t.Helper()
+	summary, err := reconcileCaches(env.db, env.client, budget, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	return summary
+}
+
+func TestReconcileCaches_ConsistentCacheKeepsConditionalRequests(t *testing.T) {
+	env := newCacheTestEnv(t)
+	env.addDeployment(t, testDeploymentId)
+	env.fetch(t)
+
+	summary := env.reconcile(t, time.Second)
+	assert.Equal(t, cache.ReconcileResult{Validated: 1}, summary.Deployments)
+
+	env.fetch(t)
+	assert.Equal(t, fmt.Sprintf("%q", testDigest(testDeploymentYAML)), env.server.lastIfNoneMatch())
+}
+
+func TestReconcileCaches_CacheWiped(t *testing.T) {
+	env := newCacheTestEnv(t)
+	env.addDeployment(t, testDeploymentId)
+	env.fetch(t)
+	require.NoError(t, os.RemoveAll("data/cache"))
+
+	summary := env.reconcile(t, time.Second)
+	assert.Equal(t, []string{testDeploymentId}, summary.Deployments.Missing)
+
+	env.fetch(t)
+	assert.Empty(t, env.server.lastIfNoneMatch(), "nothing cached, the fetch must be unconditional")
+	assert.True(t, env.cache.DeploymentExists(testDeploymentId, testDigest(testDeploymentYAML)), "the fetch refills the cache")
+}
+
+func TestReconcileCaches_CachedFileRemovedButMetadataLeft(t *testing.T) {
+	env := newCacheTestEnv(t)
+	env.addDeployment(t, testDeploymentId)
+	env.fetch(t)
+	require.NoError(t, env.cache.DeleteDeployment(testDeploymentId, testDigest(testDeploymentYAML)))
+
+	summary := env.reconcile(t, time.Second)
+	assert.Equal(t, 1, summary.Deployments.Invalidated)
+	_, err := env.cache.GetLastDeploymentDigest(testDeploymentId)
+	assert.Error(t, err, "the metadata must no longer claim the digest")
+
+	env.fetch(t)
+	assert.Empty(t, env.server.lastIfNoneMatch())
+}
+
+func TestReconcileCaches_CorruptEntry(t *testing.T) {
+	env := newCacheTestEnv(t)
+	env.addDeployment(t, testDeploymentId)
+	env.fetch(t)
+	cachedFile := filepath.Join("data/cache", string(cache.CacheTypeDeployment), testDeploymentId, testDigest(testDeploymentYAML))
+	require.NoError(t, os.WriteFile(cachedFile, []byte("tampered"), 0644))
+
+	summary := env.reconcile(t, time.Second)
+	assert.Equal(t, cache.ReconcileResult{Invalidated: 1, Missing: []string{testDeploymentId}}, summary.Deployments)
+
+	env.fetch(t)
+	assert.Empty(t, env.server.lastIfNoneMatch())
+}
+
+func TestReconcileCaches_DatabaseWipedRemovesOrphans(t *testing.T) {
+	env := newCacheTestEnv(t)
+	require.NoError(t, env.cache.StoreDeployment(testDeploymentId, testDigest(testDeploymentYAML), testDeploymentYAML))
+
+	summary := env.reconcile(t, time.Second)
+	assert.Equal(t, cache.ReconcileResult{OrphansRemoved: 1}, summary.Deployments)
+	assert.NoDirExists(t, filepath.Join("data/cache", string(cache.CacheTypeDeployment), testDeploymentId))
+}
+
+func TestReconcileCaches_OutdatedDigestsRemoved(t *testing.T) {
+	env := newCacheTestEnv(t)
+	oldYAML := []byte("kind: ApplicationDeployment\n")
+	require.NoError(t, env.cache.StoreDeployment(testDeploymentId, testDigest(oldYAML), oldYAML))
+	env.addDeployment(t, testDeploymentId)
+	env.fetch(t)
+
+	summary := env.reconcile(t, time.Second)
+	assert.Equal(t, cache.ReconcileResult{Validated: 1, OrphansRemoved: 1}, summary.Deployments)
+	assert.False(t, env.cache.DeploymentExists(testDeploymentId, testDigest(oldYAML)))
+}
+
+func TestReconcileCaches_TombstonesKeepTheirEntries(t *testing.T) {
+	env := newCacheTestEnv(t)
+	env.addDeployment(t, testDeploymentId)
+	env.fetch(t)
+	env.db.SetPhase(testDeploymentId, "REMOVED", "Removal Complete")
+	require.NoError(t, os.WriteFile(filepath.Join("data/cache", string(cache.CacheTypeDeployment), testDeploymentId, testDigest(testDeploymentYAML)), []byte("tampered"), 0644))
+
+	summary := env.reconcile(t, time.Second)
+	assert.Equal(t, cache.ReconcileResult{}, summary.Deployments, "a tombstone is neither validated nor removed")
+	assert.DirExists(t, filepath.Join("data/cache", string(cache.CacheTypeDeployment), testDeploymentId))
+}
+
+func TestReconcileCaches_BudgetExhaustedDefersVerification(t *testing.T) {
+	env := newCacheTestEnv(t)
+	env.addDeployment(t, testDeploymentId)
+	env.fetch(t)
+	cachedFile := filepath.Join("data/cache", string(cache.CacheTypeDeployment), testDeploymentId, testDigest(testDeploymentYAML))
+	require.NoError(t, os.WriteFile(cachedFile, []byte("tampered"), 0644))
+
+	summary := env.reconcile(t, 0)
+	assert.Equal(t, cache.ReconcileResult{Deferred: 1}, summary.Deployments)
+
+	// the corruption is found on first use, the client then refetches unconditionally
+	env.fetch(t)
+	env.server.mu.Lock()
+	defer env.server.mu.Unlock()
+	assert.Equal(t, []string{"", fmt.Sprintf("%q", testDigest(testDeploymentYAML)), ""}, env.server.ifNoneMatch)
+}
+
+func TestReconcileCaches_Bundles(t *testing.T) {
+	env := newCacheTestEnv(t)
+	bundleCache, err := cache.NewBundleCache("data/cache")
+	require.NoError(t, err)
+	bundle := []byte("bundle")
+	env.server.content[testDigest(bundle)] = bundle
+	require.NoError(t, bundleCache.StoreBundle("previous-device-id", testDigest(bundle), bundle))
+
+	// the database claims a bundle the cache does not hold
+	require.NoError(t, env.db.SetLastSyncedBundleDigest(testDigest(bundle)))
+
+	summary := env.reconcile(t, time.Second)
+	assert.Equal(t, 1, summary.Bundles.OrphansRemoved)
+	assert.Equal(t, []string{testDeviceId}, summary.Bundles.Missing)
+	_, err = env.db.GetLastSyncedBundleDigest()
+	assert.Error(t, err, "the bundle digest must be reset")
+	assert.False(t, bundleCache.BundleExists("previous-device-id", testDigest(bundle)))
+
+	// with a cached bundle matching the database nothing changes
+	require.NoError(t, bundleCache.StoreBundle(testDeviceId, testDigest(bundle), bundle))
+	require.NoError(t, env.db.SetLastSyncedBundleDigest(testDigest(bundle)))
+	summary = env.reconcile(t, time.Second)
+	assert.Equal(t, cache.ReconcileResult{Validated: 1}, summary.Bundles)
+
+	data, err := env.client.DownloadBundle(context.Background(), testDeviceId, testDigest(bundle))
+	require.NoError(t, err)
+	assert.Equal(t, bundle, data)
+	assert.True(t, strings.HasPrefix(env.server.lastIfNoneMatch(), `"sha256:`))
+}
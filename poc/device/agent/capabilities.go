@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"go.uber.org/zap"
+)
+
+// capabilityProbeTimeout bounds every probe, a runtime that hangs does not hold up the report
+const capabilityProbeTimeout = 10 * time.Second
+
+// HostCapabilities are the resources of the device the agent runs on, zero when unknown
+type HostCapabilities struct {
+	CPUCores     int
+	Arch         string
+	MemoryBytes  uint64
+	StorageBytes uint64
+}
+
+// CapabilityProbes detect what the device and its runtimes can do. A nil probe detects nothing, a
+// failing one is logged and leaves the values it could not read undetected.
+type CapabilityProbes struct {
+	// Host reads the cpu, architecture, memory and storage of the device
+	Host func(ctx context.Context) (HostCapabilities, error)
+	// Kubernetes returns the version of the kubernetes api server
+	Kubernetes func(ctx context.Context) (string, error)
+	// Helm checks that the helm releases can be listed
+	Helm func(ctx context.Context) error
+	// Compose returns the version of docker compose v2
+	Compose func(ctx context.Context) (string, error)
+}
+
+// RuntimeCapabilityProbes probes the device and the runtimes of the clients, nil clients are not probed
+func RuntimeCapabilityProbes(helmClient *workloads.HelmClient, composeClient *workloads.DockerComposeCliClient) CapabilityProbes {
+	probes := CapabilityProbes{Host: probeHost}
+	if helmClient != nil {
+		probes.Kubernetes = helmClient.KubernetesVersion
+		probes.Helm = func(ctx context.Context) error {
+			_, err := helmClient.ListReleases(ctx, "")
+			return err
+		}
+	}
+	if composeClient != nil {
+		probes.Compose = composeClient.ComposeVersion
+	}
+	return probes
+}
+
+type capabilityOptions struct {
+	probes CapabilityProbes
+	log    *zap.SugaredLogger
+}
+
+// CapabilityOption configures DetectCapabilities
+type CapabilityOption func(*capabilityOptions)
+
+// WithCapabilityProbes replaces the probes, by default only the device itself is probed
+func WithCapabilityProbes(probes CapabilityProbes) CapabilityOption {
+	return func(opts *capabilityOptions) {
+		opts.probes = probes
+	}
+}
+
+// WithCapabilityLogger logs the detected capabilities and the failed probes
+func WithCapabilityLogger(log *zap.SugaredLogger) CapabilityOption {
+	return func(opts *capabilityOptions) {
+		opts.log = log
+	}
+}
+
+// DetectCapabilities returns the capabilities to report to the WFM: the capabilities file of the
+// configuration with the detected cpu cores, memory, storage and roles filled in where the file
+// leaves them unset. A kubernetes runtime whose releases can be listed makes the device a
+// standalone cluster, an available docker compose v2 a standalone device. With detection disabled
+// the file is returned as it is.
+func DetectCapabilities(ctx context.Context, cfg types.Config, opts ...CapabilityOption) (*sbi.DeviceCapabilitiesManifest, error) {
+	options := capabilityOptions{probes: CapabilityProbes{Host: probeHost}, log: zap.NewNop().Sugar()}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	capabilities := &sbi.DeviceCapabilitiesManifest{ApiVersion: "device.margo/v1", Kind: sbi.DeviceCapabilities}
+	if cfg.Capabilities.ReadFromFile != "" {
+		static, err := types.LoadCapabilities(cfg.Capabilities.ReadFromFile)
+		if err != nil {
+			return nil, err
+		}
+		capabilities = static
+	}
+	if cfg.Capabilities.DisableDetection {
+		return capabilities, nil
+	}
+
+	probes := options.probes
+	var host HostCapabilities
+	if probes.Host != nil {
+		probeCtx, cancel := context.WithTimeout(ctx, capabilityProbeTimeout)
+		detected, err := probes.Host(probeCtx)
+		cancel()
+		if err != nil {
+			options.log.Warnw("Failed to detect the resources of the device", "error", err)
+		}
+		host = detected
+	}
+
+	var roles []sbi.DeviceCapabilitiesManifestPropertiesRoles
+	kubernetesVersion, err := probeKubernetes(ctx, probes)
+	if err != nil {
+		options.log.Warnw("The kubernetes runtime is not usable, the device is not reported as a cluster", "error", err)
+	} else if kubernetesVersion != "" {
+		roles = append(roles, sbi.StandaloneCluster)
+	}
+	var composeVersion string
+	if probes.Compose != nil {
+		probeCtx, cancel := context.WithTimeout(ctx, capabilityProbeTimeout)
+		composeVersion, err = probes.Compose(probeCtx)
+		cancel()
+		if err != nil {
+			options.log.Warnw("Docker compose v2 is not usable, the device is not reported as a standalone device", "error", err)
+		} else {
+			roles = append(roles, sbi.StandaloneDevice)
+		}
+	}
+
+	resources := &capabilities.Properties.Resources
+	if resources.Cpu.Cores == nil && host.CPUCores > 0 {
+		cores := float32(host.CPUCores)
+		resources.Cpu.Cores = &cores
+	}
+	if resources.Memory == "" && host.MemoryBytes > 0 {
+		resources.Memory = formatCapacity(host.MemoryBytes)
+	}
+	if resources.Storage == "" && host.StorageBytes > 0 {
+		resources.Storage = formatCapacity(host.StorageBytes)
+	}
+	if len(capabilities.Properties.Roles) == 0 {
+		capabilities.Properties.Roles = roles
+	}
+
+	options.log.Infow("Detected the device capabilities",
+		"arch", host.Arch, "kubernetesVersion", kubernetesVersion, "composeVersion", composeVersion,
+		"cpuCores", resources.Cpu.Cores, "memory", resources.Memory, "storage", resources.Storage,
+		"roles", capabilities.Properties.Roles)
+	return capabilities, nil
+}
+
+// probeKubernetes returns the version of a kubernetes runtime whose helm releases can be listed, an
+// empty version when no kubernetes runtime is probed
+func probeKubernetes(ctx context.Context, probes CapabilityProbes) (string, error) {
+	if probes.Kubernetes == nil {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, capabilityProbeTimeout)
+	defer cancel()
+	version, err := probes.Kubernetes(ctx)
+	if err != nil {
+		return "", err
+	}
+	if probes.Helm != nil {
+		if err := probes.Helm(ctx); err != nil {
+			return "", fmt.Errorf("failed to list the helm releases: %w", err)
+		}
+	}
+	return version, nil
+}
+
+// formatCapacity formats bytes as a kubernetes quantity rounded down to whole Gi, or Mi below a Gi
+func formatCapacity(bytes uint64) string {
+	if bytes >= 1<<30 {
+		return fmt.Sprintf("%dGi", bytes>>30)
+	}
+	return fmt.Sprintf("%dMi", bytes>>20)
+}
+
+// probeHost reads the resources of the device, the storage is the one of the working directory the
+// agent keeps its data in
+func probeHost(ctx context.Context) (HostCapabilities, error) {
+	host := HostCapabilities{CPUCores: runtime.NumCPU(), Arch: runtime.GOARCH}
+	memory, err := hostMemoryBytes()
+	if err != nil {
+		return host, err
+	}
+	host.MemoryBytes = memory
+	storage, err := hostStorageBytes(".")
+	if err != nil {
+		return host, err
+	}
+	host.StorageBytes = storage
+	return host, nil
+}
+
+// hostMemoryBytes reads the total memory from /proc/meminfo
+func hostMemoryBytes() (uint64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the memory of the device: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid MemTotal %q: %w", fields[1], err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("no MemTotal in /proc/meminfo")
+}
+
+// reportCapabilities detects the capabilities and reports them to the WFM
+func (a *Agent) reportCapabilities(deviceId string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	capabilities, err := DetectCapabilities(ctx, a.config, WithCapabilityProbes(a.capabilityProbes), WithCapabilityLogger(a.log))
+	if err != nil {
+		a.log.Errorw("Failed to load the capabilities file, the capabilities are not reported until it is fixed", "error", err)
+		return
+	}
+	capabilities.Properties.Id = deviceId
+	a.auth.ReportCapabilities(ctx, *capabilities)
+}
+
+// runCapabilityReports reports the capabilities again every interval until stop is closed
+func (a *Agent) runCapabilityReports(deviceId string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			a.reportCapabilities(deviceId)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// hostStorageBytes returns the size of the filesystem the path is on
+func hostStorageBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("failed to read the storage of the device: %w", err)
+	}
+	return stat.Blocks * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// hostStorageBytes is only implemented on linux
+func hostStorageBytes(path string) (uint64, error) {
+	return 0, fmt.Errorf("detecting the storage of the device is not supported on this platform")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeCapabilityProbes() CapabilityProbes {
+	return CapabilityProbes{
+		Host: func(ctx context.Context) (HostCapabilities, error) {
+			return HostCapabilities{CPUCores: 8, Arch: "arm64", MemoryBytes: 16 << 30, StorageBytes: 512 << 30}, nil
+		},
+		Kubernetes: func(ctx context.Context) (string, error) { return "v1.33.2", nil },
+		Helm:       func(ctx context.Context) error { return nil },
+		Compose:    func(ctx context.Context) (string, error) { return "2.39.2", nil },
+	}
+}
+
+func writeCapabilitiesFile(t *testing.T, content string) types.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "capabilities.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return types.Config{Capabilities: types.CapabilitiesDiscoveryConfig{ReadFromFile: path}}
+}
+
+func TestDetectCapabilities(t *testing.T) {
+	capabilities, err := DetectCapabilities(context.Background(), types.Config{}, WithCapabilityProbes(fakeCapabilityProbes()))
+	require.NoError(t, err)
+
+	assert.Equal(t, "device.margo/v1", capabilities.ApiVersion)
+	assert.Equal(t, sbi.DeviceCapabilities, capabilities.Kind)
+	require.NotNil(t, capabilities.Properties.Resources.Cpu.Cores)
+	assert.Equal(t, float32(8), *capabilities.Properties.Resources.Cpu.Cores)
+	assert.Equal(t, "16Gi", capabilities.Properties.Resources.Memory)
+	assert.Equal(t, "512Gi", capabilities.Properties.Resources.Storage)
+	assert.Equal(t, []sbi.DeviceCapabilitiesManifestPropertiesRoles{sbi.StandaloneCluster, sbi.StandaloneDevice},
+		capabilities.Properties.Roles)
+}
+
+func TestDetectCapabilities_StaticFileWins(t *testing.T) {
+	cfg := writeCapabilitiesFile(t, `{
+		"apiVersion": "device.margo/v1",
+		"kind": "DeviceCapabilities",
+		"properties": {"vendor": "Northstar", "roles": ["Cluster Leader"], "resources": {"cpu": {"cores": 4}}}
+	}`)
+
+	capabilities, err := DetectCapabilities(context.Background(), cfg, WithCapabilityProbes(fakeCapabilityProbes()))
+	require.NoError(t, err)
+
+	assert.Equal(t, "Northstar", capabilities.Properties.Vendor)
+	assert.Equal(t, float32(4), *capabilities.Properties.Resources.Cpu.Cores, "the cores set in the file win")
+	assert.Equal(t, []sbi.DeviceCapabilitiesManifestPropertiesRoles{sbi.ClusterLeader}, capabilities.Properties.Roles)
+	assert.Equal(t, "16Gi", capabilities.Properties.Resources.Memory, "the memory left unset in the file is detected")
+
+	cfg.Capabilities.DisableDetection = true
+	capabilities, err = DetectCapabilities(context.Background(), cfg, WithCapabilityProbes(fakeCapabilityProbes()))
+	require.NoError(t, err)
+	assert.Empty(t, capabilities.Properties.Resources.Memory, "without detection the file is reported as it is")
+
+	_, err = DetectCapabilities(context.Background(), writeCapabilitiesFile(t, "{"))
+	assert.ErrorContains(t, err, "failed to parse capabilities")
+}
+
+func TestDetectCapabilities_UnusableRuntimes(t *testing.T) {
+	probes := fakeCapabilityProbes()
+	probes.Helm = func(ctx context.Context) error { return errors.New("forbidden") }
+	probes.Compose = func(ctx context.Context) (string, error) { return "", errors.New("docker compose v2 not available") }
+	probes.Host = func(ctx context.Context) (HostCapabilities, error) {
+		return HostCapabilities{CPUCores: 2}, errors.New("no MemTotal in /proc/meminfo")
+	}
+
+	capabilities, err := DetectCapabilities(context.Background(), types.Config{}, WithCapabilityProbes(probes))
+	require.NoError(t, err, "failed probes only leave their values undetected")
+
+	assert.Empty(t, capabilities.Properties.Roles, "a cluster whose releases cannot be listed is not reported")
+	assert.Equal(t, float32(2), *capabilities.Properties.Resources.Cpu.Cores)
+	assert.Empty(t, capabilities.Properties.Resources.Memory)
+}
+
+func TestFormatCapacity(t *testing.T) {
+	assert.Equal(t, "1Gi", formatCapacity(1<<30+1<<29))
+	assert.Equal(t, "512Mi", formatCapacity(512<<20))
+}
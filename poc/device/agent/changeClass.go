@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// versionSelectingWords mark parameter targets that likely pick an image, a chart or a version, a
+// change of their value is not just a configuration change
+var versionSelectingWords = []string{"image", "repository", "registry", "version", "revision", "digest", "chart"}
+
+// classifyChange tells how a new desired state differs from the previous one. It is a values change
+// only when nothing but the values of parameters changed and none of them looks like it selects an
+// image or a version. Everything the classification is not sure about counts as a full change.
+func classifyChange(previous *sbi.AppDeploymentManifest, next sbi.AppDeploymentManifest) database.ChangeClass {
+	if previous == nil {
+		return database.ChangeClassInitial
+	}
+
+	// the components, the profile, the metadata and which parameters exist with which targets
+	previousStructure, err := manifestStructure(*previous)
+	if err != nil {
+		return database.ChangeClassFull
+	}
+	nextStructure, err := manifestStructure(next)
+	if err != nil {
+		return database.ChangeClassFull
+	}
+	if !reflect.DeepEqual(previousStructure, nextStructure) {
+		return database.ChangeClassFull
+	}
+
+	changed, err := changedParameters(previous.Spec.Parameters, next.Spec.Parameters)
+	if err != nil {
+		return database.ChangeClassFull
+	}
+	if len(changed) == 0 {
+		return database.ChangeClassNone
+	}
+	for _, parameter := range changed {
+		for _, target := range parameter.Targets {
+			if selectsVersion(target.Pointer) {
+				return database.ChangeClassFull
+			}
+		}
+	}
+	return database.ChangeClassValues
+}
+
+// manifestStructure is the manifest without the values of its parameters, as generic JSON so that
+// the raw component definitions compare by content rather than by formatting
+func manifestStructure(manifest sbi.AppDeploymentManifest) (interface{}, error) {
+	if manifest.Spec.Parameters != nil {
+		withoutValues := make(sbi.AppDeploymentParams, len(*manifest.Spec.Parameters))
+		for name, parameter := range *manifest.Spec.Parameters {
+			parameter.Value = nil
+			withoutValues[name] = parameter
+		}
+		manifest.Spec.Parameters = &withoutValues
+	}
+	return normalizedJSON(manifest)
+}
+
+// changedParameters returns the parameters whose value differs, both sets have the same parameters
+func changedParameters(previous, next *sbi.AppDeploymentParams) ([]sbi.AppParameterValue, error) {
+	if previous == nil || next == nil {
+		return nil, nil
+	}
+	var changed []sbi.AppParameterValue
+	for name, parameter := range *next {
+		previousValue, err := normalizedJSON((*previous)[name].Value)
+		if err != nil {
+			return nil, err
+		}
+		nextValue, err := normalizedJSON(parameter.Value)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(previousValue, nextValue) {
+			changed = append(changed, parameter)
+		}
+	}
+	return changed, nil
+}
+
+func normalizedJSON(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// selectsVersion reports whether a parameter pointer like "image.tag" or "ENV.APP_VERSION" likely
+// selects what runs rather than how it is configured
+func selectsVersion(pointer string) bool {
+	segments := strings.FieldsFunc(strings.ToLower(pointer), func(r rune) bool { return r == '.' || r == '/' })
+	for _, segment := range segments {
+		if strings.HasSuffix(segment, "tag") {
+			return true
+		}
+		for _, word := range versionSelectingWords {
+			if strings.Contains(segment, word) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// baseChangeManifest is a helm deployment with a configuration and an image parameter
+const baseChangeManifest = `{
+	"apiVersion": "application.margo.org/v1alpha1",
+	"kind": "ApplicationDeployment",
+	"metadata": {"name": "digitron"},
+	"spec": {
+		"deploymentProfile": {
+			"type": "helm.v3",
+			"components": [
+				{"name": "digitron", "properties": {"repository": "oci://registry.local/charts/digitron", "revision": "1.2.0"}}
+			]
+		},
+		"parameters": {
+			"greeting": {"value": "hello", "targets": [{"pointer": "settings.greeting", "components": ["digitron"]}]},
+			"tag": {"value": "1.2.0", "targets": [{"pointer": "image.tag", "components": ["digitron"]}]}
+		}
+	}
+}`
+
+func changeManifest(t *testing.T, replacements ...string) sbi.AppDeploymentManifest {
+	t.Helper()
+	var manifest sbi.AppDeploymentManifest
+	require.NoError(t, json.Unmarshal([]byte(strings.NewReplacer(replacements...).Replace(baseChangeManifest)), &manifest))
+	return manifest
+}
+
+func TestClassifyChange(t *testing.T) {
+	tests := []struct {
+		name         string
+		replacements []string
+		want         database.ChangeClass
+	}{
+		{
+			name: "same content",
+			want: database.ChangeClassNone,
+		},
+		{
+			name:         "parameter value only",
+			replacements: []string{`"value": "hello"`, `"value": {"text": "bonjour", "repeat": 2}`},
+			want:         database.ChangeClassValues,
+		},
+		{
+			name:         "chart revision bump",
+			replacements: []string{`"revision": "1.2.0"`, `"revision": "1.3.0"`},
+			want:         database.ChangeClassFull,
+		},
+		{
+			name:         "chart repository change",
+			replacements: []string{`charts/digitron"`, `charts/digitron-ng"`},
+			want:         database.ChangeClassFull,
+		},
+		{
+			name: "component added",
+			replacements: []string{`"revision": "1.2.0"}}`,
+				`"revision": "1.2.0"}}, {"name": "cache", "properties": {"repository": "oci://registry.local/charts/redis"}}`},
+			want: database.ChangeClassFull,
+		},
+		{
+			name:         "image tag parameter",
+			replacements: []string{`"value": "1.2.0"`, `"value": "1.3.0"`},
+			want:         database.ChangeClassFull,
+		},
+		{
+			name:         "parameter retargeted",
+			replacements: []string{`"pointer": "settings.greeting"`, `"pointer": "settings.motd"`},
+			want:         database.ChangeClassFull,
+		},
+		{
+			name: "parameter added",
+			replacements: []string{`"parameters": {`,
+				`"parameters": {"motd": {"value": "hi", "targets": [{"pointer": "settings.motd", "components": ["digitron"]}]},`},
+			want: database.ChangeClassFull,
+		},
+		{
+			name:         "profile type changed",
+			replacements: []string{`"type": "helm.v3"`, `"type": "compose"`},
+			want:         database.ChangeClassFull,
+		},
+		{
+			name:         "metadata changed along with a value",
+			replacements: []string{`"value": "hello"`, `"value": "bonjour"`, `"name": "digitron"}`, `"name": "digitron", "annotations": {"team": "ops"}}`},
+			want:         database.ChangeClassFull,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := changeManifest(t)
+			assert.Equal(t, tt.want, classifyChange(&previous, changeManifest(t, tt.replacements...)))
+		})
+	}
+}
+
+func TestClassifyChange_Initial(t *testing.T) {
+	assert.Equal(t, database.ChangeClassInitial, classifyChange(nil, changeManifest(t)))
+}
+
+func TestClassifyChange_ParametersRemoved(t *testing.T) {
+	previous := changeManifest(t)
+	next := changeManifest(t)
+	next.Spec.Parameters = nil
+	assert.Equal(t, database.ChangeClassFull, classifyChange(&previous, next))
+}
+
+func TestSelectsVersion(t *testing.T) {
+	for _, pointer := range []string{"image.tag", "image", "ENV.APP_VERSION", "global.imageRegistry", "chart.revision", "ENV.IMAGE_DIGEST", "sidecar.imageTag"} {
+		assert.True(t, selectsVersion(pointer), pointer)
+	}
+	for _, pointer := range []string{"settings.pollFrequency", "ENV.MYSQL_DATABASE", "ENV.MYSQL_USER", "replicaCount"} {
+		assert.False(t, selectsVersion(pointer), pointer)
+	}
+}
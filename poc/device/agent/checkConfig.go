@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/types"
+	httputils "github.com/margo/sandbox/shared-lib/http"
+)
+
+// checkConfig validates the agent configuration and verifies that the WFM is reachable, without
+// onboarding or starting any component. Every problem found is written to out with a hint on how to fix it.
+func checkConfig(configPath string, out io.Writer) error {
+	cfg, err := types.LoadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(out, "[FAIL] configuration %s: %v\n", configPath, err)
+		return err
+	}
+	fmt.Fprintf(out, "[ OK ] configuration %s is valid\n", configPath)
+	fmt.Fprintf(out, "[ OK ] wfm sbi url: %s\n", cfg.Wfm.SbiURL)
+	for _, warning := range cfg.Warnings {
+		fmt.Fprintf(out, "[WARN] %s\n", warning)
+	}
+
+	sbiURL, err := url.Parse(cfg.Wfm.SbiURL)
+	if err != nil {
+		fmt.Fprintf(out, "[FAIL] wfm sbi url: %v\n", err)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	host := sbiURL.Hostname()
+	if net.ParseIP(host) == nil {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			fmt.Fprintf(out, "[FAIL] cannot resolve wfm host %s: %v, check the hostname and the device's dns settings\n", host, err)
+			return err
+		}
+		fmt.Fprintf(out, "[ OK ] wfm host %s resolves to %v\n", host, addrs)
+	}
+
+	client, err := newProbeClient(cfg)
+	if err != nil {
+		fmt.Fprintf(out, "[FAIL] %v\n", err)
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.Wfm.SbiURL, nil)
+	if err != nil {
+		fmt.Fprintf(out, "[FAIL] cannot build probe request: %v\n", err)
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(out, "[FAIL] wfm is not reachable at %s: %v\n", cfg.Wfm.SbiURL, err)
+		fmt.Fprintf(out, "       %s\n", probeHint(err))
+		return err
+	}
+	resp.Body.Close()
+
+	// any http answer proves reachability, the probe is unauthenticated so 401/403/404 are expected
+	fmt.Fprintf(out, "[ OK ] wfm is reachable at %s (http status %d)\n", cfg.Wfm.SbiURL, resp.StatusCode)
+	return nil
+}
+
+// newProbeClient builds an http client from the same configuration as the agent's WFM client
+func newProbeClient(cfg *types.Config) (*http.Client, error) {
+	factory, err := httputils.NewClientFactory(cfg.Wfm.HTTPClientConfig())
+	if err != nil {
+		return nil, fmt.Errorf("cannot configure the wfm http client from wfm.clientPlugins.tlsHelper / wfm.http: %w", err)
+	}
+	return factory.Client(), nil
+}
+
+// probeHint translates the most common probe failures into something actionable
+func probeHint(err error) string {
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	var opErr *net.OpError
+
+	switch {
+	case errors.As(err, &certErr):
+		return "the wfm certificate is not trusted, configure its ca under wfm.clientPlugins.tlsHelper.caKeyRef"
+	case errors.As(err, &recordErr):
+		return "the wfm did not answer with tls, check whether it serves plain http (requires wfm.allowInsecureHttp)"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "the connection timed out, check firewalls and that the wfm port is correct"
+	case errors.As(err, &opErr):
+		return "the connection failed, check that the wfm is running and listening on the configured host and port"
+	default:
+		return "check wfm.sbiUrl and the network path to the wfm"
+	}
+}
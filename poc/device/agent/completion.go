@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/margo/sandbox/standard/pkg"
+)
+
+// completionState is how far a one-shot (run-to-completion) component has come
+type completionState int
+
+const (
+	completionRunning completionState = iota
+	completionSucceeded
+	completionFailed
+)
+
+// oneShotComponentName returns the name of the deployment's component if it is declared with
+// completionPolicy OnceSuccessful
+func oneShotComponentName(appDeployment sbi.AppDeploymentManifest) (string, bool) {
+	if len(appDeployment.Spec.DeploymentProfile.Components) == 0 {
+		return "", false
+	}
+
+	component := appDeployment.Spec.DeploymentProfile.Components[0]
+	policy, err := pkg.GetComponentCompletionPolicy(component)
+	if err != nil || policy != pkg.CompletionPolicyOnceSuccessful {
+		return "", false
+	}
+
+	// helm and compose components share the name property
+	helmComp, err := component.AsHelmApplicationDeploymentProfileComponent()
+	if err != nil {
+		return "", false
+	}
+	return helmComp.Name, true
+}
+
+// oneShotAlreadyCompleted tells whether the deployment is a one-shot component that already
+// completed for the given digest, in which case it must not be run again
+func oneShotAlreadyCompleted(db database.DatabaseIfc, deploymentId string, appDeployment sbi.AppDeploymentManifest, digest *string) bool {
+	componentName, isOneShot := oneShotComponentName(appDeployment)
+	if !isOneShot || digest == nil {
+		return false
+	}
+	return db.IsComponentCompleted(deploymentId, componentName, *digest)
+}
+
+// composeCompletionState evaluates a run-to-completion compose project: it has completed once
+// every service exited with code 0, and failed as soon as one service exited with another code
+func composeCompletionState(status *workloads.ComposeStatus) (completionState, string) {
+	if status == nil || len(status.Services) == 0 {
+		return completionRunning, "no containers created yet"
+	}
+
+	exited := 0
+	for _, service := range status.Services {
+		if service.State != "exited" && service.State != "dead" {
+			continue
+		}
+		if service.ExitCode != 0 {
+			return completionFailed, fmt.Sprintf("service %s exited with code %d", service.Name, service.ExitCode)
+		}
+		exited++
+	}
+
+	if exited == len(status.Services) {
+		return completionSucceeded, "all services exited successfully"
+	}
+	return completionRunning, fmt.Sprintf("%d of %d services completed", exited, len(status.Services))
+}
+
+// helmCompletionState evaluates a run-to-completion helm release through the Jobs it created
+func helmCompletionState(jobs *workloads.ReleaseJobsState) (completionState, string) {
+	switch {
+	case jobs == nil || jobs.Total == 0:
+		return completionRunning, "no jobs created yet"
+	case jobs.Failed > 0:
+		return completionFailed, jobs.FailureMessage
+	case jobs.Completed():
+		return completionSucceeded, "all jobs completed"
+	default:
+		return completionRunning, fmt.Sprintf("%d of %d jobs completed", jobs.Succeeded, jobs.Total)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newOneShotComposeDeployment(t *testing.T, completionPolicy string) sbi.AppDeploymentManifest {
+	t.Helper()
+	manifest := `{
+		"apiVersion": "application.margo.org/v1alpha1",
+		"kind": "ApplicationDeployment",
+		"metadata": {"name": "db-migration"},
+		"spec": {
+			"deploymentProfile": {
+				"type": "compose",
+				"components": [{
+					"name": "migrate",
+					"properties": {"packageLocation": "https://example.com/compose.yaml", "completionPolicy": "` + completionPolicy + `"}
+				}]
+			}
+		}
+	}`
+	var appDeployment sbi.AppDeploymentManifest
+	require.NoError(t, json.Unmarshal([]byte(manifest), &appDeployment))
+	return appDeployment
+}
+
+func TestComposeCompletionState(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []workloads.ServiceStatus
+		want     completionState
+	}{
+		{
+			name: "no containers yet",
+			want: completionRunning,
+		},
+		{
+			name:     "still running",
+			services: []workloads.ServiceStatus{{Name: "migrate", State: "running"}},
+			want:     completionRunning,
+		},
+		{
+			name:     "exit 0",
+			services: []workloads.ServiceStatus{{Name: "migrate", State: "exited", ExitCode: 0}},
+			want:     completionSucceeded,
+		},
+		{
+			name:     "exit 1",
+			services: []workloads.ServiceStatus{{Name: "migrate", State: "exited", ExitCode: 1}},
+			want:     completionFailed,
+		},
+		{
+			name: "one service still running",
+			services: []workloads.ServiceStatus{
+				{Name: "migrate", State: "exited", ExitCode: 0},
+				{Name: "seed", State: "running"},
+			},
+			want: completionRunning,
+		},
+		{
+			name: "one service failed while another runs",
+			services: []workloads.ServiceStatus{
+				{Name: "migrate", State: "exited", ExitCode: 2},
+				{Name: "seed", State: "running"},
+			},
+			want: completionFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, message := composeCompletionState(&workloads.ComposeStatus{Services: tt.services})
+			assert.Equal(t, tt.want, state, message)
+		})
+	}
+}
+
+func TestHelmCompletionState(t *testing.T) {
+	state, _ := helmCompletionState(&workloads.ReleaseJobsState{Total: 1, Succeeded: 1})
+	assert.Equal(t, completionSucceeded, state)
+
+	state, message := helmCompletionState(&workloads.ReleaseJobsState{Total: 1, Failed: 1, FailureMessage: "job migrate failed: BackoffLimitExceeded"})
+	assert.Equal(t, completionFailed, state)
+	assert.Equal(t, "job migrate failed: BackoffLimitExceeded", message)
+
+	state, _ = helmCompletionState(&workloads.ReleaseJobsState{Total: 2, Succeeded: 1})
+	assert.Equal(t, completionRunning, state)
+}
+
+func TestOneShotComponentName(t *testing.T) {
+	name, isOneShot := oneShotComponentName(newOneShotComposeDeployment(t, "OnceSuccessful"))
+	assert.True(t, isOneShot)
+	assert.Equal(t, "migrate", name)
+
+	_, isOneShot = oneShotComponentName(newOneShotComposeDeployment(t, ""))
+	assert.False(t, isOneShot)
+}
+
+func TestOneShotAlreadyCompleted_DigestChange(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := newTestDatabase(t, "data")
+
+	const deploymentId = "5f0c3a2e-6c1d-4f1e-9a55-000000000001"
+	oldDigest := "sha256:1111"
+	newDigest := "sha256:2222"
+
+	appDeployment := newOneShotComposeDeployment(t, "OnceSuccessful")
+	require.NoError(t, db.SetDesiredState(deploymentId, database.AppDeploymentState{
+		AppDeploymentManifest: appDeployment,
+		Digest:                &oldDigest,
+		LastUpdated:           time.Now(),
+	}))
+
+	assert.False(t, oneShotAlreadyCompleted(db, deploymentId, appDeployment, &oldDigest), "not completed yet")
+
+	db.MarkComponentCompleted(deploymentId, "migrate", oldDigest)
+	assert.True(t, oneShotAlreadyCompleted(db, deploymentId, appDeployment, &oldDigest), "completed for the same digest")
+	assert.False(t, oneShotAlreadyCompleted(db, deploymentId, appDeployment, &newDigest), "a new digest runs again")
+
+	regular := newOneShotComposeDeployment(t, "")
+	assert.False(t, oneShotAlreadyCompleted(db, deploymentId, regular, &oldDigest), "regular components are never skipped")
+}
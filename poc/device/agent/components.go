@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/margo/sandbox/poc/device/agent/breaker"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// componentDeployer installs or updates one component of a deployment, a helm release or a compose
+// project, and adds the images it runs with to images
+type componentDeployer func(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item, images *deploymentImages) error
+
+// componentRemover removes what one component of a deployment installed
+type componentRemover func(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item) error
+
+// deploymentImages collects the images the components of a deployment run with
+type deploymentImages struct {
+	references []string
+	err        error
+}
+
+func (i *deploymentImages) add(references []string, err error) {
+	if err != nil {
+		i.err = err
+		return
+	}
+	i.references = append(i.references, references...)
+}
+
+// componentFailure is a component that could not be deployed
+type componentFailure struct {
+	Component string
+	Err       error
+}
+
+// componentsDeployError is returned when some components of a multi-component deployment failed,
+// it tells which ones and which were installed nevertheless
+type componentsDeployError struct {
+	Failed    []componentFailure
+	Installed []string
+}
+
+func (e *componentsDeployError) Error() string {
+	return e.message("")
+}
+
+func (e *componentsDeployError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, failure := range e.Failed {
+		errs = append(errs, failure.Err)
+	}
+	return errs
+}
+
+// message describes every failure like a single component failure of the profile type would be
+func (e *componentsDeployError) message(profileType sbi.AppDeploymentProfileType) string {
+	failures := make([]string, 0, len(e.Failed))
+	for _, failure := range e.Failed {
+		reason := failure.Err.Error()
+		if profileType != "" {
+			reason = deploymentFailureMessage(profileType, failure.Err)
+		}
+		failures = append(failures, fmt.Sprintf("component %s: %s", failure.Component, reason))
+	}
+	message := fmt.Sprintf("%d of %d components failed: %s", len(e.Failed), len(e.Failed)+len(e.Installed), strings.Join(failures, "; "))
+	if len(e.Installed) > 0 {
+		message += fmt.Sprintf("; installed: %s", strings.Join(e.Installed, ", "))
+	}
+	return message
+}
+
+// componentName returns the name of a component, helm and compose components share the property
+func componentName(component sbi.AppDeploymentProfile_Components_Item) string {
+	helmComp, err := component.AsHelmApplicationDeploymentProfileComponent()
+	if err != nil {
+		return ""
+	}
+	return helmComp.Name
+}
+
+// deployComponents deploys every component of the profile in order and records the status of each.
+// A failed component does not keep the others from being deployed, the failures are returned in a
+// *componentsDeployError. A profile with a single component returns its error as is. An unavailable
+// runtime stops the deployment right away, the remaining components would fail the same way.
+func (dm *DeploymentManager) deployComponents(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, deploy componentDeployer) error {
+	components := appDeployment.Spec.DeploymentProfile.Components
+	images := &deploymentImages{}
+	deployErr := &componentsDeployError{}
+
+	for _, component := range components {
+		name := componentName(component)
+		if err := ctx.Err(); err != nil {
+			deployErr.Failed = append(deployErr.Failed, componentFailure{Component: name, Err: err})
+			dm.setComponentFailed(deploymentId, name, err)
+			continue
+		}
+
+		if len(components) > 1 {
+			dm.setPhase(ctx, deploymentId, "DEPLOYING", fmt.Sprintf("Deploying component %s", name))
+		}
+		dm.database.SetComponentStatus(deploymentId, name, sbi.ComponentStatus{Name: name, State: sbi.ComponentStatusStateInstalling})
+
+		err := deploy(ctx, deploymentId, appDeployment, component, images)
+		if err != nil && breaker.IsRuntimeUnavailable(err) {
+			dm.database.SetComponentStatus(deploymentId, name, sbi.ComponentStatus{Name: name, State: sbi.ComponentStatusStatePending})
+			return err
+		}
+		if err != nil {
+			dm.log.Warnw("Component deployment failed", "deploymentId", deploymentId, "component", name, "error", err)
+			deployErr.Failed = append(deployErr.Failed, componentFailure{Component: name, Err: err})
+			dm.setComponentFailed(deploymentId, name, err)
+			continue
+		}
+		deployErr.Installed = append(deployErr.Installed, name)
+		dm.database.SetComponentStatus(deploymentId, name, sbi.ComponentStatus{Name: name, State: sbi.ComponentStatusStateInstalled})
+	}
+
+	if len(deployErr.Failed) > 0 {
+		if len(components) == 1 {
+			return deployErr.Failed[0].Err
+		}
+		return deployErr
+	}
+
+	// images of a partially failed deployment are not recorded, the previous ones may still run
+	if dm.trackImages {
+		// components of a deployment may share images
+		references := images.references
+		if len(components) > 1 {
+			slices.Sort(references)
+			references = slices.Compact(references)
+		}
+		dm.recordImages(deploymentId, appDeployment.Spec.DeploymentProfile.Type, references, images.err)
+	}
+	return nil
+}
+
+// removeComponents removes every component of the profile. A component that cannot be removed does
+// not keep the others around, all failures are returned joined.
+func (dm *DeploymentManager) removeComponents(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, remove componentRemover) error {
+	var errs []error
+	for _, component := range appDeployment.Spec.DeploymentProfile.Components {
+		if err := remove(ctx, deploymentId, appDeployment, component); err != nil {
+			errs = append(errs, fmt.Errorf("component %s: %w", componentName(component), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (dm *DeploymentManager) setComponentFailed(deploymentId, name string, err error) {
+	message := err.Error()
+	dm.database.SetComponentStatus(deploymentId, name, sbi.ComponentStatus{
+		Name:  name,
+		State: sbi.ComponentStatusStateFailed,
+		Error: &struct {
+			Code    *string `json:"code,omitempty"`
+			Message *string `json:"message,omitempty"`
+		}{Message: &message},
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// multiComponentManifest is baseChangeManifest with a database, a broker and the app itself
+func multiComponentManifest(t *testing.T) sbi.AppDeploymentManifest {
+	t.Helper()
+	return changeManifest(t,
+		`{"name": "digitron", "properties": {"repository": "oci://registry.local/charts/digitron", "revision": "1.2.0"}}`,
+		`{"name": "database", "properties": {"repository": "oci://registry.local/charts/postgres"}},
+		{"name": "broker", "properties": {"repository": "oci://registry.local/charts/mosquitto"}},
+		{"name": "digitron", "properties": {"repository": "oci://registry.local/charts/digitron", "revision": "1.2.0"}}`)
+}
+
+func newComponentsTestManager(t *testing.T, manifest sbi.AppDeploymentManifest) (*DeploymentManager, *database.Database) {
+	t.Helper()
+	db := newTestDatabase(t, t.TempDir())
+	require.NoError(t, db.SetDesiredState("deployment-multi", database.AppDeploymentState{AppDeploymentManifest: manifest}))
+	return NewDeploymentManager(db, nil, nil, zap.NewNop().Sugar()), db
+}
+
+// fakeComponentDeployer fails the named components and records the order of the deployments
+func fakeComponentDeployer(deployed *[]string, failures map[string]error) componentDeployer {
+	return func(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item, images *deploymentImages) error {
+		name := componentName(component)
+		*deployed = append(*deployed, name)
+		if err := failures[name]; err != nil {
+			return err
+		}
+		images.add([]string{"registry.local/" + name + ":1", "registry.local/shared:1"}, nil)
+		return nil
+	}
+}
+
+func TestDeployComponents_DeploysEveryComponent(t *testing.T) {
+	manifest := multiComponentManifest(t)
+	dm, db := newComponentsTestManager(t, manifest)
+	dm.trackImages = true
+
+	var deployed []string
+	require.NoError(t, dm.deployComponents(context.Background(), "deployment-multi", manifest, fakeComponentDeployer(&deployed, nil)))
+
+	assert.Equal(t, []string{"database", "broker", "digitron"}, deployed)
+	record, err := db.GetDeployment("deployment-multi")
+	require.NoError(t, err)
+	for _, name := range deployed {
+		assert.Equal(t, sbi.ComponentStatusStateInstalled, record.ComponentViseStatus[name].State, name)
+	}
+	assert.Equal(t, []string{"registry.local/broker:1", "registry.local/database:1", "registry.local/digitron:1", "registry.local/shared:1"},
+		record.Images.References)
+}
+
+func TestDeployComponents_PartialFailure(t *testing.T) {
+	manifest := multiComponentManifest(t)
+	dm, db := newComponentsTestManager(t, manifest)
+
+	var deployed []string
+	err := dm.deployComponents(context.Background(), "deployment-multi", manifest,
+		fakeComponentDeployer(&deployed, map[string]error{"broker": fmt.Errorf("chart not found")}))
+
+	// the failure does not keep the later components from being deployed
+	assert.Equal(t, []string{"database", "broker", "digitron"}, deployed)
+	var componentsErr *componentsDeployError
+	require.ErrorAs(t, err, &componentsErr)
+	assert.Equal(t, []string{"database", "digitron"}, componentsErr.Installed)
+	assert.Equal(t, "1 of 3 components failed: component broker: helm.v3 operation failed: chart not found; installed: database, digitron",
+		deploymentFailureMessage(sbi.HelmV3, err))
+
+	record, getErr := db.GetDeployment("deployment-multi")
+	require.NoError(t, getErr)
+	assert.Equal(t, sbi.ComponentStatusStateInstalled, record.ComponentViseStatus["database"].State)
+	assert.Equal(t, sbi.ComponentStatusStateFailed, record.ComponentViseStatus["broker"].State)
+	assert.Equal(t, "chart not found", *record.ComponentViseStatus["broker"].Error.Message)
+	assert.Equal(t, sbi.ComponentStatusStateInstalled, record.ComponentViseStatus["digitron"].State)
+}
+
+func TestDeployComponents_SingleComponentErrorIsKept(t *testing.T) {
+	manifest := changeManifest(t)
+	dm, _ := newComponentsTestManager(t, manifest)
+	failure := errors.New("chart not found")
+
+	var deployed []string
+	err := dm.deployComponents(context.Background(), "deployment-multi", manifest,
+		fakeComponentDeployer(&deployed, map[string]error{"digitron": failure}))
+	assert.Same(t, failure, err)
+}
+
+func TestDeployComponents_StopsWhenTheRuntimeIsUnavailable(t *testing.T) {
+	manifest := multiComponentManifest(t)
+	dm, _ := newComponentsTestManager(t, manifest)
+	unavailable := fmt.Errorf("dial kubernetes: %w", syscall.ECONNREFUSED)
+
+	var deployed []string
+	err := dm.deployComponents(context.Background(), "deployment-multi", manifest,
+		fakeComponentDeployer(&deployed, map[string]error{"broker": unavailable}))
+
+	assert.Same(t, unavailable, err)
+	assert.Equal(t, []string{"database", "broker"}, deployed)
+}
+
+func TestRemoveComponents_RemovesEveryComponent(t *testing.T) {
+	manifest := multiComponentManifest(t)
+	dm, _ := newComponentsTestManager(t, manifest)
+
+	var removed []string
+	err := dm.removeComponents(context.Background(), "deployment-multi", manifest,
+		func(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item) error {
+			name := componentName(component)
+			removed = append(removed, name)
+			if name == "database" {
+				return errors.New("release not found")
+			}
+			return nil
+		})
+
+	// a failed removal does not leak the releases of the other components
+	assert.Equal(t, []string{"database", "broker", "digitron"}, removed)
+	assert.EqualError(t, err, "component database: release not found")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// phaseDegraded marks a running compose deployment with services that are unhealthy, flapping or
+// exited with an error, or a helm deployment whose workloads did not become ready in time. It is
+// reported as failed and left again once every service or workload is healthy.
+const phaseDegraded = "DEGRADED"
+
+// Error codes of the statuses of compose services that need attention
+const (
+	serviceErrorStarting   = "SERVICE_STARTING"
+	serviceErrorUnhealthy  = "SERVICE_UNHEALTHY"
+	serviceErrorRestarting = "SERVICE_RESTARTING"
+	serviceErrorExited     = "SERVICE_EXITED"
+)
+
+// composeFlappingWindow is how long a container counts as flapping after docker restarted it, a
+// container restarting less often than the monitor checks would otherwise look healthy in between
+const composeFlappingWindow = 5 * time.Minute
+
+// restartObservation is the restart count of a container at the last check and when the monitor
+// last saw it go up
+type restartObservation struct {
+	count         int
+	lastRestartAt time.Time
+}
+
+// observeRestarts returns the restart observations of the containers, given the ones of the last
+// check. Containers seen for the first time are not taken as restarted, their count may be old.
+func observeRestarts(containers []workloads.ContainerDetails, previous map[string]restartObservation, now time.Time) map[string]restartObservation {
+	observations := make(map[string]restartObservation, len(containers))
+	for _, container := range containers {
+		observation := restartObservation{count: container.RestartCount}
+		if last, seen := previous[container.ID]; seen {
+			observation.lastRestartAt = last.lastRestartAt
+			if container.RestartCount > last.count {
+				observation.lastRestartAt = now
+			}
+		}
+		observations[container.ID] = observation
+	}
+	return observations
+}
+
+// composeServiceComponentName names the status of a service of a compose component, it is reported
+// next to the status of the component itself
+func composeServiceComponentName(componentName, service string) string {
+	return componentName + "/" + service
+}
+
+// composeServiceStatuses maps the containers of a compose component to the statuses of its
+// services, sorted by name. A service with replicas gets the status of its worst container. The
+// returned problems say why the deployment is degraded, none while every service is healthy.
+func composeServiceStatuses(componentName string, containers []workloads.ContainerDetails, observations map[string]restartObservation, now time.Time) ([]sbi.ComponentStatus, []string) {
+	byService := map[string]sbi.ComponentStatus{}
+	var problems []string
+	for _, container := range containers {
+		status := composeContainerStatus(componentName, container, observations[container.ID], now)
+		if status.State == sbi.ComponentStatusStateFailed {
+			problems = append(problems, fmt.Sprintf("service %s %s", container.Service, *status.Error.Message))
+		}
+		if current, exists := byService[container.Service]; !exists || componentStateSeverity(status.State) > componentStateSeverity(current.State) {
+			byService[container.Service] = status
+		}
+	}
+
+	statuses := make([]sbi.ComponentStatus, 0, len(byService))
+	for _, status := range byService {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	sort.Strings(problems)
+	return statuses, problems
+}
+
+// composeContainerStatus maps a container to the status of its service. Restarting, unhealthy and
+// failed containers are failed, the error carries the health, restart count and exit code.
+func composeContainerStatus(componentName string, container workloads.ContainerDetails, observation restartObservation, now time.Time) sbi.ComponentStatus {
+	status := sbi.ComponentStatus{Name: composeServiceComponentName(componentName, container.Service)}
+	flapping := !observation.lastRestartAt.IsZero() && now.Sub(observation.lastRestartAt) < composeFlappingWindow
+
+	switch {
+	case container.State == "restarting" || flapping:
+		status.State = sbi.ComponentStatusStateFailed
+		setServiceError(&status, serviceErrorRestarting, fmt.Sprintf("is restarting, %s", describeContainer(container)))
+	case container.State == "exited" || container.State == "dead":
+		if container.ExitCode == 0 {
+			// services that run to completion next to long running ones
+			status.State = sbi.ComponentStatusStateInstalled
+			break
+		}
+		status.State = sbi.ComponentStatusStateFailed
+		setServiceError(&status, serviceErrorExited, fmt.Sprintf("exited, %s", describeContainer(container)))
+	case container.Health == "unhealthy":
+		status.State = sbi.ComponentStatusStateFailed
+		setServiceError(&status, serviceErrorUnhealthy, fmt.Sprintf("is unhealthy, %s", describeContainer(container)))
+	case container.Health == "starting":
+		status.State = sbi.ComponentStatusStateInstalling
+		setServiceError(&status, serviceErrorStarting, fmt.Sprintf("is starting, %s", describeContainer(container)))
+	case container.State == "running":
+		status.State = sbi.ComponentStatusStateInstalled
+	default:
+		// created or paused
+		status.State = sbi.ComponentStatusStatePending
+	}
+	return status
+}
+
+// describeContainer sums up the health, exit code and restart count of a container
+func describeContainer(container workloads.ContainerDetails) string {
+	var parts []string
+	if container.Health != "" {
+		parts = append(parts, "health "+container.Health)
+	}
+	if container.State != "running" {
+		parts = append(parts, fmt.Sprintf("exit code %d", container.ExitCode))
+	}
+	parts = append(parts, fmt.Sprintf("%d restarts", container.RestartCount))
+	return strings.Join(parts, ", ")
+}
+
+func setServiceError(status *sbi.ComponentStatus, code, message string) {
+	status.Error = &struct {
+		Code    *string `json:"code,omitempty"`
+		Message *string `json:"message,omitempty"`
+	}{Code: &code, Message: &message}
+}
+
+// componentStateSeverity orders the states a service can have, the worse the higher
+func componentStateSeverity(state sbi.ComponentStatusState) int {
+	switch state {
+	case sbi.ComponentStatusStateFailed:
+		return 3
+	case sbi.ComponentStatusStatePending:
+		return 2
+	case sbi.ComponentStatusStateInstalling:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestComposeServiceStatuses(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		container   workloads.ContainerDetails
+		observation restartObservation
+		wantState   sbi.ComponentStatusState
+		wantCode    string
+		wantMessage string
+	}{
+		{
+			name:      "running without healthcheck",
+			container: workloads.ContainerDetails{State: "running"},
+			wantState: sbi.ComponentStatusStateInstalled,
+		},
+		{
+			name:        "healthcheck starting",
+			container:   workloads.ContainerDetails{State: "running", Health: "starting"},
+			wantState:   sbi.ComponentStatusStateInstalling,
+			wantCode:    serviceErrorStarting,
+			wantMessage: "is starting, health starting, 0 restarts",
+		},
+		{
+			name:        "unhealthy",
+			container:   workloads.ContainerDetails{State: "running", Health: "unhealthy", RestartCount: 1},
+			observation: restartObservation{count: 1},
+			wantState:   sbi.ComponentStatusStateFailed,
+			wantCode:    serviceErrorUnhealthy,
+			wantMessage: "is unhealthy, health unhealthy, 1 restarts",
+		},
+		{
+			name:        "restarting",
+			container:   workloads.ContainerDetails{State: "restarting", ExitCode: 137, RestartCount: 4},
+			wantState:   sbi.ComponentStatusStateFailed,
+			wantCode:    serviceErrorRestarting,
+			wantMessage: "is restarting, exit code 137, 4 restarts",
+		},
+		{
+			name:        "running again after a recent restart",
+			container:   workloads.ContainerDetails{State: "running", Health: "healthy", RestartCount: 5},
+			observation: restartObservation{count: 5, lastRestartAt: now.Add(-time.Minute)},
+			wantState:   sbi.ComponentStatusStateFailed,
+			wantCode:    serviceErrorRestarting,
+			wantMessage: "is restarting, health healthy, 5 restarts",
+		},
+		{
+			name:        "restarted long ago",
+			container:   workloads.ContainerDetails{State: "running", Health: "healthy", RestartCount: 5},
+			observation: restartObservation{count: 5, lastRestartAt: now.Add(-composeFlappingWindow)},
+			wantState:   sbi.ComponentStatusStateInstalled,
+		},
+		{
+			name:        "exited with an error",
+			container:   workloads.ContainerDetails{State: "exited", ExitCode: 2},
+			wantState:   sbi.ComponentStatusStateFailed,
+			wantCode:    serviceErrorExited,
+			wantMessage: "exited, exit code 2, 0 restarts",
+		},
+		{
+			name:      "exited successfully",
+			container: workloads.ContainerDetails{State: "exited"},
+			wantState: sbi.ComponentStatusStateInstalled,
+		},
+		{
+			name:      "created",
+			container: workloads.ContainerDetails{State: "created"},
+			wantState: sbi.ComponentStatusStatePending,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.container.ID = "c1"
+			tt.container.Service = "web"
+
+			statuses, problems := composeServiceStatuses("shop", []workloads.ContainerDetails{tt.container},
+				map[string]restartObservation{"c1": tt.observation}, now)
+
+			require.Len(t, statuses, 1)
+			status := statuses[0]
+			assert.Equal(t, "shop/web", status.Name)
+			assert.Equal(t, tt.wantState, status.State)
+			if tt.wantCode == "" {
+				assert.Nil(t, status.Error)
+			} else {
+				require.NotNil(t, status.Error)
+				assert.Equal(t, tt.wantCode, *status.Error.Code)
+				assert.Equal(t, tt.wantMessage, *status.Error.Message)
+			}
+			if tt.wantState == sbi.ComponentStatusStateFailed {
+				assert.Equal(t, []string{"service web " + tt.wantMessage}, problems)
+			} else {
+				assert.Empty(t, problems)
+			}
+		})
+	}
+}
+
+func TestComposeServiceStatuses_ReplicasReportTheWorstContainer(t *testing.T) {
+	containers := []workloads.ContainerDetails{
+		{ID: "c1", Service: "web", State: "running"},
+		{ID: "c2", Service: "web", State: "running", Health: "unhealthy"},
+		{ID: "c3", Service: "db", State: "running", Health: "healthy"},
+	}
+
+	statuses, problems := composeServiceStatuses("shop", containers, nil, time.Now())
+
+	require.Len(t, statuses, 2)
+	assert.Equal(t, "shop/db", statuses[0].Name)
+	assert.Equal(t, sbi.ComponentStatusStateInstalled, statuses[0].State)
+	assert.Equal(t, "shop/web", statuses[1].Name)
+	assert.Equal(t, sbi.ComponentStatusStateFailed, statuses[1].State)
+	assert.Len(t, problems, 1)
+}
+
+func TestObserveRestarts(t *testing.T) {
+	first := time.Now()
+	containers := []workloads.ContainerDetails{{ID: "c1", RestartCount: 3}}
+
+	observations := observeRestarts(containers, nil, first)
+	assert.Equal(t, restartObservation{count: 3}, observations["c1"], "restarts before the first check are not flapping")
+
+	later := first.Add(monitorInterval)
+	containers[0].RestartCount = 4
+	observations = observeRestarts(containers, observations, later)
+	assert.Equal(t, restartObservation{count: 4, lastRestartAt: later}, observations["c1"])
+
+	observations = observeRestarts(containers, observations, later.Add(monitorInterval))
+	assert.Equal(t, later, observations["c1"].lastRestartAt, "the last restart is kept")
+
+	observations = observeRestarts(nil, observations, later.Add(2*monitorInterval))
+	assert.Empty(t, observations, "removed containers are forgotten")
+}
+
+func TestDeploymentMonitor_FlappingServiceDegradesTheDeployment(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := newTestDatabase(t, "data")
+	hm := NewDeploymentMonitor(db, nil, nil, zap.NewNop().Sugar())
+
+	const deploymentId = "5f0c3a2e-6c1d-4f1e-9a55-000000000007"
+	require.NoError(t, db.SetDesiredState(deploymentId, database.AppDeploymentState{LastUpdated: time.Now()}))
+	db.SetPhase(deploymentId, "RUNNING", "Deployment successful")
+	record := func() *database.DeploymentRecord {
+		record, err := db.GetDeployment(deploymentId)
+		require.NoError(t, err)
+		return record
+	}
+
+	now := time.Now()
+	web := workloads.ContainerDetails{ID: "c1", Service: "web", State: "running", RestartCount: 2}
+	observations := map[string]restartObservation{"c1": {count: 2, lastRestartAt: now}}
+	statuses, problems := composeServiceStatuses("shop", []workloads.ContainerDetails{web}, observations, now)
+	hm.applyComposeHealth(record(), statuses, problems)
+
+	degraded := record()
+	assert.Equal(t, phaseDegraded, degraded.Phase)
+	assert.Equal(t, "Deployment degraded: service web is restarting, 2 restarts", degraded.Message)
+	assert.Equal(t, sbi.ComponentStatusStateFailed, degraded.ComponentViseStatus["shop/web"].State)
+
+	// the service settled
+	statuses, problems = composeServiceStatuses("shop", []workloads.ContainerDetails{web}, nil, now)
+	hm.applyComposeHealth(degraded, statuses, problems)
+
+	recovered := record()
+	assert.Equal(t, "RUNNING", recovered.Phase)
+	assert.Equal(t, sbi.ComponentStatusStateInstalled, recovered.ComponentViseStatus["shop/web"].State)
+	assert.Nil(t, recovered.ComponentViseStatus["shop/web"].Error)
+}
+
+func TestDeploymentMonitor_RecentComposeLogs(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := `#!/bin/sh
+case "$*" in
+	*" logs "*)
+		echo "$*" > "` + argsFile + `"
+		i=0
+		while [ $i -lt 200 ]; do echo "web-1  | line $i"; i=$((i+1)); done ;;
+esac
+exit 0
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	composeClient, err := workloads.NewDockerComposeCliClient(workloads.DockerConnectivityParams{}, filepath.Join(dir, "compose"), nil)
+	require.NoError(t, err)
+	hm := NewDeploymentMonitor(nil, nil, composeClient, zap.NewNop().Sugar())
+
+	logs := hm.recentComposeLogs(context.Background(), "deployment-a", "shop-deploymen", "web")
+
+	args, err := os.ReadFile(argsFile)
+	require.NoError(t, err)
+	assert.Equal(t, "compose -p shop-deploymen logs --no-color --tail 20 web\n", string(args))
+	assert.True(t, strings.HasPrefix(logs, "..."), "the logs are cut to their end")
+	assert.LessOrEqual(t, len(logs), maxComposeFailureLogs+3)
+	assert.True(t, strings.HasSuffix(logs, "web-1  | line 199"))
+}
+
+func TestComposeFailureLogs(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := `#!/bin/sh
+case "$*" in
+	*" logs "*)
+		echo "$*" > "` + argsFile + `"
+		echo "web-1  | listening on :8080"
+		echo "web-1  | panic: database unreachable" ;;
+esac
+exit 0
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	composeClient, err := workloads.NewDockerComposeCliClient(workloads.DockerConnectivityParams{}, filepath.Join(dir, "compose"), nil)
+	require.NoError(t, err)
+	dm := NewDeploymentManager(nil, nil, composeClient, zap.NewNop().Sugar())
+
+	composeErr := &workloads.ComposeDeployError{Class: workloads.ComposeFailureStart, Services: []workloads.ServiceResult{
+		{Service: "db", Outcome: workloads.ServicePullFailed, Reason: "denied"},
+		{Service: "web", Outcome: workloads.ServiceStartFailed, Reason: "exited with code 2"},
+	}}
+	err = dm.composeFailureLogs(context.Background(), "deployment-a", "shop-deploymen", composeErr)
+
+	require.ErrorIs(t, err, composeErr)
+	args, readErr := os.ReadFile(argsFile)
+	require.NoError(t, readErr)
+	assert.Equal(t, "compose -p shop-deploymen logs --no-color --tail 20 web\n", string(args), "only started services have logs")
+	assert.Equal(t, "CONTAINER_START_FAILED: db pull_failed: denied; web start_failed: exited with code 2, recent logs:\n"+
+		"web:\nlistening on :8080\npanic: database unreachable", deploymentFailureMessage(sbi.Compose, err))
+
+	pullErr := &workloads.ComposeDeployError{Class: workloads.ComposeFailurePull, Services: []workloads.ServiceResult{
+		{Service: "db", Outcome: workloads.ServicePullFailed},
+	}}
+	assert.Same(t, pullErr, dm.composeFailureLogs(context.Background(), "deployment-a", "shop-deploymen", pullErr))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/margo/sandbox/shared-lib/workloads"
+)
+
+// composeProgressInterval is the least time between two progress messages of a deployment, every
+// message changes the phase record and is reported to the WFM
+const composeProgressInterval = 5 * time.Second
+
+// composeProgress throttles the progress messages of a deployment: a message is recorded right away
+// when none was recorded during the interval, otherwise the last one is recorded when it ends
+type composeProgress struct {
+	interval time.Duration
+	record   func(message string)
+
+	mu          sync.Mutex
+	lastMessage string
+	pending     string
+	recordedAt  time.Time
+	timer       *time.Timer
+	stopped     bool
+}
+
+func newComposeProgress(interval time.Duration, record func(message string)) *composeProgress {
+	return &composeProgress{interval: interval, record: record}
+}
+
+// forward records the message or keeps it for the end of the interval, repeated messages are dropped
+func (p *composeProgress) forward(message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped || message == p.lastMessage {
+		return
+	}
+	p.lastMessage = message
+
+	if wait := p.interval - time.Since(p.recordedAt); wait > 0 {
+		p.pending = message
+		if p.timer == nil {
+			p.timer = time.AfterFunc(wait, p.flush)
+		}
+		return
+	}
+	p.recordLocked(message)
+}
+
+// flush records the last message kept during the interval
+func (p *composeProgress) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timer = nil
+	if p.stopped || p.pending == "" {
+		return
+	}
+	p.recordLocked(p.pending)
+}
+
+func (p *composeProgress) recordLocked(message string) {
+	p.pending = ""
+	p.recordedAt = time.Now()
+	p.record(message)
+}
+
+// stop drops the kept message, the outcome of the deployment is recorded next and must not be
+// overwritten by its progress
+func (p *composeProgress) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+// composeProgressForwarder turns compose progress events into deployment progress messages and
+// returns the function that stops it once the compose call returned. Per-layer pull progress is
+// skipped, every event is logged at debug level while the phase message follows at most once per
+// composeProgressInterval.
+func (dm *DeploymentManager) composeProgressForwarder(ctx context.Context, deploymentId string) (func(workloads.ComposeEvent), func()) {
+	progress := newComposeProgress(composeProgressInterval, func(message string) {
+		dm.setPhase(ctx, deploymentId, "DEPLOYING", message)
+	})
+	forward := func(event workloads.ComposeEvent) {
+		if event.ParentID != "" || event.ID == "" {
+			return
+		}
+		dm.log.Debugw("Docker Compose progress", "deploymentId", deploymentId, "resource", event.ID, "progress", event.Text)
+		progress.forward(strings.TrimSpace(fmt.Sprintf("%s %s", event.ID, event.Text)))
+	}
+	return forward, progress.stop
+}
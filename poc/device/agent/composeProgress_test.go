@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// recordedMessages collects what a composeProgress records
+type recordedMessages struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *recordedMessages) record(message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, message)
+}
+
+func (r *recordedMessages) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+func TestComposeProgress_RecordsTheLastMessageOfAnInterval(t *testing.T) {
+	recorded := &recordedMessages{}
+	progress := newComposeProgress(200*time.Millisecond, recorded.record)
+	defer progress.stop()
+
+	progress.forward("web Pulling")
+	progress.forward("web Pulling")
+	progress.forward("web Pulled")
+	progress.forward("web Creating")
+	assert.Equal(t, []string{"web Pulling"}, recorded.get(), "the first message is recorded right away")
+
+	assert.Eventually(t, func() bool { return len(recorded.get()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"web Pulling", "web Creating"}, recorded.get(), "the last message of the interval wins")
+
+	time.Sleep(300 * time.Millisecond)
+	progress.forward("web Started")
+	assert.Equal(t, []string{"web Pulling", "web Creating", "web Started"}, recorded.get(), "a new interval records right away")
+}
+
+func TestComposeProgress_StopDropsTheKeptMessage(t *testing.T) {
+	recorded := &recordedMessages{}
+	progress := newComposeProgress(100*time.Millisecond, recorded.record)
+
+	progress.forward("web Creating")
+	progress.forward("web Starting")
+	progress.stop()
+	progress.forward("web Started")
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, []string{"web Creating"}, recorded.get(), "nothing overwrites the outcome recorded after the compose call")
+}
+
+func TestComposeProgressForwarder_DoesNotReportEveryEvent(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	const deploymentId = "deployment-compose"
+	require.NoError(t, db.SetDesiredState(deploymentId, database.AppDeploymentState{}))
+	var phaseChanges atomic.Int32
+	db.Subscribe(func(_ string, _ *database.DeploymentRecord, changeType database.DeploymentRecordChangeType) {
+		if changeType == database.DeploymentChangeTypeComponentPhaseChanged {
+			phaseChanges.Add(1)
+		}
+	})
+	dm := NewDeploymentManager(db, nil, nil, zap.NewNop().Sugar())
+
+	forward, stop := dm.composeProgressForwarder(context.Background(), deploymentId)
+	for _, event := range []workloads.ComposeEvent{
+		{ID: "Network web_default", Text: "Creating"},
+		{ID: "Network web_default", Text: "Created"},
+		{ID: "layer-1", ParentID: "web", Text: "Downloading"},
+		{ID: "Container web-db-1", Text: "Creating"},
+		{ID: "Container web-db-1", Text: "Created"},
+		{ID: "Container web-app-1", Text: "Started"},
+	} {
+		forward(event)
+	}
+	stop()
+
+	// subscribers are notified asynchronously
+	assert.Eventually(t, func() bool { return phaseChanges.Load() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Never(t, func() bool { return phaseChanges.Load() > 1 }, 200*time.Millisecond, 10*time.Millisecond,
+		"one status report for the whole compose call")
+	record, err := db.GetDeployment(deploymentId)
+	require.NoError(t, err)
+	assert.Equal(t, "DEPLOYING", record.Phase)
+	assert.Equal(t, "Network web_default Creating", record.Message)
+}
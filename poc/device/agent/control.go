@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// triggerResponse answers a control request, TriggerID matches the log entries of the trigger
+type triggerResponse struct {
+	TriggerID    string             `json:"triggerId"`
+	Action       string             `json:"action"`
+	DeploymentID string             `json:"deploymentId,omitempty"`
+	Sync         *SyncOutcome       `json:"sync,omitempty"`
+	Reconcile    []ReconcileTrigger `json:"reconcile,omitempty"`
+	Error        string             `json:"error,omitempty"`
+}
+
+// debugHandler serves the health endpoints, the last reconciliation of every deployment on
+// GET /operations, what runs on the device on GET /inventory and, when enabled, the control
+// endpoints. With a bearer token configured every
+// endpoint except liveness and readiness requires it.
+func (a *Agent) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", a.health.Handler())
+	mux.HandleFunc("GET /operations", func(w http.ResponseWriter, r *http.Request) {
+		writeControlJSON(w, http.StatusOK, a.deployer.Operations())
+	})
+	mux.HandleFunc("GET /inventory", func(w http.ResponseWriter, r *http.Request) {
+		inventory, err := a.Inventory(r.Context())
+		if err != nil {
+			writeControlJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeControlJSON(w, http.StatusOK, inventory)
+	})
+	if a.config.Health != nil && a.config.Health.Control {
+		a.registerControlEndpoints(mux)
+	}
+
+	if a.config.Health == nil || a.config.Health.BearerToken == "" {
+		return mux
+	}
+	return requireBearerToken(a.config.Health.BearerToken, mux, "/healthz", "/readyz")
+}
+
+// registerControlEndpoints adds the endpoints operators use to trigger work out of schedule:
+//
+//	POST /sync                      syncs right away, after the sync in flight, and answers with what it did,
+//	                                with ?wait=false the sync loop is only asked to sync before its next tick
+//	POST /reconcile                 reconciles every deployment right away
+//	POST /reconcile/{deploymentId}  reconciles one deployment right away, with ?force=true a removal
+//	                                goes ahead although other deployments depend on it or it is
+//	                                protected from removal
+//	POST /report/{deploymentId}     sends the status of the deployment again
+//	GET /plan/{deploymentId}        tells what reconciling the deployment would do, without doing it
+func (a *Agent) registerControlEndpoints(mux *http.ServeMux) {
+	mux.HandleFunc("POST /sync", func(w http.ResponseWriter, r *http.Request) {
+		response := a.newTrigger(r, "sync", "")
+		if r.URL.Query().Get("wait") == "false" {
+			a.syncer.TriggerSync()
+			writeControlJSON(w, http.StatusAccepted, response)
+			return
+		}
+		outcome, err := a.syncer.SyncNow(r.Context(), SyncTrigger{ID: response.TriggerID, Source: r.RemoteAddr})
+		if err != nil {
+			response.Error = err.Error()
+			writeControlJSON(w, http.StatusServiceUnavailable, response)
+			return
+		}
+		response.Sync = &outcome
+		writeControlJSON(w, http.StatusOK, response)
+	})
+	mux.HandleFunc("POST /reconcile", func(w http.ResponseWriter, r *http.Request) {
+		response := a.newTrigger(r, "reconcile", "")
+		response.Reconcile = a.deployer.ReconcileAllNow(response.TriggerID)
+		writeControlJSON(w, http.StatusAccepted, response)
+	})
+	mux.HandleFunc("POST /reconcile/{deploymentId}", func(w http.ResponseWriter, r *http.Request) {
+		response := a.newTrigger(r, "reconcile", r.PathValue("deploymentId"))
+		if r.URL.Query().Get("force") == "true" {
+			if err := a.deployer.ForceRemoval(response.DeploymentID); err != nil {
+				response.Error = err.Error()
+				writeControlJSON(w, triggerErrorCode(err, http.StatusInternalServerError), response)
+				return
+			}
+		}
+		trigger, err := a.deployer.ReconcileNow(response.DeploymentID, response.TriggerID)
+		if err != nil {
+			response.Error = err.Error()
+			writeControlJSON(w, triggerErrorCode(err, http.StatusInternalServerError), response)
+			return
+		}
+		response.Reconcile = []ReconcileTrigger{trigger}
+		writeControlJSON(w, http.StatusAccepted, response)
+	})
+	mux.HandleFunc("POST /report/{deploymentId}", func(w http.ResponseWriter, r *http.Request) {
+		response := a.newTrigger(r, "report", r.PathValue("deploymentId"))
+		if err := a.statusReporter.ReportNow(response.DeploymentID, response.TriggerID); err != nil {
+			response.Error = err.Error()
+			writeControlJSON(w, triggerErrorCode(err, http.StatusBadGateway), response)
+			return
+		}
+		writeControlJSON(w, http.StatusOK, response)
+	})
+	mux.HandleFunc("GET /plan/{deploymentId}", func(w http.ResponseWriter, r *http.Request) {
+		response := a.newTrigger(r, "plan", r.PathValue("deploymentId"))
+		plan, err := a.deployer.PlanReconciliation(response.DeploymentID)
+		if err != nil {
+			response.Error = err.Error()
+			writeControlJSON(w, triggerErrorCode(err, http.StatusServiceUnavailable), response)
+			return
+		}
+		writeControlJSON(w, http.StatusOK, plan)
+	})
+}
+
+// newTrigger assigns the trigger id and logs who asked for what
+func (a *Agent) newTrigger(r *http.Request, action, deploymentId string) triggerResponse {
+	response := triggerResponse{TriggerID: uuid.NewString(), Action: action, DeploymentID: deploymentId}
+	a.log.Infow("Manual trigger", "triggerId", response.TriggerID, "action", action,
+		"deploymentId", deploymentId, "source", r.RemoteAddr, "userAgent", r.UserAgent())
+	return response
+}
+
+func triggerErrorCode(err error, fallback int) int {
+	if errors.Is(err, errUnknownDeployment) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, errReconcileInProgress) {
+		return http.StatusConflict
+	}
+	return fallback
+}
+
+func writeControlJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// requireBearerToken rejects requests without the token, except for the public paths
+func requireBearerToken(token string, next http.Handler, publicPaths ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range publicPaths {
+			if r.URL.Path == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		presented, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeControlJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or invalid bearer token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
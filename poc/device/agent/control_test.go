@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeDeployer struct {
+	deployments map[string]bool
+	inProgress  map[string]bool
+	triggerIds  []string
+	forced      []string
+}
+
+func (f *fakeDeployer) Start() {}
+func (f *fakeDeployer) Stop()  {}
+
+func (f *fakeDeployer) Drain(ctx context.Context) []string { return nil }
+
+func (f *fakeDeployer) ReconcileNow(deploymentId, triggerId string) (ReconcileTrigger, error) {
+	if !f.deployments[deploymentId] {
+		return ReconcileTrigger{}, fmt.Errorf("%w %s", errUnknownDeployment, deploymentId)
+	}
+	f.triggerIds = append(f.triggerIds, triggerId)
+	return ReconcileTrigger{DeploymentID: deploymentId, Started: !f.inProgress[deploymentId]}, nil
+}
+
+func (f *fakeDeployer) ForceRemoval(deploymentId string) error {
+	if !f.deployments[deploymentId] {
+		return fmt.Errorf("%w %s", errUnknownDeployment, deploymentId)
+	}
+	f.forced = append(f.forced, deploymentId)
+	return nil
+}
+
+func (f *fakeDeployer) Operations() []ReconcileOperation {
+	return []ReconcileOperation{{DeploymentID: "deployment-b", ID: 7, InProgress: true}}
+}
+
+func (f *fakeDeployer) PlanReconciliation(deploymentId string) (*ReconcilePlan, error) {
+	if !f.deployments[deploymentId] {
+		return nil, fmt.Errorf("%w %s", errUnknownDeployment, deploymentId)
+	}
+	if f.inProgress[deploymentId] {
+		return nil, fmt.Errorf("%w for deployment %s", errReconcileInProgress, deploymentId)
+	}
+	return &ReconcilePlan{DeploymentID: deploymentId, Action: PlanActionUpgrade}, nil
+}
+
+func (f *fakeDeployer) ReconcileAllNow(triggerId string) []ReconcileTrigger {
+	triggers := []ReconcileTrigger{}
+	for _, deploymentId := range []string{"deployment-a", "deployment-b"} {
+		trigger, _ := f.ReconcileNow(deploymentId, triggerId)
+		triggers = append(triggers, trigger)
+	}
+	return triggers
+}
+
+type fakeReporter struct {
+	reported []string
+	err      error
+}
+
+func (f *fakeReporter) Start() {}
+func (f *fakeReporter) Stop()  {}
+
+func (f *fakeReporter) Flush(ctx context.Context) error { return nil }
+
+func (f *fakeReporter) ReportNow(deploymentId, triggerId string) error {
+	if deploymentId == "deployment-unknown" {
+		return fmt.Errorf("%w %s", errUnknownDeployment, deploymentId)
+	}
+	f.reported = append(f.reported, deploymentId)
+	return f.err
+}
+
+// newControlTestAgent wires an agent with the syncer of the env and fakes for the other components,
+// and serves its debug endpoints
+func newControlTestAgent(t *testing.T, syncer StateSyncerIfc, healthConfig *types.HealthConfig) (*Agent, *httptest.Server) {
+	t.Helper()
+	agent := &Agent{
+		log:            zap.NewNop().Sugar(),
+		config:         types.Config{Health: healthConfig},
+		syncer:         syncer,
+		deployer:       &fakeDeployer{deployments: map[string]bool{"deployment-a": true, "deployment-b": true}, inProgress: map[string]bool{"deployment-b": true}},
+		statusReporter: &fakeReporter{},
+		health:         health.NewRegistry(health.DefaultPolicy()),
+	}
+	server := httptest.NewServer(agent.debugHandler())
+	t.Cleanup(server.Close)
+	return agent, server
+}
+
+func postTrigger(t *testing.T, server *httptest.Server, path string, token string) (int, triggerResponse) {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodPost, server.URL+path, nil)
+	require.NoError(t, err)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	var body triggerResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+	return response.StatusCode, body
+}
+
+func TestControl_SyncWaitsForTheSyncInFlight(t *testing.T) {
+	var inFlight, maxInFlight, requests atomic.Int32
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server := &limitsTestServer{manifest: func(w http.ResponseWriter) int64 {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		if current > maxInFlight.Load() {
+			maxInFlight.Store(current)
+		}
+		if requests.Add(1) == 1 {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return 0
+	}}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	_, debugServer := newControlTestAgent(t, env.syncer, &types.HealthConfig{Enabled: true, Control: true})
+
+	scheduled := make(chan struct{})
+	go func() {
+		defer close(scheduled)
+		env.syncer.performSync()
+	}()
+	<-entered
+
+	type triggered struct {
+		code int
+		body triggerResponse
+	}
+	done := make(chan triggered, 1)
+	go func() {
+		code, body := postTrigger(t, debugServer, "/sync", "")
+		done <- triggered{code, body}
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("the triggered sync must wait for the scheduled one")
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Equal(t, int32(1), requests.Load(), "the triggered sync did not reach the WFM yet")
+
+	close(release)
+	<-scheduled
+	result := <-done
+	assert.Equal(t, http.StatusOK, result.code)
+	assert.Equal(t, "sync", result.body.Action)
+	assert.NotEmpty(t, result.body.TriggerID)
+	require.NotNil(t, result.body.Sync)
+	assert.Equal(t, result.body.TriggerID, result.body.Sync.TriggerID)
+	assert.False(t, result.body.Sync.Changed)
+	assert.Empty(t, result.body.Sync.Error)
+
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, int32(1), maxInFlight.Load(), "syncs must never overlap")
+}
+
+func TestControl_SyncRecordsTheTriggerInTheHistory(t *testing.T) {
+	server := &limitsTestServer{
+		manifest:    versionedManifest(2, `"v2"`, map[string][]byte{"deployment-a": testDeploymentYAML}, nil),
+		deployments: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	_, debugServer := newControlTestAgent(t, env.syncer, &types.HealthConfig{Enabled: true, Control: true})
+
+	code, body := postTrigger(t, debugServer, "/sync", "")
+	require.Equal(t, http.StatusOK, code)
+	require.NotNil(t, body.Sync)
+	assert.True(t, body.Sync.Changed)
+	assert.Equal(t, uint64(2), body.Sync.ManifestVersion)
+	assert.Equal(t, []string{"deployment-a"}, body.Sync.Delivered)
+	assert.Equal(t, []string{"deployment-existing"}, body.Sync.Removed)
+
+	history := env.db.ListSyncHistory()
+	require.Len(t, history, 1)
+	assert.Equal(t, body.TriggerID, history[0].TriggerID)
+	assert.Contains(t, history[0].TriggeredBy, "127.0.0.1")
+}
+
+func TestControl_ReconcileAndReport(t *testing.T) {
+	agent, debugServer := newControlTestAgent(t, nil, &types.HealthConfig{Enabled: true, Control: true})
+	deployer := agent.deployer.(*fakeDeployer)
+	reporter := agent.statusReporter.(*fakeReporter)
+
+	code, body := postTrigger(t, debugServer, "/reconcile", "")
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, []ReconcileTrigger{
+		{DeploymentID: "deployment-a", Started: true},
+		{DeploymentID: "deployment-b", Started: false},
+	}, body.Reconcile)
+	assert.Equal(t, []string{body.TriggerID, body.TriggerID}, deployer.triggerIds)
+
+	code, body = postTrigger(t, debugServer, "/reconcile/deployment-a", "")
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "deployment-a", body.DeploymentID)
+	assert.Equal(t, []ReconcileTrigger{{DeploymentID: "deployment-a", Started: true}}, body.Reconcile)
+
+	code, body = postTrigger(t, debugServer, "/reconcile/deployment-unknown", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Contains(t, body.Error, "unknown deployment")
+	assert.Empty(t, deployer.forced)
+
+	code, _ = postTrigger(t, debugServer, "/reconcile/deployment-a?force=true", "")
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, []string{"deployment-a"}, deployer.forced)
+	code, _ = postTrigger(t, debugServer, "/reconcile/deployment-unknown?force=true", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body = postTrigger(t, debugServer, "/report/deployment-a", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "report", body.Action)
+	assert.Equal(t, []string{"deployment-a"}, reporter.reported)
+
+	code, _ = postTrigger(t, debugServer, "/report/deployment-unknown", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	reporter.err = fmt.Errorf("wfm unavailable")
+	code, body = postTrigger(t, debugServer, "/report/deployment-a", "")
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Equal(t, "wfm unavailable", body.Error)
+}
+
+func TestControl_BearerToken(t *testing.T) {
+	_, debugServer := newControlTestAgent(t, nil, &types.HealthConfig{Enabled: true, Control: true, BearerToken: "s3cret"})
+
+	code, body := postTrigger(t, debugServer, "/reconcile", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Empty(t, body.TriggerID)
+	code, _ = postTrigger(t, debugServer, "/reconcile", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = postTrigger(t, debugServer, "/reconcile", "s3cret")
+	assert.Equal(t, http.StatusAccepted, code)
+
+	// the component details need the token, the probes do not
+	response, err := http.Get(debugServer.URL + "/health/components")
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		response, err := http.Get(debugServer.URL + path)
+		require.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode, path)
+	}
+}
+
+func TestControl_SyncWithoutWaiting(t *testing.T) {
+	server := &limitsTestServer{manifest: func(w http.ResponseWriter) int64 {
+		w.WriteHeader(http.StatusNotModified)
+		return 0
+	}}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	_, debugServer := newControlTestAgent(t, env.syncer, &types.HealthConfig{Enabled: true, Control: true})
+
+	code, body := postTrigger(t, debugServer, "/sync?wait=false", "")
+
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, "sync", body.Action)
+	assert.Nil(t, body.Sync, "the sync did not run yet")
+	assert.Len(t, env.syncer.triggerChan, 1, "the sync loop is asked to sync")
+}
+
+func TestControl_Plan(t *testing.T) {
+	_, debugServer := newControlTestAgent(t, nil, &types.HealthConfig{Enabled: true, Control: true})
+
+	response, err := http.Get(debugServer.URL + "/plan/deployment-a")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	var plan ReconcilePlan
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&plan))
+	assert.Equal(t, ReconcilePlan{DeploymentID: "deployment-a", Action: PlanActionUpgrade}, plan)
+
+	for path, want := range map[string]int{
+		"/plan/deployment-b":       http.StatusConflict,
+		"/plan/deployment-unknown": http.StatusNotFound,
+	} {
+		response, err := http.Get(debugServer.URL + path)
+		require.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, want, response.StatusCode, path)
+	}
+}
+
+func TestControl_DisabledByDefault(t *testing.T) {
+	_, debugServer := newControlTestAgent(t, nil, &types.HealthConfig{Enabled: true})
+
+	response, err := http.Post(debugServer.URL+"/sync", "application/json", nil)
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestControl_Operations(t *testing.T) {
+	_, debugServer := newControlTestAgent(t, nil, &types.HealthConfig{Enabled: true})
+
+	response, err := http.Get(debugServer.URL + "/operations")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	var operations []ReconcileOperation
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&operations))
+	assert.Equal(t, []ReconcileOperation{{DeploymentID: "deployment-b", ID: 7, InProgress: true}}, operations)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/metrics"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/margo/sandbox/shared-lib/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// dataDirAgent is the database and wfm client of an agent, opened in its data directory like
+// NewAgent does
+type dataDirAgent struct {
+	dataDir string
+	db      *database.Database
+	client  *wfm.SbiHttpClient
+}
+
+func newDataDirAgent(t *testing.T, cfg *types.Config, serverURL string) *dataDirAgent {
+	t.Helper()
+	dataDir := cfg.DataDirectory()
+	require.NoError(t, ensureWritableDir(dataDir))
+
+	db, err := openDatabase(cfg, dataDir, zap.NewNop().Sugar(), metrics.Nop{})
+	require.NoError(t, err)
+	jsonDB := db.(*database.Database)
+	t.Cleanup(jsonDB.Close)
+	require.NoError(t, jsonDB.SetDeviceSettings(database.DeviceSettingsRecord{DeviceClientId: testDeviceId}))
+
+	client, err := wfm.NewSbiHTTPClientWithCacheDir(serverURL, filepath.Join(dataDir, "cache"))
+	require.NoError(t, err)
+	return &dataDirAgent{dataDir: dataDir, db: jsonDB, client: client}
+}
+
+func TestDataDir_AgentsWithDifferentDataDirsAreIsolated(t *testing.T) {
+	// nothing may land in the default data/ directory
+	t.Chdir(t.TempDir())
+
+	server := &conditionalServer{t: t, content: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML}}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	root := t.TempDir()
+	first := newDataDirAgent(t, &types.Config{DataDir: filepath.Join(root, "first")}, httpServer.URL)
+	second := newDataDirAgent(t, &types.Config{DataDir: filepath.Join(root, "second")}, httpServer.URL)
+
+	digest := testDigest(testDeploymentYAML)
+	require.NoError(t, first.db.SetDesiredState(testDeploymentId, database.AppDeploymentState{Digest: &digest}))
+	_, err := first.client.FetchDeploymentYAML(context.Background(), testDeviceId, testDeploymentId, digest)
+	require.NoError(t, err)
+
+	_, err = second.db.GetDeployment(testDeploymentId)
+	assert.Error(t, err, "the second agent does not see the deployment of the first")
+
+	cachedFile := func(agent *dataDirAgent) string {
+		return filepath.Join(agent.dataDir, "cache", string(cache.CacheTypeDeployment), testDeploymentId, digest)
+	}
+	assert.FileExists(t, cachedFile(first))
+	assert.NoFileExists(t, cachedFile(second))
+
+	first.db.Close()
+	assert.FileExists(t, filepath.Join(first.dataDir, "agent.database.json"))
+	assert.NoDirExists(t, types.DefaultDataDir)
+}
+
+func TestEnsureWritableDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nested", "data")
+	require.NoError(t, ensureWritableDir(dir))
+	assert.DirExists(t, dir)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "the write check leaves nothing behind")
+
+	// a file in the way of the directory
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	require.NoError(t, os.WriteFile(blocker, nil, 0644))
+	err = ensureWritableDir(filepath.Join(blocker, "data"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot be created, set dataDir to a writable directory")
+
+	if os.Geteuid() == 0 {
+		t.Skip("root writes to read-only directories")
+	}
+	readOnly := filepath.Join(t.TempDir(), "read-only")
+	require.NoError(t, os.Mkdir(readOnly, 0555))
+	err = ensureWritableDir(readOnly)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not writable")
+}
@@ -5,12 +5,17 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/margo/sandbox/poc/device/agent/health"
 	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/shared-lib/dependency"
+	"github.com/margo/sandbox/shared-lib/file"
 	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"go.uber.org/zap"
 )
 
 type AppDeploymentState struct {
@@ -23,10 +28,132 @@ type AppDeploymentState struct {
     LastUpdated time.Time `json:"lastUpdated"`
     Digest      *string   `json:"digest,omitempty"`
     URL         *string   `json:"url,omitempty"`
+    // Provenance tells which manifest and sync brought this state
+    Provenance  *Provenance `json:"provenance,omitempty"`
+    // ChangeClass tells how this state differs from the desired state it replaced
+    ChangeClass ChangeClass `json:"changeClass,omitempty"`
+    // AppVersion and Dependencies describe the application AppId names, when the WFM announced it
+    AppVersion   string                   `json:"appVersion,omitempty"`
+    Dependencies []dependency.Requirement `json:"dependencies,omitempty"`
+    // RemovalProtected keeps the deployment on the device when the WFM drops it without confirming
+    RemovalProtected bool `json:"removalProtected,omitempty"`
+}
+
+// ChangeClass classifies a new desired state against the one it replaces
+type ChangeClass string
+
+const (
+	// ChangeClassInitial is the first desired state of a deployment
+	ChangeClassInitial ChangeClass = "initial"
+	// ChangeClassNone is a new digest for a deployment that did not change
+	ChangeClassNone ChangeClass = "none"
+	// ChangeClassValues only changes parameter values, the components, charts and images stay the same
+	ChangeClassValues ChangeClass = "values"
+	// ChangeClassFull is every other change, including the ones that could not be classified
+	ChangeClassFull ChangeClass = "full"
+)
+
+// How the deployment YAML of a desired state reached the device
+const (
+	DeliveredViaBundle     = "bundle"
+	DeliveredViaIndividual = "individual"
+	// ProvenanceUnknown marks what is not known about desired states stored before provenance was
+	// tracked
+	ProvenanceUnknown = "unknown"
+)
+
+// Provenance of a desired state, the manifest version and the sync that delivered it
+type Provenance struct {
+	// SourceManifestVersion is 0 when unknown
+	SourceManifestVersion uint64    `json:"sourceManifestVersion"`
+	SourceSyncTime        time.Time `json:"sourceSyncTime"`
+	// DeliveredVia is DeliveredViaBundle, DeliveredViaIndividual or ProvenanceUnknown
+	DeliveredVia string `json:"deliveredVia"`
+	// ServerETag is the etag of the manifest at delivery
+	ServerETag string `json:"serverETag"`
+}
+
+// UnknownProvenance is the provenance of desired states stored by agents that did not track it
+func UnknownProvenance() *Provenance {
+	return &Provenance{DeliveredVia: ProvenanceUnknown, ServerETag: ProvenanceUnknown}
+}
+
+// IsUnknown reports whether the provenance was filled in by the migration
+func (p *Provenance) IsUnknown() bool {
+	return p == nil || p.DeliveredVia == ProvenanceUnknown
+}
+
+// SyncRecord is an applied manifest in the sync history
+type SyncRecord struct {
+	ManifestVersion uint64    `json:"manifestVersion"`
+	Time            time.Time `json:"time"`
+	ServerETag      string    `json:"serverETag"`
+	// DeliveredVia is empty when the manifest had no deployments to fetch
+	DeliveredVia string `json:"deliveredVia,omitempty"`
+	// Delivered are the deployments whose desired state the sync stored
+	Delivered []string `json:"delivered,omitempty"`
+	// Removed are the deployments the sync marked for removal
+	Removed []string `json:"removed,omitempty"`
+	// TriggerID and TriggeredBy are set when an operator asked for the sync, they match the log
+	// entries of the trigger
+	TriggerID   string `json:"triggerId,omitempty"`
+	TriggeredBy string `json:"triggeredBy,omitempty"`
+}
+
+// maxSyncHistory is the number of syncs kept in the history, older ones are dropped
+const maxSyncHistory = 50
+
+// DeploymentTombstone is a removed deployment kept in the deployment history
+type DeploymentTombstone struct {
+	DeploymentID string `json:"deploymentId"`
+	AppID        string `json:"appId"`
+	AppVersion   string `json:"appVersion,omitempty"`
+	Digest       string `json:"digest,omitempty"`
+	// Phase and Message are the last ones of the deployment before it was removed
+	Phase       string      `json:"phase,omitempty"`
+	Message     string      `json:"message,omitempty"`
+	Provenance  *Provenance `json:"provenance,omitempty"`
+	LastUpdated time.Time   `json:"lastUpdated"`
+	RemovedAt   time.Time   `json:"removedAt"`
+	// History are the phases and states of the deployment up to its removal, oldest first
+	History []DeploymentHistoryEntry `json:"history,omitempty"`
+}
+
+const (
+	// defaultMaxDeploymentHistory is the number of removed deployments kept in the history
+	defaultMaxDeploymentHistory = 200
+	// defaultDeploymentHistoryMaxAge is how long a removed deployment is kept in the history
+	defaultDeploymentHistoryMaxAge = 30 * 24 * time.Hour
+)
+
+// DeploymentImages are the container images a deployment runs with
+type DeploymentImages struct {
+	// Runtime is the deployment profile type the images belong to, e.g. "compose" or "helm.v3"
+	Runtime    string   `json:"runtime"`
+	References []string `json:"references"`
+}
+
+// RetiredImage is an image reference no deployment uses anymore since RetiredAt, the image
+// janitor removes it once it is old enough and nothing else uses it
+type RetiredImage struct {
+	Reference string `json:"reference"`
+	Runtime   string `json:"runtime"`
+	// DeploymentID is the deployment that used the image last
+	DeploymentID string    `json:"deploymentId"`
+	RetiredAt    time.Time `json:"retiredAt"`
+}
+
+// ImageGCState is what the image janitor keeps across restarts
+type ImageGCState struct {
+	Retired        []RetiredImage `json:"retired,omitempty"`
+	RemovedImages  int64          `json:"removedImages"`
+	ReclaimedBytes int64          `json:"reclaimedBytes"`
 }
 
 type DeploymentRecord struct {
+	// AppID is the application the deployment installs, the deployment id when it is not known
 	AppID               string
+	AppVersion          string `json:",omitempty"`
 	DeploymentID        string
 	Digest              string
 	Path                string
@@ -34,9 +161,24 @@ type DeploymentRecord struct {
 	DesiredState        *AppDeploymentState
 	CurrentState        *AppDeploymentState
 	ComponentViseStatus map[string]sbi.ComponentStatus
-	Phase               string // "deploying", "running", "failed", "removing", "removed"
+	Phase               string // "deploying", "running", "completed", "failed", "removing", "removed"
 	Message             string
 	LastUpdated         time.Time
+	// Provenance of the desired state, see AppDeploymentState.Provenance
+	Provenance *Provenance `json:",omitempty"`
+	// ChangeClass of the desired state, see AppDeploymentState.ChangeClass
+	ChangeClass ChangeClass `json:",omitempty"`
+	// Images the current state runs with, they are retired when they change or the deployment is removed
+	Images *DeploymentImages `json:",omitempty"`
+	// CompletedComponents remembers one-shot components that ran to completion, keyed by component
+	// name with the deployment digest they completed for, so they are not run again after a restart
+	CompletedComponents map[string]string `json:",omitempty"`
+	// RemovalProtected is taken from the last desired state, see AppDeploymentState.RemovalProtected
+	RemovalProtected bool `json:",omitempty"`
+	// RemovalBlockedSince is when the protection first held back the removal of the deployment
+	RemovalBlockedSince *time.Time `json:",omitempty"`
+	// History are the last phases and states of the deployment, oldest first, see GetDeploymentHistory
+	History []DeploymentHistoryEntry `json:",omitempty"`
 }
 
 type DeploymentBundleRecord struct {
@@ -56,6 +198,17 @@ const (
 	DeploymentChangeTypeCurrentStateAdded     DeploymentRecordChangeType = "CURRENT-STATE-ADDED"
 )
 
+// DeploymentTransition is a snapshot of a deployment phase change, taken while the change is applied
+type DeploymentTransition struct {
+	DeploymentID  string
+	AppID         string
+	PreviousPhase string
+	Phase         string
+	Message       string
+	Digest        string
+	Time          time.Time
+}
+
 type DeviceSettingsRecord struct {
 	DeviceClientId     string                   `json:"deviceClientId"`
 	DeviceRootIdentity types.DeviceRootIdentity `json:"deviceRootIdentity"`
@@ -67,27 +220,59 @@ type DeviceSettingsRecord struct {
 	OAuthClientSecret string `json:"clientSecret"`
 	// OAuthTokenEndpointUrl The URL for the OAuth 2.0 token endpoint.
 	OAuthTokenEndpointUrl string `json:"tokenEndpointUrl"`
+	// undecryptedSecret is the stored client secret that could not be decrypted, OAuthClientSecret
+	// is empty then
+	undecryptedSecret string
 	// the applications that the device can deploy
 	CanDeployHelm    bool
 	CanDeployCompose bool
 
+	// the SBI API versions the agent and the WFM spoke when they last negotiated
+	AgentAPIVersion  string `json:"agentApiVersion,omitempty"`
+	ServerAPIVersion string `json:"serverApiVersion,omitempty"`
+
 	// Added these new fields for sync state management
     LastSyncedETag            string `json:"lastSyncedETag"`
     LastSyncedManifestVersion uint64 `json:"lastSyncedManifestVersion"`
     LastSyncedBundleDigest    string `json:"lastSyncedBundleDigest"`
+
+	// Provisioning is what the provisioning file applied on the first boot, nil for devices that
+	// were not provisioned
+	Provisioning *ProvisioningRecord `json:"provisioning,omitempty"`
+}
+
+// ProvisioningRecord sums up an applied provisioning file. The bootstrap token is never stored, it
+// only tells whether the file had one.
+type ProvisioningRecord struct {
+	SourcePath         string                    `json:"sourcePath"`
+	AppliedAt          time.Time                 `json:"appliedAt"`
+	SbiURL             string                    `json:"sbiUrl"`
+	AllowInsecureHttp  bool                      `json:"allowInsecureHttp,omitempty"`
+	Tenant             string                    `json:"tenant,omitempty"`
+	Labels             map[string]string         `json:"labels,omitempty"`
+	DeviceRootIdentity *types.DeviceRootIdentity `json:"deviceRootIdentity,omitempty"`
+	HadBootstrapToken  bool                      `json:"hadBootstrapToken"`
 }
 
 type DatabaseIfc interface {
 	// if your database engine already has persistence, then just keep the implementation empty
 	// we added an in-memory database implementation for this margo poc, hence needed this one
 	TriggerDataPersist()
+	// Persist saves the database right away, for changes that must be on disk before going on
+	Persist() error
 	Subscribe(callback func(string, *DeploymentRecord, DeploymentRecordChangeType))
+	SubscribeTransitions(listener func(DeploymentTransition))
 	SetDesiredState(deploymentId string, state AppDeploymentState) error
 	SetCurrentState(deploymentId string, state AppDeploymentState)
 	SetPhase(deploymentId, phase, message string)
 	SetComponentStatus(deploymentId, componentName string, status sbi.ComponentStatus)
+	SetRemovalBlockedSince(deploymentId string, since *time.Time)
+	MarkComponentCompleted(deploymentId, componentName, digest string)
+	IsComponentCompleted(deploymentId, componentName, digest string) bool
 	GetDeployment(deploymentId string) (*DeploymentRecord, error)
 	ListDeployments() []*DeploymentRecord
+	ListDeploymentsByPhase(phase string) []*DeploymentRecord
+	ListDeploymentsByState(state sbi.DeploymentStatusManifestStatusState) []*DeploymentRecord
 	RemoveDeployment(deploymentId string)
 	NeedsReconciliation(deploymentId string) bool
 	GetDeviceSettings() (*DeviceSettingsRecord, error)
@@ -100,19 +285,48 @@ type DatabaseIfc interface {
     SetLastSyncedManifestVersion(version uint64) error
     GetLastSyncedBundleDigest() (string, error)
     SetLastSyncedBundleDigest(digest string) error
+
+	AddSyncRecord(record SyncRecord)
+	ListSyncHistory() []SyncRecord
+	ListDeploymentHistory() []DeploymentTombstone
+	GetDeploymentHistory(deploymentId string) []DeploymentHistoryEntry
+	SyncsOfDeployment(deploymentId string) []SyncRecord
+
+	SetDeploymentImages(deploymentId string, images DeploymentImages)
+	ListRetiredImages() []RetiredImage
+	ForgetRetiredImage(runtime, reference string)
+	RecordImageRemoval(image RetiredImage, reclaimedBytes int64)
+	GetImageGCState() ImageGCState
 }
 
 type Database struct {
 	deviceSettings *DeviceSettingsRecord
 	deployments    map[string]*DeploymentRecord
+	// syncHistory holds the last applied manifests, oldest first
+	syncHistory    []SyncRecord
+	// deploymentHistory holds the removed deployments, oldest first, it is compacted to the
+	// maximum entries and age
+	deploymentHistory       []DeploymentTombstone
+	options
+	imageGC        ImageGCState
 	subscribers    []func(string, *DeploymentRecord, DeploymentRecordChangeType) // appID, record
+	// transitionListeners are called synchronously with every phase change, they must not block
+	transitionListeners []func(DeploymentTransition)
 	mu             sync.RWMutex
 	subscriberMu   sync.RWMutex
 
 	// for persistence
 	dataDir     string
+	secrets     *secretKeeper
 	persistChan chan struct{}
 	stopPersist chan struct{}
+	persistDone chan struct{}
+	closeOnce   sync.Once
+	// outcome of the last saves, reported through Health
+	persistMu       sync.Mutex
+	persistFailures int
+	lastPersistErr  error
+	lastPersistedAt time.Time
 }
 
 // ETag management for efficient polling
@@ -176,7 +390,66 @@ func (db *Database) SetLastSyncedBundleDigest(digest string) error {
 }
 
 
-func NewDatabase(dataDir string) *Database {
+// Option configures optional Database and SQLiteDatabase behaviour
+type Option func(o *options)
+
+// options are shared by the database backends
+type options struct {
+	maxDeploymentHistory    int
+	deploymentHistoryMaxAge time.Duration
+	secretKeyFile           string
+	log                     *zap.SugaredLogger
+	observePersist          func(duration time.Duration, err error)
+	stateHistoryDepth       int
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		maxDeploymentHistory:    defaultMaxDeploymentHistory,
+		deploymentHistoryMaxAge: defaultDeploymentHistoryMaxAge,
+		log:                     zap.NewNop().Sugar(),
+		observePersist:          func(time.Duration, error) {},
+		stateHistoryDepth:       defaultStateHistoryDepth,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithDeploymentHistoryRetention bounds the history of removed deployments, 0 keeps the default
+// of 200 entries and 30 days
+func WithDeploymentHistoryRetention(maxEntries int, maxAge time.Duration) Option {
+	return func(o *options) {
+		if maxEntries > 0 {
+			o.maxDeploymentHistory = maxEntries
+		}
+		if maxAge > 0 {
+			o.deploymentHistoryMaxAge = maxAge
+		}
+	}
+}
+
+// WithLogger logs what the database recovers from, e.g. a partially written file
+func WithLogger(log *zap.SugaredLogger) Option {
+	return func(o *options) {
+		if log != nil {
+			o.log = log
+		}
+	}
+}
+
+// WithPersistObserver is called with the duration and the outcome of every save of the database,
+// a file write for Database and a transaction for SQLiteDatabase
+func WithPersistObserver(observe func(duration time.Duration, err error)) Option {
+	return func(o *options) {
+		if observe != nil {
+			o.observePersist = observe
+		}
+	}
+}
+
+func NewDatabase(dataDir string, opts ...Option) *Database {
 	db := &Database{
 		deployments:    make(map[string]*DeploymentRecord),
 		deviceSettings: &DeviceSettingsRecord{},
@@ -184,7 +457,10 @@ func NewDatabase(dataDir string) *Database {
 		dataDir:        dataDir,
 		persistChan:    make(chan struct{}, 1),
 		stopPersist:    make(chan struct{}),
+		persistDone:    make(chan struct{}),
+		options:        newOptions(opts),
 	}
+	db.secrets = db.options.secretKeeper(dataDir)
 
 	// Load from disk
 	db.load()
@@ -202,7 +478,16 @@ func (db *Database) TriggerDataPersist() {
 	}
 }
 
+// Close stops the persistence loop once it saved the database a last time
+func (db *Database) Close() {
+	db.closeOnce.Do(func() {
+		close(db.stopPersist)
+		<-db.persistDone
+	})
+}
+
 func (db *Database) persistenceLoop() {
+	defer close(db.persistDone)
 	ticker := time.NewTicker(30 * time.Second) // Periodic saves
 	defer ticker.Stop()
 
@@ -211,6 +496,7 @@ func (db *Database) persistenceLoop() {
 		case <-db.persistChan:
 			db.save()
 		case <-ticker.C:
+			db.CompactDeploymentHistory()
 			db.save()
 		case <-db.stopPersist:
 			db.save() // Final save
@@ -219,50 +505,203 @@ func (db *Database) persistenceLoop() {
 	}
 }
 
-func (db *Database) save() {
+// Persist saves the database right away
+func (db *Database) Persist() error {
+	return db.save()
+}
+
+func (db *Database) save() error {
+	start := time.Now()
 	db.mu.RLock()
-	var dump = struct {
-		Deployments    map[string]*DeploymentRecord `json:"deployments"`
-		DeviceSettings *DeviceSettingsRecord        `json:"deviceSettings"`
-	}{
-		Deployments:    db.deployments,
-		DeviceSettings: db.deviceSettings,
+	// the secrets are only encrypted on disk, the copy keeps them in plaintext in memory
+	settings, err := sealDeviceSettings(db.deviceSettings, db.secrets)
+	var data []byte
+	if err == nil {
+		var dump = databaseDump{
+			Deployments:       db.deployments,
+			DeviceSettings:    settings,
+			SyncHistory:       db.syncHistory,
+			ImageGC:           db.imageGC,
+			DeploymentHistory: db.deploymentHistory,
+		}
+		data, err = json.MarshalIndent(dump, "", "  ")
 	}
-
-	data, err := json.MarshalIndent(dump, "", "  ")
 	db.mu.RUnlock()
 
 	if err != nil {
-		return
+		err = fmt.Errorf("failed to encode the database: %w", err)
+	} else if mkdirErr := os.MkdirAll(db.dataDir, 0755); mkdirErr != nil {
+		err = fmt.Errorf("failed to create the data directory: %w", mkdirErr)
+	} else {
+		err = file.WriteFileAtomic(db.databaseFile(), data, 0644)
 	}
+	db.recordPersist(err)
+	db.observePersist(time.Since(start), err)
+	return err
+}
 
-	os.MkdirAll(db.dataDir, 0755)
-	tempFile := filepath.Join(db.dataDir, "agent.database.json.tmp")
-	finalFile := filepath.Join(db.dataDir, "agent.database.json")
+// databaseDump is the content of the database file
+type databaseDump struct {
+	Deployments       map[string]*DeploymentRecord `json:"deployments"`
+	DeviceSettings    *DeviceSettingsRecord        `json:"deviceSettings"`
+	SyncHistory       []SyncRecord                 `json:"syncHistory,omitempty"`
+	ImageGC           ImageGCState                 `json:"imageGC"`
+	// DeploymentHistory is missing in the files of older agents
+	DeploymentHistory []DeploymentTombstone `json:"deploymentHistory,omitempty"`
+	// recovered names the parts of a corrupt or hand-edited file that were reset on read
+	recovered []string
+}
 
-	if err := os.WriteFile(tempFile, data, 0644); err != nil {
-		return
+// databaseFileName is the file the database is saved to in the data directory
+const databaseFileName = "agent.database.json"
+
+func (db *Database) databaseFile() string {
+	return filepath.Join(db.dataDir, databaseFileName)
+}
+
+// readDatabaseFile reads a saved database, the provenance of older files is migrated and the
+// secrets are decrypted
+func readDatabaseFile(path string, secrets *secretKeeper) (*databaseDump, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
+	var dump databaseDump
+	if err := json.Unmarshal(data, &dump); err != nil {
+		return nil, err
+	}
+	dump.recoverMissing()
+	migrateProvenance(dump.Deployments)
+	if dump.DeviceSettings != nil {
+		revealDeviceSettings(dump.DeviceSettings, secrets)
+	}
+	return &dump, nil
+}
 
-	os.Rename(tempFile, finalFile) // Atomic
+// recoverMissing resets the parts of a file that decoded to null, the database dereferences them
+func (dump *databaseDump) recoverMissing() {
+	if dump.DeviceSettings == nil {
+		dump.DeviceSettings = &DeviceSettingsRecord{}
+		dump.recovered = append(dump.recovered, "deviceSettings")
+	}
+	if dump.Deployments == nil {
+		dump.Deployments = make(map[string]*DeploymentRecord)
+		dump.recovered = append(dump.recovered, "deployments")
+	}
+	for deploymentId, record := range dump.Deployments {
+		if record == nil {
+			delete(dump.Deployments, deploymentId)
+			dump.recovered = append(dump.recovered, "deployments."+deploymentId)
+		}
+	}
 }
 
-func (db *Database) load() {
-	file := filepath.Join(db.dataDir, "agent.database.json")
-	data, err := os.ReadFile(file)
+// sealDeviceSettings returns a copy of the settings with the secrets encrypted for storage
+func sealDeviceSettings(settings *DeviceSettingsRecord, secrets *secretKeeper) (*DeviceSettingsRecord, error) {
+	if settings == nil {
+		return nil, nil
+	}
+	sealed := *settings
+	if settings.OAuthClientSecret == "" && settings.undecryptedSecret != "" {
+		sealed.OAuthClientSecret = settings.undecryptedSecret
+		return &sealed, nil
+	}
+	secret, err := secrets.seal(settings.OAuthClientSecret)
 	if err != nil {
-		return // File doesn't exist, start fresh
+		return nil, fmt.Errorf("failed to encrypt the client secret: %w", err)
 	}
+	sealed.OAuthClientSecret = secret
+	return &sealed, nil
+}
 
-	var dump = struct {
-		Deployments    map[string]*DeploymentRecord `json:"deployments"`
-		DeviceSettings *DeviceSettingsRecord        `json:"deviceSettings"`
-	}{}
-	if err := json.Unmarshal(data, &dump); err != nil {
+// revealDeviceSettings decrypts the secrets of stored settings. A secret that cannot be decrypted is
+// left empty, and its ciphertext is kept so it is stored again as it is until a new secret is set.
+func revealDeviceSettings(settings *DeviceSettingsRecord, secrets *secretKeeper) {
+	secret, err := secrets.reveal(settings.OAuthClientSecret)
+	if err != nil {
+		settings.undecryptedSecret = settings.OAuthClientSecret
+	}
+	settings.OAuthClientSecret = secret
+}
+
+func (db *Database) recordPersist(err error) {
+	db.persistMu.Lock()
+	defer db.persistMu.Unlock()
+	db.lastPersistErr = err
+	if err != nil {
+		db.persistFailures++
 		return
 	}
+	db.persistFailures = 0
+	db.lastPersistedAt = time.Now()
+}
+
+func (db *Database) Name() string {
+	return health.ComponentDatabase
+}
+
+// Health is unhealthy while persisting the database to disk fails, changes would be lost on restart
+func (db *Database) Health() health.Report {
+	db.persistMu.Lock()
+	defer db.persistMu.Unlock()
+
+	db.mu.RLock()
+	deployments := len(db.deployments)
+	db.mu.RUnlock()
+
+	metrics := map[string]float64{
+		"deployments":                float64(deployments),
+		"consecutivePersistFailures": float64(db.persistFailures),
+	}
+	if !db.lastPersistedAt.IsZero() {
+		metrics["secondsSincePersist"] = time.Since(db.lastPersistedAt).Seconds()
+	}
+	report := health.OK(metrics)
+	if db.lastPersistErr != nil {
+		report.Fail(fmt.Sprintf("persisting to disk failed: %v", db.lastPersistErr))
+	}
+	if err := db.secrets.err(); err != nil {
+		report.Degrade(fmt.Sprintf("the stored client secret cannot be decrypted: %v", err))
+	}
+	return report
+}
+
+func (db *Database) load() {
+	// a crash during a save leaves its temp file behind, the previous save is still complete
+	file.RemoveStaleTempsOf(db.databaseFile())
+	os.Remove(db.databaseFile() + ".tmp") // temp file of older agents
+
+	dump, err := readDatabaseFile(db.databaseFile(), db.secrets)
+	if err != nil {
+		return // File doesn't exist or is unreadable, start fresh
+	}
+	if len(dump.recovered) > 0 {
+		db.log.Warnw("The database file is corrupt or partial, reset what it is missing",
+			"file", db.databaseFile(), "reset", dump.recovered)
+	}
 	db.deployments = dump.Deployments
 	db.deviceSettings = dump.DeviceSettings
+	db.syncHistory = dump.SyncHistory
+	db.imageGC = dump.ImageGC
+	db.deploymentHistory = dump.DeploymentHistory
+	// the limits may have been lowered since the file was written
+	db.compactDeploymentHistory(time.Now())
+}
+
+// migrateProvenance fills in unknown provenance for the desired states of agents that did not
+// track it, so every stored desired state has one
+func migrateProvenance(deployments map[string]*DeploymentRecord) {
+	for _, record := range deployments {
+		if record.DesiredState == nil {
+			continue
+		}
+		if record.DesiredState.Provenance == nil {
+			record.DesiredState.Provenance = UnknownProvenance()
+		}
+		if record.Provenance == nil {
+			record.Provenance = record.DesiredState.Provenance
+		}
+	}
 }
 
 func (db *Database) Subscribe(callback func(string, *DeploymentRecord, DeploymentRecordChangeType)) {
@@ -282,25 +721,72 @@ func (db *Database) notify(appID string, record *DeploymentRecord, changeType De
 	}
 }
 
+// SubscribeTransitions registers a listener for deployment phase changes. Unlike Subscribe, the
+// listener gets a consistent snapshot of every transition in the order they happen, because it is
+// called while the change is applied. It must hand the transition off without blocking.
+func (db *Database) SubscribeTransitions(listener func(DeploymentTransition)) {
+	db.subscriberMu.Lock()
+	defer db.subscriberMu.Unlock()
+	db.transitionListeners = append(db.transitionListeners, listener)
+}
+
+// notifyTransition must be called with db.mu held
+func (db *Database) notifyTransition(record *DeploymentRecord, previousPhase string) {
+	db.subscriberMu.RLock()
+	defer db.subscriberMu.RUnlock()
+	if len(db.transitionListeners) == 0 {
+		return
+	}
+
+	transition := DeploymentTransition{
+		DeploymentID:  record.DeploymentID,
+		AppID:         record.AppID,
+		PreviousPhase: previousPhase,
+		Phase:         record.Phase,
+		Message:       record.Message,
+		Digest:        record.Digest,
+		Time:          record.LastUpdated,
+	}
+	for _, listener := range db.transitionListeners {
+		listener(transition)
+	}
+}
+
 func (db *Database) SetDesiredState(deploymentId string, state AppDeploymentState) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	record, exists := db.deployments[deploymentId]
 	if !exists {
-		record = &DeploymentRecord{
-			AppID:               deploymentId,
-			DeploymentID:        deploymentId,
-			ComponentViseStatus: make(map[string]sbi.ComponentStatus),
-			Phase:               "pending",
-			LastUpdated:         time.Now(),
-		}
+		record = newDeploymentRecord(deploymentId)
 		db.deployments[deploymentId] = record
 		db.notify(deploymentId, record, DeploymentChangeTypeDesiredStateAdded)
 	}
 
 	// Only update if actually different
 	// if record.DesiredState == nil || record.DesiredState.AppDeploymentYAMLHash != state.AppDeploymentYAMLHash {
+	applyDesiredState(record, state)
+    
+    db.notify(deploymentId, record, DeploymentChangeTypeDesiredStateAdded)
+ 
+    db.TriggerDataPersist()
+    
+    return nil
+}
+
+// newDeploymentRecord is the record of a deployment seen for the first time
+func newDeploymentRecord(deploymentId string) *DeploymentRecord {
+	return &DeploymentRecord{
+		AppID:               deploymentId,
+		DeploymentID:        deploymentId,
+		ComponentViseStatus: make(map[string]sbi.ComponentStatus),
+		Phase:               "pending",
+		LastUpdated:         time.Now(),
+	}
+}
+
+// applyDesiredState stores the desired state in the record, with what the record takes from it
+func applyDesiredState(record *DeploymentRecord, state AppDeploymentState) {
 	record.DesiredState = &state
 	record.LastUpdated = time.Now()
      // Store the digest and URL from the state
@@ -310,12 +796,17 @@ func (db *Database) SetDesiredState(deploymentId string, state AppDeploymentStat
     if state.URL != nil {
         record.URL = *state.URL
     }
-    
-    db.notify(deploymentId, record, DeploymentChangeTypeDesiredStateAdded)
- 
-    db.TriggerDataPersist()
-    
-    return nil
+	if state.Provenance != nil {
+		record.Provenance = state.Provenance
+	}
+	if state.ChangeClass != "" {
+		record.ChangeClass = state.ChangeClass
+	}
+	if state.AppId != "" {
+		record.AppID = state.AppId
+		record.AppVersion = state.AppVersion
+	}
+	record.RemovalProtected = state.RemovalProtected
 }
 
 func (db *Database) SetCurrentState(deploymentId string, state AppDeploymentState) {
@@ -329,6 +820,9 @@ func (db *Database) SetCurrentState(deploymentId string, state AppDeploymentStat
 
 	record.CurrentState = &state
 	record.LastUpdated = time.Now()
+	recordHistory(record, db.stateHistoryDepth, false)
+	// the current state tells what is deployed after a crash, the persistence loop coalesces the saves
+	db.TriggerDataPersist()
 }
 
 func (db *Database) SetPhase(deploymentId, phase, message string) {
@@ -340,9 +834,12 @@ func (db *Database) SetPhase(deploymentId, phase, message string) {
 		return
 	}
 
+	previousPhase := record.Phase
 	record.Phase = phase
 	record.Message = message
 	record.LastUpdated = time.Now()
+	recordHistory(record, db.stateHistoryDepth, false)
+	db.notifyTransition(record, previousPhase)
 	db.notify(deploymentId, record, DeploymentChangeTypeComponentPhaseChanged)
 }
 
@@ -354,7 +851,16 @@ func (db *Database) SetComponentStatus(deploymentId, componentName string, statu
 	if !exists {
 		return
 	}
+	applyComponentStatus(record, componentName, status)
+	db.TriggerDataPersist()
+}
 
+// applyComponentStatus stores the status of the component and the phase it implies for the
+// deployment
+func applyComponentStatus(record *DeploymentRecord, componentName string, status sbi.ComponentStatus) {
+	if record.ComponentViseStatus == nil {
+		record.ComponentViseStatus = make(map[string]sbi.ComponentStatus)
+	}
 	record.ComponentViseStatus[componentName] = status
 	record.LastUpdated = time.Now()
 
@@ -366,6 +872,55 @@ func (db *Database) SetComponentStatus(deploymentId, componentName string, statu
 	}
 }
 
+// SetRemovalBlockedSince records when the removal of a protected deployment was first held back, nil
+// once it is no longer
+func (db *Database) SetRemovalBlockedSince(deploymentId string, since *time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	record, exists := db.deployments[deploymentId]
+	if !exists {
+		return
+	}
+
+	record.RemovalBlockedSince = since
+	record.LastUpdated = time.Now()
+	db.TriggerDataPersist()
+}
+
+// MarkComponentCompleted records that a one-shot component finished successfully for the given digest
+func (db *Database) MarkComponentCompleted(deploymentId, componentName, digest string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	record, exists := db.deployments[deploymentId]
+	if !exists {
+		return
+	}
+
+	if record.CompletedComponents == nil {
+		record.CompletedComponents = make(map[string]string)
+	}
+	record.CompletedComponents[componentName] = digest
+	record.LastUpdated = time.Now()
+	db.TriggerDataPersist()
+}
+
+// IsComponentCompleted tells whether a one-shot component already completed for the given digest,
+// a component that completed for an older digest has to run again
+func (db *Database) IsComponentCompleted(deploymentId, componentName, digest string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	record, exists := db.deployments[deploymentId]
+	if !exists || record.CompletedComponents == nil {
+		return false
+	}
+
+	completedDigest, completed := record.CompletedComponents[componentName]
+	return completed && completedDigest == digest
+}
+
 func (db *Database) GetDeployment(deploymentId string) (*DeploymentRecord, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -381,34 +936,296 @@ func (db *Database) GetDeployment(deploymentId string) (*DeploymentRecord, error
 }
 
 func (db *Database) ListDeployments() []*DeploymentRecord {
+	return db.listDeployments(func(*DeploymentRecord) bool { return true })
+}
+
+// ListDeploymentsByPhase returns the deployments in the phase, compared case-insensitively as
+// phases are set both as "FAILED" and "failed"
+func (db *Database) ListDeploymentsByPhase(phase string) []*DeploymentRecord {
+	return db.listDeployments(inPhase(phase))
+}
+
+// ListDeploymentsByState returns the deployments whose current state is the state, deployments
+// without a current state are not in any
+func (db *Database) ListDeploymentsByState(state sbi.DeploymentStatusManifestStatusState) []*DeploymentRecord {
+	return db.listDeployments(inState(state))
+}
+
+// listDeployments returns a copy of the deployments matching keep
+func (db *Database) listDeployments(keep func(*DeploymentRecord) bool) []*DeploymentRecord {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
 	records := make([]*DeploymentRecord, 0, len(db.deployments))
 	for _, record := range db.deployments {
+		if !keep(record) {
+			continue
+		}
 		copy := *record
 		records = append(records, &copy)
 	}
 	return records
 }
 
+// inPhase matches the deployments in the phase, see ListDeploymentsByPhase
+func inPhase(phase string) func(*DeploymentRecord) bool {
+	return func(record *DeploymentRecord) bool {
+		return strings.EqualFold(record.Phase, phase)
+	}
+}
+
+// inState matches the deployments whose current state is the state, see ListDeploymentsByState
+func inState(state sbi.DeploymentStatusManifestStatusState) func(*DeploymentRecord) bool {
+	return func(record *DeploymentRecord) bool {
+		return record.CurrentState != nil && record.CurrentState.Status.Status.State == state
+	}
+}
+
 func (db *Database) RemoveDeployment(deploymentId string) {
     db.mu.Lock()
     defer db.mu.Unlock()
     
     if record, exists := db.deployments[deploymentId]; exists {
         delete(db.deployments, deploymentId)
+        recordHistory(record, db.stateHistoryDepth, true)
+        db.addTombstone(record)
+        if record.Images != nil {
+            db.retireImages(deploymentId, record.Images.Runtime, record.Images.References)
+        }
         db.notify(deploymentId, record, DeploymentChangeTypeRecordDeleted)
         db.TriggerDataPersist()  
     }
 }
 
+// addTombstone moves a removed deployment into the deployment history, the oldest entries are
+// dropped once it is full, db.mu must be held
+func (db *Database) addTombstone(record *DeploymentRecord) {
+	db.deploymentHistory = append(db.deploymentHistory, newTombstone(record, time.Now()))
+	if excess := len(db.deploymentHistory) - db.maxDeploymentHistory; excess > 0 {
+		db.deploymentHistory = append([]DeploymentTombstone(nil), db.deploymentHistory[excess:]...)
+	}
+}
+
+// newTombstone keeps what the deployment history tells of a removed deployment
+func newTombstone(record *DeploymentRecord, removedAt time.Time) DeploymentTombstone {
+	return DeploymentTombstone{
+		DeploymentID: record.DeploymentID,
+		AppID:        record.AppID,
+		AppVersion:   record.AppVersion,
+		Digest:       record.Digest,
+		Phase:        record.Phase,
+		Message:      record.Message,
+		Provenance:   record.Provenance,
+		LastUpdated:  record.LastUpdated,
+		RemovedAt:    removedAt,
+		History:      record.History,
+	}
+}
+
+// ListDeploymentHistory returns the removed deployments still kept in the history, oldest first
+func (db *Database) ListDeploymentHistory() []DeploymentTombstone {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return slices.Clone(db.deploymentHistory)
+}
+
+// GetDeploymentHistory returns the last phases and states of the deployment, oldest first. The
+// history of a removed deployment is kept in the deployment history, nil once it is compacted.
+func (db *Database) GetDeploymentHistory(deploymentId string) []DeploymentHistoryEntry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if record, exists := db.deployments[deploymentId]; exists {
+		return slices.Clone(record.History)
+	}
+	for i := len(db.deploymentHistory) - 1; i >= 0; i-- {
+		if db.deploymentHistory[i].DeploymentID == deploymentId {
+			return slices.Clone(db.deploymentHistory[i].History)
+		}
+	}
+	return nil
+}
+
+// CompactDeploymentHistory drops the removed deployments older than the maximum age and the oldest
+// ones over the maximum entries, the persistence loop runs it periodically
+func (db *Database) CompactDeploymentHistory() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.compactDeploymentHistory(time.Now()) {
+		db.TriggerDataPersist()
+	}
+}
+
+// compactDeploymentHistory reports whether entries were dropped, db.mu must be held
+func (db *Database) compactDeploymentHistory(now time.Time) bool {
+	before := len(db.deploymentHistory)
+	kept := slices.DeleteFunc(db.deploymentHistory, func(tombstone DeploymentTombstone) bool {
+		return now.Sub(tombstone.RemovedAt) > db.deploymentHistoryMaxAge
+	})
+	if excess := len(kept) - db.maxDeploymentHistory; excess > 0 {
+		kept = kept[excess:]
+	}
+	if len(kept) == before {
+		return false
+	}
+	db.deploymentHistory = append([]DeploymentTombstone(nil), kept...)
+	return true
+}
+
+// SetDeploymentImages records the images the current state of a deployment runs with, the
+// references it used before and no longer does are retired
+func (db *Database) SetDeploymentImages(deploymentId string, images DeploymentImages) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	record, exists := db.deployments[deploymentId]
+	if !exists {
+		return
+	}
+	if previous := record.Images; previous != nil {
+		db.retireImages(deploymentId, previous.Runtime, unusedImages(previous, images))
+	}
+
+	// an image that is used again is no longer a removal candidate
+	db.imageGC.Retired = slices.DeleteFunc(db.imageGC.Retired, func(retired RetiredImage) bool {
+		return retired.Runtime == images.Runtime && slices.Contains(images.References, retired.Reference)
+	})
+	images.References = slices.Clone(images.References)
+	record.Images = &images
+	db.TriggerDataPersist()
+}
+
+// unusedImages are the references of previous that images no longer uses
+func unusedImages(previous *DeploymentImages, images DeploymentImages) []string {
+	var unused []string
+	for _, reference := range previous.References {
+		if previous.Runtime != images.Runtime || !slices.Contains(images.References, reference) {
+			unused = append(unused, reference)
+		}
+	}
+	return unused
+}
+
+// retireImages records references that deploymentId stopped using, a reference that was retired
+// before restarts its grace period
+func (db *Database) retireImages(deploymentId, runtime string, references []string) {
+	now := time.Now()
+	for _, reference := range references {
+		db.imageGC.Retired = slices.DeleteFunc(db.imageGC.Retired, func(retired RetiredImage) bool {
+			return retired.Runtime == runtime && retired.Reference == reference
+		})
+		db.imageGC.Retired = append(db.imageGC.Retired, RetiredImage{
+			Reference:    reference,
+			Runtime:      runtime,
+			DeploymentID: deploymentId,
+			RetiredAt:    now,
+		})
+	}
+}
+
+// ListRetiredImages returns the image references no deployment uses anymore, oldest first
+func (db *Database) ListRetiredImages() []RetiredImage {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return slices.Clone(db.imageGC.Retired)
+}
+
+// ForgetRetiredImage drops a retired reference without counting it as removed, e.g. because the
+// image is gone already
+func (db *Database) ForgetRetiredImage(runtime, reference string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.forgetRetiredImage(runtime, reference)
+	db.TriggerDataPersist()
+}
+
+func (db *Database) forgetRetiredImage(runtime, reference string) {
+	db.imageGC.Retired = slices.DeleteFunc(db.imageGC.Retired, func(retired RetiredImage) bool {
+		return retired.Runtime == runtime && retired.Reference == reference
+	})
+}
+
+// RecordImageRemoval drops a retired reference the janitor removed and adds to the totals
+func (db *Database) RecordImageRemoval(image RetiredImage, reclaimedBytes int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.forgetRetiredImage(image.Runtime, image.Reference)
+	db.imageGC.RemovedImages++
+	db.imageGC.ReclaimedBytes += reclaimedBytes
+	db.TriggerDataPersist()
+}
+
+// GetImageGCState returns the retired references and what the janitor removed so far
+func (db *Database) GetImageGCState() ImageGCState {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	state := db.imageGC
+	state.Retired = slices.Clone(state.Retired)
+	return state
+}
+
+// AddSyncRecord appends an applied manifest to the sync history
+func (db *Database) AddSyncRecord(record SyncRecord) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.syncHistory = append(db.syncHistory, record)
+	if excess := len(db.syncHistory) - maxSyncHistory; excess > 0 {
+		db.syncHistory = append([]SyncRecord(nil), db.syncHistory[excess:]...)
+	}
+	db.TriggerDataPersist()
+}
+
+// ListSyncHistory returns the last applied manifests, oldest first
+func (db *Database) ListSyncHistory() []SyncRecord {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return append([]SyncRecord(nil), db.syncHistory...)
+}
+
+// SyncsOfDeployment returns the syncs in the history that delivered or removed the deployment,
+// oldest first
+func (db *Database) SyncsOfDeployment(deploymentId string) []SyncRecord {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var syncs []SyncRecord
+	for _, record := range db.syncHistory {
+		if slices.Contains(record.Delivered, deploymentId) || slices.Contains(record.Removed, deploymentId) {
+			syncs = append(syncs, record)
+		}
+	}
+	return syncs
+}
+
 func (db *Database) NeedsReconciliation(deploymentId string) bool {
     db.mu.RLock()
     defer db.mu.RUnlock()
 
     record, exists := db.deployments[deploymentId]
-    if !exists || record.DesiredState == nil {
+    return exists && needsReconciliation(record)
+}
+
+// DesiredDigestDeployed tells whether the current state was deployed from the digest of the desired
+// state, states stored without a digest count as the same
+func DesiredDigestDeployed(record *DeploymentRecord) bool {
+	if record.DesiredState == nil || record.CurrentState == nil {
+		return false
+	}
+	return record.CurrentState.DigestValue() == record.DesiredState.DigestValue()
+}
+
+// DigestValue returns the digest of the deployment YAML of the state, empty when it is not known
+func (state *AppDeploymentState) DigestValue() string {
+	if state.Digest == nil {
+		return ""
+	}
+	return *state.Digest
+}
+
+// needsReconciliation tells whether the current state of the deployment differs from its desired
+// state
+func needsReconciliation(record *DeploymentRecord) bool {
+    if record.DesiredState == nil {
         return false
     }
 
@@ -421,6 +1238,11 @@ func (db *Database) NeedsReconciliation(deploymentId string) bool {
         return true
     }
 
+    // A desired state stored while the previous one was being deployed has another digest
+    if !DesiredDigestDeployed(record) {
+        return true
+    }
+
     // Compare the deployment status
     if record.CurrentState.Status.Status.State != record.DesiredState.Status.Status.State {
         return true
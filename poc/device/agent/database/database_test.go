@@ -0,0 +1,473 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/margo/sandbox/shared-lib/file"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// newTestDatabase opens the database and closes it before the test's directories are removed, a
+// persist still running would write into them
+func newTestDatabase(t *testing.T, dataDir string, opts ...Option) *Database {
+	t.Helper()
+	db := NewDatabase(dataDir, opts...)
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestSave_CrashBeforeRename(t *testing.T) {
+	dataDir := t.TempDir()
+	db := newTestDatabase(t, dataDir)
+	db.SetDeviceSettings(DeviceSettingsRecord{DeviceClientId: "client-good"})
+	db.save()
+	require.Equal(t, health.StatusOK, db.Health().Status)
+
+	var temps []string
+	restore := file.SetBeforeRenameHook(func(tempPath, finalPath string) error {
+		temps = append(temps, tempPath)
+		return errors.New("simulated crash")
+	})
+	t.Cleanup(restore)
+
+	db.SetDeviceSettings(DeviceSettingsRecord{DeviceClientId: "client-next"})
+	db.save()
+	assert.Equal(t, health.StatusUnhealthy, db.Health().Status, "the failed save is reported")
+	require.NotEmpty(t, temps)
+	for _, temp := range temps {
+		assert.NoFileExists(t, temp)
+	}
+
+	reloaded := newTestDatabase(t, dataDir)
+	settings, err := reloaded.GetDeviceSettings()
+	require.NoError(t, err)
+	assert.Equal(t, "client-good", settings.DeviceClientId, "the previous save survives")
+}
+
+func TestLoad_RemovesStaleTemps(t *testing.T) {
+	dataDir := t.TempDir()
+	db := newTestDatabase(t, dataDir)
+	db.SetDeviceSettings(DeviceSettingsRecord{DeviceClientId: "client-good"})
+	db.save()
+
+	stale := filepath.Join(dataDir, ".agent.database.json.123"+file.TempSuffix)
+	legacy := filepath.Join(dataDir, "agent.database.json.tmp")
+	unrelated := filepath.Join(dataDir, ".other.json.456"+file.TempSuffix)
+	for _, path := range []string{stale, legacy, unrelated} {
+		require.NoError(t, os.WriteFile(path, []byte(`{"deviceSett`), 0644))
+	}
+
+	reloaded := newTestDatabase(t, dataDir)
+	settings, err := reloaded.GetDeviceSettings()
+	require.NoError(t, err)
+	assert.Equal(t, "client-good", settings.DeviceClientId)
+	assert.NoFileExists(t, stale)
+	assert.NoFileExists(t, legacy)
+	assert.FileExists(t, unrelated, "only the temp files of the database are removed")
+}
+
+func TestLoad_FillsUnknownProvenance(t *testing.T) {
+	dataDir := t.TempDir()
+	// a database written before provenance was tracked
+	legacy := `{
+		"deployments": {
+			"deployment-1": {"AppID": "deployment-1", "DeploymentID": "deployment-1", "Phase": "running",
+				"DesiredState": {"appId": "deployment-1", "state": "PENDING"},
+				"CurrentState": {"appId": "deployment-1", "state": "PENDING"}},
+			"deployment-2": {"AppID": "deployment-2", "DeploymentID": "deployment-2", "Phase": "FAILED"}
+		},
+		"deviceSettings": {"deviceClientId": "client-good"}
+	}`
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "agent.database.json"), []byte(legacy), 0644))
+
+	db := newTestDatabase(t, dataDir)
+	record, err := db.GetDeployment("deployment-1")
+	require.NoError(t, err)
+	require.NotNil(t, record.Provenance)
+	assert.True(t, record.Provenance.IsUnknown())
+	assert.Equal(t, UnknownProvenance(), record.DesiredState.Provenance)
+	assert.Equal(t, uint64(0), record.Provenance.SourceManifestVersion)
+	assert.Equal(t, ProvenanceUnknown, record.Provenance.ServerETag)
+
+	failed, err := db.GetDeployment("deployment-2")
+	require.NoError(t, err)
+	assert.Nil(t, failed.Provenance, "there is no desired state to give a provenance")
+
+	// a later delivery replaces the sentinel values
+	delivered := &Provenance{SourceManifestVersion: 4, DeliveredVia: DeliveredViaBundle, ServerETag: `"v4"`}
+	require.NoError(t, db.SetDesiredState("deployment-1", AppDeploymentState{Provenance: delivered}))
+	record, err = db.GetDeployment("deployment-1")
+	require.NoError(t, err)
+	assert.False(t, record.Provenance.IsUnknown())
+	assert.Equal(t, delivered, record.Provenance)
+}
+
+func TestSyncHistory_KeepsTheLatestAndSurvivesRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	db := newTestDatabase(t, dataDir)
+	for version := uint64(1); version <= maxSyncHistory+5; version++ {
+		record := SyncRecord{ManifestVersion: version, Delivered: []string{"deployment-a"}}
+		if version%10 == 0 {
+			record.Removed = []string{"deployment-b"}
+		}
+		db.AddSyncRecord(record)
+	}
+
+	history := db.ListSyncHistory()
+	require.Len(t, history, maxSyncHistory)
+	assert.Equal(t, uint64(6), history[0].ManifestVersion, "the oldest syncs are dropped")
+	assert.Equal(t, uint64(maxSyncHistory+5), history[len(history)-1].ManifestVersion)
+
+	removals := db.SyncsOfDeployment("deployment-b")
+	require.Len(t, removals, 5)
+	assert.Equal(t, uint64(10), removals[0].ManifestVersion)
+	assert.Empty(t, db.SyncsOfDeployment("deployment-c"))
+
+	db.save()
+	reloaded := newTestDatabase(t, dataDir)
+	assert.Equal(t, history, reloaded.ListSyncHistory())
+}
+
+func TestCurrentState_PersistedWithoutAnExplicitSave(t *testing.T) {
+	dataDir := t.TempDir()
+	db := newTestDatabase(t, dataDir)
+	require.NoError(t, db.SetDesiredState("deployment-1", AppDeploymentState{}))
+	current := AppDeploymentState{}
+	current.Status.Status.State = sbi.DeploymentStatusManifestStatusStateInstalled
+	db.SetCurrentState("deployment-1", current)
+	db.SetComponentStatus("deployment-1", "web", sbi.ComponentStatus{Name: "web", State: sbi.ComponentStatusStateInstalled})
+
+	// the persistence loop saves the changes on its own, long before its periodic save
+	require.Eventually(t, func() bool {
+		dump, err := readDatabaseFile(filepath.Join(dataDir, databaseFileName), db.secrets)
+		if err != nil || dump.Deployments["deployment-1"] == nil {
+			return false
+		}
+		record := dump.Deployments["deployment-1"]
+		return record.CurrentState != nil && record.ComponentViseStatus["web"].State == sbi.ComponentStatusStateInstalled
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a crash loses nothing that reached the file, the reloaded database knows what is deployed
+	reloaded := newTestDatabase(t, dataDir)
+	record, err := reloaded.GetDeployment("deployment-1")
+	require.NoError(t, err)
+	require.NotNil(t, record.CurrentState)
+	assert.Equal(t, sbi.DeploymentStatusManifestStatusStateInstalled, record.CurrentState.Status.Status.State)
+	assert.Equal(t, "running", record.Phase)
+}
+
+func TestListDeployments_FilteredByPhaseAndState(t *testing.T) {
+	backends := map[string]func(t *testing.T) DatabaseIfc{
+		"json":   func(t *testing.T) DatabaseIfc { return newTestDatabase(t, t.TempDir()) },
+		"sqlite": func(t *testing.T) DatabaseIfc { return newTestSQLiteDatabase(t, t.TempDir()) },
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			db := open(t)
+			deployments := []struct {
+				id, phase string
+				state     sbi.DeploymentStatusManifestStatusState
+			}{
+				{"running-1", "RUNNING", sbi.DeploymentStatusManifestStatusStateInstalled},
+				{"running-2", "running", sbi.DeploymentStatusManifestStatusStateInstalled},
+				{"failed-1", "FAILED", sbi.DeploymentStatusManifestStatusStateFailed},
+				{"failed-2", "failed", sbi.DeploymentStatusManifestStatusStateFailed},
+				{"installing-1", "INSTALLING", sbi.DeploymentStatusManifestStatusStateInstalling},
+				{"pending-1", "pending", ""},
+			}
+			for _, deployment := range deployments {
+				require.NoError(t, db.SetDesiredState(deployment.id, AppDeploymentState{}))
+				if deployment.state != "" {
+					current := AppDeploymentState{}
+					current.Status.Status.State = deployment.state
+					db.SetCurrentState(deployment.id, current)
+				}
+				db.SetPhase(deployment.id, deployment.phase, "")
+			}
+
+			ids := func(records []*DeploymentRecord) []string {
+				var ids []string
+				for _, record := range records {
+					ids = append(ids, record.DeploymentID)
+				}
+				return ids
+			}
+			assert.ElementsMatch(t, []string{"failed-1", "failed-2"}, ids(db.ListDeploymentsByPhase("failed")), "phases match in any case")
+			assert.ElementsMatch(t, []string{"running-1", "running-2"}, ids(db.ListDeploymentsByPhase("RUNNING")))
+			assert.ElementsMatch(t, []string{"pending-1"}, ids(db.ListDeploymentsByPhase("pending")))
+			assert.Empty(t, db.ListDeploymentsByPhase("REMOVING"))
+
+			assert.ElementsMatch(t, []string{"running-1", "running-2"}, ids(db.ListDeploymentsByState(sbi.DeploymentStatusManifestStatusStateInstalled)))
+			assert.ElementsMatch(t, []string{"installing-1"}, ids(db.ListDeploymentsByState(sbi.DeploymentStatusManifestStatusStateInstalling)))
+			assert.Empty(t, db.ListDeploymentsByState(sbi.DeploymentStatusManifestStatusStateRemoved), "a deployment without a current state is in no state")
+			assert.Len(t, db.ListDeployments(), len(deployments))
+
+			// the records are copies, changing them leaves the database as it was
+			failed := db.ListDeploymentsByPhase("failed")
+			failed[0].Phase = "RUNNING"
+			assert.Len(t, db.ListDeploymentsByPhase("failed"), 2)
+		})
+	}
+}
+
+func TestDeploymentImages_RetiredOnChangeAndRemoval(t *testing.T) {
+	dataDir := t.TempDir()
+	db := newTestDatabase(t, dataDir)
+	require.NoError(t, db.SetDesiredState("deployment-1", AppDeploymentState{}))
+
+	db.SetDeploymentImages("deployment-1", DeploymentImages{Runtime: "compose", References: []string{"web:1", "proxy:1"}})
+	assert.Empty(t, db.ListRetiredImages())
+
+	db.SetDeploymentImages("deployment-1", DeploymentImages{Runtime: "compose", References: []string{"web:2", "proxy:1"}})
+	retired := db.ListRetiredImages()
+	require.Len(t, retired, 1)
+	assert.Equal(t, "web:1", retired[0].Reference)
+	assert.Equal(t, "compose", retired[0].Runtime)
+	assert.Equal(t, "deployment-1", retired[0].DeploymentID)
+
+	// going back to an image takes it off the list
+	db.SetDeploymentImages("deployment-1", DeploymentImages{Runtime: "compose", References: []string{"web:1", "proxy:1"}})
+	retired = db.ListRetiredImages()
+	require.Len(t, retired, 1)
+	assert.Equal(t, "web:2", retired[0].Reference)
+
+	db.RemoveDeployment("deployment-1")
+	var references []string
+	for _, image := range db.ListRetiredImages() {
+		references = append(references, image.Reference)
+	}
+	assert.ElementsMatch(t, []string{"web:2", "web:1", "proxy:1"}, references)
+
+	db.RecordImageRemoval(RetiredImage{Reference: "web:2", Runtime: "compose"}, 1024)
+	db.ForgetRetiredImage("compose", "proxy:1")
+
+	db.save()
+	state := newTestDatabase(t, dataDir).GetImageGCState()
+	require.Len(t, state.Retired, 1)
+	assert.Equal(t, "web:1", state.Retired[0].Reference)
+	assert.Equal(t, int64(1), state.RemovedImages)
+	assert.Equal(t, int64(1024), state.ReclaimedBytes)
+}
+
+func TestDeploymentHistory_TombstonesOfRemovedDeployments(t *testing.T) {
+	dataDir := t.TempDir()
+	db := newTestDatabase(t, dataDir, WithDeploymentHistoryRetention(3, 0))
+	for i := 1; i <= 5; i++ {
+		deploymentId := fmt.Sprintf("deployment-%d", i)
+		digest := fmt.Sprintf("sha256:%d", i)
+		require.NoError(t, db.SetDesiredState(deploymentId, AppDeploymentState{AppId: "app", AppVersion: "1.0.0", Digest: &digest}))
+		db.SetPhase(deploymentId, "removed", "removed by the WFM")
+		db.RemoveDeployment(deploymentId)
+	}
+	db.RemoveDeployment("deployment-unknown")
+
+	history := db.ListDeploymentHistory()
+	require.Len(t, history, 3, "the history is capped")
+	assert.Equal(t, "deployment-3", history[0].DeploymentID, "the oldest removals are dropped")
+	assert.Equal(t, "deployment-5", history[2].DeploymentID)
+	assert.Equal(t, "app", history[2].AppID)
+	assert.Equal(t, "1.0.0", history[2].AppVersion)
+	assert.Equal(t, "sha256:5", history[2].Digest)
+	assert.Equal(t, "removed", history[2].Phase)
+	assert.False(t, history[2].RemovedAt.IsZero())
+	assert.Empty(t, db.ListDeployments())
+
+	require.NoError(t, db.Persist())
+	reloaded := newTestDatabase(t, dataDir, WithDeploymentHistoryRetention(2, 0))
+	reloadedHistory := reloaded.ListDeploymentHistory()
+	require.Len(t, reloadedHistory, 2, "lowered limits apply to the loaded history")
+	assert.Equal(t, "deployment-4", reloadedHistory[0].DeploymentID)
+}
+
+func TestDeploymentHistory_CompactsExpiredTombstones(t *testing.T) {
+	dataDir := t.TempDir()
+	db := newTestDatabase(t, dataDir, WithDeploymentHistoryRetention(0, time.Hour))
+	for _, deploymentId := range []string{"deployment-old", "deployment-new"} {
+		require.NoError(t, db.SetDesiredState(deploymentId, AppDeploymentState{}))
+		db.RemoveDeployment(deploymentId)
+	}
+	db.mu.Lock()
+	db.deploymentHistory[0].RemovedAt = time.Now().Add(-2 * time.Hour)
+	db.mu.Unlock()
+
+	db.CompactDeploymentHistory()
+
+	history := db.ListDeploymentHistory()
+	require.Len(t, history, 1)
+	assert.Equal(t, "deployment-new", history[0].DeploymentID)
+
+	require.NoError(t, db.Persist())
+	data, err := os.ReadFile(filepath.Join(dataDir, "agent.database.json"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "deployment-old", "compacted tombstones are not kept in the file")
+}
+
+func TestDeploymentHistory_LoadsDatabaseWithoutHistory(t *testing.T) {
+	dataDir := t.TempDir()
+	// a database written before removed deployments were kept
+	legacy := `{
+		"deployments": {"deployment-1": {"AppID": "app", "DeploymentID": "deployment-1", "Phase": "running"}},
+		"deviceSettings": {"DeviceClientId": "client-1"},
+		"imageGC": {"removedImages": 0, "reclaimedBytes": 0}
+	}`
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "agent.database.json"), []byte(legacy), 0644))
+
+	db := newTestDatabase(t, dataDir)
+	assert.Empty(t, db.ListDeploymentHistory())
+	db.RemoveDeployment("deployment-1")
+
+	history := db.ListDeploymentHistory()
+	require.Len(t, history, 1)
+	assert.Equal(t, "app", history[0].AppID)
+	assert.Equal(t, "running", history[0].Phase)
+}
+
+func TestLoad_RecoversNullSettingsAndDeployments(t *testing.T) {
+	dataDir := t.TempDir()
+	// a hand-edited or partially written file
+	partial := `{
+		"deployments": null,
+		"deviceSettings": null,
+		"imageGC": {"removedImages": 0, "reclaimedBytes": 0}
+	}`
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, databaseFileName), []byte(partial), 0644))
+
+	core, logs := observer.New(zap.WarnLevel)
+	db := newTestDatabase(t, dataDir, WithLogger(zap.New(core).Sugar()))
+
+	assert.NotPanics(t, func() { db.GetLastSyncedETag() })
+	assert.Empty(t, db.ListDeployments())
+	require.NoError(t, db.SetDesiredState("deployment-1", AppDeploymentState{}))
+	require.NoError(t, db.SetLastSyncedETag(`"etag-1"`))
+
+	warnings := logs.FilterMessageSnippet("corrupt or partial").All()
+	require.Len(t, warnings, 1)
+	assert.Equal(t, []interface{}{"deviceSettings", "deployments"}, warnings[0].ContextMap()["reset"])
+}
+
+func TestLoad_DropsNullDeploymentRecords(t *testing.T) {
+	dataDir := t.TempDir()
+	partial := `{
+		"deployments": {"deployment-1": null, "deployment-2": {"AppID": "app", "DeploymentID": "deployment-2"}},
+		"deviceSettings": {"deviceClientId": "client-1"}
+	}`
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, databaseFileName), []byte(partial), 0644))
+
+	db := newTestDatabase(t, dataDir)
+	records := db.ListDeployments()
+	require.Len(t, records, 1)
+	assert.Equal(t, "deployment-2", records[0].DeploymentID)
+}
+
+func TestGetDeploymentHistory_DeployFailRedeploy(t *testing.T) {
+	type closableDatabase interface {
+		DatabaseIfc
+		Close()
+	}
+	backends := map[string]func(t *testing.T, dataDir string, opts ...Option) closableDatabase{
+		"json": func(t *testing.T, dataDir string, opts ...Option) closableDatabase {
+			return newTestDatabase(t, dataDir, opts...)
+		},
+		"sqlite": func(t *testing.T, dataDir string, opts ...Option) closableDatabase {
+			return newTestSQLiteDatabase(t, dataDir, opts...)
+		},
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			db := open(t, dataDir)
+			require.NoError(t, db.SetDesiredState("deployment-1", AppDeploymentState{}))
+			setState := func(state sbi.DeploymentStatusManifestStatusState) {
+				current := AppDeploymentState{}
+				current.Status.Status.State = state
+				db.SetCurrentState("deployment-1", current)
+			}
+
+			// deploy, the progress messages of a phase make a single entry
+			db.SetPhase("deployment-1", "DEPLOYING", "pulling images")
+			db.SetPhase("deployment-1", "DEPLOYING", "starting containers")
+			setState(sbi.DeploymentStatusManifestStatusStateInstalling)
+			// fail
+			db.SetPhase("deployment-1", "FAILED", "container web exited")
+			setState(sbi.DeploymentStatusManifestStatusStateFailed)
+			// redeploy
+			db.SetPhase("deployment-1", "DEPLOYING", "retrying")
+			setState(sbi.DeploymentStatusManifestStatusStateInstalled)
+			db.SetPhase("deployment-1", "RUNNING", "")
+
+			type transition struct {
+				Phase   string
+				Message string
+				State   sbi.DeploymentStatusManifestStatusState
+			}
+			transitions := func(history []DeploymentHistoryEntry) []transition {
+				var transitions []transition
+				for i, entry := range history {
+					if i > 0 {
+						assert.False(t, entry.Time.Before(history[i-1].Time), "the history is ordered")
+					}
+					transitions = append(transitions, transition{entry.Phase, entry.Message, entry.State})
+				}
+				return transitions
+			}
+			expected := []transition{
+				{"DEPLOYING", "starting containers", ""},
+				{"DEPLOYING", "starting containers", sbi.DeploymentStatusManifestStatusStateInstalling},
+				{"FAILED", "container web exited", sbi.DeploymentStatusManifestStatusStateInstalling},
+				{"FAILED", "container web exited", sbi.DeploymentStatusManifestStatusStateFailed},
+				{"DEPLOYING", "retrying", sbi.DeploymentStatusManifestStatusStateFailed},
+				{"DEPLOYING", "retrying", sbi.DeploymentStatusManifestStatusStateInstalled},
+				{"RUNNING", "", sbi.DeploymentStatusManifestStatusStateInstalled},
+			}
+			assert.Equal(t, expected, transitions(db.GetDeploymentHistory("deployment-1")))
+			assert.Nil(t, db.GetDeploymentHistory("deployment-unknown"))
+
+			// the history is persisted, a lower depth drops the oldest entries on the next change
+			require.NoError(t, db.Persist())
+			db.Close()
+			reloaded := open(t, dataDir, WithStateHistoryDepth(3))
+			assert.Equal(t, expected, transitions(reloaded.GetDeploymentHistory("deployment-1")))
+			reloaded.SetPhase("deployment-1", "REMOVING", "")
+			reloaded.RemoveDeployment("deployment-1")
+
+			history := reloaded.GetDeploymentHistory("deployment-1")
+			assert.Equal(t, []transition{
+				{"RUNNING", "", sbi.DeploymentStatusManifestStatusStateInstalled},
+				{"REMOVING", "", sbi.DeploymentStatusManifestStatusStateInstalled},
+				{"REMOVING", "", sbi.DeploymentStatusManifestStatusStateInstalled},
+			}, transitions(history), "the history of a removed deployment is kept with its tombstone")
+			require.Len(t, history, 3)
+			assert.True(t, history[2].Removed)
+		})
+	}
+}
+
+func TestNeedsReconciliation_NewDigestOfTheSameSpec(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	firstDigest, secondDigest := "sha256:first", "sha256:second"
+	desired := AppDeploymentState{Digest: &firstDigest}
+	desired.Status.Status.State = sbi.DeploymentStatusManifestStatusStateInstalled
+	require.NoError(t, db.SetDesiredState("deployment-a", desired))
+	db.SetCurrentState("deployment-a", desired)
+	assert.False(t, db.NeedsReconciliation("deployment-a"))
+
+	// stored while the first digest was being deployed
+	desired.Digest = &secondDigest
+	require.NoError(t, db.SetDesiredState("deployment-a", desired))
+	assert.True(t, db.NeedsReconciliation("deployment-a"))
+
+	record, err := db.GetDeployment("deployment-a")
+	require.NoError(t, err)
+	assert.False(t, DesiredDigestDeployed(record))
+	assert.Equal(t, secondDigest, record.Digest)
+}
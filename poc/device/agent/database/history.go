@@ -0,0 +1,61 @@
+package database
+
+import (
+	"slices"
+	"time"
+
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// defaultStateHistoryDepth is the number of entries kept in the history of a deployment
+const defaultStateHistoryDepth = 50
+
+// DeploymentHistoryEntry is a change of the phase or of the current state of a deployment
+type DeploymentHistoryEntry struct {
+	Time    time.Time `json:"time"`
+	Phase   string    `json:"phase,omitempty"`
+	Message string    `json:"message,omitempty"`
+	// State is the state of the current state, empty while the deployment has none
+	State sbi.DeploymentStatusManifestStatusState `json:"state,omitempty"`
+	// Removed marks the last entry of a removed deployment
+	Removed bool `json:"removed,omitempty"`
+}
+
+// WithStateHistoryDepth bounds the history of the phases and states of every deployment, 0 keeps
+// the default of 50 entries
+func WithStateHistoryDepth(depth int) Option {
+	return func(o *options) {
+		if depth > 0 {
+			o.stateHistoryDepth = depth
+		}
+	}
+}
+
+// recordHistory adds an entry with the phase, message and current state of the record to its
+// history. A change of the message alone, e.g. the progress of a deployment, updates the last
+// entry instead of adding one, so that the history is made of transitions. The oldest entries over
+// depth are dropped.
+func recordHistory(record *DeploymentRecord, depth int, removed bool) {
+	entry := DeploymentHistoryEntry{
+		Time:    time.Now(),
+		Phase:   record.Phase,
+		Message: record.Message,
+		Removed: removed,
+	}
+	if record.CurrentState != nil {
+		entry.State = record.CurrentState.Status.Status.State
+	}
+
+	// the history is copied on write, the copies of the record handed out share it
+	history := slices.Clone(record.History)
+	if last := len(history) - 1; last >= 0 && !removed && !history[last].Removed &&
+		history[last].Phase == entry.Phase && history[last].State == entry.State {
+		history[last] = entry
+	} else {
+		history = append(history, entry)
+	}
+	if excess := len(history) - depth; excess > 0 {
+		history = history[excess:]
+	}
+	record.History = history
+}
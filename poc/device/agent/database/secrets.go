@@ -0,0 +1,198 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SecretKeyEnv names the environment variable that holds the key material of the secrets stored in
+// the database. It takes precedence over the key file.
+const SecretKeyEnv = "MARGO_AGENT_DATABASE_KEY"
+
+// secretKeyFileName is the default key file in the data directory, it is created on the first save
+// of a secret
+const secretKeyFileName = "agent.secret.key"
+
+// sealedPrefix marks an encrypted value, values without it are plaintext written by older agents
+const sealedPrefix = "enc:v1:"
+
+// secretKeeper encrypts the secrets of the device settings before they are written to disk and
+// decrypts them when they are read. The key is derived from a device-local secret: the value of
+// SecretKeyEnv or the content of a key file only its owner may read.
+type secretKeeper struct {
+	keyFile string
+
+	mu   sync.Mutex
+	aead cipher.AEAD
+	// lastErr is the last failure to decrypt a secret, it is reported through Health
+	lastErr error
+}
+
+func newSecretKeeper(keyFile string) *secretKeeper {
+	return &secretKeeper{keyFile: keyFile}
+}
+
+// WithSecretKeyFile sets the file holding the key material of the secrets stored in the database,
+// by default agent.secret.key in the data directory
+func WithSecretKeyFile(path string) Option {
+	return func(o *options) {
+		o.secretKeyFile = path
+	}
+}
+
+func (o options) secretKeeper(dataDir string) *secretKeeper {
+	if o.secretKeyFile != "" {
+		return newSecretKeeper(o.secretKeyFile)
+	}
+	return newSecretKeeper(filepath.Join(dataDir, secretKeyFileName))
+}
+
+// seal encrypts a secret for storage, an empty secret stays empty
+func (k *secretKeeper) seal(secret string) (string, error) {
+	if secret == "" {
+		return secret, nil
+	}
+	aead, err := k.cipher(true)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate a nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// reveal decrypts a stored secret, plaintext written by older agents is returned as it is and
+// sealed on the next save. A secret that cannot be decrypted, e.g. because the key was lost, is
+// returned empty with the error, the ciphertext is never used as the secret, and the failure is
+// reported through Health.
+func (k *secretKeeper) reveal(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	secret, err := k.open(strings.TrimPrefix(value, sealedPrefix))
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.lastErr = err
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (k *secretKeeper) open(encoded string) (string, error) {
+	aead, err := k.cipher(false)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed sealed secret")
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt a secret, the key changed: %w", err)
+	}
+	return string(secret), nil
+}
+
+// err returns the last failure to decrypt a secret
+func (k *secretKeeper) err() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.lastErr
+}
+
+// cipher returns the cipher of the configured key, the key file is created when create is set and
+// there is no key yet
+func (k *secretKeeper) cipher(create bool) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.aead != nil {
+		return k.aead, nil
+	}
+
+	material, err := k.keyMaterial(create)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, material, nil, "margo agent database secrets", 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive the secret key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	k.aead, err = cipher.NewGCM(block)
+	return k.aead, err
+}
+
+func (k *secretKeeper) keyMaterial(create bool) ([]byte, error) {
+	if value := os.Getenv(SecretKeyEnv); value != "" {
+		return []byte(value), nil
+	}
+
+	info, err := os.Stat(k.keyFile)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		return k.createKeyFile()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the secret key file: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("the secret key file %s must only be accessible by its owner, it is %v", k.keyFile, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(k.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the secret key file: %w", err)
+	}
+	material := []byte(strings.TrimSpace(string(data)))
+	if len(material) == 0 {
+		return nil, fmt.Errorf("the secret key file %s is empty", k.keyFile)
+	}
+	return material, nil
+}
+
+// createKeyFile writes a random key readable by the owner only, it fails rather than replace a key
+// file created meanwhile
+func (k *secretKeeper) createKeyFile() ([]byte, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("failed to generate the secret key: %w", err)
+	}
+	material := []byte(hex.EncodeToString(random))
+
+	if err := os.MkdirAll(filepath.Dir(k.keyFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the secret key directory: %w", err)
+	}
+	f, err := os.OpenFile(k.keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the secret key file: %w", err)
+	}
+	if _, err := f.Write(append(material, '\n')); err != nil {
+		f.Close()
+		os.Remove(k.keyFile)
+		return nil, fmt.Errorf("failed to write the secret key file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(k.keyFile)
+		return nil, fmt.Errorf("failed to write the secret key file: %w", err)
+	}
+	return material, f.Close()
+}
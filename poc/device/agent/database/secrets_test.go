@@ -0,0 +1,135 @@
+package database
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testClientSecret = "s3cr3t-client-secret"
+
+// storedSettings reads the device settings as they are in the JSON file
+func storedSettings(t *testing.T, dataDir string) (string, *DeviceSettingsRecord) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dataDir, databaseFileName))
+	require.NoError(t, err)
+	var dump databaseDump
+	require.NoError(t, json.Unmarshal(data, &dump))
+	return string(data), dump.DeviceSettings
+}
+
+func TestSecrets_RoundTrip(t *testing.T) {
+	dataDir := t.TempDir()
+	db := newTestDatabase(t, dataDir)
+	require.NoError(t, db.SetDeviceSettings(DeviceSettingsRecord{DeviceClientId: "client-1", OAuthClientSecret: testClientSecret}))
+	require.NoError(t, db.Persist())
+
+	data, stored := storedSettings(t, dataDir)
+	assert.NotContains(t, data, testClientSecret)
+	assert.True(t, strings.HasPrefix(stored.OAuthClientSecret, sealedPrefix), "the secret is stored sealed")
+	settings, _ := db.GetDeviceSettings()
+	assert.Equal(t, testClientSecret, settings.OAuthClientSecret, "the secret stays in plaintext in memory")
+
+	info, err := os.Stat(filepath.Join(dataDir, secretKeyFileName))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	db.Close()
+	reopened := newTestDatabase(t, dataDir)
+	settings, _ = reopened.GetDeviceSettings()
+	assert.Equal(t, testClientSecret, settings.OAuthClientSecret)
+	assert.Equal(t, health.StatusOK, reopened.Health().Status)
+}
+
+func TestSecrets_LegacyPlaintextIsSealedOnNextSave(t *testing.T) {
+	dataDir := t.TempDir()
+	legacy := `{"deployments": {}, "deviceSettings": {"deviceClientId": "client-1", "clientSecret": "` + testClientSecret + `"}}`
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, databaseFileName), []byte(legacy), 0644))
+
+	db := newTestDatabase(t, dataDir)
+	settings, _ := db.GetDeviceSettings()
+	assert.Equal(t, testClientSecret, settings.OAuthClientSecret)
+
+	require.NoError(t, db.Persist())
+	data, _ := storedSettings(t, dataDir)
+	assert.NotContains(t, data, testClientSecret)
+}
+
+func TestSecrets_KeyFromEnvironment(t *testing.T) {
+	t.Setenv(SecretKeyEnv, "device-local-passphrase")
+	dataDir := t.TempDir()
+	db := newTestDatabase(t, dataDir)
+	require.NoError(t, db.SetDeviceSettings(DeviceSettingsRecord{OAuthClientSecret: testClientSecret}))
+	require.NoError(t, db.Persist())
+	assert.NoFileExists(t, filepath.Join(dataDir, secretKeyFileName), "no key file is needed")
+	db.Close()
+
+	reopened := newTestDatabase(t, dataDir)
+	settings, _ := reopened.GetDeviceSettings()
+	assert.Equal(t, testClientSecret, settings.OAuthClientSecret)
+	reopened.Close()
+
+	// another key cannot decrypt the secret, the ciphertext is not handed out as the secret but it is
+	// kept rather than lost
+	t.Setenv(SecretKeyEnv, "another-passphrase")
+	wrongKey := newTestDatabase(t, dataDir)
+	settings, _ = wrongKey.GetDeviceSettings()
+	assert.Empty(t, settings.OAuthClientSecret)
+	assert.Equal(t, health.StatusDegraded, wrongKey.Health().Status)
+	require.NoError(t, wrongKey.Persist())
+	_, stored := storedSettings(t, dataDir)
+	assert.True(t, strings.HasPrefix(stored.OAuthClientSecret, sealedPrefix))
+	wrongKey.Close()
+
+	t.Setenv(SecretKeyEnv, "device-local-passphrase")
+	restored := newTestDatabase(t, dataDir)
+	settings, _ = restored.GetDeviceSettings()
+	assert.Equal(t, testClientSecret, settings.OAuthClientSecret)
+}
+
+func TestSecrets_KeyFileReadableByOthersIsRefused(t *testing.T) {
+	dataDir := t.TempDir()
+	keyFile := filepath.Join(dataDir, "shared.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("passphrase\n"), 0644))
+
+	db := newTestDatabase(t, dataDir, WithSecretKeyFile(keyFile))
+	require.NoError(t, db.SetDeviceSettings(DeviceSettingsRecord{OAuthClientSecret: testClientSecret}))
+	require.Error(t, db.Persist(), "the secret is not written with a key others can read")
+	assert.NoFileExists(t, filepath.Join(dataDir, databaseFileName))
+
+	require.NoError(t, os.Chmod(keyFile, 0600))
+	require.NoError(t, db.Persist())
+}
+
+func TestSecrets_SQLiteRoundTripAndMigration(t *testing.T) {
+	dataDir := t.TempDir()
+	legacy := `{"deployments": {}, "deviceSettings": {"deviceClientId": "client-1", "clientSecret": "` + testClientSecret + `"}}`
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, databaseFileName), []byte(legacy), 0644))
+
+	db := newTestSQLiteDatabase(t, dataDir)
+	settings, err := db.GetDeviceSettings()
+	require.NoError(t, err)
+	assert.Equal(t, testClientSecret, settings.OAuthClientSecret, "the plaintext secret is migrated")
+
+	var stored string
+	require.NoError(t, db.db.QueryRow("SELECT settings FROM device_settings WHERE id = 1").Scan(&stored))
+	assert.NotContains(t, stored, testClientSecret)
+	assert.Contains(t, stored, sealedPrefix)
+	info, err := os.Stat(filepath.Join(dataDir, databaseFileName+migratedSuffix))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "the backup is only readable by its owner")
+
+	settings.OAuthClientSecret = "rotated-secret"
+	require.NoError(t, db.SetDeviceSettings(*settings))
+	db.Close()
+	reopened := newTestSQLiteDatabase(t, dataDir)
+	settings, err = reopened.GetDeviceSettings()
+	require.NoError(t, err)
+	assert.Equal(t, "rotated-secret", settings.OAuthClientSecret)
+}
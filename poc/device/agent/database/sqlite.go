@@ -0,0 +1,983 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/shared-lib/file"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteFileName is the file SQLiteDatabase keeps its tables in, in the data directory
+const sqliteFileName = "agent.database.sqlite"
+
+// sqliteSchemaVersion is kept in the user_version of the file, 0 is a file without tables
+const sqliteSchemaVersion = 1
+
+// migratedSuffix is appended to the JSON file of Database once it was imported
+const migratedSuffix = ".migrated"
+
+// The records are kept as JSON, the columns beside them are the ones the queries need
+const sqliteSchema = `
+CREATE TABLE deployments (
+	deployment_id TEXT PRIMARY KEY,
+	record        TEXT NOT NULL
+);
+CREATE TABLE device_settings (
+	id       INTEGER PRIMARY KEY CHECK (id = 1),
+	settings TEXT NOT NULL
+);
+CREATE TABLE sync_history (
+	seq    INTEGER PRIMARY KEY AUTOINCREMENT,
+	record TEXT NOT NULL
+);
+CREATE TABLE deployment_history (
+	seq           INTEGER PRIMARY KEY AUTOINCREMENT,
+	deployment_id TEXT NOT NULL,
+	removed_at    INTEGER NOT NULL,
+	tombstone     TEXT NOT NULL
+);
+CREATE TABLE retired_images (
+	seq           INTEGER PRIMARY KEY AUTOINCREMENT,
+	runtime       TEXT NOT NULL,
+	reference     TEXT NOT NULL,
+	deployment_id TEXT NOT NULL,
+	retired_at    INTEGER NOT NULL,
+	UNIQUE (runtime, reference)
+);
+CREATE TABLE image_gc_totals (
+	id              INTEGER PRIMARY KEY CHECK (id = 1),
+	removed_images  INTEGER NOT NULL,
+	reclaimed_bytes INTEGER NOT NULL
+);
+`
+
+// SQLiteDatabase keeps the agent database in tables of a SQLite file. Unlike Database, which writes
+// everything to one JSON file, every change is committed in its own transaction, so a power loss
+// during a write loses that change only. The first time it opens, it imports the JSON file of
+// Database from the same data directory.
+type SQLiteDatabase struct {
+	db *sql.DB
+	options
+	secrets *secretKeeper
+	// mu serializes the changes, they read a record, change it and write it back
+	mu sync.Mutex
+
+	subscribers         []func(string, *DeploymentRecord, DeploymentRecordChangeType)
+	transitionListeners []func(DeploymentTransition)
+	subscriberMu        sync.RWMutex
+
+	// outcome of the last writes, reported through Health
+	writeMu       sync.Mutex
+	writeFailures int
+	lastWriteErr  error
+	lastWriteAt   time.Time
+
+	stopCompaction chan struct{}
+	compactionDone chan struct{}
+	closeOnce      sync.Once
+}
+
+// querier is a *sql.DB or a *sql.Tx
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// NewSQLiteDatabase opens the SQLite file in the data directory, it is created and the JSON file of
+// Database is migrated into it when it does not exist yet
+func NewSQLiteDatabase(dataDir string, opts ...Option) (*SQLiteDatabase, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the data directory: %w", err)
+	}
+	// WAL with full synchronous commits survives a power loss without losing committed changes
+	dsn := "file:" + filepath.Join(dataDir, sqliteFileName) +
+		"?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)"
+	sqlDB, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the database: %w", err)
+	}
+	// the changes are serialized anyway, a single connection keeps SQLite from reporting busy
+	sqlDB.SetMaxOpenConns(1)
+
+	db := &SQLiteDatabase{
+		db:             sqlDB,
+		options:        newOptions(opts),
+		stopCompaction: make(chan struct{}),
+		compactionDone: make(chan struct{}),
+	}
+	db.secrets = db.options.secretKeeper(dataDir)
+	if err := db.migrate(dataDir); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	// the limits may have been lowered since the history was written
+	db.CompactDeploymentHistory()
+
+	go db.compactionLoop()
+	return db, nil
+}
+
+// migrate creates the tables of a new file and imports the JSON file of Database into them, in one
+// transaction. The JSON file is renamed once imported, it stays as a backup but is not imported
+// again.
+func (db *SQLiteDatabase) migrate(dataDir string) error {
+	var version int
+	if err := db.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read the database schema version: %w", err)
+	}
+	switch {
+	case version == sqliteSchemaVersion:
+		return nil
+	case version > sqliteSchemaVersion:
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, sqliteSchemaVersion)
+	}
+
+	jsonFile := filepath.Join(dataDir, databaseFileName)
+	dump, err := readDatabaseFile(jsonFile, db.secrets)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to read %s to migrate it: %w", jsonFile, err)
+		}
+		dump = nil
+	}
+	if dump != nil && len(dump.recovered) > 0 {
+		db.log.Warnw("The database file to migrate is corrupt or partial, reset what it is missing",
+			"file", jsonFile, "reset", dump.recovered)
+	}
+
+	err = db.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(sqliteSchema); err != nil {
+			return fmt.Errorf("failed to create the tables: %w", err)
+		}
+		if dump != nil {
+			if err := db.importDump(tx, dump); err != nil {
+				return fmt.Errorf("failed to migrate %s: %w", jsonFile, err)
+			}
+		}
+		_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", sqliteSchemaVersion))
+		return err
+	})
+	if err != nil || dump == nil {
+		return err
+	}
+	// the file of an older agent holds the plaintext client secret, it is sealed before the file
+	// becomes the backup
+	if err := sealDatabaseFileSecret(jsonFile, db.secrets); err != nil {
+		return fmt.Errorf("failed to seal the client secret of the migrated %s: %w", jsonFile, err)
+	}
+	if err := os.Rename(jsonFile, jsonFile+migratedSuffix); err != nil {
+		return fmt.Errorf("failed to rename the migrated %s: %w", jsonFile, err)
+	}
+	if err := os.Chmod(jsonFile+migratedSuffix, 0600); err != nil {
+		return fmt.Errorf("failed to restrict the migrated %s: %w", jsonFile, err)
+	}
+	return nil
+}
+
+// sealDatabaseFileSecret rewrites a JSON file of Database with its client secret sealed, the file is
+// kept as it is when the secret is empty or sealed already. Only the secret is changed, the rest of
+// the file stays as the older agent wrote it.
+func sealDatabaseFileSecret(path string, secrets *secretKeeper) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var content map[string]json.RawMessage
+	if err := json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	var settings map[string]json.RawMessage
+	if raw, ok := content["deviceSettings"]; !ok || json.Unmarshal(raw, &settings) != nil || settings == nil {
+		return nil
+	}
+	var secret string
+	if raw, ok := settings["clientSecret"]; !ok || json.Unmarshal(raw, &secret) != nil {
+		return nil
+	}
+	if secret == "" || strings.HasPrefix(secret, sealedPrefix) {
+		return nil
+	}
+
+	sealed, err := secrets.seal(secret)
+	if err != nil {
+		return err
+	}
+	if settings["clientSecret"], err = json.Marshal(sealed); err != nil {
+		return err
+	}
+	if content["deviceSettings"], err = json.Marshal(settings); err != nil {
+		return err
+	}
+	if data, err = json.MarshalIndent(content, "", "  "); err != nil {
+		return err
+	}
+	return file.WriteFileAtomic(path, data, 0600)
+}
+
+// importDump writes the content of a JSON file of Database into the tables
+func (db *SQLiteDatabase) importDump(tx *sql.Tx, dump *databaseDump) error {
+	for _, record := range dump.Deployments {
+		if err := writeDeployment(tx, record); err != nil {
+			return err
+		}
+	}
+	if dump.DeviceSettings != nil {
+		if err := db.writeDeviceSettings(tx, dump.DeviceSettings); err != nil {
+			return err
+		}
+	}
+	for _, record := range dump.SyncHistory {
+		if err := insertJSON(tx, "INSERT INTO sync_history (record) VALUES (?)", record); err != nil {
+			return err
+		}
+	}
+	for _, tombstone := range dump.DeploymentHistory {
+		if err := insertTombstone(tx, tombstone); err != nil {
+			return err
+		}
+	}
+	for _, image := range dump.ImageGC.Retired {
+		if err := insertRetiredImage(tx, image); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("INSERT INTO image_gc_totals (id, removed_images, reclaimed_bytes) VALUES (1, ?, ?)",
+		dump.ImageGC.RemovedImages, dump.ImageGC.ReclaimedBytes)
+	return err
+}
+
+// Close stops the history compaction and closes the file
+func (db *SQLiteDatabase) Close() {
+	db.closeOnce.Do(func() {
+		close(db.stopCompaction)
+		<-db.compactionDone
+		db.db.Close()
+	})
+}
+
+func (db *SQLiteDatabase) compactionLoop() {
+	defer close(db.compactionDone)
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db.CompactDeploymentHistory()
+		case <-db.stopCompaction:
+			return
+		}
+	}
+}
+
+// update runs change in a transaction, the outcome is reported through Health
+func (db *SQLiteDatabase) update(change func(tx *sql.Tx) error) error {
+	start := time.Now()
+	tx, err := db.db.Begin()
+	if err == nil {
+		if err = change(tx); err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}
+	db.recordWrite(err)
+	db.observePersist(time.Since(start), err)
+	return err
+}
+
+// changeDeployment reads the record of the deployment, lets change modify it and writes it back in
+// one transaction. It returns the written record, nil when the deployment does not exist. db.mu
+// must be held.
+func (db *SQLiteDatabase) changeDeployment(deploymentId string, change func(tx *sql.Tx, record *DeploymentRecord) error) *DeploymentRecord {
+	var changed *DeploymentRecord
+	err := db.update(func(tx *sql.Tx) error {
+		record, err := readDeployment(tx, deploymentId)
+		if err != nil || record == nil {
+			return err
+		}
+		if err := change(tx, record); err != nil {
+			return err
+		}
+		changed = record
+		return writeDeployment(tx, record)
+	})
+	if err != nil {
+		return nil
+	}
+	return changed
+}
+
+func (db *SQLiteDatabase) recordWrite(err error) {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	db.lastWriteErr = err
+	if err != nil {
+		db.writeFailures++
+		return
+	}
+	db.writeFailures = 0
+	db.lastWriteAt = time.Now()
+}
+
+func (db *SQLiteDatabase) Name() string {
+	return health.ComponentDatabase
+}
+
+// Health is unhealthy while writing to the database fails, the changes are lost
+func (db *SQLiteDatabase) Health() health.Report {
+	var deployments int
+	countErr := db.db.QueryRow("SELECT COUNT(*) FROM deployments").Scan(&deployments)
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	metrics := map[string]float64{
+		"deployments":                float64(deployments),
+		"consecutivePersistFailures": float64(db.writeFailures),
+	}
+	if !db.lastWriteAt.IsZero() {
+		metrics["secondsSincePersist"] = time.Since(db.lastWriteAt).Seconds()
+	}
+	report := health.OK(metrics)
+	switch {
+	case db.lastWriteErr != nil:
+		report.Fail(fmt.Sprintf("writing to the database failed: %v", db.lastWriteErr))
+	case countErr != nil:
+		report.Fail(fmt.Sprintf("reading the database failed: %v", countErr))
+	}
+	if err := db.secrets.err(); err != nil {
+		report.Degrade(fmt.Sprintf("the stored client secret cannot be decrypted: %v", err))
+	}
+	return report
+}
+
+// TriggerDataPersist does nothing, every change is committed right away
+func (db *SQLiteDatabase) TriggerDataPersist() {}
+
+// Persist does nothing, every change is committed right away
+func (db *SQLiteDatabase) Persist() error {
+	return nil
+}
+
+func (db *SQLiteDatabase) Subscribe(callback func(string, *DeploymentRecord, DeploymentRecordChangeType)) {
+	db.subscriberMu.Lock()
+	defer db.subscriberMu.Unlock()
+	db.subscribers = append(db.subscribers, callback)
+}
+
+func (db *SQLiteDatabase) notify(appID string, record *DeploymentRecord, changeType DeploymentRecordChangeType) {
+	db.subscriberMu.RLock()
+	subscribers := slices.Clone(db.subscribers)
+	db.subscriberMu.RUnlock()
+
+	for _, callback := range subscribers {
+		go callback(appID, record, changeType)
+	}
+}
+
+// SubscribeTransitions registers a listener for deployment phase changes, see
+// Database.SubscribeTransitions
+func (db *SQLiteDatabase) SubscribeTransitions(listener func(DeploymentTransition)) {
+	db.subscriberMu.Lock()
+	defer db.subscriberMu.Unlock()
+	db.transitionListeners = append(db.transitionListeners, listener)
+}
+
+// notifyTransition must be called with db.mu held, so the listeners see the changes in order
+func (db *SQLiteDatabase) notifyTransition(record *DeploymentRecord, previousPhase string) {
+	db.subscriberMu.RLock()
+	defer db.subscriberMu.RUnlock()
+
+	transition := DeploymentTransition{
+		DeploymentID:  record.DeploymentID,
+		AppID:         record.AppID,
+		PreviousPhase: previousPhase,
+		Phase:         record.Phase,
+		Message:       record.Message,
+		Digest:        record.Digest,
+		Time:          record.LastUpdated,
+	}
+	for _, listener := range db.transitionListeners {
+		listener(transition)
+	}
+}
+
+func (db *SQLiteDatabase) SetDesiredState(deploymentId string, state AppDeploymentState) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var record *DeploymentRecord
+	var added bool
+	err := db.update(func(tx *sql.Tx) error {
+		var err error
+		if record, err = readDeployment(tx, deploymentId); err != nil {
+			return err
+		}
+		if record == nil {
+			record = newDeploymentRecord(deploymentId)
+			added = true
+		}
+		applyDesiredState(record, state)
+		return writeDeployment(tx, record)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store the desired state of %s: %w", deploymentId, err)
+	}
+
+	if added {
+		db.notify(deploymentId, record, DeploymentChangeTypeDesiredStateAdded)
+	}
+	db.notify(deploymentId, record, DeploymentChangeTypeDesiredStateAdded)
+	return nil
+}
+
+func (db *SQLiteDatabase) SetCurrentState(deploymentId string, state AppDeploymentState) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.changeDeployment(deploymentId, func(tx *sql.Tx, record *DeploymentRecord) error {
+		record.CurrentState = &state
+		record.LastUpdated = time.Now()
+		recordHistory(record, db.stateHistoryDepth, false)
+		return nil
+	})
+}
+
+func (db *SQLiteDatabase) SetPhase(deploymentId, phase, message string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var previousPhase string
+	record := db.changeDeployment(deploymentId, func(tx *sql.Tx, record *DeploymentRecord) error {
+		previousPhase = record.Phase
+		record.Phase = phase
+		record.Message = message
+		record.LastUpdated = time.Now()
+		recordHistory(record, db.stateHistoryDepth, false)
+		return nil
+	})
+	if record == nil {
+		return
+	}
+	db.notifyTransition(record, previousPhase)
+	db.notify(deploymentId, record, DeploymentChangeTypeComponentPhaseChanged)
+}
+
+func (db *SQLiteDatabase) SetComponentStatus(deploymentId, componentName string, status sbi.ComponentStatus) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.changeDeployment(deploymentId, func(tx *sql.Tx, record *DeploymentRecord) error {
+		applyComponentStatus(record, componentName, status)
+		return nil
+	})
+}
+
+// SetRemovalBlockedSince records when the removal of a protected deployment was first held back, nil
+// once it is no longer
+func (db *SQLiteDatabase) SetRemovalBlockedSince(deploymentId string, since *time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.changeDeployment(deploymentId, func(tx *sql.Tx, record *DeploymentRecord) error {
+		record.RemovalBlockedSince = since
+		record.LastUpdated = time.Now()
+		return nil
+	})
+}
+
+// MarkComponentCompleted records that a one-shot component finished successfully for the given digest
+func (db *SQLiteDatabase) MarkComponentCompleted(deploymentId, componentName, digest string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.changeDeployment(deploymentId, func(tx *sql.Tx, record *DeploymentRecord) error {
+		if record.CompletedComponents == nil {
+			record.CompletedComponents = make(map[string]string)
+		}
+		record.CompletedComponents[componentName] = digest
+		record.LastUpdated = time.Now()
+		return nil
+	})
+}
+
+// IsComponentCompleted tells whether a one-shot component already completed for the given digest,
+// a component that completed for an older digest has to run again
+func (db *SQLiteDatabase) IsComponentCompleted(deploymentId, componentName, digest string) bool {
+	record, err := readDeployment(db.db, deploymentId)
+	if err != nil || record == nil || record.CompletedComponents == nil {
+		return false
+	}
+	completedDigest, completed := record.CompletedComponents[componentName]
+	return completed && completedDigest == digest
+}
+
+func (db *SQLiteDatabase) GetDeployment(deploymentId string) (*DeploymentRecord, error) {
+	record, err := readDeployment(db.db, deploymentId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deployment %s: %w", deploymentId, err)
+	}
+	if record == nil {
+		return nil, fmt.Errorf("deployment %s not found", deploymentId)
+	}
+	return record, nil
+}
+
+func (db *SQLiteDatabase) ListDeployments() []*DeploymentRecord {
+	return db.listDeployments(func(*DeploymentRecord) bool { return true })
+}
+
+// ListDeploymentsByPhase returns the deployments in the phase, compared case-insensitively
+func (db *SQLiteDatabase) ListDeploymentsByPhase(phase string) []*DeploymentRecord {
+	return db.listDeployments(inPhase(phase))
+}
+
+// ListDeploymentsByState returns the deployments whose current state is the state
+func (db *SQLiteDatabase) ListDeploymentsByState(state sbi.DeploymentStatusManifestStatusState) []*DeploymentRecord {
+	return db.listDeployments(inState(state))
+}
+
+// listDeployments returns the deployments matching keep, the records are matched once decoded as
+// the phase and state are inside the stored JSON
+func (db *SQLiteDatabase) listDeployments(keep func(*DeploymentRecord) bool) []*DeploymentRecord {
+	records := []*DeploymentRecord{}
+	rows, err := db.db.Query("SELECT record FROM deployments ORDER BY deployment_id")
+	if err != nil {
+		return records
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var record DeploymentRecord
+		if scanJSON(rows, &record) == nil && keep(&record) {
+			records = append(records, &record)
+		}
+	}
+	return records
+}
+
+func (db *SQLiteDatabase) RemoveDeployment(deploymentId string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var removed *DeploymentRecord
+	err := db.update(func(tx *sql.Tx) error {
+		record, err := readDeployment(tx, deploymentId)
+		if err != nil || record == nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM deployments WHERE deployment_id = ?", deploymentId); err != nil {
+			return err
+		}
+		recordHistory(record, db.stateHistoryDepth, true)
+		if err := insertTombstone(tx, newTombstone(record, time.Now())); err != nil {
+			return err
+		}
+		if _, err := db.compactDeploymentHistory(tx, time.Now()); err != nil {
+			return err
+		}
+		if record.Images != nil {
+			if err := retireImages(tx, deploymentId, record.Images.Runtime, record.Images.References); err != nil {
+				return err
+			}
+		}
+		removed = record
+		return nil
+	})
+	if err == nil && removed != nil {
+		db.notify(deploymentId, removed, DeploymentChangeTypeRecordDeleted)
+	}
+}
+
+// ListDeploymentHistory returns the removed deployments still kept in the history, oldest first
+func (db *SQLiteDatabase) ListDeploymentHistory() []DeploymentTombstone {
+	var history []DeploymentTombstone
+	rows, err := db.db.Query("SELECT tombstone FROM deployment_history ORDER BY seq")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tombstone DeploymentTombstone
+		if scanJSON(rows, &tombstone) == nil {
+			history = append(history, tombstone)
+		}
+	}
+	return history
+}
+
+// GetDeploymentHistory returns the last phases and states of the deployment, oldest first, see
+// Database.GetDeploymentHistory
+func (db *SQLiteDatabase) GetDeploymentHistory(deploymentId string) []DeploymentHistoryEntry {
+	var record DeploymentRecord
+	err := scanJSON(db.db.QueryRow("SELECT record FROM deployments WHERE deployment_id = ?", deploymentId), &record)
+	if err == nil {
+		return record.History
+	}
+	var tombstone DeploymentTombstone
+	err = scanJSON(db.db.QueryRow("SELECT tombstone FROM deployment_history WHERE deployment_id = ? ORDER BY seq DESC LIMIT 1", deploymentId), &tombstone)
+	if err != nil {
+		return nil
+	}
+	return tombstone.History
+}
+
+// CompactDeploymentHistory drops the removed deployments older than the maximum age and the oldest
+// ones over the maximum entries, it runs periodically
+func (db *SQLiteDatabase) CompactDeploymentHistory() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.update(func(tx *sql.Tx) error {
+		_, err := db.compactDeploymentHistory(tx, time.Now())
+		return err
+	})
+}
+
+// compactDeploymentHistory reports whether entries were dropped
+func (db *SQLiteDatabase) compactDeploymentHistory(tx *sql.Tx, now time.Time) (bool, error) {
+	byAge, err := tx.Exec("DELETE FROM deployment_history WHERE removed_at < ?",
+		now.Add(-db.deploymentHistoryMaxAge).UnixNano())
+	if err != nil {
+		return false, err
+	}
+	byCount, err := tx.Exec(`DELETE FROM deployment_history WHERE seq NOT IN
+		(SELECT seq FROM deployment_history ORDER BY seq DESC LIMIT ?)`, db.maxDeploymentHistory)
+	if err != nil {
+		return false, err
+	}
+	aged, _ := byAge.RowsAffected()
+	excess, _ := byCount.RowsAffected()
+	return aged+excess > 0, nil
+}
+
+// SetDeploymentImages records the images the current state of a deployment runs with, the
+// references it used before and no longer does are retired
+func (db *SQLiteDatabase) SetDeploymentImages(deploymentId string, images DeploymentImages) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.changeDeployment(deploymentId, func(tx *sql.Tx, record *DeploymentRecord) error {
+		if previous := record.Images; previous != nil {
+			if err := retireImages(tx, deploymentId, previous.Runtime, unusedImages(previous, images)); err != nil {
+				return err
+			}
+		}
+		// an image that is used again is no longer a removal candidate
+		for _, reference := range images.References {
+			if err := deleteRetiredImage(tx, images.Runtime, reference); err != nil {
+				return err
+			}
+		}
+		images.References = slices.Clone(images.References)
+		record.Images = &images
+		return nil
+	})
+}
+
+// retireImages records references that deploymentId stopped using, a reference that was retired
+// before restarts its grace period
+func retireImages(tx *sql.Tx, deploymentId, runtime string, references []string) error {
+	now := time.Now()
+	for _, reference := range references {
+		if err := deleteRetiredImage(tx, runtime, reference); err != nil {
+			return err
+		}
+		err := insertRetiredImage(tx, RetiredImage{
+			Reference:    reference,
+			Runtime:      runtime,
+			DeploymentID: deploymentId,
+			RetiredAt:    now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListRetiredImages returns the image references no deployment uses anymore, oldest first
+func (db *SQLiteDatabase) ListRetiredImages() []RetiredImage {
+	retired, _ := readRetiredImages(db.db)
+	return retired
+}
+
+// ForgetRetiredImage drops a retired reference without counting it as removed, e.g. because the
+// image is gone already
+func (db *SQLiteDatabase) ForgetRetiredImage(runtime, reference string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.update(func(tx *sql.Tx) error {
+		return deleteRetiredImage(tx, runtime, reference)
+	})
+}
+
+// RecordImageRemoval drops a retired reference the janitor removed and adds to the totals
+func (db *SQLiteDatabase) RecordImageRemoval(image RetiredImage, reclaimedBytes int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.update(func(tx *sql.Tx) error {
+		if err := deleteRetiredImage(tx, image.Runtime, image.Reference); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO image_gc_totals (id, removed_images, reclaimed_bytes) VALUES (1, 1, ?)
+			ON CONFLICT (id) DO UPDATE SET removed_images = removed_images + 1,
+			reclaimed_bytes = reclaimed_bytes + excluded.reclaimed_bytes`, reclaimedBytes)
+		return err
+	})
+}
+
+// GetImageGCState returns the retired references and what the janitor removed so far
+func (db *SQLiteDatabase) GetImageGCState() ImageGCState {
+	var state ImageGCState
+	err := db.db.QueryRow("SELECT removed_images, reclaimed_bytes FROM image_gc_totals WHERE id = 1").
+		Scan(&state.RemovedImages, &state.ReclaimedBytes)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return state
+	}
+	state.Retired, _ = readRetiredImages(db.db)
+	return state
+}
+
+// AddSyncRecord appends an applied manifest to the sync history
+func (db *SQLiteDatabase) AddSyncRecord(record SyncRecord) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.update(func(tx *sql.Tx) error {
+		if err := insertJSON(tx, "INSERT INTO sync_history (record) VALUES (?)", record); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM sync_history WHERE seq NOT IN
+			(SELECT seq FROM sync_history ORDER BY seq DESC LIMIT ?)`, maxSyncHistory)
+		return err
+	})
+}
+
+// ListSyncHistory returns the last applied manifests, oldest first
+func (db *SQLiteDatabase) ListSyncHistory() []SyncRecord {
+	var history []SyncRecord
+	rows, err := db.db.Query("SELECT record FROM sync_history ORDER BY seq")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var record SyncRecord
+		if scanJSON(rows, &record) == nil {
+			history = append(history, record)
+		}
+	}
+	return history
+}
+
+// SyncsOfDeployment returns the syncs in the history that delivered or removed the deployment,
+// oldest first
+func (db *SQLiteDatabase) SyncsOfDeployment(deploymentId string) []SyncRecord {
+	var syncs []SyncRecord
+	for _, record := range db.ListSyncHistory() {
+		if slices.Contains(record.Delivered, deploymentId) || slices.Contains(record.Removed, deploymentId) {
+			syncs = append(syncs, record)
+		}
+	}
+	return syncs
+}
+
+func (db *SQLiteDatabase) NeedsReconciliation(deploymentId string) bool {
+	record, err := readDeployment(db.db, deploymentId)
+	return err == nil && record != nil && needsReconciliation(record)
+}
+
+// GetDeviceSettings returns a copy of the device settings, changes are stored with SetDeviceSettings
+func (db *SQLiteDatabase) GetDeviceSettings() (*DeviceSettingsRecord, error) {
+	return db.readDeviceSettings(db.db)
+}
+
+func (db *SQLiteDatabase) SetDeviceSettings(settings DeviceSettingsRecord) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.update(func(tx *sql.Tx) error {
+		return db.writeDeviceSettings(tx, &settings)
+	})
+}
+
+func (db *SQLiteDatabase) IsDeviceOnboarded() (*DeviceSettingsRecord, bool, error) {
+	settings, err := db.GetDeviceSettings()
+	if err != nil {
+		return nil, false, err
+	}
+	return settings, settings.State == types.DeviceOnboardStateOnboarded, nil
+}
+
+// changeDeviceSettings reads the device settings, lets change modify them and writes them back
+func (db *SQLiteDatabase) changeDeviceSettings(change func(settings *DeviceSettingsRecord)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.update(func(tx *sql.Tx) error {
+		settings, err := db.readDeviceSettings(tx)
+		if err != nil {
+			return err
+		}
+		change(settings)
+		return db.writeDeviceSettings(tx, settings)
+	})
+}
+
+// ETag management for efficient polling
+func (db *SQLiteDatabase) GetLastSyncedETag() (string, error) {
+	settings, err := db.GetDeviceSettings()
+	if err != nil {
+		return "", err
+	}
+	if settings.LastSyncedETag == "" {
+		return "", fmt.Errorf("No previous ETag found")
+	}
+	return settings.LastSyncedETag, nil
+}
+
+func (db *SQLiteDatabase) SetLastSyncedETag(etag string) error {
+	return db.changeDeviceSettings(func(settings *DeviceSettingsRecord) {
+		settings.LastSyncedETag = etag
+	})
+}
+
+// Manifest version management for rollback protection
+func (db *SQLiteDatabase) GetLastSyncedManifestVersion() (uint64, error) {
+	settings, err := db.GetDeviceSettings()
+	if err != nil {
+		return 0, err
+	}
+	if settings.LastSyncedManifestVersion == 0 {
+		return 0, fmt.Errorf("no previous manifest version found")
+	}
+	return settings.LastSyncedManifestVersion, nil
+}
+
+func (db *SQLiteDatabase) SetLastSyncedManifestVersion(version uint64) error {
+	return db.changeDeviceSettings(func(settings *DeviceSettingsRecord) {
+		settings.LastSyncedManifestVersion = version
+	})
+}
+
+// Bundle digest management
+func (db *SQLiteDatabase) GetLastSyncedBundleDigest() (string, error) {
+	settings, err := db.GetDeviceSettings()
+	if err != nil {
+		return "", err
+	}
+	if settings.LastSyncedBundleDigest == "" {
+		return "", fmt.Errorf("no previous bundle digest found")
+	}
+	return settings.LastSyncedBundleDigest, nil
+}
+
+func (db *SQLiteDatabase) SetLastSyncedBundleDigest(digest string) error {
+	return db.changeDeviceSettings(func(settings *DeviceSettingsRecord) {
+		settings.LastSyncedBundleDigest = digest
+	})
+}
+
+// readDeployment returns nil when the deployment does not exist
+func readDeployment(q querier, deploymentId string) (*DeploymentRecord, error) {
+	var record DeploymentRecord
+	err := scanJSON(q.QueryRow("SELECT record FROM deployments WHERE deployment_id = ?", deploymentId), &record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func writeDeployment(tx *sql.Tx, record *DeploymentRecord) error {
+	return insertJSON(tx, `INSERT INTO deployments (record, deployment_id) VALUES (?, ?)
+		ON CONFLICT (deployment_id) DO UPDATE SET record = excluded.record`, record, record.DeploymentID)
+}
+
+// readDeviceSettings returns empty settings when none were stored yet, like a new Database, the
+// secrets are decrypted
+func (db *SQLiteDatabase) readDeviceSettings(q querier) (*DeviceSettingsRecord, error) {
+	var settings DeviceSettingsRecord
+	err := scanJSON(q.QueryRow("SELECT settings FROM device_settings WHERE id = 1"), &settings)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to read the device settings: %w", err)
+	}
+	revealDeviceSettings(&settings, db.secrets)
+	return &settings, nil
+}
+
+// writeDeviceSettings stores the settings with the secrets encrypted
+func (db *SQLiteDatabase) writeDeviceSettings(tx *sql.Tx, settings *DeviceSettingsRecord) error {
+	sealed, err := sealDeviceSettings(settings, db.secrets)
+	if err != nil {
+		return err
+	}
+	return insertJSON(tx, `INSERT INTO device_settings (id, settings) VALUES (1, ?)
+		ON CONFLICT (id) DO UPDATE SET settings = excluded.settings`, sealed)
+}
+
+func insertTombstone(tx *sql.Tx, tombstone DeploymentTombstone) error {
+	return insertJSON(tx, "INSERT INTO deployment_history (tombstone, deployment_id, removed_at) VALUES (?, ?, ?)",
+		tombstone, tombstone.DeploymentID, tombstone.RemovedAt.UnixNano())
+}
+
+func insertRetiredImage(tx *sql.Tx, image RetiredImage) error {
+	_, err := tx.Exec("INSERT INTO retired_images (runtime, reference, deployment_id, retired_at) VALUES (?, ?, ?, ?)",
+		image.Runtime, image.Reference, image.DeploymentID, image.RetiredAt.UnixNano())
+	return err
+}
+
+func deleteRetiredImage(tx *sql.Tx, runtime, reference string) error {
+	_, err := tx.Exec("DELETE FROM retired_images WHERE runtime = ? AND reference = ?", runtime, reference)
+	return err
+}
+
+// readRetiredImages returns the retired references, oldest first
+func readRetiredImages(q querier) ([]RetiredImage, error) {
+	rows, err := q.Query("SELECT runtime, reference, deployment_id, retired_at FROM retired_images ORDER BY seq")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var retired []RetiredImage
+	for rows.Next() {
+		var image RetiredImage
+		var retiredAt int64
+		if err := rows.Scan(&image.Runtime, &image.Reference, &image.DeploymentID, &retiredAt); err != nil {
+			return retired, err
+		}
+		image.RetiredAt = time.Unix(0, retiredAt)
+		retired = append(retired, image)
+	}
+	return retired, rows.Err()
+}
+
+// insertJSON runs the statement with value encoded as JSON as its first argument
+func insertJSON(tx *sql.Tx, statement string, value any, args ...any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(statement, append([]any{string(data)}, args...)...)
+	return err
+}
+
+// scanJSON decodes the single JSON column of a row into value
+func scanJSON(row interface{ Scan(dest ...any) error }, value any) error {
+	var data string
+	if err := row.Scan(&data); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), value)
+}
@@ -0,0 +1,208 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSQLiteDatabase(t *testing.T, dataDir string, opts ...Option) *SQLiteDatabase {
+	t.Helper()
+	db, err := NewSQLiteDatabase(dataDir, opts...)
+	require.NoError(t, err)
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestSQLiteDatabase_ConcurrentChanges(t *testing.T) {
+	dataDir := t.TempDir()
+	db := newTestSQLiteDatabase(t, dataDir)
+
+	var transitions sync.Map
+	db.SubscribeTransitions(func(transition DeploymentTransition) {
+		transitions.Store(transition.DeploymentID+"/"+transition.Phase, true)
+	})
+
+	const deployments = 20
+	var wg sync.WaitGroup
+	for i := 0; i < deployments; i++ {
+		deploymentId := fmt.Sprintf("deployment-%d", i)
+		digest := fmt.Sprintf("sha256:%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, db.SetDesiredState(deploymentId, AppDeploymentState{AppId: "app", Digest: &digest}))
+			db.SetPhase(deploymentId, "deploying", "")
+			db.SetCurrentState(deploymentId, AppDeploymentState{AppId: "app", Digest: &digest})
+			db.SetPhase(deploymentId, "running", "")
+			if i%2 == 0 {
+				db.RemoveDeployment(deploymentId)
+			}
+		}()
+		// writers racing on the same deployment must not lose each other's changes
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				db.SetCurrentState(deploymentId, AppDeploymentState{AppId: "app", Digest: &digest})
+				db.ListDeployments()
+			}
+		}()
+	}
+	wg.Wait()
+
+	records := db.ListDeployments()
+	require.Len(t, records, deployments/2, "the even deployments are removed")
+	for _, record := range records {
+		assert.Equal(t, "running", record.Phase, record.DeploymentID)
+		require.NotNil(t, record.DesiredState, record.DeploymentID)
+		require.NotNil(t, record.CurrentState, record.DeploymentID)
+		assert.Equal(t, record.Digest, *record.CurrentState.Digest)
+		_, seen := transitions.Load(record.DeploymentID + "/running")
+		assert.True(t, seen, "the transitions of %s are reported", record.DeploymentID)
+	}
+	assert.Len(t, db.ListDeploymentHistory(), deployments/2)
+	assert.Equal(t, health.StatusOK, db.Health().Status)
+
+	// every change was committed, a new connection sees them
+	db.Close()
+	reopened := newTestSQLiteDatabase(t, dataDir)
+	assert.Len(t, reopened.ListDeployments(), deployments/2)
+	_, err := reopened.GetDeployment("deployment-0")
+	assert.Error(t, err, "the removal was committed")
+}
+
+func TestSQLiteDatabase_MigratesJSONDatabase(t *testing.T) {
+	dataDir := t.TempDir()
+	digest := "sha256:1"
+	legacy := NewDatabase(dataDir)
+	require.NoError(t, legacy.SetDeviceSettings(DeviceSettingsRecord{DeviceClientId: "client-1", State: types.DeviceOnboardStateOnboarded}))
+	require.NoError(t, legacy.SetLastSyncedETag(`"etag-1"`))
+	require.NoError(t, legacy.SetDesiredState("deployment-1", AppDeploymentState{AppId: "app", Digest: &digest}))
+	legacy.SetComponentStatus("deployment-1", "web", sbi.ComponentStatus{State: sbi.ComponentStatusStateInstalled})
+	legacy.SetDeploymentImages("deployment-1", DeploymentImages{Runtime: "compose", References: []string{"web:1"}})
+	legacy.SetDeploymentImages("deployment-1", DeploymentImages{Runtime: "compose", References: []string{"web:2"}})
+	require.NoError(t, legacy.SetDesiredState("deployment-2", AppDeploymentState{}))
+	legacy.RemoveDeployment("deployment-2")
+	legacy.AddSyncRecord(SyncRecord{ManifestVersion: 3, Delivered: []string{"deployment-1"}})
+	legacy.Close()
+
+	db := newTestSQLiteDatabase(t, dataDir)
+
+	settings, onboarded, err := db.IsDeviceOnboarded()
+	require.NoError(t, err)
+	assert.True(t, onboarded)
+	assert.Equal(t, "client-1", settings.DeviceClientId)
+	etag, err := db.GetLastSyncedETag()
+	require.NoError(t, err)
+	assert.Equal(t, `"etag-1"`, etag)
+
+	record, err := db.GetDeployment("deployment-1")
+	require.NoError(t, err)
+	assert.Equal(t, "running", record.Phase)
+	assert.Equal(t, digest, record.Digest)
+	assert.True(t, record.Provenance.IsUnknown(), "the provenance is migrated like on load")
+	assert.Equal(t, []string{"web:2"}, record.Images.References)
+
+	require.Len(t, db.ListDeploymentHistory(), 1)
+	assert.Equal(t, "deployment-2", db.ListDeploymentHistory()[0].DeploymentID)
+	assert.Len(t, db.SyncsOfDeployment("deployment-1"), 1)
+	retired := db.GetImageGCState().Retired
+	require.Len(t, retired, 1)
+	assert.Equal(t, "web:1", retired[0].Reference)
+
+	assert.NoFileExists(t, filepath.Join(dataDir, databaseFileName))
+	assert.FileExists(t, filepath.Join(dataDir, databaseFileName+migratedSuffix))
+
+	// a JSON file showing up later is not imported again
+	db.RemoveDeployment("deployment-1")
+	db.Close()
+	require.NoError(t, os.Rename(filepath.Join(dataDir, databaseFileName+migratedSuffix), filepath.Join(dataDir, databaseFileName)))
+	reopened := newTestSQLiteDatabase(t, dataDir)
+	assert.Empty(t, reopened.ListDeployments())
+	assert.FileExists(t, filepath.Join(dataDir, databaseFileName))
+}
+
+func TestSQLiteDatabase_MigratedBackupHasTheSecretSealed(t *testing.T) {
+	dataDir := t.TempDir()
+	legacy := `{"deployments": {}, "deviceSettings": {"deviceClientId": "client-1", "clientSecret": "` + testClientSecret + `"}}`
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, databaseFileName), []byte(legacy), 0644))
+
+	db := newTestSQLiteDatabase(t, dataDir)
+
+	backupFile := filepath.Join(dataDir, databaseFileName+migratedSuffix)
+	backup, err := os.ReadFile(backupFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(backup), testClientSecret)
+	assert.Contains(t, string(backup), sealedPrefix)
+	info, err := os.Stat(backupFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the backup can still be restored with the key of the database
+	dump, err := readDatabaseFile(backupFile, db.secrets)
+	require.NoError(t, err)
+	assert.Equal(t, "client-1", dump.DeviceSettings.DeviceClientId)
+	assert.Equal(t, testClientSecret, dump.DeviceSettings.OAuthClientSecret)
+}
+
+func TestSQLiteDatabase_InvalidJSONDatabaseIsNotMigrated(t *testing.T) {
+	dataDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, databaseFileName), []byte("{truncated"), 0644))
+
+	_, err := NewSQLiteDatabase(dataDir)
+	require.Error(t, err)
+
+	// the import is retried once the file is fixed or moved away
+	require.NoError(t, os.Remove(filepath.Join(dataDir, databaseFileName)))
+	db := newTestSQLiteDatabase(t, dataDir)
+	assert.Empty(t, db.ListDeployments())
+}
+
+func TestSQLiteDatabase_HistoriesAndImages(t *testing.T) {
+	dataDir := t.TempDir()
+	db := newTestSQLiteDatabase(t, dataDir, WithDeploymentHistoryRetention(2, time.Hour))
+
+	for i := 1; i <= 3; i++ {
+		deploymentId := fmt.Sprintf("deployment-%d", i)
+		require.NoError(t, db.SetDesiredState(deploymentId, AppDeploymentState{}))
+		db.RemoveDeployment(deploymentId)
+	}
+	history := db.ListDeploymentHistory()
+	require.Len(t, history, 2, "the history is capped")
+	assert.Equal(t, "deployment-2", history[0].DeploymentID)
+
+	for i := 0; i < maxSyncHistory+5; i++ {
+		db.AddSyncRecord(SyncRecord{ManifestVersion: uint64(i)})
+	}
+	syncs := db.ListSyncHistory()
+	require.Len(t, syncs, maxSyncHistory)
+	assert.Equal(t, uint64(5), syncs[0].ManifestVersion, "the oldest syncs are dropped")
+
+	require.NoError(t, db.SetDesiredState("deployment-web", AppDeploymentState{}))
+	db.SetDeploymentImages("deployment-web", DeploymentImages{Runtime: "compose", References: []string{"web:1", "db:1"}})
+	db.SetDeploymentImages("deployment-web", DeploymentImages{Runtime: "compose", References: []string{"web:2", "db:1"}})
+	db.RecordImageRemoval(RetiredImage{Runtime: "compose", Reference: "web:1"}, 1024)
+	db.SetDeploymentImages("deployment-web", DeploymentImages{Runtime: "compose", References: []string{"web:2"}})
+	db.ForgetRetiredImage("compose", "unknown:1")
+
+	state := db.GetImageGCState()
+	require.Len(t, state.Retired, 1)
+	assert.Equal(t, "db:1", state.Retired[0].Reference)
+	assert.Equal(t, "deployment-web", state.Retired[0].DeploymentID)
+	assert.Equal(t, int64(1), state.RemovedImages)
+	assert.Equal(t, int64(1024), state.ReclaimedBytes)
+
+	db.MarkComponentCompleted("deployment-web", "migrate", "sha256:1")
+	assert.True(t, db.IsComponentCompleted("deployment-web", "migrate", "sha256:1"))
+	assert.False(t, db.IsComponentCompleted("deployment-web", "migrate", "sha256:2"))
+}
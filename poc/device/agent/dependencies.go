@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/shared-lib/dependency"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// Phases of deployments held back by the dependencies between applications
+const (
+	// phaseWaitingDependency holds an installation until the applications it depends on are installed
+	phaseWaitingDependency = "WAITING_DEPENDENCY"
+	// phaseWaitingDependents holds a removal while installed deployments depend on its application
+	phaseWaitingDependents = "WAITING_DEPENDENTS"
+)
+
+// ForceRemoval lets the next removal of the deployment go ahead although other deployments still
+// depend on its application or it is protected from removal
+func (dm *DeploymentManager) ForceRemoval(deploymentId string) error {
+	if _, err := dm.database.GetDeployment(deploymentId); err != nil {
+		return fmt.Errorf("%w %s", errUnknownDeployment, deploymentId)
+	}
+	dm.forcedRemovals.Store(deploymentId, true)
+	return nil
+}
+
+// dependenciesReady reports whether the applications the deployment depends on are installed. If
+// they are not the deployment waits in phaseWaitingDependency, a circular dependency fails it.
+func (dm *DeploymentManager) dependenciesReady(ctx context.Context, record *database.DeploymentRecord) bool {
+	if record.DesiredState == nil || len(record.DesiredState.Dependencies) == 0 {
+		return true
+	}
+
+	unmet, err := unmetDependencies(record, dm.database.ListDeployments())
+	if err != nil {
+		if record.Phase != "FAILED" || record.Message != err.Error() {
+			dm.log.Errorw("Cannot install the deployment", "deploymentId", record.DeploymentID, "appId", record.AppID, "error", err)
+			dm.setPhase(ctx, record.DeploymentID, "FAILED", err.Error())
+		}
+		return false
+	}
+	if len(unmet) == 0 {
+		return true
+	}
+
+	message := fmt.Sprintf("waiting for dependencies: %s", strings.Join(unmet, "; "))
+	if record.Phase != phaseWaitingDependency || record.Message != message {
+		dm.log.Infow("Deployment waits for its dependencies", "deploymentId", record.DeploymentID, "appId", record.AppID, "unmet", unmet)
+		dm.setPhase(ctx, record.DeploymentID, phaseWaitingDependency, message)
+	}
+	return false
+}
+
+// removalAllowed reports whether the deployment can be removed. While other deployments depend on
+// its application the removal waits in phaseWaitingDependents, unless it was forced.
+func (dm *DeploymentManager) removalAllowed(ctx context.Context, record *database.DeploymentRecord) bool {
+	dependents := dependentsOf(record, dm.database.ListDeployments())
+	if len(dependents) == 0 {
+		dm.forcedRemovals.Delete(record.DeploymentID)
+		return true
+	}
+	if _, forced := dm.forcedRemovals.LoadAndDelete(record.DeploymentID); forced {
+		dm.log.Warnw("Forcing the removal of a deployment other deployments depend on",
+			"deploymentId", record.DeploymentID, "appId", record.AppID, "dependents", dependents)
+		return true
+	}
+
+	message := fmt.Sprintf("application %s is still required by %s, remove them first or force the removal",
+		record.AppID, strings.Join(dependents, ", "))
+	if record.Phase != phaseWaitingDependents || record.Message != message {
+		dm.log.Warnw("Holding the removal of a deployment other deployments depend on",
+			"deploymentId", record.DeploymentID, "appId", record.AppID, "dependents", dependents)
+		dm.setPhase(ctx, record.DeploymentID, phaseWaitingDependents, message)
+	}
+	return false
+}
+
+// unmetDependencies describes the dependencies of the deployment that no installed deployment
+// satisfies, or returns a *dependency.CycleError if the application depends on itself
+func unmetDependencies(record *database.DeploymentRecord, records []*database.DeploymentRecord) ([]string, error) {
+	if cycle := dependencyGraph(records).FindCycle(record.AppID); cycle != nil {
+		return nil, &dependency.CycleError{Cycle: cycle}
+	}
+
+	var unmet []string
+	for _, requirement := range record.DesiredState.Dependencies {
+		reason := "not deployed"
+		for _, candidate := range records {
+			if candidate.DeploymentID == record.DeploymentID || candidate.AppID != requirement.ID || isBeingRemoved(candidate) {
+				continue
+			}
+			if !isInstalled(candidate) {
+				reason = "not installed yet"
+				continue
+			}
+			satisfied, err := requirement.SatisfiedBy(candidate.AppVersion)
+			if err != nil {
+				return nil, err
+			}
+			if satisfied {
+				reason = ""
+				break
+			}
+			reason = fmt.Sprintf("installed version %q does not match", candidate.AppVersion)
+		}
+		if reason != "" {
+			unmet = append(unmet, fmt.Sprintf("%s %s", requirement, reason))
+		}
+	}
+	return unmet, nil
+}
+
+// dependentsOf returns the deployments on the device that depend on the application of the
+// deployment, none if another deployment of the application stays
+func dependentsOf(record *database.DeploymentRecord, records []*database.DeploymentRecord) []string {
+	for _, other := range records {
+		if other.DeploymentID != record.DeploymentID && other.AppID == record.AppID && !isBeingRemoved(other) {
+			return nil
+		}
+	}
+
+	var dependents []string
+	for _, other := range records {
+		if other.DeploymentID == record.DeploymentID || other.DesiredState == nil || !isDeployed(other) {
+			continue
+		}
+		for _, requirement := range other.DesiredState.Dependencies {
+			if requirement.ID == record.AppID {
+				dependents = append(dependents, other.DeploymentID)
+				break
+			}
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// dependencyGraph maps the application of every deployment that is to stay on the device to the
+// applications it depends on
+func dependencyGraph(records []*database.DeploymentRecord) dependency.Graph {
+	graph := dependency.Graph{}
+	for _, record := range records {
+		if record.DesiredState == nil || isBeingRemoved(record) {
+			continue
+		}
+		dependencies := graph[record.AppID]
+		for _, requirement := range record.DesiredState.Dependencies {
+			dependencies = append(dependencies, requirement.ID)
+		}
+		graph[record.AppID] = dependencies
+	}
+	return graph
+}
+
+func isBeingRemoved(record *database.DeploymentRecord) bool {
+	if record.DesiredState == nil {
+		return false
+	}
+	state := record.DesiredState.Status.Status.State
+	return state == sbi.DeploymentStatusManifestStatusStateRemoving || state == sbi.DeploymentStatusManifestStatusStateRemoved
+}
+
+func isInstalled(record *database.DeploymentRecord) bool {
+	return record.CurrentState != nil && record.CurrentState.Status.Status.State == sbi.DeploymentStatusManifestStatusStateInstalled
+}
+
+// isDeployed reports whether something of the deployment may be running on the device
+func isDeployed(record *database.DeploymentRecord) bool {
+	return record.CurrentState != nil && record.CurrentState.Status.Status.State != sbi.DeploymentStatusManifestStatusStateRemoved
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/shared-lib/dependency"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// dependencyTestEnv stores deployments of applications, installed ones get a current state
+type dependencyTestEnv struct {
+	t  *testing.T
+	db *database.Database
+	dm *DeploymentManager
+}
+
+func newDependencyTestEnv(t *testing.T) *dependencyTestEnv {
+	db := newTestDatabase(t, t.TempDir())
+	return &dependencyTestEnv{t: t, db: db, dm: NewDeploymentManager(db, nil, nil, zap.NewNop().Sugar())}
+}
+
+func (env *dependencyTestEnv) deploy(deploymentId, appId, version string, state sbi.DeploymentStatusManifestStatusState, dependencies ...dependency.Requirement) {
+	env.t.Helper()
+	desired := database.AppDeploymentState{AppId: appId, AppVersion: version, Dependencies: dependencies}
+	desired.Status.Status.State = sbi.DeploymentStatusManifestStatusStatePending
+	require.NoError(env.t, env.db.SetDesiredState(deploymentId, desired))
+	if state != "" {
+		current := desired
+		current.Status.Status.State = state
+		env.db.SetCurrentState(deploymentId, current)
+	}
+}
+
+func (env *dependencyTestEnv) remove(deploymentId string) {
+	env.t.Helper()
+	record := env.record(deploymentId)
+	removing := *record.DesiredState
+	removing.Status.Status.State = sbi.DeploymentStatusManifestStatusStateRemoving
+	require.NoError(env.t, env.db.SetDesiredState(deploymentId, removing))
+}
+
+func (env *dependencyTestEnv) record(deploymentId string) *database.DeploymentRecord {
+	env.t.Helper()
+	record, err := env.db.GetDeployment(deploymentId)
+	require.NoError(env.t, err)
+	return record
+}
+
+func TestDependenciesReady(t *testing.T) {
+	installed := sbi.DeploymentStatusManifestStatusStateInstalled
+	tests := []struct {
+		name        string
+		setup       func(env *dependencyTestEnv)
+		requirement dependency.Requirement
+		wantReady   bool
+		wantMessage string
+	}{
+		{
+			name:        "satisfied",
+			setup:       func(env *dependencyTestEnv) { env.deploy("deployment-broker", "mqtt-broker", "1.3.0", installed) },
+			requirement: dependency.Requirement{ID: "mqtt-broker", Version: "^1.2"},
+			wantReady:   true,
+		},
+		{
+			name:        "missing",
+			setup:       func(env *dependencyTestEnv) {},
+			requirement: dependency.Requirement{ID: "mqtt-broker"},
+			wantMessage: "waiting for dependencies: mqtt-broker not deployed",
+		},
+		{
+			name:        "not installed yet",
+			setup:       func(env *dependencyTestEnv) { env.deploy("deployment-broker", "mqtt-broker", "1.3.0", "") },
+			requirement: dependency.Requirement{ID: "mqtt-broker"},
+			wantMessage: "waiting for dependencies: mqtt-broker not installed yet",
+		},
+		{
+			name:        "version mismatch",
+			setup:       func(env *dependencyTestEnv) { env.deploy("deployment-broker", "mqtt-broker", "1.1.0", installed) },
+			requirement: dependency.Requirement{ID: "mqtt-broker", Version: "^1.2"},
+			wantMessage: `waiting for dependencies: mqtt-broker (^1.2) installed version "1.1.0" does not match`,
+		},
+		{
+			name: "being removed",
+			setup: func(env *dependencyTestEnv) {
+				env.deploy("deployment-broker", "mqtt-broker", "1.3.0", installed)
+				env.remove("deployment-broker")
+			},
+			requirement: dependency.Requirement{ID: "mqtt-broker"},
+			wantMessage: "waiting for dependencies: mqtt-broker not deployed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newDependencyTestEnv(t)
+			tt.setup(env)
+			env.deploy("deployment-dashboard", "dashboard", "1.0.0", "", tt.requirement)
+
+			assert.Equal(t, tt.wantReady, env.dm.dependenciesReady(context.Background(), env.record("deployment-dashboard")))
+			record := env.record("deployment-dashboard")
+			if tt.wantReady {
+				assert.NotEqual(t, phaseWaitingDependency, record.Phase)
+				return
+			}
+			assert.Equal(t, phaseWaitingDependency, record.Phase)
+			assert.Equal(t, tt.wantMessage, record.Message)
+		})
+	}
+}
+
+func TestDependenciesReady_WaitsUntilTheDependencyIsInstalled(t *testing.T) {
+	env := newDependencyTestEnv(t)
+	env.deploy("deployment-dashboard", "dashboard", "1.0.0", "", dependency.Requirement{ID: "mqtt-broker"})
+
+	// the reconciler holds the dependent without touching a runtime
+	env.dm.reconcileDeployment("deployment-dashboard")
+	assert.Equal(t, phaseWaitingDependency, env.record("deployment-dashboard").Phase)
+	assert.True(t, env.db.NeedsReconciliation("deployment-dashboard"), "the dependent is reconciled again")
+
+	env.deploy("deployment-broker", "mqtt-broker", "2.0.0", sbi.DeploymentStatusManifestStatusStateInstalled)
+	assert.True(t, env.dm.dependenciesReady(context.Background(), env.record("deployment-dashboard")))
+}
+
+func TestDependenciesReady_CircularDependency(t *testing.T) {
+	env := newDependencyTestEnv(t)
+	env.deploy("deployment-a", "app-a", "1.0.0", "", dependency.Requirement{ID: "app-b"})
+	env.deploy("deployment-b", "app-b", "1.0.0", "", dependency.Requirement{ID: "app-a"})
+
+	env.dm.reconcileDeployment("deployment-a")
+	record := env.record("deployment-a")
+	assert.Equal(t, "FAILED", record.Phase)
+	assert.Equal(t, "circular dependency: app-a -> app-b -> app-a", record.Message)
+}
+
+func TestRemovalAllowed(t *testing.T) {
+	installed := sbi.DeploymentStatusManifestStatusStateInstalled
+	env := newDependencyTestEnv(t)
+	env.deploy("deployment-broker", "mqtt-broker", "1.3.0", installed)
+	env.deploy("deployment-dashboard", "dashboard", "1.0.0", installed, dependency.Requirement{ID: "mqtt-broker"})
+	// dependents that were never installed do not hold the removal
+	env.deploy("deployment-waiting", "historian", "1.0.0", "", dependency.Requirement{ID: "mqtt-broker"})
+	env.remove("deployment-broker")
+
+	env.dm.reconcileDeployment("deployment-broker")
+	record := env.record("deployment-broker")
+	assert.Equal(t, phaseWaitingDependents, record.Phase)
+	assert.Contains(t, record.Message, "application mqtt-broker is still required by deployment-dashboard")
+
+	// removing the dependent as well still removes it first
+	env.remove("deployment-dashboard")
+	assert.False(t, env.dm.removalAllowed(context.Background(), env.record("deployment-broker")))
+	assert.True(t, env.dm.removalAllowed(context.Background(), env.record("deployment-dashboard")))
+
+	// a removal can be forced once
+	require.NoError(t, env.dm.ForceRemoval("deployment-broker"))
+	assert.True(t, env.dm.removalAllowed(context.Background(), env.record("deployment-broker")))
+	assert.False(t, env.dm.removalAllowed(context.Background(), env.record("deployment-broker")))
+	assert.ErrorIs(t, env.dm.ForceRemoval("deployment-unknown"), errUnknownDeployment)
+
+	// another deployment of the application keeps the dependents satisfied
+	env.deploy("deployment-broker-2", "mqtt-broker", "1.4.0", installed)
+	assert.True(t, env.dm.removalAllowed(context.Background(), env.record("deployment-broker")))
+}
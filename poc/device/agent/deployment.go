@@ -2,14 +2,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kr/pretty"
+	"github.com/margo/sandbox/poc/device/agent/breaker"
 	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/margo/sandbox/poc/device/agent/metrics"
+	"github.com/margo/sandbox/poc/device/agent/types"
 	"github.com/margo/sandbox/shared-lib/workloads"
 	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
 	"github.com/margo/sandbox/standard/pkg"
@@ -19,6 +27,19 @@ import (
 type DeploymentManagerIfc interface {
 	Start()
 	Stop()
+	ReconcileNow(deploymentId, triggerId string) (ReconcileTrigger, error)
+	ReconcileAllNow(triggerId string) []ReconcileTrigger
+	Operations() []ReconcileOperation
+	PlanReconciliation(deploymentId string) (*ReconcilePlan, error)
+	ForceRemoval(deploymentId string) error
+	Drain(ctx context.Context) []string
+}
+
+// ReconcileTrigger tells what a reconciliation requested out of schedule does
+type ReconcileTrigger struct {
+	DeploymentID string `json:"deploymentId"`
+	// Started is false when a reconciliation of the deployment is in progress already
+	Started bool `json:"started"`
 }
 
 type DeploymentManager struct {
@@ -27,31 +48,141 @@ type DeploymentManager struct {
 	composeClient *workloads.DockerComposeCliClient
 	log           *zap.SugaredLogger
 	stopChan      chan struct{}
+	stopOnce      sync.Once
+	// draining is set once the agent stops, no reconciliation starts anymore
+	draining atomic.Bool
 	//  Mutex to prevent concurrent reconciliation
-	reconcileLocks sync.Map // map[deploymentId]bool
+	reconcileLocks sync.Map // map[deploymentId]*reconcileRun
+	// operations records the last reconciliation of every deployment
+	operations reconcileOperations
+	// breakers stop deployments against a runtime that is down
+	breakers RuntimeBreakers
+	// trackImages records the images of every deployment for the image janitor
+	trackImages bool
+	// forcedRemovals are deployments whose next removal goes ahead although others depend on them or
+	// they are protected from removal
+	forcedRemovals sync.Map // map[deploymentId]bool
+	// removalProtection tunes the reports of blocked removals, nil keeps the defaults
+	removalProtection *types.RemovalProtectionConfig
+	// releaseTests runs the test hooks of a helm release before its deployment counts as running
+	releaseTests       bool
+	releaseTestTimeout time.Duration
+	// registryCredentials are the registry passwords the registryAuth of a component refers to
+	registryCredentials map[string]types.RegistryCredentialConfig
+	// metrics measures the deployments and removals on the runtimes
+	metrics metrics.Recorder
+}
+
+type DeploymentManagerOption func(dm *DeploymentManager)
+
+// WithDeploymentBreakers makes deployments against a runtime with an open circuit wait for the
+// runtime instead of failing, they are retried as soon as the circuit closes
+func WithDeploymentBreakers(breakers RuntimeBreakers) DeploymentManagerOption {
+	return func(dm *DeploymentManager) {
+		dm.breakers = breakers
+	}
+}
+
+// WithImageTracking records the images a deployment runs with after every deployment, the ones it
+// stops using are retired and removed by the image janitor later
+func WithImageTracking() DeploymentManagerOption {
+	return func(dm *DeploymentManager) {
+		dm.trackImages = true
+	}
+}
+
+// WithHelmReleaseTests runs the `helm test` hooks of a release after every install or upgrade, the
+// deployment only becomes RUNNING once they pass and FAILED with their output otherwise. A timeout
+// of 0 uses the default of the helm client.
+func WithHelmReleaseTests(timeout time.Duration) DeploymentManagerOption {
+	return func(dm *DeploymentManager) {
+		dm.releaseTests = true
+		dm.releaseTestTimeout = timeout
+	}
 }
 
-func NewDeploymentManager(db database.DatabaseIfc, helmClient *workloads.HelmClient, composeClient *workloads.DockerComposeCliClient, log *zap.SugaredLogger) *DeploymentManager {
-	return &DeploymentManager{
+// WithDeploymentMetrics records the duration of the reconciliations and the duration and the errors
+// of the deployments and removals on the helm and compose runtimes
+func WithDeploymentMetrics(recorder metrics.Recorder) DeploymentManagerOption {
+	return func(dm *DeploymentManager) {
+		if recorder != nil {
+			dm.metrics = recorder
+		}
+	}
+}
+
+func NewDeploymentManager(db database.DatabaseIfc, helmClient *workloads.HelmClient, composeClient *workloads.DockerComposeCliClient, log *zap.SugaredLogger, opts ...DeploymentManagerOption) *DeploymentManager {
+	dm := &DeploymentManager{
 		database:       db,
 		helmClient:     helmClient,
 		composeClient:  composeClient,
 		log:            log,
 		stopChan:       make(chan struct{}),
 		reconcileLocks: sync.Map{},
+		metrics:        metrics.Nop{},
+	}
+	for _, opt := range opts {
+		opt(dm)
 	}
+	return dm
 }
 
 func (dm *DeploymentManager) Start() {
 	// Subscribe to database changes
 	dm.database.Subscribe(dm.onDeploymentChange)
 
+	// Deployments that waited for a runtime are retried as soon as it is reachable again
+	for _, b := range dm.breakers.all() {
+		b.OnTransition(func(transition breaker.Transition) {
+			if transition.To == breaker.StateClosed {
+				dm.log.Infow("Runtime reachable again, retrying waiting deployments", "runtime", transition.Runtime)
+				dm.reconcileAll()
+			}
+		})
+	}
+
+	// Deployments the last shutdown interrupted are not left waiting for the first tick
+	dm.resumeInterrupted()
+
 	// Start reconciliation loop
 	go dm.reconcileLoop()
 }
 
 func (dm *DeploymentManager) Stop() {
-	close(dm.stopChan)
+	dm.stopOnce.Do(func() {
+		close(dm.stopChan)
+	})
+}
+
+func (dm *DeploymentManager) Name() string {
+	return health.ComponentDeployer
+}
+
+// Health is degraded while deployments are failed, the runtimes themselves are checked separately
+func (dm *DeploymentManager) Health() health.Report {
+	inFlight := 0
+	dm.reconcileLocks.Range(func(_, _ interface{}) bool {
+		inFlight++
+		return true
+	})
+	deployments := dm.database.ListDeployments()
+	failed := 0
+	for _, deployment := range deployments {
+		if strings.EqualFold(deployment.Phase, "failed") {
+			failed++
+		}
+	}
+
+	report := health.OK(map[string]float64{
+		"deployments":               float64(len(deployments)),
+		"failedDeployments":         float64(failed),
+		"reconciliationsInProgress": float64(inFlight),
+		"reconciliationsExpired":    float64(dm.operations.expiredCount()),
+	})
+	if failed > 0 {
+		report.Degrade(fmt.Sprintf("%d of %d deployments failed", failed, len(deployments)))
+	}
+	return report
 }
 
 func (dm *DeploymentManager) onDeploymentChange(deploymentId string, record *database.DeploymentRecord, changeType database.DeploymentRecordChangeType) {
@@ -70,6 +201,7 @@ func (dm *DeploymentManager) reconcileLoop() {
 	for {
 		select {
 		case <-ticker.C:
+			dm.expireStaleReconciliations(reconcileStaleAfter)
 			dm.reconcileAll()
 		case <-dm.stopChan:
 			return
@@ -86,13 +218,64 @@ func (dm *DeploymentManager) reconcileAll() {
 	}
 }
 
+// errUnknownDeployment is returned by triggers naming a deployment the agent does not know
+var errUnknownDeployment = errors.New("unknown deployment")
+
+// ReconcileNow starts reconciling the deployment right away instead of on the next tick
+func (dm *DeploymentManager) ReconcileNow(deploymentId, triggerId string) (ReconcileTrigger, error) {
+	if _, err := dm.database.GetDeployment(deploymentId); err != nil {
+		return ReconcileTrigger{}, fmt.Errorf("%w %s", errUnknownDeployment, deploymentId)
+	}
+	trigger := ReconcileTrigger{DeploymentID: deploymentId}
+	if _, inProgress := dm.reconcileLocks.Load(deploymentId); !inProgress {
+		trigger.Started = true
+		dm.log.Infow("Triggered reconciliation", "deploymentId", deploymentId, "triggerId", triggerId)
+		go dm.reconcileDeployment(deploymentId)
+	}
+	return trigger, nil
+}
+
+// ReconcileAllNow reconciles every deployment right away instead of on the next tick
+func (dm *DeploymentManager) ReconcileAllNow(triggerId string) []ReconcileTrigger {
+	deployments := dm.database.ListDeployments()
+	triggers := make([]ReconcileTrigger, 0, len(deployments))
+	for _, deployment := range deployments {
+		if trigger, err := dm.ReconcileNow(deployment.DeploymentID, triggerId); err == nil {
+			triggers = append(triggers, trigger)
+		}
+	}
+	sort.Slice(triggers, func(i, j int) bool { return triggers[i].DeploymentID < triggers[j].DeploymentID })
+	return triggers
+}
+
 func (dm *DeploymentManager) reconcileDeployment(deploymentId string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	//  Prevent concurrent reconciliation of the same deployment
-	if _, loaded := dm.reconcileLocks.LoadOrStore(deploymentId, true); loaded {
+	run := dm.operations.start(deploymentId, cancel)
+	// the phases the run writes are dropped once it was abandoned
+	ctx = withReconcileRun(ctx, run)
+	if _, loaded := dm.reconcileLocks.LoadOrStore(deploymentId, run); loaded {
 		dm.log.Debugw("Reconciliation already in progress, skipping", "deploymentId", deploymentId)
 		return
 	}
-	defer dm.reconcileLocks.Delete(deploymentId)
+	// checked after taking the lock, a drain either waits for this run or the run sees the drain
+	if dm.draining.Load() {
+		dm.reconcileLocks.CompareAndDelete(deploymentId, run)
+		dm.log.Debugw("Agent is stopping, not reconciling", "deploymentId", deploymentId)
+		return
+	}
+	// the release is deferred before anything else runs, a panic must not leave the deployment locked
+	dm.operations.begin(run)
+	// deferred before the release, it runs once the lock is released
+	var reconciled *database.AppDeploymentState
+	defer func() {
+		if reconciled != nil {
+			dm.followUpReconcile(deploymentId, reconciled)
+		}
+	}()
+	defer dm.finishReconcile(run)
 
 	record, err := dm.database.GetDeployment(deploymentId)
 	if err != nil {
@@ -103,9 +286,17 @@ func (dm *DeploymentManager) reconcileDeployment(deploymentId string) {
 	if record.DesiredState == nil {
 		return
 	}
+	reconciled = record.DesiredState
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
+	startedAt := time.Now()
+	defer func() {
+		dm.metrics.Reconciled(string(record.DesiredState.Status.Status.State), time.Since(startedAt))
+	}()
+
+	budget := reconcileBudget(record.DesiredState.AppDeploymentManifest)
+	run.budget.Store(int64(budget))
+	ctx, cancelBudget := context.WithTimeout(ctx, budget)
+	defer cancelBudget()
 
 	// Get the desired state from the manifest
 	desiredState := record.DesiredState.Status.Status.State
@@ -121,24 +312,29 @@ func (dm *DeploymentManager) reconcileDeployment(deploymentId string) {
 	dm.log.Debugw("Reconciling deployment",
 		"deploymentId", deploymentId,
 		"desiredState", desiredState,
-		"currentState", currentState)
+		"currentState", currentState,
+		"changeClass", record.ChangeClass)
 
 	// Only reconcile if states don't match
 	switch desiredState {
 	case sbi.DeploymentStatusManifestStatusStatePending:
 		// Only deploy if not already installed
-		if currentState != sbi.DeploymentStatusManifestStatusStateInstalled {
+		if !installedAsDesired(record) {
 			dm.log.Debugw("deploying pending deployment", "deploymentId", deploymentId)
-			dm.deployOrUpdate(ctx, deploymentId, *record.DesiredState)
+			if dm.dependenciesReady(ctx, record) {
+				dm.deployOrUpdate(ctx, deploymentId, *record.DesiredState)
+			}
 		} else {
 			dm.log.Debugw("deployment already installed, skipping", "deploymentId", deploymentId)
 		}
 
 	case sbi.DeploymentStatusManifestStatusStateInstalling:
 		// Only deploy if not already installed
-		if currentState != sbi.DeploymentStatusManifestStatusStateInstalled {
+		if !installedAsDesired(record) {
 			dm.log.Debugw("deploying or updating the deployment", "deploymentId", deploymentId)
-			dm.deployOrUpdate(ctx, deploymentId, *record.DesiredState)
+			if dm.dependenciesReady(ctx, record) {
+				dm.deployOrUpdate(ctx, deploymentId, *record.DesiredState)
+			}
 		} else {
 			dm.log.Debugw("deployment already installed, skipping", "deploymentId", deploymentId)
 		}
@@ -147,7 +343,9 @@ func (dm *DeploymentManager) reconcileDeployment(deploymentId string) {
 		// Only remove if not already removed
 		if currentState != sbi.DeploymentStatusManifestStatusStateRemoved {
 			dm.log.Debugw("removing the deployment", "deploymentId", deploymentId)
-			dm.remove(ctx, deploymentId)
+			if dm.removalUnprotected(ctx, record) && dm.removalAllowed(ctx, record) {
+				dm.remove(ctx, deploymentId)
+			}
 		} else {
 			dm.log.Debugw("deployment already removed, skipping", "deploymentId", deploymentId)
 		}
@@ -158,9 +356,11 @@ func (dm *DeploymentManager) reconcileDeployment(deploymentId string) {
 
 	case sbi.DeploymentStatusManifestStatusStateInstalled:
 		// Check if current state matches
-		if currentState != sbi.DeploymentStatusManifestStatusStateInstalled {
+		if !installedAsDesired(record) {
 			dm.log.Debugw("current state doesn't match desired, reconciling", "deploymentId", deploymentId)
-			dm.deployOrUpdate(ctx, deploymentId, *record.DesiredState)
+			if dm.dependenciesReady(ctx, record) {
+				dm.deployOrUpdate(ctx, deploymentId, *record.DesiredState)
+			}
 		} else {
 			dm.log.Debugw("deployment already installed and matches desired state", "deploymentId", deploymentId)
 		}
@@ -174,8 +374,48 @@ func (dm *DeploymentManager) reconcileDeployment(deploymentId string) {
 	}
 }
 
+// installedAsDesired tells whether the desired state is installed, a desired state with a new digest
+// is deployed although the previous one is installed
+func installedAsDesired(record *database.DeploymentRecord) bool {
+	return record.CurrentState != nil &&
+		record.CurrentState.Status.Status.State == sbi.DeploymentStatusManifestStatusStateInstalled &&
+		database.DesiredDigestDeployed(record)
+}
+
+// followUpReconcile reconciles the deployment again when a new desired state was stored while the
+// reconciled one was being deployed, the reconciliation triggered by the new state found the
+// deployment locked and was skipped
+func (dm *DeploymentManager) followUpReconcile(deploymentId string, reconciled *database.AppDeploymentState) {
+	latest, err := dm.database.GetDeployment(deploymentId)
+	if err != nil || latest.DesiredState == nil {
+		return
+	}
+	if latest.DesiredState.DigestValue() == reconciled.DigestValue() {
+		return
+	}
+	dm.log.Infow("Desired state changed during the reconciliation, reconciling again", "deploymentId", deploymentId)
+	go dm.reconcileDeployment(deploymentId)
+}
+
 func (dm *DeploymentManager) deployOrUpdate(ctx context.Context, deploymentId string, desiredState database.AppDeploymentState) {
-    dm.database.SetPhase(deploymentId, "DEPLOYING", "Starting deployment")
+    // One-shot components run once per digest, a restart or a resync must not run them again
+    if oneShotAlreadyCompleted(dm.database, deploymentId, desiredState.AppDeploymentManifest, desiredState.Digest) {
+        completedState := desiredState
+        completedState.Status.Status.State = sbi.DeploymentStatusManifestStatusStateInstalled
+        dm.database.SetCurrentState(deploymentId, completedState)
+        dm.setPhase(ctx, deploymentId, "COMPLETED", "One-shot component already completed for this digest")
+        dm.log.Infow("Skipping one-shot deployment that already completed", "deploymentId", deploymentId)
+        return
+    }
+
+    // Nothing is started against a runtime that is down, the deployment waits for it
+    profileType := desiredState.AppDeploymentManifest.Spec.DeploymentProfile.Type
+    if err := dm.breakers.allow(profileType); err != nil {
+        dm.waitForRuntime(ctx, deploymentId, "PENDING", err)
+        return
+    }
+
+    dm.setPhase(ctx, deploymentId, "DEPLOYING", "Starting deployment")
 
 	// Use the AppDeploymentManifest directly instead of converting															
     appDeployment := desiredState.AppDeploymentManifest
@@ -186,13 +426,12 @@ func (dm *DeploymentManager) deployOrUpdate(ctx context.Context, deploymentId st
         failedState := desiredState
         failedState.Status.Status.State = sbi.DeploymentStatusManifestStatusStateFailed
         dm.database.SetCurrentState(deploymentId, failedState)
-        dm.database.SetPhase(deploymentId, "FAILED", "No components found")
+        dm.setPhase(ctx, deploymentId, "FAILED", "No components found")
         return
     }
 
-												   
-    profileType := appDeployment.Spec.DeploymentProfile.Type
     var err error
+    startedAt := time.Now()
 
     switch profileType {
     case sbi.HelmV3:
@@ -200,7 +439,7 @@ func (dm *DeploymentManager) deployOrUpdate(ctx context.Context, deploymentId st
         if dm.helmClient == nil {
             err = fmt.Errorf("Helm client not initialized (device may not support Helm deployments)")
         } else {
-            err = dm.deployOrUpdateHelm(ctx, deploymentId, appDeployment)
+            err = dm.deployComponents(ctx, deploymentId, appDeployment, dm.deployOrUpdateHelm)
         }
         
     case sbi.Compose:
@@ -208,7 +447,7 @@ func (dm *DeploymentManager) deployOrUpdate(ctx context.Context, deploymentId st
         if dm.composeClient == nil {
             err = fmt.Errorf("Docker Compose client not initialized (device may not support Compose deployments)")
         } else {
-            err = dm.deployOrUpdateCompose(ctx, deploymentId, appDeployment)
+            err = dm.deployComponents(ctx, deploymentId, appDeployment, dm.deployOrUpdateCompose)
         }
         
     default:
@@ -216,7 +455,23 @@ func (dm *DeploymentManager) deployOrUpdate(ctx context.Context, deploymentId st
         failedState := desiredState
         failedState.Status.Status.State = sbi.DeploymentStatusManifestStatusStateFailed
         dm.database.SetCurrentState(deploymentId, failedState)
-        dm.database.SetPhase(deploymentId, "FAILED", fmt.Sprintf("Unsupported deployment type: %s", profileType))
+        dm.setPhase(ctx, deploymentId, "FAILED", fmt.Sprintf("Unsupported deployment type: %s", profileType))
+        return
+    }
+
+    dm.recordRuntimeOperation(profileType, metrics.OperationDeploy, startedAt, err)
+    dm.breakers.record(profileType, err)
+    // The failure that opened the circuit is transient like the ones it rejects from now on
+    if err != nil && breaker.IsRuntimeUnavailable(err) {
+        if openErr := dm.breakers.allow(profileType); openErr != nil {
+            dm.waitForRuntime(ctx, deploymentId, "PENDING", openErr)
+            return
+        }
+    }
+    // The docker daemon was not reachable even after retrying the compose calls, the deployment is
+    // retried by the next reconcile instead of failing for good
+    if err != nil && workloads.IsDaemonUnavailable(err) {
+        dm.waitForRuntime(ctx, deploymentId, "PENDING", err)
         return
     }
 
@@ -225,7 +480,7 @@ func (dm *DeploymentManager) deployOrUpdate(ctx context.Context, deploymentId st
         failedState := desiredState
         failedState.Status.Status.State = sbi.DeploymentStatusManifestStatusStateFailed
         dm.database.SetCurrentState(deploymentId, failedState)
-        dm.database.SetPhase(deploymentId, "FAILED", fmt.Sprintf("%s operation failed: %v", profileType, err))
+        dm.setPhase(ctx, deploymentId, "FAILED", deploymentFailureMessage(profileType, err))
         return
     }
 
@@ -233,20 +488,72 @@ func (dm *DeploymentManager) deployOrUpdate(ctx context.Context, deploymentId st
     currentState := desiredState
     currentState.Status.Status.State = sbi.DeploymentStatusManifestStatusStateInstalled
     dm.database.SetCurrentState(deploymentId, currentState)
-    dm.database.SetPhase(deploymentId, "RUNNING", "Deployment successful")
+    dm.setPhase(ctx, deploymentId, "RUNNING", "Deployment successful")
     dm.log.Infow("Deployment successful", "appId", deploymentId)
 }
 
+// deploymentFailureMessage is the message of a failed deployment, failures that tell which
+// services failed start with their error code, e.g. "IMAGE_PULL_FAILED: db pull_failed: ..."
+func deploymentFailureMessage(profileType sbi.AppDeploymentProfileType, err error) string {
+	var componentsErr *componentsDeployError
+	if errors.As(err, &componentsErr) {
+		return componentsErr.message(profileType)
+	}
+	var composeErr *workloads.ComposeDeployError
+	if errors.As(err, &composeErr) {
+		// the error of a failed compose deployment may carry the logs of its failed services
+		return err.Error()
+	}
+	return fmt.Sprintf("%s operation failed: %v", profileType, err)
+}
+
+// waitForRuntime leaves the deployment to be retried once the circuit of its runtime closes. The
+// current state is kept so the deployment still needs reconciliation, the phase carries the
+// RUNTIME_UNAVAILABLE code.
+func (dm *DeploymentManager) waitForRuntime(ctx context.Context, deploymentId, phase string, err error) {
+    message := err.Error()
+    if record, getErr := dm.database.GetDeployment(deploymentId); getErr == nil && record.Phase == phase && record.Message == message {
+        // already reported, the periodic reconcile must not repeat it
+        return
+    }
+    dm.log.Warnw("Runtime unavailable, deployment waits for it", "deploymentId", deploymentId, "phase", phase, "error", message)
+    dm.setPhase(ctx, deploymentId, phase, message)
+}
+
 
-func (dm *DeploymentManager) deployOrUpdateHelm(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest) error {
-	component := appDeployment.Spec.DeploymentProfile.Components[0]
+func (dm *DeploymentManager) deployOrUpdateHelm(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item, images *deploymentImages) error {
 	helmComp, err := component.AsHelmApplicationDeploymentProfileComponent()
 	if err != nil {
 		return fmt.Errorf("invalid helm component: %v", err)
 	}
 
+	// an invalid timeout fails the deployment instead of silently waiting the default
+	timeout, err := helmComponentTimeout(helmComp)
+	if err != nil {
+		return err
+	}
+
+	namespace, err := pkg.GetComponentNamespace(appDeployment, component)
+	if err != nil {
+		return err
+	}
+	// the namespace of a component is created when missing, the default one always exists
+	createNamespace := namespace != ""
+
+	// an atomic component rolls back a failed install or upgrade instead of leaving resources behind
+	atomic, err := pkg.IsComponentAtomic(component)
+	if err != nil {
+		return err
+	}
+
+	// the chart of a private OCI registry is pulled with credentials scoped to this install or upgrade
+	registryAuths, err := dm.helmRegistryAuths(component)
+	if err != nil {
+		return err
+	}
+
 	// Generate release name
-	releaseName := fmt.Sprintf("%s-%s", helmComp.Name, deploymentId[:8])
+	releaseName := helmReleaseName(helmComp.Name, deploymentId)
 
 	// Get values
 	componentValues, _ := pkg.ConvertAllAppDeploymentParamsToValues(*appDeployment.Spec.Parameters)
@@ -262,8 +569,11 @@ func (dm *DeploymentManager) deployOrUpdateHelm(ctx context.Context, deploymentI
 		"releaseName", releaseName,
 		"fullnameOverride", releaseName)
 
+	// the component waits for its resources to be ready on installs and upgrades alike
+	wait := helmComp.Properties.Wait != nil && *helmComp.Properties.Wait
+
 	// Deploy/Update
-	release, err := dm.helmClient.GetReleaseStatus(ctx, releaseName, "")
+	release, err := dm.helmClient.GetReleaseStatus(ctx, releaseName, namespace)
 	if err != nil {
 		dm.log.Infow("failed to check whether a release exists or not, assuming that it doesn't exist, will proceed with installation", "releaseName", releaseName, "deploymentId", deploymentId, "err", err.Error())
 
@@ -272,38 +582,170 @@ func (dm *DeploymentManager) deployOrUpdateHelm(ctx context.Context, deploymentI
 	if release != nil {
 		// Release exists, update it
 		dm.log.Infow("Updating existing Helm release", "releaseName", releaseName, "deploymentId", deploymentId)
-		err = dm.helmClient.UpdateChart(ctx, releaseName, helmComp.Properties.Repository, "", values)
+		err = dm.helmClient.UpdateChartWithAuth(ctx, releaseName, helmComp.Properties.Repository, namespace, wait, atomic, createNamespace, timeout, values, registryAuths)
 		if err != nil {
-			return fmt.Errorf("failed to upgrade existing release: %v", err)
+			if recovery := dm.recoverFailedHelmRelease(ctx, deploymentId, releaseName, namespace, atomic, timeout, err); recovery != "" {
+				return fmt.Errorf("failed to upgrade existing release: %w, %s", err, recovery)
+			}
+			return fmt.Errorf("failed to upgrade existing release: %w", err)
 		}
-		return nil
+		dm.collectHelmImages(ctx, releaseName, namespace, images)
+		return dm.runHelmReleaseTests(ctx, deploymentId, releaseName, namespace)
 	}
 
 	// New deployment
-	dm.log.Infow("Installing new Helm release", "releaseName", releaseName, "deploymentId", deploymentId)
+	dm.log.Infow("Installing new Helm release", "releaseName", releaseName, "namespace", namespace, "atomic", atomic, "deploymentId", deploymentId)
 	revision := "latest"
 	if helmComp.Properties.Revision != nil {
 		revision = *helmComp.Properties.Revision
 	}
-	wait := helmComp.Properties.Wait != nil && *helmComp.Properties.Wait
-	err = dm.helmClient.InstallChart(ctx, releaseName, helmComp.Properties.Repository, "", revision, wait, values)
+	err = dm.helmClient.InstallChartWithAuth(ctx, releaseName, helmComp.Properties.Repository, namespace, revision, wait, atomic, createNamespace, timeout, values, registryAuths)
 	if err != nil {
+		if recovery := dm.recoverFailedHelmRelease(ctx, deploymentId, releaseName, namespace, atomic, timeout, err); recovery != "" {
+			return fmt.Errorf("%w, %s", err, recovery)
+		}
+		return err
+	}
+	dm.collectHelmImages(ctx, releaseName, namespace, images)
+	if err := dm.runHelmReleaseTests(ctx, deploymentId, releaseName, namespace); err != nil {
 		return err
 	}
 	dm.log.Infow("Helm deployment successful", "appId", deploymentId, "releaseName", releaseName)
 	return nil
 }
 
-func (dm *DeploymentManager) deployOrUpdateCompose(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest) error {
-	component := appDeployment.Spec.DeploymentProfile.Components[0]
+// maxReleaseTestOutput is how much of the end of the test pod logs goes into the phase message
+const maxReleaseTestOutput = 2048
+
+// runHelmReleaseTests runs the test hooks of the release when release tests are enabled. Failing
+// tests fail the deployment, the end of the test pod logs is part of the error.
+func (dm *DeploymentManager) runHelmReleaseTests(ctx context.Context, deploymentId, releaseName, namespace string) error {
+	if !dm.releaseTests {
+		return nil
+	}
+
+	dm.setPhase(ctx, deploymentId, "DEPLOYING", fmt.Sprintf("Running the tests of release %s", releaseName))
+	var output bytes.Buffer
+	status, err := dm.helmClient.RunReleaseTests(ctx, releaseName, namespace, dm.releaseTestTimeout, workloads.WithReleaseTestLogs(&output))
+	if err != nil {
+		dm.log.Warnw("Helm release tests failed", "releaseName", releaseName, "deploymentId", deploymentId, "error", err, "output", output.String())
+		return releaseTestsError(err, output.String())
+	}
+	dm.log.Infow("Helm release tests passed", "releaseName", releaseName, "deploymentId", deploymentId, "tests", len(status.Tests))
+	return nil
+}
+
+// releaseTestsError adds the end of the test output to the error of failed release tests
+func releaseTestsError(err error, output string) error {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return fmt.Errorf("release tests failed: %w", err)
+	}
+	if len(output) > maxReleaseTestOutput {
+		output = "..." + strings.ToValidUTF8(output[len(output)-maxReleaseTestOutput:], "")
+	}
+	return fmt.Errorf("release tests failed: %w, test output:\n%s", err, output)
+}
+
+// recoverFailedHelmRelease leaves a release whose install or upgrade failed in a state the next
+// attempt can start from: it is rolled back to its last successful revision, or uninstalled when it
+// never deployed successfully. It returns what was done for the phase message, nothing when the
+// failure did not touch the release or helm already rolled back the atomic release.
+func (dm *DeploymentManager) recoverFailedHelmRelease(ctx context.Context, deploymentId, releaseName, namespace string, atomic bool, timeout time.Duration, deployErr error) string {
+	var helmErr *workloads.HelmError
+	if atomic || !errors.As(deployErr, &helmErr) || helmErr.Type != workloads.ErrorTypeRelease || breaker.IsRuntimeUnavailable(deployErr) {
+		return ""
+	}
+
+	revision, err := dm.helmClient.GetLastSuccessfulRevision(ctx, releaseName, namespace)
+	if err != nil {
+		dm.log.Warnw("Failed to read the history of the failed Helm release", "releaseName", releaseName, "deploymentId", deploymentId, "error", err)
+		return fmt.Sprintf("rollback not attempted, the release history is unavailable: %v", err)
+	}
+
+	if revision == 0 {
+		if _, err := dm.helmClient.GetReleaseStatus(ctx, releaseName, namespace); errors.As(err, &helmErr) && helmErr.Type == workloads.ErrorTypeNotFound {
+			// the install failed before the release was created
+			return ""
+		}
+		if err := dm.helmClient.UninstallChart(ctx, releaseName, namespace, timeout); err != nil {
+			dm.log.Warnw("Failed to uninstall the half-installed Helm release", "releaseName", releaseName, "deploymentId", deploymentId, "error", err)
+			return fmt.Sprintf("no previous revision to roll back to, uninstalling the release failed: %v", err)
+		}
+		dm.log.Infow("Uninstalled the half-installed Helm release", "releaseName", releaseName, "deploymentId", deploymentId)
+		return "no previous revision to roll back to, the release was uninstalled"
+	}
+
+	if err := dm.helmClient.RollbackRelease(ctx, releaseName, revision, namespace); err != nil {
+		dm.log.Warnw("Failed to roll back the Helm release", "releaseName", releaseName, "revision", revision, "deploymentId", deploymentId, "error", err)
+		return fmt.Sprintf("rollback to revision %d failed: %v", revision, err)
+	}
+	dm.log.Infow("Rolled back the Helm release", "releaseName", releaseName, "revision", revision, "deploymentId", deploymentId)
+	return fmt.Sprintf("rolled back to revision %d", revision)
+}
+
+// helmReleaseName generates the helm release name of a deployment's component
+func helmReleaseName(componentName, deploymentId string) string {
+	return fmt.Sprintf("%s-%s", componentName, deploymentId[:8])
+}
+
+// helmComponentTimeout returns the timeout of the Helm actions of a component, 0 for the defaults
+func helmComponentTimeout(helmComp sbi.HelmApplicationDeploymentProfileComponent) (time.Duration, error) {
+	if helmComp.Properties.Timeout == nil {
+		return 0, nil
+	}
+	return workloads.ParseHelmTimeout(*helmComp.Properties.Timeout, 0)
+}
+
+// composeWaitsForHealth tells whether the deployment of the compose component waits for its
+// services to be healthy, it does unless the component sets wait to false
+func composeWaitsForHealth(composeComp sbi.ComposeApplicationDeploymentProfileComponent) bool {
+	return composeComp.Properties.Wait == nil || *composeComp.Properties.Wait
+}
+
+// composeComponentTimeout is how long the services of the compose component may take to become
+// healthy, workloads.DefaultComposeHealthTimeout when the component sets no timeout
+func composeComponentTimeout(composeComp sbi.ComposeApplicationDeploymentProfileComponent) (time.Duration, error) {
+	if composeComp.Properties.Timeout == nil {
+		return workloads.DefaultComposeHealthTimeout, nil
+	}
+	return workloads.ParseHelmTimeout(*composeComp.Properties.Timeout, workloads.DefaultComposeHealthTimeout)
+}
+
+func (dm *DeploymentManager) collectHelmImages(ctx context.Context, releaseName, namespace string, images *deploymentImages) {
+	if !dm.trackImages {
+		return
+	}
+	images.add(dm.helmClient.ReleaseImages(ctx, releaseName, namespace))
+}
+
+// recordImages keeps the images a deployment runs with, when they cannot be determined the
+// previous ones are kept so nothing in use is ever retired
+func (dm *DeploymentManager) recordImages(deploymentId string, profileType sbi.AppDeploymentProfileType, images []string, err error) {
+	if err != nil {
+		dm.log.Warnw("Failed to determine the images of the deployment, unused images are not cleaned up", "deploymentId", deploymentId, "error", err)
+		return
+	}
+	dm.database.SetDeploymentImages(deploymentId, database.DeploymentImages{
+		Runtime:    string(profileType),
+		References: images,
+	})
+}
+
+// composeProjectName generates the docker compose project name of a deployment's component
+func composeProjectName(componentName, deploymentId string) string {
+	projectName := fmt.Sprintf("%s-%s", strings.ToLower(componentName), deploymentId[:8])
+	return strings.ReplaceAll(projectName, "_", "-")
+}
+
+func (dm *DeploymentManager) deployOrUpdateCompose(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item, images *deploymentImages) error {
 	composeComp, err := component.AsComposeApplicationDeploymentProfileComponent()
 	if err != nil {
 		return fmt.Errorf("invalid compose component %v", err)
 	}
 
 	// Generate project name (must be valid Docker Compose project name)
-	projectName := fmt.Sprintf("%s-%s", strings.ToLower(composeComp.Name), deploymentId[:8])
-	projectName = strings.ReplaceAll(projectName, "_", "-")
+	projectName := composeProjectName(composeComp.Name, deploymentId)
 
 	componentValues, _ := pkg.ConvertAllAppDeploymentParamsToValues(*appDeployment.Spec.Parameters)
 	values := componentValues[composeComp.Name]
@@ -328,30 +770,99 @@ func (dm *DeploymentManager) deployOrUpdateCompose(ctx context.Context, deployme
 	if exists {
 		// Update existing deployment
 		dm.log.Infow("Updating existing Docker Compose project", "projectName", projectName, "deploymentId", deploymentId, "composeFilename", composeFilename)
-		err = dm.composeClient.UpdateCompose(ctx, projectName, composeFilename, envVars)
 	} else {
 		// New deployment
 		dm.log.Infow("Deploying new Docker Compose project", "projectName", projectName, "deploymentId", deploymentId, "composeFilename", composeFilename)
-		err = dm.composeClient.DeployCompose(ctx, projectName, composeFilename, envVars)
 	}
-
+	registryAuths, err := dm.composeRegistryAuths(component)
+	if err != nil {
+		return err
+	}
+	forwardProgress, stopProgress := dm.composeProgressForwarder(ctx, deploymentId)
+	err = dm.composeClient.DeployComposeStream(ctx, projectName, composeFilename, envVars, forwardProgress,
+		workloads.WithRegistryAuth(registryAuths...))
+	stopProgress()
+	if err == nil && composeWaitsForHealth(composeComp) {
+		timeout, timeoutErr := composeComponentTimeout(composeComp)
+		if timeoutErr != nil {
+			return timeoutErr
+		}
+		err = dm.composeClient.WaitForHealthy(ctx, projectName, timeout)
+	}
+	var composeErr *workloads.ComposeDeployError
+	if errors.As(err, &composeErr) {
+		dm.log.Warnw("Docker Compose deployment failed", "deploymentId", deploymentId, "projectName", projectName,
+			"class", composeErr.Class, "retryable", composeErr.Retryable(), "output", composeErr.Output)
+		return dm.composeFailureLogs(ctx, deploymentId, projectName, composeErr)
+	}
 	if err != nil {
-		return fmt.Errorf("docker compose operation failed: %v", err)
+		return fmt.Errorf("docker compose operation failed: %w", err)
+	}
+
+	if dm.trackImages {
+		images.add(dm.composeClient.ComposeImages(ctx, composeFilename, projectName, envVars))
 	}
 
 	dm.log.Infow("Docker Compose deployment successful", "appId", deploymentId, "projectName", projectName)
 	return nil
 }
 
-func (dm *DeploymentManager) remove(ctx context.Context, deploymentId string) {
-	dm.database.SetPhase(deploymentId, "REMOVING", "Starting removal")
+// composeFailureLogs adds the last lines the containers of the failed services logged to the error
+// of a failed compose deployment. Services that failed to pull or to be created have no logs, logs
+// that cannot be read are only logged.
+func (dm *DeploymentManager) composeFailureLogs(ctx context.Context, deploymentId, projectName string, composeErr *workloads.ComposeDeployError) error {
+	var services []string
+	for _, service := range composeErr.FailedServices() {
+		if service.Outcome == workloads.ServiceStartFailed || service.Outcome == workloads.ServiceUnhealthy {
+			services = append(services, service.Service)
+		}
+	}
+	if len(services) == 0 {
+		return composeErr
+	}
 
+	// the deployment may have failed because its context ran out, the logs get a moment of their own
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	logs, err := dm.composeClient.GetComposeServiceLogs(ctx, projectName, workloads.LogOptions{Services: services, Tail: composeFailureLogLines})
+	if err != nil {
+		dm.log.Warnw("Failed to get the logs of the failed compose services", "deploymentId", deploymentId, "projectName", projectName, "error", err)
+		return composeErr
+	}
+
+	var sections []string
+	for _, service := range services {
+		if lines := logs[service]; len(lines) > 0 {
+			sections = append(sections, fmt.Sprintf("%s:\n%s", service, strings.Join(lines, "\n")))
+		}
+	}
+	output := strings.Join(sections, "\n")
+	if output == "" {
+		return composeErr
+	}
+	if len(output) > maxComposeFailureLogs {
+		output = "..." + strings.ToValidUTF8(output[len(output)-maxComposeFailureLogs:], "")
+	}
+	return fmt.Errorf("%w, recent logs:\n%s", composeErr, output)
+}
+
+func (dm *DeploymentManager) remove(ctx context.Context, deploymentId string) {
 	record, err := dm.database.GetDeployment(deploymentId)
 	if err != nil {
 		dm.log.Warnw("Deployment not found for removal", "deploymentId", deploymentId)
 		return
 	}
 
+	// Removing what is running needs the runtime, the removal waits for it like a deployment does
+	if record.CurrentState != nil {
+		if err := dm.breakers.allow(record.CurrentState.AppDeploymentManifest.Spec.DeploymentProfile.Type); err != nil {
+			dm.waitForRuntime(ctx, deploymentId, "REMOVING", err)
+			return
+		}
+	}
+
+	dm.setPhase(ctx, deploymentId, "REMOVING", "Starting removal")
+
 	if record.CurrentState == nil {
 		dm.log.Infow("No current state found, proceeding with complete removal", "deploymentId", deploymentId)
 
@@ -362,7 +873,7 @@ func (dm *DeploymentManager) remove(ctx context.Context, deploymentId string) {
 			dm.database.SetCurrentState(deploymentId, removedState)
 		}
 
-		dm.database.SetPhase(deploymentId, "REMOVED", "Removal Complete")
+		dm.setPhase(ctx, deploymentId, "REMOVED", "Removal Complete")
 		dm.database.RemoveDeployment(deploymentId)
 		return
 	}
@@ -383,7 +894,7 @@ func (dm *DeploymentManager) remove(ctx context.Context, deploymentId string) {
 		removedState.Status.Status.State = sbi.DeploymentStatusManifestStatusStateRemoved
 		dm.database.SetCurrentState(deploymentId, removedState)
 
-		dm.database.SetPhase(deploymentId, "REMOVED", "No components to remove")
+		dm.setPhase(ctx, deploymentId, "REMOVED", "No components to remove")
 		dm.database.RemoveDeployment(deploymentId)
 		return
 	}
@@ -392,14 +903,17 @@ func (dm *DeploymentManager) remove(ctx context.Context, deploymentId string) {
 	profileType := appDeployment.Spec.DeploymentProfile.Type
 
 	var removeErr error
+	startedAt := time.Now()
 	switch profileType {
 	case sbi.HelmV3:
-		removeErr = dm.removeHelm(ctx, deploymentId, appDeployment)
+		removeErr = dm.removeComponents(ctx, deploymentId, appDeployment, dm.removeHelm)
 	case sbi.Compose:
-		removeErr = dm.removeCompose(ctx, deploymentId, appDeployment)
+		removeErr = dm.removeComponents(ctx, deploymentId, appDeployment, dm.removeCompose)
 	default:
 		dm.log.Warnw("Unknown deployment type for removal", "type", profileType, "deploymentId", deploymentId)
 	}
+	dm.recordRuntimeOperation(profileType, metrics.OperationRemove, startedAt, removeErr)
+	dm.breakers.record(profileType, removeErr)
 
 	// Update current state to REMOVED (even if removal failed)
 	removedState := currentState
@@ -410,9 +924,9 @@ func (dm *DeploymentManager) remove(ctx context.Context, deploymentId string) {
 		dm.log.Errorw("Removal failed but marking as removed",
 			"deploymentId", deploymentId,
 			"error", removeErr)
-		dm.database.SetPhase(deploymentId, "REMOVED", fmt.Sprintf("Removal completed with errors: %v", removeErr))
+		dm.setPhase(ctx, deploymentId, "REMOVED", fmt.Sprintf("Removal completed with errors: %v", removeErr))
 	} else {
-		dm.database.SetPhase(deploymentId, "REMOVED", "Removal Complete")
+		dm.setPhase(ctx, deploymentId, "REMOVED", "Removal Complete")
 	}
 
 	// Remove from local database (triggers status report via subscriber)
@@ -421,19 +935,28 @@ func (dm *DeploymentManager) remove(ctx context.Context, deploymentId string) {
 	dm.log.Infow("Removal completed", "appId", deploymentId)
 }
 
-func (dm *DeploymentManager) removeHelm(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest) error {
+func (dm *DeploymentManager) removeHelm(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item) error {
     // Check if Helm client is available
     if dm.helmClient == nil {
         dm.log.Warnw("Helm client not initialized, skipping Helm removal", "deploymentId", deploymentId)
         return nil // Return nil to allow cleanup to continue
     }
 
-    component := appDeployment.Spec.DeploymentProfile.Components[0]
     if helmComp, err := component.AsHelmApplicationDeploymentProfileComponent(); err == nil {
-        releaseName := fmt.Sprintf("%s-%s", helmComp.Name, deploymentId[:8])
-        dm.log.Infow("Removing Helm release", "releaseName", releaseName, "deploymentId", deploymentId)
+        releaseName := helmReleaseName(helmComp.Name, deploymentId)
+        // the release was installed to this namespace, it cannot have been installed with an invalid one
+        namespace, err := pkg.GetComponentNamespace(appDeployment, component)
+        if err != nil {
+            return err
+        }
+        dm.log.Infow("Removing Helm release", "releaseName", releaseName, "namespace", namespace, "deploymentId", deploymentId)
 
-        if err := dm.helmClient.UninstallChart(ctx, releaseName, ""); err != nil {
+        // an invalid timeout must not keep the release around, it was reported when deploying
+        timeout, err := helmComponentTimeout(helmComp)
+        if err != nil {
+            dm.log.Warnw("Ignoring the timeout of the component", "releaseName", releaseName, "error", err)
+        }
+        if err := dm.helmClient.UninstallChart(ctx, releaseName, namespace, timeout); err != nil {
             dm.log.Warnw("Failed to uninstall Helm chart", "releaseName", releaseName, "error", err)
             return err
         }
@@ -442,17 +965,15 @@ func (dm *DeploymentManager) removeHelm(ctx context.Context, deploymentId string
     return nil
 }
 
-func (dm *DeploymentManager) removeCompose(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest) error {
+func (dm *DeploymentManager) removeCompose(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item) error {
     // Check if Compose client is available
     if dm.composeClient == nil {
         dm.log.Warnw("Docker Compose client not initialized, skipping Compose removal", "deploymentId", deploymentId)
         return nil // Return nil to allow cleanup to continue
     }
 
-    component := appDeployment.Spec.DeploymentProfile.Components[0]
     if composeComp, err := component.AsComposeApplicationDeploymentProfileComponent(); err == nil {
-        projectName := fmt.Sprintf("%s-%s", strings.ToLower(composeComp.Name), deploymentId[:8])
-        projectName = strings.ReplaceAll(projectName, "_", "-")
+        projectName := composeProjectName(composeComp.Name, deploymentId)
 
         dm.log.Infow("Removing Docker Compose project", "projectName", projectName, "deploymentId", deploymentId)
 
@@ -488,3 +1009,14 @@ func (dm *DeploymentManager) convertParametersToEnvVars(params map[string]interf
 
 	return envVars
 }
+
+// recordRuntimeOperation measures a deployment or removal that started at startedAt, operations of
+// unsupported profile types are not recorded
+func (dm *DeploymentManager) recordRuntimeOperation(profileType sbi.AppDeploymentProfileType, operation string, startedAt time.Time, err error) {
+	switch profileType {
+	case sbi.HelmV3:
+		dm.metrics.RuntimeOperation(metrics.RuntimeHelm, operation, time.Since(startedAt), err)
+	case sbi.Compose:
+		dm.metrics.RuntimeOperation(metrics.RuntimeCompose, operation, time.Since(startedAt), err)
+	}
+}
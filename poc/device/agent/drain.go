@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+const (
+	// phaseInterrupted marks a deployment whose reconciliation was still running when the agent
+	// stopped, it is reconciled again on the next start
+	phaseInterrupted = "INTERRUPTED"
+
+	// drainPollInterval is how often a drain checks whether the reconciliations finished
+	drainPollInterval = 100 * time.Millisecond
+	// statusFlushTimeout is how long a stopping agent waits for its last status reports
+	statusFlushTimeout = 10 * time.Second
+)
+
+// Drain stops the deployment manager like Stop and waits until the reconciliations in progress
+// finished or ctx is done. No reconciliation starts once the drain began. The reconciliations still
+// running when ctx is done are cancelled, the phases they write from then on are ignored, and their
+// deployments are marked INTERRUPTED and returned.
+func (dm *DeploymentManager) Drain(ctx context.Context) []string {
+	dm.draining.Store(true)
+	dm.Stop()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		inFlight := dm.reconcilesInFlight()
+		if len(inFlight) == 0 {
+			dm.log.Infow("Deployment manager drained")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			deploymentIds := make([]string, 0, len(inFlight))
+			for _, run := range inFlight {
+				dm.log.Warnw("Abandoning the reconciliation in progress", "deploymentId", run.deploymentId, "operationId", run.id)
+				run.abandon()
+				dm.database.SetPhase(run.deploymentId, phaseInterrupted, "The agent stopped before the reconciliation finished, it is reconciled again on the next start")
+				deploymentIds = append(deploymentIds, run.deploymentId)
+			}
+			return deploymentIds
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcilesInFlight returns the runs holding a reconciliation lock, sorted by deployment
+func (dm *DeploymentManager) reconcilesInFlight() []*reconcileRun {
+	var runs []*reconcileRun
+	dm.reconcileLocks.Range(func(_, value interface{}) bool {
+		runs = append(runs, value.(*reconcileRun))
+		return true
+	})
+	sort.Slice(runs, func(i, j int) bool { return runs[i].deploymentId < runs[j].deploymentId })
+	return runs
+}
+
+// resumeInterrupted reconciles the deployments the last shutdown interrupted. Those whose
+// reconciliation got to record its outcome before the agent stopped get their phase back.
+func (dm *DeploymentManager) resumeInterrupted() {
+	for _, deployment := range dm.database.ListDeploymentsByPhase(phaseInterrupted) {
+		deploymentId := deployment.DeploymentID
+
+		if !dm.database.NeedsReconciliation(deploymentId) && deployment.CurrentState != nil {
+			switch deployment.CurrentState.Status.Status.State {
+			case sbi.DeploymentStatusManifestStatusStateInstalled:
+				dm.database.SetPhase(deploymentId, "RUNNING", "Deployment successful")
+				continue
+			case sbi.DeploymentStatusManifestStatusStateRemoved:
+				dm.database.SetPhase(deploymentId, "REMOVED", "Removal Complete")
+				continue
+			}
+		}
+
+		dm.log.Infow("Resuming the reconciliation interrupted by the last shutdown", "deploymentId", deploymentId)
+		dm.database.SetPhase(deploymentId, "PENDING", "Resuming the reconciliation interrupted by the last shutdown")
+		go dm.reconcileDeployment(deploymentId)
+	}
+}
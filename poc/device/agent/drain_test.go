@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// blockReconcile starts a reconciliation of deployment-a that hangs until release is closed
+func blockReconcile(t *testing.T, dm *DeploymentManager, db *faultyDatabase) (release chan struct{}, done chan struct{}) {
+	t.Helper()
+	db.blocked, db.release = make(chan struct{}), make(chan struct{})
+	blocked := db.blocked
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		dm.reconcileDeployment("deployment-a")
+	}()
+	<-blocked
+	return db.release, done
+}
+
+func TestDrain_WaitsForReconciliations(t *testing.T) {
+	dm, db := newReconcileTestManager(t)
+	release, done := blockReconcile(t, dm, db)
+
+	time.AfterFunc(200*time.Millisecond, func() { close(release) })
+	abandoned := dm.Drain(context.Background())
+	assert.Empty(t, abandoned)
+	<-done
+	_, locked := dm.reconcileLocks.Load("deployment-a")
+	assert.False(t, locked)
+
+	// nothing is reconciled once drained
+	calls := db.calls.Load()
+	dm.reconcileDeployment("deployment-a")
+	assert.Equal(t, calls, db.calls.Load())
+	assert.NotPanics(t, dm.Stop, "stopping a drained manager again is fine")
+}
+
+func TestDrain_MarksAbandonedDeploymentsInterrupted(t *testing.T) {
+	dm, db := newReconcileTestManager(t)
+	release, done := blockReconcile(t, dm, db)
+	value, locked := dm.reconcileLocks.Load("deployment-a")
+	require.True(t, locked)
+	run := value.(*reconcileRun)
+	cancelled := make(chan struct{})
+	cancelRun, once := run.cancel, sync.Once{}
+	run.cancel = func() {
+		once.Do(func() { close(cancelled) })
+		cancelRun()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	abandoned := dm.Drain(ctx)
+	assert.Equal(t, []string{"deployment-a"}, abandoned)
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("the abandoned reconciliation was not cancelled")
+	}
+
+	// the abandoned run goes on, the phases it writes do not replace INTERRUPTED
+	close(release)
+	<-done
+	record, err := db.Database.GetDeployment("deployment-a")
+	require.NoError(t, err)
+	assert.Equal(t, phaseInterrupted, record.Phase)
+}
+
+func TestResumeInterrupted(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	installed := database.AppDeploymentState{}
+	installed.Status.Status.State = sbi.DeploymentStatusManifestStatusStateInstalled
+	require.NoError(t, db.SetDesiredState("deployment-done", installed))
+	db.SetCurrentState("deployment-done", installed)
+	db.SetPhase("deployment-done", phaseInterrupted, "interrupted")
+
+	removing := database.AppDeploymentState{}
+	removing.Status.Status.State = sbi.DeploymentStatusManifestStatusStateRemoving
+	require.NoError(t, db.SetDesiredState("deployment-halfway", removing))
+	db.SetCurrentState("deployment-halfway", installed)
+	db.SetPhase("deployment-halfway", phaseInterrupted, "interrupted")
+
+	dm := NewDeploymentManager(db, nil, nil, zap.NewNop().Sugar())
+	// a draining manager does not reconcile, the resumed deployment keeps its new phase
+	dm.draining.Store(true)
+	dm.resumeInterrupted()
+
+	record, err := db.GetDeployment("deployment-done")
+	require.NoError(t, err)
+	assert.Equal(t, "RUNNING", record.Phase, "the interrupted run had recorded its outcome")
+	record, err = db.GetDeployment("deployment-halfway")
+	require.NoError(t, err)
+	assert.Equal(t, "PENDING", record.Phase)
+	assert.Contains(t, record.Message, "interrupted by the last shutdown")
+}
+
+func TestStatusReporter_ReportsInterrupted(t *testing.T) {
+	t.Chdir(t.TempDir())
+	reports := make(chan sbi.DeploymentStatusManifest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report sbi.DeploymentStatusManifest
+		json.NewDecoder(r.Body).Decode(&report)
+		reports <- report
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := wfm.NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+	sr := NewStatusReporter(newTestDatabase(t, "data"), client, "device-1", zap.NewNop().Sugar())
+
+	// a first install stopped halfway has no current state yet
+	const deploymentId = "5f0c3a2e-6c1d-4f1e-9a55-000000000009"
+	record := &database.DeploymentRecord{
+		DeploymentID: deploymentId,
+		Phase:        phaseInterrupted,
+		Message:      "The agent stopped before the reconciliation finished",
+		DesiredState: &database.AppDeploymentState{},
+	}
+	require.NoError(t, sr.reportStatus(deploymentId, record))
+
+	report := <-reports
+	assert.Equal(t, sbi.DeploymentStatusManifestStatusStateInstalling, report.Status.State)
+	require.NotNil(t, report.Status.Error)
+	assert.Equal(t, phaseInterrupted, *report.Status.Error.Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, sr.Flush(ctx))
+	sr.backlog.Add(1)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorContains(t, sr.Flush(ctx), "1 status reports not sent")
+}
@@ -0,0 +1,41 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handler serves the health endpoints:
+//
+//	/healthz            liveness, answers as long as the process serves requests
+//	/readyz             readiness, 503 while a critical component is not ok
+//	/health/components  the detailed report of every component
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, req *http.Request) {
+		summary := r.Check()
+		code := http.StatusOK
+		if !summary.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, struct {
+			Ready    bool     `json:"ready"`
+			Status   Status   `json:"status"`
+			NotReady []string `json:"notReady,omitempty"`
+		}{summary.Ready, summary.Status, summary.NotReady()})
+	})
+	mux.HandleFunc("GET /health/components", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, r.Check())
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
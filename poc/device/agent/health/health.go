@@ -0,0 +1,63 @@
+// Package health aggregates what the agent components report about their own health into
+// liveness, readiness and a detailed per component view.
+package health
+
+// Status of a single component or of the agent as a whole, ordered from best to worst
+type Status string
+
+const (
+	StatusOK        Status = "ok"
+	StatusDegraded  Status = "degraded"
+	StatusUnhealthy Status = "unhealthy"
+)
+
+func (s Status) rank() int {
+	switch s {
+	case StatusOK:
+		return 0
+	case StatusDegraded:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// worse returns the worse of the two statuses
+func worse(a, b Status) Status {
+	if b.rank() > a.rank() {
+		return b
+	}
+	return a
+}
+
+// Report is what a component says about itself. Reasons explain a status other than ok, metrics
+// carry the few numbers an operator needs to judge the component, e.g. a backlog size.
+type Report struct {
+	Status  Status             `json:"status"`
+	Reasons []string           `json:"reasons,omitempty"`
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+}
+
+// OK is a healthy report with the given metrics
+func OK(metrics map[string]float64) Report {
+	return Report{Status: StatusOK, Metrics: metrics}
+}
+
+// Degrade lowers the report to at least degraded and adds the reason
+func (r *Report) Degrade(reason string) {
+	r.Status = worse(r.Status, StatusDegraded)
+	r.Reasons = append(r.Reasons, reason)
+}
+
+// Fail marks the report unhealthy and adds the reason
+func (r *Report) Fail(reason string) {
+	r.Status = StatusUnhealthy
+	r.Reasons = append(r.Reasons, reason)
+}
+
+// ComponentHealth is implemented by every agent component that can judge how well it works.
+// Health is called from the health endpoints and must return quickly.
+type ComponentHealth interface {
+	Name() string
+	Health() Report
+}
@@ -0,0 +1,230 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeComponent reports whatever the test sets
+type fakeComponent struct {
+	name   string
+	mu     sync.Mutex
+	report Report
+}
+
+func newFake(name string) *fakeComponent {
+	return &fakeComponent{name: name, report: OK(nil)}
+}
+
+func (f *fakeComponent) Name() string {
+	return f.name
+}
+
+func (f *fakeComponent) Health() Report {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.report
+}
+
+func (f *fakeComponent) set(status Status, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.report = Report{Status: status}
+	if reason != "" {
+		f.report.Reasons = []string{reason}
+	}
+}
+
+type panickingComponent struct{}
+
+func (panickingComponent) Name() string   { return "panicking" }
+func (panickingComponent) Health() Report { panic("boom") }
+
+func TestRegistry_AggregateTransitions(t *testing.T) {
+	syncer := newFake(ComponentSyncer)
+	database := newFake(ComponentDatabase)
+	helm := newFake(ComponentRuntimeHelm)
+	deployer := newFake(ComponentDeployer)
+	reporter := newFake(ComponentReporter)
+	registry := NewRegistry(nil)
+	registry.Register(syncer, database, helm, deployer, reporter)
+
+	steps := []struct {
+		name        string
+		apply       func()
+		wantStatus  Status
+		wantReady   bool
+		wantBlocked []string
+	}{
+		{
+			name:       "all ok",
+			apply:      func() {},
+			wantStatus: StatusOK,
+			wantReady:  true,
+		},
+		{
+			name:       "informational component degraded",
+			apply:      func() { reporter.set(StatusDegraded, "backlog of 200 reports") },
+			wantStatus: StatusDegraded,
+			wantReady:  true,
+		},
+		{
+			name:       "informational component unhealthy only degrades",
+			apply:      func() { deployer.set(StatusUnhealthy, "stuck") },
+			wantStatus: StatusDegraded,
+			wantReady:  true,
+		},
+		{
+			name:        "critical component degraded",
+			apply:       func() { syncer.set(StatusDegraded, "5 consecutive syncs failed") },
+			wantStatus:  StatusDegraded,
+			wantReady:   false,
+			wantBlocked: []string{ComponentSyncer},
+		},
+		{
+			name:        "critical component unhealthy",
+			apply:       func() { helm.set(StatusUnhealthy, "unreachable") },
+			wantStatus:  StatusUnhealthy,
+			wantReady:   false,
+			wantBlocked: []string{ComponentRuntimeHelm, ComponentSyncer},
+		},
+		{
+			name: "recovered",
+			apply: func() {
+				for _, component := range []*fakeComponent{syncer, database, helm, deployer, reporter} {
+					component.set(StatusOK, "")
+				}
+			},
+			wantStatus: StatusOK,
+			wantReady:  true,
+		},
+	}
+
+	for _, step := range steps {
+		step.apply()
+		summary := registry.Check()
+		assert.Equal(t, step.wantStatus, summary.Status, step.name)
+		assert.Equal(t, step.wantReady, summary.Ready, step.name)
+		assert.Equal(t, step.wantBlocked, summary.NotReady(), step.name)
+	}
+}
+
+func TestRegistry_PolicyDecidesCriticality(t *testing.T) {
+	deployer := newFake(ComponentDeployer)
+	deployer.set(StatusDegraded, "1 of 2 deployments failed")
+
+	summary := newTestRegistry(nil, deployer).Check()
+	assert.True(t, summary.Ready)
+
+	policy := DefaultPolicy()
+	policy[ComponentDeployer] = Critical
+	summary = newTestRegistry(policy, deployer).Check()
+	assert.False(t, summary.Ready)
+	assert.Equal(t, Critical, summary.Components[0].Criticality)
+
+	assert.Equal(t, Informational, DefaultPolicy().Criticality("unknown"))
+}
+
+func newTestRegistry(policy Policy, components ...ComponentHealth) *Registry {
+	registry := NewRegistry(policy)
+	registry.Register(components...)
+	return registry
+}
+
+func TestRegistry_PanickingComponentIsUnhealthy(t *testing.T) {
+	summary := newTestRegistry(Policy{"panicking": Critical}, panickingComponent{}).Check()
+
+	require.Len(t, summary.Components, 1)
+	assert.Equal(t, StatusUnhealthy, summary.Components[0].Status)
+	assert.Contains(t, summary.Components[0].Reasons[0], "boom")
+	assert.False(t, summary.Ready)
+}
+
+func TestHandler_Endpoints(t *testing.T) {
+	syncer := newFake(ComponentSyncer)
+	reporter := newFake(ComponentReporter)
+	reporter.report = OK(map[string]float64{"backlog": 3})
+	registry := newTestRegistry(nil, syncer, reporter)
+	server := httptest.NewServer(registry.Handler())
+	defer server.Close()
+
+	get := func(path string, body interface{}) int {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(body))
+		return resp.StatusCode
+	}
+
+	var readiness map[string]interface{}
+	assert.Equal(t, http.StatusOK, get("/readyz", &readiness))
+	assert.Equal(t, true, readiness["ready"])
+
+	syncer.set(StatusDegraded, "3 consecutive syncs failed")
+
+	var liveness map[string]string
+	assert.Equal(t, http.StatusOK, get("/healthz", &liveness), "liveness does not depend on the components")
+	assert.Equal(t, "alive", liveness["status"])
+
+	readiness = nil
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz", &readiness))
+	assert.Equal(t, false, readiness["ready"])
+	assert.Equal(t, "degraded", readiness["status"])
+	assert.Equal(t, []interface{}{ComponentSyncer}, readiness["notReady"])
+
+	var summary Summary
+	assert.Equal(t, http.StatusOK, get("/health/components", &summary))
+	require.Len(t, summary.Components, 2)
+	assert.Equal(t, ComponentStatus{
+		Name:        ComponentReporter,
+		Criticality: Informational,
+		Report:      Report{Status: StatusOK, Metrics: map[string]float64{"backlog": 3}},
+	}, summary.Components[0])
+	assert.Equal(t, ComponentSyncer, summary.Components[1].Name)
+	assert.Equal(t, []string{"3 consecutive syncs failed"}, summary.Components[1].Reasons)
+	assert.Equal(t, map[string]Status{ComponentReporter: StatusOK, ComponentSyncer: StatusDegraded}, summary.Vector())
+
+	resp, err := http.Post(server.URL+"/readyz", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestProbe_CachesOutcome(t *testing.T) {
+	calls := 0
+	var probeErr error
+	probe := NewProbe(ComponentRuntimeCompose, time.Minute, func(ctx context.Context) error {
+		calls++
+		_, hasDeadline := ctx.Deadline()
+		assert.True(t, hasDeadline)
+		return probeErr
+	})
+	now := time.Now()
+	probe.now = func() time.Time { return now }
+
+	assert.Equal(t, StatusOK, probe.Health().Status)
+	probeErr = errors.New("connection refused")
+	assert.Equal(t, StatusOK, probe.Health().Status, "the outcome is cached for the interval")
+	assert.Equal(t, 1, calls)
+
+	now = now.Add(time.Minute)
+	report := probe.Health()
+	assert.Equal(t, StatusUnhealthy, report.Status)
+	assert.Equal(t, []string{"unreachable: connection refused"}, report.Reasons)
+	assert.Equal(t, float64(1), report.Metrics["consecutiveFailures"])
+	assert.Equal(t, 2, calls)
+
+	probeErr = nil
+	now = now.Add(time.Minute)
+	assert.Equal(t, StatusOK, probe.Health().Status)
+}
@@ -0,0 +1,56 @@
+package health
+
+// Criticality decides whether a component takes part in readiness
+type Criticality string
+
+const (
+	// Critical components must be ok for the agent to be ready
+	Critical Criticality = "critical"
+	// Informational components are shown in the detailed view and the overall status only
+	Informational Criticality = "informational"
+)
+
+// Component names used by the agent
+const (
+	ComponentOnboarding     = "onboarding"
+	ComponentSyncer         = "syncer"
+	ComponentDeployer       = "deployer"
+	ComponentMonitor        = "monitor"
+	ComponentReporter       = "reporter"
+	ComponentDatabase       = "database"
+	ComponentCache          = "cache"
+	ComponentImageGC        = "imagegc"
+	ComponentAPIVersion     = "apiversion"
+	ComponentRuntimeHelm    = "runtime.helm"
+	ComponentRuntimeCompose = "runtime.compose"
+)
+
+// Policy maps component names to their criticality, components that are not listed are informational
+type Policy map[string]Criticality
+
+// DefaultPolicy makes the agent ready only when it is onboarded, speaks the API of the WFM, learnt
+// the desired state recently, can keep it and reach the runtimes that apply it. Problems with individual deployments or with reporting back to the WFM
+// are visible but do not take the agent out of readiness.
+func DefaultPolicy() Policy {
+	return Policy{
+		ComponentOnboarding:     Critical,
+		ComponentSyncer:         Critical,
+		ComponentDatabase:       Critical,
+		ComponentRuntimeHelm:    Critical,
+		ComponentRuntimeCompose: Critical,
+		ComponentAPIVersion:     Critical,
+		ComponentDeployer:       Informational,
+		ComponentMonitor:        Informational,
+		ComponentReporter:       Informational,
+		ComponentCache:          Informational,
+		ComponentImageGC:        Informational,
+	}
+}
+
+// Criticality returns the criticality of the named component
+func (p Policy) Criticality(name string) Criticality {
+	if criticality, found := p[name]; found {
+		return criticality
+	}
+	return Informational
+}
@@ -0,0 +1,71 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeInterval = 30 * time.Second
+	defaultProbeTimeout  = 5 * time.Second
+)
+
+// Probe is a component whose health is the outcome of an active check, e.g. whether a container
+// runtime answers. The outcome is cached for the interval so the endpoints stay cheap to call.
+type Probe struct {
+	name     string
+	check    func(ctx context.Context) error
+	interval time.Duration
+	timeout  time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	lastErr   error
+	failures  int
+}
+
+// NewProbe creates a probe that runs check at most once per interval, 0 uses a 30s interval
+func NewProbe(name string, interval time.Duration, check func(ctx context.Context) error) *Probe {
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	return &Probe{
+		name:     name,
+		check:    check,
+		interval: interval,
+		timeout:  defaultProbeTimeout,
+		now:      time.Now,
+	}
+}
+
+func (p *Probe) Name() string {
+	return p.name
+}
+
+func (p *Probe) Health() Report {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.checkedAt.IsZero() || p.now().Sub(p.checkedAt) >= p.interval {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		p.lastErr = p.check(ctx)
+		cancel()
+		p.checkedAt = p.now()
+		if p.lastErr != nil {
+			p.failures++
+		} else {
+			p.failures = 0
+		}
+	}
+
+	report := OK(map[string]float64{
+		"consecutiveFailures": float64(p.failures),
+		"secondsSinceCheck":   p.now().Sub(p.checkedAt).Seconds(),
+	})
+	if p.lastErr != nil {
+		report.Fail("unreachable: " + p.lastErr.Error())
+	}
+	return report
+}
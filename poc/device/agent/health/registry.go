@@ -0,0 +1,124 @@
+package health
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ComponentStatus is the report of one component together with its criticality
+type ComponentStatus struct {
+	Name        string      `json:"name"`
+	Criticality Criticality `json:"criticality"`
+	Report
+}
+
+// Summary is the aggregated health of the agent
+type Summary struct {
+	// Status is the worst status of all components, an unhealthy informational component only
+	// degrades the agent
+	Status Status `json:"status"`
+	// Ready is true when every critical component is ok
+	Ready      bool              `json:"ready"`
+	CheckedAt  time.Time         `json:"checkedAt"`
+	Components []ComponentStatus `json:"components"`
+}
+
+// NotReady returns the names of the critical components that keep the agent from being ready
+func (s Summary) NotReady() []string {
+	var names []string
+	for _, component := range s.Components {
+		if component.Criticality == Critical && component.Status != StatusOK {
+			names = append(names, component.Name)
+		}
+	}
+	return names
+}
+
+// Vector returns the status of every component keyed by name, compact enough to be attached to
+// reports sent to the WFM
+func (s Summary) Vector() map[string]Status {
+	vector := make(map[string]Status, len(s.Components))
+	for _, component := range s.Components {
+		vector[component.Name] = component.Status
+	}
+	return vector
+}
+
+// Registry collects the components and aggregates their health according to the policy
+type Registry struct {
+	policy     Policy
+	mu         sync.RWMutex
+	components map[string]ComponentHealth
+}
+
+// NewRegistry creates an empty registry, a nil policy uses the default policy
+func NewRegistry(policy Policy) *Registry {
+	if policy == nil {
+		policy = DefaultPolicy()
+	}
+	return &Registry{
+		policy:     policy,
+		components: map[string]ComponentHealth{},
+	}
+}
+
+// Register adds components, a component replaces an earlier one with the same name
+func (r *Registry) Register(components ...ComponentHealth) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, component := range components {
+		r.components[component.Name()] = component
+	}
+}
+
+// Check asks every component for its health and aggregates the reports
+func (r *Registry) Check() Summary {
+	r.mu.RLock()
+	components := make([]ComponentHealth, 0, len(r.components))
+	for _, component := range r.components {
+		components = append(components, component)
+	}
+	r.mu.RUnlock()
+	sort.Slice(components, func(i, j int) bool { return components[i].Name() < components[j].Name() })
+
+	summary := Summary{
+		Status:     StatusOK,
+		Ready:      true,
+		CheckedAt:  time.Now().UTC(),
+		Components: make([]ComponentStatus, 0, len(components)),
+	}
+	for _, component := range components {
+		status := ComponentStatus{
+			Name:        component.Name(),
+			Criticality: r.policy.Criticality(component.Name()),
+			Report:      checkComponent(component),
+		}
+		summary.Components = append(summary.Components, status)
+
+		if status.Criticality == Critical {
+			summary.Status = worse(summary.Status, status.Status)
+			if status.Status != StatusOK {
+				summary.Ready = false
+			}
+		} else if status.Status != StatusOK {
+			summary.Status = worse(summary.Status, StatusDegraded)
+		}
+	}
+	return summary
+}
+
+// checkComponent keeps a panicking component from taking down the health endpoints
+func checkComponent(component ComponentHealth) (report Report) {
+	defer func() {
+		if r := recover(); r != nil {
+			report = Report{Status: StatusUnhealthy, Reasons: []string{fmt.Sprintf("health check panicked: %v", r)}}
+		}
+	}()
+	report = component.Health()
+	if report.Status == "" {
+		report.Status = StatusOK
+	}
+	return report
+}
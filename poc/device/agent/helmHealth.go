@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// Error codes of the statuses of helm components whose workloads are not ready
+const (
+	releaseErrorStarting = "RELEASE_STARTING"
+	releaseErrorNotReady = "RELEASE_NOT_READY"
+)
+
+// helmReadinessStatus maps the workloads of a deployed release to the status of its component. A
+// release whose workloads are not ready is installing until timeout has passed since it was
+// deployed and failed afterwards, crash loops and image pull errors included as they may resolve
+// once a dependency is up. The returned problem says why the deployment is degraded, none while
+// the component is not failed.
+func helmReadinessStatus(componentName string, workloadStatus *workloads.WorkloadStatus, deployedAt time.Time, timeout time.Duration, now time.Time) (sbi.ComponentStatus, string) {
+	status := sbi.ComponentStatus{Name: componentName}
+	if workloadStatus.Ready() {
+		status.State = sbi.ComponentStatusStateInstalled
+		return status, ""
+	}
+
+	if now.Sub(deployedAt) < timeout {
+		status.State = sbi.ComponentStatusStateInstalling
+		setServiceError(&status, releaseErrorStarting, "is starting, "+workloadStatus.String())
+		return status, ""
+	}
+
+	message := fmt.Sprintf("is not ready %s after it was deployed, %s", timeout, workloadStatus.String())
+	status.State = sbi.ComponentStatusStateFailed
+	setServiceError(&status, releaseErrorNotReady, message)
+	return status, fmt.Sprintf("component %s %s", componentName, message)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestHelmReadinessStatus(t *testing.T) {
+	now := time.Now()
+	crashLooping := &workloads.WorkloadStatus{
+		Workloads:     []workloads.WorkloadReadiness{{Kind: "deployment", Name: "web", Replicas: 1}},
+		TotalPods:     1,
+		CrashLooping:  1,
+		FailureReason: "pod web-a container web: CrashLoopBackOff",
+	}
+
+	status, problem := helmReadinessStatus("web", &workloads.WorkloadStatus{ReadyPods: 1, TotalPods: 1}, now.Add(-time.Hour), 10*time.Minute, now)
+	assert.Equal(t, sbi.ComponentStatusStateInstalled, status.State)
+	assert.Nil(t, status.Error)
+	assert.Empty(t, problem)
+
+	status, problem = helmReadinessStatus("web", crashLooping, now.Add(-time.Minute), 10*time.Minute, now)
+	assert.Equal(t, sbi.ComponentStatusStateInstalling, status.State, "the workloads may still converge")
+	assert.Equal(t, releaseErrorStarting, *status.Error.Code)
+	assert.Empty(t, problem)
+
+	status, problem = helmReadinessStatus("web", crashLooping, now.Add(-11*time.Minute), 10*time.Minute, now)
+	assert.Equal(t, sbi.ComponentStatusStateFailed, status.State)
+	assert.Equal(t, releaseErrorNotReady, *status.Error.Code)
+	assert.Equal(t, "component web is not ready 10m0s after it was deployed, 0/1 pods ready, 1 crash looping, "+
+		"deployment web has 0/1 ready replicas: pod web-a container web: CrashLoopBackOff", problem)
+}
+
+func TestDeploymentMonitor_UnreadyReleaseDegradesTheDeployment(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := newTestDatabase(t, "data")
+	hm := NewDeploymentMonitor(db, nil, nil, zap.NewNop().Sugar())
+
+	const deploymentId = "5f0c3a2e-6c1d-4f1e-9a55-000000000008"
+	require.NoError(t, db.SetDesiredState(deploymentId, database.AppDeploymentState{LastUpdated: time.Now()}))
+	db.SetPhase(deploymentId, "RUNNING", "Deployment successful")
+	record := func() *database.DeploymentRecord {
+		record, err := db.GetDeployment(deploymentId)
+		require.NoError(t, err)
+		return record
+	}
+
+	now := time.Now()
+	unready := &workloads.WorkloadStatus{TotalPods: 1, ImagePullErrors: 1, FailureReason: "pod web-a container web: ImagePullBackOff"}
+	status, problem := helmReadinessStatus("web", unready, now.Add(-time.Hour), 10*time.Minute, now)
+	db.SetComponentStatus(deploymentId, "web", status)
+	hm.applyDegradation(record(), []string{problem})
+
+	degraded := record()
+	assert.Equal(t, phaseDegraded, degraded.Phase)
+	assert.Contains(t, degraded.Message, "Deployment degraded: component web is not ready")
+	assert.Contains(t, degraded.Message, "pod web-a container web: ImagePullBackOff")
+
+	// the image was pushed
+	status, problem = helmReadinessStatus("web", &workloads.WorkloadStatus{ReadyPods: 1, TotalPods: 1}, now.Add(-time.Hour), 10*time.Minute, now)
+	db.SetComponentStatus(deploymentId, "web", status)
+	hm.applyDegradation(degraded, nil)
+
+	recovered := record()
+	assert.Empty(t, problem)
+	assert.Equal(t, "RUNNING", recovered.Phase)
+	assert.Equal(t, sbi.ComponentStatusStateInstalled, recovered.ComponentViseStatus["web"].State)
+}
@@ -0,0 +1,172 @@
+package hooks
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultQueueSize = 256
+	// drainTimeout bounds how long Stop waits for queued events to be delivered
+	drainTimeout = 5 * time.Second
+)
+
+// action delivers one event to one hook
+type action interface {
+	Deliver(ctx context.Context, event Event) error
+}
+
+type hook struct {
+	name   string
+	filter Filter
+	action action
+}
+
+// Stats counts what happened to the emitted events
+type Stats struct {
+	// Emitted is the number of events accepted into the queue
+	Emitted uint64
+	// Dropped is the number of events discarded because the queue was full
+	Dropped uint64
+	// Delivered and Failed count deliveries per hook, an event matching two hooks counts twice
+	Delivered uint64
+	Failed    uint64
+}
+
+// Dispatcher delivers events to the configured hooks from a bounded queue on its own goroutine,
+// so that emitting an event never blocks the caller.
+type Dispatcher struct {
+	hooks []hook
+	queue chan Event
+	log   *zap.SugaredLogger
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	stopOnce sync.Once
+
+	emitted   atomic.Uint64
+	dropped   atomic.Uint64
+	delivered atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// NewDispatcher creates a dispatcher for the configured hooks, cfg may be nil in which case
+// every event is discarded
+func NewDispatcher(cfg *types.EventHooksConfig, log *zap.SugaredLogger) (*Dispatcher, error) {
+	queueSize := defaultQueueSize
+	var hooks []hook
+	if cfg != nil {
+		if cfg.QueueSize > 0 {
+			queueSize = cfg.QueueSize
+		}
+		allowed := make(map[string]bool, len(cfg.AllowedCommands))
+		for _, command := range cfg.AllowedCommands {
+			allowed[filepath.Clean(command)] = true
+		}
+
+		for _, hookCfg := range cfg.Hooks {
+			var hookAction action
+			switch {
+			case hookCfg.Webhook != nil:
+				webhook, err := newWebhookAction(*hookCfg.Webhook)
+				if err != nil {
+					return nil, fmt.Errorf("hook %s: %w", hookCfg.Name, err)
+				}
+				hookAction = webhook
+			case hookCfg.Exec != nil:
+				if !allowed[filepath.Clean(hookCfg.Exec.Command)] {
+					return nil, fmt.Errorf("hook %s: command %s is not allowed", hookCfg.Name, hookCfg.Exec.Command)
+				}
+				hookAction = newExecAction(*hookCfg.Exec, log.With("hook", hookCfg.Name))
+			default:
+				return nil, fmt.Errorf("hook %s has no action", hookCfg.Name)
+			}
+			hooks = append(hooks, hook{name: hookCfg.Name, filter: hookCfg.Events, action: hookAction})
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		hooks:  hooks,
+		queue:  make(chan Event, queueSize),
+		log:    log,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (d *Dispatcher) Start() {
+	go d.run()
+}
+
+// Stop delivers what is still queued for a short while and then gives up on the rest
+func (d *Dispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.queue)
+		select {
+		case <-d.done:
+		case <-time.After(drainTimeout):
+			d.log.Warnw("Event hooks did not drain in time, abandoning queued events", "queued", len(d.queue))
+		}
+		d.cancel()
+	})
+}
+
+// Emit queues the event for delivery, it never blocks: when the queue is full the event is dropped
+func (d *Dispatcher) Emit(event Event) {
+	if d == nil || len(d.hooks) == 0 {
+		return
+	}
+
+	defer func() {
+		// Emit after Stop, the event is dropped like on a full queue
+		if recover() != nil {
+			d.dropped.Add(1)
+		}
+	}()
+
+	select {
+	case d.queue <- event:
+		d.emitted.Add(1)
+	default:
+		d.dropped.Add(1)
+		d.log.Warnw("Event hook queue is full, dropping event", "event", event.Type, "deploymentId", event.DeploymentID)
+	}
+}
+
+// Stats returns the delivery counters
+func (d *Dispatcher) Stats() Stats {
+	return Stats{
+		Emitted:   d.emitted.Load(),
+		Dropped:   d.dropped.Load(),
+		Delivered: d.delivered.Load(),
+		Failed:    d.failed.Load(),
+	}
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	for event := range d.queue {
+		for _, h := range d.hooks {
+			if !h.filter.Matches(event.Type) {
+				continue
+			}
+			if err := h.action.Deliver(d.ctx, event); err != nil {
+				d.failed.Add(1)
+				d.log.Errorw("Event hook delivery failed", "hook", h.name, "event", event.Type, "eventId", event.ID, "error", err)
+				continue
+			}
+			d.delivered.Add(1)
+			d.log.Debugw("Event hook delivered", "hook", h.name, "event", event.Type, "eventId", event.ID)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Package hooks notifies local integrations (SCADA, notification systems, ...) about what the agent
+// does, through webhooks or whitelisted local scripts, without them having to poll the WFM.
+package hooks
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/margo/sandbox/poc/device/agent/database"
+)
+
+// Event types. Deployment events are named after the phase the deployment entered,
+// e.g. deployment.running, deployment.failed or deployment.removed.
+const (
+	EventTypeDeploymentPrefix = "deployment."
+	EventTypeSyncDegraded     = "sync.degraded"
+	EventTypeSyncRecovered    = "sync.recovered"
+	// runtime events are emitted when the circuit breaker of a runtime opens or closes
+	EventTypeRuntimeUnavailable = "runtime.unavailable"
+	EventTypeRuntimeAvailable   = "runtime.available"
+	// image events are emitted by the image janitor, unused images are reported when the janitor
+	// only reports the unused images of a runtime
+	EventTypeImageRemoved = "image.removed"
+	EventTypeImageUnused  = "image.unused"
+	// maintenance events are reserved for maintenance window transitions
+	EventTypeMaintenanceEntered = "maintenance.entered"
+	EventTypeMaintenanceExited  = "maintenance.exited"
+)
+
+// Event is the payload delivered to hooks. It only carries identifiers and state, never deployment
+// parameters, credentials or other secrets.
+type Event struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	DeviceID      string    `json:"deviceId,omitempty"`
+	DeploymentID  string    `json:"deploymentId,omitempty"`
+	AppID         string    `json:"appId,omitempty"`
+	Phase         string    `json:"phase,omitempty"`
+	PreviousPhase string    `json:"previousPhase,omitempty"`
+	Digest        string    `json:"digest,omitempty"`
+	Image         string    `json:"image,omitempty"`
+	Message       string    `json:"message,omitempty"`
+}
+
+// NewEvent creates an event of the given type with a fresh id and the current time
+func NewEvent(eventType string) Event {
+	return Event{
+		ID:   uuid.NewString(),
+		Type: eventType,
+		Time: time.Now().UTC(),
+	}
+}
+
+// DeploymentEvent converts a deployment phase change into an event
+func DeploymentEvent(transition database.DeploymentTransition) Event {
+	event := NewEvent(EventTypeDeploymentPrefix + strings.ToLower(transition.Phase))
+	if !transition.Time.IsZero() {
+		event.Time = transition.Time.UTC()
+	}
+	event.DeploymentID = transition.DeploymentID
+	event.AppID = transition.AppID
+	event.Phase = transition.Phase
+	event.PreviousPhase = transition.PreviousPhase
+	event.Digest = transition.Digest
+	event.Message = transition.Message
+	return event
+}
+
+// Filter selects events by type. Patterns use path.Match syntax with "." separated names, so
+// "deployment.*" selects every deployment event. An empty filter selects everything.
+type Filter []string
+
+// Matches reports whether the event type is selected by the filter
+func (f Filter) Matches(eventType string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, pattern := range f {
+		// path.Match treats "/" as separator, event types use "." which is matched by "*"
+		if matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(eventType)); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultExecTimeout = 10 * time.Second
+	// maxExecOutput bounds the script output kept for the logs
+	maxExecOutput = 4 * 1024
+)
+
+type execAction struct {
+	command string
+	args    []string
+	timeout time.Duration
+	log     *zap.SugaredLogger
+}
+
+func newExecAction(cfg types.ExecHookConfig, log *zap.SugaredLogger) *execAction {
+	timeout := defaultExecTimeout
+	if cfg.TimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	return &execAction{
+		command: cfg.Command,
+		args:    cfg.Args,
+		timeout: timeout,
+		log:     log,
+	}
+}
+
+// Deliver runs the script with the event as JSON on stdin, the script is killed when it
+// exceeds the timeout
+func (e *execAction) Deliver(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	output := &limitedBuffer{limit: maxExecOutput}
+	cmd := exec.CommandContext(ctx, e.command, e.args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// do not wait for grandchildren holding the output pipes after the script was killed
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out after %s, output: %s", e.command, e.timeout, output.String())
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %w, output: %s", e.command, err, output.String())
+	}
+
+	e.log.Debugw("Event hook script completed", "command", e.command, "event", event.Type, "output", output.String())
+	return nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the rest
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.buf.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.buf.Write(p[:remaining])
+			b.truncated = true
+		} else {
+			b.buf.Write(p)
+		}
+	} else if len(p) > 0 {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "...(truncated)"
+	}
+	return b.buf.String()
+}
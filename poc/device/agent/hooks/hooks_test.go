@@ -0,0 +1,261 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFilterMatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		filter    Filter
+		eventType string
+		want      bool
+	}{
+		{name: "empty filter selects everything", filter: nil, eventType: "deployment.running", want: true},
+		{name: "exact match", filter: Filter{"deployment.failed"}, eventType: "deployment.failed", want: true},
+		{name: "exact mismatch", filter: Filter{"deployment.failed"}, eventType: "deployment.running", want: false},
+		{name: "wildcard", filter: Filter{"deployment.*"}, eventType: "deployment.removed", want: true},
+		{name: "wildcard other family", filter: Filter{"deployment.*"}, eventType: "sync.degraded", want: false},
+		{name: "any of several", filter: Filter{"sync.degraded", "deployment.failed"}, eventType: "sync.degraded", want: true},
+		{name: "case insensitive", filter: Filter{"Deployment.FAILED"}, eventType: "deployment.failed", want: true},
+		{name: "invalid pattern never matches", filter: Filter{"deployment.["}, eventType: "deployment.failed", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.Matches(tt.eventType))
+		})
+	}
+}
+
+func TestDeploymentEvent(t *testing.T) {
+	event := DeploymentEvent(database.DeploymentTransition{
+		DeploymentID:  "deployment-1",
+		AppID:         "app-1",
+		PreviousPhase: "DEPLOYING",
+		Phase:         "FAILED",
+		Message:       "helm operation failed",
+		Digest:        "sha256:1234",
+	})
+
+	assert.Equal(t, "deployment.failed", event.Type)
+	assert.Equal(t, "deployment-1", event.DeploymentID)
+	assert.Equal(t, "DEPLOYING", event.PreviousPhase)
+	assert.NotEmpty(t, event.ID)
+	assert.False(t, event.Time.IsZero())
+}
+
+func TestWebhook_SignatureAndRetries(t *testing.T) {
+	secret := []byte("shared-secret")
+	var attempts atomic.Int32
+	received := make(chan Event, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first attempt so that the retry path is exercised
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !VerifySignature(secret, body, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event Event
+		require.NoError(t, json.Unmarshal(body, &event))
+		assert.Equal(t, event.Type, r.Header.Get(EventTypeHeader))
+		received <- event
+	}))
+	defer server.Close()
+
+	webhook, err := newWebhookAction(types.WebhookHookConfig{URL: server.URL, Secret: string(secret)})
+	require.NoError(t, err)
+	webhook.backoff = time.Millisecond
+
+	event := NewEvent("deployment.running")
+	require.NoError(t, webhook.Deliver(context.Background(), event))
+	assert.Equal(t, int32(2), attempts.Load())
+	assert.Equal(t, event.ID, (<-received).ID)
+}
+
+func TestWebhook_RejectedSignatureIsNotRetried(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		if !VerifySignature([]byte("receiver-secret"), body, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	webhook, err := newWebhookAction(types.WebhookHookConfig{URL: server.URL, Secret: "other-secret"})
+	require.NoError(t, err)
+	webhook.backoff = time.Millisecond
+
+	assert.Error(t, webhook.Deliver(context.Background(), NewEvent("deployment.failed")))
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"type":"deployment.running"}`)
+	signature := Sign([]byte("secret"), body)
+
+	assert.True(t, VerifySignature([]byte("secret"), body, signature))
+	assert.False(t, VerifySignature([]byte("wrong"), body, signature))
+	assert.False(t, VerifySignature([]byte("secret"), []byte(`{"type":"deployment.failed"}`), signature))
+}
+
+func writeScript(t *testing.T, content string) string {
+	t.Helper()
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("requires /bin/sh")
+	}
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+content), 0o755))
+	return path
+}
+
+func TestExec_ReceivesEventOnStdin(t *testing.T) {
+	outFile := filepath.Join(t.TempDir(), "event.json")
+	script := writeScript(t, "cat > "+outFile+"\n")
+
+	action := newExecAction(types.ExecHookConfig{Command: script, TimeoutSeconds: 5}, zap.NewNop().Sugar())
+	event := NewEvent("deployment.removed")
+	require.NoError(t, action.Deliver(context.Background(), event))
+
+	data, err := os.ReadFile(outFile)
+	require.NoError(t, err)
+	var received Event
+	require.NoError(t, json.Unmarshal(data, &received))
+	assert.Equal(t, event.ID, received.ID)
+}
+
+func TestExec_Timeout(t *testing.T) {
+	script := writeScript(t, "echo started\nsleep 10\n")
+
+	action := newExecAction(types.ExecHookConfig{Command: script}, zap.NewNop().Sugar())
+	action.timeout = 200 * time.Millisecond
+
+	startedAt := time.Now()
+	err := action.Deliver(context.Background(), NewEvent("deployment.failed"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+	assert.Contains(t, err.Error(), "started", "output is captured")
+	assert.Less(t, time.Since(startedAt), 5*time.Second)
+}
+
+func TestExec_FailureCapturesOutput(t *testing.T) {
+	script := writeScript(t, "echo cannot reach scada >&2\nexit 3\n")
+
+	action := newExecAction(types.ExecHookConfig{Command: script}, zap.NewNop().Sugar())
+	err := action.Deliver(context.Background(), NewEvent("deployment.failed"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot reach scada")
+}
+
+// blockingAction holds every delivery until released
+type blockingAction struct {
+	release   chan struct{}
+	started   chan struct{}
+	once      sync.Once
+	delivered atomic.Int32
+}
+
+func (b *blockingAction) Deliver(ctx context.Context, event Event) error {
+	b.once.Do(func() { close(b.started) })
+	<-b.release
+	b.delivered.Add(1)
+	return nil
+}
+
+func TestDispatcher_QueueOverflowDropsWithoutBlocking(t *testing.T) {
+	action := &blockingAction{release: make(chan struct{}), started: make(chan struct{})}
+	d, err := NewDispatcher(&types.EventHooksConfig{QueueSize: 2}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	d.hooks = []hook{{name: "blocking", action: action}}
+	d.Start()
+
+	// the first event is taken by the worker and blocks there, two more fill the queue
+	d.Emit(NewEvent("deployment.running"))
+	<-action.started
+	d.Emit(NewEvent("deployment.running"))
+	d.Emit(NewEvent("deployment.running"))
+
+	emitted := make(chan struct{})
+	go func() {
+		d.Emit(NewEvent("deployment.running"))
+		d.Emit(NewEvent("deployment.running"))
+		close(emitted)
+	}()
+	select {
+	case <-emitted:
+	case <-time.After(time.Second):
+		t.Fatal("Emit blocked on a full queue")
+	}
+
+	close(action.release)
+	d.Stop()
+
+	stats := d.Stats()
+	assert.Equal(t, Stats{Emitted: 3, Dropped: 2, Delivered: 3}, stats)
+	assert.Equal(t, int32(3), action.delivered.Load())
+
+	// emitting after stop is dropped as well
+	d.Emit(NewEvent("deployment.running"))
+	assert.Equal(t, uint64(3), d.Stats().Dropped)
+}
+
+func TestDispatcher_FiltersAndCountsFailures(t *testing.T) {
+	var delivered []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		delivered = append(delivered, r.Header.Get(EventTypeHeader))
+		mu.Unlock()
+		if r.Header.Get(EventTypeHeader) == "sync.degraded" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	d, err := NewDispatcher(&types.EventHooksConfig{Hooks: []types.HookConfig{{
+		Name:    "scada",
+		Events:  []string{"deployment.failed", "sync.*"},
+		Webhook: &types.WebhookHookConfig{URL: server.URL, Secret: "secret"},
+	}}}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	d.Start()
+
+	d.Emit(NewEvent("deployment.running"))
+	d.Emit(NewEvent("deployment.failed"))
+	d.Emit(NewEvent("sync.degraded"))
+	d.Stop()
+
+	assert.Equal(t, []string{"deployment.failed", "sync.degraded"}, delivered)
+	assert.Equal(t, Stats{Emitted: 3, Delivered: 1, Failed: 1}, d.Stats())
+}
+
+func TestNewDispatcher_RejectsCommandsNotAllowed(t *testing.T) {
+	_, err := NewDispatcher(&types.EventHooksConfig{Hooks: []types.HookConfig{{
+		Name: "script",
+		Exec: &types.ExecHookConfig{Command: "/usr/local/bin/notify"},
+	}}}, zap.NewNop().Sugar())
+	assert.Error(t, err)
+}
@@ -0,0 +1,139 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/types"
+	httputils "github.com/margo/sandbox/shared-lib/http"
+)
+
+const (
+	// SignatureHeader carries "sha256=<hex hmac of the body>" computed with the hook's shared secret
+	SignatureHeader = "X-Margo-Signature"
+	// EventTypeHeader carries the event type so receivers can route without parsing the body
+	EventTypeHeader = "X-Margo-Event"
+
+	defaultWebhookTimeout    = 5 * time.Second
+	defaultWebhookMaxRetries = 3
+	webhookInitialBackoff    = 500 * time.Millisecond
+)
+
+type webhookAction struct {
+	url        string
+	secret     []byte
+	client     *http.Client
+	maxRetries int
+	backoff    time.Duration
+}
+
+func newWebhookAction(cfg types.WebhookHookConfig) (*webhookAction, error) {
+	secret := []byte(cfg.Secret)
+	if cfg.SecretFile != "" {
+		data, err := os.ReadFile(cfg.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read webhook secret: %w", err)
+		}
+		secret = bytes.TrimSpace(data)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("webhook secret is empty")
+	}
+
+	timeout := defaultWebhookTimeout
+	if cfg.TimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	maxRetries := defaultWebhookMaxRetries
+	if cfg.MaxRetries > 0 {
+		maxRetries = int(cfg.MaxRetries)
+	}
+
+	return &webhookAction{
+		url:        cfg.URL,
+		secret:     secret,
+		client:     httputils.DefaultClientFactory().ClientWithTimeout(timeout),
+		maxRetries: maxRetries,
+		backoff:    webhookInitialBackoff,
+	}, nil
+}
+
+// Deliver posts the event, retrying with exponential backoff on network errors and 5xx answers
+func (w *webhookAction) Deliver(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	signature := Sign(w.secret, body)
+
+	var lastErr error
+	backoff := w.backoff
+	for attempt := 0; attempt <= w.maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return fmt.Errorf("giving up after %d attempts: %w", attempt, lastErr)
+			}
+			backoff *= 2
+		}
+
+		retry, err := w.post(ctx, event.Type, body, signature)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+	}
+	return lastErr
+}
+
+func (w *webhookAction) post(ctx context.Context, eventType string, body []byte, signature string) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventTypeHeader, eventType)
+	req.Header.Set(SignatureHeader, signature)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook answered with status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("webhook rejected the event with status %d", resp.StatusCode)
+	}
+}
+
+// Sign returns the signature header value for body
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks a signature header value against body, receivers can use it to
+// authenticate the agent
+func VerifySignature(secret, body []byte, signature string) bool {
+	expected := Sign(secret, body)
+	return hmac.Equal([]byte(expected), []byte(strings.TrimSpace(signature)))
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/margo/sandbox/poc/device/agent/hooks"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"go.uber.org/zap"
+)
+
+// imageGCPassTimeout bounds a janitor pass, removing many large images can take a while
+const imageGCPassTimeout = 10 * time.Minute
+
+// dockerImageStore is what the image janitor needs of the docker engine
+type dockerImageStore interface {
+	ListImages(ctx context.Context) ([]workloads.ImageInfo, error)
+	ImagesInUse(ctx context.Context) (map[string]bool, error)
+	RemoveImage(ctx context.Context, reference string) error
+}
+
+// ImageGCPass is the outcome of a janitor pass
+type ImageGCPass struct {
+	// Removed are the references removed from the docker engine
+	Removed        []string
+	ReclaimedBytes int64
+	// Unused are the references that could be removed but are only reported
+	Unused []string
+	// Waiting are the references still in their grace period or used by a container
+	Waiting int
+	Errors  []string
+}
+
+// ImageJanitor removes the images that deployments stopped using, see types.ImageGCConfig.
+// Images used by any container are kept, whoever created the container.
+type ImageJanitor struct {
+	database database.DatabaseIfc
+	// docker is nil when the device has no docker runtime
+	docker   dockerImageStore
+	config   *types.ImageGCConfig
+	log      *zap.SugaredLogger
+	emit     func(hooks.Event)
+	now      func() time.Time
+	stopChan chan struct{}
+
+	mu sync.Mutex
+	// reported keeps unused images from being reported again on every pass
+	reported map[string]bool
+	lastPass *ImageGCPass
+}
+
+type ImageJanitorOption func(j *ImageJanitor)
+
+// WithImageGCEvents emits an event for every removed and every reported image
+func WithImageGCEvents(emit func(hooks.Event)) ImageJanitorOption {
+	return func(j *ImageJanitor) {
+		j.emit = emit
+	}
+}
+
+// WithDockerImages lets the janitor remove docker images, without it compose images are kept
+func WithDockerImages(docker dockerImageStore) ImageJanitorOption {
+	return func(j *ImageJanitor) {
+		j.docker = docker
+	}
+}
+
+func NewImageJanitor(db database.DatabaseIfc, config *types.ImageGCConfig, log *zap.SugaredLogger, opts ...ImageJanitorOption) *ImageJanitor {
+	j := &ImageJanitor{
+		database: db,
+		config:   config,
+		log:      log,
+		emit:     func(hooks.Event) {},
+		now:      time.Now,
+		stopChan: make(chan struct{}),
+		reported: make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(j)
+	}
+	return j
+}
+
+func (j *ImageJanitor) Start() {
+	go j.loop()
+}
+
+func (j *ImageJanitor) Stop() {
+	close(j.stopChan)
+}
+
+func (j *ImageJanitor) loop() {
+	ticker := time.NewTicker(j.config.Interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), imageGCPassTimeout)
+			j.RunOnce(ctx)
+			cancel()
+		case <-j.stopChan:
+			return
+		}
+	}
+}
+
+func (j *ImageJanitor) Name() string {
+	return health.ComponentImageGC
+}
+
+// Health reports what the janitor removed since the device was set up, it is degraded while the
+// last pass had errors
+func (j *ImageJanitor) Health() health.Report {
+	state := j.database.GetImageGCState()
+
+	j.mu.Lock()
+	lastPass := j.lastPass
+	j.mu.Unlock()
+
+	metrics := map[string]float64{
+		"retiredImages":  float64(len(state.Retired)),
+		"removedImages":  float64(state.RemovedImages),
+		"reclaimedBytes": float64(state.ReclaimedBytes),
+	}
+	if lastPass == nil {
+		return health.OK(metrics)
+	}
+	metrics["unusedImages"] = float64(len(lastPass.Unused))
+	report := health.OK(metrics)
+	if len(lastPass.Errors) > 0 {
+		report.Degrade(fmt.Sprintf("last image cleanup had %d errors: %s", len(lastPass.Errors), lastPass.Errors[0]))
+	}
+	return report
+}
+
+// RunOnce goes through the retired image references and removes or reports the ones that are
+// past their grace period and used by neither a deployment nor a container
+func (j *ImageJanitor) RunOnce(ctx context.Context) ImageGCPass {
+	var pass ImageGCPass
+	active := activeImageReferences(j.database.ListDeployments())
+	gracePeriod := j.config.GracePeriod()
+	now := j.now()
+
+	var docker *dockerImagesSnapshot
+	for _, retired := range j.database.ListRetiredImages() {
+		if active[workloads.NormalizeImageReference(retired.Reference)] {
+			// it is retired again when the deployments using it stop doing so
+			j.database.ForgetRetiredImage(retired.Runtime, retired.Reference)
+			continue
+		}
+
+		mode := j.modeOf(retired.Runtime)
+		if mode == types.ImageGCOff {
+			j.database.ForgetRetiredImage(retired.Runtime, retired.Reference)
+			continue
+		}
+		if now.Sub(retired.RetiredAt) < gracePeriod {
+			pass.Waiting++
+			continue
+		}
+
+		// the cluster owns the images of its nodes, they are only reported
+		if retired.Runtime != string(sbi.Compose) {
+			j.reportUnused(&pass, retired)
+			continue
+		}
+		if j.docker == nil {
+			continue
+		}
+		if docker == nil {
+			snapshot, err := loadDockerImages(ctx, j.docker, active)
+			if err != nil {
+				pass.Errors = append(pass.Errors, err.Error())
+				break
+			}
+			docker = snapshot
+		}
+		j.collectDockerImage(ctx, &pass, docker, retired, mode)
+	}
+
+	if len(pass.Removed) > 0 || len(pass.Errors) > 0 {
+		j.log.Infow("Image cleanup finished",
+			"removed", pass.Removed,
+			"reclaimedBytes", pass.ReclaimedBytes,
+			"unused", len(pass.Unused),
+			"waiting", pass.Waiting,
+			"errors", pass.Errors)
+	}
+
+	j.mu.Lock()
+	j.lastPass = &pass
+	j.mu.Unlock()
+	return pass
+}
+
+func (j *ImageJanitor) modeOf(runtime string) types.ImageGCMode {
+	switch runtime {
+	case string(sbi.Compose):
+		return j.config.ComposeMode()
+	case string(sbi.HelmV3):
+		return j.config.HelmMode()
+	}
+	return types.ImageGCOff
+}
+
+func (j *ImageJanitor) collectDockerImage(ctx context.Context, pass *ImageGCPass, docker *dockerImagesSnapshot, retired database.RetiredImage, mode types.ImageGCMode) {
+	image := docker.find(retired.Reference)
+	if image == nil {
+		// removed by someone else already
+		j.database.ForgetRetiredImage(retired.Runtime, retired.Reference)
+		return
+	}
+	if docker.inUse[image.ID] || docker.activeIDs[image.ID] {
+		// a container or a deployment still uses the image under another name, try again later
+		pass.Waiting++
+		return
+	}
+	if mode == types.ImageGCReport {
+		j.reportUnused(pass, retired)
+		return
+	}
+
+	if err := j.docker.RemoveImage(ctx, retired.Reference); err != nil {
+		pass.Errors = append(pass.Errors, err.Error())
+		return
+	}
+	// removing one of several tags only untags the image, nothing is reclaimed
+	var reclaimed int64
+	if len(image.RepoTags) <= 1 {
+		reclaimed = image.Size
+	}
+	docker.untag(image, retired.Reference)
+
+	j.database.RecordImageRemoval(retired, reclaimed)
+	pass.Removed = append(pass.Removed, retired.Reference)
+	pass.ReclaimedBytes += reclaimed
+	j.log.Infow("Removed unused image", "image", retired.Reference, "deploymentId", retired.DeploymentID, "reclaimedBytes", reclaimed)
+
+	event := hooks.NewEvent(hooks.EventTypeImageRemoved)
+	event.DeploymentID = retired.DeploymentID
+	event.Image = retired.Reference
+	event.Message = fmt.Sprintf("removed unused image %s, reclaimed %d bytes", retired.Reference, reclaimed)
+	j.emit(event)
+}
+
+func (j *ImageJanitor) reportUnused(pass *ImageGCPass, retired database.RetiredImage) {
+	pass.Unused = append(pass.Unused, retired.Reference)
+
+	key := retired.Runtime + "/" + retired.Reference
+	j.mu.Lock()
+	alreadyReported := j.reported[key]
+	j.reported[key] = true
+	j.mu.Unlock()
+	if alreadyReported {
+		return
+	}
+
+	j.log.Infow("Image is no longer used by any deployment", "image", retired.Reference, "runtime", retired.Runtime, "deploymentId", retired.DeploymentID)
+	event := hooks.NewEvent(hooks.EventTypeImageUnused)
+	event.DeploymentID = retired.DeploymentID
+	event.Image = retired.Reference
+	event.Message = fmt.Sprintf("%s image %s is no longer used by any deployment", retired.Runtime, retired.Reference)
+	j.emit(event)
+}
+
+// activeImageReferences returns the normalized references the deployments run with
+func activeImageReferences(deployments []*database.DeploymentRecord) map[string]bool {
+	active := make(map[string]bool)
+	for _, deployment := range deployments {
+		if deployment.Images == nil {
+			continue
+		}
+		for _, reference := range deployment.Images.References {
+			active[workloads.NormalizeImageReference(reference)] = true
+		}
+	}
+	return active
+}
+
+// dockerImagesSnapshot is what the docker engine knows at the start of a pass
+type dockerImagesSnapshot struct {
+	images []workloads.ImageInfo
+	// inUse are the ids of the images used by containers
+	inUse map[string]bool
+	// activeIDs are the ids of the images deployments run with
+	activeIDs map[string]bool
+}
+
+func loadDockerImages(ctx context.Context, docker dockerImageStore, active map[string]bool) (*dockerImagesSnapshot, error) {
+	images, err := docker.ListImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	inUse, err := docker.ImagesInUse(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &dockerImagesSnapshot{images: images, inUse: inUse, activeIDs: make(map[string]bool)}
+	for reference := range active {
+		if image := snapshot.find(reference); image != nil {
+			snapshot.activeIDs[image.ID] = true
+		}
+	}
+	return snapshot, nil
+}
+
+func (s *dockerImagesSnapshot) find(reference string) *workloads.ImageInfo {
+	for i := range s.images {
+		if s.images[i].References(reference) {
+			return &s.images[i]
+		}
+	}
+	return nil
+}
+
+// untag keeps the snapshot in line with a removal, so the size of an image removed through its
+// last tag is counted
+func (s *dockerImagesSnapshot) untag(image *workloads.ImageInfo, reference string) {
+	tags := image.RepoTags[:0]
+	for _, tag := range image.RepoTags {
+		if workloads.NormalizeImageReference(tag) != workloads.NormalizeImageReference(reference) {
+			tags = append(tags, tag)
+		}
+	}
+	image.RepoTags = tags
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/margo/sandbox/poc/device/agent/hooks"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// stubDocker tracks images and the containers using them like the docker engine does
+type stubDocker struct {
+	images []workloads.ImageInfo
+	// containers maps container names to the id of their image
+	containers map[string]string
+	removed    []string
+}
+
+func (s *stubDocker) addImage(id string, size int64, tags ...string) {
+	s.images = append(s.images, workloads.ImageInfo{ID: id, RepoTags: tags, Size: size})
+}
+
+func (s *stubDocker) ListImages(ctx context.Context) ([]workloads.ImageInfo, error) {
+	images := make([]workloads.ImageInfo, 0, len(s.images))
+	for _, image := range s.images {
+		image.RepoTags = slices.Clone(image.RepoTags)
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+func (s *stubDocker) ImagesInUse(ctx context.Context) (map[string]bool, error) {
+	inUse := make(map[string]bool)
+	for _, id := range s.containers {
+		inUse[id] = true
+	}
+	return inUse, nil
+}
+
+func (s *stubDocker) RemoveImage(ctx context.Context, reference string) error {
+	for i, image := range s.images {
+		if !image.References(reference) {
+			continue
+		}
+		for name, id := range s.containers {
+			if id == image.ID {
+				return fmt.Errorf("conflict: unable to remove %s, image is being used by container %s", reference, name)
+			}
+		}
+		s.removed = append(s.removed, reference)
+		image.RepoTags = slices.DeleteFunc(image.RepoTags, func(tag string) bool {
+			return workloads.NormalizeImageReference(tag) == workloads.NormalizeImageReference(reference)
+		})
+		if len(image.RepoTags) == 0 {
+			s.images = slices.Delete(s.images, i, i+1)
+		} else {
+			s.images[i] = image
+		}
+		return nil
+	}
+	return fmt.Errorf("no such image: %s", reference)
+}
+
+func (s *stubDocker) hasImage(reference string) bool {
+	for _, image := range s.images {
+		if image.References(reference) {
+			return true
+		}
+	}
+	return false
+}
+
+type imageGCTestEnv struct {
+	db      *database.Database
+	docker  *stubDocker
+	janitor *ImageJanitor
+	events  []hooks.Event
+	now     time.Time
+}
+
+func newImageGCTestEnv(t *testing.T, config *types.ImageGCConfig) *imageGCTestEnv {
+	t.Helper()
+	env := &imageGCTestEnv{
+		db:     newTestDatabase(t, t.TempDir()),
+		docker: &stubDocker{containers: map[string]string{}},
+		now:    time.Now(),
+	}
+	env.janitor = NewImageJanitor(env.db, config, zap.NewNop().Sugar(),
+		WithDockerImages(env.docker),
+		WithImageGCEvents(func(event hooks.Event) { env.events = append(env.events, event) }))
+	env.janitor.now = func() time.Time { return env.now }
+	return env
+}
+
+// deploy stores a deployment that runs with the given images
+func (env *imageGCTestEnv) deploy(t *testing.T, deploymentId string, runtime sbi.AppDeploymentProfileType, images ...string) {
+	t.Helper()
+	if _, err := env.db.GetDeployment(deploymentId); err != nil {
+		require.NoError(t, env.db.SetDesiredState(deploymentId, database.AppDeploymentState{}))
+	}
+	env.db.SetDeploymentImages(deploymentId, database.DeploymentImages{Runtime: string(runtime), References: images})
+}
+
+func TestImageJanitor_RemovesImagesOfRemovedDeployments(t *testing.T) {
+	env := newImageGCTestEnv(t, &types.ImageGCConfig{Enabled: true, GracePeriodSeconds: 3600})
+	env.docker.addImage("sha256:web", 100, "registry.local/web:1")
+	env.docker.addImage("sha256:redis", 200, "redis:7")
+	env.docker.addImage("sha256:postgres", 300, "postgres:16")
+	env.docker.addImage("sha256:other", 400, "other:1")
+	// a container the agent knows nothing about
+	env.docker.containers["historian"] = "sha256:postgres"
+
+	env.deploy(t, "deployment-a", sbi.Compose, "registry.local/web:1", "redis:7", "postgres:16")
+	env.deploy(t, "deployment-b", sbi.Compose, "docker.io/library/redis:7")
+	env.db.RemoveDeployment("deployment-a")
+	require.Len(t, env.db.ListRetiredImages(), 3)
+
+	pass := env.janitor.RunOnce(context.Background())
+	assert.Empty(t, pass.Removed, "retired images are kept for the grace period")
+	assert.Empty(t, env.docker.removed)
+
+	env.now = env.now.Add(2 * time.Hour)
+	pass = env.janitor.RunOnce(context.Background())
+	assert.Equal(t, []string{"registry.local/web:1"}, pass.Removed)
+	assert.Equal(t, int64(100), pass.ReclaimedBytes)
+	assert.Empty(t, pass.Errors)
+	assert.False(t, env.docker.hasImage("registry.local/web:1"))
+	assert.True(t, env.docker.hasImage("redis:7"), "deployment-b still uses the image")
+	assert.True(t, env.docker.hasImage("postgres:16"), "images used by other containers are kept")
+	assert.True(t, env.docker.hasImage("other:1"), "images never used by a deployment are not touched")
+
+	// the image used by deployment-b is no longer a candidate, the one used by a container is
+	retired := env.db.ListRetiredImages()
+	require.Len(t, retired, 1)
+	assert.Equal(t, "postgres:16", retired[0].Reference)
+
+	// once the container is gone the image goes too
+	delete(env.docker.containers, "historian")
+	pass = env.janitor.RunOnce(context.Background())
+	assert.Equal(t, []string{"postgres:16"}, pass.Removed)
+	assert.Empty(t, env.db.ListRetiredImages())
+
+	state := env.db.GetImageGCState()
+	assert.Equal(t, int64(2), state.RemovedImages)
+	assert.Equal(t, int64(400), state.ReclaimedBytes)
+	report := env.janitor.Health()
+	assert.Equal(t, float64(400), report.Metrics["reclaimedBytes"])
+	assert.Equal(t, float64(2), report.Metrics["removedImages"])
+
+	require.Len(t, env.events, 2)
+	assert.Equal(t, hooks.EventTypeImageRemoved, env.events[0].Type)
+	assert.Equal(t, "registry.local/web:1", env.events[0].Image)
+	assert.Equal(t, "deployment-a", env.events[0].DeploymentID)
+}
+
+func TestImageJanitor_RemovesImagesReplacedByAnUpgrade(t *testing.T) {
+	env := newImageGCTestEnv(t, &types.ImageGCConfig{Enabled: true, GracePeriodSeconds: 60})
+	env.docker.addImage("sha256:web1", 100, "registry.local/web:1")
+	env.docker.addImage("sha256:web2", 120, "registry.local/web:2")
+	env.docker.addImage("sha256:proxy", 50, "proxy:1", "proxy:stable")
+
+	env.deploy(t, "deployment-a", sbi.Compose, "registry.local/web:1", "proxy:1")
+	env.docker.containers["deployment-a-web-1"] = "sha256:web1"
+
+	// the upgrade replaces the web container and keeps the proxy
+	env.deploy(t, "deployment-a", sbi.Compose, "registry.local/web:2", "proxy:1")
+	env.docker.containers["deployment-a-web-1"] = "sha256:web2"
+	retired := env.db.ListRetiredImages()
+	require.Len(t, retired, 1)
+	assert.Equal(t, "registry.local/web:1", retired[0].Reference)
+
+	env.now = env.now.Add(2 * time.Minute)
+	pass := env.janitor.RunOnce(context.Background())
+	assert.Equal(t, []string{"registry.local/web:1"}, pass.Removed)
+	assert.Equal(t, int64(100), pass.ReclaimedBytes)
+	assert.True(t, env.docker.hasImage("registry.local/web:2"))
+
+	// switching back to a retired tag takes it off the list again
+	env.deploy(t, "deployment-a", sbi.Compose, "registry.local/web:2", "proxy:stable")
+	env.deploy(t, "deployment-a", sbi.Compose, "registry.local/web:2", "proxy:1")
+	retired = env.db.ListRetiredImages()
+	require.Len(t, retired, 1)
+	assert.Equal(t, "proxy:stable", retired[0].Reference)
+
+	// the retired tag shares its image with the one in use, only the tag would go
+	env.now = env.now.Add(time.Hour)
+	pass = env.janitor.RunOnce(context.Background())
+	assert.Empty(t, pass.Removed)
+	assert.Equal(t, 1, pass.Waiting)
+	assert.True(t, env.docker.hasImage("proxy:stable"))
+}
+
+func TestImageJanitor_Modes(t *testing.T) {
+	env := newImageGCTestEnv(t, &types.ImageGCConfig{Enabled: true, GracePeriodSeconds: 60, Compose: types.ImageGCReport})
+	env.docker.addImage("sha256:web", 100, "registry.local/web:1")
+
+	env.deploy(t, "deployment-compose", sbi.Compose, "registry.local/web:1")
+	env.deploy(t, "deployment-helm", sbi.HelmV3, "registry.local/chart-app:3")
+	env.db.RemoveDeployment("deployment-compose")
+	env.db.RemoveDeployment("deployment-helm")
+
+	env.now = env.now.Add(time.Hour)
+	for range 2 {
+		pass := env.janitor.RunOnce(context.Background())
+		assert.Empty(t, pass.Removed)
+		assert.ElementsMatch(t, []string{"registry.local/web:1", "registry.local/chart-app:3"}, pass.Unused)
+	}
+	assert.Empty(t, env.docker.removed)
+	assert.True(t, env.docker.hasImage("registry.local/web:1"))
+	require.Len(t, env.events, 2, "unused images are reported once")
+	for _, event := range env.events {
+		assert.Equal(t, hooks.EventTypeImageUnused, event.Type)
+	}
+	assert.Equal(t, float64(2), env.janitor.Health().Metrics["unusedImages"])
+
+	// turning the cleanup off for a runtime forgets its retired images
+	env.janitor.config = &types.ImageGCConfig{Enabled: true, Helm: types.ImageGCOff, Compose: types.ImageGCReport}
+	env.janitor.RunOnce(context.Background())
+	retired := env.db.ListRetiredImages()
+	require.Len(t, retired, 1)
+	assert.Equal(t, string(sbi.Compose), retired[0].Runtime)
+}
+
+func TestImageJanitor_ReportsRemovalErrors(t *testing.T) {
+	env := newImageGCTestEnv(t, &types.ImageGCConfig{Enabled: true, GracePeriodSeconds: 60})
+	env.deploy(t, "deployment-a", sbi.Compose, "registry.local/web:1", "registry.local/gone:1")
+	env.docker.addImage("sha256:web", 100, "registry.local/web:1")
+	env.db.RemoveDeployment("deployment-a")
+
+	// the container shows up after the snapshot of the pass, the engine refuses the removal
+	env.janitor.docker = &racingDocker{stubDocker: env.docker}
+	env.now = env.now.Add(time.Hour)
+	pass := env.janitor.RunOnce(context.Background())
+	assert.Empty(t, pass.Removed)
+	require.Len(t, pass.Errors, 1)
+	assert.Contains(t, pass.Errors[0], "being used by container")
+
+	retired := env.db.ListRetiredImages()
+	require.Len(t, retired, 1, "the image that is gone already is forgotten, the other one is tried again")
+	assert.Equal(t, "registry.local/web:1", retired[0].Reference)
+	assert.Equal(t, health.StatusDegraded, env.janitor.Health().Status)
+}
+
+// racingDocker starts a container right before the removal
+type racingDocker struct {
+	*stubDocker
+}
+
+func (r *racingDocker) RemoveImage(ctx context.Context, reference string) error {
+	r.containers["late"] = "sha256:web"
+	return r.stubDocker.RemoveImage(ctx, reference)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/shared-lib/file"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/margo/sandbox/standard/pkg"
+)
+
+// version is the version of the agent, set when building with -ldflags "-X main.version=..."
+var version = "dev"
+
+const (
+	// inventorySchemaVersion changes whenever the inventory document changes incompatibly, tools
+	// consuming it check it
+	inventorySchemaVersion = 1
+	// inventoryFile is where SIGUSR1 dumps the inventory, in the data directory
+	inventoryFile = "inventory.json"
+	// inventoryTimeout bounds the runtime queries of an inventory
+	inventoryTimeout = 30 * time.Second
+)
+
+// Inventory is the machine readable list of what runs on the device: every deployment with the helm
+// releases or compose projects of its components and the images they run
+type Inventory struct {
+	SchemaVersion int                   `json:"schemaVersion"`
+	GeneratedAt   time.Time             `json:"generatedAt"`
+	AgentVersion  string                `json:"agentVersion"`
+	DeviceID      string                `json:"deviceId"`
+	Deployments   []InventoryDeployment `json:"deployments"`
+}
+
+// InventoryDeployment is a deployment with a current state
+type InventoryDeployment struct {
+	DeploymentID string `json:"deploymentId"`
+	AppID        string `json:"appId"`
+	AppVersion   string `json:"appVersion,omitempty"`
+	// Digest is the digest of the deployment manifest the current state was deployed from
+	Digest      string               `json:"digest,omitempty"`
+	ProfileType string               `json:"profileType"`
+	Phase       string               `json:"phase"`
+	State       string               `json:"state"`
+	Components  []InventoryComponent `json:"components"`
+}
+
+// InventoryComponent is a component of a deployment, a helm release or a compose project
+type InventoryComponent struct {
+	Name           string                   `json:"name"`
+	HelmRelease    *InventoryHelmRelease    `json:"helmRelease,omitempty"`
+	ComposeProject *InventoryComposeProject `json:"composeProject,omitempty"`
+	Images         []InventoryImage         `json:"images"`
+	// Errors tell what could not be read from the runtime, the inventory of the component is
+	// incomplete then
+	Errors []string `json:"errors,omitempty"`
+}
+
+// InventoryHelmRelease is the helm release of a component
+type InventoryHelmRelease struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	// Repository is where the chart comes from, as in the deployment
+	Repository string `json:"repository"`
+	// Chart and ChartVersion are the name and version of the deployed chart, the version is the
+	// requested one while the release cannot be read
+	Chart        string `json:"chart,omitempty"`
+	ChartVersion string `json:"chartVersion,omitempty"`
+	AppVersion   string `json:"appVersion,omitempty"`
+	Revision     int    `json:"revision,omitempty"`
+	Status       string `json:"status,omitempty"`
+}
+
+// InventoryComposeProject is the compose project of a component
+type InventoryComposeProject struct {
+	Name   string `json:"name"`
+	Status string `json:"status,omitempty"`
+}
+
+// InventoryImage is a container image, Digest is empty when the runtime does not know it
+type InventoryImage struct {
+	Reference  string `json:"reference"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+// InventorySources read what the runtimes run, the components of a runtime without sources are
+// listed as deployed, without images
+type InventorySources struct {
+	HelmRelease func(ctx context.Context, releaseName, namespace string) (*workloads.ReleaseStatus, error)
+	// HelmImages lists the images of the rendered manifest of a release
+	HelmImages func(ctx context.Context, releaseName, namespace string) ([]string, error)
+	// HelmPodImages lists the images of the live pods of a release, with the digests pulled
+	HelmPodImages  func(ctx context.Context, releaseName, namespace string) ([]workloads.PodImage, error)
+	ComposeProject func(ctx context.Context, projectName string) (*workloads.ComposeStatus, error)
+	// DockerImages lists the images of the docker engine, with their digests
+	DockerImages func(ctx context.Context) ([]workloads.ImageInfo, error)
+}
+
+// RuntimeInventorySources reads the inventory from the runtimes of the clients, nil clients are not read
+func RuntimeInventorySources(helmClient *workloads.HelmClient, composeClient *workloads.DockerComposeCliClient) InventorySources {
+	var sources InventorySources
+	if helmClient != nil {
+		sources.HelmRelease = helmClient.GetReleaseStatus
+		sources.HelmImages = helmClient.ReleaseImages
+		sources.HelmPodImages = helmClient.ReleasePodImages
+	}
+	if composeClient != nil {
+		sources.ComposeProject = func(ctx context.Context, projectName string) (*workloads.ComposeStatus, error) {
+			return composeClient.GetComposeStatus(ctx, "", projectName)
+		}
+		sources.DockerImages = composeClient.ListImages
+	}
+	return sources
+}
+
+// Inventory lists what runs on the device, the components the runtimes could not tell about carry
+// the errors
+func (a *Agent) Inventory(ctx context.Context) (*Inventory, error) {
+	ctx, cancel := context.WithTimeout(ctx, inventoryTimeout)
+	defer cancel()
+	return buildInventory(ctx, a.database, a.inventorySources, time.Now())
+}
+
+// DumpInventory writes the inventory to the inventory file of the data directory
+func (a *Agent) DumpInventory(ctx context.Context, dataDir string) (string, error) {
+	inventory, err := a.Inventory(ctx)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the inventory: %w", err)
+	}
+	path := filepath.Join(dataDir, inventoryFile)
+	if err := file.WriteFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("failed to write the inventory: %w", err)
+	}
+	return path, nil
+}
+
+func buildInventory(ctx context.Context, db database.DatabaseIfc, sources InventorySources, now time.Time) (*Inventory, error) {
+	settings, err := db.GetDeviceSettings()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the device settings: %w", err)
+	}
+
+	inventory := &Inventory{
+		SchemaVersion: inventorySchemaVersion,
+		GeneratedAt:   now.UTC(),
+		AgentVersion:  version,
+		Deployments:   []InventoryDeployment{},
+	}
+	if settings != nil {
+		inventory.DeviceID = settings.DeviceClientId
+	}
+
+	// the docker images are listed once, they tell the digests of every compose project
+	var dockerImages []workloads.ImageInfo
+	var dockerImagesErr error
+	dockerImagesListed := false
+
+	for _, record := range db.ListDeployments() {
+		if record.CurrentState == nil || record.CurrentState.Status.Status.State == sbi.DeploymentStatusManifestStatusStateRemoved {
+			continue
+		}
+		manifest := record.CurrentState.AppDeploymentManifest
+		deployment := InventoryDeployment{
+			DeploymentID: record.DeploymentID,
+			AppID:        record.AppID,
+			AppVersion:   record.AppVersion,
+			Digest:       record.Digest,
+			ProfileType:  string(manifest.Spec.DeploymentProfile.Type),
+			Phase:        record.Phase,
+			State:        string(record.CurrentState.Status.Status.State),
+			Components:   []InventoryComponent{},
+		}
+
+		for _, component := range manifest.Spec.DeploymentProfile.Components {
+			var inventoried InventoryComponent
+			switch manifest.Spec.DeploymentProfile.Type {
+			case sbi.HelmV3:
+				inventoried = helmInventory(ctx, sources, record.DeploymentID, manifest, component)
+			case sbi.Compose:
+				if !dockerImagesListed && sources.DockerImages != nil {
+					dockerImages, dockerImagesErr = sources.DockerImages(ctx)
+					dockerImagesListed = true
+				}
+				inventoried = composeInventory(ctx, sources, record.DeploymentID, component, dockerImages, dockerImagesErr)
+			default:
+				inventoried = InventoryComponent{Images: []InventoryImage{}}
+				inventoried.Errors = append(inventoried.Errors, fmt.Sprintf("unsupported deployment profile type %s", manifest.Spec.DeploymentProfile.Type))
+			}
+			deployment.Components = append(deployment.Components, inventoried)
+		}
+		inventory.Deployments = append(inventory.Deployments, deployment)
+	}
+
+	sort.Slice(inventory.Deployments, func(i, j int) bool {
+		return inventory.Deployments[i].DeploymentID < inventory.Deployments[j].DeploymentID
+	})
+	return inventory, nil
+}
+
+// helmInventory reads the release of a helm component, its images come from the rendered manifest
+// and their digests from the live pods
+func helmInventory(ctx context.Context, sources InventorySources, deploymentId string, manifest sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item) InventoryComponent {
+	inventoried := InventoryComponent{Images: []InventoryImage{}}
+	helmComp, err := component.AsHelmApplicationDeploymentProfileComponent()
+	if err != nil {
+		inventoried.Errors = append(inventoried.Errors, fmt.Sprintf("invalid helm component: %v", err))
+		return inventoried
+	}
+	inventoried.Name = helmComp.Name
+
+	release := &InventoryHelmRelease{
+		Name:       helmReleaseName(helmComp.Name, deploymentId),
+		Repository: helmComp.Properties.Repository,
+	}
+	if helmComp.Properties.Revision != nil {
+		release.ChartVersion = *helmComp.Properties.Revision
+	}
+	if namespace, err := pkg.GetComponentNamespace(manifest, component); err == nil {
+		release.Namespace = namespace
+	}
+	inventoried.HelmRelease = release
+	if sources.HelmRelease == nil {
+		return inventoried
+	}
+
+	status, err := sources.HelmRelease(ctx, release.Name, release.Namespace)
+	if err != nil {
+		inventoried.Errors = append(inventoried.Errors, fmt.Sprintf("failed to get the release status: %v", err))
+		return inventoried
+	}
+	release.Namespace = status.Namespace
+	release.Revision = status.Revision
+	release.Status = string(status.Status)
+	release.AppVersion = status.AppVersion
+	if status.ChartName != "" {
+		release.Chart = status.ChartName
+		release.ChartVersion = status.ChartVersion
+	}
+
+	// the pods tell the digests, they are matched to the images by reference
+	digests := map[string]string{}
+	var podImages []workloads.PodImage
+	if sources.HelmPodImages != nil {
+		podImages, err = sources.HelmPodImages(ctx, release.Name, release.Namespace)
+		if err != nil {
+			inventoried.Errors = append(inventoried.Errors, fmt.Sprintf("failed to list the images of the pods: %v", err))
+		}
+		for _, podImage := range podImages {
+			if digest := referenceDigest(podImage.ImageID); digest != "" {
+				digests[workloads.NormalizeImageReference(podImage.Image)] = digest
+			}
+		}
+	}
+
+	var references []string
+	if sources.HelmImages != nil {
+		references, err = sources.HelmImages(ctx, release.Name, release.Namespace)
+		if err != nil {
+			inventoried.Errors = append(inventoried.Errors, fmt.Sprintf("failed to list the images of the manifest: %v", err))
+		}
+	}
+	if references == nil {
+		// the rendered manifest could not be read, the live pods run the images all the same
+		for _, podImage := range podImages {
+			references = append(references, podImage.Image)
+		}
+	}
+	inventoried.Images = inventoryImages(references, func(reference string) string {
+		return digests[workloads.NormalizeImageReference(reference)]
+	})
+	return inventoried
+}
+
+// composeInventory reads the project of a compose component, the digests of its images come from
+// the images of the docker engine
+func composeInventory(ctx context.Context, sources InventorySources, deploymentId string, component sbi.AppDeploymentProfile_Components_Item, dockerImages []workloads.ImageInfo, dockerImagesErr error) InventoryComponent {
+	inventoried := InventoryComponent{Images: []InventoryImage{}}
+	composeComp, err := component.AsComposeApplicationDeploymentProfileComponent()
+	if err != nil {
+		inventoried.Errors = append(inventoried.Errors, fmt.Sprintf("invalid compose component: %v", err))
+		return inventoried
+	}
+	inventoried.Name = composeComp.Name
+
+	project := &InventoryComposeProject{Name: composeProjectName(composeComp.Name, deploymentId)}
+	inventoried.ComposeProject = project
+	if sources.ComposeProject == nil {
+		return inventoried
+	}
+
+	status, err := sources.ComposeProject(ctx, project.Name)
+	if err != nil {
+		inventoried.Errors = append(inventoried.Errors, fmt.Sprintf("failed to get the project status: %v", err))
+		return inventoried
+	}
+	project.Status = status.Status
+	if dockerImagesErr != nil {
+		inventoried.Errors = append(inventoried.Errors, fmt.Sprintf("failed to list the docker images: %v", dockerImagesErr))
+	}
+
+	var references []string
+	for _, service := range status.Services {
+		references = append(references, service.Image)
+	}
+	inventoried.Images = inventoryImages(references, func(reference string) string {
+		for _, image := range dockerImages {
+			if image.References(reference) {
+				return imageInfoDigest(image, reference)
+			}
+		}
+		return ""
+	})
+	return inventoried
+}
+
+// inventoryImages parses the references, sorted and without duplicates, digestOf tells the digest
+// of references that do not pin one
+func inventoryImages(references []string, digestOf func(reference string) string) []InventoryImage {
+	seen := map[string]bool{}
+	images := []InventoryImage{}
+	for _, reference := range references {
+		reference = strings.TrimSpace(reference)
+		if reference == "" || seen[reference] {
+			continue
+		}
+		seen[reference] = true
+
+		image := parseImageReference(reference)
+		if image.Digest == "" {
+			image.Digest = digestOf(reference)
+		}
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Reference < images[j].Reference })
+	return images
+}
+
+// parseImageReference splits a reference such as registry:5000/team/app:v1@sha256:... into its
+// repository, tag and digest
+func parseImageReference(reference string) InventoryImage {
+	image := InventoryImage{Reference: reference}
+	name := reference
+	if at := strings.Index(name, "@"); at >= 0 {
+		image.Digest = name[at+1:]
+		name = name[:at]
+	}
+	// a ":" after the last "/" separates the tag, one before it belongs to a registry port
+	if colon := strings.LastIndex(name, ":"); colon > strings.LastIndex(name, "/") {
+		image.Tag = name[colon+1:]
+		name = name[:colon]
+	}
+	image.Repository = name
+	return image
+}
+
+// referenceDigest returns the digest of an image id such as docker-pullable://nginx@sha256:..., an
+// id without a repository digest has none
+func referenceDigest(imageID string) string {
+	if at := strings.LastIndex(imageID, "@"); at >= 0 {
+		return imageID[at+1:]
+	}
+	return ""
+}
+
+// imageInfoDigest returns the repository digest of a docker image, the one of the repository of the
+// reference when the image was pulled from several
+func imageInfoDigest(image workloads.ImageInfo, reference string) string {
+	repository := parseImageReference(workloads.NormalizeImageReference(reference)).Repository
+	for _, repoDigest := range image.RepoDigests {
+		if parseImageReference(workloads.NormalizeImageReference(repoDigest)).Repository == repository {
+			return referenceDigest(repoDigest)
+		}
+	}
+	if len(image.RepoDigests) > 0 {
+		return referenceDigest(image.RepoDigests[0])
+	}
+	return ""
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// inventorySignals is empty, the platform has no SIGUSR1, the inventory is only served on
+// GET /inventory
+var inventorySignals []os.Signal
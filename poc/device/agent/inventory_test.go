@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// updateGolden rewrites the golden files with what the tests produce: go test -run Inventory -update
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+// assertGolden compares the JSON document with testdata/<name>, external tools rely on its shape
+func assertGolden(t *testing.T, name string, document interface{}) {
+	t.Helper()
+	got, err := json.MarshalIndent(document, "", "  ")
+	require.NoError(t, err)
+	got = append(got, '\n')
+
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		require.NoError(t, os.WriteFile(path, got, 0o644))
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(got), "run go test -update to accept the new shape")
+}
+
+// setInventoryDeployment stores a deployment of the manifest whose current state is state
+func setInventoryDeployment(t *testing.T, db *database.Database, deploymentId, profileType, components string, state sbi.DeploymentStatusManifestStatusState) {
+	t.Helper()
+	var manifest sbi.AppDeploymentManifest
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"apiVersion": "application.margo.org/v1alpha1",
+		"kind": "ApplicationDeployment",
+		"metadata": {"name": "inventory"},
+		"spec": {"deploymentProfile": {"type": "`+profileType+`", "components": [`+components+`]}}
+	}`), &manifest))
+	digest := "sha256:" + strings.Repeat(deploymentId[:1], 8)
+	appDeploymentState := database.AppDeploymentState{AppDeploymentManifest: manifest, AppId: "app-" + deploymentId[:4], AppVersion: "1.0.0", Digest: &digest}
+	appDeploymentState.Status.Status.State = state
+	require.NoError(t, db.SetDesiredState(deploymentId, appDeploymentState))
+	db.SetCurrentState(deploymentId, appDeploymentState)
+	db.SetPhase(deploymentId, "RUNNING", "Deployment successful")
+}
+
+func newInventoryTestDatabase(t *testing.T) *database.Database {
+	t.Helper()
+	db := newTestDatabase(t, t.TempDir())
+	require.NoError(t, db.SetDeviceSettings(database.DeviceSettingsRecord{DeviceClientId: "device-42"}))
+
+	setInventoryDeployment(t, db, "1a2b3c4d-0000-4000-8000-000000000001", "helm.v3",
+		`{"name": "digitron", "properties": {"repository": "oci://registry.local/charts/digitron", "revision": "1.2.0"}}`,
+		sbi.DeploymentStatusManifestStatusStateInstalled)
+	setInventoryDeployment(t, db, "2b3c4d5e-0000-4000-8000-000000000002", "compose",
+		`{"name": "shop", "properties": {"packageLocation": "https://registry.local/shop/compose.yaml"}}`,
+		sbi.DeploymentStatusManifestStatusStateInstalled)
+	// the release of this one is gone, the inventory tells so
+	setInventoryDeployment(t, db, "3c4d5e6f-0000-4000-8000-000000000003", "helm.v3",
+		`{"name": "broker", "properties": {"repository": "https://charts.local", "revision": "0.9.1"}}`,
+		sbi.DeploymentStatusManifestStatusStateInstalled)
+	// not running anything
+	setInventoryDeployment(t, db, "4d5e6f70-0000-4000-8000-000000000004", "compose",
+		`{"name": "gone", "properties": {"packageLocation": "https://registry.local/gone/compose.yaml"}}`,
+		sbi.DeploymentStatusManifestStatusStateRemoved)
+	require.NoError(t, db.SetDesiredState("5e6f7081-0000-4000-8000-000000000005", database.AppDeploymentState{}))
+	return db
+}
+
+func inventoryTestSources() InventorySources {
+	return InventorySources{
+		HelmRelease: func(ctx context.Context, releaseName, namespace string) (*workloads.ReleaseStatus, error) {
+			if releaseName != "digitron-1a2b3c4d" {
+				return nil, errors.New("release: not found")
+			}
+			return &workloads.ReleaseStatus{Name: releaseName, Namespace: "edge", Status: release.StatusDeployed,
+				Revision: 3, Chart: "digitron-1.2.0", ChartName: "digitron", ChartVersion: "1.2.0", AppVersion: "1.2"}, nil
+		},
+		HelmImages: func(ctx context.Context, releaseName, namespace string) ([]string, error) {
+			return []string{"registry.local:5000/digitron:1.2.0", "busybox"}, nil
+		},
+		HelmPodImages: func(ctx context.Context, releaseName, namespace string) ([]workloads.PodImage, error) {
+			return []workloads.PodImage{
+				{Pod: "digitron-0", Container: "digitron", Image: "registry.local:5000/digitron:1.2.0",
+					ImageID: "registry.local:5000/digitron@sha256:d1d1d1d1"},
+				{Pod: "digitron-0", Container: "init", Image: "busybox:latest", ImageID: "sha256:b0b0b0b0"},
+			}, nil
+		},
+		ComposeProject: func(ctx context.Context, projectName string) (*workloads.ComposeStatus, error) {
+			return &workloads.ComposeStatus{Name: projectName, Status: "running", Services: []workloads.ServiceStatus{
+				{Name: "web", Image: "nginx:1.25"},
+				{Name: "cache", Image: "redis@sha256:7e7e7e7e"},
+				{Name: "worker", Image: "nginx:1.25"},
+			}}, nil
+		},
+		DockerImages: func(ctx context.Context) ([]workloads.ImageInfo, error) {
+			return []workloads.ImageInfo{
+				{ID: "sha256:5a5a", RepoTags: []string{"nginx:1.25"}, RepoDigests: []string{"mirror.local/nginx@sha256:0f0f0f0f", "nginx@sha256:a1a1a1a1"}},
+			}, nil
+		},
+	}
+}
+
+func TestBuildInventory_Golden(t *testing.T) {
+	db := newInventoryTestDatabase(t)
+	generatedAt := time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)
+
+	inventory, err := buildInventory(context.Background(), db, inventoryTestSources(), generatedAt)
+	require.NoError(t, err)
+
+	assertGolden(t, "inventory.golden.json", inventory)
+}
+
+func TestBuildInventory_WithoutRuntimeSources(t *testing.T) {
+	db := newInventoryTestDatabase(t)
+	generatedAt := time.Date(2026, 10, 16, 8, 30, 0, 0, time.UTC)
+
+	inventory, err := buildInventory(context.Background(), db, InventorySources{}, generatedAt)
+	require.NoError(t, err)
+
+	assertGolden(t, "inventory-without-runtimes.golden.json", inventory)
+}
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		reference string
+		want      InventoryImage
+	}{
+		{"nginx", InventoryImage{Reference: "nginx", Repository: "nginx"}},
+		{"nginx:1.25", InventoryImage{Reference: "nginx:1.25", Repository: "nginx", Tag: "1.25"}},
+		{"registry.local:5000/team/app", InventoryImage{Reference: "registry.local:5000/team/app", Repository: "registry.local:5000/team/app"}},
+		{"registry.local:5000/team/app:v1@sha256:abcd", InventoryImage{Reference: "registry.local:5000/team/app:v1@sha256:abcd",
+			Repository: "registry.local:5000/team/app", Tag: "v1", Digest: "sha256:abcd"}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, parseImageReference(tt.reference), tt.reference)
+	}
+}
+
+func TestAgent_InventoryEndpoint(t *testing.T) {
+	agent, server := newControlTestAgent(t, nil, nil)
+	agent.database = newInventoryTestDatabase(t)
+	agent.inventorySources = inventoryTestSources()
+
+	resp, err := http.Get(server.URL + "/inventory")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var inventory Inventory
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&inventory))
+	assert.Equal(t, "device-42", inventory.DeviceID)
+	assert.Equal(t, version, inventory.AgentVersion)
+	assert.Len(t, inventory.Deployments, 3)
+
+	path, err := agent.DumpInventory(context.Background(), t.TempDir())
+	require.NoError(t, err)
+	dumped, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(dumped), `"schemaVersion": 1`)
+}
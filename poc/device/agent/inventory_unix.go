@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// inventorySignals make the agent dump its inventory
+var inventorySignals = []os.Signal{syscall.SIGUSR1}
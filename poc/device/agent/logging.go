@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// loggerConfig maps the logging section to a zap configuration: the production configuration,
+// JSON at info level unless the section says otherwise
+func loggerConfig(cfg types.LoggingConfig) (zap.Config, error) {
+	level, err := cfg.LogLevel()
+	if err != nil {
+		return zap.Config{}, err
+	}
+
+	zapConfig := zap.NewProductionConfig()
+	zapConfig.Level = zap.NewAtomicLevelAt(level)
+	if cfg.LogEncoding() == types.LogEncodingConsole {
+		zapConfig.Encoding = types.LogEncodingConsole
+		zapConfig.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	}
+	// log collectors parse ISO 8601 timestamps without knowing the epoch format of zap
+	zapConfig.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	return zapConfig, nil
+}
+
+// newLogger builds the agent logger from the logging section
+func newLogger(cfg types.LoggingConfig) (*zap.Logger, error) {
+	zapConfig, err := loggerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return zapConfig.Build()
+}
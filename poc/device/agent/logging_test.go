@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/shared-lib/redact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// buildTestLogger builds the logger of the logging section writing to a file, and returns the file
+func buildTestLogger(t *testing.T, cfg types.LoggingConfig) (*zap.Logger, string) {
+	t.Helper()
+	zapConfig, err := loggerConfig(cfg)
+	require.NoError(t, err)
+	logPath := filepath.Join(t.TempDir(), "agent.log")
+	zapConfig.OutputPaths = []string{logPath}
+	logger, err := zapConfig.Build()
+	require.NoError(t, err)
+	return logger, logPath
+}
+
+func readLogLines(t *testing.T, logger *zap.Logger, logPath string) []string {
+	t.Helper()
+	_ = logger.Sync()
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestNewLogger_FiltersByTheConfiguredLevel(t *testing.T) {
+	logger, logPath := buildTestLogger(t, types.LoggingConfig{Level: "WARN"})
+	logger.Debug("debug line")
+	logger.Info("info line")
+	logger.Warn("warn line")
+	logger.Error("error line")
+
+	lines := readLogLines(t, logger, logPath)
+	require.Len(t, lines, 2)
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry), "the logs are JSON by default")
+	assert.Equal(t, "warn", entry["level"])
+	assert.Equal(t, "warn line", entry["msg"])
+	assert.Contains(t, lines[1], "error line")
+}
+
+func TestNewLogger_DefaultsToJSONAtInfo(t *testing.T) {
+	logger, err := newLogger(types.LoggingConfig{})
+	require.NoError(t, err)
+	assert.False(t, logger.Core().Enabled(zap.DebugLevel))
+	assert.True(t, logger.Core().Enabled(zap.InfoLevel))
+
+	zapConfig, err := loggerConfig(types.LoggingConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, "json", zapConfig.Encoding)
+
+	_, err = newLogger(types.LoggingConfig{Level: "verbose"})
+	assert.ErrorContains(t, err, "logging.level must be debug, info, warn or error")
+}
+
+func TestNewLogger_ConsoleEncoding(t *testing.T) {
+	logger, logPath := buildTestLogger(t, types.LoggingConfig{Level: "debug", Encoding: "console"})
+	logger.Debug("debug line")
+
+	lines := readLogLines(t, logger, logPath)
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], "\tDEBUG\t")
+	assert.False(t, json.Valid([]byte(lines[0])))
+}
+
+func TestPreflightLogger_QuietAboveDebug(t *testing.T) {
+	logger, logPath := buildTestLogger(t, types.LoggingConfig{Level: "info"})
+	redactor, err := redact.New(redact.Config{})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, "https://wfm.local/onboarding", bytes.NewReader([]byte(`{"clientId":"device-1"}`)))
+	require.NoError(t, err)
+	require.NoError(t, PreflightLogger(1000, redactor, logger.Sugar())(context.Background(), req))
+
+	logger.Info("marker")
+	lines := readLogLines(t, logger, logPath)
+	require.Len(t, lines, 1, "only the marker is logged")
+	assert.Contains(t, lines[0], "marker")
+}
@@ -4,24 +4,30 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
-	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/signal"
-	"strings"
+	"path/filepath"
 	"syscall"
 	"time"
 
 	"net/http"
 
+	"github.com/margo/sandbox/poc/device/agent/breaker"
 	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/margo/sandbox/poc/device/agent/hooks"
+	"github.com/margo/sandbox/poc/device/agent/metrics"
 	"github.com/margo/sandbox/poc/device/agent/types"
 	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/margo/sandbox/shared-lib/cache"
 	"github.com/margo/sandbox/shared-lib/crypto"
+	httputils "github.com/margo/sandbox/shared-lib/http"
+	"github.com/margo/sandbox/shared-lib/redact"
 	"github.com/margo/sandbox/shared-lib/workloads"
 	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
 	"go.uber.org/zap"
@@ -40,45 +46,118 @@ type Agent struct {
 	deployer       DeploymentManagerIfc
 	monitor        DeploymentMonitorIfc
 	statusReporter StatusReporterIfc
+	eventHooks     *hooks.Dispatcher
+	// cacheReconciler aligns the wfm client caches with the database
+	cacheReconciler cacheReconciler
+	cacheHealth     *cacheHealth
+	// apiVersion holds the outcome of the api version negotiation, the agent refuses to operate
+	// against a WFM that speaks another major version
+	apiVersion   *apiVersionHealth
+	health       *health.Registry
+	healthServer *http.Server
+	// metrics is exported on its own endpoint, nil when metrics are disabled
+	metrics       *metrics.Prometheus
+	metricsServer *http.Server
+	// runtimeBreakers probe the runtimes and stop work against the ones that are down
+	runtimeBreakers RuntimeBreakers
+	breakersStop    chan struct{}
+	// imageJanitor removes the images deployments stopped using, nil when image GC is disabled
+	imageJanitor *ImageJanitor
+	// requestSigner signs the WFM requests and reloads a rotated key, nil when signing is disabled
+	requestSigner *crypto.ReloadableSigner
+	// capabilityProbes detect the capabilities reported to the WFM, on start and every report interval
+	capabilityProbes CapabilityProbes
+	capabilitiesStop chan struct{}
+	// inventorySources read the helm releases, compose projects and images of the inventory
+	inventorySources InventorySources
+	cacheStatsStop   chan struct{}
 }
 
-func NewAgent(configPath string) (*Agent, error) {
-	logger, _ := zap.NewDevelopment()
-	log := logger.Sugar()
-
+func NewAgent(configPath string, forceProvisioning bool) (*Agent, error) {
 	// Load configuration
 	cfg, err := types.LoadConfig(configPath)
 	if err != nil {
 		return nil, err
 	}
 
+	logger, err := newLogger(cfg.Logging)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the logger: %w", err)
+	}
+	log := logger.Sugar()
+
+	for _, warning := range cfg.Warnings {
+		log.Warnw("Configuration warning", "warning", warning)
+	}
+
+	// The deployments by phase are counted from the database on every scrape
+	var db agentDatabase
+	var recorder metrics.Recorder = metrics.Nop{}
+	var exporter *metrics.Prometheus
+	if cfg.Metrics != nil && cfg.Metrics.Enabled {
+		exporter = metrics.NewPrometheus(func() map[string]int { return deploymentPhases(db) })
+		recorder = exporter
+	}
+
+	// The data directory holds the database, the caches, the compose files and the downloads
+	dataDir := cfg.DataDirectory()
+	if err := ensureWritableDir(dataDir); err != nil {
+		return nil, err
+	}
+
 	// Create database
-	db := database.NewDatabase("data/")
+	db, err = openDatabase(cfg, dataDir, log.With("component", "database"), recorder)
+	if err != nil {
+		return nil, err
+	}
+	log.Infow("Using database backend", "backend", cfg.Database.BackendName())
+
+	// A provisioning file seeds the WFM endpoint and identity on the first boot
+	provisioning, err := applyProvisioning(cfg, db, forceProvisioning, log)
+	if err != nil {
+		return nil, err
+	}
 
 	// Prepare request editors (e.g., request signer) for WFM client
 	clientOptions := []wfm.HTTPApiClientOptions{}
 
-	// Create WFM client using configured URL
+	// Create WFM client using configured URL, it was normalized while loading the config
 	wfmUrl := cfg.Wfm.SbiURL
+	log.Infow("Using WFM southbound url", "sbiUrl", wfmUrl)
 
-	clientOptions = append(clientOptions, sbi.WithRequestEditorFn(PreflightLogger(100, log)))
+	redactor, err := redact.New(cfg.Logging.RedactionConfig())
+	if err != nil {
+		return nil, fmt.Errorf("invalid redaction rules: %w", err)
+	}
+	clientOptions = append(clientOptions, sbi.WithRequestEditorFn(PreflightLogger(100, redactor, log)))
 
 	hasRequestSigningKey := false
+	var requestSigner *crypto.ReloadableSigner
 	// If request signer plugin enabled in the configuration, then create signer object and add it as http client option/RequestEditorFn
 	if cfg.Wfm.ClientPlugins.RequestSigner != nil && cfg.Wfm.ClientPlugins.RequestSigner.Enabled {
 		if cfg.Wfm.ClientPlugins.RequestSigner.KeyRef == nil {
 			return nil, fmt.Errorf("request signer enabled but no keyRef provided in configuration")
 		}
-		// read private key from file
-		signer, err := crypto.NewSignerFromFile(
+		// read private key from file, a rotated key is picked up while the agent runs
+		signerLog := log.With("component", "request-signer", "keyPath", cfg.Wfm.ClientPlugins.RequestSigner.KeyRef.Path)
+		signer, err := crypto.NewReloadableSigner(
 			cfg.Wfm.ClientPlugins.RequestSigner.KeyRef.Path,
 			cfg.Wfm.ClientPlugins.RequestSigner.SignatureAlgo,
 			cfg.Wfm.ClientPlugins.RequestSigner.HashAlgo,
 			cfg.Wfm.ClientPlugins.RequestSigner.SignatureFormat,
+			crypto.WithKeyReloadInterval(time.Duration(cfg.Wfm.ClientPlugins.RequestSigner.ReloadIntervalSeconds)*time.Second),
+			crypto.WithKeyReloadListener(func(keyid string, err error) {
+				if err != nil {
+					signerLog.Errorw("Keeping the request signing key, the changed key file does not load", "keyId", keyid, "error", err)
+					return
+				}
+				signerLog.Infow("Rotated the request signing key", "audit", true, "keyId", keyid)
+			}),
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create request signer: %w", err)
 		}
+		requestSigner = signer
 
 		hasRequestSigningKey = true
 		// adapter to the generated client's RequestEditorFn signature
@@ -86,32 +165,55 @@ func NewAgent(configPath string) (*Agent, error) {
 	}
 
 	hasServerTLSVerificationEnabled := false
-	// If tls plugin is enabled in the configuration, then pass the http tls client option/RequestEditorFn
+	// If tls plugin is enabled in the configuration, the shared http client trusts the configured server ca
+	// and presents the client certificate, if any, to a WFM requiring mutual tls
 	if cfg.Wfm.ClientPlugins.TLSHelper != nil && cfg.Wfm.ClientPlugins.TLSHelper.Enabled {
 		if cfg.Wfm.ClientPlugins.TLSHelper.ServerCAKeyRef == nil {
 			return nil, fmt.Errorf("tls helper plugin is enabled but no caKeyRef is not provided in configuration")
 		}
-
-		// adapter to the generated client's RequestEditorFn signature
-		clientOptions = append(clientOptions, TLSVerifier(&cfg.Wfm.ClientPlugins.TLSHelper.ServerCAKeyRef.Path))
 		hasServerTLSVerificationEnabled = true
 	}
 
-	wfmClient, err := wfm.NewSbiHTTPClient(wfmUrl, clientOptions...)
+	httpClientConfig := cfg.Wfm.HTTPClientConfig()
+	httpClientFactory, err := httputils.NewClientFactory(httpClientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure the WFM http client: %w", err)
+	}
+	// a long-poll sync request is held open by the server for up to the wait, on top of the regular timeout
+	sbiTimeout := httpClientConfig.Timeout
+	if cfg.StateSeeking.LongPoll != nil && cfg.StateSeeking.LongPoll.Enabled {
+		sbiTimeout += time.Duration(cfg.StateSeeking.LongPoll.WaitSeconds) * time.Second
+	}
+	clientOptions = append(clientOptions, wfm.WithHTTPClientFactory(httpClientFactory, sbiTimeout))
+
+	wfmClient, err := wfm.NewSbiHTTPClientWithCacheDir(wfmUrl, filepath.Join(dataDir, "cache"), clientOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create WFM client: %w", err)
 	}
+	wfmClient.SetManifestLimits(cfg.StateSeeking.ManifestLimits())
+	wfmClient.SetCacheLimits(cache.Limits{MaxBytes: cfg.Cache.MaxBytes(), MaxAge: cfg.Cache.MaxAge()})
+	manifestVerifier, err := cfg.Wfm.ManifestVerifier()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the manifest verification key: %w", err)
+	}
+	if manifestVerifier != nil {
+		wfmClient.SetManifestVerifier(manifestVerifier)
+	}
 
 	opts := []Option{}
 	var helmClient *workloads.HelmClient
 	var composeClient *workloads.DockerComposeCliClient
+	var runtimeBreakers RuntimeBreakers
+	var releaseTests *types.HelmReleaseTestsConfig
 	for _, runtime := range cfg.Runtimes {
 		if runtime.Kubernetes != nil {
 			// Create Helm client
-			helmClient, err = workloads.NewHelmClient(runtime.Kubernetes.KubeconfigPath)
+			helmClient, err = workloads.NewHelmClient(runtime.Kubernetes.KubeconfigPath, runtime.Kubernetes.HelmClientOptions()...)
 			if err != nil {
 				return nil, err
 			}
+			runtimeBreakers.Helm = breaker.New(health.ComponentRuntimeHelm, helmClient.Ping, runtime.BreakerConfig())
+			releaseTests = runtime.Kubernetes.ReleaseTests
 			opts = append(opts, WithEnableHelmDeployment())
 		}
 
@@ -121,10 +223,11 @@ func NewAgent(configPath string) (*Agent, error) {
 				ViaSocket: &workloads.DockerConnectionViaSocket{
 					SocketPath: runtime.Docker.Url,
 				},
-			}, "data/composeFiles")
+			}, filepath.Join(dataDir, "composeFiles"), log.With("component", "compose"), runtime.Docker.ComposeClientOptions()...)
 			if err != nil {
 				return nil, err
 			}
+			runtimeBreakers.Compose = breaker.New(health.ComponentRuntimeCompose, composeClient.Ping, runtime.BreakerConfig())
 			opts = append(opts, WithEnableComposeDeployment())
 		}
 	}
@@ -133,6 +236,9 @@ func NewAgent(configPath string) (*Agent, error) {
 	}
 
 	opts = append(opts, WithDeviceRootIdentity(findDeviceRootIdentity(*cfg, log)))
+	if provisioning != nil && provisioning.bootstrapToken != "" {
+		opts = append(opts, WithBootstrapToken(provisioning.bootstrapToken))
+	}
 
 	var deviceSettings *DeviceClientSettings
 	deviceSettings, err = NewDeviceSettings(wfmClient, db, log, opts...)
@@ -145,7 +251,6 @@ func NewAgent(configPath string) (*Agent, error) {
 		return nil, err
 	}
 
-
 	if !isOnboarded {
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
@@ -155,10 +260,35 @@ func NewAgent(configPath string) (*Agent, error) {
 			return nil, fmt.Errorf("'failed to onboard' the device, %s", err.Error())
 		}
 		log.Infow("Device onboarded", "deviceId", deviceId)
+		if err := provisioning.complete(log); err != nil {
+			return nil, err
+		}
 	} else {
 		log.Infow("Device already onboarded, skipping onboarding")
 	}
 
+	// The WFM advertised its api version while onboarding, devices onboarded earlier ask it again
+	apiVersion := &apiVersionHealth{}
+	negotiateCtx, cancelNegotiation := context.WithTimeout(context.Background(), 30*time.Second)
+	apiVersion.check, apiVersion.err = deviceSettings.NegotiateAPIVersion(negotiateCtx)
+	cancelNegotiation()
+	if apiVersion.refused() {
+		log.Errorw("The WFM speaks an incompatible SBI API version, the agent refuses to operate",
+			"agentApiVersion", apiVersion.check.Client, "serverApiVersion", apiVersion.check.Server, "detail", apiVersion.check.Detail)
+	} else if apiVersion.err != nil {
+		// not fatal, a WFM that cannot be asked now is asked again on the next start
+		log.Warnw("API version negotiation failed", "error", apiVersion.err)
+	}
+
+	// Align the wfm client caches with the database before the first sync relies on them
+	cacheSummary, err := reconcileCaches(db, wfmClient, cacheReconcileBudget, log)
+	if err != nil {
+		// not fatal, the client falls back to unconditional fetches for entries it cannot serve
+		log.Warnw("Cache reconciliation failed", "error", err)
+	}
+	cacheHealth := &cacheHealth{}
+	cacheHealth.record(cacheSummary, err)
+
 	// Determine signature/certificate availability from deviceSettings (adapt to new attestation model)
 	hasValidDeviceCertificate := false
 	if deviceSettings != nil {
@@ -175,6 +305,7 @@ func NewAgent(configPath string) (*Agent, error) {
 		"deviceSignatureType", deviceSettings.deviceRootIdentity.IdentityType,
 		"hasValidDeviceCertificate", hasValidDeviceCertificate,
 		"hasServerTLSVerificationEnabled", hasServerTLSVerificationEnabled,
+		"hasClientCertificate", cfg.Wfm.ClientPlugins.TLSHelper.MutualTLS(),
 		"canSignRequests", hasRequestSigningKey,
 		"canDeployHelm", deviceSettings.canDeployHelm,
 		"canDeployCompose", deviceSettings.canDeployCompose,
@@ -183,23 +314,115 @@ func NewAgent(configPath string) (*Agent, error) {
 		"hasClientSecret", len(deviceSettings.oAuthClientSecret) != 0,
 		"hasTokenUrl", len(deviceSettings.oauthTokenUrl) != 0,
 		"tokenBasedAuthDetails", (len(deviceSettings.oauthClientId) != 0) && (len(deviceSettings.oAuthClientSecret) != 0) && (len(deviceSettings.oauthTokenUrl) != 0),
+		"cacheEntriesValidated", cacheSummary.Deployments.Validated+cacheSummary.Bundles.Validated,
+		"cacheEntriesInvalidated", cacheSummary.Deployments.Invalidated+cacheSummary.Bundles.Invalidated,
+		"cacheOrphansRemoved", cacheSummary.Deployments.OrphansRemoved+cacheSummary.Bundles.OrphansRemoved,
+		"agentApiVersion", apiVersion.check.Client,
+		"serverApiVersion", apiVersion.check.Server,
 	)
 
+	// Event hooks see every phase change as it is recorded in the database
+	eventHooks, err := hooks.NewDispatcher(cfg.EventHooks, log.With("component", "event-hooks"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure event hooks: %w", err)
+	}
+	deviceClientId := deviceSettings.deviceClientId
+	db.SubscribeTransitions(func(transition database.DeploymentTransition) {
+		event := hooks.DeploymentEvent(transition)
+		event.DeviceID = deviceClientId
+		eventHooks.Emit(event)
+	})
+	for _, b := range runtimeBreakers.all() {
+		b.OnTransition(func(transition breaker.Transition) {
+			event := hooks.NewEvent(hooks.EventTypeRuntimeAvailable)
+			event.Message = fmt.Sprintf("%s reachable again", transition.Runtime)
+			if transition.To == breaker.StateOpen {
+				log.Warnw("Runtime unavailable, circuit opened", "runtime", transition.Runtime, "error", transition.Err)
+				event = hooks.NewEvent(hooks.EventTypeRuntimeUnavailable)
+				event.Message = fmt.Sprintf("%s unavailable: %v", transition.Runtime, transition.Err)
+			} else {
+				log.Infow("Runtime available, circuit closed", "runtime", transition.Runtime)
+			}
+			event.DeviceID = deviceClientId
+			eventHooks.Emit(event)
+		})
+	}
+
 	// Create components
-	deployer := NewDeploymentManager(db, helmClient, composeClient, log)
-	monitor := NewDeploymentMonitor(db, helmClient, composeClient, log)
-	syncer := NewStateSyncer(db, wfmClient, deviceSettings.deviceClientId, cfg.StateSeeking.Interval, log)
-	statusReporter := NewStatusReporter(db, wfmClient, deviceSettings.deviceClientId, log)
+	deployerOpts := []DeploymentManagerOption{WithDeploymentBreakers(runtimeBreakers), WithRemovalProtection(cfg.RemovalProtection),
+		WithRegistryCredentials(cfg.RegistryCredentials), WithDeploymentMetrics(recorder)}
+	var imageJanitor *ImageJanitor
+	if cfg.ImageGC != nil && cfg.ImageGC.Enabled {
+		janitorOpts := []ImageJanitorOption{WithImageGCEvents(func(event hooks.Event) {
+			event.DeviceID = deviceClientId
+			eventHooks.Emit(event)
+		})}
+		if composeClient != nil {
+			janitorOpts = append(janitorOpts, WithDockerImages(composeClient))
+		}
+		imageJanitor = NewImageJanitor(db, cfg.ImageGC, log.With("component", "image-gc"), janitorOpts...)
+		deployerOpts = append(deployerOpts, WithImageTracking())
+	}
+	if releaseTests != nil && releaseTests.Enabled {
+		// validated with the config
+		timeout, _ := releaseTests.TestTimeout()
+		deployerOpts = append(deployerOpts, WithHelmReleaseTests(timeout))
+	}
+	deployer := NewDeploymentManager(db, helmClient, composeClient, log, deployerOpts...)
+	monitor := NewDeploymentMonitor(db, helmClient, composeClient, log, WithMonitorBreakers(runtimeBreakers))
+	syncerOpts := []StateSyncerOption{
+		WithLongPolling(cfg.StateSeeking.LongPoll), WithSyncEvents(eventHooks.Emit),
+		WithManifestLimits(cfg.StateSeeking.ManifestLimits()), WithSyncBackoff(cfg.StateSeeking.Backoff),
+		WithFetchConcurrency(cfg.StateSeeking.FetchConcurrency), WithBundleFetch(cfg.StateSeeking.Bundle),
+		WithSyncMetrics(recorder), WithBundleDownloadDir(filepath.Join(dataDir, "bundles")),
+	}
+	if manifestVerifier != nil {
+		syncerOpts = append(syncerOpts, WithRequiredManifestSignatures())
+	}
+	bundleVerifier, err := cfg.Wfm.BundleVerifier()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the bundle verification key: %w", err)
+	}
+	if bundleVerifier != nil {
+		syncerOpts = append(syncerOpts, WithBundleVerifier(bundleVerifier))
+	}
+	syncer := NewStateSyncer(db, wfmClient, deviceSettings.deviceClientId, cfg.StateSeeking.Interval, log, syncerOpts...)
+	statusReporter := NewStatusReporter(db, wfmClient, deviceSettings.deviceClientId, log, WithReportMetrics(recorder))
+
+	// Every component judges its own health, the registry aggregates them for the health endpoints
+	healthRegistry := health.NewRegistry(cfg.Health.HealthPolicy())
+	healthRegistry.Register(deviceSettings, syncer, deployer, monitor, statusReporter, db, cacheHealth, apiVersion)
+	// the runtimes are judged by their breakers, which keep probing them in the background
+	for _, b := range runtimeBreakers.all() {
+		healthRegistry.Register(b)
+	}
+	if imageJanitor != nil {
+		healthRegistry.Register(imageJanitor)
+	}
 
 	return &Agent{
-		database:       db,
-		syncer:         syncer,
-		deployer:       deployer,
-		monitor:        monitor,
-		auth:           deviceSettings,
-		statusReporter: statusReporter,
-		log:            log,
-		config:         *cfg,
+		database:         db,
+		syncer:           syncer,
+		deployer:         deployer,
+		monitor:          monitor,
+		auth:             deviceSettings,
+		statusReporter:   statusReporter,
+		eventHooks:       eventHooks,
+		cacheReconciler:  wfmClient,
+		cacheHealth:      cacheHealth,
+		apiVersion:       apiVersion,
+		health:           healthRegistry,
+		metrics:          exporter,
+		runtimeBreakers:  runtimeBreakers,
+		breakersStop:     make(chan struct{}),
+		imageJanitor:     imageJanitor,
+		requestSigner:    requestSigner,
+		capabilityProbes: RuntimeCapabilityProbes(helmClient, composeClient),
+		inventorySources: RuntimeInventorySources(helmClient, composeClient),
+		capabilitiesStop: make(chan struct{}),
+		cacheStatsStop:   make(chan struct{}),
+		log:              log,
+		config:           *cfg,
 	}, nil
 }
 
@@ -207,32 +430,51 @@ func (a *Agent) Start() error {
 	a.log.Info("Starting Agent")
 
 	var deviceId string
-	var err error
+
+	if a.apiVersion.refused() {
+		a.log.Errorw("Refusing to operate against a WFM with an incompatible SBI API version, serving the health endpoints only",
+			"agentApiVersion", a.apiVersion.check.Client, "serverApiVersion", a.apiVersion.check.Server)
+		if a.config.Health != nil && a.config.Health.Enabled {
+			return a.startHealthServer(a.config.Health.HealthListenAddress())
+		}
+		return nil
+	}
 
 	// 1. Onboard device
 	deviceSettings, _ := a.database.GetDeviceSettings()
 	deviceId = deviceSettings.DeviceClientId
 
-	// 2. Report capabilities
-	capabilities, err := types.LoadCapabilities(a.config.Capabilities.ReadFromFile)
-	if err != nil {
-		a.log.Errorw(
-			"failed to load the capabilities file, please resolve the issue as the capabilities will not be reported until next restart",
-			"err",
-			err.Error(),
-		)
-	} else {
-		capabilities.Properties.Id = deviceId
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		a.auth.ReportCapabilities(ctx, *capabilities)
-		cancel()
-	}
+	// 2. Report capabilities, again every interval as disk, memory and runtime versions drift
+	a.reportCapabilities(deviceId)
+	go a.runCapabilityReports(deviceId, a.config.Capabilities.ReportInterval(), a.capabilitiesStop)
 
 	// 3. Start all components
+	a.eventHooks.Start()
+	for _, b := range a.runtimeBreakers.all() {
+		go b.Run(a.breakersStop)
+	}
 	a.statusReporter.Start()
 	a.deployer.Start()
 	a.monitor.Start()
 	a.syncer.Start()
+	go a.runCacheStatsLog(a.config.Cache.StatsInterval(), a.cacheStatsStop)
+	if a.imageJanitor != nil {
+		a.imageJanitor.Start()
+	}
+	if a.requestSigner != nil {
+		a.requestSigner.Start()
+	}
+
+	if a.config.Health != nil && a.config.Health.Enabled {
+		if err := a.startHealthServer(a.config.Health.HealthListenAddress()); err != nil {
+			return err
+		}
+	}
+	if a.metrics != nil {
+		if err := a.startMetricsServer(a.config.Metrics.MetricsListenAddress()); err != nil {
+			return err
+		}
+	}
 
 	hasCfgPubCert := false
 	if a.config.DeviceRootIdentity.HasCertificateReference() {
@@ -248,19 +490,164 @@ func (a *Agent) Start() error {
 	return nil
 }
 
-func (a *Agent) Stop() error {
+// Stop drains the agent: no reconciliation starts anymore, the ones in progress may finish until
+// ctx is done, the last status reports are sent and the database is persisted. Reconciliations still
+// running when ctx is done are marked INTERRUPTED and resumed on the next start.
+func (a *Agent) Stop(ctx context.Context) error {
 	a.log.Info("Stopping Agent")
 
+	if a.healthServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		a.healthServer.Shutdown(ctx)
+		cancel()
+	}
+	if a.metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		a.metricsServer.Shutdown(ctx)
+		cancel()
+	}
+	if a.apiVersion.refused() {
+		// nothing but the health endpoints was started
+		a.log.Info("Agent stopped")
+		return nil
+	}
+
+	close(a.capabilitiesStop)
+	close(a.cacheStatsStop)
 	a.syncer.Stop()
-	a.deployer.Stop()
 	a.monitor.Stop()
+	if abandoned := a.deployer.Drain(ctx); len(abandoned) > 0 {
+		a.log.Warnw("Shutdown drain timed out, abandoned the reconciliations in progress", "deployments", abandoned)
+	}
+	if a.imageJanitor != nil {
+		a.imageJanitor.Stop()
+	}
+	if a.requestSigner != nil {
+		a.requestSigner.Stop()
+	}
+	close(a.breakersStop)
+
+	// the flush gets its own time, a drain that ran out of it still reports the interrupted phases
+	flushCtx, cancel := context.WithTimeout(context.Background(), statusFlushTimeout)
+	if err := a.statusReporter.Flush(flushCtx); err != nil {
+		a.log.Warnw("Stopping before every status report was sent", "error", err)
+	}
+	cancel()
 	a.statusReporter.Stop()
-	a.database.TriggerDataPersist()
+	a.eventHooks.Stop()
 
+	stats := a.eventHooks.Stats()
+	a.log.Infow("Event hook statistics", "emitted", stats.Emitted, "dropped", stats.Dropped,
+		"delivered", stats.Delivered, "failed", stats.Failed)
+
+	if err := a.database.Persist(); err != nil {
+		a.log.Errorw("Failed to persist the database", "error", err)
+		return err
+	}
 	a.log.Info("Agent stopped")
 	return nil
 }
 
+// Health aggregates the health reported by the agent components
+func (a *Agent) Health() health.Summary {
+	return a.health.Check()
+}
+
+func (a *Agent) startHealthServer(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen for health endpoints on %s: %w", address, err)
+	}
+	a.healthServer = &http.Server{
+		Handler:           a.debugHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := a.healthServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			a.log.Errorw("Health endpoints stopped", "error", err)
+		}
+	}()
+	a.log.Infow("Serving health endpoints", "address", listener.Addr().String())
+	return nil
+}
+
+// startMetricsServer serves the metrics and, on /healthz, whether the last sync succeeded within 3x
+// the sync period
+func (a *Agent) startMetricsServer(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the metrics endpoint on %s: %w", address, err)
+	}
+	a.metricsServer = &http.Server{
+		Handler:           a.metrics.Handler(3 * a.config.StateSeeking.SyncPeriod()),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := a.metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			a.log.Errorw("Metrics endpoint stopped", "error", err)
+		}
+	}()
+	a.log.Infow("Serving metrics", "address", listener.Addr().String())
+	return nil
+}
+
+// deploymentPhases counts the deployments of the database by phase
+func deploymentPhases(db database.DatabaseIfc) map[string]int {
+	phases := make(map[string]int)
+	if db == nil {
+		return phases
+	}
+	for _, record := range db.ListDeployments() {
+		phase := record.Phase
+		if phase == "" {
+			phase = "UNKNOWN"
+		}
+		phases[phase]++
+	}
+	return phases
+}
+
+// agentDatabase is a database backend, it reports its health like the other components
+type agentDatabase interface {
+	database.DatabaseIfc
+	health.ComponentHealth
+}
+
+// openDatabase opens the configured database backend in the data directory
+func openDatabase(cfg *types.Config, dataDir string, log *zap.SugaredLogger, recorder metrics.Recorder) (agentDatabase, error) {
+	opts := []database.Option{
+		database.WithDeploymentHistoryRetention(cfg.DeploymentHistory.Retention()),
+		database.WithStateHistoryDepth(cfg.DeploymentHistory.TransitionDepth()),
+		database.WithLogger(log),
+		database.WithPersistObserver(recorder.DatabasePersisted),
+	}
+	if keyFile := cfg.Database.SecretKey(); keyFile != "" {
+		opts = append(opts, database.WithSecretKeyFile(keyFile))
+	}
+	if cfg.Database.BackendName() == types.DatabaseBackendSQLite {
+		db, err := database.NewSQLiteDatabase(dataDir, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the sqlite database: %w", err)
+		}
+		return db, nil
+	}
+	return database.NewDatabase(dataDir, opts...), nil
+}
+
+// ensureWritableDir creates the data directory if needed and makes sure the agent can write to it,
+// a read-only filesystem fails the start instead of the first write
+func ensureWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("data directory %s cannot be created, set dataDir to a writable directory: %w", dir, err)
+	}
+	probe, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("data directory %s is not writable, set dataDir to a writable directory: %w", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
 func findDeviceRootIdentity(cfg types.Config, logger *zap.SugaredLogger) types.DeviceRootIdentity {
 	return cfg.DeviceRootIdentity
 }
@@ -272,6 +659,16 @@ func main() {
 		"poc/device/agent/config/config.yaml", // default value
 		"Path to the YAML configuration file for the Margo device agent",
 	)
+	checkConfigOnly := flag.Bool(
+		"check-config",
+		false,
+		"Validate the configuration and the connectivity to the WFM, then exit",
+	)
+	forceProvisioning := flag.Bool(
+		"force-provisioning",
+		false,
+		"Apply the provisioning file also when the device is already onboarded, it onboards again",
+	)
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nMargo Device Agent\n\n")
@@ -285,7 +682,14 @@ func main() {
 		log.Fatal("--config is mandatory command line argument")
 	}
 
-	agent, err := NewAgent(*configPath)
+	if *checkConfigOnly {
+		if err := checkConfig(*configPath, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	agent, err := NewAgent(*configPath, *forceProvisioning)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -294,36 +698,46 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Wait for shutdown signal
+	// Wait for shutdown signal, SIGUSR1 dumps the inventory into the data directory meanwhile
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	inventoryChan := make(chan os.Signal, 1)
+	if len(inventorySignals) > 0 {
+		signal.Notify(inventoryChan, inventorySignals...)
+	}
+waitForShutdown:
+	for {
+		select {
+		case <-sigChan:
+			break waitForShutdown
+		case <-inventoryChan:
+			if path, err := agent.DumpInventory(context.Background(), agent.config.DataDirectory()); err != nil {
+				agent.log.Errorw("Failed to dump the inventory", "error", err)
+			} else {
+				agent.log.Infow("Dumped the inventory", "path", path)
+			}
+		}
+	}
 
-	agent.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), agent.config.Shutdown.DrainTimeout())
+	err = agent.Stop(ctx)
+	cancel()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-// PreflightLogger returns a RequestEditorFn that logs method, URL, headers (redacted)
-// and a truncated preview of the request body. It restores req.Body so the request
-// remains intact for other editors (e.g. signing) and for sending.
-func PreflightLogger(maxPreviewBytes int, logger *zap.SugaredLogger) func(ctx context.Context, req *http.Request) error {
-	// headers we always redact
-	redact := map[string]struct{}{
-		"authorization":       {},
-		"proxy-authorization": {},
-		"cookie":              {},
-		"set-cookie":          {},
-		"x-auth-token":        {},
-	}
-
-	isTextLike := func(ct string) bool {
-		ct = strings.ToLower(ct)
-		if strings.Contains(ct, "json") || strings.Contains(ct, "xml") || strings.HasPrefix(ct, "text/") {
-			return true
+// PreflightLogger returns a RequestEditorFn that logs method, URL, headers and a truncated preview
+// of the request body, both redacted by the redactor: its body keys are masked at any depth of a
+// JSON body, and a JSON body that cannot be parsed is not shown at all. It restores req.Body so the
+// request remains intact for other editors (e.g. signing) and for sending. The requests are logged
+// at debug level, the body is not even read when the logger does not log it.
+func PreflightLogger(maxPreviewBytes int, redactor *redact.Redactor, logger *zap.SugaredLogger) func(ctx context.Context, req *http.Request) error {
+	return func(ctx context.Context, req *http.Request) error {
+		if !logger.Desugar().Core().Enabled(zap.DebugLevel) {
+			return nil
 		}
-		return false
-	}
 
-	return func(ctx context.Context, req *http.Request) error {
 		// start-line
 		method := req.Method
 		urlStr := ""
@@ -331,18 +745,10 @@ func PreflightLogger(maxPreviewBytes int, logger *zap.SugaredLogger) func(ctx co
 			urlStr = req.URL.String()
 		}
 
-		// headers (redact sensitive)
-		headers := map[string][]string{}
-		for k, vv := range req.Header {
-			kl := strings.ToLower(k)
-			if _, ok := redact[kl]; ok {
-				headers[k] = []string{"[REDACTED]"}
-			} else {
-				headers[k] = vv
-			}
-		}
+		headers := redactor.Headers(req.Header)
+		contentType := req.Header.Get("Content-Type")
 
-		// body preview logic:
+		// body preview logic, the preview is built from the redacted body:
 		var preview string
 		var truncated bool
 		var bodyLen int64 = -1
@@ -352,24 +758,14 @@ func PreflightLogger(maxPreviewBytes int, logger *zap.SugaredLogger) func(ctx co
 			r, err := req.GetBody()
 			if err == nil {
 				defer r.Close()
-				// read up to maxPreviewBytes+1 to detect truncation
-				limited := io.LimitReader(r, int64(maxPreviewBytes)+1)
-				b, _ := io.ReadAll(limited)
+				// the whole body is needed to redact it structurally, bodies above the limit are
+				// only checked heuristically
+				b, _ := io.ReadAll(io.LimitReader(r, redact.MaxParseBytes+1))
 				bodyLen = int64(len(b))
-				if len(b) > maxPreviewBytes {
-					truncated = true
-					b = b[:maxPreviewBytes]
-				}
-				if isTextLike(req.Header.Get("Content-Type")) {
-					preview = string(b)
-				} else {
-					// try to detect small textual content, else base64
-					if http.DetectContentType(b)[:4] == "text" || strings.Contains(strings.ToLower(req.Header.Get("Content-Type")), "json") {
-						preview = string(b)
-					} else {
-						preview = base64.StdEncoding.EncodeToString(b)
-					}
+				if req.ContentLength > 0 {
+					bodyLen = req.ContentLength
 				}
+				preview, truncated = redactor.Preview(b, contentType, maxPreviewBytes)
 			}
 		} else if req.Body != nil {
 			// If ContentLength provided and very large, skip body capture to avoid OOM
@@ -385,26 +781,9 @@ func PreflightLogger(maxPreviewBytes int, logger *zap.SugaredLogger) func(ctx co
 					req.Body = io.NopCloser(bytes.NewReader(nil))
 				} else {
 					bodyLen = int64(len(bodyBytes))
-					// restore body for downstream editors/sender
+					// restore body for downstream editors/sender, redaction works on a copy
 					req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-
-					// build preview (truncate if needed)
-					b := bodyBytes
-					if len(b) > maxPreviewBytes {
-						truncated = true
-						b = b[:maxPreviewBytes]
-					}
-					if isTextLike(req.Header.Get("Content-Type")) {
-						preview = string(b)
-					} else {
-						// detect if it's actually textual
-						detected := http.DetectContentType(b)
-						if strings.HasPrefix(detected, "text/") || strings.Contains(strings.ToLower(req.Header.Get("Content-Type")), "json") {
-							preview = string(b)
-						} else {
-							preview = base64.StdEncoding.EncodeToString(b)
-						}
-					}
+					preview, truncated = redactor.Preview(bodyBytes, contentType, maxPreviewBytes)
 				}
 			}
 		} else {
@@ -421,60 +800,7 @@ func PreflightLogger(maxPreviewBytes int, logger *zap.SugaredLogger) func(ctx co
 			"body_truncated", truncated,
 			"body_len", bodyLen,
 		}
-		logger.Infow("Preflight-http-request", fields...)
+		logger.Debugw("Preflight-http-request", fields...)
 		return nil
 	}
 }
-
-// pass caPath if you want to use some particular ca to verify the certificates
-func TLSVerifier(caPath *string) wfm.HTTPApiClientOptions {
-	// TODO: we should instead create our own http client and then set that into the openapi client
-	// the current way is a slightly longer route to acheive things
-	return func(client *sbi.Client) error {
-		// Validate client
-		if client == nil {
-			return fmt.Errorf("client cannot be nil")
-		}
-
-		// Create TLS config
-		tlsConfig := &tls.Config{}
-
-		// Load and configure custom CA if provided
-		if caPath != nil && *caPath != "" {
-			var err error
-			tlsConfig, err = crypto.LoadCustomCA(*caPath)
-			if err != nil {
-				return err
-			}
-		}
-
-		// Configure HTTP client with TLS
-		return configureClientTLS(client, tlsConfig)
-	}
-}
-
-// Helper function to configure client TLS
-func configureClientTLS(client *sbi.Client, tlsConfig *tls.Config) error {
-	httpClient, ok := client.Client.(*http.Client)
-	if !ok {
-		return fmt.Errorf("client.Client is not *http.Client, cannot configure TLS")
-	}
-
-	// Get or create transport
-	var transport *http.Transport
-	if httpClient.Transport != nil {
-		if existingTransport, ok := httpClient.Transport.(*http.Transport); ok {
-			transport = existingTransport.Clone()
-		} else {
-			transport = &http.Transport{}
-		}
-	} else {
-		transport = &http.Transport{}
-	}
-
-	// Configure TLS
-	transport.TLSClientConfig = tlsConfig
-	httpClient.Transport = transport
-
-	return nil
-}
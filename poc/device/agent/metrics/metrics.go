@@ -0,0 +1,48 @@
+// Package metrics collects the measurements of the agent components and exports them to
+// Prometheus. The components only know the Recorder interface, Nop stands in when metrics are
+// disabled and in tests.
+package metrics
+
+import "time"
+
+// Runtimes of RuntimeOperation
+const (
+	RuntimeHelm    = "helm"
+	RuntimeCompose = "compose"
+)
+
+// Operations of RuntimeOperation
+const (
+	OperationDeploy = "deploy"
+	OperationRemove = "remove"
+)
+
+// Recorder receives the measurements of the agent components, it must be safe for concurrent use
+type Recorder interface {
+	// SyncAttempted counts a sync with the WFM, it ends with one of the other sync calls
+	SyncAttempted()
+	SyncFailed()
+	// SyncNotModified counts a sync the WFM answered with 304 Not Modified, it also succeeded
+	SyncNotModified()
+	SyncSucceeded(at time.Time)
+	// RuntimeOperation measures a deployment or removal on a runtime, err is its outcome
+	RuntimeOperation(runtime, operation string, duration time.Duration, err error)
+	// Reconciled measures a reconciliation of a deployment towards its desired state, e.g. Installed
+	Reconciled(desiredState string, duration time.Duration)
+	// StatusQueueDepth is the number of status reports queued or being sent
+	StatusQueueDepth(depth int64)
+	// DatabasePersisted measures a save of the database, err is its outcome
+	DatabasePersisted(duration time.Duration, err error)
+}
+
+// Nop discards every measurement
+type Nop struct{}
+
+func (Nop) SyncAttempted()                                        {}
+func (Nop) SyncFailed()                                           {}
+func (Nop) SyncNotModified()                                      {}
+func (Nop) SyncSucceeded(time.Time)                               {}
+func (Nop) RuntimeOperation(string, string, time.Duration, error) {}
+func (Nop) Reconciled(string, time.Duration)                      {}
+func (Nop) StatusQueueDepth(int64)                                {}
+func (Nop) DatabasePersisted(time.Duration, error)                {}
@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "margo_agent"
+
+// PhaseCounter returns the number of deployments in every phase, it is called on every scrape
+type PhaseCounter func() map[string]int
+
+// Prometheus records the measurements into a Prometheus registry
+type Prometheus struct {
+	registry *prometheus.Registry
+
+	syncAttempts       prometheus.Counter
+	syncFailures       prometheus.Counter
+	syncNotModified    prometheus.Counter
+	lastSuccess        prometheus.Gauge
+	runtimeDurations   *prometheus.HistogramVec
+	runtimeErrors      *prometheus.CounterVec
+	reconcileDurations *prometheus.HistogramVec
+	statusQueueDepth   prometheus.Gauge
+	persistDurations   prometheus.Histogram
+	persistFailures    prometheus.Counter
+
+	mu              sync.Mutex
+	lastSuccessTime time.Time
+}
+
+// NewPrometheus registers the agent metrics in a new registry, the deployment phases are counted
+// by phases on every scrape
+func NewPrometheus(phases PhaseCounter) *Prometheus {
+	p := &Prometheus{
+		registry: prometheus.NewRegistry(),
+		syncAttempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "sync_attempts_total",
+			Help: "Syncs of the desired state with the WFM.",
+		}),
+		syncFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "sync_failures_total",
+			Help: "Syncs that failed, the desired state was left as it was.",
+		}),
+		syncNotModified: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "sync_not_modified_total",
+			Help: "Syncs the WFM answered with 304 Not Modified.",
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "sync_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful sync.",
+		}),
+		runtimeDurations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "runtime_operation_duration_seconds",
+			Help:    "Duration of the deployments and removals on the helm and compose runtimes.",
+			Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200},
+		}, []string{"runtime", "operation"}),
+		runtimeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "runtime_operation_errors_total",
+			Help: "Deployments and removals that failed on the helm and compose runtimes.",
+		}, []string{"runtime", "operation"}),
+		reconcileDurations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "reconcile_duration_seconds",
+			Help:    "Duration of the reconciliations of the deployments, by desired state.",
+			Buckets: []float64{0.01, 0.1, 1, 5, 15, 30, 60, 120, 300, 600, 1200},
+		}, []string{"desired_state"}),
+		statusQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "status_report_queue_depth",
+			Help: "Status reports queued or being sent to the WFM.",
+		}),
+		persistDurations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "database_persist_duration_seconds",
+			Help:    "Duration of the saves of the agent database.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}),
+		persistFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "database_persist_failures_total",
+			Help: "Saves of the agent database that failed.",
+		}),
+	}
+	p.registry.MustRegister(p.syncAttempts, p.syncFailures, p.syncNotModified, p.lastSuccess,
+		p.runtimeDurations, p.runtimeErrors, p.reconcileDurations, p.statusQueueDepth, p.persistDurations, p.persistFailures)
+	if phases != nil {
+		p.registry.MustRegister(&phaseCollector{phases: phases, desc: prometheus.NewDesc(
+			namespace+"_deployments", "Deployments by phase.", []string{"phase"}, nil)})
+	}
+	return p
+}
+
+func (p *Prometheus) SyncAttempted()   { p.syncAttempts.Inc() }
+func (p *Prometheus) SyncFailed()      { p.syncFailures.Inc() }
+func (p *Prometheus) SyncNotModified() { p.syncNotModified.Inc() }
+
+func (p *Prometheus) SyncSucceeded(at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastSuccessTime = at
+	p.lastSuccess.Set(float64(at.UnixNano()) / 1e9)
+}
+
+func (p *Prometheus) RuntimeOperation(runtime, operation string, duration time.Duration, err error) {
+	p.runtimeDurations.WithLabelValues(runtime, operation).Observe(duration.Seconds())
+	if err != nil {
+		p.runtimeErrors.WithLabelValues(runtime, operation).Inc()
+	}
+}
+
+func (p *Prometheus) Reconciled(desiredState string, duration time.Duration) {
+	p.reconcileDurations.WithLabelValues(desiredState).Observe(duration.Seconds())
+}
+
+func (p *Prometheus) StatusQueueDepth(depth int64) { p.statusQueueDepth.Set(float64(depth)) }
+
+func (p *Prometheus) DatabasePersisted(duration time.Duration, err error) {
+	p.persistDurations.Observe(duration.Seconds())
+	if err != nil {
+		p.persistFailures.Inc()
+	}
+}
+
+// SyncedWithin reports whether the last sync succeeded at most maxAge ago
+func (p *Prometheus) SyncedWithin(maxAge time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.lastSuccessTime.IsZero() && time.Since(p.lastSuccessTime) <= maxAge
+}
+
+// Handler serves the metrics on /metrics and, on /healthz, 200 while the last sync succeeded
+// within maxSyncAge and 503 otherwise
+func (p *Prometheus) Handler(maxSyncAge time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !p.SyncedWithin(maxSyncAge) {
+			http.Error(w, "no successful sync within "+maxSyncAge.String(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// phaseCollector exports the deployment count of every phase as it is when scraped
+type phaseCollector struct {
+	phases PhaseCounter
+	desc   *prometheus.Desc
+}
+
+func (c *phaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *phaseCollector) Collect(ch chan<- prometheus.Metric) {
+	for phase, count := range c.phases() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), phase)
+	}
+}
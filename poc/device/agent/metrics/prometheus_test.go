@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gathered returns the metric families of the registry by name
+func gathered(t *testing.T, p *Prometheus) map[string]*dto.MetricFamily {
+	t.Helper()
+	families, err := p.registry.Gather()
+	require.NoError(t, err)
+	byName := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+func TestPrometheus_RecordsMeasurements(t *testing.T) {
+	p := NewPrometheus(func() map[string]int { return map[string]int{"RUNNING": 2, "FAILED": 1} })
+	p.SyncAttempted()
+	p.SyncAttempted()
+	p.SyncFailed()
+	p.SyncNotModified()
+	p.RuntimeOperation(RuntimeHelm, OperationDeploy, 3*time.Second, nil)
+	p.RuntimeOperation(RuntimeHelm, OperationDeploy, time.Second, errors.New("release failed"))
+	p.Reconciled("Installed", 2*time.Second)
+	p.StatusQueueDepth(4)
+	p.DatabasePersisted(10*time.Millisecond, errors.New("disk full"))
+
+	families := gathered(t, p)
+	assert.Equal(t, 2.0, families["margo_agent_sync_attempts_total"].Metric[0].GetCounter().GetValue())
+	assert.Equal(t, 1.0, families["margo_agent_sync_failures_total"].Metric[0].GetCounter().GetValue())
+	assert.Equal(t, 1.0, families["margo_agent_sync_not_modified_total"].Metric[0].GetCounter().GetValue())
+	assert.Equal(t, uint64(2), families["margo_agent_runtime_operation_duration_seconds"].Metric[0].GetHistogram().GetSampleCount())
+	assert.Equal(t, 1.0, families["margo_agent_runtime_operation_errors_total"].Metric[0].GetCounter().GetValue())
+	assert.Equal(t, uint64(1), families["margo_agent_reconcile_duration_seconds"].Metric[0].GetHistogram().GetSampleCount())
+	assert.Equal(t, 4.0, families["margo_agent_status_report_queue_depth"].Metric[0].GetGauge().GetValue())
+	assert.Equal(t, 1.0, families["margo_agent_database_persist_failures_total"].Metric[0].GetCounter().GetValue())
+
+	phases := map[string]float64{}
+	for _, metric := range families["margo_agent_deployments"].Metric {
+		phases[metric.Label[0].GetValue()] = metric.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"RUNNING": 2, "FAILED": 1}, phases)
+}
+
+func TestPrometheus_HealthzFollowsTheLastSuccessfulSync(t *testing.T) {
+	p := NewPrometheus(nil)
+	handler := p.Handler(time.Minute)
+	healthz := func() int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, healthz(), "no sync succeeded yet")
+	p.SyncSucceeded(time.Now().Add(-2 * time.Minute))
+	assert.Equal(t, http.StatusServiceUnavailable, healthz(), "the last success is too old")
+	p.SyncSucceeded(time.Now())
+	assert.Equal(t, http.StatusOK, healthz())
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "margo_agent_sync_last_success_timestamp_seconds")
+}
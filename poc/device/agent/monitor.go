@@ -4,12 +4,20 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/margo/sandbox/poc/device/agent/breaker"
 	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/health"
 	"github.com/margo/sandbox/shared-lib/workloads"
 	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
-//	"github.com/margo/sandbox/standard/pkg"
+	"github.com/margo/sandbox/standard/pkg"
 	"go.uber.org/zap"
 	"helm.sh/helm/v3/pkg/release"
 )
@@ -25,34 +33,93 @@ type DeploymentMonitor struct {
 	composeClient *workloads.DockerComposeCliClient
 	log           *zap.SugaredLogger
 	stopChan      chan struct{}
+	// startedAt and lastCheckAt are unix nanoseconds, read by the health endpoints
+	startedAt   atomic.Int64
+	lastCheckAt atomic.Int64
+	// breakers keep the monitor away from runtimes that are down
+	breakers RuntimeBreakers
+	// restarts holds the restart observations of the compose containers per deployment id, to
+	// tell flapping services apart
+	restarts sync.Map
 }
 
-func NewDeploymentMonitor(db database.DatabaseIfc, helmClient *workloads.HelmClient, composeClient *workloads.DockerComposeCliClient, log *zap.SugaredLogger) *DeploymentMonitor {
-	return &DeploymentMonitor{
+type DeploymentMonitorOption func(hm *DeploymentMonitor)
+
+// WithMonitorBreakers skips the checks of deployments whose runtime has an open circuit, their
+// last known status is kept until the runtime is reachable again
+func WithMonitorBreakers(breakers RuntimeBreakers) DeploymentMonitorOption {
+	return func(hm *DeploymentMonitor) {
+		hm.breakers = breakers
+	}
+}
+
+const (
+	monitorInterval = 15 * time.Second
+	// monitorStalledAfter is how long the monitor may go without a check before it is degraded
+	monitorStalledAfter = 3 * monitorInterval
+	// composeFailureLogLines is how many of the last log lines of every container are captured
+	// when compose services fail
+	composeFailureLogLines = 20
+	// maxComposeFailureLogs is how much of the end of those logs goes into the failure report
+	maxComposeFailureLogs = 2048
+)
+
+func NewDeploymentMonitor(db database.DatabaseIfc, helmClient *workloads.HelmClient, composeClient *workloads.DockerComposeCliClient, log *zap.SugaredLogger, opts ...DeploymentMonitorOption) *DeploymentMonitor {
+	hm := &DeploymentMonitor{
 		database:      db,
 		helmClient:    helmClient,
 		composeClient: composeClient,
 		log:           log,
 		stopChan:      make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(hm)
+	}
+	return hm
 }
 
 func (hm *DeploymentMonitor) Start() {
+	hm.startedAt.Store(time.Now().UnixNano())
 	go hm.monitorLoop()
 }
 
+func (hm *DeploymentMonitor) Name() string {
+	return health.ComponentMonitor
+}
+
+// Health is degraded when the monitor loop stopped checking, the reported states then go stale
+func (hm *DeploymentMonitor) Health() health.Report {
+	report := health.OK(nil)
+	since := hm.lastCheckAt.Load()
+	if since == 0 {
+		since = hm.startedAt.Load()
+	}
+	if since == 0 {
+		report.Degrade("not started")
+		return report
+	}
+
+	idle := time.Since(time.Unix(0, since))
+	report.Metrics = map[string]float64{"secondsSinceCheck": idle.Seconds()}
+	if idle > monitorStalledAfter {
+		report.Degrade(fmt.Sprintf("no deployment check for %s", idle.Round(time.Second)))
+	}
+	return report
+}
+
 func (hm *DeploymentMonitor) Stop() {
 	close(hm.stopChan)
 }
 
 func (hm *DeploymentMonitor) monitorLoop() {
-	ticker := time.NewTicker(15 * time.Second)
+	ticker := time.NewTicker(monitorInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
 			hm.checkAllDeployments()
+			hm.lastCheckAt.Store(time.Now().UnixNano())
 		case <-hm.stopChan:
 			return
 		}
@@ -63,8 +130,8 @@ func (hm *DeploymentMonitor) checkAllDeployments() {
 	deployments := hm.database.ListDeployments()
 
 	for _, deployment := range deployments {
-		if deployment.Phase == "running" || deployment.Phase == "deploying" {
-			go hm.checkDeployment(deployment.AppID)
+		if strings.EqualFold(deployment.Phase, "running") || strings.EqualFold(deployment.Phase, "deploying") || deployment.Phase == phaseDegraded {
+			go hm.checkDeployment(deployment.DeploymentID)
 		}
 	}
 }
@@ -83,20 +150,70 @@ func (hm *DeploymentMonitor) checkDeployment(appID string) {
         return
     }
 
-    component := appDeployment.Spec.DeploymentProfile.Components[0]
+    if err := hm.breakers.allow(appDeployment.Spec.DeploymentProfile.Type); err != nil {
+        hm.log.Debugw("Skipping deployment check, runtime unavailable", "appID", appID, "error", err)
+        return
+    }
+
+    switch appDeployment.Spec.DeploymentProfile.Type {
+    case sbi.HelmV3:
+        if hm.helmClient != nil {
+            // every component is a release of its own, the deployment is degraded while any of
+            // them is not ready and recovers once the readiness of all of them is known again
+            var problems []string
+            allChecked := true
+            for _, component := range appDeployment.Spec.DeploymentProfile.Components {
+                problem, checked := hm.checkHelmDeployment(record, appDeployment, component)
+                allChecked = allChecked && checked
+                if problem != "" {
+                    problems = append(problems, problem)
+                }
+            }
+            if allChecked || len(problems) > 0 {
+                hm.applyDegradation(record, problems)
+            }
+        }
+    case sbi.Compose:
+        if hm.composeClient != nil {
+            if _, isOneShot := oneShotComponentName(appDeployment); isOneShot {
+                hm.checkComposeDeployment(record, appDeployment)
+            } else if strings.EqualFold(record.Phase, "running") || record.Phase == phaseDegraded {
+                // deployments still being deployed are left to the deployment manager
+                hm.checkComposeHealth(record, appDeployment)
+            }
+        }
+    }
+}
+
+// checkHelmDeployment records the status of the release of a component. Once the release is
+// deployed its workloads must become ready within the wait timeout of the component, the returned
+// problem says why they did not. checked is false when the readiness could not be determined.
+func (hm *DeploymentMonitor) checkHelmDeployment(record *database.DeploymentRecord, appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item) (problem string, checked bool) {
+    appID := record.DeploymentID
     helmComp, err := component.AsHelmApplicationDeploymentProfileComponent()
     if err != nil {
         hm.log.Warnw("Failed to convert component to Helm component", "appID", appID, "error", err)
-        return
+        return "", false
     }
 
     releaseName := fmt.Sprintf("%s-%s", helmComp.Name, appID[:8])
+    namespace, err := pkg.GetComponentNamespace(appDeployment, component)
+    if err != nil {
+        hm.log.Warnw("Failed to determine the namespace of the Helm component", "appID", appID, "error", err)
+        return "", false
+    }
 
     // Get Helm status
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    status, err := hm.helmClient.GetReleaseStatus(ctx, releaseName, "")
+    status, err := hm.helmClient.GetReleaseStatus(ctx, releaseName, namespace)
+    hm.breakers.record(sbi.HelmV3, err)
+    if breaker.IsRuntimeUnavailable(err) {
+        // the release is not known to be failed, only the api server is out of reach
+        hm.log.Warnw("Failed to get Helm release status, runtime unavailable", "appID", appID, "releaseName", releaseName, "error", err)
+        return "", false
+    }
     if err != nil {
         // Release not found or error
         componentStatus := sbi.ComponentStatus{
@@ -106,7 +223,36 @@ func (hm *DeploymentMonitor) checkDeployment(appID string) {
             // Error: &sbi.Error{Message: err.Error()},
         }
         hm.database.SetComponentStatus(appID, helmComp.Name, componentStatus)
-        return
+        return "", false
+    }
+
+    if oneShotName, isOneShot := oneShotComponentName(appDeployment); isOneShot && oneShotName == helmComp.Name && status.Status == release.StatusDeployed {
+        jobs, err := hm.helmClient.GetReleaseJobsState(ctx, releaseName, status.Namespace)
+        if err != nil {
+            hm.log.Warnw("Failed to check the jobs of a one-shot release", "appID", appID, "releaseName", releaseName, "error", err)
+            return "", false
+        }
+        state, message := helmCompletionState(jobs)
+        hm.applyCompletionState(record, helmComp.Name, state, message)
+        return "", false
+    }
+
+    if status.Status == release.StatusDeployed {
+        workloadStatus, err := hm.helmClient.GetReleaseWorkloadStatus(ctx, releaseName, status.Namespace)
+        hm.breakers.record(sbi.HelmV3, err)
+        if err == nil {
+            timeout, err := helmComponentTimeout(helmComp)
+            if err != nil || timeout == 0 {
+                timeout = workloads.DefaultHelmInstallTimeout
+            }
+            componentStatus, problem := helmReadinessStatus(helmComp.Name, workloadStatus, status.LastDeployed, timeout, time.Now())
+            if previous, exists := record.ComponentViseStatus[helmComp.Name]; !exists || !reflect.DeepEqual(previous, componentStatus) {
+                hm.database.SetComponentStatus(appID, helmComp.Name, componentStatus)
+            }
+            return problem, true
+        }
+        // the release status is all there is to report
+        hm.log.Warnw("Failed to get the workload status of a Helm release", "appID", appID, "releaseName", releaseName, "error", err)
     }
 
     // Convert Helm status to component status
@@ -118,6 +264,185 @@ func (hm *DeploymentMonitor) checkDeployment(appID string) {
     }
 
     hm.database.SetComponentStatus(appID, helmComp.Name, componentStatus)
+    return "", false
+}
+
+func (hm *DeploymentMonitor) checkComposeDeployment(record *database.DeploymentRecord, appDeployment sbi.AppDeploymentManifest) {
+    appID := record.DeploymentID
+    composeComp, err := appDeployment.Spec.DeploymentProfile.Components[0].AsComposeApplicationDeploymentProfileComponent()
+    if err != nil {
+        hm.log.Warnw("Failed to convert component to Compose component", "appID", appID, "error", err)
+        return
+    }
+
+    projectName := composeProjectName(composeComp.Name, appID)
+    composeFile := hm.composeClient.ProjectComposeFilePath(projectName)
+    if _, err := os.Stat(composeFile); err != nil {
+        // the compose file was not downloaded, the package location points to it directly
+        composeFile = composeComp.Properties.PackageLocation
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    status, err := hm.composeClient.GetComposeStatus(ctx, composeFile, projectName)
+    hm.breakers.record(sbi.Compose, err)
+    if err != nil {
+        hm.log.Warnw("Failed to get compose project status", "appID", appID, "projectName", projectName, "error", err)
+        return
+    }
+
+    state, message := composeCompletionState(status)
+    if state == completionFailed {
+        // the logs tell why the service failed, they go with the FAILED report
+        if logs := hm.recentComposeLogs(ctx, appID, projectName); logs != "" {
+            message = fmt.Sprintf("%s, recent logs:\n%s", message, logs)
+        }
+    }
+    hm.applyCompletionState(record, composeComp.Name, state, message)
+}
+
+// checkComposeHealth records the status of every service of a long running compose project. A
+// deployment with services that are unhealthy, flapping or failed is degraded until they recover.
+func (hm *DeploymentMonitor) checkComposeHealth(record *database.DeploymentRecord, appDeployment sbi.AppDeploymentManifest) {
+    appID := record.DeploymentID
+    composeComp, err := appDeployment.Spec.DeploymentProfile.Components[0].AsComposeApplicationDeploymentProfileComponent()
+    if err != nil {
+        hm.log.Warnw("Failed to convert component to Compose component", "appID", appID, "error", err)
+        return
+    }
+
+    projectName := composeProjectName(composeComp.Name, appID)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    containers, err := hm.composeClient.GetComposeContainerDetails(ctx, projectName)
+    hm.breakers.record(sbi.Compose, err)
+    if err != nil {
+        hm.log.Warnw("Failed to get compose container details", "appID", appID, "projectName", projectName, "error", err)
+        return
+    }
+
+    now := time.Now()
+    var previous map[string]restartObservation
+    if stored, ok := hm.restarts.Load(appID); ok {
+        previous = stored.(map[string]restartObservation)
+    }
+    observations := observeRestarts(containers, previous, now)
+    hm.restarts.Store(appID, observations)
+
+    statuses, problems := composeServiceStatuses(composeComp.Name, containers, observations, now)
+    if len(problems) > 0 && record.Phase != phaseDegraded {
+        // the degraded report only carries the state of the services, their logs are kept in the agent log
+        var failed []string
+        for _, status := range statuses {
+            if status.State == sbi.ComponentStatusStateFailed {
+                failed = append(failed, strings.TrimPrefix(status.Name, composeComp.Name+"/"))
+            }
+        }
+        hm.log.Warnw("Recent logs of the failed compose services", "appID", appID, "projectName", projectName,
+            "services", failed, "logs", hm.recentComposeLogs(ctx, appID, projectName, failed...))
+    }
+    hm.applyComposeHealth(record, statuses, problems)
+}
+
+// recentComposeLogs returns the end of the last composeFailureLogLines lines every container of the
+// services logged, all services when none are given. Logs that cannot be read are only logged.
+func (hm *DeploymentMonitor) recentComposeLogs(ctx context.Context, appID, projectName string, services ...string) string {
+    logs, err := hm.composeClient.GetComposeLogs(ctx, projectName, workloads.LogOptions{Services: services, Tail: composeFailureLogLines})
+    if err != nil {
+        hm.log.Warnw("Failed to get the compose logs", "appID", appID, "projectName", projectName, "error", err)
+        return ""
+    }
+    defer logs.Close()
+
+    content, err := io.ReadAll(logs)
+    if err != nil {
+        hm.log.Warnw("Failed to read the compose logs", "appID", appID, "projectName", projectName, "error", err)
+        return ""
+    }
+    output := strings.TrimSpace(string(content))
+    if len(output) > maxComposeFailureLogs {
+        output = "..." + strings.ToValidUTF8(output[len(output)-maxComposeFailureLogs:], "")
+    }
+    return output
+}
+
+// applyComposeHealth stores the service statuses that changed and moves the deployment in or out
+// of phaseDegraded. The phase change is what reports the new statuses to the WFM.
+func (hm *DeploymentMonitor) applyComposeHealth(record *database.DeploymentRecord, statuses []sbi.ComponentStatus, problems []string) {
+    appID := record.DeploymentID
+
+    for _, status := range statuses {
+        if previous, exists := record.ComponentViseStatus[status.Name]; exists && reflect.DeepEqual(previous, status) {
+            continue
+        }
+        hm.database.SetComponentStatus(appID, status.Name, status)
+    }
+
+    hm.applyDegradation(record, problems)
+}
+
+// applyDegradation moves the deployment into phaseDegraded while there are problems and back to
+// RUNNING once there are none, record is the deployment as it was before the check
+func (hm *DeploymentMonitor) applyDegradation(record *database.DeploymentRecord, problems []string) {
+    appID := record.DeploymentID
+
+    if len(problems) > 0 {
+        message := "Deployment degraded: " + strings.Join(problems, "; ")
+        // storing a failed service status changes the phase as well, hence the phase is read again
+        current, err := hm.database.GetDeployment(appID)
+        if err == nil && (current.Phase != phaseDegraded || current.Message != message) {
+            hm.database.SetPhase(appID, phaseDegraded, message)
+            hm.log.Warnw("Deployment degraded", "appID", appID, "problems", problems)
+        }
+        return
+    }
+
+    if record.Phase == phaseDegraded {
+        hm.database.SetPhase(appID, "RUNNING", "All services are healthy again")
+        hm.log.Infow("Deployment recovered", "appID", appID)
+    }
+}
+
+// applyCompletionState records the progress of a one-shot component. A successful run is terminal
+// and remembered for the current digest, a failed run goes through the normal failure/retry path.
+func (hm *DeploymentMonitor) applyCompletionState(record *database.DeploymentRecord, componentName string, state completionState, message string) {
+    appID := record.DeploymentID
+
+    switch state {
+    case completionSucceeded:
+        hm.database.SetComponentStatus(appID, componentName, sbi.ComponentStatus{
+            Name:  componentName,
+            State: sbi.ComponentStatusStateInstalled,
+        })
+        hm.database.MarkComponentCompleted(appID, componentName, record.Digest)
+        hm.database.SetPhase(appID, "COMPLETED", fmt.Sprintf("Component %s completed: %s", componentName, message))
+        hm.log.Infow("One-shot component completed", "appID", appID, "component", componentName, "digest", record.Digest)
+
+    case completionFailed:
+        hm.database.SetComponentStatus(appID, componentName, sbi.ComponentStatus{
+            Name:  componentName,
+            State: sbi.ComponentStatusStateFailed,
+            Error: &struct {
+                Code    *string `json:"code,omitempty"`
+                Message *string `json:"message,omitempty"`
+            }{Message: &message},
+        })
+        failedState := *record.CurrentState
+        failedState.Status.Status.State = sbi.DeploymentStatusManifestStatusStateFailed
+        hm.database.SetCurrentState(appID, failedState)
+        hm.database.SetPhase(appID, "FAILED", fmt.Sprintf("Component %s failed: %s", componentName, message))
+        hm.log.Warnw("One-shot component failed", "appID", appID, "component", componentName, "reason", message)
+
+    default:
+        hm.database.SetComponentStatus(appID, componentName, sbi.ComponentStatus{
+            Name:  componentName,
+            State: sbi.ComponentStatusStateInstalling,
+        })
+        hm.log.Debugw("One-shot component still running", "appID", appID, "component", componentName, "progress", message)
+    }
 }
 
 
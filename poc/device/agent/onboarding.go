@@ -3,10 +3,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/health"
 	"github.com/margo/sandbox/poc/device/agent/types"
 	wfm "github.com/margo/sandbox/poc/wfm/cli"
 	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
@@ -25,6 +27,8 @@ type DeviceClientSettings struct {
 	apiClient                                       wfm.SBIAPIClientInterface
 	db                                              database.DatabaseIfc
 	canDeployHelm, canDeployCompose                 bool
+	// bootstrapToken of a provisioned device, presented once while onboarding and never stored
+	bootstrapToken string
 }
 
 type Option = func(auth *DeviceClientSettings)
@@ -62,6 +66,13 @@ func WithDeviceRootIdentity(identity types.DeviceRootIdentity) Option {
 	}
 }
 
+// WithBootstrapToken presents the token of the provisioning file to the WFM while onboarding
+func WithBootstrapToken(token string) Option {
+	return func(settings *DeviceClientSettings) {
+		settings.bootstrapToken = token
+	}
+}
+
 func NewDeviceSettings(client wfm.SBIAPIClientInterface, db database.DatabaseIfc, log *zap.SugaredLogger, opts ...Option) (*DeviceClientSettings, error) {
 	existingRecord, err := db.GetDeviceSettings()
 	if err != nil {
@@ -122,14 +133,23 @@ func NewDeviceSettings(client wfm.SBIAPIClientInterface, db database.DatabaseIfc
 	return settings, nil
 }
 
+// Onboard registers the device with the WFM and stores the client id it was given as onboarded.
+// Onboarding is a single request: the SBI onboarding response carries the client id and no further
+// step, so there is no intermediate state to persist and a restarted agent that is not onboarded
+// yet simply onboards again.
 func (da *DeviceClientSettings) Onboard(ctx context.Context) (deviceClientId string, err error) {
 	devicePubCert, err := da.deviceRootIdentity.PublicCertificatePEM()
 	if err != nil {
 		return "", err
 	}
 
-	da.log.Infow("Starting device onboarding", "hasValidDeviceSignature", len(devicePubCert) != 0)
-	clientId, wfmEndpointsForClient, err := da.apiClient.OnboardDeviceClient(ctx, []byte(devicePubCert))
+	var requestOptions []wfm.HTTPApiClientRequestEditorOptions
+	if da.bootstrapToken != "" {
+		requestOptions = append(requestOptions, wfm.WithBootstrapToken(da.bootstrapToken))
+	}
+
+	da.log.Infow("Starting device onboarding", "hasValidDeviceSignature", len(devicePubCert) != 0, "hasBootstrapToken", da.bootstrapToken != "")
+	clientId, wfmEndpointsForClient, err := da.apiClient.OnboardDeviceClient(ctx, []byte(devicePubCert), requestOptions...)
 	if err != nil {
 		return "", fmt.Errorf("failed to onboard device client: %s", err.Error())
 	}
@@ -140,23 +160,30 @@ func (da *DeviceClientSettings) Onboard(ctx context.Context) (deviceClientId str
 	da.oauthClientId = ""
 	da.oAuthClientSecret = ""
 	da.oauthTokenUrl = ""
+	// the token is spent
+	da.bootstrapToken = ""
 	da.log.Infow("Device onboarding successful", "deviceClientId", da.deviceClientId)
 
-	da.db.SetDeviceSettings(database.DeviceSettingsRecord{
-		DeviceClientId:        da.deviceClientId,
-		DeviceRootIdentity:    da.deviceRootIdentity,
-		State:                 types.DeviceOnboardStateOnboarded,
-		OAuthClientId:         da.oauthClientId,
-		OAuthClientSecret:     da.oAuthClientSecret,
-		OAuthTokenEndpointUrl: da.oauthTokenUrl,
-		AuthEnabled:           da.authEnabled,
-		CanDeployHelm:         da.canDeployHelm,
-		CanDeployCompose:      da.canDeployCompose,
-	})
+	// keep what the record has beyond the onboarding, e.g. the applied provisioning
+	record := database.DeviceSettingsRecord{}
+	if existingRecord, err := da.db.GetDeviceSettings(); err == nil && existingRecord != nil {
+		record = *existingRecord
+	}
+	record.DeviceClientId = da.deviceClientId
+	record.DeviceRootIdentity = da.deviceRootIdentity
+	record.State = types.DeviceOnboardStateOnboarded
+	record.OAuthClientId = da.oauthClientId
+	record.OAuthClientSecret = da.oAuthClientSecret
+	record.OAuthTokenEndpointUrl = da.oauthTokenUrl
+	record.AuthEnabled = da.authEnabled
+	record.CanDeployHelm = da.canDeployHelm
+	record.CanDeployCompose = da.canDeployCompose
+	da.db.SetDeviceSettings(record)
 
 	return da.deviceClientId, nil
 }
 
+// OnboardWithRetries calls Onboard every 5 seconds until it succeeds or the retries are used up
 func (da *DeviceClientSettings) OnboardWithRetries(ctx context.Context, retries uint8) (deviceClientId string, err error) {
 	totalRetries := retries
 	ticker := time.NewTicker(5 * time.Second)
@@ -181,9 +208,50 @@ func (da *DeviceClientSettings) OnboardWithRetries(ctx context.Context, retries
 	return "", fmt.Errorf("unable to onboard the device")
 }
 
+// NegotiateAPIVersion checks the SBI API version of the WFM against the one of the agent and stores
+// both in the device settings. A WFM that speaks another major version is an error, the agent must
+// not operate against it. A newer minor version works but the agent does not use what it added.
+func (da *DeviceClientSettings) NegotiateAPIVersion(ctx context.Context) (wfm.APIVersionCheck, error) {
+	check, err := da.apiClient.NegotiateAPIVersion(ctx)
+	var incompatible *wfm.ErrIncompatibleAPIVersion
+	if err != nil && !errors.As(err, &incompatible) {
+		return check, fmt.Errorf("failed to negotiate the api version: %w", err)
+	}
+
+	record, dbErr := da.db.GetDeviceSettings()
+	if dbErr != nil {
+		return check, fmt.Errorf("failed to get device settings from database, %s", dbErr.Error())
+	}
+	if record != nil {
+		record.AgentAPIVersion = check.Client
+		record.ServerAPIVersion = check.Server
+		if dbErr := da.db.SetDeviceSettings(*record); dbErr != nil {
+			return check, dbErr
+		}
+	}
+
+	switch check.Compatibility {
+	case wfm.APIIncompatible:
+		return check, err
+	case wfm.APIServerNewer:
+		da.log.Warnw("The WFM speaks a newer SBI API version, the agent does not use the features it added",
+			"agentApiVersion", check.Client, "serverApiVersion", check.Server, "detail", check.Detail)
+	case wfm.APIServerOlder, wfm.APIServerUnknown:
+		da.log.Infow("SBI API versions differ", "agentApiVersion", check.Client, "serverApiVersion", check.Server, "detail", check.Detail)
+	default:
+		da.log.Infow("SBI API versions match", "apiVersion", check.Client)
+	}
+	return check, nil
+}
+
 func (da *DeviceClientSettings) ReportCapabilities(ctx context.Context, capabilities sbi.DeviceCapabilitiesManifest) error {
 	da.log.Infow("Starting capabilities reporting", "deviceClientId", da.deviceClientId)
-	err := da.apiClient.ReportCapabilities(ctx, da.deviceClientId, capabilities)
+	var serverAPIVersion string
+	if record, err := da.db.GetDeviceSettings(); err == nil && record != nil {
+		serverAPIVersion = record.ServerAPIVersion
+	}
+	// the agent version travels with every request, the negotiated one tells the WFM how the agent sees it
+	err := da.apiClient.ReportCapabilities(ctx, da.deviceClientId, capabilities, wfm.WithNegotiatedAPIVersion(serverAPIVersion))
 	if err != nil {
 		da.log.Errorw("Failed to report capabilities", "error", err, "deviceClientId", da.deviceClientId)
 		return fmt.Errorf("failed to report capabilities: %w", err)
@@ -197,3 +265,25 @@ func (da *DeviceClientSettings) IsOnboarded() (bool, error) {
 	_, isOnboarded, err := da.db.IsDeviceOnboarded()
 	return isOnboarded, err
 }
+
+func (da *DeviceClientSettings) Name() string {
+	return health.ComponentOnboarding
+}
+
+// Health is unhealthy until the database records the device as onboarded, the agent learns no
+// desired state before
+func (da *DeviceClientSettings) Health() health.Report {
+	report := health.OK(nil)
+	settings, isOnboarded, err := da.db.IsDeviceOnboarded()
+	switch {
+	case err != nil:
+		report.Fail(fmt.Sprintf("the onboarding state cannot be read: %v", err))
+	case !isOnboarded:
+		state := "unknown"
+		if settings != nil && settings.State != "" {
+			state = string(settings.State)
+		}
+		report.Fail(fmt.Sprintf("the device is not onboarded, its state is %s", state))
+	}
+	return report
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/health"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newAPIVersionTestSettings onboards a device against a WFM that advertises the version
+func newAPIVersionTestSettings(t *testing.T, version string) (*DeviceClientSettings, *database.Database) {
+	t.Helper()
+	// the sbi client and database keep their files under a relative data/ directory
+	t.Chdir(t.TempDir())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, wfm.SBIAPIVersion, r.Header.Get(wfm.APIVersionsHeader))
+		w.Header().Set(wfm.ServerAPIVersionHeader, version)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"client_id": "device-1"}`))
+	}))
+	t.Cleanup(server.Close)
+	client, err := wfm.NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+
+	db := newTestDatabase(t, "data")
+	settings, err := NewDeviceSettings(client, db, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	_, err = settings.Onboard(context.Background())
+	require.NoError(t, err)
+	return settings, db
+}
+
+func TestDeviceClientSettings_NegotiateAPIVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    string
+		want       wfm.APICompatibility
+		wantStatus health.Status
+	}{
+		{name: "matching", version: wfm.SBIAPIVersion, want: wfm.APIVersionMatch, wantStatus: health.StatusOK},
+		{name: "newer minor", version: "1.5", want: wfm.APIServerNewer, wantStatus: health.StatusOK},
+		{name: "incompatible major", version: "2.0", want: wfm.APIIncompatible, wantStatus: health.StatusUnhealthy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, db := newAPIVersionTestSettings(t, tt.version)
+
+			check, err := settings.NegotiateAPIVersion(context.Background())
+			assert.Equal(t, tt.want, check.Compatibility)
+			var incompatible *wfm.ErrIncompatibleAPIVersion
+			assert.Equal(t, tt.want == wfm.APIIncompatible, errors.As(err, &incompatible), "error %v", err)
+
+			// both versions are kept, also when the agent refuses to operate
+			record, dbErr := db.GetDeviceSettings()
+			require.NoError(t, dbErr)
+			assert.Equal(t, wfm.SBIAPIVersion, record.AgentAPIVersion)
+			assert.Equal(t, tt.version, record.ServerAPIVersion)
+
+			apiVersion := &apiVersionHealth{check: check, err: err}
+			assert.Equal(t, tt.want == wfm.APIIncompatible, apiVersion.refused())
+			assert.Equal(t, tt.wantStatus, apiVersion.Health().Status)
+		})
+	}
+}
+
+func TestAgent_ReadinessFollowsOnboarding(t *testing.T) {
+	// the sbi client and database keep their files under a relative data/ directory
+	t.Chdir(t.TempDir())
+	wfmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"client_id": "device-1"}`))
+	}))
+	t.Cleanup(wfmServer.Close)
+	client, err := wfm.NewSbiHTTPClient(wfmServer.URL)
+	require.NoError(t, err)
+	settings, err := NewDeviceSettings(client, newTestDatabase(t, "data"), zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	registry := health.NewRegistry(health.DefaultPolicy())
+	registry.Register(settings)
+	agent := &Agent{log: zap.NewNop().Sugar(), health: registry}
+	server := httptest.NewServer(agent.debugHandler())
+	t.Cleanup(server.Close)
+
+	get := func(path string, body interface{}) int {
+		response, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		require.NoError(t, json.NewDecoder(response.Body).Decode(body))
+		return response.StatusCode
+	}
+	var liveness map[string]string
+	var readiness struct {
+		Ready    bool     `json:"ready"`
+		NotReady []string `json:"notReady"`
+	}
+
+	assert.Equal(t, http.StatusOK, get("/healthz", &liveness), "a device that is not onboarded is alive")
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz", &readiness))
+	assert.False(t, readiness.Ready)
+	assert.Equal(t, []string{health.ComponentOnboarding}, readiness.NotReady)
+
+	_, err = settings.Onboard(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, get("/healthz", &liveness))
+	readiness.NotReady = nil
+	assert.Equal(t, http.StatusOK, get("/readyz", &readiness))
+	assert.True(t, readiness.Ready)
+	assert.Empty(t, readiness.NotReady)
+}
+
+func TestAgent_RefusesToOperateWithIncompatibleAPIVersion(t *testing.T) {
+	check, err := wfm.CheckAPIVersion("SBI", wfm.SBIAPIVersion, "2.0")
+	require.Error(t, err)
+	registry := health.NewRegistry(health.DefaultPolicy())
+	apiVersion := &apiVersionHealth{check: check, err: err}
+	registry.Register(apiVersion)
+
+	// no component is set, starting or stopping any of them would panic
+	agent := &Agent{log: zap.NewNop().Sugar(), apiVersion: apiVersion, health: registry}
+	require.NoError(t, agent.Start())
+	require.NoError(t, agent.Stop(context.Background()))
+
+	summary := agent.Health()
+	assert.False(t, summary.Ready)
+	assert.Equal(t, []string{health.ComponentAPIVersion}, summary.NotReady())
+}
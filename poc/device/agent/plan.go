@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/margo/sandbox/standard/pkg"
+)
+
+// What the reconciliation of a deployment or a component would do, see PlanReconciliation
+const (
+	PlanActionInstall = "install"
+	PlanActionUpgrade = "upgrade"
+	PlanActionRemove  = "remove"
+	PlanActionNone    = "none"
+)
+
+// planTimeout bounds the dry runs of a plan, the plan holds the lock of the deployment meanwhile
+const planTimeout = 2 * time.Minute
+
+// errReconcileInProgress is returned by PlanReconciliation while the deployment is reconciled
+var errReconcileInProgress = errors.New("reconciliation in progress")
+
+// ReconcilePlan is what the next reconciliation of a deployment would do
+type ReconcilePlan struct {
+	DeploymentID string                                  `json:"deploymentId"`
+	DesiredState sbi.DeploymentStatusManifestStatusState `json:"desiredState"`
+	CurrentState sbi.DeploymentStatusManifestStatusState `json:"currentState"`
+	// Action is one of the PlanAction* actions, an upgrade when any component is upgraded
+	Action      string                       `json:"action"`
+	Reason      string                       `json:"reason,omitempty"`
+	ProfileType sbi.AppDeploymentProfileType `json:"profileType,omitempty"`
+	Components  []ComponentPlan              `json:"components,omitempty"`
+}
+
+// ComponentPlan is what the reconciliation would do to one component, the release or the project
+type ComponentPlan struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// HelmRelease and Namespace are set for helm components, ComposeProject for compose ones
+	HelmRelease    string        `json:"helmRelease,omitempty"`
+	Namespace      string        `json:"namespace,omitempty"`
+	ComposeProject string        `json:"composeProject,omitempty"`
+	ValueChanges   []ValueChange `json:"valueChanges,omitempty"`
+	// Manifest is what the dry run of the helm install renders
+	Manifest string `json:"manifest,omitempty"`
+	// Services tells which services of the compose project would be created, recreated or removed
+	Services []workloads.ComposeServiceChange `json:"services,omitempty"`
+	// Error tells why the dry run of the component failed, the real reconciliation would likely fail
+	// the same way
+	Error string `json:"error,omitempty"`
+}
+
+// ValueChange is a parameter of a component whose value differs from the deployed one
+type ValueChange struct {
+	Parameter string `json:"parameter"`
+	// Pointers are the targets of the parameter in the component
+	Pointers []string    `json:"pointers"`
+	Current  interface{} `json:"current,omitempty"`
+	Desired  interface{} `json:"desired,omitempty"`
+}
+
+// PlanReconciliation tells what reconciling the deployment would do without changing anything. The
+// helm components are rendered by a dry run install, the compose files are compared with the
+// containers of their project. The plan holds the lock of the deployment like a reconciliation, it
+// is refused while one is in progress.
+//
+// Returns:
+//   - *ReconcilePlan: The action for the deployment and each of its components
+//   - error: errUnknownDeployment, errReconcileInProgress, or an error while the agent is stopping
+func (dm *DeploymentManager) PlanReconciliation(deploymentId string) (*ReconcilePlan, error) {
+	if _, err := dm.database.GetDeployment(deploymentId); err != nil {
+		return nil, fmt.Errorf("%w %s", errUnknownDeployment, deploymentId)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), planTimeout)
+	defer cancel()
+
+	// the plan is not recorded as an operation, it only takes the lock
+	run := dm.operations.start(deploymentId, cancel)
+	if _, loaded := dm.reconcileLocks.LoadOrStore(deploymentId, run); loaded {
+		return nil, fmt.Errorf("%w for deployment %s", errReconcileInProgress, deploymentId)
+	}
+	defer dm.reconcileLocks.CompareAndDelete(deploymentId, run)
+	if dm.draining.Load() {
+		return nil, fmt.Errorf("agent is stopping")
+	}
+
+	// read again under the lock, a reconciliation may have finished in between
+	record, err := dm.database.GetDeployment(deploymentId)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s", errUnknownDeployment, deploymentId)
+	}
+	plan := &ReconcilePlan{DeploymentID: deploymentId, Action: PlanActionNone}
+	if record.DesiredState == nil {
+		plan.Reason = "no desired state"
+		return plan, nil
+	}
+	plan.DesiredState = record.DesiredState.Status.Status.State
+	plan.CurrentState = sbi.DeploymentStatusManifestStatusStatePending
+	if record.CurrentState != nil {
+		plan.CurrentState = record.CurrentState.Status.Status.State
+	}
+	plan.ProfileType = record.DesiredState.AppDeploymentManifest.Spec.DeploymentProfile.Type
+
+	// the same decisions as reconcileDeployment
+	switch plan.DesiredState {
+	case sbi.DeploymentStatusManifestStatusStatePending, sbi.DeploymentStatusManifestStatusStateInstalling,
+		sbi.DeploymentStatusManifestStatusStateInstalled:
+		if plan.CurrentState == sbi.DeploymentStatusManifestStatusStateInstalled {
+			plan.Reason = "already installed"
+			return plan, nil
+		}
+		dm.planDeploy(ctx, record, plan)
+
+	case sbi.DeploymentStatusManifestStatusStateRemoving:
+		if plan.CurrentState == sbi.DeploymentStatusManifestStatusStateRemoved {
+			plan.Reason = "already removed"
+			return plan, nil
+		}
+		dm.planRemove(record, plan)
+
+	case sbi.DeploymentStatusManifestStatusStateRemoved:
+		plan.Reason = "already removed"
+
+	case sbi.DeploymentStatusManifestStatusStateFailed:
+		plan.Reason = "desired state is failed"
+
+	default:
+		plan.Reason = fmt.Sprintf("unknown desired state %s", plan.DesiredState)
+	}
+	return plan, nil
+}
+
+// planDeploy plans the install or upgrade of every component
+func (dm *DeploymentManager) planDeploy(ctx context.Context, record *database.DeploymentRecord, plan *ReconcilePlan) {
+	if len(record.DesiredState.Dependencies) > 0 {
+		unmet, err := unmetDependencies(record, dm.database.ListDeployments())
+		switch {
+		case err != nil:
+			plan.Reason = err.Error()
+			return
+		case len(unmet) > 0:
+			plan.Reason = fmt.Sprintf("waiting for dependencies: %s", strings.Join(unmet, "; "))
+			return
+		}
+	}
+
+	appDeployment := record.DesiredState.AppDeploymentManifest
+	if len(appDeployment.Spec.DeploymentProfile.Components) == 0 {
+		plan.Reason = "no components found"
+		return
+	}
+	if err := dm.breakers.allow(plan.ProfileType); err != nil {
+		plan.Reason = err.Error()
+		return
+	}
+
+	var current *sbi.AppDeploymentManifest
+	if record.CurrentState != nil {
+		current = &record.CurrentState.AppDeploymentManifest
+	}
+	plan.Action = PlanActionInstall
+	for _, component := range appDeployment.Spec.DeploymentProfile.Components {
+		componentPlan := ComponentPlan{Name: componentName(component), Action: PlanActionInstall}
+		componentPlan.ValueChanges = valueChanges(current, appDeployment, componentPlan.Name)
+
+		var err error
+		switch plan.ProfileType {
+		case sbi.HelmV3:
+			err = dm.planHelm(ctx, record.DeploymentID, appDeployment, component, &componentPlan)
+		case sbi.Compose:
+			err = dm.planCompose(ctx, record.DeploymentID, appDeployment, component, &componentPlan)
+		default:
+			err = fmt.Errorf("unsupported deployment type: %s", plan.ProfileType)
+		}
+		if err != nil {
+			componentPlan.Error = err.Error()
+		}
+		if componentPlan.Action == PlanActionUpgrade {
+			plan.Action = PlanActionUpgrade
+		}
+		plan.Components = append(plan.Components, componentPlan)
+	}
+}
+
+// planRemove names the releases or projects the removal would delete
+func (dm *DeploymentManager) planRemove(record *database.DeploymentRecord, plan *ReconcilePlan) {
+	if record.RemovalProtected {
+		if _, forced := dm.forcedRemovals.Load(record.DeploymentID); !forced {
+			plan.Reason = "removal of a protected deployment is blocked"
+			return
+		}
+	}
+	if dependents := dependentsOf(record, dm.database.ListDeployments()); len(dependents) > 0 {
+		if _, forced := dm.forcedRemovals.Load(record.DeploymentID); !forced {
+			plan.Reason = fmt.Sprintf("application %s is still required by %s", record.AppID, strings.Join(dependents, ", "))
+			return
+		}
+	}
+
+	appDeployment := record.DesiredState.AppDeploymentManifest
+	plan.Action = PlanActionRemove
+	for _, component := range appDeployment.Spec.DeploymentProfile.Components {
+		componentPlan := ComponentPlan{Name: componentName(component), Action: PlanActionRemove}
+		switch plan.ProfileType {
+		case sbi.HelmV3:
+			componentPlan.HelmRelease = helmReleaseName(componentPlan.Name, record.DeploymentID)
+			if namespace, err := pkg.GetComponentNamespace(appDeployment, component); err != nil {
+				componentPlan.Error = err.Error()
+			} else {
+				componentPlan.Namespace = namespace
+			}
+		case sbi.Compose:
+			componentPlan.ComposeProject = composeProjectName(componentPlan.Name, record.DeploymentID)
+		}
+		plan.Components = append(plan.Components, componentPlan)
+	}
+}
+
+// planHelm renders the chart of the component with a dry run install, an existing release is
+// upgraded
+func (dm *DeploymentManager) planHelm(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item, componentPlan *ComponentPlan) error {
+	helmComp, err := component.AsHelmApplicationDeploymentProfileComponent()
+	if err != nil {
+		return fmt.Errorf("invalid helm component: %v", err)
+	}
+	componentPlan.HelmRelease = helmReleaseName(helmComp.Name, deploymentId)
+	componentPlan.Namespace, err = pkg.GetComponentNamespace(appDeployment, component)
+	if err != nil {
+		return err
+	}
+	if dm.helmClient == nil {
+		return fmt.Errorf("Helm client not initialized (device may not support Helm deployments)")
+	}
+
+	if release, err := dm.helmClient.GetReleaseStatus(ctx, componentPlan.HelmRelease, componentPlan.Namespace); err == nil && release != nil {
+		componentPlan.Action = PlanActionUpgrade
+	}
+
+	// the values deployOrUpdateHelm installs with
+	values := map[string]interface{}{}
+	if appDeployment.Spec.Parameters != nil {
+		componentValues, _ := pkg.ConvertAllAppDeploymentParamsToValues(*appDeployment.Spec.Parameters)
+		if componentValues[helmComp.Name] != nil {
+			values = componentValues[helmComp.Name]
+		}
+	}
+	values["fullnameOverride"] = componentPlan.HelmRelease
+	revision := "latest"
+	if helmComp.Properties.Revision != nil {
+		revision = *helmComp.Properties.Revision
+	}
+
+	componentPlan.Manifest, err = dm.helmClient.InstallChartWithDryRun(ctx, componentPlan.HelmRelease, helmComp.Properties.Repository, componentPlan.Namespace, revision, values)
+	return err
+}
+
+// planCompose compares the compose file of the component with the containers of its project. The
+// file is downloaded next to the one of the project, which stays as it is.
+func (dm *DeploymentManager) planCompose(ctx context.Context, deploymentId string, appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item, componentPlan *ComponentPlan) error {
+	composeComp, err := component.AsComposeApplicationDeploymentProfileComponent()
+	if err != nil {
+		return fmt.Errorf("invalid compose component %v", err)
+	}
+	componentPlan.ComposeProject = composeProjectName(composeComp.Name, deploymentId)
+	if dm.composeClient == nil {
+		return fmt.Errorf("Docker Compose client not initialized (device may not support Compose deployments)")
+	}
+
+	planDir := componentPlan.ComposeProject + ".plan"
+	composeFilename, err := dm.composeClient.DownloadCompose(ctx, composeComp.Properties.PackageLocation, composeComp.Properties.KeyLocation, planDir)
+	if err != nil {
+		return fmt.Errorf("failed to get compose content: %v", err)
+	}
+	if filepath.Base(filepath.Dir(composeFilename)) == planDir {
+		defer os.RemoveAll(filepath.Dir(composeFilename))
+	}
+
+	var values map[string]interface{}
+	if appDeployment.Spec.Parameters != nil {
+		componentValues, _ := pkg.ConvertAllAppDeploymentParamsToValues(*appDeployment.Spec.Parameters)
+		values = componentValues[composeComp.Name]
+	}
+	envVars := dm.convertParametersToEnvVars(values, composeComp.Name)
+
+	componentPlan.Services, err = dm.composeClient.ComposeConfigDiff(ctx, composeFilename, componentPlan.ComposeProject, envVars)
+	if err != nil {
+		return err
+	}
+	for _, service := range componentPlan.Services {
+		if service.Action != workloads.ComposeServiceCreate {
+			componentPlan.Action = PlanActionUpgrade
+			break
+		}
+	}
+	return nil
+}
+
+// valueChanges returns the parameters targeting the component whose desired value differs from the
+// deployed one, sorted by parameter. Without a deployed manifest every parameter is a change.
+func valueChanges(current *sbi.AppDeploymentManifest, desired sbi.AppDeploymentManifest, component string) []ValueChange {
+	currentParams := sbi.AppDeploymentParams{}
+	if current != nil && current.Spec.Parameters != nil {
+		currentParams = *current.Spec.Parameters
+	}
+	desiredParams := sbi.AppDeploymentParams{}
+	if desired.Spec.Parameters != nil {
+		desiredParams = *desired.Spec.Parameters
+	}
+
+	names := map[string]bool{}
+	for name := range currentParams {
+		names[name] = true
+	}
+	for name := range desiredParams {
+		names[name] = true
+	}
+
+	var changes []ValueChange
+	for name := range names {
+		pointers := componentPointers(desiredParams[name], component)
+		if len(pointers) == 0 {
+			pointers = componentPointers(currentParams[name], component)
+		}
+		if len(pointers) == 0 {
+			continue
+		}
+		currentValue, currentErr := normalizedJSON(currentParams[name].Value)
+		desiredValue, desiredErr := normalizedJSON(desiredParams[name].Value)
+		if currentErr == nil && desiredErr == nil && reflect.DeepEqual(currentValue, desiredValue) {
+			continue
+		}
+		changes = append(changes, ValueChange{
+			Parameter: name,
+			Pointers:  pointers,
+			Current:   currentParams[name].Value,
+			Desired:   desiredParams[name].Value,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Parameter < changes[j].Parameter })
+	return changes
+}
+
+// componentPointers returns the pointers of the targets of the parameter in the component
+func componentPointers(parameter sbi.AppParameterValue, component string) []string {
+	var pointers []string
+	for _, target := range parameter.Targets {
+		for _, name := range target.Components {
+			if name == component {
+				pointers = append(pointers, target.Pointer)
+				break
+			}
+		}
+	}
+	return pointers
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// setPlanStates stores the desired and, unless currentState is empty, the current state of a
+// deployment of the manifest
+func setPlanStates(t *testing.T, db *database.Database, deploymentId string, desired sbi.AppDeploymentManifest, desiredState sbi.DeploymentStatusManifestStatusState, current sbi.AppDeploymentManifest, currentState sbi.DeploymentStatusManifestStatusState) {
+	t.Helper()
+	desiredRecord := database.AppDeploymentState{AppDeploymentManifest: desired}
+	desiredRecord.Status.Status.State = desiredState
+	require.NoError(t, db.SetDesiredState(deploymentId, desiredRecord))
+	if currentState != "" {
+		currentRecord := database.AppDeploymentState{AppDeploymentManifest: current}
+		currentRecord.Status.Status.State = currentState
+		db.SetCurrentState(deploymentId, currentRecord)
+	}
+}
+
+func TestPlanReconciliation_Compose(t *testing.T) {
+	dir := t.TempDir()
+	callLog := filepath.Join(dir, "calls")
+	script := `#!/bin/sh
+echo "$*" >> "` + callLog + `"
+case "$*" in
+	*" config --hash "*) echo "digitron 3c1a"; echo "cache 9f20" ;;
+	"ps -a --filter "*) echo "digitron 51e0" ;;
+esac
+exit 0
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	composeClient, err := workloads.NewDockerComposeCliClient(workloads.DockerConnectivityParams{}, filepath.Join(dir, "compose"), nil)
+	require.NoError(t, err)
+	composeFile := filepath.Join(dir, "docker-compose.yaml")
+	require.NoError(t, os.WriteFile(composeFile, []byte("services: {digitron: {image: digitron:1.2.0}, cache: {image: redis}}"), 0o644))
+
+	compose := []string{`"helm.v3"`, `"compose"`,
+		`"properties": {"repository": "oci://registry.local/charts/digitron", "revision": "1.2.0"}`, `"properties": {"packageLocation": "` + composeFile + `"}`}
+	deployed := changeManifest(t, compose...)
+	desired := changeManifest(t, append(compose, `"value": "hello"`, `"value": "bonjour"`)...)
+	db := newTestDatabase(t, t.TempDir())
+	setPlanStates(t, db, "deployment-plan", desired, sbi.DeploymentStatusManifestStatusStateInstalling, deployed, sbi.DeploymentStatusManifestStatusStateFailed)
+	dm := NewDeploymentManager(db, nil, composeClient, zap.NewNop().Sugar())
+
+	plan, err := dm.PlanReconciliation("deployment-plan")
+	require.NoError(t, err)
+
+	assert.Equal(t, PlanActionUpgrade, plan.Action)
+	assert.Equal(t, sbi.Compose, plan.ProfileType)
+	require.Len(t, plan.Components, 1)
+	component := plan.Components[0]
+	assert.Empty(t, component.Error)
+	assert.Equal(t, "digitron-deployme", component.ComposeProject)
+	assert.Equal(t, []workloads.ComposeServiceChange{
+		{Service: "cache", Action: workloads.ComposeServiceCreate},
+		{Service: "digitron", Action: workloads.ComposeServiceRecreate},
+	}, component.Services)
+	assert.Equal(t, []ValueChange{{Parameter: "greeting", Pointers: []string{"settings.greeting"}, Current: "hello", Desired: "bonjour"}}, component.ValueChanges)
+
+	// nothing was deployed, the deployment is unlocked and its phase untouched
+	calls, err := os.ReadFile(callLog)
+	require.NoError(t, err)
+	assert.NotContains(t, string(calls), " up ")
+	_, locked := dm.reconcileLocks.Load("deployment-plan")
+	assert.False(t, locked)
+	record, err := db.GetDeployment("deployment-plan")
+	require.NoError(t, err)
+	assert.NotEqual(t, "DEPLOYING", record.Phase)
+	assert.Empty(t, dm.Operations())
+}
+
+func TestPlanReconciliation_Remove(t *testing.T) {
+	manifest := changeManifest(t)
+	db := newTestDatabase(t, t.TempDir())
+	setPlanStates(t, db, "deployment-plan", manifest, sbi.DeploymentStatusManifestStatusStateRemoving, manifest, sbi.DeploymentStatusManifestStatusStateInstalled)
+	dm := NewDeploymentManager(db, nil, nil, zap.NewNop().Sugar())
+
+	plan, err := dm.PlanReconciliation("deployment-plan")
+	require.NoError(t, err)
+
+	assert.Equal(t, PlanActionRemove, plan.Action)
+	assert.Equal(t, []ComponentPlan{{Name: "digitron", Action: PlanActionRemove, HelmRelease: helmReleaseName("digitron", "deployment-plan")}}, plan.Components)
+}
+
+func TestPlanReconciliation_NothingToDo(t *testing.T) {
+	manifest := changeManifest(t)
+	db := newTestDatabase(t, t.TempDir())
+	setPlanStates(t, db, "deployment-plan", manifest, sbi.DeploymentStatusManifestStatusStateInstalled, manifest, sbi.DeploymentStatusManifestStatusStateInstalled)
+	dm := NewDeploymentManager(db, nil, nil, zap.NewNop().Sugar())
+
+	plan, err := dm.PlanReconciliation("deployment-plan")
+	require.NoError(t, err)
+
+	assert.Equal(t, PlanActionNone, plan.Action)
+	assert.Equal(t, "already installed", plan.Reason)
+	assert.Empty(t, plan.Components)
+}
+
+func TestPlanReconciliation_RefusedWhileReconciling(t *testing.T) {
+	manifest := changeManifest(t)
+	db := newTestDatabase(t, t.TempDir())
+	setPlanStates(t, db, "deployment-plan", manifest, sbi.DeploymentStatusManifestStatusStateInstalling, manifest, "")
+	dm := NewDeploymentManager(db, nil, nil, zap.NewNop().Sugar())
+
+	run := &reconcileRun{deploymentId: "deployment-plan"}
+	dm.reconcileLocks.Store("deployment-plan", run)
+	_, err := dm.PlanReconciliation("deployment-plan")
+	assert.ErrorIs(t, err, errReconcileInProgress)
+	lock, _ := dm.reconcileLocks.Load("deployment-plan")
+	assert.Same(t, run, lock, "the lock of the reconciliation is kept")
+
+	_, err = dm.PlanReconciliation("deployment-unknown")
+	assert.ErrorIs(t, err, errUnknownDeployment)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/margo/sandbox/shared-lib/redact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestPreflightLogger_RedactsWithoutModifyingTheRequest(t *testing.T) {
+	body := `{"clientId":"device-1","credentials":[{"clientSecret":"s3cr3t"}]}`
+	redactor, err := redact.New(redact.Config{Headers: []string{"X-Tenant-Token"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		newRequest func() *http.Request
+	}{
+		{
+			name: "body with GetBody",
+			newRequest: func() *http.Request {
+				req, err := http.NewRequest(http.MethodPost, "https://wfm.local/onboarding", bytes.NewReader([]byte(body)))
+				require.NoError(t, err)
+				return req
+			},
+		},
+		{
+			name: "body without GetBody",
+			newRequest: func() *http.Request {
+				req, err := http.NewRequest(http.MethodPost, "https://wfm.local/onboarding", io.NopCloser(bytes.NewReader([]byte(body))))
+				require.NoError(t, err)
+				require.Nil(t, req.GetBody)
+				return req
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.DebugLevel)
+			req := tt.newRequest()
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Tenant-Token", "tenant-secret")
+
+			require.NoError(t, PreflightLogger(1000, redactor, zap.New(core).Sugar())(context.Background(), req))
+
+			sent, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(sent), "the body sent downstream must be the original one")
+			assert.Equal(t, "tenant-secret", req.Header.Get("X-Tenant-Token"))
+
+			require.Equal(t, 1, logs.Len())
+			fields := logs.All()[0].ContextMap()
+			assert.Equal(t, `{"clientId":"device-1","credentials":[{"clientSecret":"[REDACTED]"}]}`, fields["body_preview"])
+			assert.Equal(t, []string{redact.Mask}, fields["headers"].(map[string][]string)["X-Tenant-Token"])
+		})
+	}
+}
+
+func TestPreflightLogger_RedactsJSONBodies(t *testing.T) {
+	redactor, err := redact.New(redact.Config{BodyKeyPatterns: []string{"*attestation"}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "onboarding payload",
+			body: `{"deviceSignature":"sig","identity":{"certificate":"-----BEGIN CERTIFICATE-----","csr":"MIIB"},"tpmAttestation":"quote"}`,
+			want: `{"deviceSignature":"sig","identity":{"certificate":"[REDACTED]","csr":"[REDACTED]"},"tpmAttestation":"[REDACTED]"}`,
+		},
+		{
+			name: "nested arrays",
+			body: `{"registries":[{"url":"r1","auth":{"refresh_token":"t"}}]}`,
+			want: `{"registries":[{"auth":{"refresh_token":"[REDACTED]"},"url":"r1"}]}`,
+		},
+		{
+			name: "malformed json",
+			body: `{"clientId":"device-1","clientSecret":"s3cr3t"`,
+			want: redact.UnparseableJSON,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.DebugLevel)
+			req, err := http.NewRequest(http.MethodPost, "https://wfm.local/onboarding", bytes.NewReader([]byte(tt.body)))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+
+			require.NoError(t, PreflightLogger(1000, redactor, zap.New(core).Sugar())(context.Background(), req))
+
+			require.Equal(t, 1, logs.Len())
+			assert.Equal(t, tt.want, logs.All()[0].ContextMap()["body_preview"])
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/shared-lib/file"
+	"go.uber.org/zap"
+)
+
+// appliedProvisioning is a provisioning file applied on this start, it is erased once the device
+// onboarded with it
+type appliedProvisioning struct {
+	path           string
+	bootstrapToken string
+}
+
+// applyProvisioning applies the provisioning file to the configuration when the database has no
+// device settings yet, or when forced. Devices provisioned earlier keep the values they were
+// provisioned with, their file is gone by then. An invalid file is an error, the agent must not
+// start half provisioned. It returns nil when no file was applied.
+func applyProvisioning(cfg *types.Config, db database.DatabaseIfc, force bool, log *zap.SugaredLogger) (*appliedProvisioning, error) {
+	record, err := db.GetDeviceSettings()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device settings from database, %s", err.Error())
+	}
+	hasDeviceSettings := record != nil && (record.DeviceClientId != "" || record.State == types.DeviceOnboardStateOnboarded)
+
+	path := cfg.Provisioning.FilePath()
+	if _, err := os.Stat(path); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to check the provisioning file %s: %w", path, err)
+		}
+		if force {
+			return nil, fmt.Errorf("provisioning forced but there is no provisioning file at %s", path)
+		}
+		applyProvisioningRecord(cfg, record)
+		return nil, nil
+	}
+
+	if hasDeviceSettings && !force {
+		log.Warnw("Ignoring the provisioning file, the device is already onboarded, re-provisioning it must be forced",
+			"path", path, "deviceClientId", record.DeviceClientId)
+		applyProvisioningRecord(cfg, record)
+		return nil, nil
+	}
+
+	provisioning, err := types.LoadProvisioning(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range provisioning.Warnings {
+		log.Warnw("Provisioning warning", "warning", warning)
+	}
+
+	// a re-provisioned device onboards again, with the identity of the file
+	applied := &database.ProvisioningRecord{
+		SourcePath:         path,
+		AppliedAt:          time.Now(),
+		SbiURL:             provisioning.Wfm.SbiURL,
+		AllowInsecureHttp:  provisioning.Wfm.AllowInsecureHttp,
+		Tenant:             provisioning.Tenant,
+		Labels:             provisioning.Labels,
+		DeviceRootIdentity: provisioning.DeviceRootIdentity,
+		HadBootstrapToken:  provisioning.BootstrapToken != "",
+	}
+	if err := db.SetDeviceSettings(database.DeviceSettingsRecord{Provisioning: applied}); err != nil {
+		return nil, fmt.Errorf("failed to store the provisioning: %w", err)
+	}
+	if err := db.Persist(); err != nil {
+		return nil, fmt.Errorf("failed to store the provisioning: %w", err)
+	}
+	applyProvisioningRecord(cfg, &database.DeviceSettingsRecord{Provisioning: applied})
+
+	log.Infow("Applied the provisioning file",
+		"audit", true,
+		"path", path,
+		"forced", force,
+		"sbiUrl", applied.SbiURL,
+		"allowInsecureHttp", applied.AllowInsecureHttp,
+		"tenant", applied.Tenant,
+		"labels", applied.Labels,
+		"deviceRootIdentityType", cfg.DeviceRootIdentity.IdentityType,
+		"deviceCertificate", cfg.DeviceRootIdentity.PublicCertificatePath(),
+		"hasBootstrapToken", applied.HadBootstrapToken)
+
+	return &appliedProvisioning{path: path, bootstrapToken: provisioning.BootstrapToken}, nil
+}
+
+// applyProvisioningRecord overrides the configuration with the values the device was provisioned with
+func applyProvisioningRecord(cfg *types.Config, record *database.DeviceSettingsRecord) {
+	if record == nil || record.Provisioning == nil {
+		return
+	}
+	cfg.Wfm.SbiURL = record.Provisioning.SbiURL
+	cfg.Wfm.AllowInsecureHttp = record.Provisioning.AllowInsecureHttp
+	if record.Provisioning.DeviceRootIdentity != nil {
+		cfg.DeviceRootIdentity = *record.Provisioning.DeviceRootIdentity
+	}
+}
+
+// complete erases the provisioning file once the device onboarded, its bootstrap token is spent and
+// must not stay on disk
+func (p *appliedProvisioning) complete(log *zap.SugaredLogger) error {
+	if p == nil {
+		return nil
+	}
+	p.bootstrapToken = ""
+	if err := file.Shred(p.path); err != nil {
+		return fmt.Errorf("failed to erase the provisioning file %s, remove it by hand: %w", p.path, err)
+	}
+	log.Infow("Erased the provisioning file", "audit", true, "path", p.path)
+	return nil
+}
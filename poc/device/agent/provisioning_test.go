@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const testBootstrapToken = "bootstrap-7f3c9a"
+
+// provisioningTestEnv is a first boot of a device with a provisioning file
+type provisioningTestEnv struct {
+	t    *testing.T
+	cfg  *types.Config
+	db   *database.Database
+	path string
+}
+
+func newProvisioningTestEnv(t *testing.T) *provisioningTestEnv {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	path := filepath.Join(t.TempDir(), "provisioning.yaml")
+	return &provisioningTestEnv{
+		t:    t,
+		path: path,
+		db:   newTestDatabase(t, "data"),
+		cfg: &types.Config{
+			Wfm:          types.WFMConfig{SbiURL: "https://configured.example.com"},
+			Provisioning: &types.ProvisioningConfig{Path: path},
+		},
+	}
+}
+
+func (env *provisioningTestEnv) writeFile(content string) {
+	env.t.Helper()
+	require.NoError(env.t, os.WriteFile(env.path, []byte(content), 0600))
+}
+
+func provisioningFile(sbiURL string) string {
+	return "wfm:\n  sbiUrl: " + sbiURL + "\n  allowInsecureHttp: true\n" +
+		"tenant: plant-7\nlabels:\n  line: assembly-3\n" +
+		"deviceRootIdentity:\n  identityType: RANDOM\n  attestation:\n    random:\n      value: device-42\n" +
+		"bootstrapToken: " + testBootstrapToken + "\n"
+}
+
+// onboardingServer is a WFM that hands out a client id for the bootstrap token only
+func onboardingServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(wfm.BootstrapTokenHeader) != testBootstrapToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"client_id": "device-1"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestProvisioning_FirstBoot(t *testing.T) {
+	env := newProvisioningTestEnv(t)
+	server := onboardingServer(t)
+	env.writeFile(provisioningFile(server.URL))
+	log := zap.NewNop().Sugar()
+
+	provisioning, err := applyProvisioning(env.cfg, env.db, false, log)
+	require.NoError(t, err)
+	require.NotNil(t, provisioning)
+	assert.Equal(t, server.URL, env.cfg.Wfm.SbiURL)
+	assert.Equal(t, "device-42", env.cfg.DeviceRootIdentity.Attestation.Random.Value)
+
+	client, err := wfm.NewSbiHTTPClient(env.cfg.Wfm.SbiURL)
+	require.NoError(t, err)
+	settings, err := NewDeviceSettings(client, env.db, log,
+		WithDeviceRootIdentity(env.cfg.DeviceRootIdentity), WithBootstrapToken(provisioning.bootstrapToken))
+	require.NoError(t, err)
+	clientId, err := settings.Onboard(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "device-1", clientId)
+	require.NoError(t, provisioning.complete(log))
+
+	record, err := env.db.GetDeviceSettings()
+	require.NoError(t, err)
+	assert.Equal(t, types.DeviceOnboardStateOnboarded, record.State)
+	require.NotNil(t, record.Provisioning, "onboarding keeps the provisioning")
+	assert.Equal(t, "plant-7", record.Provisioning.Tenant)
+	assert.Equal(t, map[string]string{"line": "assembly-3"}, record.Provisioning.Labels)
+	assert.True(t, record.Provisioning.HadBootstrapToken)
+
+	// the next boot keeps the provisioned values without the file
+	cfg := &types.Config{Wfm: types.WFMConfig{SbiURL: "https://configured.example.com"}, Provisioning: env.cfg.Provisioning}
+	provisioning, err = applyProvisioning(cfg, env.db, false, log)
+	require.NoError(t, err)
+	assert.Nil(t, provisioning)
+	assert.Equal(t, server.URL, cfg.Wfm.SbiURL)
+}
+
+func TestProvisioning_TokenIsErased(t *testing.T) {
+	env := newProvisioningTestEnv(t)
+	server := onboardingServer(t)
+	env.writeFile(provisioningFile(server.URL))
+	log := zap.NewNop().Sugar()
+
+	provisioning, err := applyProvisioning(env.cfg, env.db, false, log)
+	require.NoError(t, err)
+	client, err := wfm.NewSbiHTTPClient(env.cfg.Wfm.SbiURL)
+	require.NoError(t, err)
+	settings, err := NewDeviceSettings(client, env.db, log, WithBootstrapToken(provisioning.bootstrapToken))
+	require.NoError(t, err)
+	_, err = settings.Onboard(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, provisioning.complete(log))
+
+	_, err = os.Stat(env.path)
+	assert.True(t, os.IsNotExist(err), "the provisioning file is removed")
+	assert.Empty(t, settings.bootstrapToken)
+	assert.Empty(t, provisioning.bootstrapToken)
+
+	require.NoError(t, env.db.Persist())
+	data, err := os.ReadFile(filepath.Join("data", "agent.database.json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "plant-7")
+	assert.NotContains(t, string(data), testBootstrapToken, "the token is never stored")
+}
+
+func TestProvisioning_AlreadyOnboardedSkipsTheFile(t *testing.T) {
+	env := newProvisioningTestEnv(t)
+	require.NoError(t, env.db.SetDeviceSettings(database.DeviceSettingsRecord{
+		DeviceClientId: "device-1",
+		State:          types.DeviceOnboardStateOnboarded,
+	}))
+	env.writeFile(provisioningFile("https://provisioned.example.com"))
+
+	provisioning, err := applyProvisioning(env.cfg, env.db, false, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	assert.Nil(t, provisioning)
+	assert.Equal(t, "https://configured.example.com", env.cfg.Wfm.SbiURL)
+	_, err = os.Stat(env.path)
+	assert.NoError(t, err, "the ignored file is left alone")
+
+	// forcing it re-provisions the device, it onboards again
+	provisioning, err = applyProvisioning(env.cfg, env.db, true, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	require.NotNil(t, provisioning)
+	assert.Equal(t, "https://provisioned.example.com", env.cfg.Wfm.SbiURL)
+	_, onboarded, err := env.db.IsDeviceOnboarded()
+	require.NoError(t, err)
+	assert.False(t, onboarded)
+}
+
+func TestProvisioning_MalformedFileHaltsStartup(t *testing.T) {
+	env := newProvisioningTestEnv(t)
+	env.writeFile("wfm:\n  sbiUrl: https://provisioned.example.com\nlabels:\n  line: assembly 3\nbootstrapToken: " + testBootstrapToken + "\n")
+
+	provisioning, err := applyProvisioning(env.cfg, env.db, false, zap.NewNop().Sugar())
+	require.Error(t, err)
+	assert.Nil(t, provisioning)
+	assert.Contains(t, err.Error(), "invalid provisioning file "+env.path+": labels.line")
+
+	// nothing was applied
+	assert.Equal(t, "https://configured.example.com", env.cfg.Wfm.SbiURL)
+	record, err := env.db.GetDeviceSettings()
+	require.NoError(t, err)
+	assert.Nil(t, record.Provisioning)
+	_, err = os.Stat(env.path)
+	assert.NoError(t, err, "the file is kept to be fixed")
+
+	// forcing without a file is an error as well
+	require.NoError(t, os.Remove(env.path))
+	_, err = applyProvisioning(env.cfg, env.db, true, zap.NewNop().Sugar())
+	assert.ErrorContains(t, err, "there is no provisioning file at "+env.path)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+const (
+	// reconcileTimeout bounds a single reconciliation of a deployment, unless its components allow
+	// their runtime more time, see reconcileBudget
+	reconcileTimeout = 10 * time.Minute
+	// reconcileTimeoutMargin is added to the timeout of a component, for pulling the chart and for
+	// what runs after the runtime call
+	reconcileTimeoutMargin = 5 * time.Minute
+	// reconcileStaleAfter is the age at which a reconciliation that still holds its lock is considered
+	// stuck, it is cancelled and the deployment unlocked
+	reconcileStaleAfter = reconcileTimeout + 5*time.Minute
+)
+
+// Outcomes of a reconciliation
+const (
+	ReconcileOutcomeCompleted = "completed"
+	ReconcileOutcomeFailed    = "failed"
+	ReconcileOutcomePanicked  = "panicked"
+	ReconcileOutcomeExpired   = "expired"
+)
+
+// ReconcileOperation describes the last reconciliation of a deployment, for diagnosing stuck
+// deployments
+type ReconcileOperation struct {
+	DeploymentID string `json:"deploymentId"`
+	// ID numbers the reconciliations of the agent
+	ID uint64 `json:"id"`
+	// Goroutine that holds or held the lock of the deployment
+	Goroutine  uint64    `json:"goroutine"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	InProgress bool      `json:"inProgress"`
+	Outcome    string    `json:"outcome,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// reconcileRun is the lock a reconciliation holds on its deployment
+type reconcileRun struct {
+	deploymentId string
+	id           uint64
+	goroutine    uint64
+	startedAt    time.Time
+	cancel       context.CancelFunc
+	expired      atomic.Bool
+	// phaseMu guards abandoned, a phase write of the run and its abandonment do not interleave
+	phaseMu sync.Mutex
+	// abandoned is set once an expiry or a drain cancelled the run, its phase writes are ignored
+	abandoned bool
+	// budget is the time.Duration the run may take, set once the desired state was read
+	budget atomic.Int64
+}
+
+// abandon cancels the run, the phases it still writes are ignored
+func (run *reconcileRun) abandon() {
+	run.phaseMu.Lock()
+	run.abandoned = true
+	run.phaseMu.Unlock()
+	run.cancel()
+}
+
+// setPhase records the phase of the deployment of the run, unless the run was abandoned: the
+// phase of the expiry or the drain, or of the run that took over, must not be overwritten
+func (run *reconcileRun) setPhase(db database.DatabaseIfc, phase, message string) bool {
+	run.phaseMu.Lock()
+	defer run.phaseMu.Unlock()
+	if run.abandoned {
+		return false
+	}
+	db.SetPhase(run.deploymentId, phase, message)
+	return true
+}
+
+// reconcileRunKey is the context key of the run a reconciliation belongs to
+type reconcileRunKey struct{}
+
+func withReconcileRun(ctx context.Context, run *reconcileRun) context.Context {
+	return context.WithValue(ctx, reconcileRunKey{}, run)
+}
+
+// setPhase records the phase of a deployment. Within a reconciliation ctx carries its run, the
+// phase is dropped once the run was abandoned.
+func (dm *DeploymentManager) setPhase(ctx context.Context, deploymentId, phase, message string) {
+	run, _ := ctx.Value(reconcileRunKey{}).(*reconcileRun)
+	if run == nil {
+		dm.database.SetPhase(deploymentId, phase, message)
+		return
+	}
+	if !run.setPhase(dm.database, phase, message) {
+		dm.log.Debugw("Ignoring the phase of an abandoned reconciliation", "deploymentId", deploymentId,
+			"operationId", run.id, "phase", phase, "message", message)
+	}
+}
+
+// reconcileOperations keeps the last reconciliation of every deployment
+type reconcileOperations struct {
+	mu         sync.Mutex
+	lastId     uint64
+	operations map[string]*ReconcileOperation
+	expired    uint64
+}
+
+func (o *reconcileOperations) start(deploymentId string, cancel context.CancelFunc) *reconcileRun {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastId++
+	return &reconcileRun{
+		deploymentId: deploymentId,
+		id:           o.lastId,
+		goroutine:    goroutineID(),
+		startedAt:    time.Now(),
+		cancel:       cancel,
+	}
+}
+
+// begin records a run that acquired the lock of its deployment
+func (o *reconcileOperations) begin(run *reconcileRun) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.operations == nil {
+		o.operations = make(map[string]*ReconcileOperation)
+	}
+	o.operations[run.deploymentId] = &ReconcileOperation{
+		DeploymentID: run.deploymentId,
+		ID:           run.id,
+		Goroutine:    run.goroutine,
+		StartedAt:    run.startedAt,
+		InProgress:   true,
+	}
+}
+
+// end records how a run ended, unless a later run of the deployment was recorded meanwhile
+func (o *reconcileOperations) end(run *reconcileRun, outcome, message string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	operation, found := o.operations[run.deploymentId]
+	if !found || operation.ID != run.id {
+		return
+	}
+	operation.InProgress = false
+	operation.DurationMs = time.Since(run.startedAt).Milliseconds()
+	operation.Outcome = outcome
+	operation.Error = message
+}
+
+// list returns the last reconciliation of every deployment, sorted by deployment
+func (o *reconcileOperations) list() []ReconcileOperation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	operations := make([]ReconcileOperation, 0, len(o.operations))
+	for _, operation := range o.operations {
+		snapshot := *operation
+		if snapshot.InProgress {
+			snapshot.DurationMs = time.Since(snapshot.StartedAt).Milliseconds()
+		}
+		operations = append(operations, snapshot)
+	}
+	sort.Slice(operations, func(i, j int) bool { return operations[i].DeploymentID < operations[j].DeploymentID })
+	return operations
+}
+
+// forget drops the operations of deployments that are gone, keeping the map bounded
+func (o *reconcileOperations) forget(known func(deploymentId string) bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for deploymentId, operation := range o.operations {
+		if !operation.InProgress && !known(deploymentId) {
+			delete(o.operations, deploymentId)
+		}
+	}
+}
+
+func (o *reconcileOperations) expiredCount() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.expired
+}
+
+// Operations returns the last reconciliation of every deployment
+func (dm *DeploymentManager) Operations() []ReconcileOperation {
+	return dm.operations.list()
+}
+
+// finishReconcile releases the lock of a run. It is deferred right after the lock was acquired, a
+// panic of the reconciliation fails the deployment instead of leaving it locked forever.
+func (dm *DeploymentManager) finishReconcile(run *reconcileRun) {
+	defer run.cancel()
+
+	outcome, message := ReconcileOutcomeCompleted, ""
+	if recovered := recover(); recovered != nil {
+		outcome, message = ReconcileOutcomePanicked, fmt.Sprintf("reconciliation panicked: %v", recovered)
+		dm.log.Errorw("Reconciliation panicked", "deploymentId", run.deploymentId, "operationId", run.id,
+			"panic", recovered, "stack", string(debug.Stack()))
+		run.setPhase(dm.database, "FAILED", message)
+	} else if record, err := dm.database.GetDeployment(run.deploymentId); err == nil && record.Phase == "FAILED" {
+		outcome, message = ReconcileOutcomeFailed, record.Message
+	}
+
+	// an expired run was unlocked and recorded when it expired, the lock may belong to a later run
+	if run.expired.Load() {
+		return
+	}
+	dm.reconcileLocks.CompareAndDelete(run.deploymentId, run)
+	dm.operations.end(run, outcome, message)
+}
+
+// expireStaleReconciliations cancels and unlocks reconciliations that hold their lock for longer
+// than staleAfter, the deployments are reconciled again on the next tick
+func (dm *DeploymentManager) expireStaleReconciliations(staleAfter time.Duration) {
+	dm.reconcileLocks.Range(func(key, value interface{}) bool {
+		run := value.(*reconcileRun)
+		age := time.Since(run.startedAt)
+		// runs allowed more than reconcileTimeout get as much more before they are stuck
+		if age < staleAfter+max(0, time.Duration(run.budget.Load())-reconcileTimeout) {
+			return true
+		}
+		dm.log.Errorw("Reconciliation is stuck, cancelling it and unlocking the deployment",
+			"deploymentId", run.deploymentId, "operationId", run.id, "goroutine", run.goroutine,
+			"age", age.Round(time.Second))
+		run.expired.Store(true)
+		run.abandon()
+		if dm.reconcileLocks.CompareAndDelete(run.deploymentId, run) {
+			dm.operations.mu.Lock()
+			dm.operations.expired++
+			dm.operations.mu.Unlock()
+			dm.operations.end(run, ReconcileOutcomeExpired, fmt.Sprintf("cancelled after %s", age.Round(time.Second)))
+		}
+		return true
+	})
+
+	dm.operations.forget(func(deploymentId string) bool {
+		_, err := dm.database.GetDeployment(deploymentId)
+		return err == nil
+	})
+}
+
+// reconcileBudget is the time a reconciliation of the deployment may take: reconcileTimeout, or
+// more when the timeout of a Helm component or the health wait of a Compose component needs it
+func reconcileBudget(appDeployment sbi.AppDeploymentManifest) time.Duration {
+	budget := reconcileTimeout
+	for _, component := range appDeployment.Spec.DeploymentProfile.Components {
+		// an invalid timeout fails the deployment right away
+		timeout, err := componentTimeout(appDeployment.Spec.DeploymentProfile.Type, component)
+		if err == nil && timeout+reconcileTimeoutMargin > budget {
+			budget = timeout + reconcileTimeoutMargin
+		}
+	}
+	return budget
+}
+
+// componentTimeout is how long the deployment of the component may wait for it, 0 when it does not wait
+func componentTimeout(profileType sbi.AppDeploymentProfileType, component sbi.AppDeploymentProfile_Components_Item) (time.Duration, error) {
+	switch profileType {
+	case sbi.HelmV3:
+		helmComp, err := component.AsHelmApplicationDeploymentProfileComponent()
+		if err != nil {
+			return 0, err
+		}
+		return helmComponentTimeout(helmComp)
+	case sbi.Compose:
+		composeComp, err := component.AsComposeApplicationDeploymentProfileComponent()
+		if err != nil || !composeWaitsForHealth(composeComp) {
+			return 0, err
+		}
+		return composeComponentTimeout(composeComp)
+	default:
+		return 0, nil
+	}
+}
+
+// goroutineID is the id of the calling goroutine as shown in stack traces
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	// "goroutine 42 [running]: ..."
+	fields := bytes.Fields(buf)
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/metrics"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// faultyDatabase panics in or blocks the first GetDeployment calls, like a runtime call going wrong
+// in the middle of a reconciliation
+type faultyDatabase struct {
+	*database.Database
+	panics  atomic.Int32
+	blocked chan struct{}
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (f *faultyDatabase) GetDeployment(deploymentId string) (*database.DeploymentRecord, error) {
+	f.calls.Add(1)
+	if f.panics.Add(-1) >= 0 {
+		panic("runtime exploded")
+	}
+	if f.blocked != nil {
+		blocked := f.blocked
+		f.blocked = nil
+		close(blocked)
+		<-f.release
+	}
+	return f.Database.GetDeployment(deploymentId)
+}
+
+func newReconcileTestManager(t *testing.T) (*DeploymentManager, *faultyDatabase) {
+	t.Helper()
+	db := &faultyDatabase{Database: newTestDatabase(t, t.TempDir())}
+	desired := database.AppDeploymentState{}
+	desired.Status.Status.State = sbi.DeploymentStatusManifestStatusStateRemoved
+	require.NoError(t, db.Database.SetDesiredState("deployment-a", desired))
+	return NewDeploymentManager(db, nil, nil, zap.NewNop().Sugar()), db
+}
+
+func TestReconcileDeployment_PanicDoesNotWedgeTheDeployment(t *testing.T) {
+	dm, db := newReconcileTestManager(t)
+	db.panics.Store(1)
+
+	dm.reconcileDeployment("deployment-a")
+
+	_, locked := dm.reconcileLocks.Load("deployment-a")
+	assert.False(t, locked, "the lock is released after the panic")
+	record, err := db.Database.GetDeployment("deployment-a")
+	require.NoError(t, err)
+	assert.Equal(t, "FAILED", record.Phase)
+	assert.Contains(t, record.Message, "reconciliation panicked: runtime exploded")
+
+	operations := dm.Operations()
+	require.Len(t, operations, 1)
+	assert.Equal(t, ReconcileOutcomePanicked, operations[0].Outcome)
+	assert.False(t, operations[0].InProgress)
+	assert.NotZero(t, operations[0].Goroutine)
+
+	// the next reconciliation is not skipped
+	calls := db.calls.Load()
+	dm.reconcileDeployment("deployment-a")
+	assert.Greater(t, db.calls.Load(), calls)
+	operations = dm.Operations()
+	require.Len(t, operations, 1)
+	assert.Greater(t, operations[0].ID, uint64(1))
+	assert.False(t, operations[0].InProgress)
+}
+
+func TestExpireStaleReconciliations(t *testing.T) {
+	dm, db := newReconcileTestManager(t)
+	db.blocked, db.release = make(chan struct{}), make(chan struct{})
+	blocked := db.blocked
+
+	stuck := make(chan struct{})
+	go func() {
+		defer close(stuck)
+		dm.reconcileDeployment("deployment-a")
+	}()
+	<-blocked
+
+	value, locked := dm.reconcileLocks.Load("deployment-a")
+	require.True(t, locked)
+	stuckRun := value.(*reconcileRun)
+	operations := dm.Operations()
+	require.Len(t, operations, 1)
+	assert.True(t, operations[0].InProgress)
+
+	// fresh reconciliations are left alone
+	dm.expireStaleReconciliations(reconcileStaleAfter)
+	_, locked = dm.reconcileLocks.Load("deployment-a")
+	assert.True(t, locked)
+
+	dm.expireStaleReconciliations(0)
+	_, locked = dm.reconcileLocks.Load("deployment-a")
+	assert.False(t, locked, "the stuck reconciliation is unlocked")
+	assert.True(t, stuckRun.expired.Load())
+	operations = dm.Operations()
+	require.Len(t, operations, 1)
+	assert.Equal(t, ReconcileOutcomeExpired, operations[0].Outcome)
+	assert.Equal(t, float64(1), dm.Health().Metrics["reconciliationsExpired"])
+
+	// the deployment is reconciled again while the stuck call is still hanging
+	dm.reconcileDeployment("deployment-a")
+	operations = dm.Operations()
+	require.Len(t, operations, 1)
+	latest := operations[0]
+	assert.Equal(t, ReconcileOutcomeCompleted, latest.Outcome)
+	assert.NotEqual(t, stuckRun.id, latest.ID)
+
+	// when the stuck call returns it neither unlocks nor overwrites the later reconciliation
+	close(db.release)
+	<-stuck
+	assert.Equal(t, []ReconcileOperation{latest}, dm.Operations())
+}
+
+func TestExpireStaleReconciliations_ForgetsRemovedDeployments(t *testing.T) {
+	dm, db := newReconcileTestManager(t)
+	dm.reconcileDeployment("deployment-a")
+	require.Len(t, dm.Operations(), 1)
+
+	db.Database.RemoveDeployment("deployment-a")
+	dm.expireStaleReconciliations(reconcileStaleAfter)
+	assert.Empty(t, dm.Operations())
+}
+
+func TestReconcileBudget(t *testing.T) {
+	assert.Equal(t, reconcileTimeout, reconcileBudget(changeManifest(t)))
+	assert.Equal(t, reconcileTimeout, reconcileBudget(changeManifest(t, `"revision": "1.2.0"`, `"revision": "1.2.0", "timeout": "2m"`)))
+	assert.Equal(t, 25*time.Minute+reconcileTimeoutMargin,
+		reconcileBudget(changeManifest(t, `"revision": "1.2.0"`, `"revision": "1.2.0", "timeout": "25m"`)))
+	// invalid timeouts fail the deployment, they do not stretch the reconciliation
+	assert.Equal(t, reconcileTimeout, reconcileBudget(changeManifest(t, `"revision": "1.2.0"`, `"revision": "1.2.0", "timeout": "soon"`)))
+	// compose components wait that long for their services to be healthy
+	assert.Equal(t, 25*time.Minute+reconcileTimeoutMargin, reconcileBudget(changeManifest(t,
+		`"revision": "1.2.0"`, `"revision": "1.2.0", "timeout": "25m"`, `"type": "helm.v3"`, `"type": "compose"`)))
+	assert.Equal(t, reconcileTimeout, reconcileBudget(changeManifest(t,
+		`"revision": "1.2.0"`, `"revision": "1.2.0", "timeout": "25m", "wait": false`, `"type": "helm.v3"`, `"type": "compose"`)))
+}
+
+func TestExpireStaleReconciliations_RespectsTheBudget(t *testing.T) {
+	dm, _ := newReconcileTestManager(t)
+	run := dm.operations.start("deployment-a", func() {})
+	run.startedAt = time.Now().Add(-reconcileStaleAfter - time.Minute)
+	run.budget.Store(int64(30 * time.Minute))
+	dm.reconcileLocks.Store("deployment-a", run)
+	dm.operations.begin(run)
+
+	dm.expireStaleReconciliations(reconcileStaleAfter)
+	assert.False(t, run.expired.Load(), "a run allowed 30 minutes is not stuck after 16")
+
+	run.budget.Store(int64(reconcileTimeout))
+	dm.expireStaleReconciliations(reconcileStaleAfter)
+	assert.True(t, run.expired.Load())
+}
+
+func TestDeployOrUpdateHelm_InvalidTimeout(t *testing.T) {
+	dm, _ := newReconcileTestManager(t)
+	manifest := changeManifest(t, `"revision": "1.2.0"`, `"revision": "1.2.0", "timeout": "15 minutes"`)
+
+	err := dm.deployOrUpdateHelm(context.Background(), "deployment-a", manifest, manifest.Spec.DeploymentProfile.Components[0], &deploymentImages{})
+	var helmErr *workloads.HelmError
+	require.ErrorAs(t, err, &helmErr)
+	assert.Equal(t, workloads.ErrorTypeInvalidInput, helmErr.Type)
+	assert.Contains(t, deploymentFailureMessage(sbi.HelmV3, err), `invalid timeout "15 minutes"`)
+}
+
+func TestReleaseTestsError(t *testing.T) {
+	testErr := &workloads.HelmError{Type: workloads.ErrorTypeRelease, Message: "tests of release web failed: web-test-connection"}
+
+	err := releaseTestsError(testErr, "POD LOGS: web-test-connection\nwget: can't connect to remote host\n")
+	require.ErrorAs(t, err, new(*workloads.HelmError))
+	assert.Equal(t, "helm.v3 operation failed: release tests failed: Release: tests of release web failed: web-test-connection, "+
+		"test output:\nPOD LOGS: web-test-connection\nwget: can't connect to remote host", deploymentFailureMessage(sbi.HelmV3, err))
+
+	long := strings.Repeat("x", maxReleaseTestOutput) + "the end"
+	message := releaseTestsError(testErr, long).Error()
+	assert.True(t, strings.HasSuffix(message, "test output:\n..."+long[len(long)-maxReleaseTestOutput:]), "only the end of the output is kept")
+
+	assert.Equal(t, "release tests failed: Release: tests of release web failed: web-test-connection", releaseTestsError(testErr, " \n").Error())
+
+	// without release tests nothing is run, there is no helm client here
+	dm, _ := newReconcileTestManager(t)
+	assert.NoError(t, dm.runHelmReleaseTests(context.Background(), "deployment-a", "web", "default"))
+}
+
+// reconcileRecorder keeps the desired states of the measured reconciliations
+type reconcileRecorder struct {
+	metrics.Nop
+	desiredStates []string
+}
+
+func (r *reconcileRecorder) Reconciled(desiredState string, duration time.Duration) {
+	r.desiredStates = append(r.desiredStates, desiredState)
+}
+
+func TestReconcileDeployment_RecordsItsDuration(t *testing.T) {
+	dm, _ := newReconcileTestManager(t)
+	recorder := &reconcileRecorder{}
+	WithDeploymentMetrics(recorder)(dm)
+
+	dm.reconcileDeployment("deployment-a")
+	dm.reconcileDeployment("deployment-unknown")
+
+	assert.Equal(t, []string{"Removed"}, recorder.desiredStates, "deployments without a desired state are not measured")
+}
+
+// staleReadDatabase blocks in the first GetDeployment call after reading the deployment, like a
+// reconciliation that read the desired state just before a sync replaced it
+type staleReadDatabase struct {
+	*database.Database
+	once    sync.Once
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (s *staleReadDatabase) GetDeployment(deploymentId string) (*database.DeploymentRecord, error) {
+	record, err := s.Database.GetDeployment(deploymentId)
+	s.once.Do(func() {
+		close(s.read)
+		<-s.release
+	})
+	return record, err
+}
+
+// storeDesiredVersion stores the manifest as the pending desired state of deployment-a
+func storeDesiredVersion(t *testing.T, db *database.Database, manifest sbi.AppDeploymentManifest, digest string) {
+	t.Helper()
+	desired := database.AppDeploymentState{AppDeploymentManifest: manifest, Digest: &digest}
+	desired.Status.Status.State = sbi.DeploymentStatusManifestStatusStatePending
+	require.NoError(t, db.SetDesiredState("deployment-a", desired))
+}
+
+func TestReconcileDeployment_FollowsUpOnADesiredStateStoredMidFlight(t *testing.T) {
+	db := &staleReadDatabase{Database: newTestDatabase(t, t.TempDir()), read: make(chan struct{}), release: make(chan struct{})}
+	dm := NewDeploymentManager(db, nil, nil, zap.NewNop().Sugar())
+	first := changeManifest(t)
+	second := changeManifest(t, `"value": "hello"`, `"value": "bonjour"`)
+	storeDesiredVersion(t, db.Database, first, "sha256:first")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dm.reconcileDeployment("deployment-a")
+	}()
+	<-db.read
+
+	// the next manifest version arrives while the first one is deployed, its trigger is skipped
+	storeDesiredVersion(t, db.Database, second, "sha256:second")
+	dm.reconcileDeployment("deployment-a")
+	close(db.release)
+	<-done
+
+	// without a runtime client the deployments fail, the current state tells what was deployed last
+	require.Eventually(t, func() bool {
+		record, err := db.Database.GetDeployment("deployment-a")
+		return err == nil && record.CurrentState != nil && record.CurrentState.DigestValue() == "sha256:second"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		_, locked := dm.reconcileLocks.Load("deployment-a")
+		return !locked
+	}, 5*time.Second, 10*time.Millisecond)
+	record, err := db.Database.GetDeployment("deployment-a")
+	require.NoError(t, err)
+	assert.Equal(t, second.Spec, record.CurrentState.Spec)
+	assert.Equal(t, "sha256:second", record.Digest)
+}
+
+func TestReconcileDeployment_DeploysANewDigestOverAnInstalledOne(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	dm := NewDeploymentManager(db, nil, nil, zap.NewNop().Sugar())
+	manifest := changeManifest(t)
+	storeDesiredVersion(t, db, manifest, "sha256:first")
+	installed := *mustGetDeployment(t, db, "deployment-a").DesiredState
+	installed.Status.Status.State = sbi.DeploymentStatusManifestStatusStateInstalled
+	db.SetCurrentState("deployment-a", installed)
+
+	dm.reconcileDeployment("deployment-a")
+	assert.Equal(t, "sha256:first", mustGetDeployment(t, db, "deployment-a").CurrentState.DigestValue(), "the installed digest is left alone")
+
+	storeDesiredVersion(t, db, manifest, "sha256:second")
+	dm.reconcileDeployment("deployment-a")
+	assert.Equal(t, "sha256:second", mustGetDeployment(t, db, "deployment-a").CurrentState.DigestValue())
+}
+
+func mustGetDeployment(t *testing.T, db *database.Database, deploymentId string) *database.DeploymentRecord {
+	t.Helper()
+	record, err := db.GetDeployment(deploymentId)
+	require.NoError(t, err)
+	return record
+}
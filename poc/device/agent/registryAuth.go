@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/margo/sandbox/standard/pkg"
+)
+
+// WithRegistryCredentials resolves the passwordRef of the registry credentials of a component
+// against the passwords and tokens kept in the agent configuration
+func WithRegistryCredentials(credentials map[string]types.RegistryCredentialConfig) DeploymentManagerOption {
+	return func(dm *DeploymentManager) {
+		dm.registryCredentials = credentials
+	}
+}
+
+// registryAuths are the credentials of the private registries of the component, the passwords
+// referred to with passwordRef are resolved
+func (dm *DeploymentManager) registryAuths(component sbi.AppDeploymentProfile_Components_Item) ([]pkg.RegistryAuth, error) {
+	auths, err := pkg.GetComponentRegistryAuths(component)
+	if err != nil {
+		return nil, err
+	}
+	for i, auth := range auths {
+		if auth.PasswordRef == "" {
+			continue
+		}
+		credential, ok := dm.registryCredentials[auth.PasswordRef]
+		if !ok {
+			return nil, fmt.Errorf("registryAuth[%d] of registry %s refers to the unknown credential %q", i, auth.Registry, auth.PasswordRef)
+		}
+		password, err := credential.Secret()
+		if err != nil {
+			return nil, fmt.Errorf("registryAuth[%d] of registry %s: credential %q: %w", i, auth.Registry, auth.PasswordRef, err)
+		}
+		auths[i].Password = password
+	}
+	return auths, nil
+}
+
+// composeRegistryAuths are the credentials of the private registries the compose component pulls
+// its images from
+func (dm *DeploymentManager) composeRegistryAuths(component sbi.AppDeploymentProfile_Components_Item) ([]workloads.ComposeRegistryAuth, error) {
+	auths, err := dm.registryAuths(component)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compose component: %w", err)
+	}
+	registryAuths := make([]workloads.ComposeRegistryAuth, 0, len(auths))
+	for _, auth := range auths {
+		registryAuths = append(registryAuths, workloads.ComposeRegistryAuth{
+			Registry:  auth.Registry,
+			BasicAuth: workloads.HelmRepoBasicAuthentication{Username: auth.Username, Password: auth.Password},
+		})
+	}
+	return registryAuths, nil
+}
+
+// helmRegistryAuths are the credentials of the private OCI registry the helm component pulls its
+// chart from
+func (dm *DeploymentManager) helmRegistryAuths(component sbi.AppDeploymentProfile_Components_Item) ([]workloads.HelmRegistryAuth, error) {
+	auths, err := dm.registryAuths(component)
+	if err != nil {
+		return nil, fmt.Errorf("invalid helm component: %w", err)
+	}
+	registryAuths := make([]workloads.HelmRegistryAuth, 0, len(auths))
+	for _, auth := range auths {
+		registryAuths = append(registryAuths, workloads.HelmRegistryAuth{
+			Registry:  auth.Registry,
+			BasicAuth: workloads.HelmRepoBasicAuthentication{Username: auth.Username, Password: auth.Password},
+		})
+	}
+	return registryAuths, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/shared-lib/workloads"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestComposeRegistryAuths(t *testing.T) {
+	dm := NewDeploymentManager(nil, nil, nil, zap.NewNop().Sugar())
+	manifest := changeManifest(t, `"revision": "1.2.0"`,
+		`"revision": "1.2.0", "registryAuth": [{"registry": "registry.local:5000", "username": "deployer", "password": "s3cret"}]`)
+	auths, err := dm.composeRegistryAuths(manifest.Spec.DeploymentProfile.Components[0])
+	require.NoError(t, err)
+	assert.Equal(t, []workloads.ComposeRegistryAuth{{
+		Registry:  "registry.local:5000",
+		BasicAuth: workloads.HelmRepoBasicAuthentication{Username: "deployer", Password: "s3cret"},
+	}}, auths)
+
+	auths, err = dm.composeRegistryAuths(changeManifest(t).Spec.DeploymentProfile.Components[0])
+	require.NoError(t, err)
+	assert.Empty(t, auths, "public images need no credentials")
+
+	manifest = changeManifest(t, `"revision": "1.2.0"`, `"revision": "1.2.0", "registryAuth": [{"registry": "registry.local", "password": "s3cret"}]`)
+	_, err = dm.composeRegistryAuths(manifest.Spec.DeploymentProfile.Components[0])
+	assert.ErrorContains(t, err, "registryAuth[0] of registry registry.local has no username")
+}
+
+func TestHelmRegistryAuths_PasswordRef(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "charts.token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("rotated-token\n"), 0o600))
+	dm := NewDeploymentManager(nil, nil, nil, zap.NewNop().Sugar(), WithRegistryCredentials(map[string]types.RegistryCredentialConfig{
+		"charts": {PasswordFile: tokenFile},
+	}))
+
+	manifest := changeManifest(t, `"revision": "1.2.0"`,
+		`"revision": "1.2.0", "registryAuth": [{"registry": "oci://registry.local:5000", "username": "deployer", "passwordRef": "charts"}]`)
+	auths, err := dm.helmRegistryAuths(manifest.Spec.DeploymentProfile.Components[0])
+	require.NoError(t, err)
+	assert.Equal(t, []workloads.HelmRegistryAuth{{
+		Registry:  "oci://registry.local:5000",
+		BasicAuth: workloads.HelmRepoBasicAuthentication{Username: "deployer", Password: "rotated-token"},
+	}}, auths)
+
+	manifest = changeManifest(t, `"revision": "1.2.0"`,
+		`"revision": "1.2.0", "registryAuth": [{"registry": "registry.local", "username": "deployer", "passwordRef": "images"}]`)
+	_, err = dm.helmRegistryAuths(manifest.Spec.DeploymentProfile.Components[0])
+	assert.ErrorContains(t, err, `registryAuth[0] of registry registry.local refers to the unknown credential "images"`)
+
+	manifest = changeManifest(t, `"revision": "1.2.0"`,
+		`"revision": "1.2.0", "registryAuth": [{"registry": "registry.local", "username": "deployer", "password": "s3cret", "passwordRef": "charts"}]`)
+	_, err = dm.helmRegistryAuths(manifest.Spec.DeploymentProfile.Components[0])
+	assert.ErrorContains(t, err, "sets both password and passwordRef")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// Annotations of a deployment guarding it against accidental removals from the WFM
+const (
+	// annotationProtectRemoval set to "true" keeps the deployment on the device when a manifest
+	// no longer lists it
+	annotationProtectRemoval = "margo.org/protect-removal"
+	// annotationConfirmRemoval set to "true" removes the deployment, protected or not, the WFM
+	// delivers it once more with the annotation to confirm the removal
+	annotationConfirmRemoval = "margo.org/confirm-removal"
+)
+
+// Phases of protected deployments the WFM dropped without confirming the removal, the workload keeps
+// running in both
+const (
+	// phaseRemovalBlocked holds the removal until it is confirmed, the deployment reappears or the
+	// removal is overridden on the device
+	phaseRemovalBlocked = "REMOVAL_BLOCKED"
+	// phaseRemovalOverdue is a removal blocked for longer than the configured escalation delay
+	phaseRemovalOverdue = "REMOVAL_BLOCKED_OVERDUE"
+)
+
+// WithRemovalProtection sets how long a protected deployment may stay blocked before its report is
+// escalated
+func WithRemovalProtection(cfg *types.RemovalProtectionConfig) DeploymentManagerOption {
+	return func(dm *DeploymentManager) {
+		dm.removalProtection = cfg
+	}
+}
+
+// annotatedTrue reports whether the annotation of the deployment is set to "true"
+func annotatedTrue(deployment sbi.AppDeploymentManifest, annotation string) bool {
+	if deployment.Metadata.Annotations == nil {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace((*deployment.Metadata.Annotations)[annotation]), "true")
+}
+
+func isRemovalBlocked(record *database.DeploymentRecord) bool {
+	return record.Phase == phaseRemovalBlocked || record.Phase == phaseRemovalOverdue
+}
+
+// removalUnprotected reports whether the deployment can be removed. The removal of a protected
+// deployment waits in phaseRemovalBlocked, or phaseRemovalOverdue once it waited for longer than the
+// escalation delay, unless it was overridden on the device.
+func (dm *DeploymentManager) removalUnprotected(ctx context.Context, record *database.DeploymentRecord) bool {
+	if !record.RemovalProtected {
+		return true
+	}
+	// the override is consumed with the removal, removalAllowed may still need it
+	if _, forced := dm.forcedRemovals.Load(record.DeploymentID); forced {
+		dm.log.Warnw("Overriding the removal protection of the deployment",
+			"audit", true,
+			"deploymentId", record.DeploymentID,
+			"appId", record.AppID,
+			"phase", record.Phase,
+			"blockedSince", record.RemovalBlockedSince)
+		return true
+	}
+
+	since := record.RemovalBlockedSince
+	if since == nil {
+		now := time.Now()
+		since = &now
+		dm.database.SetRemovalBlockedSince(record.DeploymentID, since)
+	}
+
+	phase := phaseRemovalBlocked
+	message := fmt.Sprintf("removal of a protected deployment blocked since %s, confirm it with the %s annotation or override it on the device",
+		since.UTC().Format(time.RFC3339), annotationConfirmRemoval)
+	if time.Since(*since) >= dm.removalProtection.EscalateAfter() {
+		phase = phaseRemovalOverdue
+	}
+	if record.Phase != phase || record.Message != message {
+		dm.log.Warnw("Holding the removal of a protected deployment",
+			"deploymentId", record.DeploymentID, "appId", record.AppID, "phase", phase, "blockedSince", *since)
+		dm.setPhase(ctx, record.DeploymentID, phase, message)
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const protectedDeploymentId = "deployment-plc"
+
+// protectionTestEnv syncs manifests from a test server and reconciles the deployments they deliver
+type protectionTestEnv struct {
+	*limitsTestEnv
+	t       *testing.T
+	dm      *DeploymentManager
+	version sbi.ManifestVersion
+}
+
+func newProtectionTestEnv(t *testing.T) *protectionTestEnv {
+	server := &limitsTestServer{deployments: map[string][]byte{}}
+	env := &protectionTestEnv{limitsTestEnv: newLimitsTestEnv(t, server, wfm.ManifestLimits{}), t: t, version: 1}
+	env.dm = NewDeploymentManager(env.db, nil, nil, zap.NewNop().Sugar(),
+		WithRemovalProtection(&types.RemovalProtectionConfig{EscalateAfterSeconds: 3600}))
+	return env
+}
+
+// plcDeploymentYAML is a deployment with the given annotations set to "true", revision tells
+// versions of it apart
+func plcDeploymentYAML(revision int, annotations ...string) []byte {
+	yaml := fmt.Sprintf("apiVersion: application.margo.org/v1alpha1\nkind: ApplicationDeployment\nmetadata:\n  name: plc-bridge-%d\n", revision)
+	if len(annotations) > 0 {
+		yaml += "  annotations:\n"
+		for _, annotation := range annotations {
+			yaml += fmt.Sprintf("    %s: \"true\"\n", annotation)
+		}
+	}
+	yaml += "spec:\n  deploymentProfile:\n    type: helm.v3\n    components:\n" +
+		"      - name: plc-bridge\n        properties:\n          repository: oci://registry.local/charts/plc-bridge\n"
+	return []byte(yaml)
+}
+
+// deliver syncs the next manifest version listing the given deployments
+func (env *protectionTestEnv) deliver(deployments map[string][]byte) {
+	env.version++
+	for _, data := range deployments {
+		env.server.deployments[testDigest(data)] = data
+	}
+	env.server.manifest = versionedManifest(env.version, fmt.Sprintf(`"v%v"`, env.version), deployments, nil)
+	env.syncer.performSync()
+}
+
+// install records the desired state of the deployment as installed
+func (env *protectionTestEnv) install(deploymentId string) {
+	env.t.Helper()
+	installed := *env.record(deploymentId).DesiredState
+	installed.Status.Status.State = sbi.DeploymentStatusManifestStatusStateInstalled
+	env.db.SetCurrentState(deploymentId, installed)
+	env.db.SetPhase(deploymentId, "RUNNING", "Deployment successful")
+}
+
+func (env *protectionTestEnv) record(deploymentId string) *database.DeploymentRecord {
+	env.t.Helper()
+	record, err := env.db.GetDeployment(deploymentId)
+	require.NoError(env.t, err)
+	return record
+}
+
+// blockRemoval installs a protected deployment and drops it from the manifest
+func (env *protectionTestEnv) blockRemoval() {
+	env.t.Helper()
+	env.deliver(map[string][]byte{protectedDeploymentId: plcDeploymentYAML(1, annotationProtectRemoval)})
+	env.install(protectedDeploymentId)
+	require.True(env.t, env.record(protectedDeploymentId).RemovalProtected)
+
+	env.deliver(map[string][]byte{})
+	env.dm.reconcileDeployment(protectedDeploymentId)
+	require.Equal(env.t, phaseRemovalBlocked, env.record(protectedDeploymentId).Phase)
+}
+
+func TestRemovalProtection_BlocksUnconfirmedRemoval(t *testing.T) {
+	env := newProtectionTestEnv(t)
+	env.blockRemoval()
+
+	record := env.record(protectedDeploymentId)
+	assert.Equal(t, sbi.DeploymentStatusManifestStatusStateRemoving, record.DesiredState.Status.Status.State)
+	assert.Equal(t, sbi.DeploymentStatusManifestStatusStateInstalled, record.CurrentState.Status.Status.State, "the workload keeps running")
+	assert.Contains(t, record.Message, annotationConfirmRemoval)
+	require.NotNil(t, record.RemovalBlockedSince)
+	assert.False(t, isDeploymentTombstone(record), "the deployment may come back, its cache entry stays servable")
+
+	// later reconciliations keep it blocked since the first one
+	blockedSince := *record.RemovalBlockedSince
+	env.dm.reconcileDeployment(protectedDeploymentId)
+	record = env.record(protectedDeploymentId)
+	assert.Equal(t, phaseRemovalBlocked, record.Phase)
+	assert.Equal(t, blockedSince, *record.RemovalBlockedSince)
+
+	// blocked for longer than the escalation delay
+	longAgo := time.Now().Add(-2 * time.Hour)
+	env.db.SetRemovalBlockedSince(protectedDeploymentId, &longAgo)
+	env.dm.reconcileDeployment(protectedDeploymentId)
+	assert.Equal(t, phaseRemovalOverdue, env.record(protectedDeploymentId).Phase)
+
+	// the deployment reappears, its removal is called off
+	env.deliver(map[string][]byte{protectedDeploymentId: plcDeploymentYAML(1, annotationProtectRemoval)})
+	record = env.record(protectedDeploymentId)
+	assert.Equal(t, "RUNNING", record.Phase)
+	assert.Nil(t, record.RemovalBlockedSince)
+	assert.Equal(t, sbi.DeploymentStatusManifestStatusStatePending, record.DesiredState.Status.Status.State)
+	assert.True(t, record.RemovalProtected)
+}
+
+func TestRemovalProtection_ConfirmedRemoval(t *testing.T) {
+	env := newProtectionTestEnv(t)
+	env.blockRemoval()
+
+	env.deliver(map[string][]byte{
+		protectedDeploymentId: plcDeploymentYAML(1, annotationProtectRemoval, annotationConfirmRemoval),
+		// nothing to remove for deployments the device does not know
+		"deployment-unknown": plcDeploymentYAML(2, annotationConfirmRemoval),
+	})
+	_, err := env.db.GetDeployment("deployment-unknown")
+	assert.Error(t, err)
+
+	record := env.record(protectedDeploymentId)
+	assert.False(t, record.RemovalProtected)
+	assert.Equal(t, sbi.DeploymentStatusManifestStatusStateRemoving, record.DesiredState.Status.Status.State)
+
+	env.dm.reconcileDeployment(protectedDeploymentId)
+	_, err = env.db.GetDeployment(protectedDeploymentId)
+	assert.Error(t, err, "the confirmed removal goes ahead")
+}
+
+func TestRemovalProtection_LocalOverride(t *testing.T) {
+	env := newProtectionTestEnv(t)
+	env.blockRemoval()
+
+	require.NoError(t, env.dm.ForceRemoval(protectedDeploymentId))
+	env.dm.reconcileDeployment(protectedDeploymentId)
+	_, err := env.db.GetDeployment(protectedDeploymentId)
+	assert.Error(t, err, "the overridden removal goes ahead")
+}
+
+func TestRemovalProtection_AddedMidLifecycle(t *testing.T) {
+	env := newProtectionTestEnv(t)
+	env.deliver(map[string][]byte{protectedDeploymentId: plcDeploymentYAML(1)})
+	env.install(protectedDeploymentId)
+	assert.False(t, env.record(protectedDeploymentId).RemovalProtected)
+
+	// the next version of the deployment asks for protection
+	env.deliver(map[string][]byte{protectedDeploymentId: plcDeploymentYAML(2, annotationProtectRemoval)})
+	assert.True(t, env.record(protectedDeploymentId).RemovalProtected)
+
+	env.deliver(map[string][]byte{})
+	env.dm.reconcileDeployment(protectedDeploymentId)
+	record := env.record(protectedDeploymentId)
+	assert.Equal(t, phaseRemovalBlocked, record.Phase)
+	assert.NotNil(t, record.CurrentState)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/margo/sandbox/poc/device/agent/breaker"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// RuntimeBreakers are the circuit breakers of the runtime clients, a runtime without a breaker is
+// always tried
+type RuntimeBreakers struct {
+	Helm    *breaker.Breaker
+	Compose *breaker.Breaker
+}
+
+func (rb RuntimeBreakers) forProfile(profileType sbi.AppDeploymentProfileType) *breaker.Breaker {
+	switch profileType {
+	case sbi.HelmV3:
+		return rb.Helm
+	case sbi.Compose:
+		return rb.Compose
+	}
+	return nil
+}
+
+// all returns the configured breakers
+func (rb RuntimeBreakers) all() []*breaker.Breaker {
+	var breakers []*breaker.Breaker
+	for _, b := range []*breaker.Breaker{rb.Helm, rb.Compose} {
+		if b != nil {
+			breakers = append(breakers, b)
+		}
+	}
+	return breakers
+}
+
+// allow returns a *breaker.UnavailableError while the circuit of the runtime is open
+func (rb RuntimeBreakers) allow(profileType sbi.AppDeploymentProfileType) error {
+	if b := rb.forProfile(profileType); b != nil {
+		return b.Allow()
+	}
+	return nil
+}
+
+// record counts the outcome of an operation against the runtime
+func (rb RuntimeBreakers) record(profileType sbi.AppDeploymentProfileType, err error) {
+	if b := rb.forProfile(profileType); b != nil {
+		b.Record(err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/breaker"
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDeploymentManager_WaitsForOpenCircuitAndRetriesOnClose(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := newTestDatabase(t, "data")
+
+	var available atomic.Bool
+	composeBreaker := breaker.New(health.ComponentRuntimeCompose, func(ctx context.Context) error {
+		if !available.Load() {
+			return errors.New("docker daemon not reachable: Is the docker daemon running?")
+		}
+		return nil
+	}, breaker.Config{FailureThreshold: 1, WarmCheckInterval: -1, ProbeInterval: time.Millisecond})
+	composeBreaker.Record(errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock"))
+	require.Equal(t, breaker.StateOpen, composeBreaker.State())
+
+	// without a compose client a deployment that gets past the breaker fails right away, which
+	// tells the attempts apart
+	dm := NewDeploymentManager(db, nil, nil, zap.NewNop().Sugar(), WithDeploymentBreakers(RuntimeBreakers{Compose: composeBreaker}))
+	dm.Start()
+	t.Cleanup(dm.Stop)
+
+	const deploymentId = "5f0c3a2e-6c1d-4f1e-9a55-000000000002"
+	desired := database.AppDeploymentState{AppDeploymentManifest: newOneShotComposeDeployment(t, ""), LastUpdated: time.Now()}
+	desired.Status.Status.State = sbi.DeploymentStatusManifestStatusStateInstalling
+	require.NoError(t, db.SetDesiredState(deploymentId, desired))
+
+	phaseOf := func() (string, string) {
+		record, err := db.GetDeployment(deploymentId)
+		require.NoError(t, err)
+		return record.Phase, record.Message
+	}
+	require.Eventually(t, func() bool {
+		phase, message := phaseOf()
+		return phase == "PENDING" && strings.HasPrefix(message, breaker.CodeRuntimeUnavailable)
+	}, time.Second, 5*time.Millisecond)
+
+	// the deployment is waiting, not failed
+	record, err := db.GetDeployment(deploymentId)
+	require.NoError(t, err)
+	assert.Nil(t, record.CurrentState)
+	assert.True(t, db.NeedsReconciliation(deploymentId))
+
+	available.Store(true)
+	require.Eventually(t, func() bool {
+		return composeBreaker.ProbeIfDue(context.Background())
+	}, time.Second, time.Millisecond)
+	require.Equal(t, breaker.StateClosed, composeBreaker.State())
+
+	require.Eventually(t, func() bool {
+		phase, message := phaseOf()
+		return phase == "FAILED" && strings.Contains(message, "Docker Compose client not initialized")
+	}, time.Second, 5*time.Millisecond, "closing the circuit retries the deployment")
+}
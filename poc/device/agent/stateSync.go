@@ -2,19 +2,35 @@
 package main
 
 import (
+    "bytes"
     "context"
     "crypto"
-    "crypto/sha256"
     "encoding/json"
+    "errors"
     "fmt"
+    "io"
+    "math"
+    "math/rand/v2"
     "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
     "time"
 
     "github.com/margo/sandbox/poc/device/agent/database"
+    "github.com/margo/sandbox/poc/device/agent/health"
+    "github.com/margo/sandbox/poc/device/agent/hooks"
+    "github.com/margo/sandbox/poc/device/agent/metrics"
+    "github.com/margo/sandbox/poc/device/agent/types"
     wfm "github.com/margo/sandbox/poc/wfm/cli"
     "github.com/margo/sandbox/shared-lib/archive"  
+    sharedCrypto "github.com/margo/sandbox/shared-lib/crypto"
+    "github.com/margo/sandbox/shared-lib/digest"
     "github.com/margo/sandbox/shared-lib/http/auth"
     "github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+    "github.com/margo/sandbox/standard/pkg"
     "go.uber.org/zap"
     "gopkg.in/yaml.v2"
 )
@@ -23,32 +39,224 @@ import (
 type StateSyncerIfc interface {
 	Start()
 	Stop()
+	SyncNow(ctx context.Context, trigger SyncTrigger) (SyncOutcome, error)
+	TriggerSync()
 }
 
 type StateSyncer struct {
-	database                  *database.Database
+	database                  database.DatabaseIfc
 	apiClient                 wfm.SBIAPIClientInterface
 	requestSigner             crypto.Signer
 	deviceID                  string
 	log                       *zap.SugaredLogger
+	ctx                       context.Context
+	cancel                    context.CancelFunc
 	stopChan                  chan struct{}
+	// triggerChan asks the sync loop for a sync before the next tick, it holds one pending trigger
+	triggerChan               chan struct{}
 	stateSyncingIntervalInSec uint16
+	longPoll                  *types.LongPollConfig
+	longPollMetrics           longPollCounters
+	// quickChangeServed is set once a long poll answered a change right away and the next sync
+	// skipped the interval, a long poll honoring the wait clears it
+	quickChangeServed         atomic.Bool
+	emitEvent                 func(hooks.Event)
+	// outcomeMu guards the sync outcome, it is read by the health endpoints
+	outcomeMu                 sync.Mutex
+	consecutiveSyncFailures   int
+	syncDegraded              bool
+	lastSyncError             error
+	lastSuccessfulSync        time.Time
+	nextSyncDelayed           time.Duration
+	nextSyncAt                time.Time
+	backoff                   *types.SyncBackoffConfig
+	// backoffJitter returns a number in [0, 1) that picks the share of the jitter cut off
+	backoffJitter             func() float64
+	limits                    wfm.ManifestLimits
+	announcedLimits           wfm.ManifestLimits
+	// syncSlot is held while a sync runs, scheduled and triggered syncs never overlap
+	syncSlot                  chan struct{}
+	// requireSignedManifests rejects unsigned manifests, the client verifies the signed ones
+	requireSignedManifests    bool
+	unsignedManifestWarning   sync.Once
+	// bundleVerifier verifies the signatures of bundles before they are extracted, nil accepts
+	// unsigned bundles
+	bundleVerifier            *sharedCrypto.ManifestVerifier
+	// fetchConcurrency is the number of deployments fetched at once when they are not bundled
+	fetchConcurrency          int
+	// bundleFetch decides between the bundle and individual fetches, nil keeps the defaults
+	bundleFetch               *types.BundleFetchConfig
+	metrics                   metrics.Recorder
+	// bundleDownloadDir holds the bundles downloaded to disk while they are extracted
+	bundleDownloadDir         string
+}
+
+// syncDegradedThreshold is the number of consecutive failed syncs after which sync is reported degraded
+const syncDegradedThreshold = 3
+
+// StateSyncerOption configures optional StateSyncer behaviour
+type StateSyncerOption func(ss *StateSyncer)
+
+// WithLongPolling enables long-poll sync requests when the configuration asks for it
+func WithLongPolling(cfg *types.LongPollConfig) StateSyncerOption {
+	return func(ss *StateSyncer) {
+		ss.longPoll = cfg
+	}
+}
+
+// WithSyncEvents emits sync.degraded and sync.recovered events when syncing with the WFM keeps
+// failing and when it works again
+func WithSyncEvents(emit func(hooks.Event)) StateSyncerOption {
+	return func(ss *StateSyncer) {
+		ss.emitEvent = emit
+	}
+}
+
+// WithManifestLimits bounds the manifests the syncer accepts, unset limits keep their defaults
+func WithManifestLimits(limits wfm.ManifestLimits) StateSyncerOption {
+	return func(ss *StateSyncer) {
+		ss.limits = limits.WithDefaults()
+	}
+}
+
+// WithRequiredManifestSignatures rejects manifests the WFM did not sign, the sbi client has to be
+// set up to verify the signed ones
+func WithRequiredManifestSignatures() StateSyncerOption {
+	return func(ss *StateSyncer) {
+		ss.requireSignedManifests = true
+	}
+}
+
+// WithBundleVerifier rejects bundles that are not signed or whose signature does not verify against
+// the key or CA of the verifier, nothing of a rejected bundle is extracted
+func WithBundleVerifier(verifier *sharedCrypto.ManifestVerifier) StateSyncerOption {
+	return func(ss *StateSyncer) {
+		ss.bundleVerifier = verifier
+	}
+}
+
+// WithSyncBackoff tunes how the interval grows while syncs keep failing, nil keeps the defaults
+func WithSyncBackoff(cfg *types.SyncBackoffConfig) StateSyncerOption {
+	return func(ss *StateSyncer) {
+		ss.backoff = cfg
+	}
+}
+
+// WithFetchConcurrency sets how many deployments are fetched at once when the manifest has no bundle,
+// 0 keeps the defaultFetchConcurrency
+func WithFetchConcurrency(concurrency int) StateSyncerOption {
+	return func(ss *StateSyncer) {
+		if concurrency > 0 {
+			ss.fetchConcurrency = concurrency
+		}
+	}
+}
+
+// WithBundleFetch sets when the bundle of a manifest is downloaded instead of its deployments one
+// by one, nil keeps the defaults
+func WithBundleFetch(cfg *types.BundleFetchConfig) StateSyncerOption {
+	return func(ss *StateSyncer) {
+		ss.bundleFetch = cfg
+	}
+}
+
+// WithSyncMetrics records the attempts and outcomes of the syncs, nil keeps them unrecorded
+func WithSyncMetrics(recorder metrics.Recorder) StateSyncerOption {
+	return func(ss *StateSyncer) {
+		if recorder != nil {
+			ss.metrics = recorder
+		}
+	}
+}
+
+// WithBundleDownloadDir sets where bundles too large for memory are downloaded to, an empty dir
+// keeps defaultBundleDownloadDir
+func WithBundleDownloadDir(dir string) StateSyncerOption {
+	return func(ss *StateSyncer) {
+		if dir != "" {
+			ss.bundleDownloadDir = dir
+		}
+	}
+}
+
+// defaultFetchConcurrency is the number of deployments fetched at once by default
+const defaultFetchConcurrency = 4
+
+// syncResult tells the sync loop how the last sync attempt ended, so it can pick the next delay
+type syncResult int
+
+const (
+	// syncResultPolled is a regular poll, the next sync waits the normal interval
+	syncResultPolled syncResult = iota
+	// syncResultLongPollCompleted means the server held the request and answered, sync again right away
+	syncResultLongPollCompleted
+	// syncResultLongPollDropped means the long poll broke off, reconnect after a short jittered delay
+	syncResultLongPollDropped
+)
+
+// SyncTrigger tells who asked for a sync out of schedule
+type SyncTrigger struct {
+	// ID correlates the log entries and the sync history record of the sync
+	ID string
+	// Source describes the requester, e.g. the remote address of a control request
+	Source string
+}
+
+// SyncOutcome summarizes what a sync did
+type SyncOutcome struct {
+	TriggerID  string    `json:"triggerId,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	DurationMs int64     `json:"durationMs"`
+	// Changed is true when a new manifest was applied
+	Changed         bool     `json:"changed"`
+	ManifestVersion uint64   `json:"manifestVersion,omitempty"`
+	Delivered       []string `json:"delivered,omitempty"`
+	Removed         []string `json:"removed,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// LongPollMetrics records how the WFM responded to long-poll sync requests
+type LongPollMetrics struct {
+	Honored    uint64
+	NotHonored uint64
+	Dropped    uint64
+}
+
+type longPollCounters struct {
+	honored    atomic.Uint64
+	notHonored atomic.Uint64
+	dropped    atomic.Uint64
 }
 
 func NewStateSyncer(
-	db *database.Database,
+	db database.DatabaseIfc,
 	client wfm.SBIAPIClientInterface,
 	deviceID string,
 	stateSeekingIntervalInSec uint16,
-	log *zap.SugaredLogger) *StateSyncer {
-	return &StateSyncer{
+	log *zap.SugaredLogger,
+	opts ...StateSyncerOption) *StateSyncer {
+	ctx, cancel := context.WithCancel(context.Background())
+	ss := &StateSyncer{
 		database:                  db,
 		apiClient:                 client,
 		deviceID:                  deviceID,
 		log:                       log,
+		ctx:                       ctx,
+		cancel:                    cancel,
 		stopChan:                  make(chan struct{}),
+		triggerChan:               make(chan struct{}, 1),
 		stateSyncingIntervalInSec: stateSeekingIntervalInSec,
+		limits:                    wfm.DefaultManifestLimits(),
+		syncSlot:                  make(chan struct{}, 1),
+		backoffJitter:             rand.Float64,
+		fetchConcurrency:          defaultFetchConcurrency,
+		metrics:                   metrics.Nop{},
+		bundleDownloadDir:         defaultBundleDownloadDir,
+	}
+	for _, opt := range opts {
+		opt(ss)
 	}
+	return ss
 }
 
 func (ss *StateSyncer) Start() {
@@ -56,71 +264,394 @@ func (ss *StateSyncer) Start() {
 }
 
 func (ss *StateSyncer) Stop() {
+	// cancel first so that an open long poll is released immediately
+	ss.cancel()
 	close(ss.stopChan)
 }
 
+// LongPollMetrics returns how often the server honored, ignored or dropped long-poll requests
+func (ss *StateSyncer) LongPollMetrics() LongPollMetrics {
+	return LongPollMetrics{
+		Honored:    ss.longPollMetrics.honored.Load(),
+		NotHonored: ss.longPollMetrics.notHonored.Load(),
+		Dropped:    ss.longPollMetrics.dropped.Load(),
+	}
+}
+
 func (ss *StateSyncer) syncLoop() {
-	ticker := time.NewTicker(time.Duration(ss.stateSyncingIntervalInSec) * time.Second)
-	defer ticker.Stop()
+	timer := time.NewTimer(ss.pollInterval())
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			ss.performSync()
+		case <-timer.C:
+		case <-ss.triggerChan:
+			// the tick is replaced, Reset drops it from the timer
+			ss.log.Debugw("Sync triggered before the next tick")
 		case <-ss.stopChan:
 			return
 		}
+		delay := ss.nextSyncDelay(ss.performSync())
+		ss.recordNextSync(delay)
+		timer.Reset(delay)
 	}
 }
 
-func (ss *StateSyncer) performSync() {
+func (ss *StateSyncer) pollInterval() time.Duration {
+	return time.Duration(ss.stateSyncingIntervalInSec) * time.Second
+}
+
+func (ss *StateSyncer) longPollEnabled() bool {
+	return ss.longPoll != nil && ss.longPoll.Enabled && ss.longPoll.WaitSeconds > 0
+}
+
+func (ss *StateSyncer) longPollWait() time.Duration {
+	return time.Duration(ss.longPoll.WaitSeconds) * time.Second
+}
+
+// syncTimeout bounds a single sync request, long polls get the wait on top of the regular timeout
+func (ss *StateSyncer) syncTimeout() time.Duration {
+	timeout := 30 * time.Second
+	if ss.longPollEnabled() {
+		timeout += ss.longPollWait()
+	}
+	return timeout
+}
+
+func (ss *StateSyncer) nextSyncDelay(result syncResult) time.Duration {
+	ss.outcomeMu.Lock()
+	failures := ss.consecutiveSyncFailures
+	ss.outcomeMu.Unlock()
+
+	// a single dropped long poll reconnects quickly below, repeated failures back off
+	if failures > 1 || (failures == 1 && result != syncResultLongPollDropped) {
+		if delay, backingOff := ss.backoffDelay(failures); backingOff {
+			return delay
+		}
+	}
+
+	switch result {
+	case syncResultLongPollCompleted:
+		return 0
+	case syncResultLongPollDropped:
+		// spread reconnects so that a restarting server is not hit by every device at once
+		return time.Second + rand.N(ss.pollInterval()+1)
+	default:
+		return ss.pollInterval()
+	}
+}
+
+// backoffDelay multiplies the interval for every failed sync after the first, up to the maximum, and
+// cuts a random share of the jitter off it. The first successful sync restores the interval.
+func (ss *StateSyncer) backoffDelay(failures int) (time.Duration, bool) {
+	if !ss.backoff.Enabled() || failures == 0 {
+		return 0, false
+	}
+	maxInterval := ss.backoff.MaxInterval()
+	delay := float64(ss.pollInterval()) * math.Pow(ss.backoff.BackoffMultiplier(), float64(failures-1))
+	if delay > float64(maxInterval) {
+		delay = float64(maxInterval)
+	}
+	delay -= delay * ss.backoff.JitterFraction() * ss.backoffJitter()
+	return time.Duration(delay), true
+}
+
+// recordNextSync keeps when the sync loop syncs next, for GetSyncStats
+func (ss *StateSyncer) recordNextSync(delay time.Duration) {
+	ss.outcomeMu.Lock()
+	defer ss.outcomeMu.Unlock()
+	ss.nextSyncDelayed = delay
+	ss.nextSyncAt = time.Now().Add(delay)
+}
+
+// SyncStats describes the recent syncs and whether the sync loop is backing off
+type SyncStats struct {
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastSuccessfulSync  time.Time `json:"lastSuccessfulSync,omitempty"`
+	// BackingOff is set while failed syncs stretch the interval
+	BackingOff bool `json:"backingOff"`
+	// NextDelay is how long the sync loop waits after the last sync, NextSyncAt when it syncs next
+	NextDelay  time.Duration `json:"nextDelay"`
+	NextSyncAt time.Time     `json:"nextSyncAt,omitempty"`
+}
+
+// GetSyncStats returns the backoff state of the sync loop
+func (ss *StateSyncer) GetSyncStats() SyncStats {
+	ss.outcomeMu.Lock()
+	defer ss.outcomeMu.Unlock()
+	stats := SyncStats{
+		ConsecutiveFailures: ss.consecutiveSyncFailures,
+		LastSuccessfulSync:  ss.lastSuccessfulSync,
+		BackingOff:          ss.consecutiveSyncFailures > 0 && ss.backoff.Enabled(),
+		NextDelay:           ss.nextSyncDelayed,
+		NextSyncAt:          ss.nextSyncAt,
+	}
+	if ss.consecutiveSyncFailures > 0 && ss.lastSyncError != nil {
+		stats.LastError = ss.lastSyncError.Error()
+	}
+	return stats
+}
+
+// classifyLongPoll decides whether the server honored the wait preference. A server that answers
+// quickly without acknowledging the preference is treated as a plain poll, so the normal interval applies.
+func (ss *StateSyncer) classifyLongPoll(response *http.Response, err error, elapsed time.Duration) syncResult {
+	if !ss.longPollEnabled() {
+		return syncResultPolled
+	}
+
+	if err != nil {
+		if ss.ctx.Err() != nil || isLimitExceeded(err) {
+			// stopping or a rejected manifest, not a dropped connection
+			return syncResultPolled
+		}
+		ss.longPollMetrics.dropped.Add(1)
+		return syncResultLongPollDropped
+	}
+
+	if wfm.IsLongPollHonored(response) || elapsed >= ss.longPollWait()/2 {
+		ss.quickChangeServed.Store(false)
+		ss.longPollMetrics.honored.Add(1)
+		return syncResultLongPollCompleted
+	}
+	// a change may have been ready anyway, the next request tells whether the server holds it open.
+	// Only once in a row: a server ignoring the wait and the ETag answers 200 every time.
+	if response != nil && response.StatusCode == http.StatusOK && !ss.quickChangeServed.Swap(true) {
+		return syncResultLongPollCompleted
+	}
+
+	ss.longPollMetrics.notHonored.Add(1)
+	ss.log.Debugw("Server did not honor long poll, falling back to regular polling",
+		"elapsed", elapsed, "requestedWait", ss.longPollWait())
+	return syncResultPolled
+}
+
+// recordSyncOutcome tracks consecutive sync failures and emits an event when sync becomes degraded
+// or recovers. Failures caused by the syncer being stopped are not counted.
+func (ss *StateSyncer) recordSyncOutcome(deviceId string, err error) {
+	if err != nil && ss.ctx.Err() != nil {
+		return
+	}
+	ss.metrics.SyncAttempted()
+	if err != nil {
+		ss.metrics.SyncFailed()
+	}
+
+	ss.outcomeMu.Lock()
+	var event *hooks.Event
+	ss.lastSyncError = err
+	if err != nil {
+		ss.consecutiveSyncFailures++
+		// a manifest over a limit is rejected again on every sync, so there is no point in waiting
+		limitErr := isLimitExceeded(err)
+		if !ss.syncDegraded && (limitErr || ss.consecutiveSyncFailures >= syncDegradedThreshold) {
+			ss.syncDegraded = true
+			degraded := hooks.NewEvent(hooks.EventTypeSyncDegraded)
+			if limitErr {
+				degraded.Message = fmt.Sprintf("manifest rejected: %v", err)
+			} else {
+				degraded.Message = fmt.Sprintf("%d consecutive syncs failed, last error: %v", ss.consecutiveSyncFailures, err)
+			}
+			event = &degraded
+		}
+	} else {
+		if ss.syncDegraded {
+			recovered := hooks.NewEvent(hooks.EventTypeSyncRecovered)
+			recovered.Message = fmt.Sprintf("sync recovered after %d failed attempts", ss.consecutiveSyncFailures)
+			event = &recovered
+		}
+		ss.consecutiveSyncFailures = 0
+		ss.syncDegraded = false
+		ss.lastSuccessfulSync = time.Now()
+		ss.metrics.SyncSucceeded(ss.lastSuccessfulSync)
+	}
+	ss.outcomeMu.Unlock()
+
+	if event != nil && ss.emitEvent != nil {
+		event.DeviceID = deviceId
+		ss.emitEvent(*event)
+	}
+}
+
+func (ss *StateSyncer) Name() string {
+	return health.ComponentSyncer
+}
+
+// maxSyncAge is how old the last successful sync may get before the syncer is degraded, twice the
+// time between two syncs, which includes the wait of a long poll
+func (ss *StateSyncer) maxSyncAge() time.Duration {
+	between := ss.pollInterval()
+	if ss.longPollEnabled() {
+		between += ss.longPollWait()
+	}
+	return 2 * between
+}
+
+// Health is degraded once sync is reported degraded, see recordSyncOutcome, and while no sync
+// succeeded within maxSyncAge, which keeps a freshly started agent from being ready before it
+// learnt the desired state
+func (ss *StateSyncer) Health() health.Report {
+	ss.outcomeMu.Lock()
+	defer ss.outcomeMu.Unlock()
+
+	metrics := map[string]float64{
+		"consecutiveFailures": float64(ss.consecutiveSyncFailures),
+	}
+	if ss.consecutiveSyncFailures > 0 && ss.backoff.Enabled() {
+		metrics["backoffSeconds"] = ss.nextSyncDelayed.Seconds()
+	}
+	if !ss.lastSuccessfulSync.IsZero() {
+		metrics["secondsSinceSuccessfulSync"] = time.Since(ss.lastSuccessfulSync).Seconds()
+	}
+	report := health.OK(metrics)
+	if ss.syncDegraded {
+		report.Degrade(fmt.Sprintf("%d consecutive syncs failed, last error: %v", ss.consecutiveSyncFailures, ss.lastSyncError))
+	}
+	if ss.lastSuccessfulSync.IsZero() {
+		report.Degrade("no sync succeeded yet")
+	} else if age := time.Since(ss.lastSuccessfulSync); age > ss.maxSyncAge() {
+		report.Degrade(fmt.Sprintf("the last successful sync is %s old, more than %s", age.Round(time.Second), ss.maxSyncAge()))
+	}
+	return report
+}
+
+// isLimitExceeded reports whether err rejects a manifest, deployment or bundle for exceeding a limit
+func isLimitExceeded(err error) bool {
+	var limitErr *wfm.LimitExceededError
+	return errors.As(err, &limitErr)
+}
+
+// performSync runs a scheduled sync, it waits for a triggered sync in flight to finish first
+func (ss *StateSyncer) performSync() syncResult {
+    select {
+    case ss.syncSlot <- struct{}{}:
+    case <-ss.ctx.Done():
+        return syncResultPolled
+    }
+    defer func() { <-ss.syncSlot }()
+
+    result, _ := ss.runSync(SyncTrigger{})
+    return result
+}
+
+// TriggerSync asks the sync loop to sync right away instead of on the next tick, without waiting
+// for the sync. Triggers coalesce: while one is pending, further ones are dropped, and a trigger
+// during a sync in flight runs a single sync after it.
+func (ss *StateSyncer) TriggerSync() {
+    select {
+    case ss.triggerChan <- struct{}{}:
+    default:
+    }
+}
+
+// SyncNow syncs right away and returns what the sync did. A sync in flight is not interrupted, the
+// triggered one runs once it finished.
+func (ss *StateSyncer) SyncNow(ctx context.Context, trigger SyncTrigger) (SyncOutcome, error) {
+    select {
+    case ss.syncSlot <- struct{}{}:
+    case <-ctx.Done():
+        return SyncOutcome{}, ctx.Err()
+    case <-ss.ctx.Done():
+        return SyncOutcome{}, fmt.Errorf("syncer is stopped")
+    }
+    defer func() { <-ss.syncSlot }()
+
+    ss.log.Infow("Triggered sync started", "triggerId", trigger.ID, "source", trigger.Source)
+    _, outcome := ss.runSync(trigger)
+    ss.log.Infow("Triggered sync finished", "triggerId", trigger.ID, "changed", outcome.Changed,
+        "manifestVersion", outcome.ManifestVersion, "error", outcome.Error)
+    return outcome, nil
+}
+
+// runSync syncs once, the caller holds the sync slot
+func (ss *StateSyncer) runSync(trigger SyncTrigger) (result syncResult, outcome SyncOutcome) {
     ss.log.Debugf("Performing sync....")
-    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    ctx, cancel := context.WithTimeout(ss.ctx, ss.syncTimeout())
     defer cancel()
 
+    outcome = SyncOutcome{TriggerID: trigger.ID, StartedAt: time.Now()}
+    defer func() {
+        outcome.DurationMs = time.Since(outcome.StartedAt).Milliseconds()
+    }()
+
     // Get device settings
     device, err := ss.database.GetDeviceSettings()
     if err != nil {
         ss.log.Errorw("Sync failed", "err", err.Error(), "msg", "failed to fetch device settings")
-        return
+        ss.metrics.SyncAttempted()
+        ss.metrics.SyncFailed()
+        outcome.Error = err.Error()
+        return syncResultPolled, outcome
     }
 
     // Calculate current ETag for If-None-Match header
     currentETag := ss.getLastSyncedETag()
     
     // Use the existing SyncState method with proper parameters
-    var desiredStateManifest *sbi.UnsignedAppStateManifest
-    var response *http.Response
-    
+    requestOptions := []wfm.HTTPApiClientRequestEditorOptions{}
     if device.AuthEnabled {
-        desiredStateManifest, response, err = ss.apiClient.SyncStateWithResponse(
-            ctx,
-            device.DeviceClientId,
-            currentETag,
-            auth.WithOAuth(ctx, device.OAuthClientId, device.OAuthClientSecret, device.OAuthTokenEndpointUrl),
-        )
-    } else {
-        desiredStateManifest, response, err = ss.apiClient.SyncStateWithResponse(
-            ctx,
-            device.DeviceClientId,
-            currentETag,
-        )
+        requestOptions = append(requestOptions, auth.WithOAuth(ctx, device.OAuthClientId, device.OAuthClientSecret, device.OAuthTokenEndpointUrl))
     }
-    
+    if ss.longPollEnabled() {
+        requestOptions = append(requestOptions, wfm.WithLongPollWait(ss.longPollWait()))
+    }
+
+    startedAt := time.Now()
+    desiredStateManifest, response, err := ss.apiClient.SyncStateWithResponse(
+        ctx,
+        device.DeviceClientId,
+        currentETag,
+        requestOptions...,
+    )
+    result = ss.classifyLongPoll(response, err, time.Since(startedAt))
+    ss.checkAnnouncedLimits(response)
+
     if err != nil {
-        ss.log.Errorw("Sync failed", "err", err.Error(), "deviceId", device.DeviceClientId)
-        return
+        ss.recordSyncOutcome(device.DeviceClientId, err)
+        ss.log.Errorw("Sync failed", "err", err.Error(), "deviceId", device.DeviceClientId, "triggerId", trigger.ID)
+        outcome.Error = err.Error()
+        return result, outcome
+    }
+
+    // the desired state is only touched once the whole manifest was accepted
+    applied, err := ss.applyManifest(ctx, desiredStateManifest, response, trigger)
+    if err != nil {
+        ss.recordSyncOutcome(device.DeviceClientId, err)
+        ss.log.Errorw("Sync failed", "err", err.Error(), "deviceId", device.DeviceClientId, "triggerId", trigger.ID,
+            "msg", "manifest rejected, keeping the previous desired state")
+        outcome.Error = err.Error()
+        return result, outcome
+    }
+    ss.recordSyncOutcome(device.DeviceClientId, nil)
+    if applied != nil {
+        outcome.Changed = true
+        outcome.ManifestVersion = applied.ManifestVersion
+        outcome.Delivered = applied.Delivered
+        outcome.Removed = applied.Removed
     }
+    return result, outcome
+}
+
+// applyManifest fetches every deployment of the manifest and then updates the desired state. A manifest
+// exceeding one of the limits is rejected as a whole before anything is stored.
+// The sync history record of the applied manifest is returned, nil when there was nothing to apply.
+func (ss *StateSyncer) applyManifest(ctx context.Context, desiredStateManifest *sbi.UnsignedAppStateManifest, response *http.Response, trigger SyncTrigger) (*database.SyncRecord, error) {
 
     // Handle 304 Not Modified
     if response != nil && response.StatusCode == http.StatusNotModified {
-        ss.log.Infow("Sync completed", "msg", "No change in desired and current states (304 Not Modified)")
-        return
+        ss.log.Debugw("Sync completed", "msg", "No change in desired and current states (304 Not Modified)")
+        ss.metrics.SyncNotModified()
+        return nil, nil
     }
 
     if desiredStateManifest == nil {
-        ss.log.Infow("Sync completed", "msg", "No change in desired and current states")
-        return
+        ss.log.Debugw("Sync completed", "msg", "No change in desired and current states")
+        return nil, nil
+    }
+
+    // a signed manifest was verified by the client before it got here
+    if err := ss.checkManifestSignature(response); err != nil {
+        return nil, err
     }
 
     ss.log.Infow("Received manifest details", 
@@ -136,47 +667,120 @@ func (ss *StateSyncer) performSync() {
     // Security and Version Checks according to specification
     if err := ss.validateManifest(desiredStateManifest); err != nil {
         ss.log.Errorw("Manifest validation failed", "error", err)
-        return
+        return nil, nil
     }
 
-    // Process deployments from the manifest
-    ss.log.Debugf("Setting desired states....")
-    
-	ss.detectRemovedDeployments(desiredStateManifest.Deployments)
-   
-        if len(desiredStateManifest.Deployments) > 0 {
-            // Decide: bundle download vs individual fetch
-            if ss.shouldDownloadBundle(desiredStateManifest) {
-                // Download and extract bundle
-                bundleYAMLs, err := ss.downloadAndExtractBundle(ctx, desiredStateManifest.Bundle)
-                if err != nil {
-                    ss.log.Errorw("Failed to download bundle, falling back to individual fetch", 
-                        "error", err)
-                    // Fall back to individual fetch
-                    ss.processDeploymentsIndividually(ctx, desiredStateManifest.Deployments)
-                } else {
-                    // Process deployments from bundle
-                    ss.processDeploymentsFromBundle(ctx, desiredStateManifest.Deployments, bundleYAMLs)
-                }
-            } else {
-                // Fetch deployments individually
-                ss.processDeploymentsIndividually(ctx, desiredStateManifest.Deployments)
+    if count := int64(len(desiredStateManifest.Deployments)); count > ss.limits.MaxDeployments {
+        return nil, &wfm.LimitExceededError{Limit: "maxDeployments", Max: ss.limits.MaxDeployments, Actual: count}
+    }
+
+    syncTime := time.Now()
+    etag, err := ss.manifestETag(desiredStateManifest, response)
+    if err != nil {
+        return nil, err
+    }
+
+    // Fetch all deployments before the desired state is changed
+    var fetched []fetchedDeployment
+    deliveredVia := ""
+    if len(desiredStateManifest.Deployments) > 0 {
+        // Decide: bundle download vs individual fetch
+        if ss.shouldDownloadBundle(desiredStateManifest) {
+            // Download and extract bundle
+            bundleYAMLs, err := ss.downloadAndExtractBundle(ctx, desiredStateManifest.Bundle, response)
+            switch {
+            case err == nil:
+                // Process deployments from bundle
+                deliveredVia = database.DeliveredViaBundle
+                fetched, err = ss.parseDeploymentsFromBundle(desiredStateManifest.Deployments, bundleYAMLs)
+            case isLimitExceeded(err), errors.Is(err, sharedCrypto.ErrBundleSignature):
+                // the deployments of a bundle that fails its signature check are not fetched one
+                // by one either, they are what the signature was meant to vouch for
+                return nil, err
+            case isBundleRefused(err):
+                // the bundle passed its digest check, fetching the deployments one by one would not
+                // make it any safer
+                ss.log.Errorw("Refusing the bundle", "error", err)
+                deliveredVia = database.DeliveredViaBundle
+                fetched, err = refusedBundleDeployments(desiredStateManifest.Deployments, err), nil
+            default:
+                ss.log.Errorw("Failed to download bundle, falling back to individual fetch", 
+                    "error", err)
+                // Fall back to individual fetch
+                deliveredVia = database.DeliveredViaIndividual
+                fetched, err = ss.fetchDeploymentsIndividually(ctx, desiredStateManifest.Deployments)
+            }
+            if err != nil {
+                return nil, err
+            }
+        } else {
+            // Fetch deployments individually
+            var err error
+            deliveredVia = database.DeliveredViaIndividual
+            fetched, err = ss.fetchDeploymentsIndividually(ctx, desiredStateManifest.Deployments)
+            if err != nil {
+                return nil, err
             }
         }
+    }
 
-
+    // Process deployments from the manifest
+    ss.log.Debugf("Setting desired states....")
+    syncRecord := database.SyncRecord{
+        ManifestVersion: uint64(desiredStateManifest.ManifestVersion),
+        Time:            syncTime,
+        ServerETag:      etag,
+        DeliveredVia:    deliveredVia,
+        TriggerID:       trigger.ID,
+        TriggeredBy:     trigger.Source,
+    }
+    syncRecord.Removed = ss.detectRemovedDeployments(desiredStateManifest.Deployments)
+    syncRecord.Delivered = ss.storeFetchedDeployments(fetched, database.Provenance{
+        SourceManifestVersion: syncRecord.ManifestVersion,
+        SourceSyncTime:        syncTime,
+        DeliveredVia:          deliveredVia,
+        ServerETag:            etag,
+    })
+    ss.database.AddSyncRecord(syncRecord)
 
     // Store the new manifest metadata (including ETag from response)
-    if err := ss.persistManifestMetadata(desiredStateManifest, response); err != nil {
+    if err := ss.persistManifestMetadata(desiredStateManifest, etag); err != nil {
         ss.log.Errorw("Failed to persist manifest metadata", "error", err)
     }
+    ss.purgeOrphanedCaches(desiredStateManifest.Deployments)
 
     deploymentCount := len(desiredStateManifest.Deployments)
     ss.log.Debugw("Sync completed", "desiredStates", deploymentCount)
+    return &syncRecord, nil
+}
+
+// checkAnnouncedLimits logs when the server announces limits above the ones the agent enforces, the
+// server would then hand out manifests that this device rejects. Each discrepancy is logged once.
+func (ss *StateSyncer) checkAnnouncedLimits(response *http.Response) {
+    announced := wfm.AnnouncedManifestLimits(response)
+    if announced == ss.announcedLimits {
+        return
+    }
+    ss.announcedLimits = announced
+
+    check := func(limit string, announced, enforced int64) {
+        if announced > enforced {
+            ss.log.Warnw("Server announced a limit above the one enforced by the agent",
+                "limit", limit,
+                "announced", announced,
+                "enforced", enforced)
+        }
+    }
+    check("maxDeployments", announced.MaxDeployments, ss.limits.MaxDeployments)
+    check("maxManifestBytes", announced.MaxManifestBytes, ss.limits.MaxManifestBytes)
+    check("maxBundleBytes", announced.MaxBundleBytes, ss.limits.MaxBundleBytes)
 }
 
 
-func (ss *StateSyncer) detectRemovedDeployments(desiredDeployments []sbi.DeploymentManifestRef) {
+// detectRemovedDeployments marks the deployments that are no longer in the manifest for removal and
+// returns their ids
+func (ss *StateSyncer) detectRemovedDeployments(desiredDeployments []sbi.DeploymentManifestRef) []string {
+    var removed []string
     currentDeployments := ss.database.ListDeployments()
     
     desiredIDs := make(map[string]bool)
@@ -192,7 +796,8 @@ func (ss *StateSyncer) detectRemovedDeployments(desiredDeployments []sbi.Deploym
         if !desiredIDs[current.DeploymentID] {
             ss.log.Infow("Deployment removed from server, marking for removal",
                 "deploymentId", current.DeploymentID,
-                "name", current.DesiredState.Metadata.Name)
+                "name", current.DesiredState.Metadata.Name,
+                "protected", current.RemovalProtected)
             
             removingState := *current.DesiredState
             removingState.Status.Status.State = sbi.DeploymentStatusManifestStatusStateRemoving
@@ -201,9 +806,15 @@ func (ss *StateSyncer) detectRemovedDeployments(desiredDeployments []sbi.Deploym
                 ss.log.Errorw("Failed to mark deployment for removal",
                     "deploymentId", current.DeploymentID,
                     "error", err)
+                continue
+            }
+            // a deployment stays out of the manifest until it is gone, only the sync that removed it counts
+            if current.DesiredState.Status.Status.State != sbi.DeploymentStatusManifestStatusStateRemoving {
+                removed = append(removed, current.DeploymentID)
             }
         }
     }
+    return removed
 }
 
 
@@ -238,6 +849,21 @@ func (ss *StateSyncer) validateManifest(manifest *sbi.UnsignedAppStateManifest)
 
 
 
+// checkManifestSignature rejects an unsigned manifest when signatures are required, otherwise it is
+// accepted with a warning logged once
+func (ss *StateSyncer) checkManifestSignature(response *http.Response) error {
+    if wfm.IsSignedManifest(response) {
+        return nil
+    }
+    if ss.requireSignedManifests {
+        return fmt.Errorf("rejected unsigned state manifest, wfm.manifestVerification requires the WFM to sign it")
+    }
+    ss.unsignedManifestWarning.Do(func() {
+        ss.log.Warnw("Accepting unsigned state manifests, configure wfm.manifestVerification to verify that they come from the WFM")
+    })
+    return nil
+}
+
 // getLastSyncedETag retrieves the ETag from the last successful sync
 func (ss *StateSyncer) getLastSyncedETag() string {
     etag, err := ss.database.GetLastSyncedETag()
@@ -258,8 +884,37 @@ func (ss *StateSyncer) getLastSyncedManifestVersion() uint64 {
     return version
 }
 
+// manifestETag returns the etag of the manifest, the one the server sent or one computed from the
+// manifest if it sent none
+func (ss *StateSyncer) manifestETag(manifest *sbi.UnsignedAppStateManifest, response *http.Response) (string, error) {
+    // SPEC-COMPLIANT: Extract ETag from HTTP response header
+    var etag string
+    if response != nil {
+        etag = response.Header.Get("ETag")
+        ss.log.Debugw("Extracted ETag from response header", "etag", etag)
+    }
+    if etag != "" {
+        return etag, nil
+    }
+
+    // Fallback: Construct ETag if not in response (shouldn't happen with compliant server)
+    if bundleDigest, err := bundleDigestOf(manifest); err == nil {
+        // Bundle with deployments: Use bundle digest
+        etag = digest.ToETag(bundleDigest)
+    } else {
+        // Empty bundle: Compute digest of manifest JSON
+        manifestJSON, err := json.Marshal(manifest)
+        if err != nil {
+            return "", fmt.Errorf("failed to marshal manifest for digest: %w", err)
+        }
+        etag = digest.ToETag(digest.FromBytes(manifestJSON))
+    }
+    ss.log.Warnw("ETag not in response header, computed fallback", "etag", etag)
+    return etag, nil
+}
+
 // persistManifestMetadata stores manifest metadata according to specification
-func (ss *StateSyncer) persistManifestMetadata(manifest *sbi.UnsignedAppStateManifest, response *http.Response) error {
+func (ss *StateSyncer) persistManifestMetadata(manifest *sbi.UnsignedAppStateManifest, etag string) error {
     // Store manifest version for rollback protection
 											
     manifestVersionInt := uint64(manifest.ManifestVersion)
@@ -269,35 +924,15 @@ func (ss *StateSyncer) persistManifestMetadata(manifest *sbi.UnsignedAppStateMan
         }
     }
     
-    // SPEC-COMPLIANT: Extract ETag from HTTP response header
-    var etag string
-    if response != nil {
-        etag = response.Header.Get("ETag")
-        ss.log.Debugw("Extracted ETag from response header", "etag", etag)
+    // Remember which bundle the manifest refers to, the bundle cache is reconciled against it
+    bundleDigest := ""
+    if manifest.Bundle != nil && manifest.Bundle.Digest != nil {
+        bundleDigest = *manifest.Bundle.Digest
     }
-    
-    // Fallback: Construct ETag if not in response (shouldn't happen with compliant server)
-    if etag == "" {
-        if manifest.Bundle != nil && manifest.Bundle.Digest != nil {
-            // Bundle with deployments: Use bundle digest
-            etag = fmt.Sprintf("\"%s\"", *manifest.Bundle.Digest)
-            
-            // Store bundle digest
-            if err := ss.database.SetLastSyncedBundleDigest(*manifest.Bundle.Digest); err != nil {
-                return fmt.Errorf("failed to store bundle digest: %w", err)
-            }
-        } else {
-            // Empty bundle: Compute digest of manifest JSON
-            manifestJSON, err := json.Marshal(manifest)
-            if err != nil {
-                return fmt.Errorf("failed to marshal manifest for digest: %w", err)
-            }
-            hash := sha256.Sum256(manifestJSON)
-            etag = fmt.Sprintf("\"sha256:%x\"", hash)
-        }
-        ss.log.Warnw("ETag not in response header, computed fallback", "etag", etag)
+    if err := ss.database.SetLastSyncedBundleDigest(bundleDigest); err != nil {
+        return fmt.Errorf("failed to store bundle digest: %w", err)
     }
-    
+
     // Store ETag for HTTP caching (enables 304 Not Modified responses)
     if err := ss.database.SetLastSyncedETag(etag); err != nil {
         return fmt.Errorf("failed to store ETag: %w", err)
@@ -314,6 +949,36 @@ func (ss *StateSyncer) persistManifestMetadata(manifest *sbi.UnsignedAppStateMan
 }
 
 
+// cachePurger is implemented by sbi clients that cache the fetched deployments
+type cachePurger interface {
+    PurgeOrphanedDeployments(knownDeploymentIds []string) (int, error)
+}
+
+// purgeOrphanedCaches drops the cached deployments that are neither in the manifest nor in the
+// database anymore. A failure only leaves them on disk until the next sync.
+func (ss *StateSyncer) purgeOrphanedCaches(deployments []sbi.DeploymentManifestRef) {
+    purger, ok := ss.apiClient.(cachePurger)
+    if !ok {
+        return
+    }
+    known := make([]string, 0, len(deployments))
+    for _, ref := range deployments {
+        known = append(known, ref.DeploymentId)
+    }
+    for _, record := range ss.database.ListDeployments() {
+        known = append(known, record.DeploymentID)
+    }
+
+    removed, err := purger.PurgeOrphanedDeployments(known)
+    if err != nil {
+        ss.log.Warnw("Failed to purge orphaned cache entries", "error", err)
+        return
+    }
+    if removed > 0 {
+        ss.log.Infow("Purged the cache entries of deployments no longer known", "entries", removed)
+    }
+}
+
 func (ss *StateSyncer) fetchDeploymentYAML(ctx context.Context, deploymentRef sbi.DeploymentManifestRef) (*sbi.AppDeploymentManifest, error) {
     ss.log.Infow("Fetching deployment YAML", 
         "deploymentId", deploymentRef.DeploymentId,
@@ -373,8 +1038,27 @@ func (ss *StateSyncer) fetchDeploymentYAML(ctx context.Context, deploymentRef sb
 }
 
 
-// downloadAndExtractBundle downloads the bundle and extracts deployment YAMLs
-func (ss *StateSyncer) downloadAndExtractBundle(ctx context.Context, bundleRef *sbi.DeploymentBundleRef) (map[string][]byte, error) {
+// defaultBundleDownloadDir holds the bundles downloaded to disk while they are extracted
+// bundleSignatureOf reads the bundle signature from the raw manifest the response of the sync holds
+func bundleSignatureOf(response *http.Response) (string, error) {
+    if response == nil || response.Body == nil {
+        return "", nil
+    }
+    manifest, err := io.ReadAll(response.Body)
+    if err != nil {
+        return "", fmt.Errorf("failed to read the state manifest: %w", err)
+    }
+    response.Body = io.NopCloser(bytes.NewReader(manifest))
+    return pkg.BundleSignature(manifest)
+}
+
+const defaultBundleDownloadDir = "data/bundles"
+
+// downloadAndExtractBundle downloads the bundle and extracts deployment YAMLs. Bundles announced
+// up to the InMemoryBundleBytes limit are downloaded into memory, larger ones and bundles of
+// unknown size are streamed to disk. The signature of the bundle is read from the raw manifest the
+// response of the sync holds.
+func (ss *StateSyncer) downloadAndExtractBundle(ctx context.Context, bundleRef *sbi.DeploymentBundleRef, response *http.Response) (map[string][]byte, error) {
     if bundleRef == nil || bundleRef.Digest == nil {
         return nil, fmt.Errorf("invalid bundle reference")
     }
@@ -385,39 +1069,50 @@ func (ss *StateSyncer) downloadAndExtractBundle(ctx context.Context, bundleRef *
     if err != nil {
         return nil, fmt.Errorf("failed to get device settings: %w", err)
     }
-    
-    // Download bundle
-    var bundleData []byte
+    var options []wfm.HTTPApiClientRequestEditorOptions
     if device.AuthEnabled {
-        bundleData, err = ss.apiClient.DownloadBundle(
-            ctx,
-            device.DeviceClientId,
-            *bundleRef.Digest,
-            auth.WithOAuth(ctx, device.OAuthClientId, device.OAuthClientSecret, device.OAuthTokenEndpointUrl),
-        )
-    } else {
-        bundleData, err = ss.apiClient.DownloadBundle(
-            ctx,
-            device.DeviceClientId,
-            *bundleRef.Digest,
-        )
+        options = append(options, auth.WithOAuth(ctx, device.OAuthClientId, device.OAuthClientSecret, device.OAuthTokenEndpointUrl))
     }
     
-    if err != nil {
-        return nil, fmt.Errorf("failed to download bundle: %w", err)
+    // Download bundle
+    var extractor *archive.BundleExtractor
+    if bundleRef.SizeBytes != nil && int64(*bundleRef.SizeBytes) <= ss.limits.InMemoryBundleBytes {
+        bundleData, err := ss.apiClient.DownloadBundle(ctx, device.DeviceClientId, *bundleRef.Digest, options...)
+        if err != nil {
+            return nil, fmt.Errorf("failed to download bundle: %w", err)
+        }
+        extractor = archive.NewExtractor(bundleData)
+    } else {
+        var cleanup func()
+        extractor, cleanup, err = ss.downloadBundleToFile(ctx, device.DeviceClientId, *bundleRef.Digest, options)
+        if err != nil {
+            return nil, fmt.Errorf("failed to download bundle: %w", err)
+        }
+        defer cleanup()
     }
     
     ss.log.Infow("Bundle downloaded successfully", 
         "digest", *bundleRef.Digest,
-        "sizeBytes", len(bundleData))
-    
-    // Use generic extractor from shared-lib
-    extractor := archive.NewExtractor(bundleData)
+        "sizeBytes", extractor.GetBundleSize())
     
     // Verify bundle digest
     if err := extractor.VerifyBundleDigest(*bundleRef.Digest); err != nil {
         return nil, fmt.Errorf("bundle digest verification failed: %w", err)
     }
+
+    if ss.bundleVerifier != nil {
+        signature, err := bundleSignatureOf(response)
+        if err != nil {
+            return nil, fmt.Errorf("%w: bundle %s: %v", sharedCrypto.ErrBundleSignature, *bundleRef.Digest, err)
+        }
+        if signature == "" {
+            return nil, fmt.Errorf("%w: bundle %s is not signed", sharedCrypto.ErrBundleSignature, *bundleRef.Digest)
+        }
+        if err := ss.bundleVerifier.VerifyBundle([]byte(signature), extractor.BundleReader()); err != nil {
+            return nil, fmt.Errorf("bundle %s: %w", *bundleRef.Digest, err)
+        }
+        ss.log.Infow("Bundle signature verified", "digest", *bundleRef.Digest)
+    }
     
     // Extract deployments
     deploymentYAMLs, err := extractor.Extract()
@@ -431,22 +1126,100 @@ func (ss *StateSyncer) downloadAndExtractBundle(ctx context.Context, bundleRef *
     return deploymentYAMLs, nil
 }
 
+// downloadBundleToFile streams the bundle to the bundle download directory and opens an extractor of it,
+// cleanup closes the extractor and removes the download. A bundle served from the cache is
+// extracted in place and kept.
+func (ss *StateSyncer) downloadBundleToFile(ctx context.Context, deviceClientId, bundleDigest string, options []wfm.HTTPApiClientRequestEditorOptions) (extractor *archive.BundleExtractor, cleanup func(), err error) {
+    if err := os.MkdirAll(ss.bundleDownloadDir, 0755); err != nil {
+        return nil, nil, fmt.Errorf("failed to create the bundle download directory: %w", err)
+    }
+    destPath := filepath.Join(ss.bundleDownloadDir, strings.ReplaceAll(bundleDigest, ":", "-")+".tar.gz")
+    bundlePath, err := ss.apiClient.DownloadBundleToFile(ctx, deviceClientId, bundleDigest, destPath, options...)
+    if err != nil {
+        return nil, nil, err
+    }
+    removeDownload := func() {
+        if bundlePath != destPath {
+            return
+        }
+        if err := os.Remove(destPath); err != nil {
+            ss.log.Warnw("Failed to remove the downloaded bundle", "path", destPath, "error", err)
+        }
+    }
+
+    extractor, err = archive.OpenExtractor(bundlePath, archive.DefaultExtractorOptions())
+    if err != nil {
+        removeDownload()
+        return nil, nil, err
+    }
+    return extractor, func() {
+        extractor.Close()
+        removeDownload()
+    }, nil
+}
+
+// isBundleRefused reports whether the extractor refused the bundle for its size or its paths
+func isBundleRefused(err error) bool {
+    return errors.Is(err, archive.ErrBundleTooLarge) || errors.Is(err, archive.ErrUnsafePath)
+}
+
+// refusedBundleDeployments fails every deployment of a refused bundle with the reason
+func refusedBundleDeployments(deploymentRefs []sbi.DeploymentManifestRef, err error) []fetchedDeployment {
+    fetched := make([]fetchedDeployment, 0, len(deploymentRefs))
+    for _, deploymentRef := range deploymentRefs {
+        if deploymentRef.DeploymentId == "" {
+            continue
+        }
+        fetched = append(fetched, fetchedDeployment{ref: deploymentRef,
+            failure: fmt.Sprintf("Bundle refused: %v", err)})
+    }
+    return fetched
+}
+
 // shouldDownloadBundle determines if we should download the bundle or individual deployments
 func (ss *StateSyncer) shouldDownloadBundle(manifest *sbi.UnsignedAppStateManifest) bool {
     // If no bundle available, must fetch individually
     if manifest.Bundle == nil || manifest.Bundle.Digest == nil {
         return false
     }
+
+    if ss.bundleFetch.FetchMode() == types.BundleFetchNever {
+        ss.log.Infow("Using individual deployment fetch (bundle mode never)",
+            "deploymentCount", len(manifest.Deployments))
+        return false
+    }
+
+    // A bundle the device cannot verify would be rejected, the deployments may still be verifiable
+    if _, err := bundleDigestOf(manifest); err != nil {
+        ss.log.Warnw("Using individual deployment fetch (bundle digest cannot be verified)",
+            "digest", *manifest.Bundle.Digest,
+            "error", err)
+        return false
+    }
+
+    // A bundle above the limit would be rejected, the deployments can still be fetched one by one
+    if manifest.Bundle.SizeBytes != nil && float64(*manifest.Bundle.SizeBytes) > float64(ss.limits.MaxBundleBytes) {
+        ss.log.Infow("Using individual deployment fetch (bundle exceeds maxBundleBytes)",
+            "sizeBytes", *manifest.Bundle.SizeBytes,
+            "maxBundleBytes", ss.limits.MaxBundleBytes)
+        return false
+    }
     
-    // Heuristic: If more than 2 deployments, use bundle for efficiency
-    if len(manifest.Deployments) > 2 {
+    if ss.bundleFetch.FetchMode() == types.BundleFetchAlways {
+        ss.log.Infow("Using bundle download (bundle mode always)",
+            "deploymentCount", len(manifest.Deployments))
+        return true
+    }
+
+    // Heuristic: If more than the threshold of deployments, use bundle for efficiency
+    if len(manifest.Deployments) > ss.bundleFetch.Deployments() {
         ss.log.Infow("Using bundle download (many deployments)", 
             "deploymentCount", len(manifest.Deployments))
         return true
     }
     
-    // Heuristic: If bundle size is reasonable (< 50MB), use bundle
-    if manifest.Bundle.SizeBytes != nil && *manifest.Bundle.SizeBytes < 50*1024*1024 {
+    // Heuristic: If bundle size is below the threshold, use bundle
+    if manifest.Bundle.SizeBytes != nil && *manifest.Bundle.SizeBytes < float32(ss.bundleFetch.SizeBytes()) {
         ss.log.Infow("Using bundle download (reasonable size)", 
             "sizeBytes", *manifest.Bundle.SizeBytes)
         return true
@@ -458,35 +1231,119 @@ func (ss *StateSyncer) shouldDownloadBundle(manifest *sbi.UnsignedAppStateManife
     return false
 }
 
-// processDeploymentsIndividually fetches and stores each deployment individually
-func (ss *StateSyncer) processDeploymentsIndividually(ctx context.Context, deploymentRefs []sbi.DeploymentManifestRef) {
-    for _, deploymentRef := range deploymentRefs {
+// bundleDigestOf parses the digest of the bundle of the manifest, it fails when the manifest has no
+// bundle or its digest cannot be verified
+func bundleDigestOf(manifest *sbi.UnsignedAppStateManifest) (digest.Digest, error) {
+    if manifest.Bundle == nil || manifest.Bundle.Digest == nil {
+        return digest.Digest{}, fmt.Errorf("the manifest has no bundle")
+    }
+    return digest.ParseVerifiable(*manifest.Bundle.Digest)
+}
+
+// unverifiableDeployment records a deployment whose digest is malformed or of an algorithm the
+// device cannot verify, it is failed with the reason instead of being fetched
+func (ss *StateSyncer) unverifiableDeployment(deploymentRef sbi.DeploymentManifestRef, err error) fetchedDeployment {
+    ss.log.Errorw("Deployment digest cannot be verified",
+        "deploymentId", deploymentRef.DeploymentId,
+        "digest", deploymentRef.Digest,
+        "error", err)
+    return fetchedDeployment{ref: deploymentRef, failure: fmt.Sprintf("Deployment %v", err)}
+}
+
+// fetchedDeployment is a deployment of the manifest, fetched but not yet stored. failure is set when
+// the deployment could not be fetched or parsed, it is then marked failed.
+type fetchedDeployment struct {
+    ref        sbi.DeploymentManifestRef
+    deployment *sbi.AppDeploymentManifest
+    failure    string
+}
+
+// fetchDeploymentsIndividually fetches each deployment individually, up to fetchConcurrency of them
+// at once. The deployments are returned in the order of the manifest. Exceeding a limit fails the
+// whole fetch and stops the fetches in flight, other failures are recorded per deployment.
+func (ss *StateSyncer) fetchDeploymentsIndividually(ctx context.Context, deploymentRefs []sbi.DeploymentManifestRef) ([]fetchedDeployment, error) {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    results := make([]*fetchedDeployment, len(deploymentRefs))
+    var limitErr error
+    var limitOnce sync.Once
+    indexes := make(chan int)
+    var workers sync.WaitGroup
+    for w := 0; w < min(ss.fetchConcurrency, len(deploymentRefs)); w++ {
+        workers.Add(1)
+        go func() {
+            defer workers.Done()
+            for i := range indexes {
+                item, err := ss.fetchDeployment(ctx, deploymentRefs[i])
+                if err != nil {
+                    limitOnce.Do(func() {
+                        limitErr = err
+                        cancel()
+                    })
+                    continue
+                }
+                results[i] = &item
+            }
+        }()
+    }
+
+feed:
+    for i, deploymentRef := range deploymentRefs {
         if deploymentRef.DeploymentId == "" {
             ss.log.Warnw("Skipping deployment with empty DeploymentId")
             continue
         }
-        
-        deploymentId := deploymentRef.DeploymentId
-        
-        // Fetch the actual deployment YAML
-        deploymentYAML, err := ss.fetchDeploymentYAML(ctx, deploymentRef)
-        if err != nil {
-            ss.log.Errorw("Failed to fetch deployment YAML",
-                "deploymentId", deploymentId,
-                "error", err)
-            ss.database.SetPhase(deploymentId, "FAILED", 
-                fmt.Sprintf("Failed to fetch deployment: %v", err))
-            continue
+        select {
+        case indexes <- i:
+        case <-ctx.Done():
+            break feed
+        }
+    }
+    close(indexes)
+    workers.Wait()
+
+    if limitErr != nil {
+        return nil, limitErr
+    }
+    fetched := make([]fetchedDeployment, 0, len(deploymentRefs))
+    for _, item := range results {
+        if item != nil {
+            fetched = append(fetched, *item)
         }
-        
-        // Store deployment
-        ss.storeDeployment(deploymentId, deploymentRef, deploymentYAML)
     }
+    return fetched, nil
 }
 
-// processDeploymentsFromBundle processes deployments extracted from bundle
+// fetchDeployment fetches a single deployment of the manifest, the returned error is a limit the
+// deployment exceeded
+func (ss *StateSyncer) fetchDeployment(ctx context.Context, deploymentRef sbi.DeploymentManifestRef) (fetchedDeployment, error) {
+    deploymentId := deploymentRef.DeploymentId
+
+    if _, err := digest.ParseVerifiable(deploymentRef.Digest); err != nil {
+        return ss.unverifiableDeployment(deploymentRef, err), nil
+    }
 
-func (ss *StateSyncer) processDeploymentsFromBundle(ctx context.Context, deploymentRefs []sbi.DeploymentManifestRef, bundleYAMLs map[string][]byte) {
+    // Fetch the actual deployment YAML
+    deploymentYAML, err := ss.fetchDeploymentYAML(ctx, deploymentRef)
+    if err != nil {
+        if isLimitExceeded(err) {
+            return fetchedDeployment{}, fmt.Errorf("deployment %s: %w", deploymentId, err)
+        }
+        ss.log.Errorw("Failed to fetch deployment YAML",
+            "deploymentId", deploymentId,
+            "error", err)
+        return fetchedDeployment{ref: deploymentRef,
+            failure: fmt.Sprintf("Failed to fetch deployment: %v", err)}, nil
+    }
+
+    return fetchedDeployment{ref: deploymentRef, deployment: deploymentYAML}, nil
+}
+
+// parseDeploymentsFromBundle parses the deployments extracted from bundle. A deployment exceeding
+// maxDeploymentBytes fails the whole manifest, other failures are recorded per deployment.
+func (ss *StateSyncer) parseDeploymentsFromBundle(deploymentRefs []sbi.DeploymentManifestRef, bundleYAMLs map[string][]byte) ([]fetchedDeployment, error) {
+    fetched := make([]fetchedDeployment, 0, len(deploymentRefs))
     for _, deploymentRef := range deploymentRefs {
         if deploymentRef.DeploymentId == "" {
             ss.log.Warnw("Skipping deployment with empty DeploymentId")
@@ -502,21 +1359,29 @@ func (ss *StateSyncer) processDeploymentsFromBundle(ctx context.Context, deploym
             ss.log.Errorw("Deployment YAML not found in bundle",
                 "deploymentId", deploymentId,
                 "expectedFilename", yamlFilename)
-            ss.database.SetPhase(deploymentId, "FAILED", 
-                "Deployment YAML not found in bundle")
+            fetched = append(fetched, fetchedDeployment{ref: deploymentRef,
+                failure: "Deployment YAML not found in bundle"})
             continue
         }
+
+        if size := int64(len(yamlContent)); size > ss.limits.MaxDeploymentBytes {
+            return nil, fmt.Errorf("deployment %s: %w", deploymentId,
+                &wfm.LimitExceededError{Limit: "maxDeploymentBytes", Max: ss.limits.MaxDeploymentBytes, Actual: size})
+        }
         
         // Verify digest
-        hash := sha256.Sum256(yamlContent)
-        actualDigest := fmt.Sprintf("sha256:%x", hash)
-        if actualDigest != deploymentRef.Digest {
-            ss.log.Errorw("Deployment digest mismatch",
-                "deploymentId", deploymentId,
-                "expected", deploymentRef.Digest,
-                "actual", actualDigest)
-            ss.database.SetPhase(deploymentId, "FAILED", 
-                "Deployment digest verification failed")
+        if err := digest.Verify(deploymentRef.Digest, yamlContent); err != nil {
+            var mismatch *digest.IntegrityMismatch
+            if errors.As(err, &mismatch) {
+                ss.log.Errorw("Deployment digest mismatch",
+                    "deploymentId", deploymentId,
+                    "expected", mismatch.Expected.String(),
+                    "actual", mismatch.Actual.String())
+                fetched = append(fetched, fetchedDeployment{ref: deploymentRef,
+                    failure: "Deployment digest verification failed"})
+                continue
+            }
+            fetched = append(fetched, ss.unverifiableDeployment(deploymentRef, err))
             continue
         }
         
@@ -527,8 +1392,8 @@ func (ss *StateSyncer) processDeploymentsFromBundle(ctx context.Context, deploym
             ss.log.Errorw("Failed to unmarshal YAML to interface",
                 "deploymentId", deploymentId,
                 "error", err)
-            ss.database.SetPhase(deploymentId, "FAILED", 
-                fmt.Sprintf("Failed to parse YAML: %v", err))
+            fetched = append(fetched, fetchedDeployment{ref: deploymentRef,
+                failure: fmt.Sprintf("Failed to parse YAML: %v", err)})
             continue
         }
 
@@ -541,8 +1406,8 @@ func (ss *StateSyncer) processDeploymentsFromBundle(ctx context.Context, deploym
             ss.log.Errorw("Failed to marshal to JSON",
                 "deploymentId", deploymentId,
                 "error", err)
-            ss.database.SetPhase(deploymentId, "FAILED", 
-                fmt.Sprintf("Failed to convert to JSON: %v", err))
+            fetched = append(fetched, fetchedDeployment{ref: deploymentRef,
+                failure: fmt.Sprintf("Failed to convert to JSON: %v", err)})
             continue
         }
 
@@ -552,19 +1417,82 @@ func (ss *StateSyncer) processDeploymentsFromBundle(ctx context.Context, deploym
             ss.log.Errorw("Failed to unmarshal JSON to deployment",
                 "deploymentId", deploymentId,
                 "error", err)
-            ss.database.SetPhase(deploymentId, "FAILED", 
-                fmt.Sprintf("Failed to parse deployment: %v", err))
+            fetched = append(fetched, fetchedDeployment{ref: deploymentRef,
+                failure: fmt.Sprintf("Failed to parse deployment: %v", err)})
             continue
         }
 
-        // Store deployment
-        ss.storeDeployment(deploymentId, deploymentRef, &deployment)
+        fetched = append(fetched, fetchedDeployment{ref: deploymentRef, deployment: &deployment})
     }
+    return fetched, nil
 }
 
+// storeFetchedDeployments stores the fetched deployments with their provenance and marks the ones
+// that failed, it returns the ids of the stored deployments
+func (ss *StateSyncer) storeFetchedDeployments(fetched []fetchedDeployment, provenance database.Provenance) []string {
+    var stored []string
+    for _, item := range fetched {
+        if item.failure != "" {
+            ss.database.SetPhase(item.ref.DeploymentId, "FAILED", item.failure)
+            continue
+        }
+        if ss.storeDeployment(item.ref.DeploymentId, item.ref, item.deployment, provenance) {
+            stored = append(stored, item.ref.DeploymentId)
+        }
+    }
+    return stored
+}
+
+
+// storeDeployment stores a deployment in the database and reports whether it was stored
+func (ss *StateSyncer) storeDeployment(deploymentId string, deploymentRef sbi.DeploymentManifestRef, deploymentYAML *sbi.AppDeploymentManifest, provenance database.Provenance) bool {
+    // every deployment of a new manifest is stored again, only a new digest is a change to classify
+    var previous *sbi.AppDeploymentManifest
+    changeClass := database.ChangeClass("")
+    existing, err := ss.database.GetDeployment(deploymentId)
+    if err != nil {
+        existing = nil
+    }
+    if existing != nil && existing.DesiredState != nil {
+        previous = &existing.DesiredState.AppDeploymentManifest
+        if existing.Digest == deploymentRef.Digest {
+            changeClass = existing.ChangeClass
+        }
+    }
+
+    // a confirmed removal goes ahead whether the deployment is protected or not, a deployment the
+    // device does not know has nothing to remove
+    confirmedRemoval := annotatedTrue(*deploymentYAML, annotationConfirmRemoval)
+    if confirmedRemoval && existing == nil {
+        ss.log.Debugw("Ignoring the confirmed removal of an unknown deployment", "deploymentId", deploymentId)
+        return false
+    }
+    initialState := sbi.DeploymentStatusManifestStatusStatePending
+    if confirmedRemoval {
+        initialState = sbi.DeploymentStatusManifestStatusStateRemoving
+    }
+    // a deployment the runtimes cannot deploy is stored failed instead of being queued, a removal
+    // is carried out whatever the manifest looks like
+    validationErrs := pkg.ValidateAppDeploymentManifest(deploymentId, deploymentYAML)
+    if len(validationErrs) > 0 && !confirmedRemoval {
+        ss.log.Errorw("Invalid deployment", "deploymentId", deploymentId, "errors", validationErrs.Error())
+        initialState = sbi.DeploymentStatusManifestStatusStateFailed
+    }
+    if changeClass == "" {
+        changeClass = classifyChange(previous, *deploymentYAML)
+    }
+
+    // the application and its dependencies are announced in annotations, without them the
+    // deployment id stands in for the application
+    application, err := wfm.ApplicationOf(*deploymentYAML)
+    if err != nil {
+        ss.log.Warnw("Ignoring the dependencies of the deployment", "deploymentId", deploymentId, "error", err)
+        application.Dependencies = nil
+    }
+    if application.ID == "" {
+        application.ID = deploymentId
+    }
 
-// storeDeployment stores a deployment in the database
-func (ss *StateSyncer) storeDeployment(deploymentId string, deploymentRef sbi.DeploymentManifestRef, deploymentYAML *sbi.AppDeploymentManifest) {
     desiredState := database.AppDeploymentState{
         AppDeploymentManifest: *deploymentYAML,
         Status: sbi.DeploymentStatusManifest{
@@ -578,29 +1506,49 @@ func (ss *StateSyncer) storeDeployment(deploymentId string, deploymentRef sbi.De
                 } `json:"error,omitempty"`
                 State sbi.DeploymentStatusManifestStatusState `json:"state"`
             }{
-                State: sbi.DeploymentStatusManifestStatusStatePending,
+                State: initialState,
             },
         },
-        AppId:       deploymentId,
-        State:       "PENDING",
-        LastUpdated: time.Now(),
-        Digest:      &deploymentRef.Digest,
-        URL:         &deploymentRef.Url,
+        AppId:        application.ID,
+        AppVersion:   application.Version,
+        Dependencies: application.Dependencies,
+        State:        "PENDING",
+        LastUpdated:  time.Now(),
+        Digest:       &deploymentRef.Digest,
+        URL:          &deploymentRef.Url,
+        Provenance:   &provenance,
+        ChangeClass:  changeClass,
+        RemovalProtected: annotatedTrue(*deploymentYAML, annotationProtectRemoval) && !confirmedRemoval,
     }
     
-    err := ss.database.SetDesiredState(deploymentId, desiredState)
+    err = ss.database.SetDesiredState(deploymentId, desiredState)
     if err != nil {
         ss.log.Errorw("Failed to set desired state", 
             "deploymentId", deploymentId, 
             "error", err.Error())
         ss.database.SetPhase(deploymentId, "FAILED", 
             fmt.Sprintf("Failed to set desired state: %v", err))
-        return
+        return false
+    }
+
+    if initialState == sbi.DeploymentStatusManifestStatusStateFailed {
+        ss.database.SetPhase(deploymentId, "FAILED", fmt.Sprintf("Invalid deployment: %s", validationErrs.Error()))
+    } else if confirmedRemoval {
+        ss.log.Infow("WFM confirmed the removal of the deployment", "deploymentId", deploymentId, "wasProtected", existing.RemovalProtected)
+    } else if existing != nil && isRemovalBlocked(existing) {
+        // the deployment is back in the manifest, the workload never stopped
+        ss.log.Infow("Blocked removal called off, the deployment is back in the manifest", "deploymentId", deploymentId)
+        ss.database.SetRemovalBlockedSince(deploymentId, nil)
+        ss.database.SetPhase(deploymentId, "RUNNING", "Removal called off, the deployment is back in the manifest")
     }
     
     ss.log.Infow("Set desired state for deployment", 
         "deploymentId", deploymentId,
-        "digest", deploymentRef.Digest)
+        "digest", deploymentRef.Digest,
+        "manifestVersion", provenance.SourceManifestVersion,
+        "deliveredVia", provenance.DeliveredVia,
+        "changeClass", desiredState.ChangeClass)
+    return true
 }
 
 // convertYAMLToJSON converts YAML-style maps (interface{} keys) to JSON-compatible maps (string keys)
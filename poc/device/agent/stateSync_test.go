@@ -0,0 +1,1200 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	"github.com/margo/sandbox/poc/device/agent/health"
+	"github.com/margo/sandbox/poc/device/agent/hooks"
+	"github.com/margo/sandbox/poc/device/agent/metrics"
+	"github.com/margo/sandbox/poc/device/agent/types"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/margo/sandbox/shared-lib/archive"
+	"github.com/margo/sandbox/shared-lib/crypto"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestDatabase opens a database that is closed before the test's directories are cleaned up,
+// its last save must not land in a removed directory or, for a relative one, the package directory
+func newTestDatabase(t *testing.T, dataDir string) *database.Database {
+	t.Helper()
+	db := database.NewDatabase(dataDir)
+	t.Cleanup(db.Close)
+	return db
+}
+
+func newLongPollTestSyncer(t *testing.T, handler http.HandlerFunc) *StateSyncer {
+	t.Helper()
+	// the sbi client and database keep their files under a relative data/ directory
+	t.Chdir(t.TempDir())
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := wfm.NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+
+	db := newTestDatabase(t, "data")
+	require.NoError(t, db.SetDeviceSettings(database.DeviceSettingsRecord{DeviceClientId: "device-1"}))
+
+	return NewStateSyncer(db, client, "device-1", 30, zap.NewNop().Sugar(),
+		WithLongPolling(&types.LongPollConfig{Enabled: true, WaitSeconds: 1}))
+}
+
+func TestStateSyncer_LongPollHonored(t *testing.T) {
+	ss := newLongPollTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "wait=1", r.Header.Get("Prefer"))
+		// hold the request like a long-polling server would, then report no change
+		time.Sleep(700 * time.Millisecond)
+		w.WriteHeader(http.StatusNotModified)
+	})
+	defer ss.Stop()
+
+	result := ss.performSync()
+
+	assert.Equal(t, syncResultLongPollCompleted, result)
+	assert.Equal(t, time.Duration(0), ss.nextSyncDelay(result))
+	assert.Equal(t, LongPollMetrics{Honored: 1}, ss.LongPollMetrics())
+}
+
+func TestStateSyncer_LongPollHonoredViaPreferenceApplied(t *testing.T) {
+	ss := newLongPollTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Preference-Applied", "wait=1")
+		w.WriteHeader(http.StatusNotModified)
+	})
+	defer ss.Stop()
+
+	assert.Equal(t, syncResultLongPollCompleted, ss.performSync())
+	assert.Equal(t, LongPollMetrics{Honored: 1}, ss.LongPollMetrics())
+}
+
+func TestStateSyncer_LongPollNotHonored(t *testing.T) {
+	ss := newLongPollTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+		// answer right away, ignoring the wait preference
+		w.WriteHeader(http.StatusNotModified)
+	})
+	defer ss.Stop()
+
+	result := ss.performSync()
+
+	assert.Equal(t, syncResultPolled, result)
+	assert.Equal(t, 30*time.Second, ss.nextSyncDelay(result))
+	assert.Equal(t, LongPollMetrics{NotHonored: 1}, ss.LongPollMetrics())
+}
+
+func TestStateSyncer_LongPollNotHonoredWithManifest(t *testing.T) {
+	// a server ignoring the wait preference and the ETag answers the manifest right away every time
+	manifest := versionedManifest(1, `"v1"`, map[string][]byte{}, nil)
+	ss := newLongPollTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+		manifest(w)
+	})
+	defer ss.Stop()
+
+	result := ss.performSync()
+	assert.Equal(t, syncResultLongPollCompleted, result, "the change may have been ready, the next sync tells")
+	assert.Equal(t, time.Duration(0), ss.nextSyncDelay(result))
+
+	for range 2 {
+		result = ss.performSync()
+		assert.Equal(t, syncResultPolled, result)
+		assert.Equal(t, ss.pollInterval(), ss.nextSyncDelay(result), "no busy loop against the server")
+	}
+	assert.Equal(t, LongPollMetrics{NotHonored: 2}, ss.LongPollMetrics())
+}
+
+func TestStateSyncer_StopCancelsOpenLongPoll(t *testing.T) {
+	requestStarted := make(chan struct{})
+	requestCancelled := make(chan struct{})
+	ss := newLongPollTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(requestStarted)
+		select {
+		case <-r.Context().Done():
+			close(requestCancelled)
+		case <-time.After(5 * time.Second):
+			w.WriteHeader(http.StatusNotModified)
+		}
+	})
+
+	done := make(chan syncResult)
+	go func() {
+		done <- ss.performSync()
+	}()
+
+	<-requestStarted
+	ss.Stop()
+
+	select {
+	case result := <-done:
+		// being stopped is not a dropped connection
+		assert.Equal(t, syncResultPolled, result)
+	case <-time.After(2 * time.Second):
+		t.Fatal("sync did not return after Stop")
+	}
+
+	select {
+	case <-requestCancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not observe the cancelled long poll")
+	}
+	assert.Equal(t, LongPollMetrics{}, ss.LongPollMetrics())
+}
+
+func TestStateSyncer_HealthFollowsSyncOutcome(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	ss := newLongPollTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Preference-Applied", "wait=1")
+		w.WriteHeader(http.StatusNotModified)
+	})
+	defer ss.Stop()
+
+	report := ss.Health()
+	assert.Equal(t, health.StatusDegraded, report.Status, "the desired state is unknown before the first sync")
+	assert.Equal(t, []string{"no sync succeeded yet"}, report.Reasons)
+
+	for i := 1; i < syncDegradedThreshold; i++ {
+		ss.performSync()
+		assert.Len(t, ss.Health().Reasons, 1, "a few failed syncs are not reported")
+	}
+	ss.performSync()
+	report = ss.Health()
+	assert.Equal(t, health.StatusDegraded, report.Status)
+	assert.Equal(t, float64(syncDegradedThreshold), report.Metrics["consecutiveFailures"])
+	require.Len(t, report.Reasons, 2)
+
+	failing.Store(false)
+	ss.performSync()
+	report = ss.Health()
+	assert.Equal(t, health.StatusOK, report.Status)
+	assert.Contains(t, report.Metrics, "secondsSinceSuccessfulSync")
+
+	// the last successful sync gets too old, twice the 30 seconds interval and the 1 second wait
+	ss.outcomeMu.Lock()
+	ss.lastSuccessfulSync = time.Now().Add(-63 * time.Second)
+	ss.outcomeMu.Unlock()
+	report = ss.Health()
+	assert.Equal(t, health.StatusDegraded, report.Status)
+	require.Len(t, report.Reasons, 1)
+	assert.Contains(t, report.Reasons[0], "more than 1m2s")
+}
+
+// countingRecorder counts the sync measurements, the other ones are discarded
+type countingRecorder struct {
+	metrics.Nop
+	attempts, failures, notModified, successes atomic.Int32
+}
+
+func (r *countingRecorder) SyncAttempted()          { r.attempts.Add(1) }
+func (r *countingRecorder) SyncFailed()             { r.failures.Add(1) }
+func (r *countingRecorder) SyncNotModified()        { r.notModified.Add(1) }
+func (r *countingRecorder) SyncSucceeded(time.Time) { r.successes.Add(1) }
+
+func TestStateSyncer_RecordsSyncMetrics(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	ss := newLongPollTestSyncer(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNotModified)
+	})
+	defer ss.Stop()
+	recorder := &countingRecorder{}
+	WithSyncMetrics(recorder)(ss)
+
+	ss.performSync()
+	failing.Store(false)
+	ss.performSync()
+	ss.performSync()
+
+	assert.Equal(t, int32(3), recorder.attempts.Load())
+	assert.Equal(t, int32(1), recorder.failures.Load())
+	assert.Equal(t, int32(2), recorder.notModified.Load())
+	assert.Equal(t, int32(2), recorder.successes.Load())
+}
+
+func TestStateSyncer_NextSyncDelayAfterDrop(t *testing.T) {
+	ss := &StateSyncer{stateSyncingIntervalInSec: 10}
+
+	for i := 0; i < 20; i++ {
+		delay := ss.nextSyncDelay(syncResultLongPollDropped)
+		assert.GreaterOrEqual(t, delay, time.Second)
+		assert.LessOrEqual(t, delay, 11*time.Second)
+	}
+}
+
+func TestStateSyncer_BacksOffWhileSyncsFail(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	server := &limitsTestServer{manifest: func(w http.ResponseWriter) int64 {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return 0
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return 0
+	}}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	ss := env.syncer
+	ss.backoff = &types.SyncBackoffConfig{MaxIntervalSeconds: 200}
+	ss.backoffJitter = func() float64 { return 0 }
+
+	// 30s, doubled after every further failure and capped at 200s
+	for _, expected := range []time.Duration{30, 60, 120, 200, 200} {
+		delay := ss.nextSyncDelay(ss.performSync())
+		assert.Equal(t, expected*time.Second, delay)
+		ss.recordNextSync(delay)
+	}
+	stats := ss.GetSyncStats()
+	assert.True(t, stats.BackingOff)
+	assert.Equal(t, 5, stats.ConsecutiveFailures)
+	assert.Equal(t, 200*time.Second, stats.NextDelay)
+	assert.NotEmpty(t, stats.LastError)
+	assert.Equal(t, float64(200), ss.Health().Metrics["backoffSeconds"])
+
+	// a 304 is a successful sync and restores the interval
+	failing.Store(false)
+	delay := ss.nextSyncDelay(ss.performSync())
+	assert.Equal(t, 30*time.Second, delay)
+	ss.recordNextSync(delay)
+	stats = ss.GetSyncStats()
+	assert.False(t, stats.BackingOff)
+	assert.Zero(t, stats.ConsecutiveFailures)
+	assert.Empty(t, stats.LastError)
+	assert.False(t, stats.LastSuccessfulSync.IsZero())
+	assert.NotContains(t, ss.Health().Metrics, "backoffSeconds")
+}
+
+func TestStateSyncer_BackoffDelay(t *testing.T) {
+	ss := &StateSyncer{stateSyncingIntervalInSec: 10, backoffJitter: func() float64 { return 0.999 }}
+
+	// the jitter cuts up to a fifth off the grown interval
+	delay, backingOff := ss.backoffDelay(3)
+	assert.True(t, backingOff)
+	assert.Greater(t, delay, 32*time.Second)
+	assert.LessOrEqual(t, delay, 40*time.Second)
+
+	delay, _ = ss.backoffDelay(100)
+	assert.LessOrEqual(t, delay, 10*time.Minute)
+	assert.Greater(t, delay, 8*time.Minute)
+
+	_, backingOff = ss.backoffDelay(0)
+	assert.False(t, backingOff)
+
+	ss.backoff = &types.SyncBackoffConfig{Disabled: true}
+	_, backingOff = ss.backoffDelay(3)
+	assert.False(t, backingOff)
+	assert.Equal(t, 10*time.Second, ss.nextSyncDelay(syncResultPolled))
+}
+
+func TestStateSyncer_BackoffFromConstructor(t *testing.T) {
+	ss := NewStateSyncer(nil, nil, "device-1", 10, zap.NewNop().Sugar(),
+		WithSyncBackoff(&types.SyncBackoffConfig{Multiplier: 3, MaxIntervalSeconds: 60, Jitter: 0.5}))
+	ss.backoffJitter = func() float64 { return 0 }
+
+	// the configured interval, tripled after every further failure and capped, then reset
+	var delays []time.Duration
+	for _, failures := range []int{1, 2, 3, 4, 0} {
+		delay, backingOff := ss.backoffDelay(failures)
+		if !backingOff {
+			delay = ss.pollInterval()
+		}
+		delays = append(delays, delay)
+	}
+	assert.Equal(t, []time.Duration{10 * time.Second, 30 * time.Second, 60 * time.Second, 60 * time.Second, 10 * time.Second}, delays)
+
+	// at most half of the grown interval is cut off
+	ss.backoffJitter = func() float64 { return 0.999 }
+	delay, _ := ss.backoffDelay(2)
+	assert.Greater(t, delay, 15*time.Second)
+	assert.Less(t, delay, 30*time.Second)
+}
+
+func TestStateSyncer_StopInterruptsBackoff(t *testing.T) {
+	ss := NewStateSyncer(nil, nil, "device-1", 600, zap.NewNop().Sugar())
+	ss.consecutiveSyncFailures = 5
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ss.syncLoop()
+	}()
+	ss.Stop()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop must not wait for the backoff to run out")
+	}
+}
+
+// limitsTestServer serves a manifest and the deployment YAMLs it references by digest, counting the
+// manifest bytes it managed to send
+type limitsTestServer struct {
+	manifest      func(w http.ResponseWriter) int64
+	deployments   map[string][]byte
+	manifestBytes atomic.Int64
+	// manifestAccept is the Accept header of the last manifest request
+	manifestAccept string
+	// fetchDelay holds every deployment fetch, maxFetches records how many were in flight at once
+	fetchDelay time.Duration
+	fetches    atomic.Int32
+	maxFetches atomic.Int32
+}
+
+func (s *limitsTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/deployments") {
+		s.manifestAccept = r.Header.Get("Accept")
+		s.manifestBytes.Store(s.manifest(w))
+		return
+	}
+	if s.fetchDelay > 0 {
+		current := s.fetches.Add(1)
+		defer s.fetches.Add(-1)
+		for max := s.maxFetches.Load(); current > max && !s.maxFetches.CompareAndSwap(max, current); max = s.maxFetches.Load() {
+		}
+		time.Sleep(s.fetchDelay)
+	}
+	data, found := s.deployments[path.Base(r.URL.Path)]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write(data)
+}
+
+// manifestOf writes a manifest referencing the given deployments
+func manifestOf(deployments map[string][]byte) func(w http.ResponseWriter) int64 {
+	return func(w http.ResponseWriter) int64 {
+		manifest := sbi.UnsignedAppStateManifest{ManifestVersion: 2, Deployments: []sbi.DeploymentManifestRef{}}
+		for deploymentId, data := range deployments {
+			manifest.Deployments = append(manifest.Deployments, sbi.DeploymentManifestRef{
+				DeploymentId: deploymentId,
+				Digest:       testDigest(data),
+				Url:          fmt.Sprintf("/api/v1/clients/device-1/deployments/%s/%s", deploymentId, testDigest(data)),
+			})
+		}
+		body, _ := json.Marshal(manifest)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"new"`)
+		n, _ := w.Write(body)
+		return int64(n)
+	}
+}
+
+type limitsTestEnv struct {
+	server *limitsTestServer
+	client *wfm.SbiHttpClient
+	syncer *StateSyncer
+	db     *database.Database
+	events []hooks.Event
+}
+
+func newLimitsTestEnv(t *testing.T, server *limitsTestServer, limits wfm.ManifestLimits) *limitsTestEnv {
+	t.Helper()
+	// the sbi client and database keep their files under a relative data/ directory
+	t.Chdir(t.TempDir())
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	client, err := wfm.NewSbiHTTPClient(httpServer.URL)
+	require.NoError(t, err)
+	client.SetManifestLimits(limits)
+
+	db := newTestDatabase(t, "data")
+	require.NoError(t, db.SetDeviceSettings(database.DeviceSettingsRecord{DeviceClientId: "device-1"}))
+	// the previously synced desired state that a rejected manifest must leave alone
+	digest := testDigest(testDeploymentYAML)
+	require.NoError(t, db.SetDesiredState("deployment-existing", database.AppDeploymentState{Digest: &digest}))
+	require.NoError(t, db.SetLastSyncedETag(`"old"`))
+	require.NoError(t, db.SetLastSyncedManifestVersion(1))
+
+	env := &limitsTestEnv{server: server, client: client, db: db}
+	env.syncer = NewStateSyncer(db, client, "device-1", 30, zap.NewNop().Sugar(),
+		WithManifestLimits(limits), WithSyncEvents(func(event hooks.Event) {
+			env.events = append(env.events, event)
+		}))
+	t.Cleanup(env.syncer.Stop)
+	return env
+}
+
+func (env *limitsTestEnv) assertRejected(t *testing.T, limit string) {
+	t.Helper()
+	env.assertDesiredStateKept(t)
+
+	require.Len(t, env.events, 1)
+	assert.Equal(t, hooks.EventTypeSyncDegraded, env.events[0].Type)
+	assert.Contains(t, env.events[0].Message, limit)
+}
+
+// assertDesiredStateKept checks that the previously synced desired state was left alone
+func (env *limitsTestEnv) assertDesiredStateKept(t *testing.T) {
+	t.Helper()
+	deployments := env.db.ListDeployments()
+	require.Len(t, deployments, 1)
+	assert.Equal(t, "deployment-existing", deployments[0].DeploymentID)
+	assert.Empty(t, deployments[0].DesiredState.Status.Status.State, "the previous desired state must not be marked for removal")
+
+	etag, _ := env.db.GetLastSyncedETag()
+	assert.Equal(t, `"old"`, etag)
+	version, _ := env.db.GetLastSyncedManifestVersion()
+	assert.Equal(t, uint64(1), version)
+}
+
+func TestStateSyncer_OversizedManifestIsRejectedWhileStreaming(t *testing.T) {
+	const maxManifestBytes = 64 << 10
+	handlerDone := make(chan struct{})
+	server := &limitsTestServer{manifest: func(w http.ResponseWriter) int64 {
+		defer close(handlerDone)
+		// an endless manifest without Content-Length, written until the agent hangs up
+		w.Header().Set("Content-Type", "application/json")
+		written, _ := w.Write([]byte(`{"manifestVersion":2,"bundle":null,"deployments":[`))
+		chunk := []byte(strings.Repeat(`{"deploymentId":"x","digest":"sha256:0","url":"/x"},`, 1000))
+		for written < 256<<20 {
+			n, err := w.Write(chunk)
+			written += n
+			if err != nil {
+				break
+			}
+			w.(http.Flusher).Flush()
+		}
+		return int64(written)
+	}}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{MaxManifestBytes: maxManifestBytes})
+
+	env.syncer.performSync()
+
+	env.assertRejected(t, "maxManifestBytes")
+	select {
+	case <-handlerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server kept writing the manifest after the agent rejected it")
+	}
+	// the agent stops reading at the limit, only what the connection buffers took got through
+	assert.Less(t, server.manifestBytes.Load(), int64(32<<20))
+}
+
+func TestStateSyncer_ManifestAnnouncingOversizedContentLength(t *testing.T) {
+	server := &limitsTestServer{manifest: func(w http.ResponseWriter) int64 {
+		body := `{"manifestVersion":2,"bundle":null,"deployments":[]}` + strings.Repeat(" ", 2048)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		n, _ := w.Write([]byte(body))
+		return int64(n)
+	}}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{MaxManifestBytes: 1024})
+
+	env.syncer.performSync()
+
+	env.assertRejected(t, "maxManifestBytes")
+}
+
+func TestStateSyncer_TooManyDeployments(t *testing.T) {
+	deployments := map[string][]byte{}
+	for i := 0; i < 3; i++ {
+		deployments[fmt.Sprintf("deployment-%d", i)] = testDeploymentYAML
+	}
+	server := &limitsTestServer{manifest: manifestOf(deployments), deployments: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML}}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{MaxDeployments: 2})
+
+	env.syncer.performSync()
+
+	env.assertRejected(t, "maxDeployments")
+}
+
+func TestStateSyncer_OversizedDeploymentRejectsTheWholeManifest(t *testing.T) {
+	oversized := []byte("apiVersion: application.margo.org/v1alpha1\nkind: ApplicationDeployment\n# " + strings.Repeat("x", 4096) + "\n")
+	server := &limitsTestServer{
+		manifest: manifestOf(map[string][]byte{"deployment-small": testDeploymentYAML, "deployment-large": oversized}),
+		deployments: map[string][]byte{
+			testDigest(testDeploymentYAML): testDeploymentYAML,
+			testDigest(oversized):          oversized,
+		},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{MaxDeploymentBytes: 1024})
+
+	env.syncer.performSync()
+
+	env.assertRejected(t, "maxDeploymentBytes")
+}
+
+func TestStateSyncer_ManifestWithinLimitsIsApplied(t *testing.T) {
+	server := &limitsTestServer{
+		manifest:    manifestOf(map[string][]byte{"deployment-small": testDeploymentYAML}),
+		deployments: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{MaxDeployments: 1, MaxDeploymentBytes: 1024, MaxManifestBytes: 1024})
+
+	env.syncer.performSync()
+
+	small, err := env.db.GetDeployment("deployment-small")
+	require.NoError(t, err)
+	assert.NotNil(t, small.DesiredState)
+	existing, err := env.db.GetDeployment("deployment-existing")
+	require.NoError(t, err)
+	assert.Equal(t, sbi.DeploymentStatusManifestStatusStateRemoving, existing.DesiredState.Status.Status.State)
+	etag, _ := env.db.GetLastSyncedETag()
+	assert.Equal(t, `"new"`, etag)
+	assert.Empty(t, env.events)
+}
+
+func TestStateSyncer_FetchesDeploymentsConcurrently(t *testing.T) {
+	deployments := map[string][]byte{}
+	served := map[string][]byte{}
+	for i := 0; i < 8; i++ {
+		data := append(append([]byte{}, testDeploymentYAML...), fmt.Sprintf("# %d\n", i)...)
+		deployments[fmt.Sprintf("deployment-%d", i)] = data
+		served[testDigest(data)] = data
+	}
+	// the previously synced deployment changed, its new content cannot be fetched
+	deployments["deployment-existing"] = []byte("kind: ApplicationDeployment\n# unavailable\n")
+	server := &limitsTestServer{manifest: manifestOf(deployments), deployments: served, fetchDelay: 20 * time.Millisecond}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	WithFetchConcurrency(3)(env.syncer)
+
+	env.syncer.performSync()
+
+	for deploymentId := range deployments {
+		record, err := env.db.GetDeployment(deploymentId)
+		require.NoError(t, err, deploymentId)
+		if deploymentId == "deployment-existing" {
+			assert.Equal(t, "FAILED", record.Phase)
+			assert.Contains(t, record.Message, "Failed to fetch deployment")
+			continue
+		}
+		assert.NotNil(t, record.DesiredState, "the failed fetch does not keep %s from being stored", deploymentId)
+	}
+	assert.Greater(t, server.maxFetches.Load(), int32(1))
+	assert.LessOrEqual(t, server.maxFetches.Load(), int32(3))
+}
+
+func TestStateSyncer_TriggerSyncRunsBeforeTheNextTick(t *testing.T) {
+	var requests atomic.Int32
+	server := &limitsTestServer{manifest: func(w http.ResponseWriter) int64 {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotModified)
+		return 0
+	}}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+
+	// triggers pending while the loop is busy coalesce into one sync
+	for i := 0; i < 5; i++ {
+		env.syncer.TriggerSync()
+	}
+	assert.Len(t, env.syncer.triggerChan, 1)
+
+	// the interval is 30 seconds, only the trigger makes the loop sync
+	env.syncer.Start()
+	require.Eventually(t, func() bool { return requests.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), requests.Load())
+
+	env.syncer.TriggerSync()
+	require.Eventually(t, func() bool { return requests.Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStateSyncer_InvalidDeploymentIsStoredFailed(t *testing.T) {
+	invalid := []byte(`apiVersion: application.margo.org/v1alpha1
+kind: ApplicationDeployment
+metadata:
+  name: digitron
+spec:
+  deploymentProfile:
+    type: compose
+    components:
+      - name: digitron
+        properties:
+          packageLocation: registry.local/digitron
+  parameters:
+    greeting:
+      value: hello
+      targets:
+        - pointer: settings..greeting
+          components: [gateway]
+`)
+	server := &limitsTestServer{
+		manifest:    manifestOf(map[string][]byte{"deployment-invalid": invalid}),
+		deployments: map[string][]byte{testDigest(invalid): invalid},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+
+	env.syncer.performSync()
+
+	record, err := env.db.GetDeployment("deployment-invalid")
+	require.NoError(t, err)
+	assert.Equal(t, sbi.DeploymentStatusManifestStatusStateFailed, record.DesiredState.Status.Status.State, "nothing is queued for the runtimes")
+	assert.Equal(t, "FAILED", record.Phase)
+	assert.Equal(t, "Invalid deployment: "+
+		"spec.deploymentProfile.components[0].properties.packageLocation must be an http(s) URL, an absolute path or inline compose YAML; "+
+		`spec.parameters.greeting.targets[0].pointer "settings..greeting" must be names of letters, numbers, '_' or '-' separated by '.'; `+
+		`spec.parameters.greeting.targets[0].components[0] "gateway" is not a component of the deployment profile`, record.Message)
+}
+
+// versionedManifest writes a manifest of the given version referencing the deployments, through the
+// bundle when one is given
+func versionedManifest(version sbi.ManifestVersion, etag string, deployments map[string][]byte, bundle []byte) func(w http.ResponseWriter) int64 {
+	return func(w http.ResponseWriter) int64 {
+		manifest := sbi.UnsignedAppStateManifest{ManifestVersion: version, Deployments: []sbi.DeploymentManifestRef{}}
+		for deploymentId, data := range deployments {
+			manifest.Deployments = append(manifest.Deployments, sbi.DeploymentManifestRef{
+				DeploymentId: deploymentId,
+				Digest:       testDigest(data),
+				Url:          fmt.Sprintf("/api/v1/clients/device-1/deployments/%s/%s", deploymentId, testDigest(data)),
+			})
+		}
+		if bundle != nil {
+			digest := testDigest(bundle)
+			size := float32(len(bundle))
+			url := "/api/v1/clients/device-1/bundles/" + digest
+			manifest.Bundle = &sbi.DeploymentBundleRef{Digest: &digest, SizeBytes: &size, Url: &url}
+		}
+		body, _ := json.Marshal(manifest)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		n, _ := w.Write(body)
+		return int64(n)
+	}
+}
+
+func testBundle(t *testing.T, deployments map[string][]byte) []byte {
+	t.Helper()
+	archiver := archive.NewArchiver(archive.ArchiveFormatTarGZ)
+	for deploymentId, data := range deployments {
+		_, _, err := archiver.AppendContent(data, deploymentId+".yaml")
+		require.NoError(t, err)
+	}
+	bundleFile, _, _, bundlePath, err := archiver.CreateArchive()
+	require.NoError(t, err)
+	bundleFile.Close()
+	t.Cleanup(func() { archiver.Cleanup() })
+	bundle, err := os.ReadFile(bundlePath)
+	require.NoError(t, err)
+	return bundle
+}
+
+func TestStateSyncer_ProvenanceAcrossDeliveriesAndUpgrades(t *testing.T) {
+	upgradedYAML := []byte("apiVersion: application.margo.org/v1alpha1\nkind: ApplicationDeployment\nmetadata:\n  name: upgraded\n")
+	otherYAML := []byte("apiVersion: application.margo.org/v1alpha1\nkind: ApplicationDeployment\nmetadata:\n  name: other\n")
+	server := &limitsTestServer{
+		manifest:    versionedManifest(2, `"v2"`, map[string][]byte{"deployment-a": testDeploymentYAML}, nil),
+		deployments: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+
+	// version 2 is fetched deployment by deployment
+	before := time.Now()
+	env.syncer.performSync()
+
+	a, err := env.db.GetDeployment("deployment-a")
+	require.NoError(t, err)
+	require.NotNil(t, a.Provenance)
+	assert.Equal(t, uint64(2), a.Provenance.SourceManifestVersion)
+	assert.Equal(t, database.DeliveredViaIndividual, a.Provenance.DeliveredVia)
+	assert.Equal(t, `"v2"`, a.Provenance.ServerETag)
+	assert.False(t, a.Provenance.SourceSyncTime.Before(before))
+	assert.Equal(t, a.Provenance, a.DesiredState.Provenance)
+
+	// version 3 upgrades deployment-a and adds deployment-b through the bundle
+	v3 := map[string][]byte{"deployment-a": upgradedYAML, "deployment-b": otherYAML}
+	bundle := testBundle(t, v3)
+	server.manifest = versionedManifest(3, `"v3"`, v3, bundle)
+	server.deployments[testDigest(bundle)] = bundle
+	env.syncer.performSync()
+
+	for _, deploymentId := range []string{"deployment-a", "deployment-b"} {
+		record, err := env.db.GetDeployment(deploymentId)
+		require.NoError(t, err)
+		require.NotNil(t, record.Provenance, deploymentId)
+		assert.Equal(t, uint64(3), record.Provenance.SourceManifestVersion, deploymentId)
+		assert.Equal(t, database.DeliveredViaBundle, record.Provenance.DeliveredVia, deploymentId)
+		assert.Equal(t, `"v3"`, record.Provenance.ServerETag, deploymentId)
+	}
+	a, err = env.db.GetDeployment("deployment-a")
+	require.NoError(t, err)
+	assert.Equal(t, "upgraded", a.DesiredState.Metadata.Name)
+
+	// the history leads from a sync to the deployments it changed and back
+	history := env.db.ListSyncHistory()
+	require.Len(t, history, 2)
+	assert.Equal(t, database.SyncRecord{
+		ManifestVersion: 2,
+		Time:            history[0].Time,
+		ServerETag:      `"v2"`,
+		DeliveredVia:    database.DeliveredViaIndividual,
+		Delivered:       []string{"deployment-a"},
+		Removed:         []string{"deployment-existing"},
+	}, history[0])
+	assert.Equal(t, uint64(3), history[1].ManifestVersion)
+	assert.Equal(t, database.DeliveredViaBundle, history[1].DeliveredVia)
+	assert.ElementsMatch(t, []string{"deployment-a", "deployment-b"}, history[1].Delivered)
+	assert.Equal(t, a.Provenance.SourceSyncTime, history[1].Time)
+
+	syncs := env.db.SyncsOfDeployment("deployment-a")
+	require.Len(t, syncs, 2)
+	assert.Equal(t, []uint64{2, 3}, []uint64{syncs[0].ManifestVersion, syncs[1].ManifestVersion})
+	assert.Len(t, env.db.SyncsOfDeployment("deployment-existing"), 1)
+}
+
+func TestStateSyncer_StreamsLargeBundlesToDisk(t *testing.T) {
+	deployments := map[string][]byte{"deployment-a": testDeploymentYAML}
+	bundle := testBundle(t, deployments)
+	server := &limitsTestServer{
+		manifest:    versionedManifest(2, `"v2"`, deployments, bundle),
+		deployments: map[string][]byte{testDigest(bundle): bundle},
+	}
+	// every bundle is larger than a byte
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{InMemoryBundleBytes: 1})
+	env.syncer.performSync()
+
+	record, err := env.db.GetDeployment("deployment-a")
+	require.NoError(t, err)
+	require.NotNil(t, record.Provenance)
+	assert.Equal(t, database.DeliveredViaBundle, record.Provenance.DeliveredVia)
+	downloads, err := os.ReadDir(env.syncer.bundleDownloadDir)
+	require.NoError(t, err)
+	assert.Empty(t, downloads, "the download is removed once extracted")
+}
+
+func TestStateSyncer_RefusedBundleFailsItsDeployments(t *testing.T) {
+	deployments := map[string][]byte{"deployment-a": testDeploymentYAML, "deployment-b": testDeploymentYAML, "deployment-c": testDeploymentYAML}
+	server := &limitsTestServer{
+		manifest:    versionedManifest(2, `"v2"`, deployments, nil),
+		deployments: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	env.syncer.performSync()
+
+	// version 3 upgrades them through a bundle with an entry leaving the extraction root
+	upgradedYAML := []byte("apiVersion: application.margo.org/v1alpha1\nkind: ApplicationDeployment\nmetadata:\n  name: upgraded\n")
+	upgraded := map[string][]byte{"deployment-a": upgradedYAML, "deployment-b": upgradedYAML, "deployment-c": upgradedYAML}
+	archiver := archive.NewArchiver(archive.ArchiveFormatTarGZ)
+	for deploymentId, data := range upgraded {
+		_, _, err := archiver.AppendContent(data, deploymentId+".yaml")
+		require.NoError(t, err)
+	}
+	_, _, err := archiver.AppendContent([]byte("owned"), "../../etc/cron.d/escape")
+	require.NoError(t, err)
+	bundleFile, _, _, bundlePath, err := archiver.CreateArchive()
+	require.NoError(t, err)
+	bundleFile.Close()
+	t.Cleanup(func() { archiver.Cleanup() })
+	bundle, err := os.ReadFile(bundlePath)
+	require.NoError(t, err)
+
+	server.manifest = versionedManifest(3, `"v3"`, upgraded, bundle)
+	server.deployments[testDigest(bundle)] = bundle
+	server.deployments[testDigest(upgradedYAML)] = upgradedYAML
+	env.syncer.performSync()
+
+	for deploymentId := range upgraded {
+		record, err := env.db.GetDeployment(deploymentId)
+		require.NoError(t, err, deploymentId)
+		assert.Equal(t, "FAILED", record.Phase, deploymentId)
+		assert.Contains(t, record.Message, "Bundle refused: failed to extract bundle: unsafe path in bundle", deploymentId)
+		assert.NotEqual(t, "upgraded", record.DesiredState.Metadata.Name, "nothing of a refused bundle is applied")
+	}
+	history := env.db.ListSyncHistory()
+	require.Len(t, history, 2)
+	assert.Equal(t, database.DeliveredViaBundle, history[1].DeliveredVia)
+	assert.Empty(t, history[1].Delivered)
+}
+
+func TestStateSyncer_UnchangedManifestKeepsProvenance(t *testing.T) {
+	server := &limitsTestServer{
+		manifest:    versionedManifest(2, `"v2"`, map[string][]byte{"deployment-a": testDeploymentYAML}, nil),
+		deployments: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	env.syncer.performSync()
+	delivered, err := env.db.GetDeployment("deployment-a")
+	require.NoError(t, err)
+
+	server.manifest = func(w http.ResponseWriter) int64 {
+		w.WriteHeader(http.StatusNotModified)
+		return 0
+	}
+	env.syncer.performSync()
+
+	unchanged, err := env.db.GetDeployment("deployment-a")
+	require.NoError(t, err)
+	assert.Equal(t, delivered.Provenance, unchanged.Provenance)
+	assert.Len(t, env.db.ListSyncHistory(), 1, "a sync without changes is not recorded")
+}
+
+func TestStateSyncer_ClassifiesNewDigests(t *testing.T) {
+	withGreeting := func(greeting string) []byte {
+		return []byte("apiVersion: application.margo.org/v1alpha1\nkind: ApplicationDeployment\nmetadata:\n  name: greeter\n" +
+			"spec:\n  parameters:\n    greeting:\n      value: " + greeting + "\n      targets:\n        - pointer: settings.greeting\n          components: [greeter]\n")
+	}
+	hello, bonjour := withGreeting("hello"), withGreeting("bonjour")
+	server := &limitsTestServer{
+		manifest:    versionedManifest(2, `"v2"`, map[string][]byte{"deployment-a": hello}, nil),
+		deployments: map[string][]byte{testDigest(hello): hello, testDigest(bonjour): bonjour, testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	changeClass := func(deploymentId string) database.ChangeClass {
+		record, err := env.db.GetDeployment(deploymentId)
+		require.NoError(t, err)
+		return record.ChangeClass
+	}
+
+	env.syncer.performSync()
+	assert.Equal(t, database.ChangeClassInitial, changeClass("deployment-a"))
+
+	server.manifest = versionedManifest(3, `"v3"`, map[string][]byte{"deployment-a": bonjour}, nil)
+	env.syncer.performSync()
+	assert.Equal(t, database.ChangeClassValues, changeClass("deployment-a"))
+
+	// deployment-a is stored again with the same digest, that is not a change of its own
+	server.manifest = versionedManifest(4, `"v4"`, map[string][]byte{"deployment-a": bonjour, "deployment-b": testDeploymentYAML}, nil)
+	env.syncer.performSync()
+	assert.Equal(t, database.ChangeClassValues, changeClass("deployment-a"))
+	assert.Equal(t, database.ChangeClassInitial, changeClass("deployment-b"))
+}
+
+func TestStateSyncer_UnverifiableDigestFailsTheDeployment(t *testing.T) {
+	blake3Digest := "blake3:" + strings.Repeat("ab", 32)
+	server := &limitsTestServer{
+		manifest: func(w http.ResponseWriter) int64 {
+			manifest := sbi.UnsignedAppStateManifest{ManifestVersion: 2, Deployments: []sbi.DeploymentManifestRef{
+				{DeploymentId: "deployment-existing", Digest: blake3Digest, Url: "/api/v1/clients/device-1/deployments/deployment-existing/" + blake3Digest},
+				{DeploymentId: "deployment-small", Digest: testDigest(testDeploymentYAML), Url: "/api/v1/clients/device-1/deployments/deployment-small/" + testDigest(testDeploymentYAML)},
+			}}
+			body, _ := json.Marshal(manifest)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"new"`)
+			n, _ := w.Write(body)
+			return int64(n)
+		},
+		deployments: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+
+	env.syncer.performSync()
+
+	existing, err := env.db.GetDeployment("deployment-existing")
+	require.NoError(t, err)
+	assert.Equal(t, "FAILED", existing.Phase)
+	assert.Contains(t, existing.Message, `digest algorithm "blake3" cannot be verified`)
+	_, err = env.db.GetDeployment("deployment-small")
+	assert.NoError(t, err, "verifiable deployments of the manifest are still applied")
+}
+
+func TestStateSyncer_ManifestETagFallbackIsUnchanged(t *testing.T) {
+	env := newLimitsTestEnv(t, &limitsTestServer{}, wfm.ManifestLimits{})
+
+	empty := &sbi.UnsignedAppStateManifest{ManifestVersion: 3, Deployments: []sbi.DeploymentManifestRef{}}
+	manifestJSON, err := json.Marshal(empty)
+	require.NoError(t, err)
+	etag, err := env.syncer.manifestETag(empty, nil)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("\"sha256:%x\"", sha256.Sum256(manifestJSON)), etag)
+
+	bundleDigest := testDigest([]byte("bundle"))
+	withBundle := &sbi.UnsignedAppStateManifest{ManifestVersion: 3, Bundle: &sbi.DeploymentBundleRef{Digest: &bundleDigest}}
+	etag, err = env.syncer.manifestETag(withBundle, nil)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("\"%s\"", bundleDigest), etag)
+}
+
+// signingKeyPEM generates a manifest signing key, it returns the private and the public key PEM
+func signingKeyPEM(t *testing.T) (string, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	privDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDER})),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+}
+
+// signedManifestOf writes the manifest of manifestOf signed with the private key
+func signedManifestOf(t *testing.T, privateKeyPEM string, deployments map[string][]byte) func(w http.ResponseWriter) int64 {
+	unsigned := manifestOf(deployments)
+	return func(w http.ResponseWriter) int64 {
+		recorder := httptest.NewRecorder()
+		unsigned(recorder)
+		signed, err := crypto.SignManifest(recorder.Body.Bytes(), privateKeyPEM)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", crypto.SignedManifestMediaType)
+		w.Header().Set("ETag", `"new"`)
+		n, _ := w.Write(signed)
+		return int64(n)
+	}
+}
+
+// requireSignedManifests makes the env only accept manifests signed by the key of the public key PEM
+func (env *limitsTestEnv) requireSignedManifests(t *testing.T, publicKeyPEM []byte) {
+	t.Helper()
+	verifier, err := crypto.NewManifestVerifier(publicKeyPEM)
+	require.NoError(t, err)
+	env.client.SetManifestVerifier(verifier)
+	WithRequiredManifestSignatures()(env.syncer)
+}
+
+func TestStateSyncer_SignedManifestIsVerifiedAndApplied(t *testing.T) {
+	privateKeyPEM, publicKeyPEM := signingKeyPEM(t)
+	server := &limitsTestServer{
+		manifest:    signedManifestOf(t, privateKeyPEM, map[string][]byte{"deployment-signed": testDeploymentYAML}),
+		deployments: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	env.requireSignedManifests(t, publicKeyPEM)
+
+	env.syncer.performSync()
+
+	assert.Contains(t, server.manifestAccept, crypto.SignedManifestMediaType)
+	signedDeployment, err := env.db.GetDeployment("deployment-signed")
+	require.NoError(t, err)
+	assert.NotNil(t, signedDeployment.DesiredState)
+	etag, _ := env.db.GetLastSyncedETag()
+	assert.Equal(t, `"new"`, etag)
+	assert.Empty(t, env.events)
+}
+
+func TestStateSyncer_ManifestSignedByAnotherKeyIsRejected(t *testing.T) {
+	privateKeyPEM, _ := signingKeyPEM(t)
+	_, trustedPublicKeyPEM := signingKeyPEM(t)
+	server := &limitsTestServer{
+		manifest:    signedManifestOf(t, privateKeyPEM, map[string][]byte{"deployment-signed": testDeploymentYAML}),
+		deployments: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	env.requireSignedManifests(t, trustedPublicKeyPEM)
+
+	env.syncer.performSync()
+
+	env.assertDesiredStateKept(t)
+	assert.ErrorContains(t, env.syncer.lastSyncError, "manifest signature verification failed")
+}
+
+func TestStateSyncer_UnsignedManifestIsRejectedWhenSignaturesAreRequired(t *testing.T) {
+	_, publicKeyPEM := signingKeyPEM(t)
+	server := &limitsTestServer{
+		manifest:    manifestOf(map[string][]byte{"deployment-unsigned": testDeploymentYAML}),
+		deployments: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	env.requireSignedManifests(t, publicKeyPEM)
+
+	env.syncer.performSync()
+
+	env.assertDesiredStateKept(t)
+	assert.ErrorContains(t, env.syncer.lastSyncError, "rejected unsigned state manifest")
+}
+
+func TestStateSyncer_SignedManifestWithoutVerificationKey(t *testing.T) {
+	privateKeyPEM, _ := signingKeyPEM(t)
+	server := &limitsTestServer{
+		manifest:    signedManifestOf(t, privateKeyPEM, map[string][]byte{"deployment-signed": testDeploymentYAML}),
+		deployments: map[string][]byte{testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+
+	env.syncer.performSync()
+
+	env.assertDesiredStateKept(t)
+	assert.ErrorContains(t, env.syncer.lastSyncError, "no manifest verification key is configured")
+}
+
+// signedBundleManifest writes a manifest delivering the deployments through the bundle, with the
+// bundle signature when one is given
+func signedBundleManifest(deployments map[string][]byte, bundle, signature []byte) func(w http.ResponseWriter) int64 {
+	unsigned := versionedManifest(2, `"new"`, deployments, bundle)
+	return func(w http.ResponseWriter) int64 {
+		recorder := httptest.NewRecorder()
+		unsigned(recorder)
+		var manifest map[string]interface{}
+		json.Unmarshal(recorder.Body.Bytes(), &manifest)
+		if signature != nil {
+			manifest["bundle"].(map[string]interface{})["signature"] = string(signature)
+		}
+		body, _ := json.Marshal(manifest)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"new"`)
+		n, _ := w.Write(body)
+		return int64(n)
+	}
+}
+
+// newSignedBundleTestEnv serves the bundle of the deployments with the signature, the deployments
+// can also be fetched one by one, and verifies bundles against the public key
+func newSignedBundleTestEnv(t *testing.T, deployments map[string][]byte, signature, publicKeyPEM []byte) *limitsTestEnv {
+	t.Helper()
+	bundle := testBundle(t, deployments)
+	server := &limitsTestServer{
+		manifest:    signedBundleManifest(deployments, bundle, signature),
+		deployments: map[string][]byte{testDigest(bundle): bundle, testDigest(testDeploymentYAML): testDeploymentYAML},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+	verifier, err := crypto.NewManifestVerifier(publicKeyPEM)
+	require.NoError(t, err)
+	WithBundleVerifier(verifier)(env.syncer)
+	return env
+}
+
+func TestStateSyncer_SignedBundleIsVerifiedAndApplied(t *testing.T) {
+	privateKeyPEM, publicKeyPEM := signingKeyPEM(t)
+	deployments := map[string][]byte{"deployment-a": testDeploymentYAML}
+	signature, err := crypto.SignBundle(testBundle(t, deployments), privateKeyPEM)
+	require.NoError(t, err)
+	env := newSignedBundleTestEnv(t, deployments, signature, publicKeyPEM)
+
+	env.syncer.performSync()
+
+	require.NoError(t, env.syncer.lastSyncError)
+	record, err := env.db.GetDeployment("deployment-a")
+	require.NoError(t, err)
+	require.NotNil(t, record.Provenance)
+	assert.Equal(t, database.DeliveredViaBundle, record.Provenance.DeliveredVia)
+}
+
+func TestStateSyncer_SignedBundleOfASignedManifestIsVerified(t *testing.T) {
+	privateKeyPEM, publicKeyPEM := signingKeyPEM(t)
+	deployments := map[string][]byte{"deployment-a": testDeploymentYAML}
+	signature, err := crypto.SignBundle(testBundle(t, deployments), privateKeyPEM)
+	require.NoError(t, err)
+	env := newSignedBundleTestEnv(t, deployments, signature, publicKeyPEM)
+	// the bundle signature is read from the payload of the signed manifest
+	unsigned := env.server.manifest
+	env.server.manifest = func(w http.ResponseWriter) int64 {
+		recorder := httptest.NewRecorder()
+		unsigned(recorder)
+		signed, err := crypto.SignManifest(recorder.Body.Bytes(), privateKeyPEM)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", crypto.SignedManifestMediaType)
+		w.Header().Set("ETag", `"new"`)
+		n, _ := w.Write(signed)
+		return int64(n)
+	}
+	env.requireSignedManifests(t, publicKeyPEM)
+
+	env.syncer.performSync()
+
+	require.NoError(t, env.syncer.lastSyncError)
+	record, err := env.db.GetDeployment("deployment-a")
+	require.NoError(t, err)
+	require.NotNil(t, record.Provenance)
+	assert.Equal(t, database.DeliveredViaBundle, record.Provenance.DeliveredVia)
+}
+
+func TestStateSyncer_BundleSignedByAnotherKeyIsRejected(t *testing.T) {
+	privateKeyPEM, _ := signingKeyPEM(t)
+	_, trustedPublicKeyPEM := signingKeyPEM(t)
+	deployments := map[string][]byte{"deployment-a": testDeploymentYAML}
+	signature, err := crypto.SignBundle(testBundle(t, deployments), privateKeyPEM)
+	require.NoError(t, err)
+	env := newSignedBundleTestEnv(t, deployments, signature, trustedPublicKeyPEM)
+
+	env.syncer.performSync()
+
+	// the deployments are not fetched one by one instead
+	env.assertDesiredStateKept(t)
+	assert.ErrorIs(t, env.syncer.lastSyncError, crypto.ErrBundleSignature)
+}
+
+func TestStateSyncer_UnsignedBundleIsRejectedWhenSignaturesAreRequired(t *testing.T) {
+	_, publicKeyPEM := signingKeyPEM(t)
+	env := newSignedBundleTestEnv(t, map[string][]byte{"deployment-a": testDeploymentYAML}, nil, publicKeyPEM)
+
+	env.syncer.performSync()
+
+	env.assertDesiredStateKept(t)
+	assert.ErrorContains(t, env.syncer.lastSyncError, "is not signed")
+}
+
+func TestStateSyncer_ShouldDownloadBundle(t *testing.T) {
+	digest := testDigest([]byte("bundle"))
+	manifest := func(deployments int, sizeBytes float32) *sbi.UnsignedAppStateManifest {
+		return &sbi.UnsignedAppStateManifest{
+			Deployments: make([]sbi.DeploymentManifestRef, deployments),
+			Bundle:      &sbi.DeploymentBundleRef{Digest: &digest, SizeBytes: &sizeBytes},
+		}
+	}
+	small := &types.BundleFetchConfig{SizeThresholdBytes: 1000}
+
+	tests := []struct {
+		name     string
+		config   *types.BundleFetchConfig
+		manifest *sbi.UnsignedAppStateManifest
+		want     bool
+	}{
+		{"defaults, few deployments and a large bundle", nil, manifest(2, 64<<20), false},
+		{"defaults, more deployments than the threshold", nil, manifest(3, 64<<20), true},
+		{"defaults, bundle below the size threshold", nil, manifest(1, 50<<20-4), true},
+		{"defaults, bundle at the size threshold", nil, manifest(1, 50<<20), false},
+		{"deployment threshold, at the threshold", &types.BundleFetchConfig{DeploymentThreshold: 4, SizeThresholdBytes: 1000}, manifest(4, 2000), false},
+		{"deployment threshold, above the threshold", &types.BundleFetchConfig{DeploymentThreshold: 4, SizeThresholdBytes: 1000}, manifest(5, 2000), true},
+		{"size threshold, below the threshold", small, manifest(1, 999), true},
+		{"size threshold, at the threshold", small, manifest(1, 1000), false},
+		{"always, a single large bundle", &types.BundleFetchConfig{Mode: types.BundleFetchAlways}, manifest(1, 64<<20), true},
+		{"always, bundle above maxBundleBytes", &types.BundleFetchConfig{Mode: types.BundleFetchAlways}, manifest(1, 2<<30), false},
+		{"always, no bundle", &types.BundleFetchConfig{Mode: types.BundleFetchAlways}, &sbi.UnsignedAppStateManifest{Deployments: make([]sbi.DeploymentManifestRef, 5)}, false},
+		{"never, many deployments and a small bundle", &types.BundleFetchConfig{Mode: types.BundleFetchNever}, manifest(10, 1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syncer := NewStateSyncer(nil, nil, "device-1", 30, zap.NewNop().Sugar(), WithBundleFetch(tt.config))
+			assert.Equal(t, tt.want, syncer.shouldDownloadBundle(tt.manifest))
+		})
+	}
+}
+
+func TestStateSyncer_PurgesCachedDeploymentsNoLongerKnown(t *testing.T) {
+	otherYAML := []byte("apiVersion: application.margo.org/v1alpha1\nkind: ApplicationDeployment\nmetadata:\n  name: other\n")
+	server := &limitsTestServer{
+		manifest: manifestOf(map[string][]byte{"deployment-a": testDeploymentYAML}),
+		deployments: map[string][]byte{
+			testDigest(testDeploymentYAML): testDeploymentYAML,
+			testDigest(otherYAML):          otherYAML,
+		},
+	}
+	env := newLimitsTestEnv(t, server, wfm.ManifestLimits{})
+
+	env.syncer.performSync()
+	stats, err := env.client.CacheStats()
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Deployments.Entries)
+
+	// deployment-a is dropped by the manifest but kept while the database still knows it
+	server.manifest = manifestOf(map[string][]byte{"deployment-b": otherYAML})
+	env.syncer.performSync()
+	stats, err = env.client.CacheStats()
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Deployments.Entries)
+	assert.Zero(t, stats.Deployments.Evicted)
+
+	// once removed from the database its cache entry goes with the next sync
+	env.db.RemoveDeployment("deployment-a")
+	env.syncer.performSync()
+	stats, err = env.client.CacheStats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Deployments.Entries)
+	assert.Equal(t, uint64(1), stats.Deployments.Evicted)
+}
@@ -2,10 +2,15 @@ package main
 
 import (
     "context"
+    "fmt"
+    "sync"
+    "sync/atomic"
     "time"
 
     
     "github.com/margo/sandbox/poc/device/agent/database"
+    "github.com/margo/sandbox/poc/device/agent/health"
+    "github.com/margo/sandbox/poc/device/agent/metrics"
     wfm "github.com/margo/sandbox/poc/wfm/cli"
     "github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
     "go.uber.org/zap"
@@ -14,6 +19,8 @@ import (
 type StatusReporterIfc interface {
     Start()
     Stop()
+    ReportNow(deploymentId, triggerId string) error
+    Flush(ctx context.Context) error
 }
 
 type StatusReporter struct {
@@ -22,16 +29,48 @@ type StatusReporter struct {
     deviceID  string
     log       *zap.SugaredLogger
     stopChan  chan struct{}
+    // backlog counts the status reports that are queued or being sent
+    backlog   atomic.Int64
+    outcomeMu sync.Mutex
+    failures  int
+    lastError error
+    metrics   metrics.Recorder
 }
 
-func NewStatusReporter(db database.DatabaseIfc, client wfm.SBIAPIClientInterface, deviceID string, log *zap.SugaredLogger) *StatusReporter {
-    return &StatusReporter{
+// StatusReporterOption configures optional StatusReporter behaviour
+type StatusReporterOption func(sr *StatusReporter)
+
+// WithReportMetrics records the depth of the status report queue
+func WithReportMetrics(recorder metrics.Recorder) StatusReporterOption {
+    return func(sr *StatusReporter) {
+        if recorder != nil {
+            sr.metrics = recorder
+        }
+    }
+}
+
+const (
+    // reporterBacklogThreshold is the number of unsent status reports at which reporting is degraded
+    reporterBacklogThreshold = 100
+    // reporterFailureThreshold is the number of consecutive failed reports at which reporting is degraded
+    reporterFailureThreshold = 3
+    // reporterFlushPollInterval is how often Flush checks whether the reports were sent
+    reporterFlushPollInterval = 50 * time.Millisecond
+)
+
+func NewStatusReporter(db database.DatabaseIfc, client wfm.SBIAPIClientInterface, deviceID string, log *zap.SugaredLogger, opts ...StatusReporterOption) *StatusReporter {
+    sr := &StatusReporter{
         database:  db,
         apiClient: client,
         deviceID:  deviceID,
         log:       log,
         stopChan:  make(chan struct{}),
+        metrics:   metrics.Nop{},
+    }
+    for _, opt := range opts {
+        opt(sr)
     }
+    return sr
 }
 
 func (sr *StatusReporter) Start() {
@@ -43,6 +82,21 @@ func (sr *StatusReporter) Stop() {
     close(sr.stopChan)
 }
 
+// Flush waits until the status reports queued or being sent are done, or ctx is done. The agent
+// flushes before it stops so the WFM learns the last phases, e.g. INTERRUPTED deployments.
+func (sr *StatusReporter) Flush(ctx context.Context) error {
+    ticker := time.NewTicker(reporterFlushPollInterval)
+    defer ticker.Stop()
+    for sr.backlog.Load() > 0 {
+        select {
+        case <-ctx.Done():
+            return fmt.Errorf("%d status reports not sent: %w", sr.backlog.Load(), ctx.Err())
+        case <-ticker.C:
+        }
+    }
+    return nil
+}
+
 func (sr *StatusReporter) onDeploymentChange(appID string, record *database.DeploymentRecord, changeType database.DeploymentRecordChangeType) {
     // Concise logging with only important fields
     logFields := []interface{}{
@@ -76,24 +130,86 @@ func (sr *StatusReporter) onDeploymentChange(appID string, record *database.Depl
     // Report status when phase changes
     if changeType == database.DeploymentChangeTypeDesiredStateAdded ||
         changeType == database.DeploymentChangeTypeComponentPhaseChanged {
-        go sr.reportStatus(appID, record)
+        sr.queueChanged(1)
+        go func() {
+            defer sr.queueChanged(-1)
+            sr.reportStatus(appID, record)
+        }()
+    }
+}
+
+func (sr *StatusReporter) Name() string {
+    return health.ComponentReporter
+}
+
+// Health is degraded when status reports pile up or keep failing, the WFM then shows outdated states
+func (sr *StatusReporter) Health() health.Report {
+    sr.outcomeMu.Lock()
+    failures, lastError := sr.failures, sr.lastError
+    sr.outcomeMu.Unlock()
+
+    backlog := sr.backlog.Load()
+    report := health.OK(map[string]float64{
+        "backlog":             float64(backlog),
+        "consecutiveFailures": float64(failures),
+    })
+    if backlog >= reporterBacklogThreshold {
+        report.Degrade(fmt.Sprintf("%d status reports not sent yet", backlog))
+    }
+    if failures >= reporterFailureThreshold {
+        report.Degrade(fmt.Sprintf("%d consecutive status reports failed, last error: %v", failures, lastError))
+    }
+    return report
+}
+
+// queueChanged adds delta to the status reports that are queued or being sent
+func (sr *StatusReporter) queueChanged(delta int64) {
+    sr.metrics.StatusQueueDepth(sr.backlog.Add(delta))
+}
+
+func (sr *StatusReporter) recordReportOutcome(err error) {
+    sr.outcomeMu.Lock()
+    defer sr.outcomeMu.Unlock()
+    sr.lastError = err
+    if err != nil {
+        sr.failures++
+        return
     }
+    sr.failures = 0
 }
 
 
-func (sr *StatusReporter) reportStatus(appID string, record *database.DeploymentRecord) {
+// ReportNow sends the status of the deployment again, it returns once the WFM answered
+func (sr *StatusReporter) ReportNow(deploymentId, triggerId string) error {
+    record, err := sr.database.GetDeployment(deploymentId)
+    if err != nil {
+        return fmt.Errorf("%w %s", errUnknownDeployment, deploymentId)
+    }
+    if record.CurrentState == nil && record.Phase != "FAILED" && record.Phase != phaseWaitingDependency && record.Phase != phaseInterrupted {
+        return fmt.Errorf("deployment %s has no status to report yet, phase %s", deploymentId, record.Phase)
+    }
+
+    sr.log.Infow("Triggered status report", "appId", deploymentId, "triggerId", triggerId)
+    sr.queueChanged(1)
+    defer sr.queueChanged(-1)
+    return sr.reportStatus(deploymentId, record)
+}
+
+// reportStatus sends the status of the deployment, deployments without a status yet are skipped
+func (sr *StatusReporter) reportStatus(appID string, record *database.DeploymentRecord) (err error) {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
     // Add nil check for record
     if record == nil {
         sr.log.Warnw("Skipping status report - nil deployment record", "appId", appID)
-        return
+        return nil
     }
 
     // Allow reporting failures even without current state
     // If phase is FAILED but no current state, create one from desired state
-    if record.CurrentState == nil {
+    // deployments waiting for their dependencies have nothing installed yet, they are reported pending
+    if record.CurrentState == nil && record.Phase != phaseWaitingDependency && record.Phase != phaseInterrupted {
         if record.Phase == "FAILED" && record.DesiredState != nil {
             sr.log.Infow("Creating current state for failed deployment", "appId", appID)
             
@@ -103,12 +219,12 @@ func (sr *StatusReporter) reportStatus(appID string, record *database.Deployment
             
             // This will trigger another status report via the subscriber
             sr.database.SetCurrentState(appID, failedState)
-            return
+            return nil
         }
         
         // For non-failed states, skip reporting
         sr.log.Debugw("Skipping status report - no current state yet", "appId", appID, "phase", record.Phase)
-        return
+        return nil
     }
 
     // Convert component status - ensure non-nil slice
@@ -125,6 +241,7 @@ func (sr *StatusReporter) reportStatus(appID string, record *database.Deployment
 
     // Use the actual sbi constants for deployment state
     var deploymentState sbi.DeploymentStatusManifestStatusState
+    var deploymentErr error
     
     // Map the phase to the correct deployment state (case-insensitive)
     switch record.Phase {
@@ -134,12 +251,39 @@ func (sr *StatusReporter) reportStatus(appID string, record *database.Deployment
         deploymentState = sbi.DeploymentStatusManifestStatusStateInstalling
     case "RUNNING", "running":
         deploymentState = sbi.DeploymentStatusManifestStatusStateInstalled
+    case "COMPLETED", "completed":
+        // one-shot components that ran to completion are reported as installed
+        deploymentState = sbi.DeploymentStatusManifestStatusStateInstalled
     case "FAILED", "failed":
         deploymentState = sbi.DeploymentStatusManifestStatusStateFailed
     case "REMOVING", "removing":
         deploymentState = sbi.DeploymentStatusManifestStatusStateRemoving
     case "REMOVED", "removed":
         deploymentState = sbi.DeploymentStatusManifestStatusStateRemoved
+    case phaseWaitingDependency:
+        deploymentState = sbi.DeploymentStatusManifestStatusStatePending
+        deploymentErr = &wfm.DeploymentStatusError{Code: phaseWaitingDependency, Message: record.Message}
+    case phaseWaitingDependents:
+        deploymentState = sbi.DeploymentStatusManifestStatusStateRemoving
+        deploymentErr = &wfm.DeploymentStatusError{Code: phaseWaitingDependents, Message: record.Message}
+    case phaseRemovalBlocked:
+        deploymentState = sbi.DeploymentStatusManifestStatusStateRemoving
+        deploymentErr = &wfm.DeploymentStatusError{Code: phaseRemovalBlocked, Message: record.Message}
+    case phaseDegraded:
+        // the workload is installed but some of its services are not healthy
+        deploymentState = sbi.DeploymentStatusManifestStatusStateFailed
+        deploymentErr = &wfm.DeploymentStatusError{Code: phaseDegraded, Message: record.Message}
+    case phaseInterrupted:
+        // the operation stopped halfway, it is resumed on the next start of the agent
+        deploymentState = sbi.DeploymentStatusManifestStatusStateInstalling
+        if record.DesiredState != nil && record.DesiredState.Status.Status.State == sbi.DeploymentStatusManifestStatusStateRemoving {
+            deploymentState = sbi.DeploymentStatusManifestStatusStateRemoving
+        }
+        deploymentErr = &wfm.DeploymentStatusError{Code: phaseInterrupted, Message: record.Message}
+    case phaseRemovalOverdue:
+        // the workload still runs, failing the removal makes the WFM look at it
+        deploymentState = sbi.DeploymentStatusManifestStatusStateFailed
+        deploymentErr = &wfm.DeploymentStatusError{Code: phaseRemovalOverdue, Message: record.Message}
     default:
         sr.log.Warnw("Unknown deployment phase, defaulting to PENDING", "appId", appID, "phase", record.Phase)
         deploymentState = sbi.DeploymentStatusManifestStatusStatePending
@@ -161,24 +305,38 @@ func (sr *StatusReporter) reportStatus(appID string, record *database.Deployment
                 "panic", r,
                 "phase", record.Phase,
                 "state", deploymentState)
+            err = fmt.Errorf("status report panicked: %v", r)
         }
     }()
 
-    err := sr.apiClient.ReportDeploymentStatus(
+    // pair the status with the manifest version that delivered the desired state, unknown for
+    // desired states stored before provenance was tracked
+    var requestOptions []wfm.HTTPApiClientRequestEditorOptions
+    if record.Provenance != nil && record.Provenance.SourceManifestVersion != 0 {
+        requestOptions = append(requestOptions, wfm.WithManifestVersion(record.Provenance.SourceManifestVersion))
+    }
+    if record.ChangeClass != "" {
+        requestOptions = append(requestOptions, wfm.WithChangeClass(string(record.ChangeClass)))
+    }
+
+    err = sr.apiClient.ReportDeploymentStatus(
         ctx, 
         sr.deviceID, 
         appID, 
         deploymentState, 
         components,
-        nil, // error parameter
+        deploymentErr,
+        requestOptions...,
     )
     
+    sr.recordReportOutcome(err)
     if err != nil {
         sr.log.Errorw("Failed to report status", "appId", appID, "error", err)
-        return
+        return err
     }
 
     sr.log.Infow("Status reported successfully", "appId", appID, "phase", record.Phase, "state", deploymentState)
+    return nil
 }
 
 
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/margo/sandbox/poc/device/agent/database"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStatusReporter_ReportsManifestVersion(t *testing.T) {
+	t.Chdir(t.TempDir())
+	versions := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		versions <- r.Header.Get(wfm.ManifestVersionHeader)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := wfm.NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+	sr := NewStatusReporter(newTestDatabase(t, "data"), client, "device-1", zap.NewNop().Sugar())
+
+	const deploymentId = "5f0c3a2e-6c1d-4f1e-9a55-000000000003"
+	record := &database.DeploymentRecord{
+		DeploymentID: deploymentId,
+		Phase:        "running",
+		CurrentState: &database.AppDeploymentState{},
+		Provenance:   &database.Provenance{SourceManifestVersion: 7, DeliveredVia: database.DeliveredViaBundle},
+	}
+	sr.reportStatus(deploymentId, record)
+	assert.Equal(t, "7", <-versions)
+
+	// migrated records do not know the manifest version
+	record.Provenance = database.UnknownProvenance()
+	sr.reportStatus(deploymentId, record)
+	assert.Equal(t, "", <-versions)
+}
+
+func TestStatusReporter_ReportsChangeClass(t *testing.T) {
+	t.Chdir(t.TempDir())
+	classes := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		classes <- r.Header.Get(wfm.ChangeClassHeader)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := wfm.NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+	sr := NewStatusReporter(newTestDatabase(t, "data"), client, "device-1", zap.NewNop().Sugar())
+
+	const deploymentId = "5f0c3a2e-6c1d-4f1e-9a55-000000000004"
+	record := &database.DeploymentRecord{
+		DeploymentID: deploymentId,
+		Phase:        "running",
+		CurrentState: &database.AppDeploymentState{},
+		ChangeClass:  database.ChangeClassValues,
+	}
+	require.NoError(t, sr.reportStatus(deploymentId, record))
+	assert.Equal(t, "values", <-classes)
+
+	// records stored before changes were classified
+	record.ChangeClass = ""
+	require.NoError(t, sr.reportStatus(deploymentId, record))
+	assert.Equal(t, "", <-classes)
+}
+
+func TestStatusReporter_ReportsWaitingDependency(t *testing.T) {
+	t.Chdir(t.TempDir())
+	reports := make(chan sbi.DeploymentStatusManifest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report sbi.DeploymentStatusManifest
+		json.NewDecoder(r.Body).Decode(&report)
+		reports <- report
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := wfm.NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+	sr := NewStatusReporter(newTestDatabase(t, "data"), client, "device-1", zap.NewNop().Sugar())
+
+	// nothing is installed while the deployment waits, it is reported anyway
+	const deploymentId = "5f0c3a2e-6c1d-4f1e-9a55-000000000005"
+	record := &database.DeploymentRecord{
+		DeploymentID: deploymentId,
+		Phase:        phaseWaitingDependency,
+		Message:      "waiting for dependencies: mqtt-broker not deployed",
+		DesiredState: &database.AppDeploymentState{},
+	}
+	require.NoError(t, sr.reportStatus(deploymentId, record))
+
+	report := <-reports
+	assert.Equal(t, sbi.DeploymentStatusManifestStatusStatePending, report.Status.State)
+	require.NotNil(t, report.Status.Error)
+	assert.Equal(t, phaseWaitingDependency, *report.Status.Error.Code)
+	assert.Equal(t, record.Message, *report.Status.Error.Message)
+}
+
+func TestStatusReporter_ReportsBlockedRemovals(t *testing.T) {
+	t.Chdir(t.TempDir())
+	reports := make(chan sbi.DeploymentStatusManifest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report sbi.DeploymentStatusManifest
+		json.NewDecoder(r.Body).Decode(&report)
+		reports <- report
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := wfm.NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+	sr := NewStatusReporter(newTestDatabase(t, "data"), client, "device-1", zap.NewNop().Sugar())
+
+	const deploymentId = "5f0c3a2e-6c1d-4f1e-9a55-000000000006"
+	tests := []struct {
+		phase     string
+		wantState sbi.DeploymentStatusManifestStatusState
+	}{
+		{phase: phaseRemovalBlocked, wantState: sbi.DeploymentStatusManifestStatusStateRemoving},
+		{phase: phaseRemovalOverdue, wantState: sbi.DeploymentStatusManifestStatusStateFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.phase, func(t *testing.T) {
+			record := &database.DeploymentRecord{
+				DeploymentID: deploymentId,
+				Phase:        tt.phase,
+				Message:      "removal of a protected deployment blocked",
+				CurrentState: &database.AppDeploymentState{},
+			}
+			require.NoError(t, sr.reportStatus(deploymentId, record))
+
+			report := <-reports
+			assert.Equal(t, tt.wantState, report.Status.State)
+			require.NotNil(t, report.Status.Error)
+			assert.Equal(t, tt.phase, *report.Status.Error.Code)
+			assert.Equal(t, record.Message, *report.Status.Error.Message)
+		})
+	}
+}
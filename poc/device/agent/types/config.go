@@ -1,12 +1,30 @@
 package types
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/margo/sandbox/poc/device/agent/breaker"
+	"github.com/margo/sandbox/poc/device/agent/health"
+	wfm "github.com/margo/sandbox/poc/wfm/cli"
+	"github.com/margo/sandbox/shared-lib/crypto"
+	httputils "github.com/margo/sandbox/shared-lib/http"
+	"github.com/margo/sandbox/shared-lib/redact"
+	"github.com/margo/sandbox/shared-lib/workloads"
 	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v2"
 )
 
@@ -49,17 +67,360 @@ type Config struct {
 	DeviceRootIdentity DeviceRootIdentity          `yaml:"deviceRootIdentity" validate:"required"`
 	Wfm                WFMConfig                   `yaml:"wfm" validate:"required"`
 	StateSeeking       StateSeekingConfig          `yaml:"stateSeeking" validate:"required"`
-	Capabilities       CapabilitiesDiscoveryConfig `yaml:"capabilities" validate:"required"`
+	Capabilities       CapabilitiesDiscoveryConfig `yaml:"capabilities"`
 	Runtimes           []RuntimeInfo               `yaml:"runtimes" validate:"required"`
+	// DataDir holds the database, the caches, the compose files and the downloaded bundles of the
+	// agent, two agents on one host need one each
+	DataDir string `yaml:"dataDir,omitempty"`
+	// EventHooks notifies local integrations about deployment and sync events
+	EventHooks *EventHooksConfig `yaml:"eventHooks,omitempty"`
+	// Health exposes the liveness, readiness and component health endpoints
+	Health *HealthConfig `yaml:"health,omitempty"`
+	// Metrics exports the agent metrics to Prometheus
+	Metrics *MetricsConfig `yaml:"metrics,omitempty"`
+	// ImageGC removes the images of removed and upgraded deployments once nothing uses them
+	ImageGC *ImageGCConfig `yaml:"imageGC,omitempty"`
+	// RemovalProtection tunes how deployments protected from removal are reported while the WFM
+	// drops them without confirming the removal
+	RemovalProtection *RemovalProtectionConfig `yaml:"removalProtection,omitempty"`
+	// Provisioning tells where the provisioning file applied on the first boot is
+	Provisioning *ProvisioningConfig `yaml:"provisioning,omitempty"`
+	// Shutdown tunes how long the agent waits for the deployments in progress when it stops
+	Shutdown *ShutdownConfig `yaml:"shutdown,omitempty"`
+	// DeploymentHistory bounds the history of removed deployments kept in the agent database
+	DeploymentHistory *DeploymentHistoryConfig `yaml:"deploymentHistory,omitempty"`
+	// Database selects where the agent keeps its deployments and device settings
+	Database *DatabaseConfig `yaml:"database,omitempty"`
+	// Cache bounds the deployments and bundles cached by the sbi client
+	Cache *CacheConfig `yaml:"cache,omitempty"`
+	// RegistryCredentials are the passwords and tokens of private registries by name, the
+	// registryAuth of a component refers to one with passwordRef instead of carrying it
+	RegistryCredentials map[string]RegistryCredentialConfig `yaml:"registryCredentials,omitempty"`
+	// Warnings collects configuration problems that do not prevent the agent from starting
+	Warnings []string `yaml:"-"`
+}
+
+// DefaultDataDir is the data directory used when none is configured, relative to the working
+// directory
+const DefaultDataDir = "data/"
+
+// DataDirectory returns the configured data directory or DefaultDataDir
+func (config *Config) DataDirectory() string {
+	if config.DataDir == "" {
+		return DefaultDataDir
+	}
+	return config.DataDir
+}
+
+// RegistryCredentialConfig is the password or token of a private registry. PasswordFile is read on
+// every use, so the token can be rotated without restarting the agent, Password can be used instead.
+type RegistryCredentialConfig struct {
+	PasswordFile string `yaml:"passwordFile,omitempty"`
+	Password     string `yaml:"password,omitempty"`
+}
+
+// Secret returns the password, read from PasswordFile when it is set
+func (r RegistryCredentialConfig) Secret() (string, error) {
+	if r.PasswordFile == "" {
+		return r.Password, nil
+	}
+	data, err := os.ReadFile(r.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the password file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ShutdownConfig tunes the drain of the agent when it stops
+type ShutdownConfig struct {
+	// DrainTimeoutSeconds is how long the reconciliations in progress may take to finish, the ones
+	// still running then are marked INTERRUPTED and resumed on the next start (default 60)
+	DrainTimeoutSeconds uint16 `yaml:"drainTimeoutSeconds,omitempty"`
+}
+
+// DrainTimeout returns the configured drain timeout or the default of 60 seconds
+func (s *ShutdownConfig) DrainTimeout() time.Duration {
+	if s == nil || s.DrainTimeoutSeconds == 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(s.DrainTimeoutSeconds) * time.Second
+}
+
+// DeploymentHistoryConfig bounds the history of removed deployments, 0 keeps the default
+type DeploymentHistoryConfig struct {
+	// MaxEntries is the number of removed deployments kept (default 200)
+	MaxEntries uint32 `yaml:"maxEntries,omitempty"`
+	// MaxAgeSeconds is how long a removed deployment is kept (default 2592000, 30 days)
+	MaxAgeSeconds uint32 `yaml:"maxAgeSeconds,omitempty"`
+	// TransitionsPerDeployment is the number of phase and state changes kept for every deployment
+	// (default 50)
+	TransitionsPerDeployment uint32 `yaml:"transitionsPerDeployment,omitempty"`
+}
+
+// Retention returns the maximum entries and age of the history, 0 for the ones left unset
+func (d *DeploymentHistoryConfig) Retention() (int, time.Duration) {
+	if d == nil {
+		return 0, 0
+	}
+	return int(d.MaxEntries), time.Duration(d.MaxAgeSeconds) * time.Second
+}
+
+// TransitionDepth returns the number of phase and state changes kept for every deployment, 0 when
+// it is left unset
+func (d *DeploymentHistoryConfig) TransitionDepth() int {
+	if d == nil {
+		return 0
+	}
+	return int(d.TransitionsPerDeployment)
+}
+
+// Database backends
+const (
+	// DatabaseBackendJSON keeps the database in memory and saves it to a JSON file
+	DatabaseBackendJSON = "json"
+	// DatabaseBackendSQLite commits every change to a SQLite file
+	DatabaseBackendSQLite = "sqlite"
+)
+
+// DatabaseConfig selects the database backend of the agent
+type DatabaseConfig struct {
+	// Backend is json or sqlite (default json), the first start with sqlite migrates the JSON file
+	Backend string `yaml:"backend,omitempty"`
+	// SecretKeyFile holds the key material the OAuth client secret is encrypted with on disk,
+	// default data/agent.secret.key, generated on first use. MARGO_AGENT_DATABASE_KEY takes
+	// precedence when it is set.
+	SecretKeyFile string `yaml:"secretKeyFile,omitempty"`
+}
+
+// SecretKey returns the configured key file, empty for the default one in the data directory
+func (d *DatabaseConfig) SecretKey() string {
+	if d == nil {
+		return ""
+	}
+	return d.SecretKeyFile
+}
+
+// BackendName returns the configured backend or the default json
+func (d *DatabaseConfig) BackendName() string {
+	if d == nil || d.Backend == "" {
+		return DatabaseBackendJSON
+	}
+	return d.Backend
+}
+
+// CacheConfig bounds the deployment and bundle caches of the sbi client, each cache on its own.
+// The entries of the last sync are never evicted, so a cache may exceed MaxSizeBytes by them.
+type CacheConfig struct {
+	// MaxSizeBytes is the total size of a cache, the least recently used entries are evicted
+	// beyond it (default unlimited)
+	MaxSizeBytes int64 `yaml:"maxSizeBytes,omitempty"`
+	// MaxAgeSeconds is how long an entry is kept after it was last used (default unlimited)
+	MaxAgeSeconds uint32 `yaml:"maxAgeSeconds,omitempty"`
+	// StatsIntervalSeconds is how often the cache statistics are logged (default 600)
+	StatsIntervalSeconds uint32 `yaml:"statsIntervalSeconds,omitempty"`
+}
+
+// MaxAge returns the configured maximum entry age, 0 when entries do not expire
+func (c *CacheConfig) MaxAge() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return time.Duration(c.MaxAgeSeconds) * time.Second
+}
+
+// MaxBytes returns the configured maximum cache size, 0 when it is unlimited
+func (c *CacheConfig) MaxBytes() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.MaxSizeBytes
+}
+
+// StatsInterval returns the configured statistics interval or the default of 10 minutes
+func (c *CacheConfig) StatsInterval() time.Duration {
+	if c == nil || c.StatsIntervalSeconds == 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(c.StatsIntervalSeconds) * time.Second
 }
 
 type StateSeekingConfig struct {
-	Interval uint16 `yaml:"interval" validate:"required"`
+	// Interval is the time between two syncs in seconds, it must be greater than 0
+	Interval uint16 `yaml:"interval"`
+	// LongPoll, when enabled, asks the WFM to hold the sync request open until the
+	// desired state changes (or the wait elapses) instead of answering immediately.
+	LongPoll *LongPollConfig `yaml:"longPoll,omitempty"`
+	// Limits bounds the manifests accepted from the WFM, unset limits keep generous defaults
+	Limits *ManifestLimitsConfig `yaml:"limits,omitempty"`
+	// Backoff stretches the interval while syncs keep failing, it is on by default
+	Backoff *SyncBackoffConfig `yaml:"backoff,omitempty"`
+	// FetchConcurrency is the number of deployments fetched at once when the manifest has no
+	// bundle (default 4)
+	FetchConcurrency int `yaml:"fetchConcurrency,omitempty"`
+	// Bundle decides when the deployments of a manifest are downloaded as its bundle
+	Bundle *BundleFetchConfig `yaml:"bundle,omitempty"`
+}
+
+// SyncPeriod is the longest a sync takes to come around while the WFM is reachable, the interval
+// plus the long-poll wait when the server may hold the request
+func (c StateSeekingConfig) SyncPeriod() time.Duration {
+	period := time.Duration(c.Interval) * time.Second
+	if c.LongPoll != nil && c.LongPoll.Enabled {
+		period += time.Duration(c.LongPoll.WaitSeconds) * time.Second
+	}
+	return period
+}
+
+// Bundle fetch modes
+const (
+	// BundleFetchAuto downloads the bundle when the manifest has many deployments or a small bundle
+	BundleFetchAuto = "auto"
+	// BundleFetchAlways downloads the bundle whenever the manifest has one the device can accept
+	BundleFetchAlways = "always"
+	// BundleFetchNever fetches the deployments one by one, which reuses the deployment cache
+	BundleFetchNever = "never"
+)
+
+// BundleFetchConfig decides between downloading the bundle of a manifest and fetching its
+// deployments one by one, 0 keeps the default
+type BundleFetchConfig struct {
+	// Mode is auto, always or never (default auto)
+	Mode string `yaml:"mode,omitempty"`
+	// DeploymentThreshold is the number of deployments above which auto downloads the bundle
+	// (default 2)
+	DeploymentThreshold int `yaml:"deploymentThreshold,omitempty"`
+	// SizeThresholdBytes is the announced bundle size below which auto downloads the bundle
+	// whatever the number of deployments (default 50 MiB)
+	SizeThresholdBytes int64 `yaml:"sizeThresholdBytes,omitempty"`
+}
+
+// FetchMode returns the configured mode or the default auto
+func (b *BundleFetchConfig) FetchMode() string {
+	if b == nil || b.Mode == "" {
+		return BundleFetchAuto
+	}
+	return b.Mode
+}
+
+// Deployments returns the configured deployment threshold or the default of 2
+func (b *BundleFetchConfig) Deployments() int {
+	if b == nil || b.DeploymentThreshold == 0 {
+		return 2
+	}
+	return b.DeploymentThreshold
+}
+
+// SizeBytes returns the configured size threshold or the default of 50 MiB
+func (b *BundleFetchConfig) SizeBytes() int64 {
+	if b == nil || b.SizeThresholdBytes == 0 {
+		return 50 * 1024 * 1024
+	}
+	return b.SizeThresholdBytes
+}
+
+// SyncBackoffConfig tunes how the sync interval grows while syncs keep failing, 0 keeps the default
+type SyncBackoffConfig struct {
+	// Disabled keeps syncing at the configured interval while syncs fail
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Multiplier grows the interval after every further failed sync (default 2)
+	Multiplier float64 `yaml:"multiplier,omitempty"`
+	// MaxIntervalSeconds caps the grown interval (default 600)
+	MaxIntervalSeconds uint32 `yaml:"maxIntervalSeconds,omitempty"`
+	// Jitter is the fraction of the grown interval that is randomly cut off, so that devices losing
+	// the WFM at the same time do not come back in lockstep (default 0.2)
+	Jitter float64 `yaml:"jitter,omitempty"`
+}
+
+// Enabled reports whether syncs back off, they do unless disabled
+func (b *SyncBackoffConfig) Enabled() bool {
+	return b == nil || !b.Disabled
+}
+
+// BackoffMultiplier returns the configured multiplier or the default of 2
+func (b *SyncBackoffConfig) BackoffMultiplier() float64 {
+	if b == nil || b.Multiplier == 0 {
+		return 2
+	}
+	return b.Multiplier
+}
+
+// MaxInterval returns the configured cap or the default of 10 minutes
+func (b *SyncBackoffConfig) MaxInterval() time.Duration {
+	if b == nil || b.MaxIntervalSeconds == 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(b.MaxIntervalSeconds) * time.Second
+}
+
+// JitterFraction returns the configured jitter or the default of 0.2
+func (b *SyncBackoffConfig) JitterFraction() float64 {
+	if b == nil || b.Jitter == 0 {
+		return 0.2
+	}
+	return b.Jitter
+}
+
+// ManifestLimitsConfig bounds what the agent accepts from the WFM, a manifest exceeding any of the
+// limits is rejected as a whole. 0 keeps the default.
+type ManifestLimitsConfig struct {
+	MaxDeployments     int64 `yaml:"maxDeployments,omitempty"`
+	MaxManifestBytes   int64 `yaml:"maxManifestBytes,omitempty"`
+	MaxDeploymentBytes int64 `yaml:"maxDeploymentBytes,omitempty"`
+	MaxBundleBytes     int64 `yaml:"maxBundleBytes,omitempty"`
+	// InMemoryBundleBytes is the size up to which a bundle is downloaded into memory, larger
+	// bundles are downloaded to disk
+	InMemoryBundleBytes int64 `yaml:"inMemoryBundleBytes,omitempty"`
+}
+
+// ManifestLimits returns the configured limits, defaults filled in
+func (s StateSeekingConfig) ManifestLimits() wfm.ManifestLimits {
+	if s.Limits == nil {
+		return wfm.DefaultManifestLimits()
+	}
+	return wfm.ManifestLimits{
+		MaxDeployments:      s.Limits.MaxDeployments,
+		MaxManifestBytes:    s.Limits.MaxManifestBytes,
+		MaxDeploymentBytes:  s.Limits.MaxDeploymentBytes,
+		MaxBundleBytes:      s.Limits.MaxBundleBytes,
+		InMemoryBundleBytes: s.Limits.InMemoryBundleBytes,
+	}.WithDefaults()
+}
+
+type LongPollConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// WaitSeconds is the maximum time the server is asked to hold the request open
+	WaitSeconds uint16 `yaml:"waitSeconds"`
 }
 
 type WFMConfig struct {
-	SbiURL        string              `yaml:"sbiUrl" validate:"required"`
-	ClientPlugins ClientPluginsConfig `yaml:"clientPlugins,omitempty"`
+	SbiURL string `yaml:"sbiUrl" validate:"required"`
+	// AllowInsecureHttp permits a plain http sbiUrl, meant for local development only
+	AllowInsecureHttp bool                `yaml:"allowInsecureHttp,omitempty"`
+	ClientPlugins     ClientPluginsConfig `yaml:"clientPlugins,omitempty"`
+	// HTTP tunes the outbound http client used to talk to the WFM
+	HTTP *HTTPClientConfig `yaml:"http,omitempty"`
+	// ManifestVerification makes the agent only accept state manifests signed by the WFM
+	ManifestVerification *ManifestVerificationConfig `yaml:"manifestVerification,omitempty"`
+	// BundleVerification makes the agent only extract deployment bundles the WFM signed, the key or
+	// CA may differ from the one of the manifests
+	BundleVerification *ManifestVerificationConfig `yaml:"bundleVerification,omitempty"`
+}
+
+// ManifestVerificationConfig holds what signed state manifests, or bundle signatures, are verified
+// against, exactly one of the public key and the CA is set
+type ManifestVerificationConfig struct {
+	// PublicKeyPath is a PEM public key or certificate of the key the WFM signs manifests with
+	PublicKeyPath string `yaml:"publicKeyPath,omitempty"`
+	// CACertPath is a PEM CA bundle the certificate chain of signed manifests has to lead to
+	CACertPath string `yaml:"caCertPath,omitempty"`
+}
+
+type HTTPClientConfig struct {
+	// TimeoutSeconds bounds a single request, long-poll requests get the wait added on top
+	TimeoutSeconds uint16 `yaml:"timeoutSeconds,omitempty"`
+	// ProxyURL routes requests through a proxy, when empty HTTP(S)_PROXY from the environment is used
+	ProxyURL  string `yaml:"proxyUrl,omitempty"`
+	UserAgent string `yaml:"userAgent,omitempty"`
 }
 
 type ClientPluginsConfig struct {
@@ -75,6 +436,8 @@ type RequestSignerConfig struct {
 	SignatureFormat string `yaml:"signatureFormat" validate:"required"`
 	// KeyRef describes where the private key used for request signing is located.
 	KeyRef *KeyRef `yaml:"keyRef,omitempty"`
+	// ReloadIntervalSeconds is how often the key file is checked for a rotated key (default 30)
+	ReloadIntervalSeconds uint16 `yaml:"reloadIntervalSeconds,omitempty"`
 }
 
 type AuthHelperConfig struct {
@@ -86,9 +449,185 @@ type AuthHelperConfig struct {
 type TLSHelperConfig struct {
 	Enabled        bool    `yaml:"enabled"`
 	ServerCAKeyRef *KeyRef `yaml:"caKeyRef,omitempty"`
-	// you can support the following to enable client side tls as well
-	// ClientCertPath string `yaml:"certPath"`
-	// ClientKeyPath  string `yaml:"keyPath"`
+	// ClientCertRef and ClientKeyRef are the PEM certificate and private key the agent presents to a
+	// WFM requiring mutual tls, both or none must be set
+	ClientCertRef *KeyRef `yaml:"clientCertRef,omitempty"`
+	ClientKeyRef  *KeyRef `yaml:"clientKeyRef,omitempty"`
+}
+
+// MutualTLS tells whether a client certificate is configured
+func (t *TLSHelperConfig) MutualTLS() bool {
+	return t != nil && t.Enabled && t.ClientCertRef != nil && t.ClientKeyRef != nil
+}
+
+// DefaultHealthListenAddress keeps the health endpoints local to the device unless configured otherwise
+const DefaultHealthListenAddress = "127.0.0.1:8090"
+
+type HealthConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ListenAddress of the health endpoints (default 127.0.0.1:8090)
+	ListenAddress string `yaml:"listenAddress,omitempty"`
+	// Policy overrides the criticality of components, e.g. "deployer: critical" makes failed
+	// deployments take the agent out of readiness
+	Policy map[string]health.Criticality `yaml:"policy,omitempty"`
+	// Control enables the endpoints that trigger a sync, a reconciliation or a status report right
+	// away: POST /sync, /reconcile, /reconcile/{deploymentId} and /report/{deploymentId}
+	Control bool `yaml:"control,omitempty"`
+	// BearerToken, when set, is required by every endpoint except liveness and readiness
+	BearerToken string `yaml:"bearerToken,omitempty"`
+}
+
+// HealthPolicy returns the default policy with the configured overrides applied
+func (h *HealthConfig) HealthPolicy() health.Policy {
+	policy := health.DefaultPolicy()
+	if h == nil {
+		return policy
+	}
+	for name, criticality := range h.Policy {
+		policy[name] = criticality
+	}
+	return policy
+}
+
+// HealthListenAddress returns the configured listen address or the default one
+func (h *HealthConfig) HealthListenAddress() string {
+	if h == nil || h.ListenAddress == "" {
+		return DefaultHealthListenAddress
+	}
+	return h.ListenAddress
+}
+
+// DefaultMetricsListenAddress keeps the metrics endpoint local to the device unless configured otherwise
+const DefaultMetricsListenAddress = "127.0.0.1:9102"
+
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ListenAddr of the /metrics and /healthz endpoints (default 127.0.0.1:9102)
+	ListenAddr string `yaml:"listenAddr,omitempty"`
+}
+
+// MetricsListenAddress returns the configured listen address or the default one
+func (m *MetricsConfig) MetricsListenAddress() string {
+	if m == nil || m.ListenAddr == "" {
+		return DefaultMetricsListenAddress
+	}
+	return m.ListenAddr
+}
+
+// isLoopbackAddress reports whether a listen address only accepts connections from the device itself
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ImageGCMode is what the image janitor does with the unused images of a runtime
+type ImageGCMode string
+
+const (
+	ImageGCRemove ImageGCMode = "remove"
+	ImageGCReport ImageGCMode = "report"
+	ImageGCOff    ImageGCMode = "off"
+)
+
+type ImageGCConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// IntervalSeconds between two janitor passes (default 3600)
+	IntervalSeconds uint32 `yaml:"intervalSeconds,omitempty"`
+	// GracePeriodSeconds keeps an image after the last deployment stopped using it, so a rollback
+	// does not need to pull it again (default 86400)
+	GracePeriodSeconds uint32 `yaml:"gracePeriodSeconds,omitempty"`
+	// Compose is remove (default), report or off
+	Compose ImageGCMode `yaml:"compose,omitempty"`
+	// Helm is report (default) or off, pruning the images of the nodes is left to the cluster
+	// (e.g. the kubelet image garbage collection)
+	Helm ImageGCMode `yaml:"helm,omitempty"`
+}
+
+// Interval returns the configured interval or the default one
+func (g *ImageGCConfig) Interval() time.Duration {
+	if g == nil || g.IntervalSeconds == 0 {
+		return time.Hour
+	}
+	return time.Duration(g.IntervalSeconds) * time.Second
+}
+
+// GracePeriod returns the configured grace period or the default one
+func (g *ImageGCConfig) GracePeriod() time.Duration {
+	if g == nil || g.GracePeriodSeconds == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(g.GracePeriodSeconds) * time.Second
+}
+
+// ComposeMode returns the configured mode of the docker images or the default one
+func (g *ImageGCConfig) ComposeMode() ImageGCMode {
+	if g == nil || g.Compose == "" {
+		return ImageGCRemove
+	}
+	return g.Compose
+}
+
+// HelmMode returns the configured mode of the kubernetes images or the default one
+func (g *ImageGCConfig) HelmMode() ImageGCMode {
+	if g == nil || g.Helm == "" {
+		return ImageGCReport
+	}
+	return g.Helm
+}
+
+// RemovalProtectionConfig tunes the reports of blocked removals, 0 keeps the default
+type RemovalProtectionConfig struct {
+	// EscalateAfterSeconds is how long a removal may stay blocked before it is reported as failed
+	// instead of removing (default 86400)
+	EscalateAfterSeconds uint32 `yaml:"escalateAfterSeconds,omitempty"`
+}
+
+// EscalateAfter returns the configured escalation delay or the default one
+func (r *RemovalProtectionConfig) EscalateAfter() time.Duration {
+	if r == nil || r.EscalateAfterSeconds == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(r.EscalateAfterSeconds) * time.Second
+}
+
+type EventHooksConfig struct {
+	// QueueSize bounds the events waiting for delivery, events beyond it are dropped (default 256)
+	QueueSize int `yaml:"queueSize,omitempty"`
+	// AllowedCommands lists the scripts exec hooks may run (absolute paths), anything else is rejected
+	AllowedCommands []string     `yaml:"allowedCommands,omitempty"`
+	Hooks           []HookConfig `yaml:"hooks"`
+}
+
+type HookConfig struct {
+	Name string `yaml:"name"`
+	// Events selects the events the hook receives, e.g. "deployment.failed", "deployment.*" or
+	// "sync.degraded", an empty list selects every event
+	Events  []string           `yaml:"events,omitempty"`
+	Webhook *WebhookHookConfig `yaml:"webhook,omitempty"`
+	Exec    *ExecHookConfig    `yaml:"exec,omitempty"`
+}
+
+type WebhookHookConfig struct {
+	URL string `yaml:"url"`
+	// SecretFile holds the shared secret used to sign the payload (HMAC-SHA256), Secret can be used instead
+	SecretFile     string `yaml:"secretFile,omitempty"`
+	Secret         string `yaml:"secret,omitempty"`
+	TimeoutSeconds uint16 `yaml:"timeoutSeconds,omitempty"`
+	MaxRetries     uint8  `yaml:"maxRetries,omitempty"`
+}
+
+type ExecHookConfig struct {
+	// Command must be listed in eventHooks.allowedCommands, the event is passed as JSON on stdin
+	Command        string   `yaml:"command"`
+	Args           []string `yaml:"args,omitempty"`
+	TimeoutSeconds uint16   `yaml:"timeoutSeconds,omitempty"`
 }
 
 type JWTConfig struct {
@@ -97,16 +636,132 @@ type JWTConfig struct {
 	TokenUrl     string `yaml:"tokenUrl,omitempty"`
 }
 
+// CapabilitiesDiscoveryConfig tells how the capabilities reported to the WFM are discovered. The
+// cpu, memory, storage and roles are detected from the device and its runtimes, the fields set in
+// the ReadFromFile file win over the detected ones.
 type CapabilitiesDiscoveryConfig struct {
-	ReadFromFile string `yaml:"readFromFile" validate:"required"`
+	ReadFromFile string `yaml:"readFromFile,omitempty"`
+	// DisableDetection reports the file as it is
+	DisableDetection bool `yaml:"disableDetection,omitempty"`
+	// ReportIntervalSeconds is how often the capabilities are detected and reported again, as disk,
+	// memory and runtime versions drift (default 86400, a day)
+	ReportIntervalSeconds uint32 `yaml:"reportIntervalSeconds,omitempty"`
 }
 
+// ReportInterval returns the configured report interval or the default of a day
+func (c CapabilitiesDiscoveryConfig) ReportInterval() time.Duration {
+	if c.ReportIntervalSeconds == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.ReportIntervalSeconds) * time.Second
+}
+
+// Encodings of the agent logs
+const (
+	LogEncodingJSON    = "json"
+	LogEncodingConsole = "console"
+)
+
 type LoggingConfig struct {
-	Level string `yaml:"level" validate:"required"`
+	// Level is the lowest level logged: debug, info, warn or error, info when unset
+	Level string `yaml:"level,omitempty"`
+	// Encoding is json, for log collectors, or console, for people reading the logs, json when unset
+	Encoding string `yaml:"encoding,omitempty"`
+	// Redaction extends the built-in rules that keep credentials out of logged requests
+	Redaction *RedactionConfig `yaml:"redaction,omitempty"`
+}
+
+// RedactionConfig adds header names, header name patterns and body keys to redact on top of the
+// built-in ones (authorization, cookies, clientSecret, password, token, ...)
+type RedactionConfig struct {
+	Headers        []string `yaml:"headers,omitempty"`
+	HeaderPatterns []string `yaml:"headerPatterns,omitempty"`
+	BodyKeys       []string `yaml:"bodyKeys,omitempty"`
+	// BodyKeyPatterns are glob patterns on the keys of JSON and form bodies, e.g. "*pin"
+	BodyKeyPatterns []string `yaml:"bodyKeyPatterns,omitempty"`
+}
+
+// LogLevel parses the configured level, in any case, info when it is not set
+func (l LoggingConfig) LogLevel() (zapcore.Level, error) {
+	switch strings.ToLower(l.Level) {
+	case "debug":
+		return zapcore.DebugLevel, nil
+	case "", "info":
+		return zapcore.InfoLevel, nil
+	case "warn":
+		return zapcore.WarnLevel, nil
+	case "error":
+		return zapcore.ErrorLevel, nil
+	}
+	return zapcore.InfoLevel, fmt.Errorf("logging.level must be debug, info, warn or error, not %q", l.Level)
+}
+
+// LogEncoding returns the configured encoding or LogEncodingJSON
+func (l LoggingConfig) LogEncoding() string {
+	if l.Encoding == "" {
+		return LogEncodingJSON
+	}
+	return strings.ToLower(l.Encoding)
+}
+
+// RedactionConfig maps the logging section to the shared redaction rules
+func (l LoggingConfig) RedactionConfig() redact.Config {
+	if l.Redaction == nil {
+		return redact.Config{}
+	}
+	return redact.Config{
+		Headers:         l.Redaction.Headers,
+		HeaderPatterns:  l.Redaction.HeaderPatterns,
+		BodyKeys:        l.Redaction.BodyKeys,
+		BodyKeyPatterns: l.Redaction.BodyKeyPatterns,
+	}
 }
 
 type KubernetesConfig struct {
 	KubeconfigPath string `yaml:"kubeconfigPath" validate:"required"`
+	// OCI tunes how helm charts are pulled from OCI registries
+	OCI *OCIRegistryConfig `yaml:"oci,omitempty"`
+	// ReleaseTests runs the helm test hooks of a release after every install or upgrade
+	ReleaseTests *HelmReleaseTestsConfig `yaml:"releaseTests,omitempty"`
+}
+
+// HelmReleaseTestsConfig makes a helm deployment only count as running once the `helm test` hooks
+// of its release pass. Releases without test hooks pass.
+type HelmReleaseTestsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Timeout is how long the tests of a release may run, e.g. "10m" (default 5m)
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+// TestTimeout returns the timeout of the tests of a release
+func (c HelmReleaseTestsConfig) TestTimeout() (time.Duration, error) {
+	return workloads.ParseHelmTimeout(c.Timeout, workloads.DefaultHelmTestTimeout)
+}
+
+// OCIRegistryConfig lets charts be pulled from registries without https or with a certificate that
+// does not verify. Both expose the charts and registry credentials on the network, they are meant
+// for registries on a trusted network only.
+type OCIRegistryConfig struct {
+	// PlainHTTP pulls over plain http when true and over https when false, unset guesses it from the
+	// port of the registry (80, 8080 and 8081 are plain http)
+	PlainHTTP *bool `yaml:"plainHttp,omitempty"`
+	// InsecureSkipTLSVerify accepts any certificate of the registry
+	InsecureSkipTLSVerify bool `yaml:"insecureSkipTlsVerify,omitempty"`
+}
+
+// HelmClientOptions maps the oci section onto the options of the helm client
+func (k KubernetesConfig) HelmClientOptions() []workloads.HelmClientOption {
+	var opts []workloads.HelmClientOption
+	if k.OCI == nil {
+		return opts
+	}
+	if k.OCI.PlainHTTP != nil {
+		opts = append(opts, workloads.WithOCIPlainHTTP(*k.OCI.PlainHTTP))
+	}
+	if k.OCI.InsecureSkipTLSVerify {
+		opts = append(opts, workloads.WithOCIInsecureSkipTLSVerify(true))
+	}
+	return opts
 }
 
 type TLSConfig struct {
@@ -119,14 +774,72 @@ type DockerConfig struct {
 	Url                 string     `yaml:"url" validator:"url"`
 	TLS                 *TLSConfig `yaml:"tls"`
 	TLSSkipVerification *bool      `yaml:"tlsSkipVerification"`
+	// Retry tunes how the pull, up and down calls are retried while the daemon or a registry is
+	// unavailable
+	Retry *ComposeRetryConfig `yaml:"retry,omitempty"`
+}
+
+// ComposeRetryConfig tunes the retries of the docker compose calls, 0 keeps the default
+type ComposeRetryConfig struct {
+	// Attempts is the number of calls including the first one, 1 turns retrying off (default 3)
+	Attempts uint16 `yaml:"attempts,omitempty"`
+	// DelaySeconds is the wait before the first retry, it doubles for every further one (default 2)
+	DelaySeconds uint16 `yaml:"delaySeconds,omitempty"`
+}
+
+// ComposeClientOptions maps the retry section onto the options of the compose client
+func (d DockerConfig) ComposeClientOptions() []workloads.ComposeClientOption {
+	var opts []workloads.ComposeClientOption
+	if d.Retry == nil {
+		return opts
+	}
+	policy := workloads.DefaultComposeRetryPolicy
+	if d.Retry.Attempts > 0 {
+		policy.Attempts = int(d.Retry.Attempts)
+	}
+	if d.Retry.DelaySeconds > 0 {
+		policy.Delay = time.Duration(d.Retry.DelaySeconds) * time.Second
+	}
+	return append(opts, workloads.WithComposeRetryPolicy(policy))
 }
 
 type RuntimeInfo struct {
 	Type       string            `yaml:"type" validate:"required"`
 	Kubernetes *KubernetesConfig `yaml:"kubernetes,omitempty"`
 	Docker     *DockerConfig     `yaml:"docker,omitempty"`
+	// Breaker tunes the circuit breaker that stops deployments against the runtime while it is down
+	Breaker *RuntimeBreakerConfig `yaml:"breaker,omitempty"`
+}
+
+// RuntimeBreakerConfig tunes the circuit breaker of a runtime, 0 keeps the default
+type RuntimeBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures reaching the runtime that open the
+	// circuit (default 3)
+	FailureThreshold uint16 `yaml:"failureThreshold,omitempty"`
+	// WarmCheckIntervalSeconds is how often the runtime is checked while it works (default 30)
+	WarmCheckIntervalSeconds uint16 `yaml:"warmCheckIntervalSeconds,omitempty"`
+	// ProbeIntervalSeconds is the first wait between the probes of an open circuit, it doubles
+	// after every failed probe up to MaxProbeIntervalSeconds (defaults 5 and 120)
+	ProbeIntervalSeconds    uint16 `yaml:"probeIntervalSeconds,omitempty"`
+	MaxProbeIntervalSeconds uint16 `yaml:"maxProbeIntervalSeconds,omitempty"`
 }
 
+// BreakerConfig returns the circuit breaker config of the runtime, defaults filled in
+func (r RuntimeInfo) BreakerConfig() breaker.Config {
+	var config breaker.Config
+	if r.Breaker != nil {
+		config = breaker.Config{
+			FailureThreshold:  int(r.Breaker.FailureThreshold),
+			WarmCheckInterval: time.Duration(r.Breaker.WarmCheckIntervalSeconds) * time.Second,
+			ProbeInterval:     time.Duration(r.Breaker.ProbeIntervalSeconds) * time.Second,
+			MaxProbeInterval:  time.Duration(r.Breaker.MaxProbeIntervalSeconds) * time.Second,
+		}
+	}
+	return config.WithDefaults()
+}
+
+// LoadConfig reads the configuration, expands the environment variables it references, see
+// expandEnvironment, and validates it
 func LoadConfig(configPath string) (*Config, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
@@ -138,9 +851,12 @@ func LoadConfig(configPath string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
+	if err := expandEnvironment(&config); err != nil {
+		return &config, err
+	}
 
 	// fmt.Println("parsed config", pretty.Sprint(config))
-	return &config, validateConfig(&config)
+	return &config, config.Validate()
 }
 
 func LoadCapabilities(capabilitiesPath string) (*sbi.DeviceCapabilitiesManifest, error) {
@@ -157,41 +873,315 @@ func LoadCapabilities(capabilitiesPath string) (*sbi.DeviceCapabilitiesManifest,
 	return &capabilities, nil
 }
 
-// validateConfig validates the configuration
-func validateConfig(config *Config) error {
+// ConfigErrors lists every problem found in a configuration
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	if len(e) == 1 {
+		return "invalid configuration: " + e[0]
+	}
+	return fmt.Sprintf("invalid configuration, %d problems:\n  - %s", len(e), strings.Join(e, "\n  - "))
+}
+
+// Validate checks the whole configuration up front and returns ConfigErrors with every problem it
+// found. It normalizes the sbi url and collects the problems that do not prevent the agent from
+// starting in Warnings.
+func (config *Config) Validate() error {
+	var problems ConfigErrors
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
 	v := validator.New()
+	// the fields are named like in the yaml file, e.g. wfm.sbiUrl
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _ := yamlFieldName(field)
+		return name
+	})
 	if err := v.Struct(config); err != nil {
-		// Return the validator error directly so caller can inspect validation failures
-		return fmt.Errorf("invalid configuration: %w", err)
+		var fieldErrors validator.ValidationErrors
+		if !errors.As(err, &fieldErrors) {
+			return fmt.Errorf("invalid configuration: %w", err)
+		}
+		for _, fieldError := range fieldErrors {
+			// the namespace starts with the name of the Config type
+			_, field, _ := strings.Cut(fieldError.Namespace(), ".")
+			if fieldError.Tag() == "required" {
+				addProblem("%s is required", field)
+			} else {
+				addProblem("%s fails the %s check", field, fieldError.Tag())
+			}
+		}
 	}
 
-	// logging.level must be present
-	if config.Logging.Level == "" {
-		return fmt.Errorf("logging.level is required in configuration")
+	if _, err := config.Logging.LogLevel(); err != nil {
+		addProblem("%v", err)
 	}
+	switch config.Logging.LogEncoding() {
+	case LogEncodingJSON, LogEncodingConsole:
+	default:
+		addProblem("logging.encoding must be %q or %q", LogEncodingJSON, LogEncodingConsole)
+	}
+
 	// If request signer plugin is enabled, require a KeyRef for signing (explicitly decoupled from deviceRootIdentity)
-	if config.Wfm.ClientPlugins.RequestSigner != nil && config.Wfm.ClientPlugins.RequestSigner.Enabled {
-		if config.Wfm.ClientPlugins.RequestSigner.KeyRef == nil {
-			return fmt.Errorf("wfm.clientPlugins.requestSigner.keyRef is required when request signer is enabled")
+	if signer := config.Wfm.ClientPlugins.RequestSigner; signer != nil && signer.Enabled {
+		if signer.KeyRef == nil {
+			addProblem("wfm.clientPlugins.requestSigner.keyRef is required when request signer is enabled")
+		} else if err := checkReadable(signer.KeyRef.Path); err != nil {
+			addProblem("wfm.clientPlugins.requestSigner.keyRef.path: %v", err)
+		}
+	}
+	if tlsHelper := config.Wfm.ClientPlugins.TLSHelper; tlsHelper != nil && tlsHelper.Enabled {
+		if tlsHelper.ServerCAKeyRef == nil {
+			addProblem("wfm.clientPlugins.tlsHelper.caKeyRef is required when the tls helper is enabled")
+		} else if err := checkReadable(tlsHelper.ServerCAKeyRef.Path); err != nil {
+			addProblem("wfm.clientPlugins.tlsHelper.caKeyRef.path: %v", err)
+		}
+		if (tlsHelper.ClientCertRef == nil) != (tlsHelper.ClientKeyRef == nil) {
+			addProblem("wfm.clientPlugins.tlsHelper needs both clientCertRef and clientKeyRef for mutual tls, only one is set")
+		} else if tlsHelper.MutualTLS() {
+			if _, err := tls.LoadX509KeyPair(tlsHelper.ClientCertRef.Path, tlsHelper.ClientKeyRef.Path); err != nil {
+				addProblem("wfm.clientPlugins.tlsHelper client certificate: %v", err)
+			}
 		}
 	}
 
-	if config.Wfm.SbiURL == "" {
-		return fmt.Errorf("wfm.sbiUrl is required in configuration")
+	if verification := config.Wfm.ManifestVerification; verification != nil {
+		if (verification.PublicKeyPath == "") == (verification.CACertPath == "") {
+			addProblem("wfm.manifestVerification requires exactly one of publicKeyPath and caCertPath")
+		}
+	}
+	if verification := config.Wfm.BundleVerification; verification != nil {
+		if (verification.PublicKeyPath == "") == (verification.CACertPath == "") {
+			addProblem("wfm.bundleVerification requires exactly one of publicKeyPath and caCertPath")
+		}
+	}
+
+	// an empty url is reported as required above
+	if config.Wfm.SbiURL != "" {
+		sbiURL, warnings, err := NormalizeSbiURL(config.Wfm.SbiURL, config.Wfm.AllowInsecureHttp)
+		if err != nil {
+			addProblem("%v", err)
+		} else {
+			config.Wfm.SbiURL = sbiURL
+			config.Warnings = append(config.Warnings, warnings...)
+		}
+	}
+
+	if config.StateSeeking.Interval == 0 {
+		addProblem("stateSeeking.interval must be greater than 0")
 	}
 
 	if len(config.Runtimes) == 0 {
-		return fmt.Errorf("there are no runtimes defined in agent configuration")
+		addProblem("there are no runtimes defined in agent configuration")
+	}
+
+	if config.Capabilities.DisableDetection && config.Capabilities.ReadFromFile == "" {
+		addProblem("capabilities.readFromFile is required when capabilities.disableDetection is set")
 	}
 
-	if config.Capabilities.ReadFromFile == "" {
-		return fmt.Errorf("capabilities.readFromFile is required in configuration")
+	if config.StateSeeking.LongPoll != nil && config.StateSeeking.LongPoll.Enabled {
+		if config.StateSeeking.LongPoll.WaitSeconds == 0 {
+			addProblem("stateSeeking.longPoll.waitSeconds is required when long polling is enabled")
+		}
+	}
+
+	if config.Health != nil {
+		for _, name := range slices.Sorted(maps.Keys(config.Health.Policy)) {
+			if criticality := config.Health.Policy[name]; criticality != health.Critical && criticality != health.Informational {
+				addProblem("health.policy.%s must be %q or %q", name, health.Critical, health.Informational)
+			}
+		}
+		if config.Health.Enabled && config.Health.Control && config.Health.BearerToken == "" && !isLoopbackAddress(config.Health.HealthListenAddress()) {
+			config.Warnings = append(config.Warnings, fmt.Sprintf(
+				"health.control is enabled on %s without a health.bearerToken, anyone reaching the address can trigger syncs",
+				config.Health.HealthListenAddress()))
+		}
+	}
+
+	for i, runtime := range config.Runtimes {
+		if runtime.Kubernetes == nil && runtime.Docker == nil {
+			addProblem("runtimes[%d] needs kubernetes or docker", i)
+		}
+		if b := runtime.Breaker; b != nil && b.MaxProbeIntervalSeconds != 0 && b.MaxProbeIntervalSeconds < b.ProbeIntervalSeconds {
+			addProblem("runtimes[%d].breaker.maxProbeIntervalSeconds must not be lower than probeIntervalSeconds", i)
+		}
+		if runtime.Kubernetes != nil && runtime.Kubernetes.ReleaseTests != nil {
+			if _, err := runtime.Kubernetes.ReleaseTests.TestTimeout(); err != nil {
+				addProblem("runtimes[%d].kubernetes.releaseTests.timeout: %v", i, err)
+			}
+		}
+	}
+
+	if backoff := config.StateSeeking.Backoff; backoff != nil {
+		if backoff.Multiplier != 0 && backoff.Multiplier < 1 {
+			addProblem("stateSeeking.backoff.multiplier must be at least 1")
+		}
+		if backoff.Jitter < 0 || backoff.Jitter >= 1 {
+			addProblem("stateSeeking.backoff.jitter must be at least 0 and below 1")
+		}
+	}
+
+	switch config.Database.BackendName() {
+	case DatabaseBackendJSON, DatabaseBackendSQLite:
+	default:
+		addProblem("database.backend must be %q or %q", DatabaseBackendJSON, DatabaseBackendSQLite)
+	}
+
+	if config.Cache != nil && config.Cache.MaxSizeBytes < 0 {
+		addProblem("cache.maxSizeBytes must not be negative")
+	}
+
+	if bundle := config.StateSeeking.Bundle; bundle != nil {
+		switch bundle.FetchMode() {
+		case BundleFetchAuto, BundleFetchAlways, BundleFetchNever:
+		default:
+			addProblem("stateSeeking.bundle.mode must be %q, %q or %q", BundleFetchAuto, BundleFetchAlways, BundleFetchNever)
+		}
+		if bundle.DeploymentThreshold < 0 || bundle.SizeThresholdBytes < 0 {
+			addProblem("stateSeeking.bundle thresholds must not be negative")
+		}
+	}
+
+	if config.StateSeeking.FetchConcurrency < 0 {
+		addProblem("stateSeeking.fetchConcurrency must not be negative")
+	}
+
+	if limits := config.StateSeeking.Limits; limits != nil {
+		if limits.MaxDeployments < 0 || limits.MaxManifestBytes < 0 || limits.MaxDeploymentBytes < 0 || limits.MaxBundleBytes < 0 || limits.InMemoryBundleBytes < 0 {
+			addProblem("stateSeeking.limits must not be negative")
+		}
+	}
+
+	if gc := config.ImageGC; gc != nil {
+		switch gc.ComposeMode() {
+		case ImageGCRemove, ImageGCReport, ImageGCOff:
+		default:
+			addProblem("imageGC.compose must be %q, %q or %q", ImageGCRemove, ImageGCReport, ImageGCOff)
+		}
+		switch gc.HelmMode() {
+		case ImageGCReport, ImageGCOff:
+		default:
+			addProblem("imageGC.helm must be %q or %q", ImageGCReport, ImageGCOff)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(config.RegistryCredentials)) {
+		if credential := config.RegistryCredentials[name]; credential.Password == "" && credential.PasswordFile == "" {
+			addProblem("registryCredentials.%s needs a password or passwordFile", name)
+		}
+	}
+
+	if _, err := redact.New(config.Logging.RedactionConfig()); err != nil {
+		addProblem("logging.redaction: %v", err)
+	}
+
+	if err := validateEventHooks(config.EventHooks); err != nil {
+		addProblem("%v", err)
 	}
 
 	// Basic checks for client plugins (no strict validation here; plugin-specific validation should exist in plugin)
+	if len(problems) > 0 {
+		return problems
+	}
 	return nil
 }
 
+// checkReadable reports a file that does not exist or cannot be read by the agent
+func checkReadable(path string) error {
+	if path == "" {
+		return errors.New("the path is empty")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func validateEventHooks(cfg *EventHooksConfig) error {
+	if cfg == nil {
+		return nil
+	}
+
+	allowed := make(map[string]bool, len(cfg.AllowedCommands))
+	for _, command := range cfg.AllowedCommands {
+		if !filepath.IsAbs(command) {
+			return fmt.Errorf("eventHooks.allowedCommands: %q must be an absolute path", command)
+		}
+		allowed[filepath.Clean(command)] = true
+	}
+
+	for i, hook := range cfg.Hooks {
+		field := fmt.Sprintf("eventHooks.hooks[%d]", i)
+		if hook.Name == "" {
+			return fmt.Errorf("%s.name is required", field)
+		}
+		if (hook.Webhook == nil) == (hook.Exec == nil) {
+			return fmt.Errorf("%s (%s) needs exactly one of webhook or exec", field, hook.Name)
+		}
+		if hook.Webhook != nil {
+			hookURL, err := url.Parse(hook.Webhook.URL)
+			if err != nil || (hookURL.Scheme != "http" && hookURL.Scheme != "https") || hookURL.Host == "" {
+				return fmt.Errorf("%s.webhook.url %q must be an http(s) url", field, hook.Webhook.URL)
+			}
+			if hook.Webhook.Secret == "" && hook.Webhook.SecretFile == "" {
+				return fmt.Errorf("%s.webhook needs a secret or secretFile to sign the payload", field)
+			}
+		}
+		if hook.Exec != nil && !allowed[filepath.Clean(hook.Exec.Command)] {
+			return fmt.Errorf("%s.exec.command %q is not listed in eventHooks.allowedCommands", field, hook.Exec.Command)
+		}
+	}
+	return nil
+}
+
+// HTTPClientConfig maps the wfm section of the configuration onto the shared http client configuration
+func (w WFMConfig) HTTPClientConfig() httputils.ClientConfig {
+	clientConfig := httputils.DefaultClientConfig()
+	if w.ClientPlugins.TLSHelper != nil && w.ClientPlugins.TLSHelper.Enabled && w.ClientPlugins.TLSHelper.ServerCAKeyRef != nil {
+		clientConfig.CACertPath = w.ClientPlugins.TLSHelper.ServerCAKeyRef.Path
+	}
+	if w.ClientPlugins.TLSHelper.MutualTLS() {
+		clientConfig.ClientCertPath = w.ClientPlugins.TLSHelper.ClientCertRef.Path
+		clientConfig.ClientKeyPath = w.ClientPlugins.TLSHelper.ClientKeyRef.Path
+	}
+	if w.HTTP != nil {
+		if w.HTTP.TimeoutSeconds > 0 {
+			clientConfig.Timeout = time.Duration(w.HTTP.TimeoutSeconds) * time.Second
+		}
+		if w.HTTP.ProxyURL != "" {
+			clientConfig.ProxyURL = w.HTTP.ProxyURL
+		}
+		if w.HTTP.UserAgent != "" {
+			clientConfig.UserAgent = w.HTTP.UserAgent
+		}
+	}
+	return clientConfig
+}
+
+// ManifestVerifier loads the key or CA signed state manifests are verified against, nil when
+// manifest verification is not configured
+func (w WFMConfig) ManifestVerifier() (*crypto.ManifestVerifier, error) {
+	return w.ManifestVerification.verifier()
+}
+
+// BundleVerifier loads the key or CA bundle signatures are verified against, nil when bundle
+// verification is not configured
+func (w WFMConfig) BundleVerifier() (*crypto.ManifestVerifier, error) {
+	return w.BundleVerification.verifier()
+}
+
+func (v *ManifestVerificationConfig) verifier() (*crypto.ManifestVerifier, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if v.CACertPath != "" {
+		return crypto.NewManifestVerifierFromFile(v.CACertPath, true)
+	}
+	return crypto.NewManifestVerifierFromFile(v.PublicKeyPath, false)
+}
+
 // PublicCertificatePEM returns the public certificate PEM content if available for PKI attestation.
 func (d DeviceRootIdentity) PublicCertificatePEM() (string, error) {
 	if d.Attestation.PKI != nil && d.Attestation.PKI.PubCertPath != "" {
@@ -0,0 +1,153 @@
+package types
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// envVarName is the name of an environment variable that may be referenced in the configuration
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// expandEnvironment replaces the ${VAR} and ${VAR:-default} references in every string of the
+// configuration, at any depth, with the value of the environment variable. The default is used when
+// the variable is unset or empty, a variable without a default must be set. $${ stands for a
+// literal ${. Every unset variable and malformed reference is reported.
+func expandEnvironment(config *Config) error {
+	var problems ConfigErrors
+	expandStrings(reflect.ValueOf(config).Elem(), "", func(path, value string) string {
+		expanded, err := expandEnvValue(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+			return value
+		}
+		return expanded
+	})
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// expandEnvValue expands the references of a single value
+func expandEnvValue(value string) (string, error) {
+	if !strings.Contains(value, "${") {
+		return value, nil
+	}
+
+	var expanded strings.Builder
+	var unset []string
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			expanded.WriteString(value)
+			break
+		}
+		if start > 0 && value[start-1] == '$' {
+			expanded.WriteString(value[:start-1] + "${")
+			value = value[start+2:]
+			continue
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated reference %q", value[start:])
+		}
+		reference := value[start+2 : start+end]
+		name, fallback, hasDefault := strings.Cut(reference, ":-")
+		if !envVarName.MatchString(name) {
+			return "", fmt.Errorf("invalid environment variable reference ${%s}", reference)
+		}
+
+		expanded.WriteString(value[:start])
+		resolved, set := os.LookupEnv(name)
+		switch {
+		case hasDefault && resolved == "":
+			resolved = fallback
+		case !set:
+			unset = append(unset, name)
+		}
+		expanded.WriteString(resolved)
+		value = value[start+end+1:]
+	}
+
+	switch len(unset) {
+	case 0:
+		return expanded.String(), nil
+	case 1:
+		return "", fmt.Errorf("environment variable %s is not set", unset[0])
+	default:
+		return "", fmt.Errorf("environment variables %s are not set", strings.Join(unset, ", "))
+	}
+}
+
+// expandStrings replaces every string reachable from v with what expand returns for it, path is
+// the position of v in the configuration named like in the yaml file, e.g. runtimes[0].docker.url
+func expandStrings(v reflect.Value, path string, expand func(path, value string) string) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(expand(path, v.String()))
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			expandStrings(v.Elem(), path, expand)
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		// the value of an interface cannot be changed in place, it is expanded in a copy
+		inner := reflect.New(v.Elem().Type()).Elem()
+		inner.Set(v.Elem())
+		expandStrings(inner, path, expand)
+		if v.CanSet() {
+			v.Set(inner)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, inline := yamlFieldName(field)
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			fieldPath := path
+			if !inline {
+				fieldPath = joinConfigPath(path, name)
+			}
+			expandStrings(v.Field(i), fieldPath, expand)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			expandStrings(v.Index(i), fmt.Sprintf("%s[%d]", path, i), expand)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(iter.Value().Type()).Elem()
+			value.Set(iter.Value())
+			expandStrings(value, joinConfigPath(path, fmt.Sprint(iter.Key().Interface())), expand)
+			v.SetMapIndex(iter.Key(), value)
+		}
+	}
+}
+
+// yamlFieldName returns the name of the field in the yaml file, yaml.v2 lowercases the names of
+// untagged fields
+func yamlFieldName(field reflect.StructField) (name string, inline bool) {
+	tag := field.Tag.Get("yaml")
+	name, flags, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, strings.Contains(flags, "inline")
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,278 @@
+package types
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	httputils "github.com/margo/sandbox/shared-lib/http"
+	"github.com/margo/sandbox/shared-lib/http/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+const envConfig = `
+logging:
+  level: ${MARGO_TEST_LOG_LEVEL:-INFO}
+deviceRootIdentity:
+  identityType: random
+  attestation:
+    random:
+      value: ${MARGO_TEST_DEVICE}
+wfm:
+  sbiUrl: https://${MARGO_TEST_WFM_HOST}:8082/margo/
+  clientPlugins:
+    authHelper:
+      enabled: true
+      authType: jwt
+      jwt:
+        clientId: agent
+        clientSecret: ${MARGO_TEST_CLIENT_SECRET}
+stateSeeking:
+  interval: 15
+runtimes:
+  - type: kubernetes
+    kubernetes:
+      kubeconfigPath: ${MARGO_TEST_KUBECONFIG:-/etc/margo/kubeconfig}
+  - type: docker
+    docker:
+      url: ${MARGO_TEST_DOCKER_SOCKET}
+registryCredentials:
+  harbor:
+    password: prefix-$${MARGO_TEST_LITERAL}-${MARGO_TEST_REGISTRY_TOKEN}
+`
+
+func TestLoadConfig_ExpandsEnvironmentVariables(t *testing.T) {
+	t.Setenv("MARGO_TEST_DEVICE", "device-42")
+	t.Setenv("MARGO_TEST_WFM_HOST", "wfm.example.com")
+	t.Setenv("MARGO_TEST_CLIENT_SECRET", "s3cr3t")
+	t.Setenv("MARGO_TEST_KUBECONFIG", "")
+	t.Setenv("MARGO_TEST_DOCKER_SOCKET", "unix:///run/docker.sock")
+	t.Setenv("MARGO_TEST_REGISTRY_TOKEN", "token")
+
+	config, err := LoadConfig(writeConfig(t, envConfig))
+	require.NoError(t, err)
+
+	assert.Equal(t, "INFO", config.Logging.Level, "the default of an unset variable")
+	assert.Equal(t, "device-42", config.DeviceRootIdentity.Attestation.Random.Value)
+	assert.Equal(t, "https://wfm.example.com:8082/margo", config.Wfm.SbiURL, "the expanded url is validated and normalized")
+	assert.Equal(t, "s3cr3t", config.Wfm.ClientPlugins.AuthHelper.JWT.ClientSecret)
+	assert.Equal(t, "/etc/margo/kubeconfig", config.Runtimes[0].Kubernetes.KubeconfigPath, "the default of an empty variable")
+	assert.Equal(t, "unix:///run/docker.sock", config.Runtimes[1].Docker.Url)
+	assert.Equal(t, "prefix-${MARGO_TEST_LITERAL}-token", config.RegistryCredentials["harbor"].Password, "$${ is a literal ${")
+}
+
+func TestLoadConfig_UnsetEnvironmentVariablesAreErrors(t *testing.T) {
+	t.Setenv("MARGO_TEST_DEVICE", "device-42")
+	t.Setenv("MARGO_TEST_WFM_HOST", "wfm.example.com")
+	t.Setenv("MARGO_TEST_REGISTRY_TOKEN", "token")
+	// an empty value is a value, only a default replaces it
+	t.Setenv("MARGO_TEST_DOCKER_SOCKET", "")
+
+	_, err := LoadConfig(writeConfig(t, envConfig+`
+  broken:
+    password: ${MARGO TEST}
+`))
+	require.Error(t, err)
+	var problems ConfigErrors
+	require.ErrorAs(t, err, &problems)
+	assert.ElementsMatch(t, ConfigErrors{
+		"wfm.clientPlugins.authHelper.jwt.clientSecret: environment variable MARGO_TEST_CLIENT_SECRET is not set",
+		"registryCredentials.broken.password: invalid environment variable reference ${MARGO TEST}",
+	}, problems)
+}
+
+func TestConfig_ValidateListsEveryProblem(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "device-private.key")
+	config, err := LoadConfig(writeConfig(t, `
+logging:
+  level: INFO
+deviceRootIdentity:
+  identityType: random
+  attestation:
+    random:
+      value: device-42
+wfm:
+  sbiUrl: ftp://wfm.example.com
+  clientPlugins:
+    requestSigner:
+      enabled: true
+      signatureAlgo: rsa
+      hashAlgo: sha256
+      signatureFormat: structured
+      keyRef:
+        path: `+keyPath+`
+stateSeeking:
+  interval: 0
+runtimes:
+  - type: docker
+`))
+	require.NotNil(t, config)
+	var problems ConfigErrors
+	require.ErrorAs(t, err, &problems)
+	require.Len(t, problems, 4, problems.Error())
+	assert.Contains(t, problems[0], "wfm.clientPlugins.requestSigner.keyRef.path")
+	assert.Contains(t, problems[1], "ftp")
+	assert.Equal(t, "stateSeeking.interval must be greater than 0", problems[2])
+	assert.Equal(t, "runtimes[0] needs kubernetes or docker", problems[3])
+	assert.Contains(t, err.Error(), "4 problems")
+
+	// a readable key clears its problem
+	require.NoError(t, os.WriteFile(keyPath, []byte("key"), 0600))
+	_, err = LoadConfig(writeConfig(t, `
+logging:
+  level: INFO
+deviceRootIdentity:
+  identityType: random
+  attestation:
+    random:
+      value: device-42
+wfm:
+  sbiUrl: https://wfm.example.com
+  clientPlugins:
+    requestSigner:
+      enabled: true
+      signatureAlgo: rsa
+      hashAlgo: sha256
+      signatureFormat: structured
+      keyRef:
+        path: `+keyPath+`
+stateSeeking:
+  interval: 15
+runtimes:
+  - type: docker
+    docker:
+      url: unix:///run/docker.sock
+`))
+	assert.NoError(t, err)
+}
+
+func TestConfig_ValidateNamesMissingFieldsLikeTheYAML(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, `
+stateSeeking:
+  interval: 15
+runtimes:
+  - docker:
+      url: unix:///run/docker.sock
+`))
+	var problems ConfigErrors
+	require.ErrorAs(t, err, &problems)
+	assert.NotContains(t, problems, "logging.level is required", "the level defaults to info")
+	assert.Contains(t, problems, "wfm.sbiUrl is required")
+	assert.Contains(t, problems, "deviceRootIdentity.identityType is required")
+}
+
+// tlsHelperConfig is a valid configuration whose tls helper trusts caPath, with clientRefs added
+// to the tls helper section
+func tlsHelperConfig(sbiURL, caPath, clientRefs string) string {
+	return `
+logging:
+  level: INFO
+deviceRootIdentity:
+  identityType: random
+  attestation:
+    random:
+      value: device-42
+wfm:
+  sbiUrl: ` + sbiURL + `
+  clientPlugins:
+    tlsHelper:
+      enabled: true
+      caKeyRef:
+        path: ` + caPath + `
+` + clientRefs + `
+stateSeeking:
+  interval: 15
+runtimes:
+  - docker:
+      url: unix:///run/docker.sock
+`
+}
+
+func TestWFMConfig_MutualTLS(t *testing.T) {
+	server := clienttest.NewMutualTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	caPath := server.WriteCA(t)
+	certPath, keyPath := server.WriteClientCertificate(t, "device-42")
+
+	get := func(config *Config) error {
+		factory, err := httputils.NewClientFactory(config.Wfm.HTTPClientConfig())
+		require.NoError(t, err)
+		resp, err := factory.Client().Get(server.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// the server ca alone is not enough for the server
+	config, err := LoadConfig(writeConfig(t, tlsHelperConfig(server.URL, caPath, "")))
+	require.NoError(t, err)
+	assert.False(t, config.Wfm.ClientPlugins.TLSHelper.MutualTLS())
+	assert.Error(t, get(config))
+
+	config, err = LoadConfig(writeConfig(t, tlsHelperConfig(server.URL, caPath, `
+      clientCertRef:
+        path: `+certPath+`
+      clientKeyRef:
+        path: `+keyPath)))
+	require.NoError(t, err)
+	assert.True(t, config.Wfm.ClientPlugins.TLSHelper.MutualTLS())
+	require.NoError(t, get(config))
+	assert.Equal(t, []string{"device-42"}, server.ClientNames())
+}
+
+func TestConfig_ValidateMutualTLS(t *testing.T) {
+	server := clienttest.NewMutualTLSServer(t, http.NotFoundHandler())
+	caPath := server.WriteCA(t)
+	certPath, keyPath := server.WriteClientCertificate(t, "device-42")
+	_, otherKeyPath := server.WriteClientCertificate(t, "device-43")
+
+	tests := []struct {
+		name        string
+		clientRefs  string
+		wantProblem string
+	}{
+		{
+			name: "certificate without key",
+			clientRefs: `
+      clientCertRef:
+        path: ` + certPath,
+			wantProblem: "wfm.clientPlugins.tlsHelper needs both clientCertRef and clientKeyRef for mutual tls, only one is set",
+		},
+		{
+			name: "key without certificate",
+			clientRefs: `
+      clientKeyRef:
+        path: ` + keyPath,
+			wantProblem: "wfm.clientPlugins.tlsHelper needs both clientCertRef and clientKeyRef for mutual tls, only one is set",
+		},
+		{
+			name: "key of another certificate",
+			clientRefs: `
+      clientCertRef:
+        path: ` + certPath + `
+      clientKeyRef:
+        path: ` + otherKeyPath,
+			wantProblem: "wfm.clientPlugins.tlsHelper client certificate: tls: private key does not match public key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, tlsHelperConfig(server.URL, caPath, tt.clientRefs)))
+			var problems ConfigErrors
+			require.ErrorAs(t, err, &problems)
+			assert.Equal(t, ConfigErrors{tt.wantProblem}, problems)
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultProvisioningPath is where the agent looks for a provisioning file on first boot
+const DefaultProvisioningPath = "/etc/margo/provisioning.yaml"
+
+type ProvisioningConfig struct {
+	// Path of the provisioning file read on first boot (default /etc/margo/provisioning.yaml)
+	Path string `yaml:"path,omitempty"`
+}
+
+// FilePath returns the configured path of the provisioning file or the default one
+func (p *ProvisioningConfig) FilePath() string {
+	if p == nil || p.Path == "" {
+		return DefaultProvisioningPath
+	}
+	return p.Path
+}
+
+// Provisioning is the file a manufacturing line puts onto the device image. It is applied on the
+// first boot only and erased once the device is onboarded, its bootstrap token is never stored.
+type Provisioning struct {
+	Wfm ProvisioningWFM `yaml:"wfm" validate:"required"`
+	// Tenant the device is provisioned for
+	Tenant string `yaml:"tenant,omitempty"`
+	// Labels the device starts with
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// DeviceRootIdentity replaces the identity of the configuration, e.g. to reference the
+	// certificate the line issued for the device
+	DeviceRootIdentity *DeviceRootIdentity `yaml:"deviceRootIdentity,omitempty"`
+	// BootstrapToken is exchanged for the client id while onboarding
+	BootstrapToken string `yaml:"bootstrapToken,omitempty"`
+	// Warnings collects problems of the file that do not prevent the provisioning
+	Warnings []string `yaml:"-"`
+}
+
+type ProvisioningWFM struct {
+	SbiURL string `yaml:"sbiUrl" validate:"required"`
+	// AllowInsecureHttp permits a plain http sbiUrl, meant for local development only
+	AllowInsecureHttp bool `yaml:"allowInsecureHttp,omitempty"`
+}
+
+// LoadProvisioning reads and validates a provisioning file. Fields the schema does not know are
+// errors, a misspelled field must not be skipped silently.
+func LoadProvisioning(path string) (*Provisioning, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provisioning file: %w", err)
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return nil, fmt.Errorf("provisioning file %s is empty", path)
+	}
+
+	var provisioning Provisioning
+	if err := yaml.UnmarshalStrict(data, &provisioning); err != nil {
+		return nil, fmt.Errorf("failed to parse provisioning file %s: %w", path, err)
+	}
+	if err := validateProvisioning(&provisioning); err != nil {
+		return nil, fmt.Errorf("invalid provisioning file %s: %w", path, err)
+	}
+	return &provisioning, nil
+}
+
+var (
+	// labels follow the syntax of kubernetes label names and values
+	labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_./]{0,61}[A-Za-z0-9])?$`)
+	labelValuePattern = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?)?$`)
+)
+
+// validateProvisioning validates the provisioning file, every error names the field by its path in
+// the file
+func validateProvisioning(provisioning *Provisioning) error {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		return strings.Split(field.Tag.Get("yaml"), ",")[0]
+	})
+	if err := v.Struct(provisioning); err != nil {
+		var validationErrs validator.ValidationErrors
+		if errors.As(err, &validationErrs) {
+			// the namespace starts with the struct name, e.g. Provisioning.wfm.sbiUrl
+			_, field, _ := strings.Cut(validationErrs[0].Namespace(), ".")
+			return fmt.Errorf("%s is required", field)
+		}
+		return err
+	}
+
+	sbiURL, warnings, err := NormalizeSbiURL(provisioning.Wfm.SbiURL, provisioning.Wfm.AllowInsecureHttp)
+	if err != nil {
+		return err
+	}
+	provisioning.Wfm.SbiURL = sbiURL
+	provisioning.Warnings = append(provisioning.Warnings, warnings...)
+
+	if provisioning.Tenant != strings.TrimSpace(provisioning.Tenant) || strings.ContainsAny(provisioning.Tenant, " \t\n") {
+		return fmt.Errorf("tenant %q must not contain whitespace", provisioning.Tenant)
+	}
+
+	keys := make([]string, 0, len(provisioning.Labels))
+	for key := range provisioning.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("labels: key %q must be at most 63 alphanumeric characters, '-', '_', '.' or '/', starting and ending with an alphanumeric one", key)
+		}
+		if value := provisioning.Labels[key]; !labelValuePattern.MatchString(value) {
+			return fmt.Errorf("labels.%s: value %q must be at most 63 alphanumeric characters, '-', '_' or '.', starting and ending with an alphanumeric one", key, value)
+		}
+	}
+
+	if provisioning.BootstrapToken != "" && strings.ContainsAny(provisioning.BootstrapToken, " \t\r\n") {
+		return fmt.Errorf("bootstrapToken must not contain whitespace")
+	}
+	if provisioning.DeviceRootIdentity == nil {
+		if provisioning.BootstrapToken == "" {
+			return fmt.Errorf("either bootstrapToken or deviceRootIdentity is required to onboard the device")
+		}
+		return nil
+	}
+	return validateProvisionedIdentity(*provisioning.DeviceRootIdentity)
+}
+
+// validateProvisionedIdentity checks that the identity references what its type needs, the
+// certificate of a PKI identity must be readable
+func validateProvisionedIdentity(identity DeviceRootIdentity) error {
+	switch strings.ToUpper(identity.IdentityType) {
+	case "PKI":
+		if identity.Attestation.PKI == nil || identity.Attestation.PKI.PubCertPath == "" {
+			return fmt.Errorf("deviceRootIdentity.attestation.pki.pubCertPath is required for identityType PKI")
+		}
+		if _, err := identity.PublicCertificatePEM(); err != nil {
+			return fmt.Errorf("deviceRootIdentity.attestation.pki.pubCertPath: %w", err)
+		}
+	case "RANDOM":
+		if identity.Attestation.Random == nil || identity.Attestation.Random.Value == "" {
+			return fmt.Errorf("deviceRootIdentity.attestation.random.value is required for identityType RANDOM")
+		}
+	default:
+		return fmt.Errorf("deviceRootIdentity.identityType %q must be PKI or RANDOM", identity.IdentityType)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeProvisioning(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "provisioning.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadProvisioning(t *testing.T) {
+	path := writeProvisioning(t, `
+wfm:
+  sbiUrl: https://wfm.example.com/margo/
+tenant: plant-7
+labels:
+  line: assembly-3
+  margo.org/site: munich
+deviceRootIdentity:
+  identityType: random
+  attestation:
+    random:
+      value: device-42
+bootstrapToken: s3cr3t
+`)
+
+	provisioning, err := LoadProvisioning(path)
+	require.NoError(t, err)
+	assert.Equal(t, "https://wfm.example.com/margo", provisioning.Wfm.SbiURL)
+	assert.Equal(t, "plant-7", provisioning.Tenant)
+	assert.Equal(t, map[string]string{"line": "assembly-3", "margo.org/site": "munich"}, provisioning.Labels)
+	assert.Equal(t, "device-42", provisioning.DeviceRootIdentity.Attestation.Random.Value)
+	assert.Equal(t, "s3cr3t", provisioning.BootstrapToken)
+}
+
+func TestLoadProvisioning_Malformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "empty",
+			content: "\n",
+			wantErr: "is empty",
+		},
+		{
+			name:    "unknown field",
+			content: "wfm:\n  sbiUrl: https://wfm.example.com\n  sbiURL: https://other.example.com\nbootstrapToken: t\n",
+			wantErr: "field sbiURL not found",
+		},
+		{
+			name:    "missing sbiUrl",
+			content: "tenant: plant-7\nbootstrapToken: t\n",
+			wantErr: "wfm.sbiUrl is required",
+		},
+		{
+			name:    "plain http",
+			content: "wfm:\n  sbiUrl: http://wfm.example.com\nbootstrapToken: t\n",
+			wantErr: `wfm.sbiUrl "http://wfm.example.com"`,
+		},
+		{
+			name:    "invalid label",
+			content: "wfm:\n  sbiUrl: https://wfm.example.com\nlabels:\n  line: assembly 3\nbootstrapToken: t\n",
+			wantErr: `labels.line: value "assembly 3"`,
+		},
+		{
+			name:    "no credentials",
+			content: "wfm:\n  sbiUrl: https://wfm.example.com\n",
+			wantErr: "either bootstrapToken or deviceRootIdentity is required",
+		},
+		{
+			name:    "missing certificate",
+			content: "wfm:\n  sbiUrl: https://wfm.example.com\ndeviceRootIdentity:\n  identityType: PKI\n  attestation:\n    pki:\n      pubCertPath: /nonexistent/device.pem\n",
+			wantErr: "deviceRootIdentity.attestation.pki.pubCertPath: failed to read certificate file /nonexistent/device.pem",
+		},
+		{
+			name:    "unknown identity type",
+			content: "wfm:\n  sbiUrl: https://wfm.example.com\ndeviceRootIdentity:\n  identityType: TPM\n",
+			wantErr: `deviceRootIdentity.identityType "TPM" must be PKI or RANDOM`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeProvisioning(t, tt.content)
+
+			_, err := LoadProvisioning(path)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), path)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
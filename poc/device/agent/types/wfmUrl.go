@@ -0,0 +1,81 @@
+package types
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// sbiOperationsPath is the path prefix the generated sbi client appends to the configured url
+const sbiOperationsPath = "/api/v1"
+
+// NormalizeSbiURL validates the configured WFM southbound url and returns it in the form used
+// everywhere in the agent: explicit scheme, lower-case host, no trailing or duplicate slashes.
+// Problems that are likely, but not certainly, misconfigurations are returned as warnings.
+func NormalizeSbiURL(rawURL string, allowInsecureHttp bool) (string, []string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return "", nil, fmt.Errorf("wfm.sbiUrl is required in configuration")
+	}
+
+	if !strings.Contains(rawURL, "://") {
+		return "", nil, fmt.Errorf("wfm.sbiUrl %q has no scheme, use https://%s", rawURL, rawURL)
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("wfm.sbiUrl %q is not a valid url: %w", rawURL, err)
+	}
+
+	scheme := strings.ToLower(parsed.Scheme)
+	switch scheme {
+	case "https":
+	case "http":
+		if !allowInsecureHttp {
+			return "", nil, fmt.Errorf("wfm.sbiUrl %q uses plain http, use https or set wfm.allowInsecureHttp to true", rawURL)
+		}
+	default:
+		return "", nil, fmt.Errorf("wfm.sbiUrl %q has unsupported scheme %q, expected http or https", rawURL, parsed.Scheme)
+	}
+
+	if parsed.Hostname() == "" {
+		return "", nil, fmt.Errorf("wfm.sbiUrl %q has no host", rawURL)
+	}
+	if parsed.User != nil {
+		return "", nil, fmt.Errorf("wfm.sbiUrl must not carry credentials, configure them under wfm.clientPlugins instead")
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", nil, fmt.Errorf("wfm.sbiUrl %q must not contain a query or fragment", rawURL)
+	}
+
+	basePath := ""
+	if parsed.Path != "" && parsed.Path != "/" {
+		basePath = strings.TrimSuffix(path.Clean("/"+parsed.Path), "/")
+	}
+
+	if basePath == sbiOperationsPath || strings.HasSuffix(basePath, sbiOperationsPath) || strings.Contains(basePath, sbiOperationsPath+"/") {
+		return "", nil, fmt.Errorf("wfm.sbiUrl %q must be the base url of the southbound api, the agent appends %s/... itself", rawURL, sbiOperationsPath)
+	}
+
+	var warnings []string
+	if containsPathSegment(basePath, "nbi") {
+		warnings = append(warnings, fmt.Sprintf("wfm.sbiUrl path %q looks like a northbound (nbi) path, the agent talks to the southbound (sbi) api", basePath))
+	}
+
+	normalized := url.URL{
+		Scheme: scheme,
+		Host:   strings.ToLower(parsed.Host),
+		Path:   basePath,
+	}
+	return normalized.String(), warnings, nil
+}
+
+func containsPathSegment(p, segment string) bool {
+	for _, part := range strings.Split(p, "/") {
+		if strings.EqualFold(part, segment) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package wfm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// The clients tell the WFM which API version they speak with every request, the WFM answers with
+// the version it speaks. Versions are "major.minor": minors only add to an API, so a client and a
+// server work together as long as their majors match.
+const (
+	// APIVersionsHeader carries the API versions the client supports, comma separated
+	APIVersionsHeader = "X-Margo-Api-Versions"
+	// ServerAPIVersionHeader carries the API version the server speaks
+	ServerAPIVersionHeader = "X-Margo-Api-Version"
+	// NegotiatedAPIVersionHeader carries the server API version a device negotiated, so that the WFM
+	// can track agents that run against an older view of itself
+	NegotiatedAPIVersionHeader = "X-Margo-Negotiated-Api-Version"
+)
+
+// API versions spoken by the clients of this package
+const (
+	SBIAPIVersion = "1.0"
+	NBIAPIVersion = "1.0"
+)
+
+// APICompatibility is the outcome of comparing the API versions of a client and a server
+type APICompatibility string
+
+const (
+	// APIVersionMatch means both speak the same major and minor version
+	APIVersionMatch APICompatibility = "match"
+	// APIServerNewer means the server speaks a newer minor version, features it added are not used
+	APIServerNewer APICompatibility = "server-newer"
+	// APIServerOlder means the server speaks an older minor version and may ignore newer features
+	APIServerOlder APICompatibility = "server-older"
+	// APIServerUnknown means the server does not advertise a usable version, it is assumed to match
+	APIServerUnknown APICompatibility = "unknown"
+	// APIIncompatible means the majors differ, the client must not talk to the server
+	APIIncompatible APICompatibility = "incompatible"
+)
+
+// APIVersionCheck compares the API version of a client with the one of the server it talks to
+type APIVersionCheck struct {
+	API           string
+	Client        string
+	Server        string
+	Compatibility APICompatibility
+	// Detail explains what does not work as usual, empty when the versions match
+	Detail string
+}
+
+// Compatible reports whether the client may talk to the server
+func (c APIVersionCheck) Compatible() bool {
+	return c.Compatibility != APIIncompatible
+}
+
+// ErrIncompatibleAPIVersion is returned when the server speaks another major version of the API
+type ErrIncompatibleAPIVersion struct {
+	API    string
+	Client string
+	Server string
+}
+
+func (e *ErrIncompatibleAPIVersion) Error() string {
+	return fmt.Sprintf("incompatible %s API version: the server speaks %s, this client speaks %s", e.API, e.Server, e.Client)
+}
+
+// CheckAPIVersion compares the version the client speaks with the version the server advertised.
+// A server that advertises no version, or one that cannot be parsed, is assumed to match, servers
+// predating the negotiation do not send one.
+//
+// Returns:
+//   - APIVersionCheck: The outcome, also for incompatible versions
+//   - error: An *ErrIncompatibleAPIVersion if the majors differ
+func CheckAPIVersion(api, client, server string) (APIVersionCheck, error) {
+	check := APIVersionCheck{API: api, Client: client, Server: server}
+
+	clientVersion, err := semver.NewVersion(client)
+	if err != nil {
+		return check, fmt.Errorf("invalid %s API version %q of the client: %w", api, client, err)
+	}
+	if server == "" {
+		check.Compatibility = APIServerUnknown
+		check.Detail = fmt.Sprintf("the server does not advertise its %s API version", api)
+		return check, nil
+	}
+	serverVersion, err := semver.NewVersion(server)
+	if err != nil {
+		check.Compatibility = APIServerUnknown
+		check.Detail = fmt.Sprintf("the server advertises an invalid %s API version %q", api, server)
+		return check, nil
+	}
+
+	switch {
+	case serverVersion.Major() != clientVersion.Major():
+		check.Compatibility = APIIncompatible
+		check.Detail = fmt.Sprintf("the server speaks %s API %d.x, this client only %d.x", api, serverVersion.Major(), clientVersion.Major())
+		return check, &ErrIncompatibleAPIVersion{API: api, Client: client, Server: server}
+	case serverVersion.Minor() > clientVersion.Minor():
+		check.Compatibility = APIServerNewer
+		check.Detail = fmt.Sprintf("the server speaks %s API %s, features added after %s are not used by this client", api, server, client)
+	case serverVersion.Minor() < clientVersion.Minor():
+		check.Compatibility = APIServerOlder
+		check.Detail = fmt.Sprintf("the server speaks %s API %s, features added after %s may be ignored by the server", api, server, server)
+	default:
+		check.Compatibility = APIVersionMatch
+	}
+	return check, nil
+}
+
+// withAPIVersions tells the server which API version the client speaks
+func withAPIVersions(version string) func(ctx context.Context, req *http.Request) error {
+	return func(ctx context.Context, req *http.Request) error {
+		req.Header.Set(APIVersionsHeader, version)
+		return nil
+	}
+}
+
+// WithNegotiatedAPIVersion tells the server which of its API versions the device negotiated.
+// Servers that do not know the header ignore it.
+func WithNegotiatedAPIVersion(version string) HTTPApiClientRequestEditorOptions {
+	return func(ctx context.Context, req *http.Request) error {
+		if version != "" {
+			req.Header.Set(NegotiatedAPIVersionHeader, version)
+		}
+		return nil
+	}
+}
+
+// CheckAPIVersion is CheckAPIVersionWithContext without a caller context, the client timeout bounds
+// its requests.
+//
+// Deprecated: use CheckAPIVersionWithContext.
+func (cli *NbiApiClient) CheckAPIVersion() (APIVersionCheck, error) {
+	return cli.CheckAPIVersionWithContext(context.Background())
+}
+
+// CheckAPIVersionWithContext asks the server which NBI API version it speaks, with an OPTIONS
+// request to the base URL, and checks it against the one of the client. Operator tooling calls it
+// before it acts on a server it has not talked to before.
+//
+// Returns:
+//   - APIVersionCheck: The client and server versions and whether they work together
+//   - error: An *ErrIncompatibleAPIVersion if the majors differ, or an error if the request failed
+func (cli *NbiApiClient) CheckAPIVersionWithContext(ctx context.Context) (APIVersionCheck, error) {
+	ctx, cancel := cli.requestContext(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, cli.nbiBaseURL, nil)
+	if err != nil {
+		return APIVersionCheck{API: "NBI", Client: NBIAPIVersion}, fmt.Errorf("failed to create api version request: %w", err)
+	}
+	withAPIVersions(NBIAPIVersion)(ctx, req)
+
+	resp, err := cli.httpClient.Do(req)
+	if err != nil {
+		return APIVersionCheck{API: "NBI", Client: NBIAPIVersion}, fmt.Errorf("api version request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return CheckAPIVersion("NBI", NBIAPIVersion, resp.Header.Get(ServerAPIVersionHeader))
+}
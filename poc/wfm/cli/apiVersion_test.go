@@ -0,0 +1,157 @@
+package wfm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/margo/sandbox/shared-lib/http/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// apiVersionStub advertises an api version on onboarding and OPTIONS requests like a WFM that
+// negotiates, and records the versions the clients send
+type apiVersionStub struct {
+	mu            sync.Mutex
+	version       string
+	onboardHeader bool
+	probes        int
+	clientHeaders []string
+}
+
+func (s *apiVersionStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clientHeaders = append(s.clientHeaders, r.Header.Get(APIVersionsHeader))
+	switch r.Method {
+	case http.MethodOptions:
+		s.probes++
+		if s.version != "" {
+			w.Header().Set(ServerAPIVersionHeader, s.version)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		if s.onboardHeader && s.version != "" {
+			w.Header().Set(ServerAPIVersionHeader, s.version)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"client_id": "device-1"}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestCheckAPIVersion(t *testing.T) {
+	tests := []struct {
+		name             string
+		server           string
+		want             APICompatibility
+		wantIncompatible bool
+	}{
+		{name: "matching", server: "1.0", want: APIVersionMatch},
+		{name: "matching patch", server: "1.0.3", want: APIVersionMatch},
+		{name: "newer minor", server: "1.3", want: APIServerNewer},
+		{name: "incompatible major", server: "2.0", want: APIIncompatible, wantIncompatible: true},
+		{name: "not advertised", server: "", want: APIServerUnknown},
+		{name: "invalid", server: "latest", want: APIServerUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check, err := CheckAPIVersion("SBI", "1.0", tt.server)
+
+			assert.Equal(t, tt.want, check.Compatibility)
+			assert.Equal(t, !tt.wantIncompatible, check.Compatible())
+			var incompatible *ErrIncompatibleAPIVersion
+			assert.Equal(t, tt.wantIncompatible, errors.As(err, &incompatible), "error %v", err)
+			if tt.want != APIVersionMatch {
+				assert.NotEmpty(t, check.Detail)
+			}
+		})
+	}
+
+	check, err := CheckAPIVersion("SBI", "1.2", "1.1")
+	require.NoError(t, err)
+	assert.Equal(t, APIServerOlder, check.Compatibility)
+}
+
+func TestSbiHttpClient_NegotiateAPIVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		stub *apiVersionStub
+		want APICompatibility
+		// wantProbes is 0 when the onboarding response advertised the version
+		wantProbes int
+	}{
+		{name: "matching", stub: &apiVersionStub{version: SBIAPIVersion, onboardHeader: true}, want: APIVersionMatch},
+		{name: "newer minor", stub: &apiVersionStub{version: "1.4", onboardHeader: true}, want: APIServerNewer},
+		{name: "incompatible major", stub: &apiVersionStub{version: "2.0", onboardHeader: true}, want: APIIncompatible},
+		{name: "probed when onboarding lacks it", stub: &apiVersionStub{version: "1.4"}, want: APIServerNewer, wantProbes: 1},
+		{name: "server predating the negotiation", stub: &apiVersionStub{}, want: APIServerUnknown, wantProbes: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the client keeps its caches under a relative data/ directory
+			t.Chdir(t.TempDir())
+			server := httptest.NewServer(tt.stub)
+			t.Cleanup(server.Close)
+			client, err := NewSbiHTTPClient(server.URL)
+			require.NoError(t, err)
+
+			_, _, err = client.OnboardDeviceClient(context.Background(), []byte("certificate"))
+			require.NoError(t, err)
+			check, err := client.NegotiateAPIVersion(context.Background())
+
+			assert.Equal(t, tt.want, check.Compatibility)
+			assert.Equal(t, SBIAPIVersion, check.Client)
+			assert.Equal(t, tt.stub.version, check.Server)
+			if tt.want == APIIncompatible {
+				var incompatible *ErrIncompatibleAPIVersion
+				assert.True(t, errors.As(err, &incompatible), "error %v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantProbes, tt.stub.probes)
+			for _, header := range tt.stub.clientHeaders {
+				assert.Equal(t, SBIAPIVersion, header)
+			}
+		})
+	}
+}
+
+func TestNbiApiClient_CheckAPIVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		want    APICompatibility
+	}{
+		{name: "matching", version: NBIAPIVersion, want: APIVersionMatch},
+		{name: "newer minor", version: "1.2", want: APIServerNewer},
+		{name: "incompatible major", version: "2.1", want: APIIncompatible},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &apiVersionStub{version: tt.version}
+			server := clienttest.NewTLSServer(t, stub)
+			serverURL, err := url.Parse(server.URL)
+			require.NoError(t, err)
+			port, err := strconv.ParseUint(serverURL.Port(), 10, 16)
+			require.NoError(t, err)
+			cli := NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil,
+				WithClientFactory(newTestClientFactory(t, server, "")))
+
+			check, err := cli.CheckAPIVersion()
+
+			assert.Equal(t, tt.want, check.Compatibility)
+			assert.Equal(t, tt.want != APIIncompatible, err == nil, "error %v", err)
+			assert.Equal(t, []string{NBIAPIVersion}, stub.clientHeaders)
+		})
+	}
+}
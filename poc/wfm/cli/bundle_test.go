@@ -0,0 +1,83 @@
+package wfm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bundleStub serves the bundle and answers 304 to requests that already hold it
+type bundleStub struct {
+	mu          sync.Mutex
+	bundle      []byte
+	ifNoneMatch []string
+}
+
+func (s *bundleStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	etag := r.Header.Get("If-None-Match")
+	s.ifNoneMatch = append(s.ifNoneMatch, etag)
+	if etag != "" {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(s.bundle)
+}
+
+func TestDownloadBundleToFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := &bundleStub{bundle: []byte("bundle-bytes")}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	client, err := NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+	ctx := context.Background()
+	digest := sha256Digest(stub.bundle)
+
+	destPath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	bundlePath, err := client.DownloadBundleToFile(ctx, inspectDeviceId, digest, destPath)
+	require.NoError(t, err)
+	assert.Equal(t, destPath, bundlePath)
+	content, err := os.ReadFile(bundlePath)
+	require.NoError(t, err)
+	assert.Equal(t, stub.bundle, content)
+
+	// the bundle was cached, the server confirms it and the cached file is returned
+	bundlePath, err = client.DownloadBundleToFile(ctx, inspectDeviceId, digest, filepath.Join(t.TempDir(), "again.tar.gz"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", `"` + digest + `"`}, stub.ifNoneMatch)
+	content, err = os.ReadFile(bundlePath)
+	require.NoError(t, err)
+	assert.Equal(t, stub.bundle, content)
+
+	// the in-memory download shares the cache
+	data, err := client.DownloadBundle(ctx, inspectDeviceId, digest)
+	require.NoError(t, err)
+	assert.Equal(t, stub.bundle, data)
+}
+
+func TestDownloadBundleToFile_DigestMismatch(t *testing.T) {
+	t.Chdir(t.TempDir())
+	stub := &bundleStub{bundle: []byte("tampered-bundle")}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	client, err := NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+
+	destPath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	_, err = client.DownloadBundleToFile(context.Background(), inspectDeviceId, sha256Digest([]byte("bundle-bytes")), destPath)
+	assert.ErrorContains(t, err, "bundle")
+	assert.NoFileExists(t, destPath)
+	entries, err := os.ReadDir(filepath.Dir(destPath))
+	require.NoError(t, err)
+	assert.Empty(t, entries, "the partial download is removed")
+}
@@ -0,0 +1,106 @@
+package wfm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	httputils "github.com/margo/sandbox/shared-lib/http"
+	"github.com/margo/sandbox/shared-lib/http/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClientFactory(t *testing.T, server *clienttest.Server, userAgent string) *httputils.ClientFactory {
+	t.Helper()
+	config := httputils.DefaultClientConfig()
+	config.CACertPath = server.WriteCA(t)
+	config.UserAgent = userAgent
+	factory, err := httputils.NewClientFactory(config)
+	require.NoError(t, err)
+	return factory
+}
+
+func TestNbiApiClient_ClientFactory(t *testing.T) {
+	server := clienttest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"apiVersion": "margo.org", "kind": "DeviceList", "items": []}`))
+	}))
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseUint(serverURL.Port(), 10, 16)
+	require.NoError(t, err)
+
+	// the default client does not trust the test CA
+	_, err = NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil).ListDevices(ListDevicesParams{})
+	require.Error(t, err)
+
+	cli := NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil,
+		WithClientFactory(newTestClientFactory(t, server, "nbi-test/1.0")))
+	_, err = cli.ListDevices(ListDevicesParams{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"nbi-test/1.0"}, server.UserAgents())
+}
+
+func TestNbiApiClient_CallerContext(t *testing.T) {
+	// the server answers no request, only the contexts end them
+	server := clienttest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseUint(serverURL.Port(), 10, 16)
+	require.NoError(t, err)
+	cli := NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil,
+		WithClientFactory(newTestClientFactory(t, server, "")), WithTimeout(time.Minute))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = cli.GetAppPkgWithContext(ctx, "pkg-1")
+	assert.True(t, errors.Is(err, context.Canceled), "the caller cancels the request: %v", err)
+
+	// a caller deadline replaces the client timeout
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = cli.DeleteDeploymentWithContext(ctx, "deployment-1")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "the caller deadline ends the request: %v", err)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	// the client timeout bounds the requests of callers without a deadline
+	cli = NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil,
+		WithClientFactory(newTestClientFactory(t, server, "")), WithTimeout(50*time.Millisecond))
+	_, err = cli.ListDevicesWithContext(context.Background(), ListDevicesParams{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "the client timeout ends the request: %v", err)
+}
+
+func TestSbiHttpClient_ClientFactory(t *testing.T) {
+	// the sbi client keeps its caches under a relative data/ directory
+	t.Chdir(t.TempDir())
+
+	server := clienttest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+
+	untrusted, err := NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+	_, _, err = untrusted.SyncStateWithResponse(context.Background(), "device-1", "")
+	require.Error(t, err)
+
+	factory := newTestClientFactory(t, server, "sbi-test/1.0")
+	client, err := NewSbiHTTPClient(server.URL, WithHTTPClientFactory(factory, 10*time.Second))
+	require.NoError(t, err)
+	_, resp, err := client.SyncStateWithResponse(context.Background(), "device-1", "")
+	require.NoError(t, err)
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, []string{"sbi-test/1.0"}, server.UserAgents())
+}
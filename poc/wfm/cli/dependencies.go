@@ -0,0 +1,148 @@
+package wfm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	nonStdWfmNbi "github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+	"github.com/margo/sandbox/non-standard/pkg/models"
+	"github.com/margo/sandbox/shared-lib/dependency"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// The SBI deployment has no notion of applications, the application a deployment installs and the
+// applications it depends on travel in annotations of the deployment metadata: LabelAppId,
+// LabelAppVersion and AnnotationAppDependencies. DeploymentAnnotations derives them from the
+// application description of the deployed package.
+const (
+	// AnnotationAppDependencies holds the dependencies of the application as a JSON list of
+	// {"id": ..., "version": ...} requirements
+	AnnotationAppDependencies = "app.margo.org/dependencies"
+)
+
+// DeploymentApplication is the application a deployment installs
+type DeploymentApplication struct {
+	ID           string
+	Version      string
+	Dependencies []dependency.Requirement
+}
+
+// DeploymentAnnotations returns the annotations telling the device which application a deployment
+// of the described package installs and which applications it depends on
+func DeploymentAnnotations(description nonStdWfmNbi.AppDescription) (map[string]string, error) {
+	if err := models.ValidateDependencies(description); err != nil {
+		return nil, err
+	}
+	annotations := map[string]string{
+		LabelAppId:      description.Metadata.Id,
+		LabelAppVersion: description.Metadata.Version,
+	}
+	if dependencies := models.DependenciesOf(description); len(dependencies) > 0 {
+		encoded, err := json.Marshal(dependencies)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode the dependencies: %w", err)
+		}
+		annotations[AnnotationAppDependencies] = string(encoded)
+	}
+	return annotations, nil
+}
+
+// ApplicationOf returns the application a deployment installs, read from its annotations. The id is
+// empty for deployments without them.
+func ApplicationOf(deployment sbi.AppDeploymentManifest) (DeploymentApplication, error) {
+	var application DeploymentApplication
+	if deployment.Metadata.Annotations == nil {
+		return application, nil
+	}
+	annotations := *deployment.Metadata.Annotations
+	application.ID = annotations[LabelAppId]
+	application.Version = annotations[LabelAppVersion]
+	if encoded := annotations[AnnotationAppDependencies]; encoded != "" {
+		if err := json.Unmarshal([]byte(encoded), &application.Dependencies); err != nil {
+			return application, fmt.Errorf("invalid %s annotation: %w", AnnotationAppDependencies, err)
+		}
+		for _, requirement := range application.Dependencies {
+			if err := requirement.Validate(); err != nil {
+				return application, fmt.Errorf("invalid %s annotation: %w", AnnotationAppDependencies, err)
+			}
+		}
+	}
+	return application, nil
+}
+
+// DependencyWarning tells why a dependency of an application cannot be deployed with the packages
+// onboarded so far
+type DependencyWarning struct {
+	Dependency dependency.Requirement
+	Message    string
+}
+
+func (w DependencyWarning) String() string {
+	return fmt.Sprintf("dependency %s: %s", w.Dependency, w.Message)
+}
+
+// CheckAppPkgDependencies is CheckAppPkgDependenciesWithContext without a caller context, the
+// client timeout bounds its requests.
+//
+// Deprecated: use CheckAppPkgDependenciesWithContext.
+func (cli *NbiApiClient) CheckAppPkgDependencies(description nonStdWfmNbi.AppDescription) ([]DependencyWarning, error) {
+	return cli.CheckAppPkgDependenciesWithContext(context.Background(), description)
+}
+
+// CheckAppPkgDependenciesWithContext checks the dependencies an application description declares
+// against the packages onboarded on the server, before or right after the package itself is
+// onboarded.
+//
+// A dependency that is not onboarded yet does not prevent onboarding, the package may be onboarded
+// first, so it is reported as a warning. Malformed declarations are an error.
+//
+// Parameters:
+//   - ctx: Cancels the requests, each one is bounded by the client timeout when ctx has no deadline
+//   - description: The application description of the package
+//
+// Returns:
+//   - []DependencyWarning: The dependencies without an onboarded package, or whose versions do not
+//     match, empty if every dependency is satisfied
+//   - error: An error if a declaration is invalid or the packages cannot be listed
+func (cli *NbiApiClient) CheckAppPkgDependenciesWithContext(ctx context.Context, description nonStdWfmNbi.AppDescription) ([]DependencyWarning, error) {
+	if err := models.ValidateDependencies(description); err != nil {
+		return nil, err
+	}
+	dependencies := models.DependenciesOf(description)
+	if len(dependencies) == 0 {
+		return nil, nil
+	}
+
+	pkgs, err := cli.ListAllAppPkgs(ctx, ListAppPkgsParams{})
+	if err != nil {
+		return nil, err
+	}
+	return checkAppPkgDependencies(dependencies, pkgs), nil
+}
+
+func checkAppPkgDependencies(dependencies []dependency.Requirement, pkgs []AppPkgSummary) []DependencyWarning {
+	var warnings []DependencyWarning
+	for _, requirement := range dependencies {
+		versions := groupAppPkgVersions(pkgs, requirement.ID, "")
+		if len(versions) == 0 {
+			warnings = append(warnings, DependencyWarning{Dependency: requirement, Message: "no package of the application is onboarded"})
+			continue
+		}
+		if _, err := latestAppPkgVersion(versions, requirement.ID, "", requirement.Version); err != nil {
+			var noMatch *ErrNoMatchingVersion
+			if !errors.As(err, &noMatch) {
+				warnings = append(warnings, DependencyWarning{Dependency: requirement, Message: err.Error()})
+				continue
+			}
+			onboarded := make([]string, 0, len(versions))
+			for _, version := range versions {
+				onboarded = append(onboarded, version.RawVersion)
+			}
+			warnings = append(warnings, DependencyWarning{Dependency: requirement,
+				Message: fmt.Sprintf("no onboarded version matches, onboarded versions: %v", onboarded)})
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,77 @@
+package wfm
+
+import (
+	"testing"
+
+	nonStdWfmNbi "github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+	"github.com/margo/sandbox/shared-lib/dependency"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func describedApp(id, version string, dependencies ...nonStdWfmNbi.AppDescriptionDependency) nonStdWfmNbi.AppDescription {
+	description := nonStdWfmNbi.AppDescription{Metadata: nonStdWfmNbi.AppDescriptionMetadata{Id: id, Version: version}}
+	if len(dependencies) > 0 {
+		description.Dependencies = &dependencies
+	}
+	return description
+}
+
+func TestCheckAppPkgDependencies(t *testing.T) {
+	constraint := "^1.2"
+	stub := &versionsStub{pageSize: 10, pkgs: []AppPkgSummary{
+		newVersionedPkg("pkg-broker-1.1", "mqtt-broker", "1.1.0", ""),
+		newVersionedPkg("pkg-broker-1.3", "mqtt-broker", "1.3.0", ""),
+		newVersionedPkg("pkg-db-0.9", "device-db", "0.9.0", ""),
+	}}
+	cli := newVersionsStubClient(t, stub)
+
+	warnings, err := cli.CheckAppPkgDependencies(describedApp("dashboard", "1.0.0",
+		nonStdWfmNbi.AppDescriptionDependency{Id: "mqtt-broker", Version: &constraint},
+		nonStdWfmNbi.AppDescriptionDependency{Id: "device-db", Version: &constraint},
+		nonStdWfmNbi.AppDescriptionDependency{Id: "historian"},
+	))
+	require.NoError(t, err)
+	require.Len(t, warnings, 2)
+	assert.Equal(t, "device-db", warnings[0].Dependency.ID)
+	assert.Contains(t, warnings[0].String(), "no onboarded version matches, onboarded versions: [0.9.0]")
+	assert.Equal(t, "historian", warnings[1].Dependency.ID)
+	assert.Contains(t, warnings[1].String(), "no package of the application is onboarded")
+
+	// without dependencies nothing is listed
+	requests := stub.listRequests
+	warnings, err = cli.CheckAppPkgDependencies(describedApp("dashboard", "1.0.0"))
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Equal(t, requests, stub.listRequests)
+
+	_, err = cli.CheckAppPkgDependencies(describedApp("dashboard", "1.0.0", nonStdWfmNbi.AppDescriptionDependency{Id: "dashboard"}))
+	assert.ErrorContains(t, err, "cannot depend on itself")
+}
+
+func TestDeploymentAnnotations_RoundTrip(t *testing.T) {
+	constraint := ">= 1.0"
+	annotations, err := DeploymentAnnotations(describedApp("dashboard", "2.1.0",
+		nonStdWfmNbi.AppDescriptionDependency{Id: "mqtt-broker", Version: &constraint}))
+	require.NoError(t, err)
+
+	deployment := sbi.AppDeploymentManifest{}
+	deployment.Metadata.Annotations = &annotations
+	application, err := ApplicationOf(deployment)
+	require.NoError(t, err)
+	assert.Equal(t, DeploymentApplication{
+		ID:           "dashboard",
+		Version:      "2.1.0",
+		Dependencies: []dependency.Requirement{{ID: "mqtt-broker", Version: ">= 1.0"}},
+	}, application)
+
+	// deployments without annotations install an unknown application
+	application, err = ApplicationOf(sbi.AppDeploymentManifest{})
+	require.NoError(t, err)
+	assert.Empty(t, application.ID)
+
+	annotations[AnnotationAppDependencies] = `[{"version": "1.0"}]`
+	_, err = ApplicationOf(deployment)
+	assert.ErrorContains(t, err, "dependency id cannot be empty")
+}
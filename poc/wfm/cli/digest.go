@@ -0,0 +1,116 @@
+package wfm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	contentdigest "github.com/margo/sandbox/shared-lib/digest"
+)
+
+// ErrPackageDrifted is returned when the content of an application package no longer matches
+// the digest the caller expects, e.g. because it was onboarded from a moving git branch or OCI tag.
+type ErrPackageDrifted struct {
+	PackageId string
+	Expected  string
+	// Actual is empty when the drift was detected by the server and it did not report the current digest
+	Actual string
+}
+
+func (e *ErrPackageDrifted) Error() string {
+	if e.Actual == "" {
+		return fmt.Sprintf("package %s drifted: expected digest %s", e.PackageId, e.Expected)
+	}
+	return fmt.Sprintf("package %s drifted: expected digest %s, got %s", e.PackageId, e.Expected, e.Actual)
+}
+
+// CreateDeploymentOption configures optional behavior of CreateDeployment
+type CreateDeploymentOption func(*createDeploymentOptions)
+
+type createDeploymentOptions struct {
+	expectedPackageDigest string
+
+	resolveAppId      string
+	resolveChannel    string
+	resolveConstraint string
+}
+
+// WithExpectedPackageDigest pins the deployment to the given package digest. The client checks the
+// package's current digest before submitting and forwards the pin so the server can enforce it too.
+func WithExpectedPackageDigest(digest string) CreateDeploymentOption {
+	return func(opts *createDeploymentOptions) {
+		opts.expectedPackageDigest = digest
+	}
+}
+
+// WithAppPkgResolution deploys the newest version of an application instead of a fixed package.
+// The package is resolved with GetLatestAppPkg, an empty channel or constraint selects any, and
+// replaces the package id of the request.
+func WithAppPkgResolution(appId, channel, constraint string) CreateDeploymentOption {
+	return func(opts *createDeploymentOptions) {
+		opts.resolveAppId = appId
+		opts.resolveChannel = channel
+		opts.resolveConstraint = constraint
+	}
+}
+
+// AppPkgDigest returns the content digest the server computed when the package was onboarded,
+// or an empty string if the server did not report one.
+func AppPkgDigest(pkg *AppPkgSummary) string {
+	if pkg == nil || pkg.Status == nil || pkg.Status.Digest == nil {
+		return ""
+	}
+	return *pkg.Status.Digest
+}
+
+// VerifyPackageDigest is VerifyPackageDigestWithContext without a caller context, the client
+// timeout bounds its requests.
+//
+// Deprecated: use VerifyPackageDigestWithContext.
+func (cli *NbiApiClient) VerifyPackageDigest(pkgId, expectedDigest string) (*AppPkgSummary, error) {
+	return cli.VerifyPackageDigestWithContext(context.Background(), pkgId, expectedDigest)
+}
+
+// VerifyPackageDigestWithContext checks that the package on the server still has the expected
+// digest.
+//
+// Use it with a digest computed locally (see packageManager.PackageDigest) as an integrity check for
+// packages onboarded from sources the client controls, or with a digest recorded at review time.
+//
+// Returns:
+//   - *AppPkgSummary: The package as currently known by the server
+//   - error: *ErrPackageDrifted if the digests differ, or an error if the package cannot be retrieved
+//     or the server did not report a digest
+func (cli *NbiApiClient) VerifyPackageDigestWithContext(ctx context.Context, pkgId, expectedDigest string) (*AppPkgSummary, error) {
+	pkg, err := cli.GetAppPkgWithContext(ctx, pkgId)
+	if err != nil {
+		return nil, err
+	}
+
+	actual := AppPkgDigest(pkg)
+	if actual == "" {
+		return pkg, fmt.Errorf("package %s has no digest, it may still be onboarding", pkgId)
+	}
+	if !digestsEqual(expectedDigest, actual) {
+		return pkg, &ErrPackageDrifted{PackageId: pkgId, Expected: expectedDigest, Actual: actual}
+	}
+	return pkg, nil
+}
+
+// digestsEqual compares two digests, a bare hex value matches its sha256-prefixed form. Digests
+// that do not parse are compared as text.
+func digestsEqual(a, b string) bool {
+	normalize := func(value string) string {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if !strings.Contains(value, ":") {
+			value = string(contentdigest.Canonical) + ":" + value
+		}
+		return value
+	}
+	parsedA, errA := contentdigest.Parse(normalize(a))
+	parsedB, errB := contentdigest.Parse(normalize(b))
+	if errA != nil || errB != nil {
+		return normalize(a) == normalize(b)
+	}
+	return parsedA.Equal(parsedB)
+}
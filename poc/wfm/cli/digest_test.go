@@ -0,0 +1,147 @@
+package wfm
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/margo/sandbox/shared-lib/http/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	reviewedDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	driftedDigest  = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+// packageStub serves an app package with the given digest and records the deployments created
+type packageStub struct {
+	mu                 sync.Mutex
+	digest             string
+	createStatus       int
+	createdDeployments []string
+}
+
+func (s *packageStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/app-packages/pkg-1"):
+		w.Write([]byte(`{
+			"apiVersion": "margo.org", "kind": "ApplicationPackage",
+			"metadata": {"name": "my-app", "id": "pkg-1"},
+			"spec": {"sourceType": "GIT_REPO", "source": {"url": "https://example.com/app.git", "branch": "main"}},
+			"status": {"state": "ONBOARDED", "digest": "` + s.digest + `"}
+		}`))
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/app-deployments"):
+		body, _ := io.ReadAll(r.Body)
+		s.createdDeployments = append(s.createdDeployments, string(body))
+		if s.createStatus != 0 {
+			w.WriteHeader(s.createStatus)
+			w.Write([]byte(`{"code": "PACKAGE_DRIFTED", "message": "package digest mismatch"}`))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newPackageStubClient(t *testing.T, stub *packageStub) *NbiApiClient {
+	t.Helper()
+	server := clienttest.NewTLSServer(t, stub)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseUint(serverURL.Port(), 10, 16)
+	require.NoError(t, err)
+
+	return NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil,
+		WithClientFactory(newTestClientFactory(t, server, "")))
+}
+
+func newTestDeploymentReq(t *testing.T) DeploymentReq {
+	t.Helper()
+	var req DeploymentReq
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"apiVersion": "margo.org", "kind": "ApplicationDeployment",
+		"metadata": {"name": "my-app-deployment"},
+		"spec": {
+			"appPackageRef": {"id": "pkg-1"},
+			"deploymentProfile": {"type": "compose", "components": [{"name": "web", "properties": {"packageLocation": "https://example.com/compose.yaml"}}]}
+		}
+	}`), &req))
+	return req
+}
+
+func TestGetAppPkg_ExposesDigest(t *testing.T) {
+	cli := newPackageStubClient(t, &packageStub{digest: reviewedDigest})
+
+	pkg, err := cli.GetAppPkg("pkg-1")
+	require.NoError(t, err)
+	assert.Equal(t, reviewedDigest, AppPkgDigest(pkg))
+	assert.Equal(t, "", AppPkgDigest(nil))
+}
+
+func TestCreateDeployment_PinnedDigest(t *testing.T) {
+	stub := &packageStub{digest: reviewedDigest}
+	cli := newPackageStubClient(t, stub)
+
+	_, err := cli.CreateDeployment(newTestDeploymentReq(t), WithExpectedPackageDigest(reviewedDigest))
+	require.NoError(t, err)
+
+	require.Len(t, stub.createdDeployments, 1)
+	assert.Contains(t, stub.createdDeployments[0], `"digest":"`+reviewedDigest+`"`, "the pin is forwarded to the server")
+}
+
+func TestCreateDeployment_PackageDrifted(t *testing.T) {
+	stub := &packageStub{digest: driftedDigest}
+	cli := newPackageStubClient(t, stub)
+
+	_, err := cli.CreateDeployment(newTestDeploymentReq(t), WithExpectedPackageDigest(reviewedDigest))
+
+	var drifted *ErrPackageDrifted
+	require.True(t, errors.As(err, &drifted), "expected ErrPackageDrifted, got %v", err)
+	assert.Equal(t, "pkg-1", drifted.PackageId)
+	assert.Equal(t, reviewedDigest, drifted.Expected)
+	assert.Equal(t, driftedDigest, drifted.Actual)
+	assert.Empty(t, stub.createdDeployments, "nothing is submitted once drift is detected")
+}
+
+func TestCreateDeployment_ServerRejectsPin(t *testing.T) {
+	// the package drifts between the client side check and the server processing the request
+	stub := &packageStub{digest: reviewedDigest, createStatus: http.StatusPreconditionFailed}
+	cli := newPackageStubClient(t, stub)
+
+	_, err := cli.CreateDeployment(newTestDeploymentReq(t), WithExpectedPackageDigest(reviewedDigest))
+
+	var drifted *ErrPackageDrifted
+	require.True(t, errors.As(err, &drifted), "expected ErrPackageDrifted, got %v", err)
+	assert.Equal(t, reviewedDigest, drifted.Expected)
+}
+
+func TestCreateDeployment_Unpinned(t *testing.T) {
+	stub := &packageStub{digest: driftedDigest}
+	cli := newPackageStubClient(t, stub)
+
+	_, err := cli.CreateDeployment(newTestDeploymentReq(t))
+	require.NoError(t, err)
+	require.Len(t, stub.createdDeployments, 1)
+	assert.NotContains(t, stub.createdDeployments[0], `"digest"`)
+}
+
+func TestDigestsEqual(t *testing.T) {
+	assert.True(t, digestsEqual(reviewedDigest, strings.TrimPrefix(reviewedDigest, "sha256:")))
+	assert.True(t, digestsEqual(strings.ToUpper(reviewedDigest), reviewedDigest))
+	assert.False(t, digestsEqual(reviewedDigest, driftedDigest))
+}
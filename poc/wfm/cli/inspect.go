@@ -0,0 +1,110 @@
+package wfm
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+
+    "github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// DesiredStateSnapshot is the desired state of a device as the WFM serves it, fetched for inspection
+type DesiredStateSnapshot struct {
+    Manifest *sbi.UnsignedAppStateManifest
+    // ETag is the etag the WFM returned with the manifest
+    ETag string
+    // Deployments maps the deployment ids to their verified deployment YAML
+    Deployments map[string][]byte
+    // Bundle is the verified bundle, nil when the manifest references none
+    Bundle []byte
+}
+
+// InspectDesiredState fetches the desired state of a device the way the agent does, through the
+// same manifest, deployment and bundle endpoints with the same size limits and digest
+// verification, but read-only: nothing is read from or written to the caches and no conditional
+// requests are sent, so operators can look at what a device would receive without affecting it.
+//
+// Tools should use it rather than the legacy desired-state endpoint, which has no etags and no
+// digest verification and so does not show what a real device gets.
+//
+// Returns:
+//   - *DesiredStateSnapshot: The manifest with its verified deployments and bundle
+//   - error: *LimitExceededError if the manifest or content exceeds the limits, or an error if the
+//     content does not match its digest or cannot be fetched
+func (self *SbiHttpClient) InspectDesiredState(ctx context.Context, deviceClientId string, overrideOptions ...HTTPApiClientRequestEditorOptions) (*DesiredStateSnapshot, error) {
+    manifest, resp, err := self.SyncStateWithResponse(ctx, deviceClientId, "", overrideOptions...)
+    if err != nil {
+        return nil, fmt.Errorf("failed to fetch the desired state manifest: %w", err)
+    }
+    if resp != nil {
+        resp.Body.Close()
+    }
+    if manifest == nil {
+        return nil, fmt.Errorf("the server returned no desired state manifest")
+    }
+
+    if count := int64(len(manifest.Deployments)); count > self.limits.MaxDeployments {
+        return nil, &LimitExceededError{Limit: "maxDeployments", Max: self.limits.MaxDeployments, Actual: count}
+    }
+
+    snapshot := &DesiredStateSnapshot{
+        Manifest:    manifest,
+        ETag:        resp.Header.Get("ETag"),
+        Deployments: make(map[string][]byte, len(manifest.Deployments)),
+    }
+
+    for _, deployment := range manifest.Deployments {
+        resp, err := self.client.GetApiV1ClientsClientIdDeploymentsDeploymentIdDigest(
+            ctx,
+            deviceClientId,
+            deployment.DeploymentId,
+            deployment.Digest,
+            &sbi.GetApiV1ClientsClientIdDeploymentsDeploymentIdDigestParams{},
+            overrideOptions...,
+        )
+        if err != nil {
+            return nil, fmt.Errorf("failed to fetch deployment YAML: %w", err)
+        }
+        content, err := readInspectedContent(resp, "deployment", "maxDeploymentBytes", self.limits.MaxDeploymentBytes, deployment.Digest)
+        if err != nil {
+            return nil, fmt.Errorf("deployment %s: %w", deployment.DeploymentId, err)
+        }
+        snapshot.Deployments[deployment.DeploymentId] = content
+    }
+
+    if manifest.Bundle != nil && manifest.Bundle.Digest != nil && *manifest.Bundle.Digest != "" {
+        resp, err := self.client.GetApiV1ClientsClientIdBundlesDigest(
+            ctx,
+            deviceClientId,
+            *manifest.Bundle.Digest,
+            &sbi.GetApiV1ClientsClientIdBundlesDigestParams{},
+            overrideOptions...,
+        )
+        if err != nil {
+            return nil, fmt.Errorf("failed to download bundle: %w", err)
+        }
+        snapshot.Bundle, err = readInspectedContent(resp, "bundle", "maxBundleBytes", self.limits.MaxBundleBytes, *manifest.Bundle.Digest)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return snapshot, nil
+}
+
+// readInspectedContent reads a deployment or bundle response within its limit and verifies its digest
+func readInspectedContent(resp *http.Response, kind, limit string, max int64, digest string) ([]byte, error) {
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%s fetch failed with status: %d", kind, resp.StatusCode)
+    }
+    expected, err := requestedDigest(kind, digest)
+    if err != nil {
+        return nil, err
+    }
+    if err := limitResponseBody(resp, limit, max); err != nil {
+        return nil, err
+    }
+    return readVerifiedContent(resp.Body, kind, expected)
+}
@@ -0,0 +1,207 @@
+package wfm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	contentdigest "github.com/margo/sandbox/shared-lib/digest"
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const inspectDeviceId = "device-client-1"
+
+func sha256Digest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// desiredStateStub serves a manifest, the deployment YAMLs and the bundle it references, the
+// content served for a digest can differ from the digest to simulate tampering
+type desiredStateStub struct {
+	mu           sync.Mutex
+	deployments  map[string][]byte
+	bundle       []byte
+	tampered     map[string][]byte
+	conditionals int
+}
+
+func (s *desiredStateStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Header.Get("If-None-Match") != "" {
+		s.conditionals++
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/deployments"):
+		manifest := sbi.UnsignedAppStateManifest{ManifestVersion: 3, Deployments: []sbi.DeploymentManifestRef{}}
+		for _, deploymentId := range []string{"deployment-web", "deployment-db"} {
+			digest := sha256Digest(s.deployments[deploymentId])
+			manifest.Deployments = append(manifest.Deployments, sbi.DeploymentManifestRef{
+				DeploymentId: deploymentId,
+				Digest:       digest,
+				Url:          fmt.Sprintf("/api/v1/clients/%s/deployments/%s/%s", inspectDeviceId, deploymentId, digest),
+			})
+		}
+		if s.bundle != nil {
+			digest := sha256Digest(s.bundle)
+			manifest.Bundle = &sbi.DeploymentBundleRef{Digest: &digest}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"manifest-3"`)
+		json.NewEncoder(w).Encode(manifest)
+	case strings.Contains(r.URL.Path, "/bundles/"):
+		w.Write(s.bundle)
+	default:
+		deploymentId := path.Base(path.Dir(r.URL.Path))
+		if data, found := s.tampered[deploymentId]; found {
+			w.Write(data)
+			return
+		}
+		w.Write(s.deployments[deploymentId])
+	}
+}
+
+func newDesiredStateStub() *desiredStateStub {
+	return &desiredStateStub{
+		deployments: map[string][]byte{
+			"deployment-web": []byte("apiVersion: margo.org\nkind: ApplicationDeployment\nmetadata: {name: web}\n"),
+			"deployment-db":  []byte("apiVersion: margo.org\nkind: ApplicationDeployment\nmetadata: {name: db}\n"),
+		},
+		bundle:   []byte("bundle-bytes"),
+		tampered: map[string][]byte{},
+	}
+}
+
+// agentFetch fetches the desired state through the calls the agent's state syncer makes
+func agentFetch(ctx context.Context, client *SbiHttpClient) (*DesiredStateSnapshot, error) {
+	manifest, resp, err := client.SyncStateWithResponse(ctx, inspectDeviceId, "")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	snapshot := &DesiredStateSnapshot{Manifest: manifest, ETag: resp.Header.Get("ETag"), Deployments: map[string][]byte{}}
+	for _, deployment := range manifest.Deployments {
+		content, err := client.FetchDeploymentYAML(ctx, inspectDeviceId, deployment.DeploymentId, deployment.Digest)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Deployments[deployment.DeploymentId] = content
+	}
+	if manifest.Bundle != nil {
+		if snapshot.Bundle, err = client.DownloadBundle(ctx, inspectDeviceId, *manifest.Bundle.Digest); err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+func newInspectTestClient(t *testing.T, stub *desiredStateStub) *SbiHttpClient {
+	t.Helper()
+	// the sbi client keeps its caches under a relative data/ directory
+	t.Chdir(t.TempDir())
+
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	client, err := NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+	return client
+}
+
+func cachedFiles(t *testing.T) []string {
+	t.Helper()
+	var files []string
+	require.NoError(t, filepath.WalkDir("data/cache", func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	}))
+	return files
+}
+
+func TestInspectDesiredState_MatchesAgentPath(t *testing.T) {
+	stub := newDesiredStateStub()
+	client := newInspectTestClient(t, stub)
+
+	inspected, err := client.InspectDesiredState(context.Background(), inspectDeviceId)
+	require.NoError(t, err)
+	assert.Empty(t, cachedFiles(t), "inspection never writes the caches")
+
+	synced, err := agentFetch(context.Background(), client)
+	require.NoError(t, err)
+	assert.NotEmpty(t, cachedFiles(t))
+
+	assert.Equal(t, synced, inspected)
+	assert.Equal(t, `"manifest-3"`, inspected.ETag)
+	assert.Equal(t, stub.bundle, inspected.Bundle)
+	assert.Len(t, inspected.Deployments, 2)
+
+	// with warm caches the agent sends conditional requests, the inspection still does not
+	conditionals := stub.conditionals
+	again, err := client.InspectDesiredState(context.Background(), inspectDeviceId)
+	require.NoError(t, err)
+	assert.Equal(t, inspected, again)
+	assert.Equal(t, conditionals, stub.conditionals)
+}
+
+func TestInspectDesiredState_SameDigestVerification(t *testing.T) {
+	stub := newDesiredStateStub()
+	stub.tampered["deployment-db"] = []byte("kind: Tampered\n")
+	client := newInspectTestClient(t, stub)
+
+	_, inspectErr := client.InspectDesiredState(context.Background(), inspectDeviceId)
+	_, agentErr := agentFetch(context.Background(), client)
+
+	require.Error(t, inspectErr)
+	require.Error(t, agentErr)
+	wantErr := fmt.Sprintf("deployment digest mismatch: expected %s, got %s",
+		sha256Digest(stub.deployments["deployment-db"]), sha256Digest(stub.tampered["deployment-db"]))
+	assert.Equal(t, wantErr, agentErr.Error())
+	assert.Equal(t, "deployment deployment-db: "+wantErr, inspectErr.Error())
+}
+
+func TestInspectDesiredState_EnforcesLimits(t *testing.T) {
+	client := newInspectTestClient(t, newDesiredStateStub())
+	client.SetManifestLimits(ManifestLimits{MaxBundleBytes: 4})
+
+	_, err := client.InspectDesiredState(context.Background(), inspectDeviceId)
+
+	var limitErr *LimitExceededError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, "maxBundleBytes", limitErr.Limit)
+}
+
+func TestFetch_UnverifiableDigestIsNotRequested(t *testing.T) {
+	t.Chdir(t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s", r.URL.Path)
+	}))
+	t.Cleanup(server.Close)
+	client, err := NewSbiHTTPClient(server.URL)
+	require.NoError(t, err)
+
+	blake3Digest := "blake3:" + strings.Repeat("ab", 32)
+	_, err = client.FetchDeploymentYAML(context.Background(), inspectDeviceId, "deployment-web", blake3Digest)
+	var unsupported *contentdigest.UnsupportedAlgorithmError
+	require.True(t, errors.As(err, &unsupported), "got %v", err)
+	assert.Equal(t, contentdigest.BLAKE3, unsupported.Algorithm)
+
+	_, err = client.DownloadBundle(context.Background(), inspectDeviceId, "md5:"+strings.Repeat("ab", 16))
+	require.True(t, errors.As(err, &unsupported), "got %v", err)
+	assert.EqualError(t, err, `bundle digest algorithm "md5" is unknown, supported: sha256, sha384, sha512`)
+}
@@ -14,19 +14,48 @@ type SBIAPIClientInterface interface {
 	SyncStateWithResponse(ctx context.Context, deviceClientId string, etag string, overrideOptions ...HTTPApiClientRequestEditorOptions) (desiredStates *sbi.UnsignedAppStateManifest, response *http.Response, err error)
 	FetchDeploymentYAML(ctx context.Context, deviceClientId, deploymentId, digest string, overrideOptions ...HTTPApiClientRequestEditorOptions) (yamlContent []byte, err error)
 	DownloadBundle(ctx context.Context, deviceClientId, digest string, overrideOptions ...HTTPApiClientRequestEditorOptions) (bundleData []byte, err error)
+	DownloadBundleToFile(ctx context.Context, deviceClientId, digest, destPath string, overrideOptions ...HTTPApiClientRequestEditorOptions) (bundlePath string, err error)
+	InspectDesiredState(ctx context.Context, deviceClientId string, overrideOptions ...HTTPApiClientRequestEditorOptions) (*DesiredStateSnapshot, error)
+	NegotiateAPIVersion(ctx context.Context, overrideOptions ...HTTPApiClientRequestEditorOptions) (APIVersionCheck, error)
 	ReportCapabilities(ctx context.Context, deviceId string, capabilities sbi.DeviceCapabilitiesManifest, overrideOptions ...HTTPApiClientRequestEditorOptions) error
-	ReportDeploymentStatus(ctx context.Context, deviceID, appID string, overallAppStatus sbi.DeploymentStatusManifestStatusState, components []sbi.ComponentStatus, err error) error
+	ReportDeploymentStatus(ctx context.Context, deviceID, appID string, overallAppStatus sbi.DeploymentStatusManifestStatusState, components []sbi.ComponentStatus, err error, overrideOptions ...HTTPApiClientRequestEditorOptions) error
 	// DeboardDeviceClient(ctx context.Context, clientId string, overrideOptions ...HTTPApiClientOptions) error
 }
 
+// NBIAPIClientInterface is the NBI client, the methods without a context are deprecated in favor of
+// their WithContext variants
 type NBIAPIClientInterface interface {
 	OnboardAppPkg(params AppPkgOnboardingReq) (*AppPkgOnboardingResp, error)
+	OnboardAppPkgWithContext(ctx context.Context, params AppPkgOnboardingReq) (*AppPkgOnboardingResp, error)
 	GetAppPkg(pkgId string) (*AppPkgSummary, error)
+	GetAppPkgWithContext(ctx context.Context, pkgId string) (*AppPkgSummary, error)
 	ListAppPkgs(params ListAppPkgsParams) (*ListAppPkgsResp, error)
+	ListAppPkgsWithContext(ctx context.Context, params ListAppPkgsParams) (*ListAppPkgsResp, error)
+	ListAllAppPkgs(ctx context.Context, params ListAppPkgsParams) ([]AppPkgSummary, error)
+	ListAppPkgVersions(appId string, opts ...ListAppPkgVersionsOption) ([]AppPkgVersion, error)
+	ListAppPkgVersionsWithContext(ctx context.Context, appId string, opts ...ListAppPkgVersionsOption) ([]AppPkgVersion, error)
+	GetLatestAppPkg(appId, constraint string, opts ...ListAppPkgVersionsOption) (*AppPkgVersion, error)
+	GetLatestAppPkgWithContext(ctx context.Context, appId, constraint string, opts ...ListAppPkgVersionsOption) (*AppPkgVersion, error)
+	PromotePackage(pkgId, channel string) (*AppPkgSummary, error)
+	PromotePackageWithContext(ctx context.Context, pkgId, channel string) (*AppPkgSummary, error)
 	DeleteAppPkg(pkgId string) error
-	CreateDeployment(params DeploymentReq) (*DeploymentResp, error)
+	DeleteAppPkgWithContext(ctx context.Context, pkgId string) error
+	ValidateDeployment(params DeploymentReq) (*DeploymentValidationResult, error)
+	ValidateDeploymentWithContext(ctx context.Context, params DeploymentReq) (*DeploymentValidationResult, error)
+	CreateDeployment(params DeploymentReq, opts ...CreateDeploymentOption) (*DeploymentResp, error)
+	CreateDeploymentWithContext(ctx context.Context, params DeploymentReq, opts ...CreateDeploymentOption) (*DeploymentResp, error)
+	CreateDeploymentForSelector(params DeploymentReq, selector map[string]string, opts ...SelectorDeploymentOption) (*SelectorDeploymentSummary, error)
+	CreateDeploymentForSelectorWithContext(ctx context.Context, params DeploymentReq, selector map[string]string, opts ...SelectorDeploymentOption) (*SelectorDeploymentSummary, error)
 	GetDeployment(deploymentId string) (*DeploymentResp, error)
-	ListDeployments(params DeploymentListParams)
+	GetDeploymentWithContext(ctx context.Context, deploymentId string) (*DeploymentResp, error)
+	ListDeployments(params DeploymentListParams) (*DeploymentListResp, error)
+	ListDeploymentsWithContext(ctx context.Context, params DeploymentListParams) (*DeploymentListResp, error)
+	ListAllDeployments(ctx context.Context, params DeploymentListParams) ([]DeploymentResp, error)
 	DeleteDeployment(deploymentId string) error
-	ListDevices() (*DeviceListResp, error)
+	DeleteDeploymentWithContext(ctx context.Context, deploymentId string) error
+	ListDevices(params ListDevicesParams) (*DeviceListResp, error)
+	ListDevicesWithContext(ctx context.Context, params ListDevicesParams) (*DeviceListResp, error)
+	ListAllDevices(ctx context.Context, params ListDevicesParams) ([]DeviceManifest, error)
+	CheckAPIVersion() (APIVersionCheck, error)
+	CheckAPIVersionWithContext(ctx context.Context) (APIVersionCheck, error)
 }
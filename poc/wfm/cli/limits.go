@@ -0,0 +1,132 @@
+package wfm
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+)
+
+// Headers a WFM may use to announce the limits it applies to the manifests it serves
+const (
+    MaxDeploymentsHeader   = "X-Margo-Max-Deployments"
+    MaxManifestBytesHeader = "X-Margo-Max-Manifest-Bytes"
+    MaxBundleBytesHeader   = "X-Margo-Max-Bundle-Bytes"
+)
+
+// ManifestLimits bounds what the client accepts from the WFM. Byte limits are enforced while the
+// response body is read, so an oversized response is rejected without buffering it.
+type ManifestLimits struct {
+    MaxDeployments      int64
+    MaxManifestBytes    int64
+    MaxDeploymentBytes  int64
+    MaxBundleBytes      int64
+    // InMemoryBundleBytes is the size up to which a bundle is downloaded into memory, larger
+    // bundles are streamed to disk with DownloadBundleToFile. It is no limit, the WFM is not told.
+    InMemoryBundleBytes int64
+}
+
+// DefaultManifestLimits are generous for any real device but keep a misbehaving WFM from exhausting memory
+func DefaultManifestLimits() ManifestLimits {
+    return ManifestLimits{
+        MaxDeployments:      1000,
+        MaxManifestBytes:    8 << 20,
+        MaxDeploymentBytes:  4 << 20,
+        MaxBundleBytes:      256 << 20,
+        InMemoryBundleBytes: 16 << 20,
+    }
+}
+
+// WithDefaults returns the limits with every unset (zero) limit replaced by its default
+func (l ManifestLimits) WithDefaults() ManifestLimits {
+    defaults := DefaultManifestLimits()
+    if l.MaxDeployments <= 0 {
+        l.MaxDeployments = defaults.MaxDeployments
+    }
+    if l.MaxManifestBytes <= 0 {
+        l.MaxManifestBytes = defaults.MaxManifestBytes
+    }
+    if l.MaxDeploymentBytes <= 0 {
+        l.MaxDeploymentBytes = defaults.MaxDeploymentBytes
+    }
+    if l.MaxBundleBytes <= 0 {
+        l.MaxBundleBytes = defaults.MaxBundleBytes
+    }
+    if l.InMemoryBundleBytes <= 0 {
+        l.InMemoryBundleBytes = defaults.InMemoryBundleBytes
+    }
+    return l
+}
+
+// AnnouncedManifestLimits reads the limits the server announced in the response headers, limits that
+// were not announced are left zero
+func AnnouncedManifestLimits(resp *http.Response) ManifestLimits {
+    var announced ManifestLimits
+    if resp == nil {
+        return announced
+    }
+    parse := func(header string) int64 {
+        value, err := strconv.ParseInt(resp.Header.Get(header), 10, 64)
+        if err != nil || value < 0 {
+            return 0
+        }
+        return value
+    }
+    announced.MaxDeployments = parse(MaxDeploymentsHeader)
+    announced.MaxManifestBytes = parse(MaxManifestBytesHeader)
+    announced.MaxBundleBytes = parse(MaxBundleBytesHeader)
+    return announced
+}
+
+// LimitExceededError reports which limit a manifest, deployment or bundle exceeded
+type LimitExceededError struct {
+    // Limit names the exceeded limit, e.g. maxManifestBytes
+    Limit string
+    Max   int64
+    // Actual is the offending value, -1 when the body was cut off before its size was known
+    Actual int64
+}
+
+func (e *LimitExceededError) Error() string {
+    if e.Actual < 0 {
+        return fmt.Sprintf("%s limit of %d exceeded", e.Limit, e.Max)
+    }
+    return fmt.Sprintf("%s limit of %d exceeded: %d", e.Limit, e.Max, e.Actual)
+}
+
+// limitResponseBody makes reading more than max bytes from the response fail with a
+// LimitExceededError. Responses announcing a larger Content-Length are rejected right away.
+func limitResponseBody(resp *http.Response, limit string, max int64) error {
+    if resp.ContentLength > max {
+        return &LimitExceededError{Limit: limit, Max: max, Actual: resp.ContentLength}
+    }
+    resp.Body = &limitedBody{
+        reader:    io.LimitReader(resp.Body, max+1),
+        closer:    resp.Body,
+        limit:     limit,
+        max:       max,
+        remaining: max,
+    }
+    return nil
+}
+
+type limitedBody struct {
+    reader    io.Reader
+    closer    io.Closer
+    limit     string
+    max       int64
+    remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+    n, err := b.reader.Read(p)
+    b.remaining -= int64(n)
+    if b.remaining < 0 {
+        return 0, &LimitExceededError{Limit: b.limit, Max: b.max, Actual: -1}
+    }
+    return n, err
+}
+
+func (b *limitedBody) Close() error {
+    return b.closer.Close()
+}
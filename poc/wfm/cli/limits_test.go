@@ -0,0 +1,72 @@
+package wfm
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitResponseBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		wantRejected  bool
+		wantReadErr   bool
+	}{
+		{name: "within the limit", body: "12345678", contentLength: -1},
+		{name: "exactly at the limit", body: "1234567890", contentLength: 10},
+		{name: "content length above the limit", body: "12345678901", contentLength: 11, wantRejected: true},
+		{name: "unknown length above the limit", body: strings.Repeat("x", 100), contentLength: -1, wantReadErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Body: io.NopCloser(strings.NewReader(tt.body)), ContentLength: tt.contentLength}
+
+			err := limitResponseBody(resp, "maxManifestBytes", 10)
+			var limitErr *LimitExceededError
+			if tt.wantRejected {
+				require.True(t, errors.As(err, &limitErr))
+				assert.Equal(t, "maxManifestBytes limit of 10 exceeded: 11", err.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			data, err := io.ReadAll(resp.Body)
+			if tt.wantReadErr {
+				require.True(t, errors.As(err, &limitErr))
+				assert.Equal(t, int64(-1), limitErr.Actual)
+				assert.LessOrEqual(t, len(data), 10)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(data))
+		})
+	}
+}
+
+func TestAnnouncedManifestLimits(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set(MaxDeploymentsHeader, "50")
+	resp.Header.Set(MaxManifestBytesHeader, "not-a-number")
+	resp.Header.Set(MaxBundleBytesHeader, "1048576")
+
+	assert.Equal(t, ManifestLimits{MaxDeployments: 50, MaxBundleBytes: 1048576}, AnnouncedManifestLimits(resp))
+	assert.Equal(t, ManifestLimits{}, AnnouncedManifestLimits(nil))
+}
+
+func TestManifestLimits_WithDefaults(t *testing.T) {
+	limits := ManifestLimits{MaxDeployments: 5}.WithDefaults()
+
+	assert.Equal(t, int64(5), limits.MaxDeployments)
+	assert.Equal(t, DefaultManifestLimits().MaxManifestBytes, limits.MaxManifestBytes)
+	assert.Equal(t, DefaultManifestLimits().MaxDeploymentBytes, limits.MaxDeploymentBytes)
+	assert.Equal(t, DefaultManifestLimits().MaxBundleBytes, limits.MaxBundleBytes)
+	assert.Equal(t, DefaultManifestLimits().InMemoryBundleBytes, limits.InMemoryBundleBytes)
+}
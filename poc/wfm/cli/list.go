@@ -0,0 +1,253 @@
+package wfm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	nonStdWfmNbi "github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+	httputils "github.com/margo/sandbox/shared-lib/http"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// listAllPageSize is the page size used when walking all items and the params leave it unset
+const listAllPageSize = 100
+
+// ListParams selects a page of a list and filters its items. The zero value lists the first page
+// with the page size of the server.
+//
+// The NBI list responses only tell whether more items exist, the continue token of a page is the
+// number of items that come before it.
+type ListParams struct {
+	// PageSize is the maximum number of items of a page, 0 leaves it to the server
+	PageSize int
+	// Continue is the token of the page to list, empty for the first page
+	Continue string
+	// LabelSelector only selects the items whose labels match, e.g. "tier=edge,env!=dev"
+	LabelSelector string
+	// State only selects the items in this state: the onboard state of a device or the status
+	// state of a package or deployment
+	State string
+	// NoCache requests the list unconditionally, without the ETag of the previous response, and
+	// leaves the cached response alone
+	NoCache bool
+}
+
+type (
+	ListAppPkgsParams    = ListParams
+	DeploymentListParams = ListParams
+	ListDevicesParams    = ListParams
+)
+
+// limit returns the limit query parameter of the page
+func (params ListParams) limit() *int {
+	if params.PageSize <= 0 {
+		return nil
+	}
+	limit := params.PageSize
+	return &limit
+}
+
+// continueToken returns the continue query parameter of the page
+func (params ListParams) continueToken() *string {
+	if params.Continue == "" {
+		return nil
+	}
+	token := params.Continue
+	return &token
+}
+
+// filters adds the label selector and state query parameters, the generated client does not
+// know them
+func (params ListParams) filters() nonStdWfmNbi.RequestEditorFn {
+	return func(ctx context.Context, req *http.Request) error {
+		query := req.URL.Query()
+		if params.LabelSelector != "" {
+			query.Set("labelSelector", params.LabelSelector)
+		}
+		if params.State != "" {
+			query.Set("state", params.State)
+		}
+		req.URL.RawQuery = query.Encode()
+		return nil
+	}
+}
+
+// cacheKey identifies the query of the params in the list cache
+func (params ListParams) cacheKey(operation string) string {
+	params.NoCache = false
+	return fmt.Sprintf("%s %+v", operation, params)
+}
+
+// conditional returns the request editors of the query, the filters and, with a cache, the ETag of
+// the cached response
+func (params ListParams) conditional(cache *httputils.ConditionalCache, key string) []nonStdWfmNbi.RequestEditorFn {
+	editors := []nonStdWfmNbi.RequestEditorFn{params.filters()}
+	if cache != nil {
+		editors = append(editors, cache.IfNoneMatch(key))
+	}
+	return editors
+}
+
+// listCacheFor returns the cache of the list requests, nil when the client or the call disables it
+func (cli *NbiApiClient) listCacheFor(params ListParams) *httputils.ConditionalCache {
+	if params.NoCache {
+		return nil
+	}
+	return cli.listCache
+}
+
+// listPage lists one page of items as the server returned them
+type listPage[T any] func(ctx context.Context, params ListParams) ([]T, *nonStdWfmNbi.PaginationMetadata, error)
+
+// listItem returns the metadata and state of an item, used to filter it
+type listItem[T any] func(item *T) (nonStdWfmNbi.Metadata, string)
+
+// listAll follows the pagination until the server reports there are no more items, or returns a
+// page without items. The filters are applied to the listed items as well, a server not knowing
+// them returns every item.
+func listAll[T any](ctx context.Context, operation string, params ListParams, list listPage[T], describe listItem[T]) ([]T, error) {
+	selector, err := labels.Parse(params.LabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector %q: %w", params.LabelSelector, err)
+	}
+	offset := 0
+	if params.Continue != "" {
+		if offset, err = strconv.Atoi(params.Continue); err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid continue token %q, it is the number of items to skip", params.Continue)
+		}
+	}
+	if params.PageSize <= 0 {
+		params.PageSize = listAllPageSize
+	}
+
+	var (
+		items []T
+		seen  = map[string]bool{}
+	)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("%s canceled: %w", operation, err)
+		}
+
+		page, metadata, err := list(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			return items, nil
+		}
+		for i := range page {
+			metadata, state := describe(&page[i])
+			if metadata.Id != nil {
+				// a server ignoring the continue token would otherwise be paged forever
+				if seen[*metadata.Id] {
+					return nil, fmt.Errorf("%s returned %s twice, the server does not support pagination", operation, *metadata.Id)
+				}
+				seen[*metadata.Id] = true
+			}
+			if matchesListFilters(metadata, state, selector, params.State) {
+				items = append(items, page[i])
+			}
+		}
+		offset += len(page)
+		if metadata == nil || metadata.Continue == nil || !*metadata.Continue {
+			return items, nil
+		}
+		params.Continue = strconv.Itoa(offset)
+	}
+}
+
+func matchesListFilters(metadata nonStdWfmNbi.Metadata, state string, selector labels.Selector, wantState string) bool {
+	if wantState != "" && !strings.EqualFold(state, wantState) {
+		return false
+	}
+	itemLabels := labels.Set{}
+	if metadata.Labels != nil {
+		itemLabels = *metadata.Labels
+	}
+	return selector.Matches(itemLabels)
+}
+
+func appPkgListItem(pkg *AppPkgSummary) (nonStdWfmNbi.Metadata, string) {
+	if pkg.Status == nil || pkg.Status.State == nil {
+		return pkg.Metadata, ""
+	}
+	return pkg.Metadata, string(*pkg.Status.State)
+}
+
+func deploymentListItem(deployment *DeploymentResp) (nonStdWfmNbi.Metadata, string) {
+	if deployment.Status == nil || deployment.Status.State == nil {
+		return deployment.Metadata, ""
+	}
+	return deployment.Metadata, string(*deployment.Status.State)
+}
+
+func deviceListItem(device *DeviceManifest) (nonStdWfmNbi.Metadata, string) {
+	return device.Metadata, string(device.State.Onboard)
+}
+
+// ListAllAppPkgs retrieves every application package matching the filters of the params,
+// following the pagination until the server reports there are no more items.
+//
+// Parameters:
+//   - ctx: Cancels the listing between and during pages
+//   - params: The page size and filters, a continue token starts the listing at that page
+//
+// Returns:
+//   - []AppPkgSummary: The packages of all pages
+//   - error: An error if a page cannot be listed or the listing was canceled
+func (cli *NbiApiClient) ListAllAppPkgs(ctx context.Context, params ListAppPkgsParams) ([]AppPkgSummary, error) {
+	return listAll(ctx, "list app packages", params,
+		func(ctx context.Context, params ListParams) ([]AppPkgSummary, *nonStdWfmNbi.PaginationMetadata, error) {
+			page, err := cli.ListAppPkgsWithContext(ctx, params)
+			if err != nil || page == nil {
+				return nil, nil, err
+			}
+			return page.Items, page.Metadata, nil
+		}, appPkgListItem)
+}
+
+// ListAllDeployments retrieves every application deployment matching the filters of the params,
+// following the pagination until the server reports there are no more items.
+//
+// Parameters:
+//   - ctx: Cancels the listing between and during pages
+//   - params: The page size and filters, a continue token starts the listing at that page
+//
+// Returns:
+//   - []DeploymentResp: The deployments of all pages
+//   - error: An error if a page cannot be listed or the listing was canceled
+func (cli *NbiApiClient) ListAllDeployments(ctx context.Context, params DeploymentListParams) ([]DeploymentResp, error) {
+	return listAll(ctx, "list app deployments", params,
+		func(ctx context.Context, params ListParams) ([]DeploymentResp, *nonStdWfmNbi.PaginationMetadata, error) {
+			page, err := cli.ListDeploymentsWithContext(ctx, params)
+			if err != nil || page == nil {
+				return nil, nil, err
+			}
+			return page.Items, &page.Metadata, nil
+		}, deploymentListItem)
+}
+
+// ListAllDevices retrieves every device matching the filters of the params, following the
+// pagination until the server reports there are no more items.
+//
+// Parameters:
+//   - ctx: Cancels the listing between and during pages
+//   - params: The page size and filters, a continue token starts the listing at that page
+//
+// Returns:
+//   - []DeviceManifest: The devices of all pages
+//   - error: An error if a page cannot be listed or the listing was canceled
+func (cli *NbiApiClient) ListAllDevices(ctx context.Context, params ListDevicesParams) ([]DeviceManifest, error) {
+	return listAll(ctx, "list devices", params,
+		func(ctx context.Context, params ListParams) ([]DeviceManifest, *nonStdWfmNbi.PaginationMetadata, error) {
+			page, err := cli.ListDevicesWithContext(ctx, params)
+			if err != nil || page == nil {
+				return nil, nil, err
+			}
+			return page.Items, page.Metadata, nil
+		}, deviceListItem)
+}
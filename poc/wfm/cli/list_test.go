@@ -0,0 +1,216 @@
+package wfm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	nonStdWfmNbi "github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+	"github.com/margo/sandbox/shared-lib/http/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// devicesStub serves the devices in pages of the requested limit and records the queries
+type devicesStub struct {
+	mu      sync.Mutex
+	devices []DeviceManifest
+	// noMetadata leaves the pagination metadata out of the responses
+	noMetadata bool
+	// onPage is called before a page is served
+	onPage  func(page int)
+	queries []url.Values
+}
+
+func (s *devicesStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.queries = append(s.queries, r.URL.Query())
+	page := len(s.queries)
+	s.mu.Unlock()
+	if s.onPage != nil {
+		s.onPage(page)
+	}
+
+	query := r.URL.Query()
+	offset, _ := strconv.Atoi(query.Get("continue"))
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil {
+		limit = len(s.devices)
+	}
+	end := min(offset+limit, len(s.devices))
+	resp := DeviceListResp{ApiVersion: "margo.org", Kind: "DeviceList", Items: s.devices[offset:end]}
+	if !s.noMetadata {
+		more := end < len(s.devices)
+		resp.Metadata = &nonStdWfmNbi.PaginationMetadata{Continue: &more}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newDevice(id, onboard string, labels map[string]string) DeviceManifest {
+	device := DeviceManifest{ApiVersion: "margo.org", Kind: "Device"}
+	device.Metadata.Id = &id
+	device.Metadata.Name = id
+	device.Metadata.Labels = &labels
+	device.State.Onboard = nonStdWfmNbi.DeviceOnboardStatus(onboard)
+	return device
+}
+
+func deviceIds(devices []DeviceManifest) []string {
+	ids := make([]string, 0, len(devices))
+	for _, device := range devices {
+		ids = append(ids, *device.Metadata.Id)
+	}
+	return ids
+}
+
+func newDevicesStubClient(t *testing.T, stub *devicesStub) *NbiApiClient {
+	t.Helper()
+	server := clienttest.NewTLSServer(t, stub)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseUint(serverURL.Port(), 10, 16)
+	require.NoError(t, err)
+
+	return NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil,
+		WithClientFactory(newTestClientFactory(t, server, "")))
+}
+
+func TestListAllDevices_FollowsPagination(t *testing.T) {
+	stub := &devicesStub{devices: []DeviceManifest{
+		newDevice("device-a", "ONBOARDED", map[string]string{"site": "plant-7"}),
+		newDevice("device-b", "ONBOARDED", map[string]string{"site": "plant-8"}),
+		newDevice("device-c", "PENDING", map[string]string{"site": "plant-7"}),
+		newDevice("device-d", "ONBOARDED", map[string]string{"site": "plant-7"}),
+		newDevice("device-e", "ONBOARDED", nil),
+	}}
+	cli := newDevicesStubClient(t, stub)
+
+	devices, err := cli.ListAllDevices(context.Background(), ListDevicesParams{PageSize: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"device-a", "device-b", "device-c", "device-d", "device-e"}, deviceIds(devices))
+	require.Len(t, stub.queries, 3)
+	assert.Equal(t, url.Values{"limit": {"2"}}, stub.queries[0])
+	assert.Equal(t, url.Values{"limit": {"2"}, "continue": {"2"}}, stub.queries[1])
+	assert.Equal(t, url.Values{"limit": {"2"}, "continue": {"4"}}, stub.queries[2])
+
+	// the filters are sent to the server, and applied to the pages this stub does not filter
+	stub.queries = nil
+	devices, err = cli.ListAllDevices(context.Background(), ListDevicesParams{
+		PageSize:      2,
+		LabelSelector: "site=plant-7",
+		State:         "onboarded",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"device-a", "device-d"}, deviceIds(devices))
+	assert.Equal(t, "site=plant-7", stub.queries[0].Get("labelSelector"))
+	assert.Equal(t, "onboarded", stub.queries[0].Get("state"))
+
+	// a single page starts at its continue token
+	page, err := cli.ListDevices(ListDevicesParams{PageSize: 2, Continue: "4"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"device-e"}, deviceIds(page.Items))
+	assert.False(t, *page.Metadata.Continue)
+
+	_, err = cli.ListAllDevices(context.Background(), ListDevicesParams{LabelSelector: "site in (plant-7"})
+	assert.ErrorContains(t, err, "invalid label selector")
+	_, err = cli.ListAllDevices(context.Background(), ListDevicesParams{Continue: "next"})
+	assert.ErrorContains(t, err, "invalid continue token")
+}
+
+func TestListAllDevices_EmptyContinueStops(t *testing.T) {
+	stub := &devicesStub{noMetadata: true, devices: []DeviceManifest{
+		newDevice("device-a", "ONBOARDED", nil),
+		newDevice("device-b", "ONBOARDED", nil),
+		newDevice("device-c", "ONBOARDED", nil),
+	}}
+	cli := newDevicesStubClient(t, stub)
+
+	// without a continue the first page is the last one, even if it is full
+	devices, err := cli.ListAllDevices(context.Background(), ListDevicesParams{PageSize: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"device-a", "device-b"}, deviceIds(devices))
+	assert.Len(t, stub.queries, 1)
+
+	// an empty page ends the listing as well
+	stub.queries = nil
+	stub.devices = nil
+	devices, err = cli.ListAllDevices(context.Background(), ListDevicesParams{})
+	require.NoError(t, err)
+	assert.Empty(t, devices)
+	assert.Len(t, stub.queries, 1)
+}
+
+func TestListAllDevices_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stub := &devicesStub{
+		devices: []DeviceManifest{
+			newDevice("device-a", "ONBOARDED", nil),
+			newDevice("device-b", "ONBOARDED", nil),
+			newDevice("device-c", "ONBOARDED", nil),
+		},
+		onPage: func(page int) {
+			if page == 2 {
+				cancel()
+			}
+		},
+	}
+	cli := newDevicesStubClient(t, stub)
+
+	_, err := cli.ListAllDevices(ctx, ListDevicesParams{PageSize: 1})
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, stub.queries, 2, "no page is requested after the cancellation")
+}
+
+func TestListAppPkgs_ConditionalRequests(t *testing.T) {
+	var mu sync.Mutex
+	var ifNoneMatch []string
+	server := clienttest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+		mu.Unlock()
+		etag := `"` + r.URL.Query().Get("state") + `-v1"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		name := "pkg-" + r.URL.Query().Get("state")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ListAppPkgsResp{ApiVersion: "margo.org", Kind: "ApplicationPackageList",
+			Items: []AppPkgSummary{{Metadata: nonStdWfmNbi.Metadata{Id: &name, Name: name}}}})
+	}))
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseUint(serverURL.Port(), 10, 16)
+	require.NoError(t, err)
+	cli := NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil, WithClientFactory(newTestClientFactory(t, server, "")))
+
+	for range 2 {
+		pkgs, err := cli.ListAppPkgs(ListAppPkgsParams{State: "onboarded"})
+		require.NoError(t, err)
+		require.Len(t, pkgs.Items, 1)
+		assert.Equal(t, "pkg-onboarded", pkgs.Items[0].Metadata.Name)
+	}
+	// the ETag is remembered per query
+	_, err = cli.ListAppPkgs(ListAppPkgsParams{State: "failed"})
+	require.NoError(t, err)
+	pkgs, err := cli.ListAppPkgs(ListAppPkgsParams{State: "onboarded", NoCache: true})
+	require.NoError(t, err)
+	assert.Equal(t, "pkg-onboarded", pkgs.Items[0].Metadata.Name)
+	assert.Equal(t, []string{"", `"onboarded-v1"`, "", ""}, ifNoneMatch)
+
+	ifNoneMatch = nil
+	cli = NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil, WithClientFactory(newTestClientFactory(t, server, "")), WithListCacheTTL(0))
+	for range 2 {
+		_, err := cli.ListAppPkgs(ListAppPkgsParams{State: "onboarded"})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"", ""}, ifNoneMatch, "a disabled cache sends no ETags")
+}
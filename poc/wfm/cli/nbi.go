@@ -12,9 +12,10 @@ import (
 	"io"
 	"log"
 	"time"
-	"crypto/tls"
     "net/http"
 	nonStdWfmNbi "github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+	httputils "github.com/margo/sandbox/shared-lib/http"
+	"github.com/margo/sandbox/shared-lib/redact"
 )
 
 const (
@@ -23,6 +24,10 @@ const (
 
 	// Default timeout for API requests
 	nbiDefaultTimeout = 30 * time.Second
+
+	// nbiListCacheTTL is how long the responses of the list requests are kept to answer a
+	// 304 Not Modified with
+	nbiListCacheTTL = 5 * time.Minute
 )
 
 // Type aliases for better API ergonomics, and can be used later on to change the structs if needed
@@ -30,14 +35,13 @@ type (
 	AppPkgOnboardingReq  = nonStdWfmNbi.ApplicationPackageManifestRequest
 	AppPkgOnboardingResp = nonStdWfmNbi.ApplicationPackageManifestResp
 	AppPkgSummary        = nonStdWfmNbi.ApplicationPackageManifestResp
-	ListAppPkgsParams    = nonStdWfmNbi.ListAppPackagesParams
 	ListAppPkgsResp      = nonStdWfmNbi.ApplicationPackageListResp
 
 	DeploymentReq        = nonStdWfmNbi.ApplicationDeploymentManifestRequest
 	DeploymentResp       = nonStdWfmNbi.ApplicationDeploymentManifestResp
 	DeploymentListResp   = nonStdWfmNbi.ApplicationDeploymentListResp
-	DeploymentListParams = nonStdWfmNbi.ListApplicationDeploymentsParams
 
+	DeviceManifest = nonStdWfmNbi.DeviceManifestResp
 	DeviceListResp = nonStdWfmNbi.DeviceListResp
 )
 
@@ -52,6 +56,10 @@ type NbiApiClient struct {
 	timeout       time.Duration
 	logger        *log.Logger
 	httpClient    *http.Client
+	// listCache makes the package and deployment list requests conditional, nil when disabled
+	listCache *httputils.ConditionalCache
+
+	validationSupport deploymentValidationSupport
 }
 
 // WFMCliOption defines functional options for configuring the client
@@ -67,17 +75,37 @@ func WithTimeout(timeout time.Duration) WFMCliOption {
 // WithInsecureTLS configures the client to skip TLS verification (development only)
 func WithInsecureTLS() WFMCliOption {
     return func(cli *NbiApiClient) {
-        cli.httpClient = &http.Client{
-            Transport: &http.Transport{
-                TLSClientConfig: &tls.Config{
-                    InsecureSkipVerify: true, // Only for development
-                },
-            },
-            Timeout: cli.timeout,
+        config := httputils.DefaultClientConfig()
+        config.InsecureSkipVerify = true // Only for development
+        factory, err := httputils.NewClientFactory(config)
+        if err != nil {
+            cli.logger.Printf("failed to configure insecure TLS: %v", err)
+            return
         }
+        cli.httpClient = factory.ClientWithTimeout(cli.timeout)
     }
 }
 
+// WithClientFactory builds the client's http client from the shared client factory, so that
+// timeouts, TLS trust, proxy and user agent follow the same configuration as every other client
+func WithClientFactory(factory *httputils.ClientFactory) WFMCliOption {
+    return func(cli *NbiApiClient) {
+        cli.httpClient = factory.ClientWithTimeout(cli.timeout)
+    }
+}
+
+
+// WithListCacheTTL keeps the package and deployment lists for ttl: they are requested with the
+// ETag of the last response and a 304 Not Modified is answered with that response. 0 disables
+// the cache, ListParams.NoCache disables it for a single call.
+func WithListCacheTTL(ttl time.Duration) WFMCliOption {
+	return func(cli *NbiApiClient) {
+		cli.listCache = nil
+		if ttl > 0 {
+			cli.listCache = httputils.NewConditionalCache(ttl)
+		}
+	}
+}
 
 // WithLogger sets a custom logger for the client
 func WithLogger(logger *log.Logger) WFMCliOption {
@@ -118,7 +146,8 @@ func NewNbiHTTPCli(host string, port uint16, nbiBasePath *string, opts ...WFMCli
 		nbiBaseURL:    fmt.Sprintf("https://%s:%d/%s", host, port, nbiBaseURLPath),
 		timeout:       nbiDefaultTimeout,
 		logger:        log.Default(),
-		httpClient:    &http.Client{Timeout: nbiDefaultTimeout},
+		httpClient:    httputils.DefaultClientFactory().ClientWithTimeout(nbiDefaultTimeout),
+		listCache:     httputils.NewConditionalCache(nbiListCacheTTL),
 	}
 
     // Apply options
@@ -141,14 +170,19 @@ func (cli *NbiApiClient) createNonStdNbiClient() (*nonStdWfmNbi.Client, error) {
     if cli.httpClient != nil {
         client.Client = cli.httpClient
     }
+    client.RequestEditors = append(client.RequestEditors, withAPIVersions(NBIAPIVersion))
     
     return client, nil
 }
 
 
-// createContext creates a context with timeout
-func (cli *NbiApiClient) createContext() (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), cli.timeout)
+// requestContext bounds a request by the caller context, and by the client timeout when the caller
+// context has no deadline of its own
+func (cli *NbiApiClient) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, cli.timeout)
 }
 
 // handleErrorResponse processes error responses consistently
@@ -160,16 +194,26 @@ func (cli *NbiApiClient) handleErrorResponse(errBody []byte, statusCode int, ope
 		return fmt.Errorf("%s failed: error (status %d) (could not read response body, reason: %s)", operation, statusCode, err.Error())
 	}
 	// cli.logger.Printf("%s request failed with error %d: %s", operation, statusCode, string(body))
-	return fmt.Errorf("%s failed: error (status %d): %s", operation, statusCode, string(body))
+	// the error ends up in logs, the server may echo credentials from the request
+	return fmt.Errorf("%s failed: error (status %d): %s", operation, statusCode, string(redact.Default().Body(body, "")))
+}
+
+// OnboardAppPkg is OnboardAppPkgWithContext without a caller context, the client timeout bounds its
+// requests.
+//
+// Deprecated: use OnboardAppPkgWithContext.
+func (cli *NbiApiClient) OnboardAppPkg(params AppPkgOnboardingReq) (*AppPkgOnboardingResp, error) {
+	return cli.OnboardAppPkgWithContext(context.Background(), params)
 }
 
-// OnboardAppPkg onboards a new application package.
+// OnboardAppPkgWithContext onboards a new application package.
 //
 // This method validates the request parameters and submits an onboarding request
 // to the Northbound service. The service will process the package from the specified
 // source and make it available for deployment.
 //
 // Parameters:
+//   - ctx: Cancels the requests, each one is bounded by the client timeout when ctx has no deadline
 //   - params: The onboarding request parameters including name, source type, and source details
 //
 // Returns:
@@ -183,8 +227,8 @@ func (cli *NbiApiClient) handleErrorResponse(errBody []byte, statusCode int, ope
 //	    SourceType: "git",
 //	    Source: map[string]interface{}{"url": "https://github.com/user/app.git"},
 //	}
-//	resp, err := cli.OnboardAppPkg(req)
-func (cli *NbiApiClient) OnboardAppPkg(params AppPkgOnboardingReq) (*AppPkgOnboardingResp, error) {
+//	resp, err := cli.OnboardAppPkgWithContext(ctx, req)
+func (cli *NbiApiClient) OnboardAppPkgWithContext(ctx context.Context, params AppPkgOnboardingReq) (*AppPkgOnboardingResp, error) {
 	// Validate required parameters
 	if params.Metadata.Name == "" {
 		return nil, fmt.Errorf("package name cannot be empty")
@@ -199,7 +243,7 @@ func (cli *NbiApiClient) OnboardAppPkg(params AppPkgOnboardingReq) (*AppPkgOnboa
 		return nil, err
 	}
 
-	ctx, cancel := cli.createContext()
+	ctx, cancel := cli.requestContext(ctx)
 	defer cancel()
 
 	// Make API request
@@ -228,15 +272,24 @@ func (cli *NbiApiClient) OnboardAppPkg(params AppPkgOnboardingReq) (*AppPkgOnboa
 	}
 }
 
-// GetAppPkg retrieves details for a specific application package.
+// GetAppPkg is GetAppPkgWithContext without a caller context, the client timeout bounds its
+// requests.
+//
+// Deprecated: use GetAppPkgWithContext.
+func (cli *NbiApiClient) GetAppPkg(pkgId string) (*AppPkgSummary, error) {
+	return cli.GetAppPkgWithContext(context.Background(), pkgId)
+}
+
+// GetAppPkgWithContext retrieves details for a specific application package.
 //
 // Parameters:
+//   - ctx: Cancels the requests, each one is bounded by the client timeout when ctx has no deadline
 //   - pkgId: The unique identifier of the package to retrieve
 //
 // Returns:
 //   - *AppPkgSummary: The package summary with details
 //   - error: An error if the package is not found or cannot be retrieved
-func (cli *NbiApiClient) GetAppPkg(pkgId string) (*AppPkgSummary, error) {
+func (cli *NbiApiClient) GetAppPkgWithContext(ctx context.Context, pkgId string) (*AppPkgSummary, error) {
 	if pkgId == "" {
 		return nil, fmt.Errorf("package ID cannot be empty")
 	}
@@ -246,7 +299,7 @@ func (cli *NbiApiClient) GetAppPkg(pkgId string) (*AppPkgSummary, error) {
 		return nil, err
 	}
 
-	ctx, cancel := cli.createContext()
+	ctx, cancel := cli.requestContext(ctx)
 	defer cancel()
 
 	resp, err := client.GetAppPackage(ctx, pkgId)
@@ -269,28 +322,47 @@ func (cli *NbiApiClient) GetAppPkg(pkgId string) (*AppPkgSummary, error) {
 	}
 }
 
-// ListAppPkgs retrieves a list of application packages.
+// ListAppPkgs is ListAppPkgsWithContext without a caller context, the client timeout bounds its
+// requests.
+//
+// Deprecated: use ListAppPkgsWithContext.
+func (cli *NbiApiClient) ListAppPkgs(params ListAppPkgsParams) (*ListAppPkgsResp, error) {
+	return cli.ListAppPkgsWithContext(context.Background(), params)
+}
+
+// ListAppPkgsWithContext retrieves a page of application packages, see ListAllAppPkgs to list all
+// pages.
 //
 // Parameters:
+//   - ctx: Cancels the requests, each one is bounded by the client timeout when ctx has no deadline
 //   - params: Optional filtering and pagination parameters
 //
 // Returns:
 //   - *ListAppPkgsResp: The list response containing packages and metadata
 //   - error: An error if the request cannot be processed
-func (cli *NbiApiClient) ListAppPkgs(params ListAppPkgsParams) (*ListAppPkgsResp, error) {
+func (cli *NbiApiClient) ListAppPkgsWithContext(ctx context.Context, params ListAppPkgsParams) (*ListAppPkgsResp, error) {
 	client, err := cli.createNonStdNbiClient()
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := cli.createContext()
+	ctx, cancel := cli.requestContext(ctx)
 	defer cancel()
 
-	resp, err := client.ListAppPackages(ctx, &params)
+	cache, key := cli.listCacheFor(params), params.cacheKey("list app packages")
+	resp, err := client.ListAppPackages(ctx, &nonStdWfmNbi.ListAppPackagesParams{
+		Limit:    params.limit(),
+		Continue: params.continueToken(),
+	}, params.conditional(cache, key)...)
 	if err != nil {
 		return nil, fmt.Errorf("list app packages request failed: %w", err)
 	}
 	defer resp.Body.Close()
+	if cache != nil {
+		if resp, err = cache.Resolve(key, resp); err != nil {
+			return nil, fmt.Errorf("list app packages failed: %w", err)
+		}
+	}
 
 	pkgResp, err := nonStdWfmNbi.ParseListAppPackagesResponse(resp)
 	if err != nil {
@@ -310,14 +382,23 @@ func (cli *NbiApiClient) ListAppPkgs(params ListAppPkgsParams) (*ListAppPkgsResp
 	}
 }
 
-// DeleteAppPkg deletes a specific application package.
+// DeleteAppPkg is DeleteAppPkgWithContext without a caller context, the client timeout bounds its
+// requests.
+//
+// Deprecated: use DeleteAppPkgWithContext.
+func (cli *NbiApiClient) DeleteAppPkg(pkgId string) error {
+	return cli.DeleteAppPkgWithContext(context.Background(), pkgId)
+}
+
+// DeleteAppPkgWithContext deletes a specific application package.
 //
 // Parameters:
+//   - ctx: Cancels the requests, each one is bounded by the client timeout when ctx has no deadline
 //   - pkgId: The unique identifier of the package to delete
 //
 // Returns:
 //   - error: An error if the package cannot be deleted
-func (cli *NbiApiClient) DeleteAppPkg(pkgId string) error {
+func (cli *NbiApiClient) DeleteAppPkgWithContext(ctx context.Context, pkgId string) error {
 	if pkgId == "" {
 		return fmt.Errorf("package ID cannot be empty")
 	}
@@ -327,7 +408,7 @@ func (cli *NbiApiClient) DeleteAppPkg(pkgId string) error {
 		return err
 	}
 
-	ctx, cancel := cli.createContext()
+	ctx, cancel := cli.requestContext(ctx)
 	defer cancel()
 
 	resp, err := client.DeleteAppPackage(ctx, pkgId, &nonStdWfmNbi.DeleteAppPackageParams{})
@@ -350,15 +431,60 @@ func (cli *NbiApiClient) DeleteAppPkg(pkgId string) error {
 	}
 }
 
-func (cli *NbiApiClient) CreateDeployment(params DeploymentReq) (*DeploymentResp, error) {
-	// Validate required parameters
+// CreateDeployment is CreateDeploymentWithContext without a caller context, the client timeout
+// bounds its requests.
+//
+// Deprecated: use CreateDeploymentWithContext.
+func (cli *NbiApiClient) CreateDeployment(params DeploymentReq, opts ...CreateDeploymentOption) (*DeploymentResp, error) {
+	return cli.CreateDeploymentWithContext(context.Background(), params, opts...)
+}
+
+// CreateDeploymentWithContext creates a new application deployment.
+//
+// Parameters:
+//   - ctx: Cancels the requests, each one is bounded by the client timeout when ctx has no deadline
+//   - params: The deployment request
+//   - opts: Optional settings, e.g. WithExpectedPackageDigest to pin the package content or
+//     WithAppPkgResolution to deploy the newest version of an application
+//
+// Returns:
+//   - *DeploymentResp: The deployment as accepted by the server
+//   - error: *ErrPackageDrifted if the package no longer matches the pinned digest, or an error if
+//     the request cannot be processed
+func (cli *NbiApiClient) CreateDeploymentWithContext(ctx context.Context, params DeploymentReq, opts ...CreateDeploymentOption) (*DeploymentResp, error) {
+	options := &createDeploymentOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	// Resolve the package from the application version before the pin is checked against it
+	if options.resolveAppId != "" {
+		var channelOpts []ListAppPkgVersionsOption
+		if options.resolveChannel != "" {
+			channelOpts = append(channelOpts, InChannel(options.resolveChannel))
+		}
+		version, err := cli.GetLatestAppPkgWithContext(ctx, options.resolveAppId, options.resolveConstraint, channelOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve package of app %s: %w", options.resolveAppId, err)
+		}
+		params.Spec.AppPackageRef.Id = version.PkgId()
+	}
+
+	// Verify the pinned package digest before submitting and forward the pin to the server
+	if options.expectedPackageDigest != "" {
+		if _, err := cli.VerifyPackageDigestWithContext(ctx, params.Spec.AppPackageRef.Id, options.expectedPackageDigest); err != nil {
+			return nil, err
+		}
+		params.Spec.AppPackageRef.Digest = &options.expectedPackageDigest
+	}
+
 	// Create client and context
 	client, err := cli.createNonStdNbiClient()
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := cli.createContext()
+	ctx, cancel := cli.requestContext(ctx)
 	defer cancel()
 
 	// Make API request
@@ -382,13 +508,27 @@ func (cli *NbiApiClient) CreateDeployment(params DeploymentReq) (*DeploymentResp
 			return pkgResp.JSON202, nil
 		}
 		return nil, nil
+	case 412:
+		// the server rejected the pin because the package changed since the check above
+		if params.Spec.AppPackageRef.Digest != nil {
+			return nil, &ErrPackageDrifted{PackageId: params.Spec.AppPackageRef.Id, Expected: *params.Spec.AppPackageRef.Digest}
+		}
+		return nil, cli.handleErrorResponse(pkgResp.Body, pkgResp.StatusCode(), "create app deployment")
 	default:
 		return nil, cli.handleErrorResponse(pkgResp.Body, pkgResp.StatusCode(), "create app deployment")
 	}
 }
 
-// GetDeployment retrieves details for a specific application deployment.
+// GetDeployment is GetDeploymentWithContext without a caller context, the client timeout bounds its
+// requests.
+//
+// Deprecated: use GetDeploymentWithContext.
 func (cli *NbiApiClient) GetDeployment(deploymentId string) (*DeploymentResp, error) {
+	return cli.GetDeploymentWithContext(context.Background(), deploymentId)
+}
+
+// GetDeploymentWithContext retrieves details for a specific application deployment.
+func (cli *NbiApiClient) GetDeploymentWithContext(ctx context.Context, deploymentId string) (*DeploymentResp, error) {
 	if deploymentId == "" {
 		return nil, fmt.Errorf("deployment ID cannot be empty")
 	}
@@ -398,7 +538,7 @@ func (cli *NbiApiClient) GetDeployment(deploymentId string) (*DeploymentResp, er
 		return nil, err
 	}
 
-	ctx, cancel := cli.createContext()
+	ctx, cancel := cli.requestContext(ctx)
 	defer cancel()
 
 	resp, err := client.GetApplicationDeployment(ctx, deploymentId)
@@ -421,21 +561,39 @@ func (cli *NbiApiClient) GetDeployment(deploymentId string) (*DeploymentResp, er
 	}
 }
 
-// ListDeployments retrieves a list of application packages.
+// ListDeployments is ListDeploymentsWithContext without a caller context, the client timeout bounds
+// its requests.
+//
+// Deprecated: use ListDeploymentsWithContext.
 func (cli *NbiApiClient) ListDeployments(params DeploymentListParams) (*DeploymentListResp, error) {
+	return cli.ListDeploymentsWithContext(context.Background(), params)
+}
+
+// ListDeploymentsWithContext retrieves a page of application deployments, see ListAllDeployments to
+// list all pages.
+func (cli *NbiApiClient) ListDeploymentsWithContext(ctx context.Context, params DeploymentListParams) (*DeploymentListResp, error) {
 	client, err := cli.createNonStdNbiClient()
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := cli.createContext()
+	ctx, cancel := cli.requestContext(ctx)
 	defer cancel()
 
-	resp, err := client.ListApplicationDeployments(ctx, &params)
+	cache, key := cli.listCacheFor(params), params.cacheKey("list app deployments")
+	resp, err := client.ListApplicationDeployments(ctx, &nonStdWfmNbi.ListApplicationDeploymentsParams{
+		Limit:    params.limit(),
+		Continue: params.continueToken(),
+	}, params.conditional(cache, key)...)
 	if err != nil {
 		return nil, fmt.Errorf("list app packages request failed: %w", err)
 	}
 	defer resp.Body.Close()
+	if cache != nil {
+		if resp, err = cache.Resolve(key, resp); err != nil {
+			return nil, fmt.Errorf("list app deployments failed: %w", err)
+		}
+	}
 
 	deploymentListResp, err := nonStdWfmNbi.ParseListApplicationDeploymentsResponse(resp)
 	if err != nil {
@@ -455,7 +613,16 @@ func (cli *NbiApiClient) ListDeployments(params DeploymentListParams) (*Deployme
 	}
 }
 
+// DeleteDeployment is DeleteDeploymentWithContext without a caller context, the client timeout
+// bounds its requests.
+//
+// Deprecated: use DeleteDeploymentWithContext.
 func (cli *NbiApiClient) DeleteDeployment(deploymentId string) error {
+	return cli.DeleteDeploymentWithContext(context.Background(), deploymentId)
+}
+
+// DeleteDeploymentWithContext deletes a specific application deployment.
+func (cli *NbiApiClient) DeleteDeploymentWithContext(ctx context.Context, deploymentId string) error {
 	if deploymentId == "" {
 		return fmt.Errorf("deployment ID cannot be empty")
 	}
@@ -465,7 +632,7 @@ func (cli *NbiApiClient) DeleteDeployment(deploymentId string) error {
 		return err
 	}
 
-	ctx, cancel := cli.createContext()
+	ctx, cancel := cli.requestContext(ctx)
 	defer cancel()
 
 	resp, err := client.DeleteApplicationDeployment(ctx, deploymentId)
@@ -488,16 +655,28 @@ func (cli *NbiApiClient) DeleteDeployment(deploymentId string) error {
 	}
 }
 
-func (cli *NbiApiClient) ListDevices() (*DeviceListResp, error) {
+// ListDevices is ListDevicesWithContext without a caller context, the client timeout bounds its
+// requests.
+//
+// Deprecated: use ListDevicesWithContext.
+func (cli *NbiApiClient) ListDevices(params ListDevicesParams) (*DeviceListResp, error) {
+	return cli.ListDevicesWithContext(context.Background(), params)
+}
+
+// ListDevicesWithContext retrieves a page of devices, see ListAllDevices to list all pages.
+func (cli *NbiApiClient) ListDevicesWithContext(ctx context.Context, params ListDevicesParams) (*DeviceListResp, error) {
 	client, err := cli.createNonStdNbiClient()
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := cli.createContext()
+	ctx, cancel := cli.requestContext(ctx)
 	defer cancel()
 
-	resp, err := client.ListDevices(ctx, nil)
+	resp, err := client.ListDevices(ctx, &nonStdWfmNbi.ListDevicesParams{
+		Limit:    params.limit(),
+		Continue: params.continueToken(),
+	}, params.filters())
 	if err != nil {
 		return nil, fmt.Errorf("list devices request failed: %w", err)
 	}
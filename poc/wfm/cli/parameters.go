@@ -0,0 +1,301 @@
+package wfm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	nonStdWfmNbi "github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+	"gopkg.in/yaml.v3"
+)
+
+// ParameterError is a value of a deployment parameter that does not pass the schema of its setting
+type ParameterError struct {
+	// Section and Setting are the names of the configuration setting that collects the parameter,
+	// empty for answers to parameters no setting collects
+	Section   string `json:"section,omitempty"`
+	Setting   string `json:"setting,omitempty"`
+	Parameter string `json:"parameter"`
+	Message   string `json:"message"`
+}
+
+func (e ParameterError) Error() string {
+	if e.Setting == "" {
+		return fmt.Sprintf("parameter %s %s", e.Parameter, e.Message)
+	}
+	return fmt.Sprintf("%s/%s (parameter %s) %s", e.Section, e.Setting, e.Parameter, e.Message)
+}
+
+// ParameterErrors are all the values that do not pass their schema
+type ParameterErrors []ParameterError
+
+func (e ParameterErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// parameterSetting is a configuration setting with the section it is in and its schema
+type parameterSetting struct {
+	section string
+	setting nonStdWfmNbi.ConfigurationSetting
+	schema  *nonStdWfmNbi.ConfigurationSchema
+}
+
+// BuildDeploymentParameters returns the parameters of a deployment of the described application:
+// every parameter of the description with its targets, set to the answer given for it or else to
+// its declared default. The values of the parameters collected by the configuration settings are
+// checked against the schema of the setting and converted to its data type. All the failures are
+// returned at once as ParameterErrors. The result is the Spec.Parameters of a DeploymentReq.
+func BuildDeploymentParameters(description nonStdWfmNbi.AppDescription, answers map[string]interface{}) (nonStdWfmNbi.DeploymentParameters, error) {
+	declared := nonStdWfmNbi.AppDescriptionParametersMap{}
+	if description.Parameters != nil {
+		declared = *description.Parameters
+	}
+	settings := parameterSettings(description.Configuration)
+
+	var errs ParameterErrors
+	for _, name := range slices.Sorted(maps.Keys(answers)) {
+		if _, ok := declared[name]; !ok {
+			errs = append(errs, ParameterError{Parameter: name, Message: "is not a parameter of the application"})
+		}
+	}
+
+	parameters := nonStdWfmNbi.DeploymentParameters{}
+	for _, name := range slices.Sorted(maps.Keys(declared)) {
+		parameter := declared[name]
+		value, answered := answers[name]
+		if !answered {
+			value = parameter.Value
+		}
+		if setting, ok := settings[name]; ok {
+			checked, err := checkParameterValue(setting.schema, value)
+			if err != nil {
+				errs = append(errs, ParameterError{Section: setting.section, Setting: setting.setting.Name, Parameter: name, Message: err.Error()})
+				continue
+			}
+			value = checked
+		}
+
+		targets := make([]nonStdWfmNbi.DeploymentParameterTarget, 0, len(parameter.Targets))
+		for _, target := range parameter.Targets {
+			targets = append(targets, nonStdWfmNbi.DeploymentParameterTarget{
+				Components: slices.Clone(target.Components),
+				Pointer:    target.Pointer,
+			})
+		}
+		parameters[name] = nonStdWfmNbi.DeploymentParameterValue{Targets: targets, Value: value}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return parameters, nil
+}
+
+// parameterSettings returns the settings of the configuration by the parameter they collect
+func parameterSettings(configuration *nonStdWfmNbi.AppConfigurationSchema) map[string]parameterSetting {
+	settings := map[string]parameterSetting{}
+	if configuration == nil || configuration.Sections == nil {
+		return settings
+	}
+	schemas := map[string]*nonStdWfmNbi.ConfigurationSchema{}
+	if configuration.Schema != nil {
+		for i := range *configuration.Schema {
+			schema := &(*configuration.Schema)[i]
+			schemas[schema.Name] = schema
+		}
+	}
+	for _, section := range *configuration.Sections {
+		for _, setting := range section.Settings {
+			settings[setting.Parameter] = parameterSetting{section: section.Name, setting: setting, schema: schemas[setting.Schema]}
+		}
+	}
+	return settings
+}
+
+// checkParameterValue checks a value against the schema and returns it converted to the data type
+// of the schema, answers read from text arrive as strings
+func checkParameterValue(schema *nonStdWfmNbi.ConfigurationSchema, value interface{}) (interface{}, error) {
+	if schema == nil {
+		return value, nil
+	}
+	allowEmpty := schema.AllowEmpty != nil && *schema.AllowEmpty
+	if value == nil || value == "" {
+		if allowEmpty {
+			return value, nil
+		}
+		return nil, fmt.Errorf("is required")
+	}
+
+	switch schema.DataType {
+	case nonStdWfmNbi.String:
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a string, got %v", value)
+		}
+		length := utf8.RuneCountInString(text)
+		if schema.MinLength != nil && length < *schema.MinLength {
+			return nil, fmt.Errorf("must be at least %d characters long", *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			return nil, fmt.Errorf("must be at most %d characters long", *schema.MaxLength)
+		}
+		if schema.RegexMatch != nil {
+			pattern, err := regexp.Compile(`^(?:` + *schema.RegexMatch + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("has an invalid regexMatch in schema %s: %v", schema.Name, err)
+			}
+			if !pattern.MatchString(text) {
+				return nil, fmt.Errorf("%q does not match %s", text, *schema.RegexMatch)
+			}
+		}
+		return text, nil
+
+	case nonStdWfmNbi.Integer:
+		number, err := parameterNumber(value)
+		if err != nil || number != math.Trunc(number) {
+			return nil, fmt.Errorf("must be an integer, got %v", value)
+		}
+		if err := checkParameterRange(schema, number); err != nil {
+			return nil, err
+		}
+		return int64(number), nil
+
+	case nonStdWfmNbi.Double:
+		number, err := parameterNumber(value)
+		if err != nil {
+			return nil, fmt.Errorf("must be a number, got %v", value)
+		}
+		if err := checkParameterRange(schema, number); err != nil {
+			return nil, err
+		}
+		if schema.MaxPrecision != nil {
+			if _, decimals, found := strings.Cut(strconv.FormatFloat(number, 'f', -1, 64), "."); found && len(decimals) > *schema.MaxPrecision {
+				return nil, fmt.Errorf("must have at most %d decimals", *schema.MaxPrecision)
+			}
+		}
+		return number, nil
+
+	case nonStdWfmNbi.Boolean:
+		switch typed := value.(type) {
+		case bool:
+			return typed, nil
+		case string:
+			if parsed, err := strconv.ParseBool(typed); err == nil {
+				return parsed, nil
+			}
+		}
+		return nil, fmt.Errorf("must be true or false, got %v", value)
+
+	default:
+		return nil, fmt.Errorf("has the unknown data type %q in schema %s", schema.DataType, schema.Name)
+	}
+}
+
+// parameterNumber returns the number of a numeric value or of a string holding one
+func parameterNumber(value interface{}) (float64, error) {
+	switch typed := value.(type) {
+	case int:
+		return float64(typed), nil
+	case int64:
+		return float64(typed), nil
+	case float32:
+		return float64(typed), nil
+	case float64:
+		return typed, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(typed), 64)
+	default:
+		return 0, fmt.Errorf("not a number: %v", value)
+	}
+}
+
+func checkParameterRange(schema *nonStdWfmNbi.ConfigurationSchema, number float64) error {
+	if schema.MinValue != nil && number < float64(*schema.MinValue) {
+		return fmt.Errorf("must be at least %v", *schema.MinValue)
+	}
+	if schema.MaxValue != nil && number > float64(*schema.MaxValue) {
+		return fmt.Errorf("must be at most %v", *schema.MaxValue)
+	}
+	return nil
+}
+
+// LoadParameterAnswers reads the answers to the deployment parameters from a YAML file mapping
+// parameter names to values, the non-interactive counterpart of PromptParameterAnswers for e.g.
+// CI pipelines
+func LoadParameterAnswers(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the parameters file: %w", err)
+	}
+	answers := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &answers); err != nil {
+		return nil, fmt.Errorf("failed to parse the parameters file %s: %w", path, err)
+	}
+	return answers, nil
+}
+
+// PromptParameterAnswers asks for the value of every configuration setting of the description,
+// section by section. An empty answer keeps the default of the parameter, an answer that does not
+// pass the schema of the setting is asked for again. The answers are returned by parameter name
+// for BuildDeploymentParameters.
+func PromptParameterAnswers(description nonStdWfmNbi.AppDescription, in io.Reader, out io.Writer) (map[string]interface{}, error) {
+	answers := map[string]interface{}{}
+	configuration := description.Configuration
+	if configuration == nil || configuration.Sections == nil {
+		return answers, nil
+	}
+	declared := nonStdWfmNbi.AppDescriptionParametersMap{}
+	if description.Parameters != nil {
+		declared = *description.Parameters
+	}
+	settings := parameterSettings(configuration)
+
+	reader := bufio.NewReader(in)
+	for _, section := range *configuration.Sections {
+		fmt.Fprintf(out, "%s\n", section.Name)
+		for _, setting := range section.Settings {
+			defaultValue := declared[setting.Parameter].Value
+			for {
+				prompt := "  " + setting.Name
+				if setting.Description != nil && *setting.Description != "" {
+					prompt += " (" + *setting.Description + ")"
+				}
+				if defaultValue != nil {
+					prompt += fmt.Sprintf(" [%v]", defaultValue)
+				}
+				fmt.Fprint(out, prompt+": ")
+
+				line, err := reader.ReadString('\n')
+				if err != nil && (err != io.EOF || line == "") {
+					return nil, fmt.Errorf("failed to read the value of %s: %w", setting.Name, err)
+				}
+				line = strings.TrimSpace(line)
+				var value interface{} = line
+				if line == "" {
+					value = defaultValue
+				}
+				if _, err := checkParameterValue(settings[setting.Parameter].schema, value); err != nil {
+					fmt.Fprintf(out, "  %s %v\n", setting.Name, err)
+					continue
+				}
+				if line != "" {
+					answers[setting.Parameter] = line
+				}
+				break
+			}
+		}
+	}
+	return answers, nil
+}
@@ -0,0 +1,171 @@
+package wfm
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	nonStdWfmNbi "github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const parametersDescriptionYAML = `
+parameters:
+  hostname:
+    value: web
+    targets:
+      - pointer: env.HOSTNAME
+        components: [web]
+  port:
+    value: 8080
+    targets:
+      - pointer: env.PORT
+        components: [web]
+  ratio:
+    targets:
+      - pointer: env.RATIO
+        components: [web]
+  debug:
+    value: false
+    targets:
+      - pointer: env.DEBUG
+        components: [web, worker]
+configuration:
+  sections:
+    - name: Network
+      settings:
+        - name: Hostname
+          parameter: hostname
+          schema: host
+        - name: Port
+          parameter: port
+          schema: port
+          description: Port the web service listens on
+    - name: Tuning
+      settings:
+        - name: Ratio
+          parameter: ratio
+          schema: ratio
+        - name: Debug
+          parameter: debug
+          schema: flag
+  schema:
+    - name: host
+      dataType: string
+      minLength: 3
+      maxLength: 16
+      regexMatch: "[a-z][a-z0-9-]*"
+    - name: port
+      dataType: integer
+      minValue: 1
+      maxValue: 65535
+    - name: ratio
+      dataType: double
+      maxPrecision: 1
+      allowEmpty: true
+    - name: flag
+      dataType: boolean
+`
+
+func parametersDescription(t *testing.T) nonStdWfmNbi.AppDescription {
+	t.Helper()
+	var description nonStdWfmNbi.AppDescription
+	require.NoError(t, yaml.Unmarshal([]byte(parametersDescriptionYAML), &description))
+	return description
+}
+
+func TestBuildDeploymentParameters(t *testing.T) {
+	parameters, err := BuildDeploymentParameters(parametersDescription(t), map[string]interface{}{
+		"port":  "9090",
+		"ratio": 0.5,
+		"debug": "true",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "web", parameters["hostname"].Value, "unanswered parameters keep their default")
+	assert.Equal(t, int64(9090), parameters["port"].Value)
+	assert.Equal(t, 0.5, parameters["ratio"].Value)
+	assert.Equal(t, true, parameters["debug"].Value)
+	assert.Equal(t, []nonStdWfmNbi.DeploymentParameterTarget{{Components: []string{"web", "worker"}, Pointer: "env.DEBUG"}}, parameters["debug"].Targets)
+
+	// the parameters are the spec parameters of a deployment request
+	request := DeploymentReq{}
+	request.Spec.Parameters = &parameters
+	data, err := json.Marshal(request)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"port":{"targets":[{"components":["web"],"pointer":"env.PORT"}],"value":9090}`)
+}
+
+func TestBuildDeploymentParameters_Invalid(t *testing.T) {
+	_, err := BuildDeploymentParameters(parametersDescription(t), map[string]interface{}{
+		"hostname": "Web Server",
+		"port":     70000,
+		"ratio":    0.25,
+		"debug":    "maybe",
+		"replicas": 3,
+	})
+	var errs ParameterErrors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 5)
+
+	assert.Equal(t, ParameterError{Parameter: "replicas", Message: "is not a parameter of the application"}, errs[0])
+	assert.Equal(t, "Tuning", errs[1].Section)
+	assert.Equal(t, "Debug", errs[1].Setting)
+	assert.Contains(t, errs[1].Message, "must be true or false")
+	assert.Contains(t, errs[2].Message, "does not match")
+	assert.Equal(t, "Network/Port (parameter port) must be at most 65535", errs[3].Error())
+	assert.Contains(t, errs[4].Message, "at most 1 decimals")
+
+	_, err = BuildDeploymentParameters(parametersDescription(t), map[string]interface{}{"port": 80.5, "hostname": "ab"})
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2)
+	assert.Contains(t, errs[0].Message, "at least 3 characters")
+	assert.Contains(t, errs[1].Message, "must be an integer")
+
+	_, err = BuildDeploymentParameters(parametersDescription(t), map[string]interface{}{"hostname": ""})
+	assert.ErrorContains(t, err, "Network/Hostname (parameter hostname) is required")
+}
+
+func TestLoadParameterAnswers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "params.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("hostname: api\nport: 443\ndebug: true\n"), 0o644))
+
+	answers, err := LoadParameterAnswers(path)
+	require.NoError(t, err)
+	parameters, err := BuildDeploymentParameters(parametersDescription(t), answers)
+	require.NoError(t, err)
+	assert.Equal(t, "api", parameters["hostname"].Value)
+	assert.Equal(t, int64(443), parameters["port"].Value)
+	assert.Equal(t, true, parameters["debug"].Value)
+
+	require.NoError(t, os.WriteFile(path, []byte("- not a map\n"), 0o644))
+	_, err = LoadParameterAnswers(path)
+	assert.ErrorContains(t, err, "failed to parse the parameters file")
+}
+
+func TestPromptParameterAnswers(t *testing.T) {
+	// an invalid port is asked for again, empty answers keep the defaults
+	in := strings.NewReader("\nhttp\n8443\n\n\n")
+	var out bytes.Buffer
+	answers, err := PromptParameterAnswers(parametersDescription(t), in, &out)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"port": "8443"}, answers)
+
+	prompts := out.String()
+	assert.Contains(t, prompts, "Network\n  Hostname [web]: ")
+	assert.Contains(t, prompts, "  Port (Port the web service listens on) [8080]: ")
+	assert.Contains(t, prompts, "  Port must be an integer, got http\n")
+	assert.Contains(t, prompts, "Tuning\n  Ratio: ")
+
+	parameters, err := BuildDeploymentParameters(parametersDescription(t), answers)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8443), parameters["port"].Value)
+
+	_, err = PromptParameterAnswers(parametersDescription(t), strings.NewReader("api\n"), &out)
+	assert.ErrorContains(t, err, "failed to read the value of Port")
+}
@@ -1,16 +1,26 @@
 package wfm
 
 import (
+    "bytes"
     "context"
-    "crypto/sha256"
     "encoding/base64"
+    "encoding/json"
+    "errors"
     "fmt"
     "io"
+    "mime"
     "net/http"
+    "strconv"
+    "strings"
+    "sync"
     "time"
 
     "github.com/google/uuid"
     "github.com/margo/sandbox/shared-lib/cache"
+    "github.com/margo/sandbox/shared-lib/crypto"
+    contentdigest "github.com/margo/sandbox/shared-lib/digest"
+    "github.com/margo/sandbox/shared-lib/file"
+    httputils "github.com/margo/sandbox/shared-lib/http"
     "github.com/margo/sandbox/shared-lib/pointers"
     "github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
 )
@@ -33,9 +43,32 @@ type SbiHttpClient struct {
     options         []HTTPApiClientOptions
     bundleCache     *cache.BundleCache
     deploymentCache *cache.DeploymentCache
+    limits          ManifestLimits
+
+    // manifestVerifier verifies signed state manifests, signed manifests are refused without it
+    manifestVerifier *crypto.ManifestVerifier
+
+    // serverAPIVersion is the API version the server advertised while onboarding
+    serverAPIVersionMu sync.Mutex
+    serverAPIVersion   string
+}
+
+// WithHTTPClientFactory makes the generated client send its requests through a client built by the
+// shared factory, timeout overrides the factory's timeout so that long-poll requests can outlive it
+func WithHTTPClientFactory(factory *httputils.ClientFactory, timeout time.Duration) HTTPApiClientOptions {
+    return sbi.WithHTTPClient(factory.ClientWithTimeout(timeout))
 }
 
+// DefaultCacheDir is where NewSbiHTTPClient keeps the cached deployments and bundles
+const DefaultCacheDir = "data/cache"
+
 func NewSbiHTTPClient(url string, options ...HTTPApiClientOptions) (*SbiHttpClient, error) {
+    return NewSbiHTTPClientWithCacheDir(url, DefaultCacheDir, options...)
+}
+
+// NewSbiHTTPClientWithCacheDir creates a client that keeps the cached deployments and bundles in
+// cacheDir, so that clients of several agents on one host do not share their caches
+func NewSbiHTTPClientWithCacheDir(url, cacheDir string, options ...HTTPApiClientOptions) (*SbiHttpClient, error) {
     client, err := sbi.NewClient(url)
     if err != nil {
         return nil, fmt.Errorf("failed to create API client: %w", err)
@@ -43,14 +76,15 @@ func NewSbiHTTPClient(url string, options ...HTTPApiClientOptions) (*SbiHttpClie
     for _, opt := range options {
         opt(client)
     }
+    client.RequestEditors = append(client.RequestEditors, withAPIVersions(SBIAPIVersion))
 
     // Initialize caches
-    bundleCache, err := cache.NewBundleCache("data/cache")
+    bundleCache, err := cache.NewBundleCache(cacheDir)
     if err != nil {
         return nil, fmt.Errorf("failed to create bundle cache: %w", err)
     }
 
-    deploymentCache, err := cache.NewDeploymentCache("data/cache")
+    deploymentCache, err := cache.NewDeploymentCache(cacheDir)
     if err != nil {
         return nil, fmt.Errorf("failed to create deployment cache: %w", err)
     }
@@ -61,10 +95,35 @@ func NewSbiHTTPClient(url string, options ...HTTPApiClientOptions) (*SbiHttpClie
         options:         options,
         bundleCache:     bundleCache,
         deploymentCache: deploymentCache,
+        limits:          DefaultManifestLimits(),
     }
     return apiClient, nil
 }
 
+// SetManifestLimits replaces the default limits on manifest, deployment and bundle sizes, unset
+// limits keep their default. It must be called before the client is used.
+func (self *SbiHttpClient) SetManifestLimits(limits ManifestLimits) {
+    self.limits = limits.WithDefaults()
+}
+
+// SetManifestVerifier makes the client ask for signed state manifests and verify them. It must be
+// called before the client is used.
+func (self *SbiHttpClient) SetManifestVerifier(verifier *crypto.ManifestVerifier) {
+    self.manifestVerifier = verifier
+}
+
+// ManifestLimits returns the limits the client enforces
+func (self *SbiHttpClient) ManifestLimits() ManifestLimits {
+    return self.limits
+}
+
+// SetCacheLimits bounds the size and age of the deployment and bundle caches, each cache is held to
+// the limits on its own. The entries of the last synced digests are never evicted.
+func (self *SbiHttpClient) SetCacheLimits(limits cache.Limits) {
+    self.deploymentCache.SetDeploymentCacheLimits(limits)
+    self.bundleCache.SetBundleCacheLimits(limits)
+}
+
 func (self *SbiHttpClient) OnboardDeviceClient(ctx context.Context, deviceCertificate []byte, overrideOptions ...HTTPApiClientRequestEditorOptions) (clientId string, endpoints []string, err error) {
     cert := base64.StdEncoding.EncodeToString([]byte(deviceCertificate))
 
@@ -81,6 +140,7 @@ func (self *SbiHttpClient) OnboardDeviceClient(ctx context.Context, deviceCertif
     if resp.StatusCode != 201 {
         return "", nil, fmt.Errorf("onboarding failed with status: %d", resp.StatusCode)
     }
+    self.setServerAPIVersion(resp.Header.Get(ServerAPIVersionHeader))
 
     onboardingResp, err := sbi.ParsePostApiV1OnboardingResponse(resp)
     if err != nil {
@@ -104,7 +164,7 @@ func (self *SbiHttpClient) OnboardDeviceClient(ctx context.Context, deviceCertif
 }
 
 func (self *SbiHttpClient) ReportCapabilities(ctx context.Context, deviceClientId string, capabilities sbi.DeviceCapabilitiesManifest, overrideOptions ...HTTPApiClientRequestEditorOptions) error {
-    resp, err := self.client.PostApiV1ClientsClientIdCapabilities(ctx, deviceClientId, capabilities)
+    resp, err := self.client.PostApiV1ClientsClientIdCapabilities(ctx, deviceClientId, capabilities, overrideOptions...)
     if err != nil {
         return fmt.Errorf("failed to report capabilities: %w", err)
     }
@@ -117,21 +177,90 @@ func (self *SbiHttpClient) ReportCapabilities(ctx context.Context, deviceClientI
     return nil
 }
 
-func (self *SbiHttpClient) SyncState(ctx context.Context, deviceClientId string, etag string, overrideOptions ...HTTPApiClientRequestEditorOptions) (desiredStates *sbi.UnsignedAppStateManifest, err error) {
-    // Prepare parameters
+// NegotiateAPIVersion checks the SBI API version of the server against the one of the client. The
+// version the server advertised while onboarding is used, without one the server is asked with an
+// OPTIONS request to the onboarding endpoint.
+//
+// Returns:
+//   - APIVersionCheck: The client and server versions and whether they work together
+//   - error: An *ErrIncompatibleAPIVersion if the majors differ, or an error if the probe failed
+func (self *SbiHttpClient) NegotiateAPIVersion(ctx context.Context, overrideOptions ...HTTPApiClientRequestEditorOptions) (APIVersionCheck, error) {
+    server := self.getServerAPIVersion()
+    if server == "" {
+        probed, err := self.probeServerAPIVersion(ctx, overrideOptions...)
+        if err != nil {
+            return APIVersionCheck{API: "SBI", Client: SBIAPIVersion}, err
+        }
+        self.setServerAPIVersion(probed)
+        server = probed
+    }
+    return CheckAPIVersion("SBI", SBIAPIVersion, server)
+}
+
+func (self *SbiHttpClient) probeServerAPIVersion(ctx context.Context, overrideOptions ...HTTPApiClientRequestEditorOptions) (string, error) {
+    client, ok := self.client.(*sbi.Client)
+    if !ok {
+        return "", nil
+    }
+
+    // the generated client has no discovery operation, ask the onboarding endpoint what it speaks
+    req, err := sbi.NewPostApiV1OnboardingRequestWithBody(client.Server, "application/json", nil)
+    if err != nil {
+        return "", fmt.Errorf("failed to create api version request: %w", err)
+    }
+    req.Method = http.MethodOptions
+    req = req.WithContext(ctx)
+    for _, editor := range append(append([]sbi.RequestEditorFn{}, client.RequestEditors...), overrideOptions...) {
+        if err := editor(ctx, req); err != nil {
+            return "", fmt.Errorf("failed to prepare api version request: %w", err)
+        }
+    }
+
+    resp, err := client.Client.Do(req)
+    if err != nil {
+        return "", fmt.Errorf("api version request failed: %w", err)
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, resp.Body)
+
+    // servers that do not answer OPTIONS predate the negotiation, they advertise no version
+    return resp.Header.Get(ServerAPIVersionHeader), nil
+}
+
+func (self *SbiHttpClient) setServerAPIVersion(version string) {
+    self.serverAPIVersionMu.Lock()
+    defer self.serverAPIVersionMu.Unlock()
+    self.serverAPIVersion = version
+}
+
+func (self *SbiHttpClient) getServerAPIVersion() string {
+    self.serverAPIVersionMu.Lock()
+    defer self.serverAPIVersionMu.Unlock()
+    return self.serverAPIVersion
+}
+
+// syncStateParams asks for the desired state manifest, a signed one is preferred when the client
+// verifies signatures
+func (self *SbiHttpClient) syncStateParams(etag string) *sbi.GetApiV1ClientsClientIdDeploymentsParams {
     params := &sbi.GetApiV1ClientsClientIdDeploymentsParams{
         Accept: pointers.Ptr("application/vnd.margo.manifest.v1+json"),
     }
+    if self.manifestVerifier != nil {
+        params.Accept = pointers.Ptr(crypto.SignedManifestMediaType + ", application/vnd.margo.manifest.v1+json;q=0.5")
+    }
 
     // Only set If-None-Match if etag is not empty
     if etag != "" && etag != `""` {
         params.IfNoneMatch = &etag
     }
+    return params
+}
 
+func (self *SbiHttpClient) SyncState(ctx context.Context, deviceClientId string, etag string, overrideOptions ...HTTPApiClientRequestEditorOptions) (desiredStates *sbi.UnsignedAppStateManifest, err error) {
     resp, err := self.client.GetApiV1ClientsClientIdDeployments(
         ctx,
         deviceClientId,
-        params,
+        self.syncStateParams(etag),
         overrideOptions...,
     )
     if err != nil {
@@ -139,6 +268,16 @@ func (self *SbiHttpClient) SyncState(ctx context.Context, deviceClientId string,
     }
     defer resp.Body.Close()
 
+    if resp.StatusCode == http.StatusOK {
+        if err := limitResponseBody(resp, "maxManifestBytes", self.limits.MaxManifestBytes); err != nil {
+            return nil, err
+        }
+        if IsSignedManifest(resp) {
+            manifest, _, err := self.verifySignedManifest(resp)
+            return manifest, err
+        }
+    }
+
     // Parse response first
     desiredStateResp, err := sbi.ParseGetApiV1ClientsClientIdDeploymentsResponse(resp)
     if err != nil {
@@ -167,22 +306,14 @@ func (self *SbiHttpClient) SyncState(ctx context.Context, deviceClientId string,
     }
 }
 
-// SyncStateWithResponse retrieves the desired state manifest and returns the HTTP response for header access
+// SyncStateWithResponse retrieves the desired state manifest and returns the HTTP response for header access.
+// The body of the response returned with a manifest holds the raw manifest JSON, the payload of a signed one,
+// for the properties the generated models do not have yet.
 func (self *SbiHttpClient) SyncStateWithResponse(ctx context.Context, deviceClientId string, etag string, overrideOptions ...HTTPApiClientRequestEditorOptions) (desiredStates *sbi.UnsignedAppStateManifest, response *http.Response, err error) {
-    // Prepare parameters
-    params := &sbi.GetApiV1ClientsClientIdDeploymentsParams{
-        Accept: pointers.Ptr("application/vnd.margo.manifest.v1+json"),
-    }
-
-    // Only set If-None-Match if etag is not empty
-    if etag != "" && etag != `""` {
-        params.IfNoneMatch = &etag
-    }
-
     resp, err := self.client.GetApiV1ClientsClientIdDeployments(
         ctx,
         deviceClientId,
-        params,
+        self.syncStateParams(etag),
         overrideOptions...,
     )
     if err != nil {
@@ -195,10 +326,35 @@ func (self *SbiHttpClient) SyncStateWithResponse(ctx context.Context, deviceClie
         return nil, resp, nil
     }
 
+    // Bound the manifest while it is read, the response is returned so its headers stay available
+    if resp.StatusCode == http.StatusOK {
+        if err := limitResponseBody(resp, "maxManifestBytes", self.limits.MaxManifestBytes); err != nil {
+            resp.Body.Close()
+            return nil, resp, err
+        }
+        if IsSignedManifest(resp) {
+            manifest, payload, err := self.verifySignedManifest(resp)
+            resp.Body.Close()
+            if err != nil {
+                var limitErr *LimitExceededError
+                if errors.As(err, &limitErr) {
+                    return nil, resp, err
+                }
+                return nil, nil, err
+            }
+            resp.Body = io.NopCloser(bytes.NewReader(payload))
+            return manifest, resp, nil
+        }
+    }
+
     // Only parse response for status codes that have a body
     desiredStateResp, err := sbi.ParseGetApiV1ClientsClientIdDeploymentsResponse(resp)
     if err != nil {
         resp.Body.Close()
+        var limitErr *LimitExceededError
+        if errors.As(err, &limitErr) {
+            return nil, resp, err
+        }
         return nil, nil, fmt.Errorf("failed to parse response: %w", err)
     }
 
@@ -207,6 +363,7 @@ func (self *SbiHttpClient) SyncStateWithResponse(ctx context.Context, deviceClie
     case 200:
         // OK - new data available
         if desiredStateResp.ApplicationvndMargoManifestV1JSON200 != nil {
+            resp.Body = io.NopCloser(bytes.NewReader(desiredStateResp.Body))
             return desiredStateResp.ApplicationvndMargoManifestV1JSON200, resp, nil
         }
         resp.Body.Close()
@@ -223,7 +380,111 @@ func (self *SbiHttpClient) SyncStateWithResponse(ctx context.Context, deviceClie
     }
 }
 
-func (self *SbiHttpClient) ReportDeploymentStatus(ctx context.Context, deviceID, appID string, overallAppStatus sbi.DeploymentStatusManifestStatusState, components []sbi.ComponentStatus, deploymentErr error) error {
+// IsSignedManifest reports whether the response carries a signed state manifest, SyncStateWithResponse
+// only returns the manifest of such a response once its signature is verified
+func IsSignedManifest(resp *http.Response) bool {
+    if resp == nil {
+        return false
+    }
+    mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+    return err == nil && mediaType == crypto.SignedManifestMediaType
+}
+
+// verifySignedManifest verifies the signed manifest of the response and decodes its payload, the
+// payload is returned as well
+func (self *SbiHttpClient) verifySignedManifest(resp *http.Response) (*sbi.UnsignedAppStateManifest, []byte, error) {
+    if self.manifestVerifier == nil {
+        return nil, nil, fmt.Errorf("the WFM served a signed manifest but no manifest verification key is configured")
+    }
+    signed, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, nil, err
+    }
+    payload, err := self.manifestVerifier.Verify(signed)
+    if err != nil {
+        return nil, nil, fmt.Errorf("rejected the state manifest: %w", err)
+    }
+    var manifest sbi.UnsignedAppStateManifest
+    if err := json.Unmarshal(payload, &manifest); err != nil {
+        return nil, nil, fmt.Errorf("failed to parse signed manifest payload: %w", err)
+    }
+    return &manifest, payload, nil
+}
+
+// WithLongPollWait asks the server (RFC 7240 "Prefer: wait") to hold the sync request open
+// until the desired state changes or the wait elapses. Servers that do not support it simply ignore the header.
+func WithLongPollWait(wait time.Duration) HTTPApiClientRequestEditorOptions {
+    return func(ctx context.Context, req *http.Request) error {
+        req.Header.Set("Prefer", fmt.Sprintf("wait=%d", int(wait.Seconds())))
+        return nil
+    }
+}
+
+// IsLongPollHonored reports whether the server acknowledged the wait preference via the
+// Preference-Applied response header.
+func IsLongPollHonored(resp *http.Response) bool {
+    if resp == nil {
+        return false
+    }
+    for _, applied := range resp.Header.Values("Preference-Applied") {
+        if strings.HasPrefix(strings.TrimSpace(strings.ToLower(applied)), "wait") {
+            return true
+        }
+    }
+    return false
+}
+
+// ManifestVersionHeader carries the version of the manifest that delivered the reported desired
+// state, the status manifest itself has no place for it
+const ManifestVersionHeader = "X-Margo-Manifest-Version"
+
+// WithManifestVersion tells the server which manifest version delivered the desired state a status
+// report is about. Servers that do not know the header ignore it.
+func WithManifestVersion(version uint64) HTTPApiClientRequestEditorOptions {
+    return func(ctx context.Context, req *http.Request) error {
+        req.Header.Set(ManifestVersionHeader, strconv.FormatUint(version, 10))
+        return nil
+    }
+}
+
+// BootstrapTokenHeader carries the one-time token a provisioned device exchanges for its client id
+// while onboarding
+const BootstrapTokenHeader = "X-Margo-Bootstrap-Token"
+
+// WithBootstrapToken presents the bootstrap token of a provisioned device when it onboards
+func WithBootstrapToken(token string) HTTPApiClientRequestEditorOptions {
+    return func(ctx context.Context, req *http.Request) error {
+        req.Header.Set(BootstrapTokenHeader, token)
+        return nil
+    }
+}
+
+// DeploymentStatusError is reported with its own code instead of DEPLOYMENT_ERROR, e.g. for a
+// deployment that waits for its dependencies
+type DeploymentStatusError struct {
+    Code    string
+    Message string
+}
+
+func (e *DeploymentStatusError) Error() string {
+    return e.Message
+}
+
+// ChangeClassHeader carries the kind of change that led to the reported desired state, e.g. "values"
+// for parameter-only updates and "full" for chart or image updates, so a WFM can tell config from
+// version updates
+const ChangeClassHeader = "X-Margo-Change-Class"
+
+// WithChangeClass tells the server which kind of change a status report is about. Servers that do
+// not know the header ignore it.
+func WithChangeClass(class string) HTTPApiClientRequestEditorOptions {
+    return func(ctx context.Context, req *http.Request) error {
+        req.Header.Set(ChangeClassHeader, class)
+        return nil
+    }
+}
+
+func (self *SbiHttpClient) ReportDeploymentStatus(ctx context.Context, deviceID, appID string, overallAppStatus sbi.DeploymentStatusManifestStatusState, components []sbi.ComponentStatus, deploymentErr error, overrideOptions ...HTTPApiClientRequestEditorOptions) error {
     appUUID, err := uuid.Parse(appID)
     if err != nil {
         return err
@@ -236,11 +497,16 @@ func (self *SbiHttpClient) ReportDeploymentStatus(ctx context.Context, deviceID,
     }
 
     if deploymentErr != nil {
+        code := "DEPLOYMENT_ERROR"
+        var statusErr *DeploymentStatusError
+        if errors.As(deploymentErr, &statusErr) && statusErr.Code != "" {
+            code = statusErr.Code
+        }
         errorStruct = &struct {
             Code    *string `json:"code,omitempty"`
             Message *string `json:"message,omitempty"`
         }{
-            Code:    pointers.Ptr("DEPLOYMENT_ERROR"),
+            Code:    pointers.Ptr(code),
             Message: pointers.Ptr(deploymentErr.Error()),
         }
     }
@@ -262,7 +528,7 @@ func (self *SbiHttpClient) ReportDeploymentStatus(ctx context.Context, deviceID,
         },
     }
 
-    resp, err := self.client.PostApiV1ClientsClientIdDeploymentDeploymentIdStatus(ctx, deviceID, appUUID.String(), deploymentStatus)
+    resp, err := self.client.PostApiV1ClientsClientIdDeploymentDeploymentIdStatus(ctx, deviceID, appUUID.String(), deploymentStatus, overrideOptions...)
     if err != nil {
         return err
     }
@@ -273,14 +539,20 @@ func (self *SbiHttpClient) ReportDeploymentStatus(ctx context.Context, deviceID,
 
 // FetchDeploymentYAML with caching support and enhanced logging
 func (self *SbiHttpClient) FetchDeploymentYAML(ctx context.Context, deviceClientId, deploymentId, digest string, overrideOptions ...HTTPApiClientRequestEditorOptions) (yamlContent []byte, err error) {
+    expected, err := requestedDigest("deployment", digest)
+    if err != nil {
+        return nil, err
+    }
+
     // Check if we have this deployment cached
     cachedDigest, cacheErr := self.deploymentCache.GetLastDeploymentDigest(deploymentId)
 
     params := &sbi.GetApiV1ClientsClientIdDeploymentsDeploymentIdDigestParams{}
 
-    // Add If-None-Match header if we have a cached version
-    if cacheErr == nil && cachedDigest == digest {
-        etag := fmt.Sprintf("\"%s\"", digest)
+    // Add If-None-Match header if we have a cached version, the metadata alone is not enough as
+    // the cached file may have been removed since
+    if cacheErr == nil && cachedDigest == digest && self.deploymentCache.DeploymentExists(deploymentId, digest) {
+        etag := contentdigest.ToETag(expected)
         params.IfNoneMatch = &etag
         fmt.Printf("INFO: [Cache] Sending If-None-Match for deployment %s: %s\n", 
             deploymentId[:8], etag)
@@ -306,7 +578,13 @@ func (self *SbiHttpClient) FetchDeploymentYAML(ctx context.Context, deviceClient
         
         cachedData, err := self.deploymentCache.GetDeployment(deploymentId, digest)
         if err != nil {
-            return nil, fmt.Errorf("304 received but cache read failed: %w", err)
+            // the entry turned out to be corrupt, forget it and fetch unconditionally
+            if params.IfNoneMatch == nil || self.deploymentCache.ClearDeploymentCache(deploymentId) != nil {
+                return nil, fmt.Errorf("304 received but cache read failed: %w", err)
+            }
+            fmt.Printf("WARNING: [Cache] 304 received but cache read failed for deployment %s, refetching: %v\n",
+                deploymentId[:8], err)
+            return self.FetchDeploymentYAML(ctx, deviceClientId, deploymentId, digest, overrideOptions...)
         }
         return cachedData, nil
     }
@@ -314,25 +592,19 @@ func (self *SbiHttpClient) FetchDeploymentYAML(ctx context.Context, deviceClient
     if resp.StatusCode != 200 {
         return nil, fmt.Errorf("deployment fetch failed with status: %d", resp.StatusCode)
     }
+    if err := limitResponseBody(resp, "maxDeploymentBytes", self.limits.MaxDeploymentBytes); err != nil {
+        return nil, err
+    }
 
-    // Read YAML content
-    yamlContent, err = io.ReadAll(resp.Body)
+    // Read YAML content, verifying its digest (Exact Bytes Rule)
+    yamlContent, err = readVerifiedContent(resp.Body, "deployment", expected)
     if err != nil {
-        return nil, fmt.Errorf("failed to read deployment YAML: %w", err)
+        return nil, err
     }
 
     fmt.Printf("INFO: [Cache MISS] Downloaded deployment %s (%d bytes)\n", 
         deploymentId[:8], len(yamlContent))
 
-    // CRITICAL: Verify digest (Exact Bytes Rule)
-    hash := sha256.Sum256(yamlContent)
-    actualDigest := fmt.Sprintf("sha256:%x", hash)
-
-    if actualDigest != digest {
-        return nil, fmt.Errorf("deployment digest mismatch: expected %s, got %s",
-            digest, actualDigest)
-    }
-
     // Store in cache (digest verification happens inside cache.Store)
     if err := self.deploymentCache.StoreDeployment(deploymentId, digest, yamlContent); err != nil {
         fmt.Printf("WARNING: [Cache] Failed to cache deployment %s: %v\n", deploymentId[:8], err)
@@ -344,21 +616,62 @@ func (self *SbiHttpClient) FetchDeploymentYAML(ctx context.Context, deviceClient
     return yamlContent, nil
 }
 
-// DownloadBundle with caching support and enhanced logging
-func (self *SbiHttpClient) DownloadBundle(ctx context.Context, deviceClientId, digest string, overrideOptions ...HTTPApiClientRequestEditorOptions) (bundleData []byte, err error) {
-    // Check if we have this bundle cached
-    cachedDigest, cacheErr := self.bundleCache.GetLastBundleDigest(deviceClientId)
+// requestedDigest parses the digest content is requested by, content whose digest cannot be
+// verified is not fetched at all
+func requestedDigest(kind, digest string) (contentdigest.Digest, error) {
+    expected, err := contentdigest.ParseVerifiable(digest)
+    if err != nil {
+        return contentdigest.Digest{}, fmt.Errorf("%s %w", kind, err)
+    }
+    return expected, nil
+}
 
-    params := &sbi.GetApiV1ClientsClientIdBundlesDigestParams{}
+// readVerifiedContent reads content and checks that it has exactly the digest it was requested by,
+// the content is hashed while it is read
+func readVerifiedContent(body io.Reader, kind string, expected contentdigest.Digest) ([]byte, error) {
+    digester, err := contentdigest.NewDigester(expected.Algorithm())
+    if err != nil {
+        return nil, fmt.Errorf("%s %w", kind, err)
+    }
+    content, err := io.ReadAll(io.TeeReader(body, digester))
+    if err != nil {
+        return nil, fmt.Errorf("failed to read %s: %w", kind, err)
+    }
+    if err := expected.Check(digester.Digest()); err != nil {
+        return nil, fmt.Errorf("%s %w", kind, err)
+    }
+    return content, nil
+}
 
-    // Add If-None-Match header if we have a cached version
-    if cacheErr == nil && cachedDigest == digest {
-        etag := fmt.Sprintf("\"%s\"", digest)
-        params.IfNoneMatch = &etag
-        fmt.Printf("INFO: [Cache] Sending If-None-Match for bundle (device: %s, digest: %s...)\n", 
-            deviceClientId[:8], digest[:16])
+// writeVerifiedContent streams content to path and checks that it has exactly the digest it was
+// requested by, path is only replaced by content that does
+func writeVerifiedContent(body io.Reader, kind string, expected contentdigest.Digest, path string) (int64, error) {
+    digester, err := contentdigest.NewDigester(expected.Algorithm())
+    if err != nil {
+        return 0, fmt.Errorf("%s %w", kind, err)
     }
+    var size int64
+    err = file.WriteAtomic(path, 0644, func(w io.Writer) error {
+        size, err = io.Copy(io.MultiWriter(w, digester), body)
+        if err != nil {
+            return fmt.Errorf("failed to read %s: %w", kind, err)
+        }
+        if err := expected.Check(digester.Digest()); err != nil {
+            return fmt.Errorf("%s %w", kind, err)
+        }
+        return nil
+    })
+    return size, err
+}
 
+// DownloadBundle with caching support and enhanced logging
+func (self *SbiHttpClient) DownloadBundle(ctx context.Context, deviceClientId, digest string, overrideOptions ...HTTPApiClientRequestEditorOptions) (bundleData []byte, err error) {
+    expected, err := requestedDigest("bundle", digest)
+    if err != nil {
+        return nil, err
+    }
+
+    params := self.bundleRequestParams(deviceClientId, digest, expected)
     resp, err := self.client.GetApiV1ClientsClientIdBundlesDigest(
         ctx,
         deviceClientId,
@@ -378,7 +691,12 @@ func (self *SbiHttpClient) DownloadBundle(ctx context.Context, deviceClientId, d
         
         cachedData, err := self.bundleCache.GetBundle(deviceClientId, digest)
         if err != nil {
-            return nil, fmt.Errorf("304 received but cache read failed: %w", err)
+            // the entry turned out to be corrupt, forget it and download unconditionally
+            if params.IfNoneMatch == nil || self.bundleCache.ClearDeviceBundles(deviceClientId) != nil {
+                return nil, fmt.Errorf("304 received but cache read failed: %w", err)
+            }
+            fmt.Printf("WARNING: [Cache] 304 received but cache read failed for bundle, refetching: %v\n", err)
+            return self.DownloadBundle(ctx, deviceClientId, digest, overrideOptions...)
         }
         
         fmt.Printf("INFO: [Cache] Retrieved bundle from cache (%d bytes)\n", len(cachedData))
@@ -388,25 +706,19 @@ func (self *SbiHttpClient) DownloadBundle(ctx context.Context, deviceClientId, d
     if resp.StatusCode != 200 {
         return nil, fmt.Errorf("bundle download failed with status: %d", resp.StatusCode)
     }
+    if err := limitResponseBody(resp, "maxBundleBytes", self.limits.MaxBundleBytes); err != nil {
+        return nil, err
+    }
 
-    // Read bundle data
-    bundleData, err = io.ReadAll(resp.Body)
+    // Read bundle data, verifying its digest (Exact Bytes Rule)
+    bundleData, err = readVerifiedContent(resp.Body, "bundle", expected)
     if err != nil {
-        return nil, fmt.Errorf("failed to read bundle: %w", err)
+        return nil, err
     }
 
     fmt.Printf("INFO: [Cache MISS] Downloaded bundle for device %s (%d bytes)\n", 
         deviceClientId[:8], len(bundleData))
 
-    // Verify digest (Exact Bytes Rule)
-    hash := sha256.Sum256(bundleData)
-    actualDigest := fmt.Sprintf("sha256:%x", hash)
-
-    if actualDigest != digest {
-        return nil, fmt.Errorf("bundle digest mismatch: expected %s, got %s",
-            digest, actualDigest)
-    }
-
     // Store in cache (digest verification happens inside cache.Store)
     if err := self.bundleCache.StoreBundle(deviceClientId, digest, bundleData); err != nil {
         fmt.Printf("WARNING: [Cache] Failed to cache bundle for device %s: %v\n", 
@@ -418,3 +730,149 @@ func (self *SbiHttpClient) DownloadBundle(ctx context.Context, deviceClientId, d
 
     return bundleData, nil
 }
+
+// bundleRequestParams sends If-None-Match when the bundle is the last one cached for the device
+func (self *SbiHttpClient) bundleRequestParams(deviceClientId, digest string, expected contentdigest.Digest) *sbi.GetApiV1ClientsClientIdBundlesDigestParams {
+    params := &sbi.GetApiV1ClientsClientIdBundlesDigestParams{}
+
+    cachedDigest, cacheErr := self.bundleCache.GetLastBundleDigest(deviceClientId)
+    if cacheErr == nil && cachedDigest == digest && self.bundleCache.BundleExists(deviceClientId, digest) {
+        etag := contentdigest.ToETag(expected)
+        params.IfNoneMatch = &etag
+        fmt.Printf("INFO: [Cache] Sending If-None-Match for bundle (device: %s, digest: %s...)\n", 
+            deviceClientId[:8], digest[:16])
+    }
+    return params
+}
+
+// DownloadBundleToFile downloads the bundle like DownloadBundle but streams it to destPath while
+// its digest is computed, so that a large bundle is never held in memory. The returned path holds
+// the verified bundle: destPath, or the cached bundle when the server answers 304 Not Modified,
+// which the caller must not modify or remove. A bundle that does not match its digest is discarded
+// and destPath is left as it was.
+func (self *SbiHttpClient) DownloadBundleToFile(ctx context.Context, deviceClientId, digest, destPath string, overrideOptions ...HTTPApiClientRequestEditorOptions) (bundlePath string, err error) {
+    expected, err := requestedDigest("bundle", digest)
+    if err != nil {
+        return "", err
+    }
+
+    params := self.bundleRequestParams(deviceClientId, digest, expected)
+    resp, err := self.client.GetApiV1ClientsClientIdBundlesDigest(
+        ctx,
+        deviceClientId,
+        digest,
+        params,
+        overrideOptions...,
+    )
+    if err != nil {
+        return "", fmt.Errorf("failed to download bundle: %w", err)
+    }
+    defer resp.Body.Close()
+
+    // Handle 304 Not Modified
+    if resp.StatusCode == http.StatusNotModified {
+        fmt.Printf("INFO: [Cache HIT] Bundle not modified (304) - using cached version (device: %s)\n", 
+            deviceClientId[:8])
+
+        cachedPath, err := self.bundleCache.GetBundlePath(deviceClientId, digest)
+        if err != nil {
+            // the entry turned out to be corrupt, forget it and download unconditionally
+            if params.IfNoneMatch == nil || self.bundleCache.ClearDeviceBundles(deviceClientId) != nil {
+                return "", fmt.Errorf("304 received but cache read failed: %w", err)
+            }
+            fmt.Printf("WARNING: [Cache] 304 received but cache read failed for bundle, refetching: %v\n", err)
+            return self.DownloadBundleToFile(ctx, deviceClientId, digest, destPath, overrideOptions...)
+        }
+        return cachedPath, nil
+    }
+
+    if resp.StatusCode != 200 {
+        return "", fmt.Errorf("bundle download failed with status: %d", resp.StatusCode)
+    }
+    if err := limitResponseBody(resp, "maxBundleBytes", self.limits.MaxBundleBytes); err != nil {
+        return "", err
+    }
+
+    // Write the bundle, verifying its digest (Exact Bytes Rule)
+    size, err := writeVerifiedContent(resp.Body, "bundle", expected, destPath)
+    if err != nil {
+        return "", err
+    }
+
+    fmt.Printf("INFO: [Cache MISS] Downloaded bundle for device %s to %s (%d bytes)\n", 
+        deviceClientId[:8], destPath, size)
+
+    if err := self.bundleCache.StoreBundleFile(deviceClientId, digest, destPath); err != nil {
+        fmt.Printf("WARNING: [Cache] Failed to cache bundle for device %s: %v\n", 
+            deviceClientId[:8], err)
+    } else {
+        fmt.Printf("INFO: [Cache] Stored bundle for device %s (digest: %s...)\n", 
+            deviceClientId[:8], digest[:16])
+    }
+
+    return destPath, nil
+}
+
+// CacheExpectations describes what the device database expects the local caches to hold
+type CacheExpectations struct {
+    DeviceClientId string
+    // BundleDigest is the digest of the last synced bundle, empty when there is none
+    BundleDigest string
+    // Deployments maps every deployment id known to the database to its digest
+    Deployments map[string]string
+}
+
+// CacheReconcileSummary reports what a ReconcileCaches pass found
+type CacheReconcileSummary struct {
+    Deployments cache.ReconcileResult
+    Bundles     cache.ReconcileResult
+}
+
+// ReconcileCaches aligns the deployment and bundle caches with the database: entries that are no
+// longer expected are removed and expected entries that are missing or corrupt are invalidated, so
+// that the next fetch does not send an If-None-Match the cache cannot serve. Digests are verified
+// until ctx is done, the remaining entries are verified on first use.
+func (self *SbiHttpClient) ReconcileCaches(ctx context.Context, expected CacheExpectations) (CacheReconcileSummary, error) {
+    var summary CacheReconcileSummary
+    var err error
+
+    summary.Deployments, err = self.deploymentCache.ReconcileDeployments(ctx, expected.Deployments)
+    if err != nil {
+        return summary, fmt.Errorf("failed to reconcile the deployment cache: %w", err)
+    }
+
+    expectedBundles := map[string]string{}
+    if expected.DeviceClientId != "" && expected.BundleDigest != "" {
+        expectedBundles[expected.DeviceClientId] = expected.BundleDigest
+    }
+    summary.Bundles, err = self.bundleCache.ReconcileBundles(ctx, expectedBundles)
+    if err != nil {
+        return summary, fmt.Errorf("failed to reconcile the bundle cache: %w", err)
+    }
+    return summary, nil
+}
+
+// PurgeOrphanedDeployments drops the cached deployments that are not one of knownDeploymentIds, the
+// deployments of the last synced manifest. It returns the number of entries removed.
+func (self *SbiHttpClient) PurgeOrphanedDeployments(knownDeploymentIds []string) (int, error) {
+    return self.deploymentCache.PurgeOrphaned(knownDeploymentIds)
+}
+
+// CacheStats describes the deployment and bundle caches
+type CacheStats struct {
+    Deployments cache.Stats
+    Bundles     cache.Stats
+}
+
+// CacheStats returns the entries, the sizes and the hits and misses of the caches
+func (self *SbiHttpClient) CacheStats() (CacheStats, error) {
+    var stats CacheStats
+    var err error
+    if stats.Deployments, err = self.deploymentCache.DeploymentStats(); err != nil {
+        return stats, fmt.Errorf("failed to read the deployment cache stats: %w", err)
+    }
+    if stats.Bundles, err = self.bundleCache.BundleStats(); err != nil {
+        return stats, fmt.Errorf("failed to read the bundle cache stats: %w", err)
+    }
+    return stats, nil
+}
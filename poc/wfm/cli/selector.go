@@ -0,0 +1,167 @@
+package wfm
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+
+	nonStdWfmNbi "github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// defaultSelectorConcurrency is the number of deployments created at once for a selector
+const defaultSelectorConcurrency = 4
+
+// SelectorDeploymentOption configures CreateDeploymentForSelector
+type SelectorDeploymentOption func(*selectorDeploymentOptions)
+
+type selectorDeploymentOptions struct {
+	concurrency int
+	dryRun      bool
+	create      []CreateDeploymentOption
+}
+
+// WithFanOutConcurrency sets how many deployments are created at once, 0 keeps the default of 4
+func WithFanOutConcurrency(concurrency int) SelectorDeploymentOption {
+	return func(opts *selectorDeploymentOptions) {
+		if concurrency > 0 {
+			opts.concurrency = concurrency
+		}
+	}
+}
+
+// WithDryRun only reports which devices the selector targets, no deployment is created
+func WithDryRun() SelectorDeploymentOption {
+	return func(opts *selectorDeploymentOptions) {
+		opts.dryRun = true
+	}
+}
+
+// WithDeploymentOptions applies the options of CreateDeployment to the deployment of every device,
+// e.g. WithExpectedPackageDigest
+func WithDeploymentOptions(opts ...CreateDeploymentOption) SelectorDeploymentOption {
+	return func(options *selectorDeploymentOptions) {
+		options.create = append(options.create, opts...)
+	}
+}
+
+// DeviceDeploymentResult is the outcome of the deployment of one device
+type DeviceDeploymentResult struct {
+	DeviceId string
+	// Deployment is the deployment as accepted by the server, nil when it failed or on a dry run
+	Deployment *DeploymentResp
+	// Err tells why the deployment failed
+	Err error
+}
+
+// SkippedDevice is a device the selector matched that cannot take the deployment
+type SkippedDevice struct {
+	DeviceId string
+	Reason   string
+}
+
+// SelectorDeploymentSummary is the outcome of CreateDeploymentForSelector, ordered by device id
+type SelectorDeploymentSummary struct {
+	DryRun bool
+	// Targeted are the devices a deployment was created for, or would be on a dry run
+	Targeted []string
+	// Succeeded and Failed are the outcomes of the targeted devices, both are empty on a dry run
+	Succeeded []DeviceDeploymentResult
+	Failed    []DeviceDeploymentResult
+	// Skipped are the matching devices that are not onboarded, they would not sync the deployment
+	Skipped []SkippedDevice
+}
+
+// CreateDeploymentForSelector is CreateDeploymentForSelectorWithContext without a caller context,
+// the client timeout bounds its requests.
+//
+// Deprecated: use CreateDeploymentForSelectorWithContext.
+func (cli *NbiApiClient) CreateDeploymentForSelector(params DeploymentReq, selector map[string]string, opts ...SelectorDeploymentOption) (*SelectorDeploymentSummary, error) {
+	return cli.CreateDeploymentForSelectorWithContext(context.Background(), params, selector, opts...)
+}
+
+// CreateDeploymentForSelectorWithContext creates the deployment for every device whose labels match
+// the selector, one deployment request per device. A failed request does not stop the others, every
+// outcome is in the summary.
+//
+// Parameters:
+//   - ctx: Cancels the requests, each one is bounded by the client timeout when ctx has no deadline
+//   - params: The deployment request, its device reference is replaced by each targeted device
+//   - selector: The labels a device must have, e.g. {"site": "plant-7"}, at least one is required
+//   - opts: Optional settings, e.g. WithFanOutConcurrency, WithDryRun or WithDeploymentOptions
+//
+// Returns:
+//   - *SelectorDeploymentSummary: The targeted, succeeded, failed and skipped devices
+//   - error: An error if the selector is invalid or the devices cannot be listed
+func (cli *NbiApiClient) CreateDeploymentForSelectorWithContext(ctx context.Context, params DeploymentReq, selector map[string]string, opts ...SelectorDeploymentOption) (*SelectorDeploymentSummary, error) {
+	options := &selectorDeploymentOptions{concurrency: defaultSelectorConcurrency}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if len(selector) == 0 {
+		return nil, errors.New("the device selector needs at least one label, an empty selector would target every device")
+	}
+	labelSelector, err := labels.ValidatedSelectorFromSet(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := cli.ListAllDevices(ctx, ListDevicesParams{LabelSelector: labelSelector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &SelectorDeploymentSummary{DryRun: options.dryRun}
+	for _, device := range devices {
+		if device.Metadata.Id == nil || *device.Metadata.Id == "" {
+			continue
+		}
+		deviceId := *device.Metadata.Id
+		if device.State.Onboard != nonStdWfmNbi.ONBOARDED {
+			summary.Skipped = append(summary.Skipped, SkippedDevice{
+				DeviceId: deviceId,
+				Reason:   "device is not onboarded, its state is " + string(device.State.Onboard),
+			})
+			continue
+		}
+		summary.Targeted = append(summary.Targeted, deviceId)
+	}
+	slices.Sort(summary.Targeted)
+	slices.SortFunc(summary.Skipped, func(a, b SkippedDevice) int { return strings.Compare(a.DeviceId, b.DeviceId) })
+	if options.dryRun {
+		return summary, nil
+	}
+
+	results := make([]DeviceDeploymentResult, len(summary.Targeted))
+	slots := make(chan struct{}, options.concurrency)
+	var wg sync.WaitGroup
+	for i, deviceId := range summary.Targeted {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			deployment, err := cli.CreateDeploymentWithContext(ctx, forDevice(params, deviceId), options.create...)
+			results[i] = DeviceDeploymentResult{DeviceId: deviceId, Deployment: deployment, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result.Err != nil {
+			summary.Failed = append(summary.Failed, result)
+		} else {
+			summary.Succeeded = append(summary.Succeeded, result)
+		}
+	}
+	return summary, nil
+}
+
+// forDevice returns a copy of the deployment request that targets the device
+func forDevice(params DeploymentReq, deviceId string) DeploymentReq {
+	id := deviceId
+	params.Spec.DeviceRef = &nonStdWfmNbi.ApplicationDeploymentSpec_DeviceRef{Id: &id}
+	return params
+}
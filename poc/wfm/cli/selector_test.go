@@ -0,0 +1,150 @@
+package wfm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/shared-lib/http/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fleetStub lists the devices of a devicesStub and accepts the deployments of every device but the
+// failing ones
+type fleetStub struct {
+	devices devicesStub
+	failing map[string]bool
+
+	mu       sync.Mutex
+	deployed []string
+	inFlight atomic.Int32
+	maxSeen  atomic.Int32
+}
+
+func (s *fleetStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.devices.ServeHTTP(w, r)
+		return
+	}
+
+	current := s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	for max := s.maxSeen.Load(); current > max && !s.maxSeen.CompareAndSwap(max, current); max = s.maxSeen.Load() {
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	var req DeploymentReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Spec.DeviceRef == nil || req.Spec.DeviceRef.Id == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	deviceId := *req.Spec.DeviceRef.Id
+	if s.failing[deviceId] {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"errorCode": "CONFLICT", "message": "device is full"}`))
+		return
+	}
+	s.mu.Lock()
+	s.deployed = append(s.deployed, deviceId)
+	s.mu.Unlock()
+
+	resp := DeploymentResp{ApiVersion: req.ApiVersion, Kind: req.Kind}
+	resp.Metadata.Name = req.Metadata.Name
+	resp.Metadata.Id = &deviceId
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newFleetStubClient(t *testing.T, stub *fleetStub) *NbiApiClient {
+	t.Helper()
+	server := clienttest.NewTLSServer(t, stub)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseUint(serverURL.Port(), 10, 16)
+	require.NoError(t, err)
+
+	return NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil,
+		WithClientFactory(newTestClientFactory(t, server, "")))
+}
+
+func newFleet() *fleetStub {
+	plant7 := map[string]string{"site": "plant-7"}
+	return &fleetStub{
+		devices: devicesStub{devices: []DeviceManifest{
+			newDevice("device-c", "ONBOARDED", plant7),
+			newDevice("device-a", "ONBOARDED", plant7),
+			newDevice("device-b", "ONBOARDED", plant7),
+			newDevice("device-d", "IN-PROGRESS", plant7),
+			newDevice("device-e", "ONBOARDED", plant7),
+		}},
+		failing: map[string]bool{"device-b": true},
+	}
+}
+
+func fleetDeploymentReq() DeploymentReq {
+	req := DeploymentReq{ApiVersion: "margo.org", Kind: "ApplicationDeployment"}
+	req.Metadata.Name = "web"
+	req.Spec.AppPackageRef.Id = "pkg-1"
+	return req
+}
+
+func TestCreateDeploymentForSelector_FansOutAndKeepsGoing(t *testing.T) {
+	stub := newFleet()
+	cli := newFleetStubClient(t, stub)
+
+	summary, err := cli.CreateDeploymentForSelector(fleetDeploymentReq(), map[string]string{"site": "plant-7"}, WithFanOutConcurrency(2))
+	require.NoError(t, err)
+
+	assert.Equal(t, "site=plant-7", stub.devices.queries[0].Get("labelSelector"))
+	assert.Equal(t, []string{"device-a", "device-b", "device-c", "device-e"}, summary.Targeted)
+	assert.Equal(t, []SkippedDevice{{DeviceId: "device-d", Reason: "device is not onboarded, its state is IN-PROGRESS"}}, summary.Skipped)
+
+	require.Len(t, summary.Failed, 1, "a failed device does not stop the others")
+	assert.Equal(t, "device-b", summary.Failed[0].DeviceId)
+	assert.ErrorContains(t, summary.Failed[0].Err, "device is full")
+
+	var succeeded []string
+	for _, result := range summary.Succeeded {
+		require.NotNil(t, result.Deployment, result.DeviceId)
+		assert.Equal(t, result.DeviceId, *result.Deployment.Metadata.Id)
+		succeeded = append(succeeded, result.DeviceId)
+	}
+	assert.Equal(t, []string{"device-a", "device-c", "device-e"}, succeeded)
+	assert.ElementsMatch(t, succeeded, stub.deployed)
+	assert.LessOrEqual(t, stub.maxSeen.Load(), int32(2), "the concurrency is bounded")
+}
+
+func TestCreateDeploymentForSelector_DryRun(t *testing.T) {
+	stub := newFleet()
+	cli := newFleetStubClient(t, stub)
+
+	summary, err := cli.CreateDeploymentForSelector(fleetDeploymentReq(), map[string]string{"site": "plant-7"}, WithDryRun())
+	require.NoError(t, err)
+
+	assert.True(t, summary.DryRun)
+	assert.Equal(t, []string{"device-a", "device-b", "device-c", "device-e"}, summary.Targeted)
+	assert.Len(t, summary.Skipped, 1)
+	assert.Empty(t, summary.Succeeded)
+	assert.Empty(t, summary.Failed)
+	assert.Empty(t, stub.deployed, "a dry run creates no deployment")
+}
+
+func TestCreateDeploymentForSelector_InvalidSelector(t *testing.T) {
+	stub := newFleet()
+	cli := newFleetStubClient(t, stub)
+
+	_, err := cli.CreateDeploymentForSelector(fleetDeploymentReq(), nil)
+	assert.Error(t, err, "an empty selector would target the whole fleet")
+	_, err = cli.CreateDeploymentForSelector(fleetDeploymentReq(), map[string]string{"site": "plant 7"})
+	assert.Error(t, err)
+	assert.Empty(t, stub.devices.queries, "nothing is listed")
+}
@@ -0,0 +1,314 @@
+package wfm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	nonStdWfmNbi "github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+)
+
+// Exit codes of a deployment validation, see DeploymentValidationResult.ExitCode
+const (
+	ValidationExitOK       = 0
+	ValidationExitWarnings = 1
+	ValidationExitErrors   = 2
+)
+
+// OutputFormat selects how a validation result is rendered
+type OutputFormat string
+
+const (
+	OutputTable OutputFormat = "table"
+	OutputJSON  OutputFormat = "json"
+)
+
+// validateDeploymentPath is appended to the deployments collection URL
+const validateDeploymentPath = "validate"
+
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// ValidationIssue is one finding of a deployment validation
+type ValidationIssue struct {
+	// Field is the path of the offending field in the deployment request, e.g. spec.appPackageRef.id
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+}
+
+// DeploymentValidationResult is the outcome of ValidateDeployment
+type DeploymentValidationResult struct {
+	Errors   []ValidationIssue `json:"errors"`
+	Warnings []ValidationIssue `json:"warnings"`
+	// ServerValidated is false when only the client side checks ran
+	ServerValidated bool `json:"serverValidated"`
+	// Notice explains why the server did not validate the request
+	Notice string `json:"notice,omitempty"`
+}
+
+// Valid reports whether the deployment has no errors, warnings do not make it invalid
+func (r *DeploymentValidationResult) Valid() bool {
+	return len(r.Errors) == 0
+}
+
+// HasWarnings reports whether the validation produced warnings
+func (r *DeploymentValidationResult) HasWarnings() bool {
+	return len(r.Warnings) > 0
+}
+
+// ExitCode maps the result to the exit code of a validate-only run: 0 when clean, 2 on errors
+// and 1 on warnings only when strict, otherwise warnings pass
+func (r *DeploymentValidationResult) ExitCode(strict bool) int {
+	switch {
+	case !r.Valid():
+		return ValidationExitErrors
+	case strict && r.HasWarnings():
+		return ValidationExitWarnings
+	default:
+		return ValidationExitOK
+	}
+}
+
+// Render writes the result in the given format
+func (r *DeploymentValidationResult) Render(w io.Writer, format OutputFormat) error {
+	switch format {
+	case OutputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case OutputTable, "":
+		return r.renderTable(w)
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+func (r *DeploymentValidationResult) renderTable(w io.Writer) error {
+	if r.Notice != "" {
+		if _, err := fmt.Fprintf(w, "NOTE: %s\n", r.Notice); err != nil {
+			return err
+		}
+	}
+	if len(r.Errors) == 0 && len(r.Warnings) == 0 {
+		_, err := fmt.Fprintln(w, "deployment is valid")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEVERITY\tFIELD\tCODE\tMESSAGE")
+	for _, issue := range r.Errors {
+		fmt.Fprintf(tw, "error\t%s\t%s\t%s\n", issue.Field, issue.Code, issue.Message)
+	}
+	for _, issue := range r.Warnings {
+		fmt.Fprintf(tw, "warning\t%s\t%s\t%s\n", issue.Field, issue.Code, issue.Message)
+	}
+	return tw.Flush()
+}
+
+// deploymentValidationSupport caches whether the server offers the validation endpoint
+type deploymentValidationSupport struct {
+	mu        sync.Mutex
+	known     bool
+	supported bool
+	reason    string
+}
+
+// ValidateDeployment is ValidateDeploymentWithContext without a caller context, the client timeout
+// bounds its requests.
+//
+// Deprecated: use ValidateDeploymentWithContext.
+func (cli *NbiApiClient) ValidateDeployment(params DeploymentReq) (*DeploymentValidationResult, error) {
+	return cli.ValidateDeploymentWithContext(context.Background(), params)
+}
+
+// ValidateDeploymentWithContext dry-runs a deployment request without creating it.
+//
+// The request is always checked on the client side. When the server offers the validation
+// endpoint, which is detected once per client with an OPTIONS request, the request is also
+// validated by the server and the findings of both are merged. Otherwise the result carries a
+// "server validation unavailable" notice and only the client side findings.
+//
+// Parameters:
+//   - ctx: Cancels the requests, each one is bounded by the client timeout when ctx has no deadline
+//   - params: The deployment request that would be passed to CreateDeployment
+//
+// Returns:
+//   - *DeploymentValidationResult: The errors and warnings with their field paths
+//   - error: An error if the validation request itself cannot be processed
+func (cli *NbiApiClient) ValidateDeploymentWithContext(ctx context.Context, params DeploymentReq) (*DeploymentValidationResult, error) {
+	result := &DeploymentValidationResult{Errors: validateDeploymentLocally(params)}
+
+	supported, reason := cli.serverValidatesDeployments(ctx)
+	if !supported {
+		result.Notice = "server validation unavailable: " + reason
+		return result, nil
+	}
+
+	client, err := cli.createNonStdNbiClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := cli.requestContext(ctx)
+	defer cancel()
+
+	// the generated client has no validate operation, reuse the body of the create operation
+	req, err := nonStdWfmNbi.NewCreateApplicationDeploymentRequest(client.Server, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create validate app deployment request: %w", err)
+	}
+	req.URL = req.URL.JoinPath(validateDeploymentPath)
+	req = req.WithContext(ctx)
+
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("validate app deployment request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read validate app deployment response: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case 200, 422:
+		var serverResult DeploymentValidationResult
+		if err := json.Unmarshal(body, &serverResult); err != nil {
+			return nil, fmt.Errorf("failed to parse validate app deployment response: %w", err)
+		}
+		result.ServerValidated = true
+		result.Errors = mergeValidationIssues(result.Errors, serverResult.Errors)
+		result.Warnings = mergeValidationIssues(result.Warnings, serverResult.Warnings)
+		return result, nil
+	default:
+		return nil, cli.handleErrorResponse(body, resp.StatusCode, "validate app deployment")
+	}
+}
+
+// serverValidatesDeployments detects the validation endpoint, the outcome is kept for the
+// lifetime of the client unless the detection request failed
+func (cli *NbiApiClient) serverValidatesDeployments(ctx context.Context) (bool, string) {
+	support := &cli.validationSupport
+	support.mu.Lock()
+	defer support.mu.Unlock()
+	if support.known {
+		return support.supported, support.reason
+	}
+
+	supported, reason, err := cli.detectDeploymentValidation(ctx)
+	if err != nil {
+		// a network failure says nothing about the server, detect again next time
+		return false, err.Error()
+	}
+	support.known = true
+	support.supported = supported
+	support.reason = reason
+	return supported, reason
+}
+
+func (cli *NbiApiClient) detectDeploymentValidation(ctx context.Context) (bool, string, error) {
+	client, err := cli.createNonStdNbiClient()
+	if err != nil {
+		return false, "", err
+	}
+
+	ctx, cancel := cli.requestContext(ctx)
+	defer cancel()
+
+	req, err := nonStdWfmNbi.NewCreateApplicationDeploymentRequestWithBody(client.Server, "application/json", nil)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to create validation capability request: %w", err)
+	}
+	req.URL = req.URL.JoinPath(validateDeploymentPath)
+	req.Method = http.MethodOptions
+	req = req.WithContext(ctx)
+
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		return false, "", fmt.Errorf("validation capability request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == 404 || resp.StatusCode == 405 || resp.StatusCode == 501:
+		return false, fmt.Sprintf("the server does not offer the validation endpoint (status %d)", resp.StatusCode), nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return false, "", fmt.Errorf("validation capability request failed with status %d", resp.StatusCode)
+	}
+	// a server that answers OPTIONS without an Allow header is taken at its word
+	allow := resp.Header.Get("Allow")
+	if allow == "" {
+		return true, "", nil
+	}
+	for _, method := range strings.Split(allow, ",") {
+		if strings.EqualFold(strings.TrimSpace(method), http.MethodPost) {
+			return true, "", nil
+		}
+	}
+	return false, fmt.Sprintf("the validation endpoint does not accept POST (allows %s)", allow), nil
+}
+
+// validateDeploymentLocally runs the checks that need no server
+func validateDeploymentLocally(params DeploymentReq) []ValidationIssue {
+	var issues []ValidationIssue
+	add := func(field, code, message string) {
+		issues = append(issues, ValidationIssue{Field: field, Code: code, Message: message})
+	}
+
+	if params.ApiVersion == "" {
+		add("apiVersion", "REQUIRED", "apiVersion cannot be empty")
+	}
+	if params.Kind == "" {
+		add("kind", "REQUIRED", "kind cannot be empty")
+	} else if params.Kind != "ApplicationDeployment" {
+		add("kind", "INVALID_VALUE", fmt.Sprintf("kind must be ApplicationDeployment, got %q", params.Kind))
+	}
+	if params.Metadata.Name == "" {
+		add("metadata.name", "REQUIRED", "deployment name cannot be empty")
+	}
+	if params.Spec.AppPackageRef.Id == "" {
+		add("spec.appPackageRef.id", "REQUIRED", "package ID cannot be empty")
+	}
+	if digest := params.Spec.AppPackageRef.Digest; digest != nil && !digestPattern.MatchString(*digest) {
+		add("spec.appPackageRef.digest", "INVALID_FORMAT", fmt.Sprintf("digest %q is not of the form sha256:<64 hex characters>", *digest))
+	}
+
+	profile := params.Spec.DeploymentProfile
+	switch profile.Type {
+	case nonStdWfmNbi.DeploymentExecutionProfileTypeCompose, nonStdWfmNbi.DeploymentExecutionProfileTypeHelmV3:
+	case "":
+		add("spec.deploymentProfile.type", "REQUIRED", "deployment profile type cannot be empty")
+	default:
+		add("spec.deploymentProfile.type", "INVALID_VALUE", fmt.Sprintf("unsupported deployment profile type %q", profile.Type))
+	}
+	if len(profile.Components) == 0 {
+		add("spec.deploymentProfile.components", "REQUIRED", "deployment profile needs at least one component")
+	}
+	return issues
+}
+
+// mergeValidationIssues appends the server findings that the client did not report already
+func mergeValidationIssues(local, server []ValidationIssue) []ValidationIssue {
+	merged := append([]ValidationIssue{}, local...)
+	for _, issue := range server {
+		duplicate := false
+		for _, known := range local {
+			if known.Field == issue.Field && known.Code == issue.Code {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			merged = append(merged, issue)
+		}
+	}
+	return merged
+}
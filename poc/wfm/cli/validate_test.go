@@ -0,0 +1,185 @@
+package wfm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/margo/sandbox/shared-lib/http/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// validationStub serves the validation endpoint when withEndpoint is set and records the requests
+type validationStub struct {
+	mu                 sync.Mutex
+	withEndpoint       bool
+	optionsRequests    int
+	validated          []string
+	createdDeployments []string
+}
+
+func (s *validationStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/app-deployments/validate") && s.withEndpoint:
+		switch r.Method {
+		case http.MethodOptions:
+			s.optionsRequests++
+			w.Header().Set("Allow", "OPTIONS, POST")
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPost:
+			body, _ := io.ReadAll(r.Body)
+			s.validated = append(s.validated, string(body))
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{
+				"errors": [{"field": "spec.parameters.pollFrequency", "code": "NO_TARGET", "message": "component poller does not exist"}],
+				"warnings": [{"field": "spec.deviceRef", "code": "NO_DEVICES", "message": "no device matches the selector"}]
+			}`))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case strings.HasSuffix(r.URL.Path, "/app-deployments/validate"):
+		s.optionsRequests++
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/app-deployments"):
+		body, _ := io.ReadAll(r.Body)
+		s.createdDeployments = append(s.createdDeployments, string(body))
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newValidationStubClient(t *testing.T, stub *validationStub) *NbiApiClient {
+	t.Helper()
+	server := clienttest.NewTLSServer(t, stub)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseUint(serverURL.Port(), 10, 16)
+	require.NoError(t, err)
+
+	return NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil,
+		WithClientFactory(newTestClientFactory(t, server, "")))
+}
+
+func TestValidateDeployment_ServerEndpoint(t *testing.T) {
+	stub := &validationStub{withEndpoint: true}
+	cli := newValidationStubClient(t, stub)
+
+	req := newTestDeploymentReq(t)
+	malformed := "sha256:nope"
+	req.Spec.AppPackageRef.Digest = &malformed
+
+	result, err := cli.ValidateDeployment(req)
+	require.NoError(t, err)
+	assert.True(t, result.ServerValidated)
+	assert.Empty(t, result.Notice)
+	require.Len(t, result.Errors, 2, "client and server errors are merged")
+	assert.Equal(t, "spec.appPackageRef.digest", result.Errors[0].Field)
+	assert.Equal(t, "spec.parameters.pollFrequency", result.Errors[1].Field)
+	require.Len(t, result.Warnings, 1)
+	assert.Equal(t, "spec.deviceRef", result.Warnings[0].Field)
+	assert.Equal(t, ValidationExitErrors, result.ExitCode(false))
+
+	_, err = cli.ValidateDeployment(newTestDeploymentReq(t))
+	require.NoError(t, err)
+	assert.Equal(t, 1, stub.optionsRequests, "the endpoint is detected once per client")
+	assert.Len(t, stub.validated, 2)
+	assert.Empty(t, stub.createdDeployments, "validation never creates the deployment")
+}
+
+func TestValidateDeployment_FallsBackToClientSide(t *testing.T) {
+	stub := &validationStub{}
+	cli := newValidationStubClient(t, stub)
+
+	result, err := cli.ValidateDeployment(newTestDeploymentReq(t))
+	require.NoError(t, err)
+	assert.False(t, result.ServerValidated)
+	assert.True(t, strings.HasPrefix(result.Notice, "server validation unavailable"), result.Notice)
+	assert.True(t, result.Valid())
+	assert.Equal(t, ValidationExitOK, result.ExitCode(true))
+
+	var invalid DeploymentReq
+	result, err = cli.ValidateDeployment(invalid)
+	require.NoError(t, err)
+	assert.False(t, result.ServerValidated)
+	var fields []string
+	for _, issue := range result.Errors {
+		fields = append(fields, issue.Field)
+	}
+	assert.Equal(t, []string{
+		"apiVersion",
+		"kind",
+		"metadata.name",
+		"spec.appPackageRef.id",
+		"spec.deploymentProfile.type",
+		"spec.deploymentProfile.components",
+	}, fields)
+
+	assert.Equal(t, 1, stub.optionsRequests)
+	assert.Empty(t, stub.validated)
+	assert.Empty(t, stub.createdDeployments)
+}
+
+func TestDeploymentValidationResult_ExitCode(t *testing.T) {
+	issue := ValidationIssue{Field: "metadata.name", Message: "deployment name cannot be empty"}
+	tests := []struct {
+		name   string
+		result DeploymentValidationResult
+		strict bool
+		want   int
+	}{
+		{"clean", DeploymentValidationResult{}, false, ValidationExitOK},
+		{"clean strict", DeploymentValidationResult{}, true, ValidationExitOK},
+		{"warnings only", DeploymentValidationResult{Warnings: []ValidationIssue{issue}}, false, ValidationExitOK},
+		{"warnings only strict", DeploymentValidationResult{Warnings: []ValidationIssue{issue}}, true, ValidationExitWarnings},
+		{"errors", DeploymentValidationResult{Errors: []ValidationIssue{issue}}, false, ValidationExitErrors},
+		{"errors and warnings strict", DeploymentValidationResult{Errors: []ValidationIssue{issue}, Warnings: []ValidationIssue{issue}}, true, ValidationExitErrors},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.result.ExitCode(tt.strict))
+		})
+	}
+}
+
+func TestDeploymentValidationResult_Render(t *testing.T) {
+	result := &DeploymentValidationResult{
+		Errors:   []ValidationIssue{{Field: "spec.appPackageRef.id", Code: "REQUIRED", Message: "package ID cannot be empty"}},
+		Warnings: []ValidationIssue{{Field: "spec.deviceRef", Code: "NO_DEVICES", Message: "no device matches the selector"}},
+		Notice:   "server validation unavailable: the server does not offer the validation endpoint (status 404)",
+	}
+
+	var table bytes.Buffer
+	require.NoError(t, result.Render(&table, OutputTable))
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, "NOTE: "+result.Notice, lines[0])
+	assert.Regexp(t, `^SEVERITY\s+FIELD\s+CODE\s+MESSAGE$`, lines[1])
+	assert.Regexp(t, `^error\s+spec\.appPackageRef\.id\s+REQUIRED\s+package ID cannot be empty$`, lines[2])
+	assert.Regexp(t, `^warning\s+spec\.deviceRef\s+NO_DEVICES\s+no device matches the selector$`, lines[3])
+
+	var encoded bytes.Buffer
+	require.NoError(t, result.Render(&encoded, OutputJSON))
+	var decoded DeploymentValidationResult
+	require.NoError(t, json.Unmarshal(encoded.Bytes(), &decoded))
+	assert.Equal(t, *result, decoded)
+
+	var clean bytes.Buffer
+	require.NoError(t, (&DeploymentValidationResult{ServerValidated: true}).Render(&clean, OutputTable))
+	assert.Equal(t, "deployment is valid\n", clean.String())
+
+	assert.Error(t, result.Render(io.Discard, "yaml"))
+}
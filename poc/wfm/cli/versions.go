@@ -0,0 +1,338 @@
+package wfm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	nonStdWfmNbi "github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+)
+
+// The NBI has no notion of versions or channels, the client keeps them in package labels:
+// packages sharing the app id label are versions of the same application, and the channel
+// label is what PromotePackage moves between channels.
+const (
+	// LabelAppId holds the application id (metadata.id of the application description),
+	// packages without it are grouped by their name
+	LabelAppId = "app.margo.org/id"
+	// LabelAppVersion holds the application version (metadata.version of the application description)
+	LabelAppVersion = "app.margo.org/version"
+	// LabelChannel holds the release channel of the package, e.g. dev, beta or stable
+	LabelChannel = "app.margo.org/channel"
+)
+
+// ErrNoMatchingVersion is returned when no package version satisfies the requested constraint
+type ErrNoMatchingVersion struct {
+	AppId      string
+	Channel    string
+	Constraint string
+	// NonSemver lists the versions that were skipped because they are not semantic versions
+	NonSemver []string
+}
+
+func (e *ErrNoMatchingVersion) Error() string {
+	msg := fmt.Sprintf("no version of app %s matches constraint %q", e.AppId, e.Constraint)
+	if e.Channel != "" {
+		msg += fmt.Sprintf(" in channel %s", e.Channel)
+	}
+	if len(e.NonSemver) > 0 {
+		msg += fmt.Sprintf(" (skipped non-semver versions: %s)", strings.Join(e.NonSemver, ", "))
+	}
+	return msg
+}
+
+// ErrPackageUpdateUnsupported is returned when the server does not offer the package update endpoint
+var ErrPackageUpdateUnsupported = errors.New("the server does not support updating application packages")
+
+// AppPkgVersion is one version of an application
+type AppPkgVersion struct {
+	// Version is nil when RawVersion is not a semantic version
+	Version    *semver.Version
+	RawVersion string
+	Channel    string
+	Package    AppPkgSummary
+}
+
+// PkgId returns the server generated id of the package
+func (v AppPkgVersion) PkgId() string {
+	if v.Package.Metadata.Id == nil {
+		return ""
+	}
+	return *v.Package.Metadata.Id
+}
+
+// ListAppPkgVersionsOption configures optional behavior of ListAppPkgVersions and GetLatestAppPkg
+type ListAppPkgVersionsOption func(*listAppPkgVersionsOptions)
+
+type listAppPkgVersionsOptions struct {
+	channel string
+}
+
+// InChannel only selects the packages promoted to the given channel
+func InChannel(channel string) ListAppPkgVersionsOption {
+	return func(opts *listAppPkgVersionsOptions) {
+		opts.channel = channel
+	}
+}
+
+// AppPkgAppId returns the application id a package belongs to
+func AppPkgAppId(pkg *AppPkgSummary) string {
+	if id := appPkgLabel(pkg, LabelAppId); id != "" {
+		return id
+	}
+	if pkg == nil {
+		return ""
+	}
+	return pkg.Metadata.Name
+}
+
+// AppPkgVersionOf returns the application version of a package, or an empty string if it has none
+func AppPkgVersionOf(pkg *AppPkgSummary) string {
+	return appPkgLabel(pkg, LabelAppVersion)
+}
+
+// AppPkgChannel returns the channel a package was promoted to, or an empty string if it has none
+func AppPkgChannel(pkg *AppPkgSummary) string {
+	return appPkgLabel(pkg, LabelChannel)
+}
+
+func appPkgLabel(pkg *AppPkgSummary, key string) string {
+	if pkg == nil || pkg.Metadata.Labels == nil {
+		return ""
+	}
+	return (*pkg.Metadata.Labels)[key]
+}
+
+// ListAppPkgVersions is ListAppPkgVersionsWithContext without a caller context, the client timeout
+// bounds its requests.
+//
+// Deprecated: use ListAppPkgVersionsWithContext.
+func (cli *NbiApiClient) ListAppPkgVersions(appId string, opts ...ListAppPkgVersionsOption) ([]AppPkgVersion, error) {
+	return cli.ListAppPkgVersionsWithContext(context.Background(), appId, opts...)
+}
+
+// ListAppPkgVersionsWithContext retrieves the versions of an application, newest first.
+//
+// The NBI has no versions endpoint, so all packages are listed and grouped by their app id
+// label. Versions that are not semantic versions are kept and sorted after the others.
+//
+// Parameters:
+//   - ctx: Cancels the requests, each one is bounded by the client timeout when ctx has no deadline
+//   - appId: The application id, see LabelAppId
+//   - opts: InChannel to only select the packages of a channel
+//
+// Returns:
+//   - []AppPkgVersion: The versions of the application, empty if it has none
+//   - error: An error if the packages cannot be listed
+func (cli *NbiApiClient) ListAppPkgVersionsWithContext(ctx context.Context, appId string, opts ...ListAppPkgVersionsOption) ([]AppPkgVersion, error) {
+	if appId == "" {
+		return nil, fmt.Errorf("app ID cannot be empty")
+	}
+	options := &listAppPkgVersionsOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	pkgs, err := cli.ListAllAppPkgs(ctx, ListAppPkgsParams{})
+	if err != nil {
+		return nil, err
+	}
+	return groupAppPkgVersions(pkgs, appId, options.channel), nil
+}
+
+// groupAppPkgVersions selects the packages of an application and sorts them newest first
+func groupAppPkgVersions(pkgs []AppPkgSummary, appId, channel string) []AppPkgVersion {
+	var versions []AppPkgVersion
+	for i := range pkgs {
+		pkg := &pkgs[i]
+		if AppPkgAppId(pkg) != appId {
+			continue
+		}
+		if channel != "" && AppPkgChannel(pkg) != channel {
+			continue
+		}
+		version := AppPkgVersion{
+			RawVersion: AppPkgVersionOf(pkg),
+			Channel:    AppPkgChannel(pkg),
+			Package:    *pkg,
+		}
+		if parsed, err := semver.NewVersion(version.RawVersion); err == nil {
+			version.Version = parsed
+		}
+		versions = append(versions, version)
+	}
+	sortAppPkgVersions(versions)
+	return versions
+}
+
+// sortAppPkgVersions sorts semantic versions newest first (a prerelease before its release),
+// followed by the other versions in reverse lexical order
+func sortAppPkgVersions(versions []AppPkgVersion) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		switch {
+		case a.Version != nil && b.Version != nil:
+			if cmp := a.Version.Compare(b.Version); cmp != 0 {
+				return cmp > 0
+			}
+			// 1.0 and 1.0.0 are the same version, keep the order stable on the raw value
+			return a.RawVersion > b.RawVersion
+		case a.Version != nil:
+			return true
+		case b.Version != nil:
+			return false
+		default:
+			return a.RawVersion > b.RawVersion
+		}
+	})
+}
+
+// GetLatestAppPkg is GetLatestAppPkgWithContext without a caller context, the client timeout bounds
+// its requests.
+//
+// Deprecated: use GetLatestAppPkgWithContext.
+func (cli *NbiApiClient) GetLatestAppPkg(appId, constraint string, opts ...ListAppPkgVersionsOption) (*AppPkgVersion, error) {
+	return cli.GetLatestAppPkgWithContext(context.Background(), appId, constraint, opts...)
+}
+
+// GetLatestAppPkgWithContext retrieves the newest version of an application satisfying a semver
+// constraint.
+//
+// Prereleases are only selected when the constraint mentions a prerelease, e.g. ">= 2.0.0-0".
+//
+// Parameters:
+//   - ctx: Cancels the requests, each one is bounded by the client timeout when ctx has no deadline
+//   - appId: The application id, see LabelAppId
+//   - constraint: A semver constraint such as "^1.2" or ">= 1.0, < 2.0", empty selects any version
+//   - opts: InChannel to only select the packages of a channel
+//
+// Returns:
+//   - *AppPkgVersion: The newest matching version
+//   - error: *ErrNoMatchingVersion if no version matches, or an error if the constraint is
+//     invalid or the packages cannot be listed
+func (cli *NbiApiClient) GetLatestAppPkgWithContext(ctx context.Context, appId, constraint string, opts ...ListAppPkgVersionsOption) (*AppPkgVersion, error) {
+	options := &listAppPkgVersionsOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	versions, err := cli.ListAppPkgVersionsWithContext(ctx, appId, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return latestAppPkgVersion(versions, appId, options.channel, constraint)
+}
+
+// latestAppPkgVersion picks the newest version satisfying the constraint, versions must be sorted
+func latestAppPkgVersion(versions []AppPkgVersion, appId, channel, constraint string) (*AppPkgVersion, error) {
+	if strings.TrimSpace(constraint) == "" {
+		constraint = "*"
+	}
+	constraints, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version constraint %q: %w", constraint, err)
+	}
+
+	var nonSemver []string
+	for i := range versions {
+		if versions[i].Version == nil {
+			nonSemver = append(nonSemver, fmt.Sprintf("%q (package %s)", versions[i].RawVersion, versions[i].PkgId()))
+			continue
+		}
+		if constraints.Check(versions[i].Version) {
+			return &versions[i], nil
+		}
+	}
+	return nil, &ErrNoMatchingVersion{AppId: appId, Channel: channel, Constraint: constraint, NonSemver: nonSemver}
+}
+
+// PromotePackage is PromotePackageWithContext without a caller context, the client timeout bounds
+// its requests.
+//
+// Deprecated: use PromotePackageWithContext.
+func (cli *NbiApiClient) PromotePackage(pkgId, channel string) (*AppPkgSummary, error) {
+	return cli.PromotePackageWithContext(context.Background(), pkgId, channel)
+}
+
+// PromotePackageWithContext moves a package to a release channel by setting its channel label.
+//
+// The label is set with a JSON merge patch on the package, the other labels are kept.
+//
+// Parameters:
+//   - ctx: Cancels the requests, each one is bounded by the client timeout when ctx has no deadline
+//   - pkgId: The unique identifier of the package to promote
+//   - channel: The channel to promote the package to, e.g. beta or stable
+//
+// Returns:
+//   - *AppPkgSummary: The updated package
+//   - error: ErrPackageUpdateUnsupported if the server cannot update packages, or an error if
+//     the request cannot be processed
+func (cli *NbiApiClient) PromotePackageWithContext(ctx context.Context, pkgId, channel string) (*AppPkgSummary, error) {
+	if pkgId == "" {
+		return nil, fmt.Errorf("package ID cannot be empty")
+	}
+	if channel == "" {
+		return nil, fmt.Errorf("channel cannot be empty")
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{LabelChannel: channel},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode package update: %w", err)
+	}
+
+	client, err := cli.createNonStdNbiClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := cli.requestContext(ctx)
+	defer cancel()
+
+	// the generated client has no update operation, reuse the package URL of the get operation
+	req, err := nonStdWfmNbi.NewGetAppPackageRequest(client.Server, pkgId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create update app package request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Method = http.MethodPatch
+	req.Body = io.NopCloser(bytes.NewReader(patch))
+	req.ContentLength = int64(len(patch))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("update app package request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read update app package response: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		var pkg AppPkgSummary
+		if err := json.Unmarshal(body, &pkg); err != nil {
+			return nil, fmt.Errorf("failed to parse update app package response: %w", err)
+		}
+		return &pkg, nil
+	case 204:
+		return cli.GetAppPkgWithContext(ctx, pkgId)
+	case 405, 501:
+		return nil, ErrPackageUpdateUnsupported
+	default:
+		return nil, cli.handleErrorResponse(body, resp.StatusCode, "update app package")
+	}
+}
@@ -0,0 +1,323 @@
+package wfm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	nonStdWfmNbi "github.com/margo/sandbox/non-standard/generatedCode/wfm/nbi"
+	"github.com/margo/sandbox/shared-lib/http/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newVersionedPkg(id, appId, version, channel string) AppPkgSummary {
+	labels := map[string]string{}
+	if appId != "" {
+		labels[LabelAppId] = appId
+	}
+	if version != "" {
+		labels[LabelAppVersion] = version
+	}
+	if channel != "" {
+		labels[LabelChannel] = channel
+	}
+	pkg := AppPkgSummary{ApiVersion: "margo.org", Kind: "ApplicationPackage"}
+	pkg.Metadata.Id = &id
+	pkg.Metadata.Name = id
+	pkg.Metadata.Labels = &labels
+	return pkg
+}
+
+func pkgIds(versions []AppPkgVersion) []string {
+	ids := make([]string, 0, len(versions))
+	for _, version := range versions {
+		ids = append(ids, version.PkgId())
+	}
+	return ids
+}
+
+func TestGroupAppPkgVersions_Sorting(t *testing.T) {
+	pkgs := []AppPkgSummary{
+		newVersionedPkg("pkg-1.0.0", "app", "1.0.0", "stable"),
+		newVersionedPkg("pkg-other", "other-app", "9.0.0", "stable"),
+		newVersionedPkg("pkg-1.10.0", "app", "1.10.0", "stable"),
+		newVersionedPkg("pkg-nightly", "app", "nightly", "dev"),
+		newVersionedPkg("pkg-1.2.0", "app", "v1.2.0", "beta"),
+		newVersionedPkg("pkg-2.0.0-rc.1", "app", "2.0.0-rc.1", "beta"),
+		newVersionedPkg("pkg-2.0.0-alpha", "app", "2.0.0-alpha", "dev"),
+		newVersionedPkg("pkg-latest", "app", "latest", "dev"),
+		newVersionedPkg("pkg-unversioned", "app", "", ""),
+	}
+
+	tests := []struct {
+		name    string
+		appId   string
+		channel string
+		want    []string
+	}{
+		{
+			name:  "semver newest first, prereleases before their release, non-semver last",
+			appId: "app",
+			want: []string{"pkg-2.0.0-rc.1", "pkg-2.0.0-alpha", "pkg-1.10.0", "pkg-1.2.0", "pkg-1.0.0",
+				"pkg-nightly", "pkg-latest", "pkg-unversioned"},
+		},
+		{
+			name:    "channel filter",
+			appId:   "app",
+			channel: "beta",
+			want:    []string{"pkg-2.0.0-rc.1", "pkg-1.2.0"},
+		},
+		{
+			name:  "other app",
+			appId: "other-app",
+			want:  []string{"pkg-other"},
+		},
+		{
+			name:  "unknown app",
+			appId: "missing",
+			want:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, pkgIds(groupAppPkgVersions(pkgs, tt.appId, tt.channel)))
+		})
+	}
+}
+
+func TestGroupAppPkgVersions_FallsBackToName(t *testing.T) {
+	pkg := newVersionedPkg("pkg-1", "", "1.0.0", "")
+	pkg.Metadata.Name = "my-app"
+
+	versions := groupAppPkgVersions([]AppPkgSummary{pkg}, "my-app", "")
+	require.Len(t, versions, 1)
+	assert.Equal(t, "1.0.0", versions[0].Version.String())
+}
+
+func TestLatestAppPkgVersion(t *testing.T) {
+	versions := groupAppPkgVersions([]AppPkgSummary{
+		newVersionedPkg("pkg-1.0.0", "app", "1.0.0", "stable"),
+		newVersionedPkg("pkg-1.4.2", "app", "1.4.2", "stable"),
+		newVersionedPkg("pkg-1.5.0-beta.2", "app", "1.5.0-beta.2", "beta"),
+		newVersionedPkg("pkg-2.0.0", "app", "2.0.0", "stable"),
+		newVersionedPkg("pkg-3.0.0-rc.1", "app", "3.0.0-rc.1", "beta"),
+		newVersionedPkg("pkg-latest", "app", "latest", "dev"),
+	}, "app", "")
+
+	tests := []struct {
+		name       string
+		constraint string
+		want       string
+		wantErr    string
+	}{
+		{name: "empty selects the newest release", constraint: "", want: "pkg-2.0.0"},
+		{name: "wildcard skips prereleases", constraint: "*", want: "pkg-2.0.0"},
+		{name: "caret", constraint: "^1.0", want: "pkg-1.4.2"},
+		{name: "tilde", constraint: "~1.4.0", want: "pkg-1.4.2"},
+		{name: "exact", constraint: "1.0.0", want: "pkg-1.0.0"},
+		{name: "range", constraint: ">= 1.0, < 2.0", want: "pkg-1.4.2"},
+		{name: "prerelease in constraint selects prereleases", constraint: ">= 3.0.0-0", want: "pkg-3.0.0-rc.1"},
+		{name: "prerelease of the same version", constraint: "~1.5.0-0", want: "pkg-1.5.0-beta.2"},
+		{
+			name:       "no match reports the skipped non-semver versions",
+			constraint: ">= 4.0",
+			wantErr:    `no version of app app matches constraint ">= 4.0" (skipped non-semver versions: "latest" (package pkg-latest))`,
+		},
+		{name: "invalid constraint", constraint: "not a constraint", wantErr: `invalid version constraint "not a constraint"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := latestAppPkgVersion(versions, "app", "", tt.constraint)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.PkgId())
+		})
+	}
+}
+
+func TestLatestAppPkgVersion_NoVersions(t *testing.T) {
+	_, err := latestAppPkgVersion(nil, "app", "stable", "^1.0")
+
+	var noMatch *ErrNoMatchingVersion
+	require.True(t, errors.As(err, &noMatch), "expected ErrNoMatchingVersion, got %v", err)
+	assert.Equal(t, "stable", noMatch.Channel)
+	assert.Equal(t, `no version of app app matches constraint "^1.0" in channel stable`, err.Error())
+}
+
+// versionsStub serves the packages in pages and records the package updates and deployments
+type versionsStub struct {
+	mu                 sync.Mutex
+	pkgs               []AppPkgSummary
+	pageSize           int
+	ignoreContinue     bool
+	updateStatus       int
+	listRequests       int
+	patches            []string
+	createdDeployments []string
+}
+
+func (s *versionsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/app-packages"):
+		s.listRequests++
+		offset := 0
+		if token := r.URL.Query().Get("continue"); token != "" && !s.ignoreContinue {
+			offset, _ = strconv.Atoi(token)
+		}
+		end := min(offset+s.pageSize, len(s.pkgs))
+		more := end < len(s.pkgs)
+		json.NewEncoder(w).Encode(ListAppPkgsResp{
+			ApiVersion: "margo.org",
+			Kind:       "ApplicationPackageList",
+			Items:      s.pkgs[offset:end],
+			Metadata:   &nonStdWfmNbi.PaginationMetadata{Continue: &more},
+		})
+	case r.Method == http.MethodPatch && strings.Contains(r.URL.Path, "/app-packages/"):
+		if s.updateStatus != 0 {
+			w.WriteHeader(s.updateStatus)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		s.patches = append(s.patches, r.Header.Get("Content-Type")+" "+string(body))
+
+		var patch struct {
+			Metadata struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+		}
+		json.Unmarshal(body, &patch)
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		for i := range s.pkgs {
+			if *s.pkgs[i].Metadata.Id == id {
+				for key, value := range patch.Metadata.Labels {
+					(*s.pkgs[i].Metadata.Labels)[key] = value
+				}
+				json.NewEncoder(w).Encode(s.pkgs[i])
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/app-deployments"):
+		body, _ := io.ReadAll(r.Body)
+		s.createdDeployments = append(s.createdDeployments, string(body))
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(body)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newVersionsStubClient(t *testing.T, stub *versionsStub) *NbiApiClient {
+	t.Helper()
+	server := clienttest.NewTLSServer(t, stub)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.ParseUint(serverURL.Port(), 10, 16)
+	require.NoError(t, err)
+
+	return NewNbiHTTPCli(serverURL.Hostname(), uint16(port), nil,
+		WithClientFactory(newTestClientFactory(t, server, "")))
+}
+
+func TestListAppPkgVersions_FollowsPagination(t *testing.T) {
+	stub := &versionsStub{pageSize: 2, pkgs: []AppPkgSummary{
+		newVersionedPkg("pkg-a", "app", "1.0.0", "stable"),
+		newVersionedPkg("pkg-b", "other-app", "1.0.0", "stable"),
+		newVersionedPkg("pkg-c", "app", "1.1.0", "beta"),
+		newVersionedPkg("pkg-d", "other-app", "2.0.0", "stable"),
+		newVersionedPkg("pkg-e", "app", "1.2.0", "stable"),
+	}}
+	cli := newVersionsStubClient(t, stub)
+
+	versions, err := cli.ListAppPkgVersions("app")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pkg-e", "pkg-c", "pkg-a"}, pkgIds(versions))
+	assert.Equal(t, 3, stub.listRequests)
+
+	versions, err = cli.ListAppPkgVersions("app", InChannel("stable"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pkg-e", "pkg-a"}, pkgIds(versions))
+
+	_, err = cli.ListAppPkgVersions("")
+	assert.Error(t, err)
+}
+
+func TestListAllAppPkgs_ServerIgnoresContinue(t *testing.T) {
+	stub := &versionsStub{pageSize: 1, ignoreContinue: true, pkgs: []AppPkgSummary{
+		newVersionedPkg("pkg-a", "app", "1.0.0", ""),
+		newVersionedPkg("pkg-b", "app", "1.1.0", ""),
+	}}
+	cli := newVersionsStubClient(t, stub)
+
+	_, err := cli.ListAllAppPkgs(context.Background(), ListAppPkgsParams{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not support pagination")
+}
+
+func TestPromotePackage(t *testing.T) {
+	stub := &versionsStub{pageSize: 10, pkgs: []AppPkgSummary{
+		newVersionedPkg("pkg-a", "app", "1.0.0", "stable"),
+		newVersionedPkg("pkg-b", "app", "1.1.0", "beta"),
+	}}
+	cli := newVersionsStubClient(t, stub)
+
+	pkg, err := cli.PromotePackage("pkg-b", "stable")
+	require.NoError(t, err)
+	assert.Equal(t, "stable", AppPkgChannel(pkg))
+	assert.Equal(t, "1.1.0", AppPkgVersionOf(pkg), "the other labels are kept")
+	require.Len(t, stub.patches, 1)
+	assert.Equal(t, `application/merge-patch+json {"metadata":{"labels":{"app.margo.org/channel":"stable"}}}`, stub.patches[0])
+
+	latest, err := cli.GetLatestAppPkg("app", "", InChannel("stable"))
+	require.NoError(t, err)
+	assert.Equal(t, "pkg-b", latest.PkgId())
+
+	_, err = cli.PromotePackage("pkg-a", "")
+	assert.Error(t, err)
+}
+
+func TestPromotePackage_Unsupported(t *testing.T) {
+	stub := &versionsStub{updateStatus: http.StatusMethodNotAllowed}
+	cli := newVersionsStubClient(t, stub)
+
+	_, err := cli.PromotePackage("pkg-a", "stable")
+	assert.ErrorIs(t, err, ErrPackageUpdateUnsupported)
+}
+
+func TestCreateDeployment_ResolvesAppPkg(t *testing.T) {
+	stub := &versionsStub{pageSize: 10, pkgs: []AppPkgSummary{
+		newVersionedPkg("pkg-1.0.0", "app", "1.0.0", "stable"),
+		newVersionedPkg("pkg-1.1.0", "app", "1.1.0", "stable"),
+		newVersionedPkg("pkg-2.0.0", "app", "2.0.0", "beta"),
+	}}
+	cli := newVersionsStubClient(t, stub)
+
+	_, err := cli.CreateDeployment(newTestDeploymentReq(t), WithAppPkgResolution("app", "stable", "^1.0"))
+	require.NoError(t, err)
+	require.Len(t, stub.createdDeployments, 1)
+	assert.Contains(t, stub.createdDeployments[0], `"appPackageRef":{"id":"pkg-1.1.0"}`)
+
+	_, err = cli.CreateDeployment(newTestDeploymentReq(t), WithAppPkgResolution("app", "stable", "^2.0"))
+	var noMatch *ErrNoMatchingVersion
+	require.True(t, errors.As(err, &noMatch), "expected ErrNoMatchingVersion, got %v", err)
+	assert.Len(t, stub.createdDeployments, 1, "nothing is submitted when no version matches")
+}
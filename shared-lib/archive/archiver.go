@@ -3,8 +3,6 @@ package archive
 import (
 	"archive/tar"
 	"compress/gzip"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -12,6 +10,8 @@ import (
 	"strings"
 	"time"
 	"sort"
+
+	"github.com/margo/sandbox/shared-lib/digest"
 )
 
 type ArchiveFormats string
@@ -236,14 +236,11 @@ func (a *Archiver) calculateDigestAndSize() (string, uint64, error) {
 	}
 	size := uint64(fileInfo.Size())
 
-	// Calculate SHA256 hash
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
+	d, err := digest.Compute(digest.Canonical, file)
+	if err != nil {
 		return "", 0, err
 	}
-
-	digest := hex.EncodeToString(hasher.Sum(nil))
-	return fmt.Sprintf("sha256:%s", digest), size, nil
+	return d.String(), size, nil
 }
 
 // GetEntries returns the list of entries that will be/were added to archive
@@ -4,29 +4,132 @@ import (
     "archive/tar"
     "bytes"
     "compress/gzip"
-    "crypto/sha256"
+    "errors"
     "fmt"
     "io"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+
+    "github.com/margo/sandbox/shared-lib/digest"
+)
+
+// Errors of bundles the extractor refuses, they wrap the details
+var (
+    // ErrBundleTooLarge is a bundle with more entries or bigger files than the extractor allows
+    ErrBundleTooLarge = errors.New("bundle too large")
+    // ErrUnsafePath is a bundle entry with an absolute path or a path leaving the bundle root
+    ErrUnsafePath = errors.New("unsafe path in bundle")
 )
 
-// BundleExtractor handles extraction of tar.gz bundles
+// ExtractorOptions limit what a bundle may unpack to, the extracted files are held in memory. Zero
+// values take the defaults of DefaultExtractorOptions.
+type ExtractorOptions struct {
+    // MaxTotalBytes caps the uncompressed size of all files together
+    MaxTotalBytes int64
+    // MaxFileBytes caps the uncompressed size of each file
+    MaxFileBytes int64
+    // MaxEntries caps the number of entries, directories and links included
+    MaxEntries int
+}
+
+// DefaultExtractorOptions are generous for bundles of deployment YAMLs but keep a compression bomb
+// from exhausting memory
+func DefaultExtractorOptions() ExtractorOptions {
+    return ExtractorOptions{
+        MaxTotalBytes: 200 << 20,
+        MaxFileBytes:  50 << 20,
+        MaxEntries:    10000,
+    }
+}
+
+func (o ExtractorOptions) withDefaults() ExtractorOptions {
+    defaults := DefaultExtractorOptions()
+    if o.MaxTotalBytes <= 0 {
+        o.MaxTotalBytes = defaults.MaxTotalBytes
+    }
+    if o.MaxFileBytes <= 0 {
+        o.MaxFileBytes = defaults.MaxFileBytes
+    }
+    if o.MaxEntries <= 0 {
+        o.MaxEntries = defaults.MaxEntries
+    }
+    return o
+}
+
+// BundleExtractor handles extraction of tar.gz bundles, the bundle is read through an io.ReaderAt
+// so that a bundle on disk is streamed rather than loaded
 type BundleExtractor struct {
-    bundleData []byte
-    entries    map[string][]byte
+    bundle  io.ReaderAt
+    size    int64
+    closer  io.Closer
+    entries map[string][]byte
+    options ExtractorOptions
 }
 
-// NewExtractor creates a new bundle extractor
+// NewExtractor creates a new bundle extractor with the default limits
 func NewExtractor(bundleData []byte) *BundleExtractor {
+    return NewExtractorWithOptions(bundleData, DefaultExtractorOptions())
+}
+
+// NewExtractorWithOptions creates a new bundle extractor with the given limits
+func NewExtractorWithOptions(bundleData []byte, options ExtractorOptions) *BundleExtractor {
+    return NewExtractorFromReaderAt(bytes.NewReader(bundleData), int64(len(bundleData)), options)
+}
+
+// NewExtractorFromReaderAt creates a bundle extractor of the size bytes of bundle with the given limits
+func NewExtractorFromReaderAt(bundle io.ReaderAt, size int64, options ExtractorOptions) *BundleExtractor {
     return &BundleExtractor{
-        bundleData: bundleData,
-        entries:    make(map[string][]byte),
+        bundle:  bundle,
+        size:    size,
+        entries: make(map[string][]byte),
+        options: options.withDefaults(),
+    }
+}
+
+// OpenExtractor creates a bundle extractor of the bundle file with the given limits, the file is
+// read as needed and must be released with Close
+func OpenExtractor(bundlePath string, options ExtractorOptions) (*BundleExtractor, error) {
+    f, err := os.Open(bundlePath)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open bundle: %w", err)
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return nil, fmt.Errorf("failed to stat bundle: %w", err)
     }
+    e := NewExtractorFromReaderAt(f, info.Size(), options)
+    e.closer = f
+    return e, nil
 }
 
-// Extract extracts all files from the tar.gz bundle
+// Close releases the bundle file of an extractor created by OpenExtractor, it does nothing for
+// other extractors
+func (e *BundleExtractor) Close() error {
+    if e.closer == nil {
+        return nil
+    }
+    return e.closer.Close()
+}
+
+// reader returns a reader of the whole bundle
+func (e *BundleExtractor) reader() io.Reader {
+    return io.NewSectionReader(e.bundle, 0, e.size)
+}
+
+// BundleReader returns a reader of the whole bundle as it was downloaded, e.g. to verify a
+// signature of it
+func (e *BundleExtractor) BundleReader() io.Reader {
+    return e.reader()
+}
+
+// Extract extracts all files from the tar.gz bundle. Entries with unsafe paths are an ErrUnsafePath,
+// exceeding a limit is an ErrBundleTooLarge. Nothing is extracted from a refused bundle.
 func (e *BundleExtractor) Extract() (map[string][]byte, error) {
     // Create gzip reader
-    gzipReader, err := gzip.NewReader(bytes.NewReader(e.bundleData))
+    gzipReader, err := gzip.NewReader(e.reader())
     if err != nil {
         return nil, fmt.Errorf("failed to create gzip reader: %w", err)
     }
@@ -35,6 +138,9 @@ func (e *BundleExtractor) Extract() (map[string][]byte, error) {
     // Create tar reader
     tarReader := tar.NewReader(gzipReader)
 
+    entries := make(map[string][]byte)
+    var count int
+    var totalBytes int64
     // Extract each file
     for {
         header, err := tarReader.Next()
@@ -45,24 +151,59 @@ func (e *BundleExtractor) Extract() (map[string][]byte, error) {
             return nil, fmt.Errorf("failed to read tar entry: %w", err)
         }
 
+        count++
+        if count > e.options.MaxEntries {
+            return nil, fmt.Errorf("%w: more than %d entries", ErrBundleTooLarge, e.options.MaxEntries)
+        }
+        if err := checkEntryPath(header.Name); err != nil {
+            return nil, err
+        }
+
         // Only process regular files
         if header.Typeflag != tar.TypeReg {
             continue
         }
 
-        // Read file content
-        content, err := io.ReadAll(tarReader)
+        if header.Size > e.options.MaxFileBytes {
+            return nil, fmt.Errorf("%w: file %s of %d bytes exceeds %d bytes", ErrBundleTooLarge, header.Name, header.Size, e.options.MaxFileBytes)
+        }
+
+        // Read file content, the header may understate the size
+        content, err := io.ReadAll(io.LimitReader(tarReader, e.options.MaxFileBytes+1))
         if err != nil {
             return nil, fmt.Errorf("failed to read file %s: %w", header.Name, err)
         }
+        if int64(len(content)) > e.options.MaxFileBytes {
+            return nil, fmt.Errorf("%w: file %s exceeds %d bytes", ErrBundleTooLarge, header.Name, e.options.MaxFileBytes)
+        }
+        totalBytes += int64(len(content))
+        if totalBytes > e.options.MaxTotalBytes {
+            return nil, fmt.Errorf("%w: files exceed %d bytes in total", ErrBundleTooLarge, e.options.MaxTotalBytes)
+        }
 
         // Store with filename as key
-        e.entries[header.Name] = content
+        entries[header.Name] = content
     }
 
+    e.entries = entries
     return e.entries, nil
 }
 
+// checkEntryPath refuses absolute entry paths and paths that leave the root of the bundle once cleaned
+func checkEntryPath(name string) error {
+    if name == "" {
+        return fmt.Errorf("%w: entry without a name", ErrUnsafePath)
+    }
+    if path.IsAbs(name) || filepath.IsAbs(name) || strings.HasPrefix(name, `\`) || filepath.VolumeName(name) != "" {
+        return fmt.Errorf("%w: absolute path %s", ErrUnsafePath, name)
+    }
+    cleaned := path.Clean(strings.ReplaceAll(name, `\`, "/"))
+    if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+        return fmt.Errorf("%w: path %s leaves the bundle root", ErrUnsafePath, name)
+    }
+    return nil
+}
+
 // ExtractWithDigestVerification extracts and verifies each file's digest
 func (e *BundleExtractor) ExtractWithDigestVerification(expectedDigests map[string]string) (map[string][]byte, error) {
     entries, err := e.Extract()
@@ -78,13 +219,8 @@ func (e *BundleExtractor) ExtractWithDigestVerification(expectedDigests map[stri
                 continue // Skip files without expected digest
             }
 
-            // Compute actual digest
-            hash := sha256.Sum256(content)
-            actualDigest := fmt.Sprintf("sha256:%x", hash)
-
-            if actualDigest != expectedDigest {
-                return nil, fmt.Errorf("digest mismatch for %s: expected %s, got %s",
-                    filename, expectedDigest, actualDigest)
+            if err := digest.Verify(expectedDigest, content); err != nil {
+                return nil, fmt.Errorf("%s: %w", filename, err)
             }
         }
     }
@@ -126,18 +262,17 @@ func (e *BundleExtractor) ListEntries() ([]string, error) {
 
 // VerifyBundleDigest verifies the digest of the entire bundle
 func (e *BundleExtractor) VerifyBundleDigest(expectedDigest string) error {
-    hash := sha256.Sum256(e.bundleData)
-    actualDigest := fmt.Sprintf("sha256:%x", hash)
-
-    if actualDigest != expectedDigest {
-        return fmt.Errorf("bundle digest mismatch: expected %s, got %s",
-            expectedDigest, actualDigest)
+    expected, err := digest.Parse(expectedDigest)
+    if err != nil {
+        return fmt.Errorf("bundle %w", err)
+    }
+    if err := expected.VerifyReader(e.reader()); err != nil {
+        return fmt.Errorf("bundle %w", err)
     }
-
     return nil
 }
 
 // GetBundleSize returns the size of the bundle in bytes
 func (e *BundleExtractor) GetBundleSize() uint64 {
-    return uint64(len(e.bundleData))
+    return uint64(e.size)
 }
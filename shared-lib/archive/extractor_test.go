@@ -0,0 +1,178 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/margo/sandbox/shared-lib/digest"
+)
+
+type testEntry struct {
+	name     string
+	content  []byte
+	typeflag byte
+}
+
+// buildTarGz writes the entries as they are, unlike the archiver it keeps unsafe names
+func buildTarGz(t *testing.T, entries ...testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		typeflag := entry.typeflag
+		if typeflag == 0 {
+			typeflag = tar.TypeReg
+		}
+		header := &tar.Header{Name: entry.name, Typeflag: typeflag, Mode: 0644, Size: int64(len(entry.content))}
+		if typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if typeflag == tar.TypeReg {
+			if _, err := tarWriter.Write(entry.content); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	bundle := buildTarGz(t,
+		testEntry{name: "deployments/", typeflag: tar.TypeDir},
+		testEntry{name: "deployment-a.yaml", content: []byte("kind: ApplicationDeployment\n")},
+		testEntry{name: "./nested/../deployment-b.yaml", content: []byte("kind: ApplicationDeployment\n")},
+	)
+
+	entries, err := NewExtractor(bundle).Extract()
+	if err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+	if len(entries) != 2 || entries["deployment-a.yaml"] == nil {
+		t.Errorf("Extract() = %v, want both deployments", entries)
+	}
+}
+
+func TestExtract_RefusesUnsafePaths(t *testing.T) {
+	for _, name := range []string{"../escape.yaml", "deployments/../../escape.yaml", "/etc/passwd", `..\escape.yaml`, `\\server\share\x.yaml`} {
+		t.Run(name, func(t *testing.T) {
+			bundle := buildTarGz(t,
+				testEntry{name: "deployment-a.yaml", content: []byte("a")},
+				testEntry{name: name, content: []byte("b")},
+			)
+
+			entries, err := NewExtractor(bundle).Extract()
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("Extract() error = %v, want %v", err, ErrUnsafePath)
+			}
+			if entries != nil {
+				t.Errorf("Extract() = %v, nothing is extracted from a refused bundle", entries)
+			}
+		})
+	}
+
+	// links are not extracted but their names are checked all the same
+	bundle := buildTarGz(t, testEntry{name: "../link", typeflag: tar.TypeSymlink})
+	if _, err := NewExtractor(bundle).Extract(); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("Extract() of a link leaving the root error = %v, want %v", err, ErrUnsafePath)
+	}
+}
+
+func TestExtract_Limits(t *testing.T) {
+	many := make([]testEntry, 0, 11)
+	for i := 0; i < 11; i++ {
+		many = append(many, testEntry{name: fmt.Sprintf("deployment-%d.yaml", i), content: []byte("x")})
+	}
+	// compresses to a few hundred bytes
+	bomb := bytes.Repeat([]byte{0}, 2<<20)
+
+	tests := []struct {
+		name    string
+		entries []testEntry
+		options ExtractorOptions
+		wantErr error
+	}{
+		{name: "too many entries", entries: many, options: ExtractorOptions{MaxEntries: 10}, wantErr: ErrBundleTooLarge},
+		{name: "entries at the limit", entries: many[:10], options: ExtractorOptions{MaxEntries: 10}},
+		{name: "file too large", entries: []testEntry{{name: "bomb.yaml", content: bomb}}, options: ExtractorOptions{MaxFileBytes: 1 << 20}, wantErr: ErrBundleTooLarge},
+		{
+			name:    "files too large together",
+			entries: []testEntry{{name: "a.yaml", content: bomb}, {name: "b.yaml", content: bomb}},
+			options: ExtractorOptions{MaxTotalBytes: 3 << 20},
+			wantErr: ErrBundleTooLarge,
+		},
+		{name: "defaults fill unset limits", entries: []testEntry{{name: "a.yaml", content: bomb}}, options: ExtractorOptions{MaxEntries: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle := buildTarGz(t, tt.entries...)
+			if tt.wantErr != nil && len(bundle) > 64<<10 {
+				t.Fatalf("the test bundle of %d bytes is no compression bomb", len(bundle))
+			}
+
+			entries, err := NewExtractorWithOptions(bundle, tt.options).Extract()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Extract() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Extract() error = %v", err)
+			}
+			if len(entries) != len(tt.entries) {
+				t.Errorf("Extract() extracted %d files, want %d", len(entries), len(tt.entries))
+			}
+		})
+	}
+}
+
+func TestOpenExtractor(t *testing.T) {
+	bundle := buildTarGz(t, testEntry{name: "deployment-a.yaml", content: []byte("kind: ApplicationDeployment\n")})
+	bundlePath := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	if err := os.WriteFile(bundlePath, bundle, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	extractor, err := OpenExtractor(bundlePath, ExtractorOptions{})
+	if err != nil {
+		t.Fatalf("OpenExtractor() error = %v", err)
+	}
+	defer extractor.Close()
+
+	if err := extractor.VerifyBundleDigest(digest.FromBytes(bundle).String()); err != nil {
+		t.Errorf("VerifyBundleDigest() error = %v", err)
+	}
+	if err := extractor.VerifyBundleDigest(digest.FromBytes([]byte("other")).String()); err == nil {
+		t.Error("VerifyBundleDigest() of another digest succeeded")
+	}
+	if size := extractor.GetBundleSize(); size != uint64(len(bundle)) {
+		t.Errorf("GetBundleSize() = %d, want %d", size, len(bundle))
+	}
+	entries, err := extractor.Extract()
+	if err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+	if string(entries["deployment-a.yaml"]) != "kind: ApplicationDeployment\n" {
+		t.Errorf("Extract() = %v, want deployment-a.yaml", entries)
+	}
+
+	if _, err := OpenExtractor(filepath.Join(t.TempDir(), "missing.tar.gz"), ExtractorOptions{}); err == nil {
+		t.Error("OpenExtractor() of a missing bundle succeeded")
+	}
+}
@@ -1,6 +1,6 @@
 package cache
 
-
+import "context"
 
 // BundleCache provides bundle-specific caching operations
 type BundleCache struct {
@@ -27,6 +27,16 @@ func (bc *BundleCache) GetBundle(deviceId, digest string) ([]byte, error) {
     return bc.cache.Get(CacheTypeBundle, deviceId, digest)
 }
 
+// StoreBundleFile stores the bundle file with digest verification, without loading it
+func (bc *BundleCache) StoreBundleFile(deviceId, digest, bundlePath string) error {
+    return bc.cache.StoreFile(CacheTypeBundle, deviceId, digest, bundlePath)
+}
+
+// GetBundlePath returns the path of a cached bundle after verifying it, the file must not be modified
+func (bc *BundleCache) GetBundlePath(deviceId, digest string) (string, error) {
+    return bc.cache.Path(CacheTypeBundle, deviceId, digest)
+}
+
 // GetLastBundleDigest retrieves the last cached bundle digest for a device
 func (bc *BundleCache) GetLastBundleDigest(deviceId string) (string, error) {
     return bc.cache.GetLastDigest(CacheTypeBundle, deviceId)
@@ -51,3 +61,24 @@ func (bc *BundleCache) ClearDeviceBundles(deviceId string) error {
 func (bc *BundleCache) GetBundleCacheStats() (totalSize int64, fileCount int, err error) {
     return bc.cache.GetCacheStats(CacheTypeBundle)
 }
+
+// ReconcileBundles cross-checks the cached bundles against the digest expected for every device,
+// see Cache.Reconcile
+func (bc *BundleCache) ReconcileBundles(ctx context.Context, expected map[string]string) (ReconcileResult, error) {
+    return bc.cache.Reconcile(ctx, CacheTypeBundle, expected)
+}
+
+// SetBundleCacheLimits bounds the size and age of the cached bundles, see Cache.Evict
+func (bc *BundleCache) SetBundleCacheLimits(limits Limits) {
+    bc.cache.SetLimits(limits)
+}
+
+// EvictBundles applies the limits to the cached bundles, the last bundle of every device is kept
+func (bc *BundleCache) EvictBundles() (int, error) {
+    return bc.cache.Evict(CacheTypeBundle)
+}
+
+// BundleStats returns the cached bundles and the hits, misses and evictions so far
+func (bc *BundleCache) BundleStats() (Stats, error) {
+    return bc.cache.Stats(CacheTypeBundle)
+}
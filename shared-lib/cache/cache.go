@@ -1,12 +1,16 @@
 package cache
 
 import (
-    "crypto/sha256"
+    "context"
     "encoding/json"
     "fmt"
+    "io"
     "os"
     "path/filepath"
     "sync"
+
+    contentdigest "github.com/margo/sandbox/shared-lib/digest"
+    "github.com/margo/sandbox/shared-lib/file"
 )
 
 // CacheType represents different types of cached resources
@@ -21,6 +25,10 @@ const (
 type Cache struct {
     baseDir string
     mu      sync.RWMutex
+    limits  Limits
+
+    countersMu sync.Mutex
+    counters   map[CacheType]counters
 }
 
 // NewCache creates a new cache instance
@@ -28,9 +36,15 @@ func NewCache(baseDir string) (*Cache, error) {
     if err := os.MkdirAll(baseDir, 0755); err != nil {
         return nil, fmt.Errorf("failed to create cache directory: %w", err)
     }
+
+    // Writes interrupted by a crash leave their temp files behind, nothing reads them
+    if _, err := file.RemoveStaleTemps(baseDir); err != nil {
+        return nil, fmt.Errorf("failed to clean up the cache directory: %w", err)
+    }
     
     return &Cache{
-        baseDir: baseDir,
+        baseDir:  baseDir,
+        counters: map[CacheType]counters{},
     }, nil
 }
 
@@ -40,10 +54,8 @@ func (c *Cache) Store(cacheType CacheType, key, digest string, data []byte) erro
     defer c.mu.Unlock()
     
     // Verify digest before storing (Exact Bytes Rule)
-    hash := sha256.Sum256(data)
-    actualDigest := fmt.Sprintf("sha256:%x", hash)
-    if actualDigest != digest {
-        return fmt.Errorf("digest mismatch: expected %s, got %s", digest, actualDigest)
+    if err := contentdigest.Verify(digest, data); err != nil {
+        return err
     }
     
     // Create cache path
@@ -53,12 +65,60 @@ func (c *Cache) Store(cacheType CacheType, key, digest string, data []byte) erro
     }
     
     // Write data
-    if err := os.WriteFile(cachePath, data, 0644); err != nil {
+    if err := file.WriteFileAtomic(cachePath, data, 0644); err != nil {
         return fmt.Errorf("failed to write cache file: %w", err)
     }
     
     // Update metadata
-    return c.updateMetadata(cacheType, key, digest)
+    if err := c.updateMetadata(cacheType, key, digest); err != nil {
+        return err
+    }
+    // the entry is stored, failing to make room for it is retried with the next one
+    c.evict(cacheType)
+    return nil
+}
+
+// StoreFile stores the file at srcPath with digest verification, the file is streamed into the
+// cache rather than loaded
+func (c *Cache) StoreFile(cacheType CacheType, key, digest, srcPath string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    expected, err := contentdigest.Parse(digest)
+    if err != nil {
+        return err
+    }
+    digester, err := contentdigest.NewDigester(expected.Algorithm())
+    if err != nil {
+        return err
+    }
+    src, err := os.Open(srcPath)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %w", srcPath, err)
+    }
+    defer src.Close()
+
+    cachePath := filepath.Join(c.baseDir, string(cacheType), key, digest)
+    if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+        return fmt.Errorf("failed to create cache directory: %w", err)
+    }
+
+    // Verify the digest while copying (Exact Bytes Rule), nothing is stored on a mismatch
+    err = file.WriteAtomic(cachePath, 0644, func(w io.Writer) error {
+        if _, err := io.Copy(io.MultiWriter(w, digester), src); err != nil {
+            return fmt.Errorf("failed to write cache file: %w", err)
+        }
+        return expected.Check(digester.Digest())
+    })
+    if err != nil {
+        return err
+    }
+
+    if err := c.updateMetadata(cacheType, key, digest); err != nil {
+        return err
+    }
+    c.evict(cacheType)
+    return nil
 }
 
 // Get retrieves cached data with integrity verification
@@ -69,26 +129,47 @@ func (c *Cache) Get(cacheType CacheType, key, digest string) ([]byte, error) {
     cachePath := filepath.Join(c.baseDir, string(cacheType), key, digest)
     data, err := os.ReadFile(cachePath)
     if err != nil {
+        c.count(cacheType, func(n *counters) { n.misses++ })
         return nil, fmt.Errorf("cache miss: %w", err)
     }
     
     // Verify integrity (Exact Bytes Rule)
-    hash := sha256.Sum256(data)
-    actualDigest := fmt.Sprintf("sha256:%x", hash)
-    if actualDigest != digest {
+    if err := contentdigest.Verify(digest, data); err != nil {
         // Cache corruption detected - remove corrupted file
         os.Remove(cachePath)
-        return nil, fmt.Errorf("cache corruption detected: expected %s, got %s", digest, actualDigest)
+        c.count(cacheType, func(n *counters) { n.misses++ })
+        return nil, fmt.Errorf("cache corruption detected: %w", err)
     }
     
+    c.touch(cacheType, key, digest)
+    c.count(cacheType, func(n *counters) { n.hits++ })
     return data, nil
 }
 
+// Path returns the path of a cached entry after verifying its integrity, the entry is streamed
+// rather than loaded. A corrupt entry is removed. The file must not be modified.
+func (c *Cache) Path(cacheType CacheType, key, digest string) (string, error) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    if err := c.verify(cacheType, key, digest); err != nil {
+        c.count(cacheType, func(n *counters) { n.misses++ })
+        return "", err
+    }
+    c.touch(cacheType, key, digest)
+    c.count(cacheType, func(n *counters) { n.hits++ })
+    return filepath.Join(c.baseDir, string(cacheType), key, digest), nil
+}
+
 // GetLastDigest retrieves the last cached digest for a key
 func (c *Cache) GetLastDigest(cacheType CacheType, key string) (string, error) {
     c.mu.RLock()
     defer c.mu.RUnlock()
-    
+    return c.readLastDigest(cacheType, key)
+}
+
+// readLastDigest reads the metadata of a key, c.mu must be held
+func (c *Cache) readLastDigest(cacheType CacheType, key string) (string, error) {
     metaPath := filepath.Join(c.baseDir, string(cacheType), key, "metadata.json")
     data, err := os.ReadFile(metaPath)
     if err != nil {
@@ -159,7 +240,7 @@ func (c *Cache) updateMetadata(cacheType CacheType, key, digest string) error {
         return fmt.Errorf("failed to marshal metadata: %w", err)
     }
     
-    return os.WriteFile(metaPath, metaData, 0644)
+    return file.WriteFileAtomic(metaPath, metaData, 0644)
 }
 
 // GetCacheStats returns statistics about the cache
@@ -182,3 +263,123 @@ func (c *Cache) GetCacheStats(cacheType CacheType) (totalSize int64, fileCount i
     
     return totalSize, fileCount, err
 }
+
+// ReconcileResult summarizes a Reconcile pass
+type ReconcileResult struct {
+    // Validated entries were re-hashed and match their digest
+    Validated int
+    // Deferred entries exist but were not re-hashed because the pass ran out of time, Get verifies them on first use
+    Deferred int
+    // Invalidated entries were expected but missing or corrupt, their metadata was reset so the next
+    // fetch is unconditional
+    Invalidated int
+    // OrphansRemoved counts the keys and outdated digests that are no longer expected
+    OrphansRemoved int
+    // Missing lists the expected keys whose digest the cache cannot serve
+    Missing []string
+}
+
+// Reconcile cross-checks the cached entries of a type against the digest expected for every key.
+// Keys that are not expected are removed, entries for the expected digests are re-hashed until ctx
+// is done and only checked for existence afterwards. An expected empty digest keeps the key as is.
+func (c *Cache) Reconcile(ctx context.Context, cacheType CacheType, expected map[string]string) (ReconcileResult, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    var result ReconcileResult
+    typePath := filepath.Join(c.baseDir, string(cacheType))
+    entries, err := os.ReadDir(typePath)
+    if err != nil && !os.IsNotExist(err) {
+        return result, fmt.Errorf("failed to list cache entries: %w", err)
+    }
+
+    cached := make(map[string]bool, len(entries))
+    for _, entry := range entries {
+        if !entry.IsDir() {
+            continue
+        }
+        key := entry.Name()
+        cached[key] = true
+
+        digest, isExpected := expected[key]
+        if !isExpected {
+            if err := os.RemoveAll(filepath.Join(typePath, key)); err != nil {
+                return result, fmt.Errorf("failed to remove orphaned cache entry %s: %w", key, err)
+            }
+            result.OrphansRemoved++
+            continue
+        }
+        if digest == "" {
+            continue
+        }
+
+        files, err := os.ReadDir(filepath.Join(typePath, key))
+        if err != nil {
+            return result, fmt.Errorf("failed to list cache entry %s: %w", key, err)
+        }
+        found := false
+        for _, file := range files {
+            if file.IsDir() || file.Name() == "metadata.json" {
+                continue
+            }
+            if file.Name() == digest {
+                found = true
+                continue
+            }
+            // an older version of the entry, it can no longer be requested
+            if err := os.Remove(filepath.Join(typePath, key, file.Name())); err != nil {
+                return result, fmt.Errorf("failed to remove outdated cache entry %s: %w", key, err)
+            }
+            result.OrphansRemoved++
+        }
+
+        switch {
+        case !found:
+            result.Invalidated++
+            result.Missing = append(result.Missing, key)
+            c.resetMetadata(cacheType, key)
+        case ctx.Err() != nil:
+            result.Deferred++
+        case c.verify(cacheType, key, digest) != nil:
+            result.Invalidated++
+            result.Missing = append(result.Missing, key)
+            c.resetMetadata(cacheType, key)
+        default:
+            result.Validated++
+        }
+    }
+
+    for key, digest := range expected {
+        if digest != "" && !cached[key] {
+            result.Missing = append(result.Missing, key)
+        }
+    }
+    return result, nil
+}
+
+// verify re-hashes a cached entry and removes it when it is corrupt, c.mu must be held
+func (c *Cache) verify(cacheType CacheType, key, digest string) error {
+    expected, err := contentdigest.Parse(digest)
+    if err != nil {
+        return err
+    }
+
+    cachePath := filepath.Join(c.baseDir, string(cacheType), key, digest)
+    f, err := os.Open(cachePath)
+    if err != nil {
+        return fmt.Errorf("cache miss: %w", err)
+    }
+    // streamed, the entry is only hashed and need not be held in memory
+    err = expected.VerifyReader(f)
+    f.Close()
+    if err != nil {
+        os.Remove(cachePath)
+        return fmt.Errorf("cache corruption detected: %w", err)
+    }
+    return nil
+}
+
+// resetMetadata forgets the last digest of a key, c.mu must be held
+func (c *Cache) resetMetadata(cacheType CacheType, key string) {
+    os.Remove(filepath.Join(c.baseDir, string(cacheType), key, "metadata.json"))
+}
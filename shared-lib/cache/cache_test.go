@@ -0,0 +1,278 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/shared-lib/file"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func digestOf(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// crashBeforeRename fails the atomic writes whose final path matches, the temp files seen are returned
+func crashBeforeRename(t *testing.T, match func(finalPath string) bool) *[]string {
+	t.Helper()
+	var temps []string
+	restore := file.SetBeforeRenameHook(func(tempPath, finalPath string) error {
+		if !match(finalPath) {
+			return nil
+		}
+		temps = append(temps, tempPath)
+		return errors.New("simulated crash")
+	})
+	t.Cleanup(restore)
+	return &temps
+}
+
+func TestStore_CrashBeforeRename(t *testing.T) {
+	good, next := []byte("kind: good"), []byte("kind: next")
+
+	tests := []struct {
+		name      string
+		cacheType CacheType
+		store     func(baseDir string, digest string, data []byte) error
+		// crashOn selects the write that fails, the entry itself or its metadata
+		crashOn       string
+		wantNextEntry bool
+	}{
+		{
+			name:      "deployment entry",
+			cacheType: CacheTypeDeployment,
+			store: func(baseDir, digest string, data []byte) error {
+				dc, err := NewDeploymentCache(baseDir)
+				require.NoError(t, err)
+				return dc.StoreDeployment("deployment-1", digest, data)
+			},
+			crashOn: "entry",
+		},
+		{
+			name:      "deployment metadata",
+			cacheType: CacheTypeDeployment,
+			store: func(baseDir, digest string, data []byte) error {
+				dc, err := NewDeploymentCache(baseDir)
+				require.NoError(t, err)
+				return dc.StoreDeployment("deployment-1", digest, data)
+			},
+			crashOn:       "metadata",
+			wantNextEntry: true,
+		},
+		{
+			name:      "bundle entry",
+			cacheType: CacheTypeBundle,
+			store: func(baseDir, digest string, data []byte) error {
+				bc, err := NewBundleCache(baseDir)
+				require.NoError(t, err)
+				return bc.StoreBundle("deployment-1", digest, data)
+			},
+			crashOn: "entry",
+		},
+		{
+			name:      "bundle metadata",
+			cacheType: CacheTypeBundle,
+			store: func(baseDir, digest string, data []byte) error {
+				bc, err := NewBundleCache(baseDir)
+				require.NoError(t, err)
+				return bc.StoreBundle("deployment-1", digest, data)
+			},
+			crashOn:       "metadata",
+			wantNextEntry: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseDir := t.TempDir()
+			require.NoError(t, tt.store(baseDir, digestOf(good), good))
+
+			temps := crashBeforeRename(t, func(finalPath string) bool {
+				isMetadata := filepath.Base(finalPath) == "metadata.json"
+				return isMetadata == (tt.crashOn == "metadata")
+			})
+			require.Error(t, tt.store(baseDir, digestOf(next), next))
+
+			c, err := NewCache(baseDir)
+			require.NoError(t, err)
+			last, err := c.GetLastDigest(tt.cacheType, "deployment-1")
+			require.NoError(t, err)
+			assert.Equal(t, digestOf(good), last, "the metadata still points to the good entry")
+			data, err := c.Get(tt.cacheType, "deployment-1", last)
+			require.NoError(t, err)
+			assert.Equal(t, good, data)
+			assert.Equal(t, tt.wantNextEntry, c.Exists(tt.cacheType, "deployment-1", digestOf(next)))
+			require.Len(t, *temps, 1)
+			assert.NoFileExists(t, (*temps)[0])
+		})
+	}
+}
+
+func TestNewCache_RemovesStaleTemps(t *testing.T) {
+	baseDir := t.TempDir()
+	entryDir := filepath.Join(baseDir, string(CacheTypeDeployment), "deployment-1")
+	require.NoError(t, os.MkdirAll(entryDir, 0755))
+	stale := filepath.Join(entryDir, ".metadata.json.123"+file.TempSuffix)
+	require.NoError(t, os.WriteFile(stale, []byte(`{"lastDig`), 0644))
+
+	_, err := NewCache(baseDir)
+	require.NoError(t, err)
+	assert.NoFileExists(t, stale)
+
+	entries, err := os.ReadDir(entryDir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasSuffix(entry.Name(), file.TempSuffix))
+	}
+}
+
+func TestStoreBundleFile(t *testing.T) {
+	bc, err := NewBundleCache(t.TempDir())
+	require.NoError(t, err)
+	bundle := []byte("bundle content")
+	src := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	require.NoError(t, os.WriteFile(src, bundle, 0644))
+
+	require.NoError(t, bc.StoreBundleFile("device-1", digestOf(bundle), src))
+	bundlePath, err := bc.GetBundlePath("device-1", digestOf(bundle))
+	require.NoError(t, err)
+	assert.NotEqual(t, src, bundlePath, "the cache keeps its own copy")
+	stored, err := os.ReadFile(bundlePath)
+	require.NoError(t, err)
+	assert.Equal(t, bundle, stored)
+	last, err := bc.GetLastBundleDigest("device-1")
+	require.NoError(t, err)
+	assert.Equal(t, digestOf(bundle), last)
+
+	// a file that does not match the digest is not stored
+	other := digestOf([]byte("other"))
+	assert.Error(t, bc.StoreBundleFile("device-1", other, src))
+	assert.False(t, bc.BundleExists("device-1", other))
+
+	// a corrupt entry is not served and removed
+	require.NoError(t, os.WriteFile(bundlePath, []byte("tampered"), 0644))
+	_, err = bc.GetBundlePath("device-1", digestOf(bundle))
+	assert.ErrorContains(t, err, "cache corruption detected")
+	assert.False(t, bc.BundleExists("device-1", digestOf(bundle)))
+}
+
+// storeAged stores the data and makes it look last used age ago
+func storeAged(t *testing.T, dc *DeploymentCache, deploymentId string, data []byte, age time.Duration) {
+	t.Helper()
+	require.NoError(t, dc.StoreDeployment(deploymentId, digestOf(data), data))
+	used := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(dc.cache.entryPath(CacheTypeDeployment, deploymentId, digestOf(data)), used, used))
+}
+
+func TestEvict_LeastRecentlyUsedBeyondMaxBytes(t *testing.T) {
+	dc, err := NewDeploymentCache(t.TempDir())
+	require.NoError(t, err)
+	v1, v2, v3 := []byte("version-1"), []byte("version-2"), []byte("version-3")
+	other := []byte("other-one")
+	storeAged(t, dc, "deployment-1", v1, 3*time.Hour)
+	storeAged(t, dc, "deployment-1", v2, time.Hour)
+	storeAged(t, dc, "deployment-2", other, 4*time.Hour)
+	storeAged(t, dc, "deployment-1", v3, 2*time.Hour)
+
+	// every entry is 9 bytes, 2 entries fit
+	dc.SetDeploymentCacheLimits(Limits{MaxBytes: 18})
+	removed, err := dc.EvictDeployments()
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.False(t, dc.DeploymentExists("deployment-1", digestOf(v1)), "the least recently used older digest is evicted")
+	assert.False(t, dc.DeploymentExists("deployment-1", digestOf(v2)))
+	assert.True(t, dc.DeploymentExists("deployment-1", digestOf(v3)), "the last digest is kept")
+	assert.True(t, dc.DeploymentExists("deployment-2", digestOf(other)), "the last digest is kept although it is the oldest")
+
+	// the last digests are kept even when they alone exceed the limit
+	dc.SetDeploymentCacheLimits(Limits{MaxBytes: 1})
+	removed, err = dc.EvictDeployments()
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+}
+
+func TestEvict_ReadEntriesAreKeptLonger(t *testing.T) {
+	dc, err := NewDeploymentCache(t.TempDir())
+	require.NoError(t, err)
+	v1, v2, v3 := []byte("version-1"), []byte("version-2"), []byte("version-3")
+	storeAged(t, dc, "deployment-1", v1, 2*time.Hour)
+	storeAged(t, dc, "deployment-1", v2, time.Hour)
+	_, err = dc.GetDeployment("deployment-1", digestOf(v1))
+	require.NoError(t, err)
+
+	// storing applies the limits
+	dc.SetDeploymentCacheLimits(Limits{MaxBytes: 18})
+	require.NoError(t, dc.StoreDeployment("deployment-1", digestOf(v3), v3))
+	assert.True(t, dc.DeploymentExists("deployment-1", digestOf(v1)), "the entry read last is kept")
+	assert.False(t, dc.DeploymentExists("deployment-1", digestOf(v2)))
+}
+
+func TestEvict_MaxAge(t *testing.T) {
+	bc, err := NewBundleCache(t.TempDir())
+	require.NoError(t, err)
+	old, current := []byte("old bundle"), []byte("current bundle")
+	require.NoError(t, bc.StoreBundle("device-1", digestOf(old), old))
+	require.NoError(t, bc.StoreBundle("device-1", digestOf(current), current))
+	aged := time.Now().Add(-48 * time.Hour)
+	for _, data := range [][]byte{old, current} {
+		require.NoError(t, os.Chtimes(bc.cache.entryPath(CacheTypeBundle, "device-1", digestOf(data)), aged, aged))
+	}
+
+	bc.SetBundleCacheLimits(Limits{MaxAge: 24 * time.Hour})
+	removed, err := bc.EvictBundles()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.False(t, bc.BundleExists("device-1", digestOf(old)))
+	assert.True(t, bc.BundleExists("device-1", digestOf(current)), "the bundle of the synced etag is kept however old")
+}
+
+func TestPurgeOrphaned(t *testing.T) {
+	dc, err := NewDeploymentCache(t.TempDir())
+	require.NoError(t, err)
+	for _, deploymentId := range []string{"deployment-1", "deployment-2", "deployment-removed"} {
+		for _, version := range []string{"v1", "v2"} {
+			data := []byte(deploymentId + version)
+			require.NoError(t, dc.StoreDeployment(deploymentId, digestOf(data), data))
+		}
+	}
+
+	removed, err := dc.PurgeOrphaned([]string{"deployment-1", "deployment-2", "deployment-unknown"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	_, err = dc.GetLastDeploymentDigest("deployment-removed")
+	assert.Error(t, err)
+	assert.True(t, dc.DeploymentExists("deployment-1", digestOf([]byte("deployment-1v2"))))
+
+	stats, err := dc.DeploymentStats()
+	require.NoError(t, err)
+	assert.Equal(t, 4, stats.Entries)
+	assert.Equal(t, uint64(2), stats.Evicted)
+}
+
+func TestStats(t *testing.T) {
+	bc, err := NewBundleCache(t.TempDir())
+	require.NoError(t, err)
+	stats, err := bc.BundleStats()
+	require.NoError(t, err)
+	assert.Equal(t, Stats{}, stats, "an empty cache")
+
+	bundle := []byte("bundle content")
+	require.NoError(t, bc.StoreBundle("device-1", digestOf(bundle), bundle))
+	_, err = bc.GetBundle("device-1", digestOf(bundle))
+	require.NoError(t, err)
+	_, err = bc.GetBundlePath("device-1", digestOf(bundle))
+	require.NoError(t, err)
+	_, err = bc.GetBundle("device-1", digestOf([]byte("other")))
+	require.Error(t, err)
+
+	stats, err = bc.BundleStats()
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Entries: 1, Bytes: int64(len(bundle)), Hits: 2, Misses: 1}, stats)
+}
@@ -1,5 +1,7 @@
 package cache
 
+import "context"
+
 // DeploymentCache provides deployment-specific caching operations
 type DeploymentCache struct {
     cache *Cache
@@ -49,3 +51,31 @@ func (dc *DeploymentCache) ClearDeploymentCache(deploymentId string) error {
 func (dc *DeploymentCache) GetDeploymentCacheStats() (totalSize int64, fileCount int, err error) {
     return dc.cache.GetCacheStats(CacheTypeDeployment)
 }
+
+// ReconcileDeployments cross-checks the cached deployments against the digest expected for every
+// deployment id, see Cache.Reconcile
+func (dc *DeploymentCache) ReconcileDeployments(ctx context.Context, expected map[string]string) (ReconcileResult, error) {
+    return dc.cache.Reconcile(ctx, CacheTypeDeployment, expected)
+}
+
+// SetDeploymentCacheLimits bounds the size and age of the cached deployments, see Cache.Evict
+func (dc *DeploymentCache) SetDeploymentCacheLimits(limits Limits) {
+    dc.cache.SetLimits(limits)
+}
+
+// EvictDeployments applies the limits to the cached deployments, the last digest of every
+// deployment is kept
+func (dc *DeploymentCache) EvictDeployments() (int, error) {
+    return dc.cache.Evict(CacheTypeDeployment)
+}
+
+// PurgeOrphaned removes the cached deployments that are not one of knownDeploymentIds, e.g. the
+// deployments of the last synced manifest. It returns the number of entries removed.
+func (dc *DeploymentCache) PurgeOrphaned(knownDeploymentIds []string) (int, error) {
+    return dc.cache.PurgeOrphaned(CacheTypeDeployment, knownDeploymentIds)
+}
+
+// DeploymentStats returns the cached deployments and the hits, misses and evictions so far
+func (dc *DeploymentCache) DeploymentStats() (Stats, error) {
+    return dc.cache.Stats(CacheTypeDeployment)
+}
@@ -0,0 +1,221 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/margo/sandbox/shared-lib/file"
+)
+
+// Limits bound what a cache type keeps on disk, 0 leaves a limit off
+type Limits struct {
+	// MaxBytes is the total size of the entries of the type, the least recently used entries are
+	// evicted beyond it
+	MaxBytes int64
+	// MaxAge is how long an entry is kept after it was last stored or read
+	MaxAge time.Duration
+}
+
+// Stats describes the entries of a cache type and how well the cache served them since it was
+// created
+type Stats struct {
+	Entries int
+	Bytes   int64
+	Hits    uint64
+	Misses  uint64
+	// Evicted counts the entries removed by the limits and by PurgeOrphaned
+	Evicted uint64
+}
+
+// counters are the hits, misses and evictions of a cache type
+type counters struct {
+	hits, misses, evicted uint64
+}
+
+// cacheEntry is a cached digest of a key
+type cacheEntry struct {
+	key, digest string
+	size        int64
+	// lastUsed is the modification time, it is refreshed whenever the entry is read
+	lastUsed time.Time
+}
+
+// SetLimits replaces the limits of every cache type, they are applied whenever an entry is stored
+func (c *Cache) SetLimits(limits Limits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits = limits
+}
+
+// Evict removes the entries of the type that are older than MaxAge, then the least recently used
+// ones until the type fits in MaxBytes. The last digest stored for a key is never evicted: it is the
+// one the next sync asks the server about, see PurgeOrphaned to drop keys that are no longer synced.
+// It returns the number of entries removed.
+func (c *Cache) Evict(cacheType CacheType) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evict(cacheType)
+}
+
+// evict must be called with c.mu held
+func (c *Cache) evict(cacheType CacheType) (int, error) {
+	if c.limits.MaxBytes <= 0 && c.limits.MaxAge <= 0 {
+		return 0, nil
+	}
+	entries, err := c.listEntries(cacheType)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	var candidates []cacheEntry
+	for _, entry := range entries {
+		total += entry.size
+		if entry.digest != c.lastDigest(cacheType, entry.key) {
+			candidates = append(candidates, entry)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b cacheEntry) int {
+		return a.lastUsed.Compare(b.lastUsed)
+	})
+
+	removed := 0
+	now := time.Now()
+	for _, entry := range candidates {
+		expired := c.limits.MaxAge > 0 && now.Sub(entry.lastUsed) > c.limits.MaxAge
+		oversized := c.limits.MaxBytes > 0 && total > c.limits.MaxBytes
+		if !expired && !oversized {
+			continue
+		}
+		if err := os.Remove(c.entryPath(cacheType, entry.key, entry.digest)); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to evict cache entry %s/%s: %w", entry.key, entry.digest, err)
+		}
+		total -= entry.size
+		removed++
+	}
+	c.count(cacheType, func(n *counters) { n.evicted += uint64(removed) })
+	return removed, nil
+}
+
+// PurgeOrphaned removes every key of the type that is not one of knownKeys, with all its entries.
+// It returns the number of entries removed.
+func (c *Cache) PurgeOrphaned(cacheType CacheType, knownKeys []string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := c.listEntries(cacheType)
+	if err != nil {
+		return 0, err
+	}
+	keys, err := os.ReadDir(filepath.Join(c.baseDir, string(cacheType)))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to list cache entries: %w", err)
+	}
+
+	removed := 0
+	for _, key := range keys {
+		if !key.IsDir() || slices.Contains(knownKeys, key.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(c.baseDir, string(cacheType), key.Name())); err != nil {
+			return removed, fmt.Errorf("failed to remove orphaned cache entry %s: %w", key.Name(), err)
+		}
+		for _, entry := range entries {
+			if entry.key == key.Name() {
+				removed++
+			}
+		}
+	}
+	c.count(cacheType, func(n *counters) { n.evicted += uint64(removed) })
+	return removed, nil
+}
+
+// Stats returns the entries of the type and the hits, misses and evictions so far
+func (c *Cache) Stats(cacheType CacheType) (Stats, error) {
+	c.mu.RLock()
+	entries, err := c.listEntries(cacheType)
+	c.mu.RUnlock()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	c.countersMu.Lock()
+	n := c.counters[cacheType]
+	c.countersMu.Unlock()
+	stats := Stats{Entries: len(entries), Hits: n.hits, Misses: n.misses, Evicted: n.evicted}
+	for _, entry := range entries {
+		stats.Bytes += entry.size
+	}
+	return stats, nil
+}
+
+// listEntries returns every cached digest of the type, c.mu must be held
+func (c *Cache) listEntries(cacheType CacheType) ([]cacheEntry, error) {
+	typePath := filepath.Join(c.baseDir, string(cacheType))
+	keys, err := os.ReadDir(typePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list cache entries: %w", err)
+	}
+
+	var entries []cacheEntry
+	for _, key := range keys {
+		if !key.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(typePath, key.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list cache entry %s: %w", key.Name(), err)
+		}
+		for _, f := range files {
+			if f.IsDir() || f.Name() == "metadata.json" || strings.HasSuffix(f.Name(), file.TempSuffix) {
+				continue
+			}
+			info, err := f.Info()
+			if err != nil {
+				continue // removed meanwhile
+			}
+			entries = append(entries, cacheEntry{
+				key:      key.Name(),
+				digest:   f.Name(),
+				size:     info.Size(),
+				lastUsed: info.ModTime(),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// lastDigest is the digest recorded in the metadata of the key, empty when there is none
+func (c *Cache) lastDigest(cacheType CacheType, key string) string {
+	digest, err := c.readLastDigest(cacheType, key)
+	if err != nil {
+		return ""
+	}
+	return digest
+}
+
+func (c *Cache) entryPath(cacheType CacheType, key, digest string) string {
+	return filepath.Join(c.baseDir, string(cacheType), key, digest)
+}
+
+// touch marks an entry as used now, so it is evicted after the ones that were not used since
+func (c *Cache) touch(cacheType CacheType, key, digest string) {
+	now := time.Now()
+	os.Chtimes(c.entryPath(cacheType, key, digest), now, now)
+}
+
+// count updates the counters of the type
+func (c *Cache) count(cacheType CacheType, update func(n *counters)) {
+	c.countersMu.Lock()
+	defer c.countersMu.Unlock()
+	n := c.counters[cacheType]
+	update(&n)
+	c.counters[cacheType] = n
+}
@@ -1,15 +1,15 @@
 package crypto
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+
+	"github.com/margo/sandbox/shared-lib/digest"
 )
 
 // GetDigestOfFile calculates the SHA256 digest of a file
-func GetDigestOfFile(filepath string) (digest string, err error) {
+func GetDigestOfFile(filepath string) (string, error) {
 	// Validate input
 	if filepath == "" {
 		return "", fmt.Errorf("filepath cannot be empty")
@@ -22,97 +22,64 @@ func GetDigestOfFile(filepath string) (digest string, err error) {
 	}
 	defer file.Close()
 
-	// Create SHA256 hasher
-	hasher := sha256.New()
-
-	// Copy file content to hasher
-	if _, err := io.Copy(hasher, file); err != nil {
+	d, err := digest.Compute(digest.Canonical, file)
+	if err != nil {
 		return "", fmt.Errorf("failed to read file %s: %w", filepath, err)
 	}
-
-	// Calculate digest
-	hash := hasher.Sum(nil)
-	digest = fmt.Sprintf("sha256:%s", hex.EncodeToString(hash))
-
-	return digest, nil
+	return d.String(), nil
 }
 
 // GetDigestOfContent calculates the SHA256 digest of byte content
 // Note: The original signature had 'filepath string' but this should be content
-func GetDigestOfContent(content []byte) (digest string, err error) {
-	// Create SHA256 hasher
-	hasher := sha256.New()
-
-	// Write content to hasher
-	if _, err := hasher.Write(content); err != nil {
-		return "", fmt.Errorf("failed to hash content: %w", err)
-	}
-
-	// Calculate digest
-	hash := hasher.Sum(nil)
-	digest = fmt.Sprintf("sha256:%s", hex.EncodeToString(hash))
-
-	return digest, nil
+func GetDigestOfContent(content []byte) (string, error) {
+	return digest.FromBytes(content).String(), nil
 }
 
-// Alternative implementation if you want to keep the original signature
-// GetDigestOfContentFromFile reads content from file and calculates digest
-func GetDigestOfContentFromFile(filepath string) (digest string, err error) {
-	// Validate input
-	if filepath == "" {
-		return "", fmt.Errorf("filepath cannot be empty")
-	}
-
-	// Read file content
-	content, err := os.ReadFile(filepath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read file %s: %w", filepath, err)
-	}
-
-	// Calculate digest of content
-	return GetDigestOfContent(content)
+// GetDigestOfContentFromFile calculates the digest of the content of a file, the file is streamed
+// like in GetDigestOfFile
+func GetDigestOfContentFromFile(filepath string) (string, error) {
+	return GetDigestOfFile(filepath)
 }
 
 // GetDigestOfString calculates the SHA256 digest of a string
-func GetDigestOfString(content string) (digest string, err error) {
+func GetDigestOfString(content string) (string, error) {
 	return GetDigestOfContent([]byte(content))
 }
 
 // GetDigestOfReader calculates the SHA256 digest from an io.Reader
-func GetDigestOfReader(reader io.Reader) (digest string, err error) {
+func GetDigestOfReader(reader io.Reader) (string, error) {
 	if reader == nil {
 		return "", fmt.Errorf("reader cannot be nil")
 	}
 
-	// Create SHA256 hasher
-	hasher := sha256.New()
-
-	// Copy reader content to hasher
-	if _, err := io.Copy(hasher, reader); err != nil {
+	d, err := digest.Compute(digest.Canonical, reader)
+	if err != nil {
 		return "", fmt.Errorf("failed to read from reader: %w", err)
 	}
-
-	// Calculate digest
-	hash := hasher.Sum(nil)
-	digest = fmt.Sprintf("sha256:%s", hex.EncodeToString(hash))
-
-	return digest, nil
+	return d.String(), nil
 }
 
-// VerifyFileDigest verifies if a file matches the expected digest
+// VerifyFileDigest verifies if a file matches the expected digest, a malformed expected digest
+// never matches
 func VerifyFileDigest(filepath string, expectedDigest string) (bool, error) {
 	actualDigest, err := GetDigestOfFile(filepath)
 	if err != nil {
 		return false, err
 	}
-	return actualDigest == expectedDigest, nil
+	return digestsMatch(expectedDigest, actualDigest), nil
 }
 
-// VerifyContentDigest verifies if content matches the expected digest
+// VerifyContentDigest verifies if content matches the expected digest, a malformed expected digest
+// never matches
 func VerifyContentDigest(content []byte, expectedDigest string) (bool, error) {
-	actualDigest, err := GetDigestOfContent(content)
+	return digestsMatch(expectedDigest, digest.FromBytes(content).String()), nil
+}
+
+func digestsMatch(expected, actual string) bool {
+	expectedDigest, err := digest.Parse(expected)
 	if err != nil {
-		return false, err
+		return false
 	}
-	return actualDigest == expectedDigest, nil
+	actualDigest, err := digest.Parse(actual)
+	return err == nil && expectedDigest.Equal(actualDigest)
 }
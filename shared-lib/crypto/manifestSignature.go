@@ -0,0 +1,387 @@
+package crypto
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+)
+
+// SignedManifestMediaType is the content type of a state manifest signed by the WFM: a JWS in compact
+// serialization whose payload is the manifest JSON
+const SignedManifestMediaType = "application/vnd.margo.manifest.v1+jws"
+
+// ErrManifestSignature is wrapped by every error of a signed manifest that does not verify
+var ErrManifestSignature = errors.New("manifest signature verification failed")
+
+// ErrBundleSignature is wrapped by every error of a bundle signature that does not verify
+var ErrBundleSignature = errors.New("bundle signature verification failed")
+
+// The typ headers of signed manifests and of bundle signatures
+const (
+	manifestJWSType = "margo-manifest+jws"
+	bundleJWSType   = "margo-bundle+jws"
+)
+
+type jwsHeader struct {
+	Alg string   `json:"alg"`
+	Typ string   `json:"typ,omitempty"`
+	Kid string   `json:"kid,omitempty"`
+	X5c []string `json:"x5c,omitempty"`
+}
+
+// ManifestVerifier verifies signed state manifests and bundle signatures, either against a fixed
+// public key or against the certificate chain of the signature, which has to lead to one of the
+// trusted CAs
+type ManifestVerifier struct {
+	publicKey any
+	roots     *x509.CertPool
+}
+
+// NewManifestVerifier returns a verifier trusting the key of a PEM public key or certificate
+func NewManifestVerifier(publicKeyPEM []byte) (*ManifestVerifier, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode public key PEM")
+	}
+	var publicKey any
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate PEM: %w", err)
+		}
+		publicKey = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RSA public key: %w", err)
+		}
+		publicKey = key
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported or invalid public key PEM (type=%s): %w", block.Type, err)
+		}
+		publicKey = key
+	}
+	switch publicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type: %T", publicKey)
+	}
+	return &ManifestVerifier{publicKey: publicKey}, nil
+}
+
+// NewManifestVerifierFromCA returns a verifier trusting manifests whose x5c certificate chain leads to
+// one of the CA certificates of the PEM bundle
+func NewManifestVerifierFromCA(caPEM []byte) (*ManifestVerifier, error) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no CA certificate found in PEM")
+	}
+	return &ManifestVerifier{roots: roots}, nil
+}
+
+// NewManifestVerifierFromFile reads the public key, or with isCA the CA bundle, from a PEM file
+func NewManifestVerifierFromFile(path string, isCA bool) (*ManifestVerifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if isCA {
+		return NewManifestVerifierFromCA(data)
+	}
+	return NewManifestVerifier(data)
+}
+
+// Verify checks the signature of a signed manifest and returns its payload, the manifest JSON
+func (v *ManifestVerifier) Verify(signed []byte) ([]byte, error) {
+	parts := bytes.Split(bytes.TrimSpace(signed), []byte("."))
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWS in compact serialization", ErrManifestSignature)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid payload encoding: %v", ErrManifestSignature, err)
+	}
+	signingInput := bytes.NewReader(bytes.TrimSpace(signed)[:len(parts[0])+1+len(parts[1])])
+	if err := v.verifyJWS(parts[0], parts[2], signingInput); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrManifestSignature, err)
+	}
+	return payload, nil
+}
+
+// VerifyBundle checks a bundle signature, a JWS in compact serialization with the bundle as its
+// detached payload (RFC 7515 appendix F), against the bundle read from r. The bundle is streamed
+// through the hash of the signature algorithm, only EdDSA holds it in memory.
+func (v *ManifestVerifier) VerifyBundle(signature []byte, bundle io.Reader) error {
+	parts := bytes.Split(bytes.TrimSpace(signature), []byte("."))
+	if len(parts) != 3 || len(parts[1]) != 0 {
+		return fmt.Errorf("%w: not a JWS with a detached payload", ErrBundleSignature)
+	}
+	// the signing input is the encoded header and the encoded bundle, encoded as it is read
+	reader, writer := io.Pipe()
+	go func() {
+		encoder := base64.NewEncoder(base64.RawURLEncoding, writer)
+		_, err := io.Copy(encoder, bundle)
+		if err == nil {
+			err = encoder.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	defer reader.Close()
+	signingInput := io.MultiReader(bytes.NewReader(append(parts[0], '.')), reader)
+	if err := v.verifyJWS(parts[0], parts[2], signingInput); err != nil {
+		return fmt.Errorf("%w: %v", ErrBundleSignature, err)
+	}
+	return nil
+}
+
+// verifyJWS checks the encoded signature of the signing input with the key of the verifier, or
+// with the key of the x5c chain of the encoded header when the verifier trusts CAs
+func (v *ManifestVerifier) verifyJWS(encodedHeader, encodedSignature []byte, signingInput io.Reader) error {
+	headerJSON, err := base64.RawURLEncoding.DecodeString(string(encodedHeader))
+	if err != nil {
+		return fmt.Errorf("invalid header encoding: %v", err)
+	}
+	var header jwsHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return fmt.Errorf("invalid header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(string(encodedSignature))
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	publicKey := v.publicKey
+	if v.roots != nil {
+		publicKey, err = v.verifyChain(header.X5c)
+		if err != nil {
+			return err
+		}
+	}
+	return verifyJWSSignature(header.Alg, publicKey, signingInput, signature)
+}
+
+// verifyChain returns the key of the leaf certificate of an x5c chain issued by one of the roots
+func (v *ManifestVerifier) verifyChain(x5c []string) (any, error) {
+	if len(x5c) == 0 {
+		return nil, fmt.Errorf("no x5c certificate chain to verify against the CA")
+	}
+	certs := make([]*x509.Certificate, 0, len(x5c))
+	for i, encoded := range x5c {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x5c[%d] encoding: %v", i, err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x5c[%d] certificate: %v", i, err)
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("untrusted signing certificate %q: %v", certs[0].Subject.CommonName, err)
+	}
+	return certs[0].PublicKey, nil
+}
+
+// hashSigningInput returns the digest of the signing input read from r
+func hashSigningInput(hash stdcrypto.Hash, r io.Reader) ([]byte, error) {
+	hasher := hash.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return nil, fmt.Errorf("failed to read the signed content: %v", err)
+	}
+	return hasher.Sum(nil), nil
+}
+
+// verifyJWSSignature checks the signature of the signing input with the algorithm of the header,
+// the algorithm has to match the type of the key so a key cannot be used with a weaker one
+func verifyJWSSignature(alg string, publicKey any, signingInput io.Reader, signature []byte) error {
+	switch alg {
+	case "ES256", "ES384":
+		key, ok := publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s does not match the %T key", alg, publicKey)
+		}
+		curve, hash := elliptic.P256(), stdcrypto.SHA256
+		if alg == "ES384" {
+			curve, hash = elliptic.P384(), stdcrypto.SHA384
+		}
+		if key.Curve != curve {
+			return fmt.Errorf("algorithm %s does not match the %s key", alg, key.Curve.Params().Name)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid %s signature length %d", alg, len(signature))
+		}
+		hashed, err := hashSigningInput(hash, signingInput)
+		if err != nil {
+			return err
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, hashed, r, s) {
+			return fmt.Errorf("invalid %s signature", alg)
+		}
+		return nil
+
+	case "RS256", "PS256":
+		key, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s does not match the %T key", alg, publicKey)
+		}
+		hashed, err := hashSigningInput(stdcrypto.SHA256, signingInput)
+		if err != nil {
+			return err
+		}
+		if alg == "RS256" {
+			err = rsa.VerifyPKCS1v15(key, stdcrypto.SHA256, hashed, signature)
+		} else {
+			err = rsa.VerifyPSS(key, stdcrypto.SHA256, hashed, signature, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s signature", alg)
+		}
+		return nil
+
+	case "EdDSA":
+		key, ok := publicKey.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %s does not match the %T key", alg, publicKey)
+		}
+		// EdDSA signs the input itself rather than a digest of it
+		message, err := io.ReadAll(signingInput)
+		if err != nil {
+			return fmt.Errorf("failed to read the signed content: %v", err)
+		}
+		if !ed25519.Verify(key, message, signature) {
+			return fmt.Errorf("invalid %s signature", alg)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+}
+
+// SignManifest signs the manifest JSON with a PEM private key into a JWS in compact serialization,
+// the certificate chain of the key, leaf first, is added as x5c for verifiers trusting a CA
+func SignManifest(manifest []byte, privateKeyPEM string, chain ...*x509.Certificate) ([]byte, error) {
+	encodedHeader, signature, err := signJWS(manifestJWSType, manifest, privateKeyPEM, chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign manifest: %w", err)
+	}
+	return []byte(encodedHeader + "." + base64.RawURLEncoding.EncodeToString(manifest) + "." + signature), nil
+}
+
+// SignBundle signs the bundle archive with a PEM private key into a JWS in compact serialization
+// whose payload is detached, the bundle is not part of the signature and is passed to VerifyBundle
+// as it is. The certificate chain is added like SignManifest does.
+func SignBundle(bundle []byte, privateKeyPEM string, chain ...*x509.Certificate) ([]byte, error) {
+	encodedHeader, signature, err := signJWS(bundleJWSType, bundle, privateKeyPEM, chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign bundle: %w", err)
+	}
+	return []byte(encodedHeader + ".." + signature), nil
+}
+
+// signJWS signs the payload into a JWS of the typ and returns its encoded header and signature
+func signJWS(typ string, payload []byte, privateKeyPEM string, chain []*x509.Certificate) (encodedHeader, encodedSignature string, err error) {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return "", "", fmt.Errorf("failed to decode private key PEM")
+	}
+	var privateKey any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("unsupported or invalid private key PEM (type=%s): %w", block.Type, err)
+	}
+
+	header := jwsHeader{Typ: typ}
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			header.Alg = "ES256"
+		case elliptic.P384():
+			header.Alg = "ES384"
+		default:
+			return "", "", fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+	case *rsa.PrivateKey:
+		header.Alg = "RS256"
+	case ed25519.PrivateKey:
+		header.Alg = "EdDSA"
+	default:
+		return "", "", fmt.Errorf("unsupported private key type: %T", privateKey)
+	}
+	for _, cert := range chain {
+		header.X5c = append(header.X5c, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", "", err
+	}
+	encodedHeader = base64.RawURLEncoding.EncodeToString(headerJSON)
+	signingInput := encodedHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch key := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		hashed := sha256.Sum256([]byte(signingInput))
+		digest := hashed[:]
+		if header.Alg == "ES384" {
+			hashed := sha512.Sum384([]byte(signingInput))
+			digest = hashed[:]
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return "", "", err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, stdcrypto.SHA256, digest[:])
+		if err != nil {
+			return "", "", err
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signingInput))
+	}
+	return encodedHeader, base64.RawURLEncoding.EncodeToString(signature), nil
+}
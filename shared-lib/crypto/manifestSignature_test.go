@@ -0,0 +1,189 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testManifest = []byte(`{"manifestVersion":3,"deployments":[]}`)
+
+func generateECKeyPEM(t *testing.T) (*ecdsa.PrivateKey, string, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	privDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return key,
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privDER})),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+}
+
+// issueTestCertificate issues a certificate for key, self-signed when parent is nil
+func issueTestCertificate(t *testing.T, name string, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestManifestSignature_PublicKey(t *testing.T) {
+	_, privatePEM, publicPEM := generateECKeyPEM(t)
+	signed, err := SignManifest(testManifest, privatePEM)
+	require.NoError(t, err)
+
+	verifier, err := NewManifestVerifier(publicPEM)
+	require.NoError(t, err)
+	payload, err := verifier.Verify(signed)
+	require.NoError(t, err)
+	assert.Equal(t, testManifest, payload)
+
+	// the payload of a signed manifest cannot be swapped
+	_, _, otherPublicPEM := generateECKeyPEM(t)
+	otherVerifier, err := NewManifestVerifier(otherPublicPEM)
+	require.NoError(t, err)
+	_, err = otherVerifier.Verify(signed)
+	assert.ErrorIs(t, err, ErrManifestSignature)
+
+	forged, err := SignManifest([]byte(`{"manifestVersion":4}`), privatePEM)
+	require.NoError(t, err)
+	parts := splitJWS(t, signed)
+	forgedParts := splitJWS(t, forged)
+	_, err = verifier.Verify([]byte(parts[0] + "." + forgedParts[1] + "." + parts[2]))
+	assert.ErrorIs(t, err, ErrManifestSignature)
+
+	_, err = verifier.Verify(testManifest)
+	assert.ErrorContains(t, err, "not a JWS in compact serialization")
+}
+
+func TestManifestSignature_RSAAndEd25519(t *testing.T) {
+	rsaPrivatePEM, rsaPublicPEM := generateTestKeyPair(t)
+	signed, err := SignManifest(testManifest, rsaPrivatePEM)
+	require.NoError(t, err)
+	verifier, err := NewManifestVerifier([]byte(rsaPublicPEM))
+	require.NoError(t, err)
+	payload, err := verifier.Verify(signed)
+	require.NoError(t, err)
+	assert.Equal(t, testManifest, payload)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	privDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	pubDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+	signed, err = SignManifest(testManifest, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})))
+	require.NoError(t, err)
+	verifier, err = NewManifestVerifier(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+	require.NoError(t, err)
+	payload, err = verifier.Verify(signed)
+	require.NoError(t, err)
+	assert.Equal(t, testManifest, payload)
+
+	// a manifest signed with another algorithm than the one the key is for is rejected
+	_, err = verifier.Verify([]byte(`eyJhbGciOiJIUzI1NiJ9.` + splitJWS(t, signed)[1] + `.c2ln`))
+	assert.ErrorContains(t, err, `unsupported algorithm "HS256"`)
+}
+
+func TestManifestSignature_CA(t *testing.T) {
+	caKey, _, _ := generateECKeyPEM(t)
+	ca := issueTestCertificate(t, "wfm-ca", caKey, nil, nil)
+	signingKey, signingPEM, _ := generateECKeyPEM(t)
+	signingCert := issueTestCertificate(t, "wfm-manifest-signer", signingKey, ca, caKey)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+
+	verifier, err := NewManifestVerifierFromCA(caPEM)
+	require.NoError(t, err)
+
+	signed, err := SignManifest(testManifest, signingPEM, signingCert)
+	require.NoError(t, err)
+	payload, err := verifier.Verify(signed)
+	require.NoError(t, err)
+	assert.Equal(t, testManifest, payload)
+
+	unchained, err := SignManifest(testManifest, signingPEM)
+	require.NoError(t, err)
+	_, err = verifier.Verify(unchained)
+	assert.ErrorContains(t, err, "no x5c certificate chain")
+
+	// a self-issued certificate is not trusted
+	rogueKey, roguePEM, _ := generateECKeyPEM(t)
+	rogue := issueTestCertificate(t, "rogue", rogueKey, nil, nil)
+	signed, err = SignManifest(testManifest, roguePEM, rogue)
+	require.NoError(t, err)
+	_, err = verifier.Verify(signed)
+	assert.ErrorIs(t, err, ErrManifestSignature)
+	assert.ErrorContains(t, err, `untrusted signing certificate "rogue"`)
+
+	// the certificate of the key also works as a plain public key
+	certVerifier, err := NewManifestVerifier(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signingCert.Raw}))
+	require.NoError(t, err)
+	_, err = certVerifier.Verify(unchained)
+	assert.NoError(t, err)
+
+	_, err = NewManifestVerifierFromCA([]byte("not a certificate"))
+	assert.ErrorContains(t, err, "no CA certificate found")
+}
+
+func TestBundleSignature(t *testing.T) {
+	bundle := bytes.Repeat([]byte("bundle"), 1<<12)
+	rsaPrivatePEM, rsaPublicPEM := generateTestKeyPair(t)
+	_, ecPrivatePEM, ecPublicPEM := generateECKeyPEM(t)
+	for name, keys := range map[string][2]string{"RSA": {rsaPrivatePEM, rsaPublicPEM}, "EC": {ecPrivatePEM, string(ecPublicPEM)}} {
+		signature, err := SignBundle(bundle, keys[0])
+		require.NoError(t, err, name)
+		assert.Equal(t, 2, strings.Count(string(signature), "."), name)
+		assert.Contains(t, string(signature), "..", name)
+
+		verifier, err := NewManifestVerifier([]byte(keys[1]))
+		require.NoError(t, err, name)
+		assert.NoError(t, verifier.VerifyBundle(signature, bytes.NewReader(bundle)), name)
+
+		tampered := append(bytes.Clone(bundle), '!')
+		assert.ErrorIs(t, verifier.VerifyBundle(signature, bytes.NewReader(tampered)), ErrBundleSignature, name)
+	}
+
+	verifier, err := NewManifestVerifier(ecPublicPEM)
+	require.NoError(t, err)
+	// a signed manifest is not a bundle signature
+	signed, err := SignManifest(testManifest, ecPrivatePEM)
+	require.NoError(t, err)
+	err = verifier.VerifyBundle(signed, bytes.NewReader(testManifest))
+	assert.ErrorIs(t, err, ErrBundleSignature)
+	assert.ErrorContains(t, err, "not a JWS with a detached payload")
+}
+
+func splitJWS(t *testing.T, signed []byte) []string {
+	t.Helper()
+	parts := strings.Split(string(signed), ".")
+	require.Len(t, parts, 3)
+	return parts
+}
@@ -0,0 +1,178 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultKeyReloadInterval is how often a ReloadableSigner checks its key file for changes
+const DefaultKeyReloadInterval = 30 * time.Second
+
+// ReloadableSigner signs requests with the private key of a file and picks up a new key when the
+// file changes, so keys can be rotated without a restart. A key that does not load is not swapped
+// in, requests keep being signed with the last good one. It is safe for concurrent use.
+type ReloadableSigner struct {
+	path            string
+	signatureAlgo   string
+	hashAlgo        string
+	signatureFormat string
+	interval        time.Duration
+	onReload        func(keyid string, err error)
+
+	current atomic.Pointer[loadedSigner]
+	// reloadMu serializes reloads, signing does not wait for it
+	reloadMu sync.Mutex
+	// seen is the state of the key file at the last reload attempt
+	seen keyFileState
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type loadedSigner struct {
+	signer HTTPSigner
+	keyid  string
+}
+
+type keyFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+type ReloadableSignerOption func(*ReloadableSigner)
+
+// WithKeyReloadInterval sets how often the key file is checked for changes
+func WithKeyReloadInterval(interval time.Duration) ReloadableSignerOption {
+	return func(s *ReloadableSigner) {
+		if interval > 0 {
+			s.interval = interval
+		}
+	}
+}
+
+// WithKeyReloadListener is called after every reload of a changed key file, with the keyid of the
+// new key or the error that kept the old one. Without it reloads are logged with the log package.
+func WithKeyReloadListener(listener func(keyid string, err error)) ReloadableSignerOption {
+	return func(s *ReloadableSigner) {
+		s.onReload = listener
+	}
+}
+
+// NewReloadableSigner loads the key of the file, it fails like NewSignerFromFile when the key does
+// not load. Call Start to watch the file for changes.
+func NewReloadableSigner(path, signatureAlgo, hashAlgo, signatureFormat string, opts ...ReloadableSignerOption) (*ReloadableSigner, error) {
+	s := &ReloadableSigner{
+		path:            path,
+		signatureAlgo:   signatureAlgo,
+		hashAlgo:        hashAlgo,
+		signatureFormat: signatureFormat,
+		interval:        DefaultKeyReloadInterval,
+		stop:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads the key file and swaps in its key. On failure the current key is kept.
+func (s *ReloadableSigner) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.reload()
+}
+
+func (s *ReloadableSigner) reload() error {
+	if info, err := os.Stat(s.path); err == nil {
+		s.seen = keyFileState{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	keyBytes, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read request signer key from %s: %w", s.path, err)
+	}
+	keyid, err := ComputeKeyIDFromPrivateKeyPEM(string(keyBytes))
+	if err != nil {
+		return fmt.Errorf("failed to derive keyid from private key %s: %w", s.path, err)
+	}
+	signer, err := NewSigner(string(keyBytes), keyid, s.signatureAlgo, s.hashAlgo, s.signatureFormat)
+	if err != nil {
+		return fmt.Errorf("failed to load request signer key from %s: %w", s.path, err)
+	}
+	s.current.Store(&loadedSigner{signer: signer, keyid: keyid})
+	return nil
+}
+
+// KeyID returns the keyid of the key requests are signed with
+func (s *ReloadableSigner) KeyID() string {
+	return s.current.Load().keyid
+}
+
+// SignRequest signs the request with the current key, it is a RequestEditorFn
+func (s *ReloadableSigner) SignRequest(ctx context.Context, req *http.Request) error {
+	return s.current.Load().signer.SignRequest(ctx, req)
+}
+
+func (s *ReloadableSigner) SignResponse(ctx context.Context, resp http.ResponseWriter) error {
+	return s.current.Load().signer.SignResponse(ctx, resp)
+}
+
+// Start checks the key file for changes every interval until Stop is called
+func (s *ReloadableSigner) Start() {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.reloadIfChanged()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops watching the key file, the signer keeps signing with the current key
+func (s *ReloadableSigner) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// reloadIfChanged reloads the key once the modification time or size of the file changed. A key
+// that failed to load is tried again only after the file changed again.
+func (s *ReloadableSigner) reloadIfChanged() {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		// a key being replaced by a rename may be missing for a moment
+		return
+	}
+	if info.ModTime().Equal(s.seen.modTime) && info.Size() == s.seen.size {
+		return
+	}
+
+	previous := s.current.Load().keyid
+	err = s.reload()
+	keyid := s.current.Load().keyid
+	switch {
+	case s.onReload != nil:
+		s.onReload(keyid, err)
+	case err != nil:
+		log.Printf("Keeping request signer key %s, the changed key file does not load: %v", previous, err)
+	default:
+		log.Printf("Reloaded request signer key from %s, keyid %s", s.path, keyid)
+	}
+}
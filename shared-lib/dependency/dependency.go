@@ -0,0 +1,163 @@
+// Package dependency resolves declared dependencies between named items, e.g. applications that
+// need other applications installed first. It checks version constraints, finds cycles and orders
+// items so that dependencies come before their dependents.
+package dependency
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// Requirement names an item that must be present and optionally constrains its version
+type Requirement struct {
+	// ID of the required item
+	ID string `json:"id" yaml:"id"`
+	// Version is a semver constraint such as "^1.2" or ">= 1.0, < 2.0", empty accepts any version
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+}
+
+func (r Requirement) String() string {
+	if r.Version == "" {
+		return r.ID
+	}
+	return fmt.Sprintf("%s (%s)", r.ID, r.Version)
+}
+
+// Validate checks that the requirement names an item and that its constraint parses
+func (r Requirement) Validate() error {
+	if strings.TrimSpace(r.ID) == "" {
+		return fmt.Errorf("dependency id cannot be empty")
+	}
+	if r.Version == "" {
+		return nil
+	}
+	if _, err := semver.NewConstraint(r.Version); err != nil {
+		return fmt.Errorf("invalid version constraint %q for dependency %s: %w", r.Version, r.ID, err)
+	}
+	return nil
+}
+
+// SatisfiedBy reports whether version satisfies the constraint of the requirement. Without a
+// constraint any version does, with one the version must be a semantic version.
+func (r Requirement) SatisfiedBy(version string) (bool, error) {
+	if r.Version == "" {
+		return true, nil
+	}
+	constraint, err := semver.NewConstraint(r.Version)
+	if err != nil {
+		return false, fmt.Errorf("invalid version constraint %q for dependency %s: %w", r.Version, r.ID, err)
+	}
+	parsed, err := semver.NewVersion(version)
+	if err != nil {
+		return false, nil
+	}
+	return constraint.Check(parsed), nil
+}
+
+// CycleError is returned when items depend on each other in a circle
+type CycleError struct {
+	// Cycle lists the items of the circle, the first one is repeated at the end
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("circular dependency: %s", strings.Join(e.Cycle, " -> "))
+}
+
+// Graph maps every item to the ids of the items it depends on. Dependencies that are not items of
+// the graph themselves are ignored when ordering, whether they are present is up to the caller.
+type Graph map[string][]string
+
+// FindCycle returns the cycle that start is part of or leads to, nil if there is none
+func (g Graph) FindCycle(start string) []string {
+	var (
+		path    []string
+		onPath  = map[string]bool{}
+		visited = map[string]bool{}
+		visit   func(id string) []string
+	)
+	visit = func(id string) []string {
+		if onPath[id] {
+			for i, pathId := range path {
+				if pathId == id {
+					return append(append([]string{}, path[i:]...), id)
+				}
+			}
+		}
+		if visited[id] {
+			return nil
+		}
+		visited[id] = true
+		onPath[id] = true
+		path = append(path, id)
+		for _, dependency := range g.sortedDependencies(id) {
+			if cycle := visit(dependency); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		onPath[id] = false
+		return nil
+	}
+	return visit(start)
+}
+
+// Order returns the items of the graph with every item after the items it depends on. Items that do
+// not depend on each other are sorted by id, so the order is stable. A *CycleError is returned when
+// no such order exists.
+func (g Graph) Order() ([]string, error) {
+	ids := make([]string, 0, len(g))
+	for id := range g {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var (
+		order   = make([]string, 0, len(g))
+		ordered = map[string]bool{}
+		visit   func(id string)
+	)
+	visit = func(id string) {
+		if ordered[id] {
+			return
+		}
+		ordered[id] = true
+		for _, dependency := range g.sortedDependencies(id) {
+			if _, known := g[dependency]; known {
+				visit(dependency)
+			}
+		}
+		order = append(order, id)
+	}
+	for _, id := range ids {
+		if cycle := g.FindCycle(id); cycle != nil {
+			return nil, &CycleError{Cycle: cycle}
+		}
+		visit(id)
+	}
+	return order, nil
+}
+
+// Dependents returns the items that depend on id directly, sorted
+func (g Graph) Dependents(id string) []string {
+	var dependents []string
+	for item, dependencies := range g {
+		for _, dependency := range dependencies {
+			if dependency == id && item != id {
+				dependents = append(dependents, item)
+				break
+			}
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+func (g Graph) sortedDependencies(id string) []string {
+	dependencies := append([]string{}, g[id]...)
+	sort.Strings(dependencies)
+	return dependencies
+}
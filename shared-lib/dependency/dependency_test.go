@@ -0,0 +1,99 @@
+package dependency
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRequirementSatisfiedBy(t *testing.T) {
+	tests := []struct {
+		name        string
+		requirement Requirement
+		version     string
+		want        bool
+	}{
+		{name: "no constraint", requirement: Requirement{ID: "broker"}, version: "whatever", want: true},
+		{name: "matching version", requirement: Requirement{ID: "broker", Version: "^1.2"}, version: "1.4.0", want: true},
+		{name: "version too old", requirement: Requirement{ID: "broker", Version: ">= 1.2"}, version: "1.1.9", want: false},
+		{name: "major mismatch", requirement: Requirement{ID: "broker", Version: "^1.2"}, version: "2.0.0", want: false},
+		{name: "not a semantic version", requirement: Requirement{ID: "broker", Version: "^1.2"}, version: "latest", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.requirement.SatisfiedBy(tt.version)
+			if err != nil {
+				t.Fatalf("SatisfiedBy() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("SatisfiedBy(%q) = %v, want %v", tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequirementValidate(t *testing.T) {
+	if err := (Requirement{ID: "broker", Version: ">= 1.0, < 2.0"}).Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	if err := (Requirement{Version: "1.0"}).Validate(); err == nil {
+		t.Error("Validate() accepted a requirement without id")
+	}
+	if err := (Requirement{ID: "broker", Version: "not a constraint"}).Validate(); err == nil {
+		t.Error("Validate() accepted an invalid constraint")
+	}
+}
+
+func TestGraphOrder(t *testing.T) {
+	graph := Graph{
+		"dashboard": {"broker", "database"},
+		"database":  nil,
+		"broker":    {"database", "not-a-node"},
+		"logger":    nil,
+	}
+	order, err := graph.Order()
+	if err != nil {
+		t.Fatalf("Order() error = %v", err)
+	}
+	want := []string{"database", "broker", "dashboard", "logger"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("Order() = %v, want %v", order, want)
+	}
+
+	if dependents := graph.Dependents("database"); !reflect.DeepEqual(dependents, []string{"broker", "dashboard"}) {
+		t.Errorf("Dependents() = %v", dependents)
+	}
+}
+
+func TestGraphCycles(t *testing.T) {
+	graph := Graph{
+		"a": {"b"},
+		"b": {"c"},
+		"c": {"a"},
+		"d": {"a"},
+		"e": nil,
+	}
+	if cycle := graph.FindCycle("a"); !reflect.DeepEqual(cycle, []string{"a", "b", "c", "a"}) {
+		t.Errorf("FindCycle(a) = %v", cycle)
+	}
+	// d is not part of the cycle but cannot be installed either
+	if cycle := graph.FindCycle("d"); !reflect.DeepEqual(cycle, []string{"a", "b", "c", "a"}) {
+		t.Errorf("FindCycle(d) = %v", cycle)
+	}
+	if cycle := graph.FindCycle("e"); cycle != nil {
+		t.Errorf("FindCycle(e) = %v, want none", cycle)
+	}
+
+	_, err := graph.Order()
+	var cycleErr *CycleError
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("Order() error = %v, want a CycleError", err)
+	}
+	if cycleErr.Error() != "circular dependency: a -> b -> c -> a" {
+		t.Errorf("unexpected error %q", cycleErr.Error())
+	}
+
+	if cycle := (Graph{"self": {"self"}}).FindCycle("self"); !reflect.DeepEqual(cycle, []string{"self", "self"}) {
+		t.Errorf("FindCycle(self) = %v", cycle)
+	}
+}
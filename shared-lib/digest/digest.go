@@ -0,0 +1,253 @@
+// Package digest computes, parses and verifies the content digests ("algorithm:hex") that address
+// deployments, bundles and cache entries. Every place that hashes content or compares digests goes
+// through it, so that a new digest algorithm is a change to this package only.
+package digest
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Algorithm names a digest algorithm, e.g. "sha256"
+type Algorithm string
+
+// Algorithms known to the device and the WFM
+const (
+	SHA256 Algorithm = "sha256"
+	SHA384 Algorithm = "sha384"
+	SHA512 Algorithm = "sha512"
+	// BLAKE3 is registered for OCI content but cannot be computed here, its digests are parsed
+	// as unverifiable
+	BLAKE3 Algorithm = "blake3"
+)
+
+// Canonical is the algorithm new digests are computed with
+const Canonical = SHA256
+
+// algorithms are the known algorithms with the length of their hex encoding and their hash, nil
+// for the ones that cannot be verified
+var algorithms = map[Algorithm]struct {
+	hexLen  int
+	newHash func() hash.Hash
+}{
+	SHA256: {hexLen: 64, newHash: sha256.New},
+	SHA384: {hexLen: 96, newHash: sha512.New384},
+	SHA512: {hexLen: 128, newHash: sha512.New},
+	BLAKE3: {hexLen: 64},
+}
+
+// Verifiable reports whether digests of the algorithm can be computed and verified
+func (a Algorithm) Verifiable() bool {
+	return algorithms[a].newHash != nil
+}
+
+// ErrInvalid is wrapped by the errors of malformed digests. Like every error of the package its
+// message starts with "digest", callers prefix it with what they verified, e.g. "bundle digest ...".
+var ErrInvalid = errors.New("digest is malformed")
+
+// UnsupportedAlgorithmError is returned for digests of an algorithm that is unknown, or known but
+// cannot be computed here
+type UnsupportedAlgorithmError struct {
+	Algorithm Algorithm
+}
+
+func (e *UnsupportedAlgorithmError) Error() string {
+	if _, known := algorithms[e.Algorithm]; known {
+		return fmt.Sprintf("digest algorithm %q cannot be verified, supported: %s", e.Algorithm, supportedAlgorithms())
+	}
+	return fmt.Sprintf("digest algorithm %q is unknown, supported: %s", e.Algorithm, supportedAlgorithms())
+}
+
+// IntegrityMismatch is returned when content does not have the digest it is expected to have
+type IntegrityMismatch struct {
+	Expected Digest
+	Actual   Digest
+}
+
+func (e *IntegrityMismatch) Error() string {
+	return fmt.Sprintf("digest mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+func supportedAlgorithms() string {
+	var names []string
+	for algorithm := range algorithms {
+		if algorithm.Verifiable() {
+			names = append(names, string(algorithm))
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Digest is a content digest. The zero value is no digest, a parsed digest of an algorithm that
+// cannot be computed here is kept as is and reported by Verifiable.
+type Digest struct {
+	algorithm Algorithm
+	encoded   string
+}
+
+var hexPattern = regexp.MustCompile(`^[a-f0-9]+$`)
+
+// Parse parses an "algorithm:hex" digest, the hex is case insensitive. Malformed digests wrap
+// ErrInvalid and unknown algorithms are an *UnsupportedAlgorithmError; known algorithms that
+// cannot be computed here parse into a digest that is not Verifiable.
+func Parse(s string) (Digest, error) {
+	s = strings.TrimSpace(s)
+	name, encoded, found := strings.Cut(s, ":")
+	if !found || name == "" || encoded == "" {
+		return Digest{}, fmt.Errorf("%w: %q, expected algorithm:hex", ErrInvalid, s)
+	}
+
+	algorithm := Algorithm(strings.ToLower(name))
+	spec, known := algorithms[algorithm]
+	if !known {
+		return Digest{}, &UnsupportedAlgorithmError{Algorithm: algorithm}
+	}
+
+	encoded = strings.ToLower(encoded)
+	if len(encoded) != spec.hexLen || !hexPattern.MatchString(encoded) {
+		return Digest{}, fmt.Errorf("%w: %q, %s expects %d hex characters", ErrInvalid, s, algorithm, spec.hexLen)
+	}
+	return Digest{algorithm: algorithm, encoded: encoded}, nil
+}
+
+// ParseVerifiable parses a digest content is about to be fetched or checked against, a digest that
+// is not Verifiable is an *UnsupportedAlgorithmError
+func ParseVerifiable(s string) (Digest, error) {
+	d, err := Parse(s)
+	if err != nil {
+		return Digest{}, err
+	}
+	if !d.Verifiable() {
+		return Digest{}, &UnsupportedAlgorithmError{Algorithm: d.algorithm}
+	}
+	return d, nil
+}
+
+// FromBytes returns the Canonical digest of data
+func FromBytes(data []byte) Digest {
+	digester := newDigester(Canonical)
+	digester.Write(data)
+	return digester.Digest()
+}
+
+// Compute streams r into a digest of the algorithm, the content is never held in memory
+func Compute(algorithm Algorithm, r io.Reader) (Digest, error) {
+	digester, err := NewDigester(algorithm)
+	if err != nil {
+		return Digest{}, err
+	}
+	if _, err := io.Copy(digester, r); err != nil {
+		return Digest{}, fmt.Errorf("failed to read the content to digest: %w", err)
+	}
+	return digester.Digest(), nil
+}
+
+// Verify checks that data has the expected digest, see Digest.Verify
+func Verify(expected string, data []byte) error {
+	d, err := Parse(expected)
+	if err != nil {
+		return err
+	}
+	return d.Verify(data)
+}
+
+// Algorithm returns the algorithm of the digest
+func (d Digest) Algorithm() Algorithm {
+	return d.algorithm
+}
+
+// Encoded returns the lower case hex of the digest
+func (d Digest) Encoded() string {
+	return d.encoded
+}
+
+// IsZero reports whether d is no digest
+func (d Digest) IsZero() bool {
+	return d.algorithm == ""
+}
+
+// Verifiable reports whether content can be verified against the digest
+func (d Digest) Verifiable() bool {
+	return d.algorithm.Verifiable()
+}
+
+// String returns the "algorithm:hex" form of the digest
+func (d Digest) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return string(d.algorithm) + ":" + d.encoded
+}
+
+// Equal reports whether both digests are of the same algorithm and value. Digests of different
+// algorithms never compare equal, even of the same content.
+func (d Digest) Equal(other Digest) bool {
+	return d.algorithm == other.algorithm && d.encoded == other.encoded
+}
+
+// Verify checks that data has the digest. It returns an *IntegrityMismatch when it does not and an
+// *UnsupportedAlgorithmError when the digest is not Verifiable.
+func (d Digest) Verify(data []byte) error {
+	digester, err := NewDigester(d.algorithm)
+	if err != nil {
+		return err
+	}
+	digester.Write(data)
+	return d.Check(digester.Digest())
+}
+
+// VerifyReader streams r and checks that its content has the digest, see Verify
+func (d Digest) VerifyReader(r io.Reader) error {
+	actual, err := Compute(d.algorithm, r)
+	if err != nil {
+		return err
+	}
+	return d.Check(actual)
+}
+
+// Check returns an *IntegrityMismatch when the actual digest, e.g. of a Digester, differs
+func (d Digest) Check(actual Digest) error {
+	if !d.Equal(actual) {
+		return &IntegrityMismatch{Expected: d, Actual: actual}
+	}
+	return nil
+}
+
+// Digester computes a digest of everything written to it, wrap a reader in an io.TeeReader to
+// digest content while it is read
+type Digester struct {
+	algorithm Algorithm
+	hash      hash.Hash
+}
+
+// NewDigester returns a digester of the algorithm, or an *UnsupportedAlgorithmError when it is
+// not Verifiable
+func NewDigester(algorithm Algorithm) (*Digester, error) {
+	if !algorithm.Verifiable() {
+		return nil, &UnsupportedAlgorithmError{Algorithm: algorithm}
+	}
+	return newDigester(algorithm), nil
+}
+
+func newDigester(algorithm Algorithm) *Digester {
+	return &Digester{algorithm: algorithm, hash: algorithms[algorithm].newHash()}
+}
+
+// Write adds p to the digested content, it never fails
+func (d *Digester) Write(p []byte) (int, error) {
+	return d.hash.Write(p)
+}
+
+// Digest returns the digest of the content written so far
+func (d *Digester) Digest() Digest {
+	return Digest{algorithm: d.algorithm, encoded: hex.EncodeToString(d.hash.Sum(nil))}
+}
@@ -0,0 +1,123 @@
+package digest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyDigest is how digests were formatted before this package, every migrated site must keep
+// producing it
+func legacyDigest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+func TestDigest_MatchesLegacyFormat(t *testing.T) {
+	large := bytes.Repeat([]byte("margo"), 1<<20)
+	for _, data := range [][]byte{nil, []byte("kind: ApplicationDeployment\n"), large} {
+		assert.Equal(t, legacyDigest(data), FromBytes(data).String())
+
+		computed, err := Compute(Canonical, bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, legacyDigest(data), computed.String())
+
+		assert.Equal(t, fmt.Sprintf("\"%s\"", legacyDigest(data)), ToETag(computed))
+		assert.NoError(t, Verify(legacyDigest(data), data))
+	}
+}
+
+func TestParse(t *testing.T) {
+	sha256Hex := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name           string
+		value          string
+		want           string
+		wantVerifiable bool
+		wantInvalid    bool
+		wantAlgorithm  Algorithm
+	}{
+		{name: "sha256", value: "sha256:" + sha256Hex, want: "sha256:" + sha256Hex, wantVerifiable: true},
+		{name: "upper case", value: " SHA256:" + strings.ToUpper(sha256Hex) + " ", want: "sha256:" + sha256Hex, wantVerifiable: true},
+		{name: "sha512", value: "sha512:" + strings.Repeat("ab", 64), want: "sha512:" + strings.Repeat("ab", 64), wantVerifiable: true},
+		{name: "known but not verifiable", value: "blake3:" + sha256Hex, want: "blake3:" + sha256Hex},
+		{name: "unknown algorithm", value: "md5:" + strings.Repeat("ab", 16), wantAlgorithm: "md5"},
+		{name: "bare hex", value: sha256Hex, wantInvalid: true},
+		{name: "short", value: "sha256:abcd", wantInvalid: true},
+		{name: "not hex", value: "sha256:" + strings.Repeat("zz", 32), wantInvalid: true},
+		{name: "empty", value: "", wantInvalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.value)
+			switch {
+			case tt.wantInvalid:
+				assert.ErrorIs(t, err, ErrInvalid)
+			case tt.wantAlgorithm != "":
+				var unsupported *UnsupportedAlgorithmError
+				require.True(t, errors.As(err, &unsupported), "got %v", err)
+				assert.Equal(t, tt.wantAlgorithm, unsupported.Algorithm)
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, got.String())
+				assert.Equal(t, tt.wantVerifiable, got.Verifiable())
+			}
+		})
+	}
+}
+
+func TestDigest_VerifyUnverifiable(t *testing.T) {
+	blake3, err := Parse("blake3:" + strings.Repeat("ab", 32))
+	require.NoError(t, err)
+
+	var unsupported *UnsupportedAlgorithmError
+	assert.True(t, errors.As(blake3.Verify([]byte("data")), &unsupported))
+	_, err = ParseVerifiable(blake3.String())
+	assert.EqualError(t, err, `digest algorithm "blake3" cannot be verified, supported: sha256, sha384, sha512`)
+}
+
+func TestDigest_IntegrityMismatch(t *testing.T) {
+	expected := FromBytes([]byte("original"))
+
+	err := expected.VerifyReader(strings.NewReader("tampered"))
+
+	var mismatch *IntegrityMismatch
+	require.True(t, errors.As(err, &mismatch), "got %v", err)
+	assert.True(t, expected.Equal(mismatch.Expected))
+	assert.Equal(t, legacyDigest([]byte("tampered")), mismatch.Actual.String())
+	assert.Equal(t, fmt.Sprintf("digest mismatch: expected %s, got %s", expected, mismatch.Actual), err.Error())
+}
+
+func TestDigest_EqualIsAlgorithmAware(t *testing.T) {
+	sha256Digest, err := Parse("sha256:" + strings.Repeat("ab", 32))
+	require.NoError(t, err)
+	blake3Digest, err := Parse("blake3:" + strings.Repeat("ab", 32))
+	require.NoError(t, err)
+	upper, err := Parse("sha256:" + strings.Repeat("AB", 32))
+	require.NoError(t, err)
+
+	assert.True(t, sha256Digest.Equal(upper))
+	assert.False(t, sha256Digest.Equal(blake3Digest), "same hex of different algorithms")
+	assert.False(t, sha256Digest.Equal(Digest{}))
+}
+
+func TestFromETag(t *testing.T) {
+	d := FromBytes([]byte("bundle"))
+
+	for _, etag := range []string{ToETag(d), "W/" + ToETag(d), " " + ToETag(d) + " "} {
+		parsed, err := FromETag(etag)
+		require.NoError(t, err, etag)
+		assert.True(t, d.Equal(parsed), etag)
+	}
+
+	_, err := FromETag(d.String())
+	assert.ErrorIs(t, err, ErrInvalid, "an unquoted entity tag")
+	_, err = FromETag(`"v2"`)
+	assert.ErrorIs(t, err, ErrInvalid, "an entity tag that is no digest")
+}
@@ -0,0 +1,22 @@
+package digest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ToETag returns the strong entity tag of content with the digest, the quoted digest
+func ToETag(d Digest) string {
+	return `"` + d.String() + `"`
+}
+
+// FromETag parses the digest of an entity tag. Weak validators (W/"...") are accepted, the digest
+// still names the content for If-None-Match, which compares entity tags weakly.
+func FromETag(etag string) (Digest, error) {
+	value := strings.TrimSpace(etag)
+	value = strings.TrimPrefix(value, "W/")
+	if len(value) < 2 || !strings.HasPrefix(value, `"`) || !strings.HasSuffix(value, `"`) {
+		return Digest{}, fmt.Errorf("%w: entity tag %q is not quoted", ErrInvalid, etag)
+	}
+	return Parse(value[1 : len(value)-1])
+}
@@ -0,0 +1,191 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// TempSuffix marks the temporary files of atomic writes, RemoveStaleTemps removes the ones a
+// crash left behind
+const TempSuffix = ".margo-tmp"
+
+// beforeRename is called between writing a temp file and renaming it into place, tests use it to
+// simulate a crash at the worst possible moment
+var beforeRename atomic.Pointer[func(tempPath, finalPath string) error]
+
+// SetBeforeRenameHook installs a hook that runs before every atomic rename, an error returned by
+// the hook aborts the write as if the rename failed. It is meant for tests, the returned function
+// restores the previous hook.
+func SetBeforeRenameHook(hook func(tempPath, finalPath string) error) (restore func()) {
+	previous := beforeRename.Swap(&hook)
+	return func() {
+		beforeRename.Store(previous)
+	}
+}
+
+// AtomicFile is written to a temp file in the directory of its final path and only replaces the
+// final path on Commit, so readers see either the previous or the complete new content.
+type AtomicFile struct {
+	file      *os.File
+	path      string
+	perm      fs.FileMode
+	committed bool
+}
+
+// CreateAtomic starts an atomic write of path, the directory must exist.
+// Close without Commit discards the write.
+func CreateAtomic(path string, perm fs.FileMode) (*AtomicFile, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, "."+base+".*"+TempSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file for %s: %w", path, err)
+	}
+	return &AtomicFile{file: file, path: path, perm: perm}, nil
+}
+
+func (f *AtomicFile) Write(p []byte) (int, error) {
+	return f.file.Write(p)
+}
+
+// Name returns the temp file being written
+func (f *AtomicFile) Name() string {
+	return f.file.Name()
+}
+
+// Commit flushes the temp file to disk and renames it to the final path
+func (f *AtomicFile) Commit() error {
+	if f.committed {
+		return nil
+	}
+	tempPath := f.file.Name()
+	if err := f.file.Chmod(f.perm); err != nil {
+		f.discard()
+		return fmt.Errorf("failed to set permissions of %s: %w", f.path, err)
+	}
+	if err := f.file.Sync(); err != nil {
+		f.discard()
+		return fmt.Errorf("failed to sync %s: %w", f.path, err)
+	}
+	if err := f.file.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to close %s: %w", f.path, err)
+	}
+	if hook := beforeRename.Load(); hook != nil && *hook != nil {
+		if err := (*hook)(tempPath, f.path); err != nil {
+			os.Remove(tempPath)
+			return fmt.Errorf("failed to replace %s: %w", f.path, err)
+		}
+	}
+	if err := os.Rename(tempPath, f.path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to replace %s: %w", f.path, err)
+	}
+	f.committed = true
+	return syncDir(filepath.Dir(f.path))
+}
+
+// Close discards the write unless it was committed
+func (f *AtomicFile) Close() error {
+	if f.committed {
+		return nil
+	}
+	f.discard()
+	return nil
+}
+
+func (f *AtomicFile) discard() {
+	f.file.Close()
+	os.Remove(f.file.Name())
+}
+
+// WriteFileAtomic is os.WriteFile with the guarantee that path holds either its previous or the
+// complete new content after a crash
+func WriteFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	return WriteAtomic(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteAtomic atomically replaces path with what write produces, nothing is replaced if write fails
+func WriteAtomic(path string, perm fs.FileMode, write func(w io.Writer) error) error {
+	file, err := CreateAtomic(path, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := write(file); err != nil {
+		return err
+	}
+	return file.Commit()
+}
+
+// RemoveStaleTemps removes the temp files of atomic writes interrupted by a crash from dir and
+// its subdirectories. Call it at startup, before anything writes to dir. A missing dir is not an error.
+func RemoveStaleTemps(dir string) ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), TempSuffix) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale temp file %s: %w", path, err)
+		}
+		removed = append(removed, path)
+		return nil
+	})
+	return removed, err
+}
+
+// RemoveStaleTempsOf removes the temp files left behind by interrupted atomic writes of path only,
+// for writers that share their directory with others
+func RemoveStaleTempsOf(path string) ([]string, error) {
+	dir, base := filepath.Split(path)
+	matches, err := filepath.Glob(filepath.Join(dir, "."+escapeGlob(base)+".*"+TempSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, match := range matches {
+		if err := os.Remove(match); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, fmt.Errorf("failed to remove stale temp file %s: %w", match, err)
+		}
+		removed = append(removed, match)
+	}
+	return removed, nil
+}
+
+func escapeGlob(name string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+	return replacer.Replace(name)
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+	// some filesystems do not support syncing directories, the rename itself already happened
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) && !errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
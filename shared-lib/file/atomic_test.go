@@ -0,0 +1,130 @@
+package file
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errCrash = errors.New("simulated crash")
+
+// crashBeforeRename fails every atomic write between writing the temp file and renaming it,
+// the temp files seen by the hook are returned
+func crashBeforeRename(t *testing.T) *[]string {
+	t.Helper()
+	var temps []string
+	restore := SetBeforeRenameHook(func(tempPath, finalPath string) error {
+		temps = append(temps, tempPath)
+		return errCrash
+	})
+	t.Cleanup(restore)
+	return &temps
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	require.NoError(t, WriteFileAtomic(path, []byte("first"), 0600))
+	require.NoError(t, WriteFileAtomic(path, []byte("second"), 0600))
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(content))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "no temp file is left behind")
+}
+
+func TestWriteFileAtomic_CrashBeforeRename(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, WriteFileAtomic(path, []byte("good"), 0644))
+
+	temps := crashBeforeRename(t)
+	err := WriteFileAtomic(path, []byte("partial"), 0644)
+	require.ErrorIs(t, err, errCrash)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "good", string(content))
+	require.Len(t, *temps, 1)
+	assert.True(t, strings.HasSuffix((*temps)[0], TempSuffix))
+	assert.NoFileExists(t, (*temps)[0])
+}
+
+func TestWriteAtomic_WriterFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, WriteFileAtomic(path, []byte("good"), 0644))
+
+	err := WriteAtomic(path, 0644, func(w io.Writer) error {
+		w.Write([]byte("half"))
+		return errCrash
+	})
+	require.ErrorIs(t, err, errCrash)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "good", string(content))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestRemoveStaleTemps(t *testing.T) {
+	dir := t.TempDir()
+	keep := filepath.Join(dir, "state.json")
+	stale := filepath.Join(dir, ".state.json.123"+TempSuffix)
+	nestedStale := filepath.Join(dir, "nested", ".blob.456"+TempSuffix)
+	require.NoError(t, os.MkdirAll(filepath.Dir(nestedStale), 0755))
+	for _, path := range []string{keep, stale, nestedStale} {
+		require.NoError(t, os.WriteFile(path, []byte("x"), 0644))
+	}
+
+	removed, err := RemoveStaleTemps(dir)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{stale, nestedStale}, removed)
+	assert.FileExists(t, keep)
+	assert.NoFileExists(t, stale)
+	assert.NoFileExists(t, nestedStale)
+
+	removed, err = RemoveStaleTemps(filepath.Join(dir, "missing"))
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+}
+
+func TestDownloadFileUsingHttp_CrashKeepsPreviousFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("services: {new: {}}"))
+	}))
+	defer server.Close()
+
+	outputPath := filepath.Join(t.TempDir(), "compose.yaml")
+	require.NoError(t, os.WriteFile(outputPath, []byte("services: {old: {}}"), 0644))
+
+	temps := crashBeforeRename(t)
+	_, err := DownloadFileUsingHttp("GET", server.URL, nil, nil, nil, &DownloadOptions{
+		OutputPath:     outputPath,
+		OverwriteExist: true,
+		Timeout:        10 * time.Second,
+	})
+	require.ErrorIs(t, err, errCrash)
+
+	content, err := os.ReadFile(outputPath)
+	require.NoError(t, err)
+	assert.Equal(t, "services: {old: {}}", string(content))
+	require.Len(t, *temps, 1)
+	assert.NoFileExists(t, (*temps)[0])
+}
@@ -34,6 +34,8 @@ type DownloadOptions struct {
 	Headers          map[string]string             // Additional headers
 	ResumeDownload   bool                          // Resume partial downloads
 	ProgressCallback func(downloaded, total int64) // Progress callback
+	// ClientFactory builds the http client, defaults to httputils.DefaultClientFactory. Timeout still applies.
+	ClientFactory *httputils.ClientFactory
 }
 
 // DownloadFileUsingHttp downloads a file using the specified HTTP method with authentication
@@ -49,9 +51,11 @@ func DownloadFileUsingHttp(httpVerb, url string, auth *auth.AuthConfig, queryPar
 	}
 
 	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: options.Timeout,
+	factory := options.ClientFactory
+	if factory == nil {
+		factory = httputils.DefaultClientFactory()
 	}
+	client := factory.ClientWithTimeout(options.Timeout)
 
 	// Create HTTP request using the reusable methods
 	req, err := createHTTPRequest(httpVerb, url, auth, queryParams, body, options)
@@ -252,26 +256,33 @@ func downloadFile(resp *http.Response, outputPath string, options *DownloadOptio
 	}
 
 	// Open output file
-	var file *os.File
-	var err error
+	var (
+		file        io.Writer
+		commit      func() error
+		initialSize int64
+	)
 
 	if options.ResumeDownload && resp.StatusCode == http.StatusPartialContent {
-		// Open file for appending
-		file, err = os.OpenFile(outputPath, os.O_WRONLY|os.O_APPEND, 0644)
-	} else {
-		// Create new file or truncate existing
-		file, err = os.Create(outputPath)
-	}
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to create output file: %w", err)
-	}
-	defer file.Close()
+		// Open file for appending, the partial content is kept on purpose so it can be resumed
+		appendFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer appendFile.Close()
 
-	// Get initial file size for resume
-	var initialSize int64
-	if stat, err := file.Stat(); err == nil {
-		initialSize = stat.Size()
+		// Get initial file size for resume
+		if stat, err := appendFile.Stat(); err == nil {
+			initialSize = stat.Size()
+		}
+		file, commit = appendFile, appendFile.Sync
+	} else {
+		// Replace an existing file only once the download is complete
+		atomicFile, err := CreateAtomic(outputPath, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer atomicFile.Close()
+		file, commit = atomicFile, atomicFile.Commit
 	}
 
 	// Create progress reader if callback is provided
@@ -286,7 +297,10 @@ func downloadFile(resp *http.Response, outputPath string, options *DownloadOptio
 	}
 
 	// Copy data with size limit
-	var written int64
+	var (
+		written int64
+		err     error
+	)
 	if options.MaxFileSize > 0 {
 		limitedReader := io.LimitReader(reader, options.MaxFileSize)
 		written, err = io.Copy(file, limitedReader)
@@ -297,6 +311,9 @@ func downloadFile(resp *http.Response, outputPath string, options *DownloadOptio
 	if err != nil {
 		return nil, fmt.Errorf("failed to write file: %w", err)
 	}
+	if err := commit(); err != nil {
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
 
 	// Parse Last-Modified header
 	var lastModified time.Time
@@ -357,6 +374,6 @@ func setDownloadHeaders(req *http.Request) {
 	// req.Header.Set("Accept", "*/*")
 	// req.Header.Set("Accept-Encoding", "gzip, deflate")
 	req.Header.Set("Accept", "application/json, application/yaml, application/x-yaml, text/yaml, text/plain, */*")
-	req.Header.Set("User-Agent", "margo-device-agent/1.0")
+	req.Header.Set("User-Agent", httputils.DefaultUserAgent)
 	req.Header.Set("Accept-Encoding", "identity") // Request uncompressed content
 }
@@ -10,7 +10,9 @@ import (
 	"testing"
 	"time"
 
+	httputils "github.com/margo/sandbox/shared-lib/http"
 	"github.com/margo/sandbox/shared-lib/http/auth"
+	"github.com/margo/sandbox/shared-lib/http/clienttest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -332,3 +334,35 @@ func TestDownloadFileUsingHttp_FileExistsNoOverwrite(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "Existing content", string(content))
 }
+
+func TestDownloadFileUsingHttp_ClientFactory(t *testing.T) {
+	server := clienttest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("trusted"))
+	}))
+
+	config := httputils.DefaultClientConfig()
+	config.CACertPath = server.WriteCA(t)
+	config.UserAgent = "download-test/1.0"
+	factory, err := httputils.NewClientFactory(config)
+	require.NoError(t, err)
+
+	options := &DownloadOptions{
+		OutputPath:     filepath.Join(t.TempDir(), "trusted.txt"),
+		CreateDirs:     true,
+		OverwriteExist: true,
+		Timeout:        10 * time.Second,
+		ClientFactory:  factory,
+	}
+
+	result, err := DownloadFileUsingHttp("GET", server.URL+"/file", nil, nil, nil, options)
+	require.NoError(t, err)
+	content, err := os.ReadFile(result.FilePath)
+	require.NoError(t, err)
+	assert.Equal(t, "trusted", string(content))
+	assert.Equal(t, []string{"download-test/1.0"}, server.UserAgents())
+
+	// the default factory does not trust the test CA
+	options.ClientFactory = nil
+	_, err = DownloadFileUsingHttp("GET", server.URL+"/file", nil, nil, nil, options)
+	assert.Error(t, err)
+}
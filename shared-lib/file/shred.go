@@ -0,0 +1,56 @@
+package file
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// beforeShredRemove is called between overwriting a file and removing it, tests use it to check
+// what is left when the removal fails
+var beforeShredRemove = func(path string) error { return nil }
+
+// Shred erases a file holding secrets: its content is overwritten with zeros and flushed to disk,
+// then the file is truncated and removed. When the removal fails the file is left empty. On
+// journaling and copy-on-write filesystems the old blocks may survive, Shred is the best effort
+// available without control over the storage.
+func Shred(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if _, err := io.CopyN(f, zeroReader{}, info.Size()); err != nil {
+		return fmt.Errorf("failed to overwrite %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to flush %s: %w", path, err)
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to flush %s: %w", path, err)
+	}
+
+	if err := beforeShredRemove(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
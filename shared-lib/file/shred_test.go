@@ -0,0 +1,38 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShred(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provisioning.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("bootstrapToken: s3cr3t\n"), 0600))
+
+	require.NoError(t, Shred(path))
+	assert.NoFileExists(t, path)
+}
+
+func TestShred_RemovalFailsLeavesEmptyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "provisioning.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("bootstrapToken: s3cr3t\n"), 0600))
+
+	previous := beforeShredRemove
+	beforeShredRemove = func(string) error { return errors.New("read-only file system") }
+	t.Cleanup(func() { beforeShredRemove = previous })
+
+	assert.Error(t, Shred(path))
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, content, "the secret is gone although the file is not")
+}
+
+func TestShred_MissingFile(t *testing.T) {
+	err := Shred(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
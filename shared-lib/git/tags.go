@@ -0,0 +1,53 @@
+package git
+
+import (
+	"fmt"
+
+	goGit "github.com/go-git/go-git/v5"
+	goGitConfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// ListRemoteTags returns the names of the tags of a remote repository without cloning it, e.g.
+// "v1.2.0" for refs/tags/v1.2.0.
+//
+// Parameters:
+//   - url: The Git repository URL, HTTP(S) or a local path
+//   - auth: Optional authentication credentials for private repositories
+//
+// Returns:
+//   - []string: The tag names in the order the remote advertises them
+//   - error: An error if the remote cannot be listed
+func ListRemoteTags(url string, auth *Auth) ([]string, error) {
+	if url == "" {
+		return nil, fmt.Errorf("git URL cannot be empty")
+	}
+
+	listOptions := &goGit.ListOptions{}
+	if auth != nil {
+		listOptions.CABundle = auth.CABundle
+		if auth.ClientCert != nil && auth.ClientKey != nil {
+			listOptions.ClientCert = auth.ClientCert
+			listOptions.ClientKey = auth.ClientKey
+		}
+		authMethod, err := getAuthMethod(url, auth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup authentication: %w", err)
+		}
+		listOptions.Auth = authMethod
+	}
+
+	remote := goGit.NewRemote(memory.NewStorage(), &goGitConfig.RemoteConfig{Name: "origin", URLs: []string{url}})
+	refs, err := remote.List(listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the tags of %s: %w", url, err)
+	}
+
+	var tags []string
+	for _, ref := range refs {
+		if ref.Name().IsTag() {
+			tags = append(tags, ref.Name().Short())
+		}
+	}
+	return tags, nil
+}
@@ -87,6 +87,9 @@ func WithSignRequest(ctx context.Context, signer func(ctx context.Context, req *
 
 func WithOAuth(ctx context.Context, clientId, clientSecret, tokenUrl string) AuthOption {
 	return func(ctx context.Context, req *http.Request) error {
+		if clientSecret == "" {
+			return fmt.Errorf("client secret required for oauth authentication")
+		}
 		tokenResp, err := GetOAuthToken(ctx, clientId, clientSecret, tokenUrl)
 		if err != nil {
 			return err
@@ -0,0 +1,226 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// DefaultUserAgent is sent by every outbound client unless configured otherwise
+const DefaultUserAgent = "margo-device-agent/1.0"
+
+// ClientConfig is the single description of how outbound http clients behave: timeouts, proxy,
+// TLS trust, client certificates, user agent and transport tuning. All clients (NBI, SBI, file
+// downloads, OCI) are built from it through a ClientFactory so that these policies cannot drift.
+type ClientConfig struct {
+	// Timeout bounds a whole request including reading the body, 0 leaves it to the caller's context
+	Timeout time.Duration
+	// DialTimeout bounds establishing the tcp connection
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout bounds the tls handshake
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds waiting for the response headers once the request was written
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout closes keep-alive connections that were idle for this long
+	IdleConnTimeout     time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+
+	// ProxyURL sends all requests through this proxy, when empty the HTTP(S)_PROXY environment is used
+	ProxyURL string
+
+	// CACertPath and CACertPEM add trusted CAs on top of the system pool
+	CACertPath string
+	CACertPEM  []byte
+	// ClientCertPath/ClientKeyPath or ClientCertPEM/ClientKeyPEM enable mutual TLS
+	ClientCertPath string
+	ClientKeyPath  string
+	ClientCertPEM  []byte
+	ClientKeyPEM   []byte
+	// InsecureSkipVerify disables server certificate verification, development only
+	InsecureSkipVerify bool
+
+	// UserAgent is sent with every request unless the request explicitly asks for another one,
+	// empty keeps whatever the request has
+	UserAgent string
+
+	// RoundTripperHooks wrap the transport in the given order, e.g. for logging or metrics
+	RoundTripperHooks []func(http.RoundTripper) http.RoundTripper
+}
+
+// DefaultClientConfig returns the defaults every outbound client starts from
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		Timeout:               30 * time.Second,
+		DialTimeout:           10 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		UserAgent:             DefaultUserAgent,
+		ResponseHeaderTimeout: 0,
+	}
+}
+
+// ClientFactory builds http clients and transports from one ClientConfig
+type ClientFactory struct {
+	config    ClientConfig
+	tlsConfig *tls.Config
+	proxy     func(*http.Request) (*url.URL, error)
+}
+
+// NewClientFactory validates the configuration and loads the TLS material once, so that
+// misconfigured certificates are reported when the client is set up rather than on the first request
+func NewClientFactory(config ClientConfig) (*ClientFactory, error) {
+	tlsConfig, err := buildTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %q: %w", config.ProxyURL, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &ClientFactory{
+		config:    config,
+		tlsConfig: tlsConfig,
+		proxy:     proxy,
+	}, nil
+}
+
+// DefaultClientFactory returns a factory for DefaultClientConfig
+func DefaultClientFactory() *ClientFactory {
+	// the default config carries no TLS material, so building it cannot fail
+	factory, _ := NewClientFactory(DefaultClientConfig())
+	return factory
+}
+
+// Config returns a copy of the configuration the factory was built from
+func (f *ClientFactory) Config() ClientConfig {
+	return f.config
+}
+
+// TLSConfig returns a copy of the TLS configuration used by the factory's transports
+func (f *ClientFactory) TLSConfig() *tls.Config {
+	return f.tlsConfig.Clone()
+}
+
+// Transport returns a new transport with the configured TLS, proxy and tuning. It does not
+// apply the user agent or the hooks, use RoundTripper for that.
+func (f *ClientFactory) Transport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   f.config.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		Proxy:                 f.proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       f.tlsConfig.Clone(),
+		TLSHandshakeTimeout:   f.config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: f.config.ResponseHeaderTimeout,
+		IdleConnTimeout:       f.config.IdleConnTimeout,
+		MaxIdleConns:          f.config.MaxIdleConns,
+		MaxIdleConnsPerHost:   f.config.MaxIdleConnsPerHost,
+		ForceAttemptHTTP2:     true,
+	}
+}
+
+// RoundTripper returns the transport wrapped with the user agent and the configured hooks
+func (f *ClientFactory) RoundTripper() http.RoundTripper {
+	var rt http.RoundTripper = f.Transport()
+	if f.config.UserAgent != "" {
+		rt = &userAgentRoundTripper{next: rt, userAgent: f.config.UserAgent}
+	}
+	for _, hook := range f.config.RoundTripperHooks {
+		rt = hook(rt)
+	}
+	return rt
+}
+
+// Client returns a new client using the configured timeout
+func (f *ClientFactory) Client() *http.Client {
+	return f.ClientWithTimeout(f.config.Timeout)
+}
+
+// ClientWithTimeout returns a new client that overrides the configured timeout
+func (f *ClientFactory) ClientWithTimeout(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: f.RoundTripper(),
+		Timeout:   timeout,
+	}
+}
+
+func buildTLSConfig(config ClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	caPEM := config.CACertPEM
+	if config.CACertPath != "" {
+		data, err := os.ReadFile(config.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate %s: %w", config.CACertPath, err)
+		}
+		caPEM = append(append([]byte{}, caPEM...), data...)
+	}
+	if len(caPEM) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no valid CA certificates found in the configured CA")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	certPEM, keyPEM := config.ClientCertPEM, config.ClientKeyPEM
+	if config.ClientCertPath != "" || config.ClientKeyPath != "" {
+		var err error
+		if certPEM, err = os.ReadFile(config.ClientCertPath); err != nil {
+			return nil, fmt.Errorf("failed to read client certificate %s: %w", config.ClientCertPath, err)
+		}
+		if keyPEM, err = os.ReadFile(config.ClientKeyPath); err != nil {
+			return nil, fmt.Errorf("failed to read client key %s: %w", config.ClientKeyPath, err)
+		}
+	}
+	if len(certPEM) > 0 || len(keyPEM) > 0 {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// userAgentRoundTripper stamps the configured user agent on every request that does not carry a
+// caller-chosen one. The library default set by the request builders does not count as caller-chosen.
+type userAgentRoundTripper struct {
+	next      http.RoundTripper
+	userAgent string
+}
+
+func (rt *userAgentRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	current := req.Header.Get("User-Agent")
+	if current == rt.userAgent || (current != "" && current != DefaultUserAgent) {
+		return rt.next.RoundTrip(req)
+	}
+	// a RoundTripper must not modify the caller's request
+	clone := req.Clone(req.Context())
+	clone.Header.Set("User-Agent", rt.userAgent)
+	return rt.next.RoundTrip(clone)
+}
@@ -0,0 +1,110 @@
+package http
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/margo/sandbox/shared-lib/http/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientFactory_UserAgentAndCA(t *testing.T) {
+	server := clienttest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// without the server's CA the request must fail verification
+	_, err := DefaultClientFactory().Client().Get(server.URL)
+	require.Error(t, err)
+
+	config := DefaultClientConfig()
+	config.CACertPath = server.WriteCA(t)
+	config.UserAgent = "factory-test/1.0"
+	factory, err := NewClientFactory(config)
+	require.NoError(t, err)
+
+	resp, err := factory.Client().Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// a request built with the library defaults gets the configured user agent
+	req, err := NewGetRequest(server.URL, nil, nil)
+	require.NoError(t, err)
+	resp, err = factory.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// an explicitly chosen user agent wins over the configured one
+	req, err = http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("User-Agent", "explicit/2.0")
+	resp, err = factory.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"factory-test/1.0", "factory-test/1.0", "explicit/2.0"}, server.UserAgents())
+}
+
+func TestClientFactory_Hooks(t *testing.T) {
+	server := clienttest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	var calls []string
+	hook := func(name string) func(http.RoundTripper) http.RoundTripper {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				calls = append(calls, name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+
+	config := DefaultClientConfig()
+	config.CACertPEM = server.CAPEM
+	config.RoundTripperHooks = append(config.RoundTripperHooks, hook("inner"), hook("outer"))
+	factory, err := NewClientFactory(config)
+	require.NoError(t, err)
+
+	resp, err := factory.Client().Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"outer", "inner"}, calls)
+}
+
+func TestNewClientFactory_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ClientConfig
+	}{
+		{name: "missing CA file", config: ClientConfig{CACertPath: "/does/not/exist.pem"}},
+		{name: "invalid CA", config: ClientConfig{CACertPEM: []byte("not a certificate")}},
+		{name: "client cert without key", config: ClientConfig{ClientCertPEM: []byte("not a certificate")}},
+		{name: "invalid proxy", config: ClientConfig{ProxyURL: "://proxy"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewClientFactory(tt.config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestClientFactory_Timeouts(t *testing.T) {
+	config := DefaultClientConfig()
+	config.ResponseHeaderTimeout = 5 * time.Second
+	factory, err := NewClientFactory(config)
+	require.NoError(t, err)
+
+	assert.Equal(t, config.Timeout, factory.Client().Timeout)
+	assert.Equal(t, time.Minute, factory.ClientWithTimeout(time.Minute).Timeout)
+	assert.Equal(t, 5*time.Second, factory.Transport().ResponseHeaderTimeout)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
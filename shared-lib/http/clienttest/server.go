@@ -0,0 +1,163 @@
+// Package clienttest provides a TLS test server shared by the tests of every outbound client, so
+// that each of them can assert the user agent and CA trust configured through the client factory.
+package clienttest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server is a TLS server with its own CA that records the user agent of every request it receives
+type Server struct {
+	*httptest.Server
+	// CAPEM is the PEM encoded certificate clients must trust to talk to the server
+	CAPEM []byte
+
+	mu          sync.Mutex
+	userAgents  []string
+	clientNames []string
+
+	// clientCA signs the client certificates of a mutual TLS server
+	clientCA    *x509.Certificate
+	clientCAKey *ecdsa.PrivateKey
+}
+
+// NewTLSServer starts a TLS server serving handler, it is closed when the test ends
+func NewTLSServer(t *testing.T, handler http.Handler) *Server {
+	t.Helper()
+
+	s := &Server{}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.userAgents = append(s.userAgents, r.UserAgent())
+		s.mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+
+	s.CAPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	return s
+}
+
+// NewMutualTLSServer starts a TLS server serving handler that only accepts clients presenting a
+// certificate issued by WriteClientCertificate, it is closed when the test ends
+func NewMutualTLSServer(t *testing.T, handler http.Handler) *Server {
+	t.Helper()
+
+	s := &Server{}
+	s.clientCA, s.clientCAKey = newCertificate(t, "client-ca", nil, nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(s.clientCA)
+
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.userAgents = append(s.userAgents, r.UserAgent())
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			s.clientNames = append(s.clientNames, r.TLS.PeerCertificates[0].Subject.CommonName)
+		}
+		s.mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	s.StartTLS()
+	t.Cleanup(s.Close)
+
+	s.CAPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	return s
+}
+
+// WriteClientCertificate issues a client certificate for commonName that a mutual TLS server
+// accepts, and writes it and its key as PEM files to a temporary directory
+func (s *Server) WriteClientCertificate(t *testing.T, commonName string) (certPath, keyPath string) {
+	t.Helper()
+	if s.clientCA == nil {
+		t.Fatalf("the server does not require client certificates")
+	}
+
+	cert, key := newCertificate(t, commonName, s.clientCA, s.clientCAKey)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode client key: %v", err)
+	}
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+		t.Fatalf("failed to write client certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write client key: %v", err)
+	}
+	return certPath, keyPath
+}
+
+// newCertificate creates a CA certificate when issuer is nil and a client certificate issued by it
+// otherwise
+func newCertificate(t *testing.T, commonName string, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		issuer, issuerKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+// WriteCA writes the server's CA to a file in a temporary directory and returns its path
+func (s *Server) WriteCA(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, s.CAPEM, 0o600); err != nil {
+		t.Fatalf("failed to write CA: %v", err)
+	}
+	return path
+}
+
+// ClientNames returns the common names of the client certificates of all requests received so far
+func (s *Server) ClientNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.clientNames...)
+}
+
+// UserAgents returns the user agents of all requests received so far
+func (s *Server) UserAgents() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.userAgents...)
+}
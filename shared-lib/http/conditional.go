@@ -0,0 +1,114 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNotModified is returned when the server answers a conditional request with 304 Not Modified
+// and the response it refers to is not cached (anymore)
+var ErrNotModified = errors.New("not modified")
+
+// ConditionalCache makes repeated GET requests conditional: it remembers the ETag and the response
+// of every query by key, sends the ETag with If-None-Match and answers a 304 Not Modified with the
+// remembered response. Responses are kept for the TTL. It is safe for concurrent use.
+type ConditionalCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]conditionalEntry
+}
+
+type conditionalEntry struct {
+	etag     string
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+}
+
+// NewConditionalCache returns a cache keeping responses for ttl
+func NewConditionalCache(ttl time.Duration) *ConditionalCache {
+	return &ConditionalCache{ttl: ttl, now: time.Now, entries: map[string]conditionalEntry{}}
+}
+
+// IfNoneMatch is a request editor setting If-None-Match to the ETag of the response cached for key,
+// the request is left unconditional when nothing is cached
+func (c *ConditionalCache) IfNoneMatch(key string) func(ctx context.Context, req *http.Request) error {
+	return func(ctx context.Context, req *http.Request) error {
+		if entry, ok := c.lookup(key); ok {
+			req.Header.Set("If-None-Match", entry.etag)
+		}
+		return nil
+	}
+}
+
+// Resolve caches a 200 response carrying an ETag and replaces a 304 Not Modified with the cached
+// response, both are returned with their body still readable. A 304 whose response is not cached
+// is returned with ErrNotModified, every other response is returned as it is.
+func (c *ConditionalCache) Resolve(key string, resp *http.Response) (*http.Response, error) {
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		entry, ok := c.lookup(key)
+		if !ok {
+			return resp, ErrNotModified
+		}
+		resp.Body.Close()
+		cached := *resp
+		cached.StatusCode = http.StatusOK
+		cached.Status = "200 OK"
+		cached.Header = entry.header.Clone()
+		cached.Body = io.NopCloser(bytes.NewReader(entry.body))
+		cached.ContentLength = int64(len(entry.body))
+		return &cached, nil
+
+	case http.StatusOK:
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			c.Forget(key)
+			return resp, nil
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+
+		c.mu.Lock()
+		c.entries[key] = conditionalEntry{etag: etag, header: resp.Header.Clone(), body: body, storedAt: c.now()}
+		c.mu.Unlock()
+		return resp, nil
+
+	default:
+		return resp, nil
+	}
+}
+
+// Forget drops the response cached for key
+func (c *ConditionalCache) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// lookup returns the response cached for key, expired ones are dropped
+func (c *ConditionalCache) lookup(key string) (conditionalEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return conditionalEntry{}, false
+	}
+	if c.now().Sub(entry.storedAt) >= c.ttl {
+		delete(c.entries, key)
+		return conditionalEntry{}, false
+	}
+	return entry, true
+}
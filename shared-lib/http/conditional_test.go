@@ -0,0 +1,71 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func conditionalGet(t *testing.T, cache *ConditionalCache, url string) (*http.Response, string, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	require.NoError(t, cache.IfNoneMatch("packages")(req.Context(), req))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp, err = cache.Resolve("packages", resp)
+	if err != nil {
+		resp.Body.Close()
+		return resp, "", err
+	}
+	defer resp.Body.Close()
+	body, readErr := io.ReadAll(resp.Body)
+	require.NoError(t, readErr)
+	return resp, string(body), nil
+}
+
+func TestConditionalCache(t *testing.T) {
+	var ifNoneMatch []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"items":[]}`))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	cache := NewConditionalCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	resp, body, err := conditionalGet(t, cache, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, `{"items":[]}`, body)
+
+	resp, body, err = conditionalGet(t, cache, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "the 304 is answered with the cached response")
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"items":[]}`, body)
+	assert.Equal(t, []string{"", `"v1"`}, ifNoneMatch)
+
+	now = now.Add(time.Minute)
+	_, _, err = conditionalGet(t, cache, server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "", ifNoneMatch[2], "an expired response is requested again")
+
+	cache.Forget("packages")
+	resp, err = cache.Resolve("packages", &http.Response{StatusCode: http.StatusNotModified, Body: io.NopCloser(strings.NewReader(""))})
+	assert.ErrorIs(t, err, ErrNotModified)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
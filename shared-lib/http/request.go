@@ -343,7 +343,7 @@ func applyAuthentication(req *http.Request, authReq *auth.AuthConfig) error {
 
 // Helper function to set default headers
 func setDefaultHeaders(req *http.Request) {
-	req.Header.Set("User-Agent", "margo-device-agent/1.0")
+	req.Header.Set("User-Agent", DefaultUserAgent)
 	req.Header.Set("Accept", "application/json, text/plain, */*")
 
 	// Set Accept-Encoding for compression support
@@ -2,15 +2,14 @@ package oci
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
-	"net/http"
 	"strings"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	httputils "github.com/margo/sandbox/shared-lib/http"
 )
 
 // Config holds OCI registry configuration and authentication details
@@ -18,7 +17,7 @@ type Config struct {
 	Registry   string        // Registry URL (e.g., "gcr.io", "docker.io", "localhost:5000")
 	Username   string        // Registry username
 	Password   string        // Registry password/token
-	Insecure   bool          // Allow insecure connections (HTTP instead of HTTPS)
+	Insecure   bool          // Allow insecure connections (HTTP, or HTTPS without verification)
 	Timeout    time.Duration // Request timeout (default: 30 seconds)
 	UserAgent  string        // Custom user agent string
 	CABundle   []byte        // CA bundle (PEM encoded) for custom certificates
@@ -100,32 +99,43 @@ func (c *Client) setupRemoteOptions() error {
 		remote.WithAuth(c.auth),
 		remote.WithUserAgent(c.config.UserAgent),
 	}
-	// Setup custom transport if needed
-	transport := &http.Transport{
-		ResponseHeaderTimeout: c.config.Timeout,
-	}
-	// Configure TLS settings
-	if c.config.Insecure {
-		transport.TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: true,
-		}
+	// The transport comes from the shared factory so that TLS trust, client certificates, proxy and
+	// timeouts follow the same rules as every other outbound client. The user agent is left to
+	// remote.WithUserAgent, which adds the go-containerregistry version to it.
+	clientConfig := httputils.DefaultClientConfig()
+	clientConfig.ResponseHeaderTimeout = c.config.Timeout
+	clientConfig.InsecureSkipVerify = c.config.Insecure
+	clientConfig.CACertPEM = c.config.CABundle
+	if len(c.config.ClientCert) > 0 && len(c.config.ClientKey) > 0 {
+		clientConfig.ClientCertPEM = c.config.ClientCert
+		clientConfig.ClientKeyPEM = c.config.ClientKey
 	}
+	clientConfig.UserAgent = ""
 
-	// Add custom CA bundle if provided
-	if len(c.config.CABundle) > 0 {
-		// TODO: Implement custom CA bundle loading
-		// This would require creating a custom cert pool
-	}
-	// Add client certificate if provided
-	if len(c.config.ClientCert) > 0 && len(c.config.ClientKey) > 0 {
-		// TODO: Implement client certificate loading
-		// This would require parsing the cert and key
+	factory, err := httputils.NewClientFactory(clientConfig)
+	if err != nil {
+		return fmt.Errorf("failed to configure registry transport: %w", err)
 	}
+	transport := factory.RoundTripper()
 	c.remoteOpts = append(c.remoteOpts, remote.WithTransport(transport))
 
 	return nil
 }
 
+// nameOptions are the options to parse the references of the registry with, an insecure registry
+// may be talked to over plain HTTP
+func (c *Client) nameOptions() []name.Option {
+	if c.config.Insecure {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+// parseReference parses a reference to an image of the registry
+func (c *Client) parseReference(reference string) (name.Reference, error) {
+	return name.ParseReference(reference, c.nameOptions()...)
+}
+
 // Ping checks if the registry is accessible and returns basic information
 //
 // Parameters:
@@ -150,7 +160,7 @@ func (c *Client) Ping(ctx context.Context) (bool, error) {
 	if !strings.Contains(registryHost, "/") {
 		registryHost = registryHost + "/library/hello-world"
 	}
-	ref, err := name.ParseReference(registryHost + ":latest")
+	ref, err := c.parseReference(registryHost + ":latest")
 	if err != nil {
 		return false, fmt.Errorf("failed to parse reference for ping: %w", err)
 	}
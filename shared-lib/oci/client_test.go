@@ -0,0 +1,66 @@
+package oci
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/margo/sandbox/shared-lib/http/clienttest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRegistry serves just enough of the distribution api for Ping: the /v2/ base and a
+// manifest that does not exist
+func newTestRegistry(t *testing.T) (*clienttest.Server, string) {
+	server := clienttest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	return server, serverURL.Host
+}
+
+func TestClient_PingUsesConfiguredCAAndUserAgent(t *testing.T) {
+	server, registry := newTestRegistry(t)
+
+	client, err := NewClient(&Config{
+		Registry:  registry,
+		UserAgent: "oci-test/1.0",
+		CABundle:  server.CAPEM,
+	})
+	require.NoError(t, err)
+
+	accessible, err := client.Ping(context.Background())
+	require.NoError(t, err)
+	assert.True(t, accessible)
+
+	userAgents := server.UserAgents()
+	require.NotEmpty(t, userAgents)
+	for _, userAgent := range userAgents {
+		assert.True(t, strings.HasPrefix(userAgent, "oci-test/1.0"), "unexpected user agent %q", userAgent)
+	}
+}
+
+func TestClient_PingRejectsUntrustedRegistry(t *testing.T) {
+	_, registry := newTestRegistry(t)
+
+	client, err := NewClient(&Config{Registry: registry})
+	require.NoError(t, err)
+
+	accessible, err := client.Ping(context.Background())
+	assert.Error(t, err)
+	assert.False(t, accessible)
+}
+
+func TestNewClient_InvalidCABundle(t *testing.T) {
+	_, err := NewClient(&Config{Registry: "localhost:5000", CABundle: []byte("not a certificate")})
+	assert.Error(t, err)
+}
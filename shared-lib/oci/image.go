@@ -67,7 +67,7 @@ func (c *Client) PushImage(ctx context.Context, image v1.Image, reference string
 	}
 
 	// Parse the reference
-	ref, err := name.ParseReference(reference)
+	ref, err := c.parseReference(reference)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse reference %s: %w", reference, err)
 	}
@@ -124,7 +124,7 @@ func (c *Client) PullImage(ctx context.Context, reference string) (v1.Image, *Pu
 	}
 
 	// Parse the reference
-	ref, err := name.ParseReference(reference)
+	ref, err := c.parseReference(reference)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to parse reference %s: %w", reference, err)
 	}
@@ -183,7 +183,7 @@ func (c *Client) GetImageInfo(ctx context.Context, reference string) (*ImageInfo
 	}
 
 	// Parse the reference
-	ref, err := name.ParseReference(reference)
+	ref, err := c.parseReference(reference)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse reference %s: %w", reference, err)
 	}
@@ -259,7 +259,7 @@ func (c *Client) ListTags(ctx context.Context, repository string) ([]string, err
 		return nil, fmt.Errorf("repository cannot be empty")
 	}
 	// Parse repository reference
-	repo, err := name.NewRepository(fmt.Sprintf("%s/%s", c.config.Registry, repository))
+	repo, err := name.NewRepository(fmt.Sprintf("%s/%s", c.config.Registry, repository), c.nameOptions()...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse repository %s: %w", repository, err)
 	}
@@ -294,7 +294,7 @@ func (c *Client) DeleteImage(ctx context.Context, reference string) error {
 		return fmt.Errorf("reference cannot be empty")
 	}
 	// Parse the reference
-	ref, err := name.ParseReference(reference)
+	ref, err := c.parseReference(reference)
 	if err != nil {
 		return fmt.Errorf("failed to parse reference %s: %w", reference, err)
 	}
@@ -331,7 +331,7 @@ func (c *Client) ImageExists(ctx context.Context, reference string) (bool, error
 		return false, fmt.Errorf("reference cannot be empty")
 	}
 	// Parse the reference
-	ref, err := name.ParseReference(reference)
+	ref, err := c.parseReference(reference)
 	if err != nil {
 		return false, fmt.Errorf("failed to parse reference %s: %w", reference, err)
 	}
@@ -414,7 +414,7 @@ func (c *Client) GetManifest(ctx context.Context, reference string) ([]byte, str
 		return nil, "", fmt.Errorf("reference cannot be empty")
 	}
 	// Parse the reference
-	ref, err := name.ParseReference(reference)
+	ref, err := c.parseReference(reference)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to parse reference %s: %w", reference, err)
 	}
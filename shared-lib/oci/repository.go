@@ -42,7 +42,7 @@ type RepositoryInfo struct {
 //	}
 func (c *Client) ListRepositories(ctx context.Context) ([]string, error) {
 	// Create a registry reference
-	registry, err := name.NewRegistry(c.config.Registry)
+	registry, err := name.NewRegistry(c.config.Registry, c.nameOptions()...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse registry %s: %w", c.config.Registry, err)
 	}
@@ -0,0 +1,339 @@
+// Package redact removes credentials from headers and bodies before they are logged, recorded or
+// exported. Every place that shows request or response content outside the process goes through
+// a Redactor so that there is a single implementation to audit.
+package redact
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces redacted header and field values
+const Mask = "[REDACTED]"
+
+// UnparseableJSON replaces a JSON body that cannot be parsed, its raw bytes are never shown
+const UnparseableJSON = "[UNPARSEABLE JSON BODY REDACTED]"
+
+// MaxParseBytes bounds the body size that is parsed for structural redaction, larger bodies are
+// only checked with the sensitive-content heuristic
+const MaxParseBytes = 1 << 20
+
+// DefaultHeaders are always redacted
+var DefaultHeaders = []string{
+	"authorization",
+	"proxy-authorization",
+	"cookie",
+	"set-cookie",
+	"x-auth-token",
+	"x-api-key",
+	"x-margo-bootstrap-token",
+}
+
+// DefaultBodyKeys are always masked in JSON and form bodies. Keys are compared ignoring case,
+// "_" and "-", so clientSecret also covers client_secret.
+var DefaultBodyKeys = []string{
+	"clientSecret",
+	"password",
+	"token",
+	"accessToken",
+	"refreshToken",
+	"idToken",
+	"authorization",
+	"apiKey",
+	"privateKey",
+	"secret",
+	"certificate",
+	"csr",
+}
+
+// DefaultBodyKeyPatterns are always masked too, they are glob patterns (path.Match syntax) matched
+// against the keys compared like DefaultBodyKeys, so *secret covers client_secret and tenantSecret
+var DefaultBodyKeyPatterns = []string{
+	"*password",
+	"*secret",
+	"*token",
+	"*privatekey",
+	"*certificate",
+}
+
+// sensitiveMarkers make an unparseable body count as sensitive on top of the configured body keys
+var sensitiveMarkers = []string{"bearer ", "-----begin"}
+
+// Config adds to the default redaction rules
+type Config struct {
+	// Headers are additional header names to redact, matched ignoring case
+	Headers []string
+	// HeaderPatterns are glob patterns (path.Match syntax) for header names to redact, e.g. "x-*-token"
+	HeaderPatterns []string
+	// BodyKeys are additional keys whose values are masked at any nesting depth
+	BodyKeys []string
+	// BodyKeyPatterns are glob patterns (path.Match syntax) for additional keys, e.g. "*pin"
+	BodyKeyPatterns []string
+}
+
+// Redactor applies the redaction rules, it is safe for concurrent use
+type Redactor struct {
+	headers        map[string]bool
+	headerPatterns []string
+	bodyKeys       map[string]bool
+	bodyPatterns   []string
+}
+
+// New creates a redactor with the default rules extended by cfg
+func New(cfg Config) (*Redactor, error) {
+	r := &Redactor{
+		headers:  map[string]bool{},
+		bodyKeys: map[string]bool{},
+	}
+	for _, name := range append(append([]string{}, DefaultHeaders...), cfg.Headers...) {
+		r.headers[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	for _, pattern := range cfg.HeaderPatterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid header pattern %q: %w", pattern, err)
+		}
+		r.headerPatterns = append(r.headerPatterns, pattern)
+	}
+	for _, key := range append(append([]string{}, DefaultBodyKeys...), cfg.BodyKeys...) {
+		if normalized := normalizeKey(key); normalized != "" {
+			r.bodyKeys[normalized] = true
+		}
+	}
+	for _, pattern := range append(append([]string{}, DefaultBodyKeyPatterns...), cfg.BodyKeyPatterns...) {
+		pattern = normalizeKey(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid body key pattern %q: %w", pattern, err)
+		}
+		r.bodyPatterns = append(r.bodyPatterns, pattern)
+	}
+	return r, nil
+}
+
+var (
+	defaultRedactor     *Redactor
+	defaultRedactorOnce sync.Once
+)
+
+// Default returns a redactor with the default rules only
+func Default() *Redactor {
+	defaultRedactorOnce.Do(func() {
+		defaultRedactor, _ = New(Config{})
+	})
+	return defaultRedactor
+}
+
+func normalizeKey(key string) string {
+	key = strings.ToLower(strings.TrimSpace(key))
+	return strings.NewReplacer("_", "", "-", "").Replace(key)
+}
+
+// IsSensitiveHeader reports whether the header value must not be shown
+func (r *Redactor) IsSensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	if r.headers[name] {
+		return true
+	}
+	for _, pattern := range r.headerPatterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers returns a copy of the headers with the sensitive values masked
+func (r *Redactor) Headers(header http.Header) map[string][]string {
+	redacted := make(map[string][]string, len(header))
+	for name, values := range header {
+		if r.IsSensitiveHeader(name) {
+			redacted[name] = []string{Mask}
+			continue
+		}
+		redacted[name] = append([]string(nil), values...)
+	}
+	return redacted
+}
+
+// IsSensitiveKey reports whether the value stored under a JSON or form key must not be shown
+func (r *Redactor) IsSensitiveKey(key string) bool {
+	key = normalizeKey(key)
+	if r.bodyKeys[key] {
+		return true
+	}
+	for _, pattern := range r.bodyPatterns {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Body returns a redacted copy of the body. JSON and form encoded bodies keep their structure with
+// the values of sensitive keys masked at any depth. A body of a JSON content type that cannot be
+// parsed, or is too large to, is replaced by UnparseableJSON. Any other body that cannot be parsed
+// is suppressed as a whole when it looks like it contains credentials. The given slice is never
+// modified.
+func (r *Redactor) Body(body []byte, contentType string) []byte {
+	if len(body) == 0 {
+		return body
+	}
+
+	if isJSON(contentType) {
+		if len(body) <= MaxParseBytes {
+			if redacted, ok := r.redactJSON(body); ok {
+				return redacted
+			}
+		}
+		return []byte(UnparseableJSON)
+	}
+
+	if len(body) <= MaxParseBytes {
+		if redacted, ok := r.redactJSON(body); ok {
+			return redacted
+		}
+		if isForm(contentType) {
+			if redacted, ok := r.redactForm(body); ok {
+				return redacted
+			}
+		}
+	}
+
+	if r.looksSensitive(body) {
+		return []byte(fmt.Sprintf("[REDACTED: %d bytes suppressed]", len(body)))
+	}
+	return body
+}
+
+// Preview returns the redacted body for logging, cut to maxBytes. Text is shown as is, binary
+// content base64 encoded.
+func (r *Redactor) Preview(body []byte, contentType string, maxBytes int) (preview string, truncated bool) {
+	if body == nil {
+		return "<no body>", false
+	}
+
+	redacted := r.Body(body, contentType)
+	if len(redacted) > maxBytes {
+		truncated = true
+		redacted = redacted[:maxBytes]
+	}
+	if isTextLike(contentType) || strings.HasPrefix(http.DetectContentType(redacted), "text/") {
+		return string(redacted), truncated
+	}
+	return base64.StdEncoding.EncodeToString(redacted), truncated
+}
+
+func (r *Redactor) redactJSON(body []byte) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, false
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	// keep numbers exactly as they were sent
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil || decoder.More() {
+		return nil, false
+	}
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(r.redactValue(document)); err != nil {
+		return nil, false
+	}
+	return bytes.TrimRight(out.Bytes(), "\n"), true
+}
+
+func (r *Redactor) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if r.IsSensitiveKey(key) {
+				redacted[key] = Mask
+				continue
+			}
+			redacted[key] = r.redactValue(item)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = r.redactValue(item)
+		}
+		return redacted
+	default:
+		return value
+	}
+}
+
+func (r *Redactor) redactForm(body []byte) ([]byte, bool) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, false
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var out strings.Builder
+	for _, key := range keys {
+		for _, value := range values[key] {
+			if out.Len() > 0 {
+				out.WriteByte('&')
+			}
+			out.WriteString(url.QueryEscape(key))
+			out.WriteByte('=')
+			if r.IsSensitiveKey(key) {
+				// left unescaped so the mask stays readable
+				out.WriteString(Mask)
+			} else {
+				out.WriteString(url.QueryEscape(value))
+			}
+		}
+	}
+	return []byte(out.String()), true
+}
+
+// looksSensitive is the heuristic for bodies that cannot be parsed
+func (r *Redactor) looksSensitive(body []byte) bool {
+	lower := strings.ToLower(string(body))
+	normalized := normalizeKey(lower)
+	for key := range r.bodyKeys {
+		if strings.Contains(normalized, key) {
+			return true
+		}
+	}
+	for _, marker := range sensitiveMarkers {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func isJSON(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "json")
+}
+
+func isForm(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "application/x-www-form-urlencoded")
+}
+
+func isTextLike(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	return strings.Contains(contentType, "json") || strings.Contains(contentType, "xml") ||
+		strings.HasPrefix(contentType, "text/") || isForm(contentType)
+}
@@ -18,12 +18,14 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/margo/sandbox/shared-lib/file"
+	"go.uber.org/zap"
 )
 
 type DockerComposeClient struct {
 	dockerClient *client.Client
 	composeAPI   api.Service
 	workingDir   string
+	log          *zap.SugaredLogger
 }
 
 type DockerConnectionViaHttp struct {
@@ -60,9 +62,42 @@ type ServiceStatus struct {
 	Ports       []string `json:"ports"`
 	ContainerID string   `json:"container_id"`
 	Health      string   `json:"health"`
+	// State is the raw container state reported by docker, e.g. "running" or "exited"
+	State string `json:"state,omitempty"`
+	// ExitCode is only meaningful when the container has exited
+	ExitCode int `json:"exit_code"`
 }
 
-func NewDockerComposeClient(params DockerConnectivityParams, workingDir string) (*DockerComposeClient, error) {
+// ContainerDetails is what docker inspect reports about a container of a compose project beyond
+// compose ps, most notably how often docker restarted it
+type ContainerDetails struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Service string `json:"service"`
+	// State is the container state, e.g. "running", "restarting" or "exited"
+	State string `json:"state"`
+	// Health is "healthy", "unhealthy" or "starting", empty without a healthcheck
+	Health       string `json:"health,omitempty"`
+	RestartCount int    `json:"restart_count"`
+	// ExitCode is only meaningful when the container has exited
+	ExitCode int `json:"exit_code"`
+}
+
+// DockerComposeClientOption configures the DockerComposeClient
+type DockerComposeClientOption func(*DockerComposeClient)
+
+// WithDockerComposeLogger logs what the client does to log, without it nothing is logged
+func WithDockerComposeLogger(log *zap.SugaredLogger) DockerComposeClientOption {
+	return func(c *DockerComposeClient) {
+		if log != nil {
+			c.log = log
+		}
+	}
+}
+
+// NewDockerComposeClient creates a compose client working in workingDir that talks to the docker
+// daemon through its api
+func NewDockerComposeClient(params DockerConnectivityParams, workingDir string, opts ...DockerComposeClientOption) (*DockerComposeClient, error) {
 	var dockerClient *client.Client
 	var err error
 
@@ -110,14 +145,14 @@ func NewDockerComposeClient(params DockerConnectivityParams, workingDir string)
 	}
 
 	// Initialize CLI with client
-	opts := &flags.ClientOptions{
+	clientOpts := &flags.ClientOptions{
 		Debug: true,
 	}
 	if params.ViaSocket != nil {
-		opts.Hosts = []string{params.ViaSocket.SocketPath}
+		clientOpts.Hosts = []string{params.ViaSocket.SocketPath}
 	}
 
-	if err := cli.Initialize(opts); err != nil {
+	if err := cli.Initialize(clientOpts); err != nil {
 		return nil, fmt.Errorf("failed to initialize docker CLI: %w", err)
 	}
 
@@ -128,11 +163,21 @@ func NewDockerComposeClient(params DockerConnectivityParams, workingDir string)
 		return nil, fmt.Errorf("failed to create working directory: %w", err)
 	}
 
-	return &DockerComposeClient{
+	// Compose files whose download was interrupted by a crash are never used
+	if _, err := file.RemoveStaleTemps(workingDir); err != nil {
+		return nil, fmt.Errorf("failed to clean up working directory: %w", err)
+	}
+
+	c := &DockerComposeClient{
 		dockerClient: dockerClient,
 		composeAPI:   composeAPI,
 		workingDir:   workingDir,
-	}, nil
+		log:          zap.NewNop().Sugar(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
 }
 
 func (c *DockerComposeClient) DeployCompose(ctx context.Context, projectName string, composeFile string, envVars map[string]string) error {
@@ -146,7 +191,7 @@ func (c *DockerComposeClient) DeployCompose(ctx context.Context, projectName str
 		return fmt.Errorf("failed to load compose project: %w", err)
 	}
 
-	fmt.Println("ProjectName", project.Name, "working directory", project.WorkingDir, "filename", project.Configs)
+	c.log.Debugw("Loaded compose project", "project", project.Name, "workingDir", project.WorkingDir, "configs", project.Configs)
 
 	err = c.composeAPI.Down(ctx, project.Name, api.DownOptions{
 		RemoveOrphans: true,
@@ -155,13 +200,13 @@ func (c *DockerComposeClient) DeployCompose(ctx context.Context, projectName str
 		// Images:        "all",
 	})
 	if err != nil {
-		fmt.Println("Failed to bring down the compose", "err", err.Error())
+		c.log.Warnw("Failed to bring down the compose project", "project", projectName, "error", err)
 	}
 
 	time.Sleep(time.Second * 10)
 
 	if err := c.forceCleanupProject(ctx, projectName); err != nil {
-		fmt.Println("failed to force cleanup the project", "error", err.Error())
+		c.log.Warnw("Failed to force cleanup the compose project", "project", projectName, "error", err)
 	}
 
 	// Load compose project
@@ -170,7 +215,7 @@ func (c *DockerComposeClient) DeployCompose(ctx context.Context, projectName str
 		return fmt.Errorf("failed to load compose project: %w", err)
 	}
 
-	fmt.Println("ProjectName", project.Name, "working directory", project.WorkingDir, "filename", project.Configs)
+	c.log.Debugw("Loaded compose project", "project", project.Name, "workingDir", project.WorkingDir, "configs", project.Configs)
 
 	// Create containers first
 	err = c.composeAPI.Create(ctx, project, api.CreateOptions{
@@ -195,7 +240,7 @@ func (c *DockerComposeClient) DeployCompose(ctx context.Context, projectName str
 		return fmt.Errorf("failed to load compose project: %w", err)
 	}
 
-	fmt.Println("ProjectName", project.Name, "working directory", project.WorkingDir, "filename", project.Configs)
+	c.log.Debugw("Loaded compose project", "project", project.Name, "workingDir", project.WorkingDir, "configs", project.Configs)
 	err = c.composeAPI.Start(ctx, project.Name, api.StartOptions{
 		Project: project,
 		Wait:    true,
@@ -361,7 +406,7 @@ func (c *DockerComposeClient) FetchComposeFileFromURL(ctx context.Context, url s
 		OverwriteExist: true,
 		ResumeDownload: false,
 		ProgressCallback: func(downloaded, total int64) {
-			fmt.Printf("\nTotal: %d, Downloaded: %d", total, downloaded)
+			c.log.Debugw("Downloading compose file", "url", url, "downloaded", downloaded, "total", total)
 		},
 	})
 	if err != nil {
@@ -409,7 +454,7 @@ func (c *DockerComposeClient) forceCleanupProject(ctx context.Context, projectNa
 			RemoveVolumes: true,
 			RemoveLinks:   false,
 		}); err != nil {
-			fmt.Printf("Warning: failed to remove container %s: %v\n", containerID, err)
+			c.log.Warnw("Failed to remove container", "project", projectName, "container", containerID, "error", err)
 			// Continue with other containers
 		}
 	}
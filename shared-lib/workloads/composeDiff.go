@@ -0,0 +1,120 @@
+package workloads
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// What `docker compose up` would do to a service, see ComposeConfigDiff
+const (
+	ComposeServiceCreate    = "create"
+	ComposeServiceRecreate  = "recreate"
+	ComposeServiceUnchanged = "unchanged"
+	ComposeServiceRemove    = "remove"
+)
+
+// composeConfigHashLabel is the label compose puts on the containers of a service, the hash of the
+// configuration of the service they were created from
+const composeConfigHashLabel = "com.docker.compose.config-hash"
+
+// ComposeServiceChange is what deploying a compose file would do to one service of the project
+type ComposeServiceChange struct {
+	Service string `json:"service"`
+	// Action is one of the ComposeService* actions
+	Action string `json:"action"`
+}
+
+// ComposeConfigDiff tells what deploying the compose file with the environment variables would do
+// to the services of the project, without changing anything. The configuration hash compose
+// computes for every service of the file is compared with the hash the containers of the project
+// were created from: a service without containers is created, one whose hash differs is
+// recreated, i.e. its containers are restarted. Services that run but are no longer in the file
+// are removed. A newer image behind an unchanged tag is not detected, it is only known once pulled.
+//
+// Returns:
+//   - []ComposeServiceChange: The change of every service, sorted by service
+//   - error: A *ComposeDeployError if the compose file is invalid, or an error if the containers of
+//     the project cannot be listed
+func (c *DockerComposeCliClient) ComposeConfigDiff(ctx context.Context, composeFile, projectName string, envVars map[string]string) ([]ComposeServiceChange, error) {
+	if strings.TrimSpace(projectName) == "" {
+		return nil, fmt.Errorf("project name cannot be empty")
+	}
+
+	cmd := exec.CommandContext(ctx, c.dockerBinary, "compose",
+		"-f", filepath.Base(composeFile),
+		"-p", projectName,
+		"config", "--hash", "*")
+	cmd.Dir = filepath.Dir(composeFile)
+	cmd.Env = prepareDockerEnv(c.params, envVars)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, &ComposeDeployError{
+			Class:  ComposeFailureInvalid,
+			Output: redactEnvValues(stderr.String(), envVars),
+			Err:    newComposeError(err, splitLines(stderr.Bytes()), ""),
+		}
+	}
+	desired := parseServiceHashes(output)
+
+	listCmd := exec.CommandContext(ctx, c.dockerBinary, "ps", "-a",
+		"--filter", "label=com.docker.compose.project="+projectName,
+		"--format", `{{.Label "com.docker.compose.service"}} {{.Label "`+composeConfigHashLabel+`"}}`)
+	listCmd.Env = prepareDockerEnv(c.params, nil)
+	output, err = listCmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the containers of the compose project: %w", err)
+	}
+	// a scaled service has several containers, any of them with another hash is recreated
+	running := map[string][]string{}
+	for _, line := range splitLines(output) {
+		service, hash, _ := strings.Cut(line, " ")
+		running[service] = append(running[service], hash)
+	}
+
+	changes := make([]ComposeServiceChange, 0, len(desired)+len(running))
+	for service, hash := range desired {
+		action := ComposeServiceUnchanged
+		hashes, found := running[service]
+		switch {
+		case !found:
+			action = ComposeServiceCreate
+		case !allEqual(hashes, hash):
+			action = ComposeServiceRecreate
+		}
+		changes = append(changes, ComposeServiceChange{Service: service, Action: action})
+	}
+	for service := range running {
+		if _, found := desired[service]; !found {
+			changes = append(changes, ComposeServiceChange{Service: service, Action: ComposeServiceRemove})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Service < changes[j].Service })
+	return changes, nil
+}
+
+// parseServiceHashes parses the "<service> <hash>" lines of compose config --hash
+func parseServiceHashes(output []byte) map[string]string {
+	hashes := map[string]string{}
+	for _, line := range splitLines(output) {
+		if service, hash, found := strings.Cut(line, " "); found {
+			hashes[service] = strings.TrimSpace(hash)
+		}
+	}
+	return hashes
+}
+
+func allEqual(values []string, value string) bool {
+	for _, v := range values {
+		if v != value {
+			return false
+		}
+	}
+	return true
+}
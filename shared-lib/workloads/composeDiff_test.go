@@ -0,0 +1,47 @@
+package workloads
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestComposeConfigDiff(t *testing.T) {
+	client, composeFile, callLog := newStubComposeClient(t, "config-diff")
+
+	changes, err := client.ComposeConfigDiff(context.Background(), composeFile, "demo", map[string]string{"TAG": "1.26"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one of the two web containers was created from another configuration
+	want := []ComposeServiceChange{
+		{Service: "api", Action: ComposeServiceUnchanged},
+		{Service: "cache", Action: ComposeServiceCreate},
+		{Service: "web", Action: ComposeServiceRecreate},
+		{Service: "worker", Action: ComposeServiceRemove},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %+v, want %+v", changes, want)
+	}
+
+	// nothing is deployed or removed
+	for _, call := range stubDockerCalls(t, callLog) {
+		for _, verb := range []string{" up ", " down", " pull ", "rm "} {
+			if strings.Contains(call, verb) {
+				t.Errorf("unexpected docker call %q", call)
+			}
+		}
+	}
+}
+
+func TestComposeConfigDiff_InvalidFile(t *testing.T) {
+	client, composeFile, _ := newStubComposeClient(t, "config-diff-invalid")
+
+	_, err := client.ComposeConfigDiff(context.Background(), composeFile, "demo", nil)
+	var deployErr *ComposeDeployError
+	if !errors.As(err, &deployErr) || deployErr.Class != ComposeFailureInvalid {
+		t.Fatalf("err = %v, want a ComposeDeployError of class %s", err, ComposeFailureInvalid)
+	}
+}
@@ -0,0 +1,170 @@
+package workloads
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ComposeFailureClass classifies why a compose deployment failed, the values double as the error
+// codes reported with the failed deployment
+type ComposeFailureClass string
+
+const (
+	// ComposeFailureInvalid means the compose file (with its variables) does not validate, retrying
+	// the same deployment fails again
+	ComposeFailureInvalid ComposeFailureClass = "COMPOSE_INVALID"
+	// ComposeFailurePull means images could not be pulled, e.g. because the registry is unreachable
+	ComposeFailurePull ComposeFailureClass = "IMAGE_PULL_FAILED"
+	// ComposeFailureCreate means containers could not be created
+	ComposeFailureCreate ComposeFailureClass = "CONTAINER_CREATE_FAILED"
+	// ComposeFailureStart means containers were created but did not start, e.g. on a port conflict
+	ComposeFailureStart ComposeFailureClass = "CONTAINER_START_FAILED"
+	// ComposeFailureUnhealthy means containers started but did not become healthy in time, or exited
+	ComposeFailureUnhealthy ComposeFailureClass = "CONTAINER_UNHEALTHY"
+)
+
+// ServiceOutcome is how far a service of a compose project got
+type ServiceOutcome string
+
+const (
+	ServiceStarted     ServiceOutcome = "started"
+	ServicePullFailed  ServiceOutcome = "pull_failed"
+	ServiceNotCreated  ServiceOutcome = "not_created"
+	ServiceStartFailed ServiceOutcome = "start_failed"
+	ServiceUnhealthy   ServiceOutcome = "unhealthy"
+)
+
+// maxServiceReasonLength keeps the reasons short enough for a status message
+const maxServiceReasonLength = 200
+
+// ServiceResult is the outcome of one service of a failed compose deployment
+type ServiceResult struct {
+	Service string         `json:"service"`
+	Outcome ServiceOutcome `json:"outcome"`
+	Reason  string         `json:"reason,omitempty"`
+}
+
+// Failed reports whether the service did not come up
+func (r ServiceResult) Failed() bool {
+	return r.Outcome != ServiceStarted
+}
+
+// ComposeDeployError is returned when a compose deployment fails, it tells which services failed
+// and why instead of the raw output of the docker CLI
+type ComposeDeployError struct {
+	Class    ComposeFailureClass `json:"class"`
+	Services []ServiceResult     `json:"services,omitempty"`
+	// Output is the raw output of the failed command, meant for logs
+	Output string `json:"-"`
+	Err    error  `json:"-"`
+}
+
+// Error lists the failed services with their reasons, prefixed by the failure class
+func (e *ComposeDeployError) Error() string {
+	var failed []string
+	for _, service := range e.FailedServices() {
+		if service.Reason == "" {
+			failed = append(failed, fmt.Sprintf("%s %s", service.Service, service.Outcome))
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%s %s: %s", service.Service, service.Outcome, service.Reason))
+	}
+	if len(failed) > 0 {
+		return fmt.Sprintf("%s: %s", e.Class, strings.Join(failed, "; "))
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Class, composeErrorReason(e.Err))
+	}
+	return string(e.Class)
+}
+
+func (e *ComposeDeployError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether the same deployment may succeed later without changes, which is the
+// case when images could not be pulled
+func (e *ComposeDeployError) Retryable() bool {
+	return e.Class == ComposeFailurePull
+}
+
+// FailedServices returns the services that did not come up, sorted by name
+func (e *ComposeDeployError) FailedServices() []ServiceResult {
+	var failed []ServiceResult
+	for _, service := range e.Services {
+		if service.Failed() {
+			failed = append(failed, service)
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Service < failed[j].Service })
+	return failed
+}
+
+// classifyComposeUp decides the outcome of every service after a failed compose up. Services
+// without a container did not get created, the ones whose container does not run did not start.
+func classifyComposeUp(projectName string, services []string, containers []ServiceStatus, upMessages []string) []ServiceResult {
+	containerOf := make(map[string]ServiceStatus, len(containers))
+	for _, container := range containers {
+		containerOf[container.Name] = container
+	}
+
+	results := make([]ServiceResult, 0, len(services))
+	for _, service := range services {
+		container, created := containerOf[service]
+		result := ServiceResult{Service: service}
+		switch {
+		case !created:
+			result.Outcome = ServiceNotCreated
+			result.Reason = serviceReason(projectName, service, upMessages)
+		case container.Status == "running":
+			result.Outcome = ServiceStarted
+		default:
+			result.Outcome = ServiceStartFailed
+			result.Reason = serviceReason(projectName, service, upMessages)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// composeFailureClass is the class of the most fundamental failure among the services
+func composeFailureClass(results []ServiceResult) ComposeFailureClass {
+	class := ComposeFailureStart
+	for _, result := range results {
+		switch result.Outcome {
+		case ServicePullFailed:
+			return ComposeFailurePull
+		case ServiceNotCreated:
+			class = ComposeFailureCreate
+		}
+	}
+	return class
+}
+
+// serviceReason picks the message of the compose output that is about the service, compose names
+// containers <project>-<service>-<index>
+func serviceReason(projectName, service string, messages []string) string {
+	containerPrefix := fmt.Sprintf("%s-%s-", projectName, service)
+	quoted := fmt.Sprintf("service %q", service)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if strings.Contains(messages[i], containerPrefix) || strings.Contains(messages[i], quoted) {
+			return conciseReason(messages[i])
+		}
+	}
+	return ""
+}
+
+// conciseReason strips the noise the docker CLI wraps around an error message and truncates it
+func conciseReason(message string) string {
+	message = strings.TrimSpace(message)
+	if lines := strings.Split(message, "\n"); len(lines) > 1 {
+		message = strings.TrimSpace(lines[len(lines)-1])
+	}
+	message = strings.TrimPrefix(message, "Error response from daemon: ")
+	message = strings.TrimPrefix(message, "Error ")
+	if len(message) > maxServiceReasonLength {
+		message = message[:maxServiceReasonLength-3] + "..."
+	}
+	return message
+}
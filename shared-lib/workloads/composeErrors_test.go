@@ -0,0 +1,149 @@
+package workloads
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// newStubComposeClient returns a client whose docker CLI answers from the given scenario of
+// testdata/composeDeploy, the path of its compose file and the log of the docker calls
+func newStubComposeClient(t *testing.T, scenario string) (*DockerComposeCliClient, string, string) {
+	t.Helper()
+	stub, err := filepath.Abs(filepath.Join("testdata", "composeDeploy", "stub-docker.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callLog := filepath.Join(t.TempDir(), "calls.log")
+	t.Setenv("STUB_DOCKER_SCENARIO", filepath.Join(filepath.Dir(stub), scenario))
+	t.Setenv("STUB_DOCKER_LOG", callLog)
+
+	client := &DockerComposeCliClient{workingDir: t.TempDir(), dockerBinary: stub, log: zap.NewNop().Sugar()}
+	composeFile := client.generateAbsProjectFilepath("demo")
+	if err := os.MkdirAll(filepath.Dir(composeFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(composeFile, []byte("services: {web: {image: nginx:1.25}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return client, composeFile, callLog
+}
+
+func stubDockerCalls(t *testing.T, callLog string) []string {
+	t.Helper()
+	content, err := os.ReadFile(callLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestDeployComposeStream_Failures(t *testing.T) {
+	tests := []struct {
+		name         string
+		scenario     string
+		wantClass    ComposeFailureClass
+		wantServices []ServiceResult
+		wantMessage  string
+		retryable    bool
+	}{
+		{
+			name:        "invalid yaml",
+			scenario:    "invalid-yaml",
+			wantClass:   ComposeFailureInvalid,
+			wantMessage: "COMPOSE_INVALID: yaml: line 4: mapping values are not allowed in this context",
+		},
+		{
+			name:      "one of three images fails to pull",
+			scenario:  "pull-failure",
+			wantClass: ComposeFailurePull,
+			wantServices: []ServiceResult{
+				{Service: "db", Outcome: ServicePullFailed, Reason: "pull access denied for registry.local/db, repository does not exist or may require 'docker login': denied: requested access to the resource is denied"},
+			},
+			wantMessage: "IMAGE_PULL_FAILED: db pull_failed: pull access denied for registry.local/db, repository does not exist or may require 'docker login': denied: requested access to the resource is denied",
+			retryable:   true,
+		},
+		{
+			name:      "port conflict",
+			scenario:  "port-conflict",
+			wantClass: ComposeFailureStart,
+			wantServices: []ServiceResult{
+				{Service: "db", Outcome: ServiceStarted},
+				{Service: "web", Outcome: ServiceStartFailed, Reason: "driver failed programming external connectivity on endpoint demo-web-1 (3f2a9c8e1b7d): Bind for 0.0.0.0:8080 failed: port is already allocated"},
+			},
+			wantMessage: "CONTAINER_START_FAILED: web start_failed: driver failed programming external connectivity on endpoint demo-web-1 (3f2a9c8e1b7d): Bind for 0.0.0.0:8080 failed: port is already allocated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, composeFile, callLog := newStubComposeClient(t, tt.scenario)
+
+			err := client.DeployComposeStream(context.Background(), "demo", composeFile, nil, nil)
+			var deployErr *ComposeDeployError
+			if !errors.As(err, &deployErr) {
+				t.Fatalf("DeployComposeStream() error = %v, want a *ComposeDeployError", err)
+			}
+			if deployErr.Class != tt.wantClass {
+				t.Errorf("Class = %s, want %s", deployErr.Class, tt.wantClass)
+			}
+			if !reflect.DeepEqual(deployErr.Services, tt.wantServices) {
+				t.Errorf("Services = %+v, want %+v", deployErr.Services, tt.wantServices)
+			}
+			if err.Error() != tt.wantMessage {
+				t.Errorf("Error() = %q, want %q", err.Error(), tt.wantMessage)
+			}
+			if deployErr.Retryable() != tt.retryable {
+				t.Errorf("Retryable() = %v, want %v", deployErr.Retryable(), tt.retryable)
+			}
+			if deployErr.Output == "" {
+				t.Error("the raw output is kept for the logs")
+			}
+
+			if tt.wantClass == ComposeFailureInvalid {
+				if calls := stubDockerCalls(t, callLog); len(calls) != 1 {
+					t.Errorf("nothing runs after the validation failed, got calls %v", calls)
+				}
+			}
+			if tt.wantClass == ComposeFailurePull {
+				for _, call := range stubDockerCalls(t, callLog) {
+					if strings.Contains(call, " up ") {
+						t.Errorf("the containers are not started with stale images, got call %s", call)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDeployComposeStream_Success(t *testing.T) {
+	client, composeFile, callLog := newStubComposeClient(t, "success")
+
+	var events []ComposeEvent
+	err := client.DeployComposeStream(context.Background(), "demo", composeFile, nil, func(event ComposeEvent) {
+		events = append(events, event)
+	})
+	if err != nil {
+		t.Fatalf("DeployComposeStream() error = %v", err)
+	}
+	if len(events) != 3 {
+		t.Errorf("expected the 3 progress events of compose up, got %+v", events)
+	}
+
+	var commands []string
+	for _, call := range stubDockerCalls(t, callLog) {
+		if strings.HasPrefix(call, "compose") {
+			fields := strings.Fields(call)
+			commands = append(commands, strings.Join(fields[len(fields)-2:], " "))
+		}
+	}
+	want := []string{"config --services", "--remove-orphans --volumes", "pull db", "pull web", "-d --force-recreate", "json --all"}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("compose commands = %v, want %v", commands, want)
+	}
+}
@@ -0,0 +1,119 @@
+package workloads
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultComposeHealthTimeout is how long WaitForHealthy waits when the caller passes no timeout
+const DefaultComposeHealthTimeout = 5 * time.Minute
+
+// composeHealthPollInterval is how often WaitForHealthy inspects the containers
+var composeHealthPollInterval = 2 * time.Second
+
+// WaitForHealthy waits until every service of the compose project is up: its containers run and
+// the ones with a healthcheck report healthy. Containers that exited with code 0, e.g. one-shot
+// migrations, count as up. A timeout of 0 waits DefaultComposeHealthTimeout.
+//
+// A container that exited with another code fails the wait right away. When the timeout expires
+// the *ComposeDeployError of class ComposeFailureUnhealthy tells which services are not up and why.
+func (c *DockerComposeCliClient) WaitForHealthy(ctx context.Context, projectName string, timeout time.Duration) error {
+	timeout = orDefault(timeout, DefaultComposeHealthTimeout)
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var results []ServiceResult
+	var inspectErr error
+	for {
+		containers, err := c.GetComposeContainerDetails(waitCtx, projectName)
+		switch {
+		case err != nil:
+			inspectErr = err
+		case len(containers) == 0:
+			results, inspectErr = nil, fmt.Errorf("compose project %s has no containers", projectName)
+		default:
+			var ready, failed bool
+			results, ready, failed = composeHealth(containers)
+			inspectErr = nil
+			if ready {
+				c.log.Infow("Compose project is healthy", "project", projectName, "services", len(results))
+				return nil
+			}
+			if failed {
+				return &ComposeDeployError{Class: ComposeFailureUnhealthy, Services: results}
+			}
+		}
+
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return fmt.Errorf("waiting for compose project %s to become healthy: %w", projectName, ctx.Err())
+			}
+			err := fmt.Errorf("compose project %s not healthy after %s", projectName, timeout)
+			if inspectErr != nil {
+				err = fmt.Errorf("%w: %w", err, inspectErr)
+			}
+			return &ComposeDeployError{Class: ComposeFailureUnhealthy, Services: results, Err: err}
+		case <-time.After(composeHealthPollInterval):
+		}
+	}
+}
+
+// composeHealth decides whether every service of the containers is up, a service with several
+// containers is up once all of them are. failed means a container exited with an error and the
+// project will not become healthy.
+func composeHealth(containers []ContainerDetails) (results []ServiceResult, ready, failed bool) {
+	byService := make(map[string]*ServiceResult)
+	ready = true
+	for _, container := range containers {
+		result, seen := byService[container.Service]
+		if !seen {
+			result = &ServiceResult{Service: container.Service, Outcome: ServiceStarted}
+			byService[container.Service] = result
+		}
+
+		reason, containerFailed := containerHealthProblem(container)
+		if reason == "" {
+			continue
+		}
+		ready = false
+		failed = failed || containerFailed
+		if result.Outcome == ServiceStarted {
+			result.Outcome = ServiceUnhealthy
+			result.Reason = reason
+		}
+	}
+
+	for _, result := range byService {
+		results = append(results, *result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Service < results[j].Service })
+	return results, ready, failed
+}
+
+// containerHealthProblem tells why the container is not up, empty when it is. fatal means it
+// exited with an error or is dead.
+func containerHealthProblem(container ContainerDetails) (reason string, fatal bool) {
+	switch container.State {
+	case "running":
+		switch container.Health {
+		case "", "healthy":
+			return "", false
+		default:
+			return fmt.Sprintf("health check %s", container.Health), false
+		}
+	case "exited":
+		if container.ExitCode == 0 {
+			return "", false
+		}
+		return fmt.Sprintf("exited with code %d", container.ExitCode), true
+	case "dead":
+		return "container is dead", true
+	case "restarting":
+		return fmt.Sprintf("restarting, restarted %d times", container.RestartCount), false
+	default:
+		return fmt.Sprintf("container is %s", container.State), false
+	}
+}
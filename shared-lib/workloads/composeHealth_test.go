@@ -0,0 +1,112 @@
+package workloads
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForHealthy(t *testing.T) {
+	client, _, _ := newStubComposeClient(t, "healthy")
+
+	if err := client.WaitForHealthy(context.Background(), "demo", time.Minute); err != nil {
+		t.Errorf("WaitForHealthy() error = %v, want the healthy, running and completed services to be up", err)
+	}
+}
+
+func TestWaitForHealthy_ExitedContainer(t *testing.T) {
+	client, _, callLog := newStubComposeClient(t, "exited")
+
+	err := client.WaitForHealthy(context.Background(), "demo", time.Minute)
+	var composeErr *ComposeDeployError
+	if !errors.As(err, &composeErr) {
+		t.Fatalf("WaitForHealthy() error = %v, want a *ComposeDeployError", err)
+	}
+	if composeErr.Class != ComposeFailureUnhealthy {
+		t.Errorf("Class = %s, want %s", composeErr.Class, ComposeFailureUnhealthy)
+	}
+	want := "CONTAINER_UNHEALTHY: db unhealthy: health check starting; web unhealthy: exited with code 3"
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+	// a container that exited with an error does not recover, the wait stops at once
+	if calls := stubDockerCalls(t, callLog); len(calls) != 2 {
+		t.Errorf("docker calls = %v, want a single inspection", calls)
+	}
+}
+
+func TestWaitForHealthy_Timeout(t *testing.T) {
+	interval := composeHealthPollInterval
+	composeHealthPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { composeHealthPollInterval = interval })
+	client, _, _ := newStubComposeClient(t, "container-details")
+
+	err := client.WaitForHealthy(context.Background(), "demo", 100*time.Millisecond)
+	var composeErr *ComposeDeployError
+	if !errors.As(err, &composeErr) {
+		t.Fatalf("WaitForHealthy() error = %v, want a *ComposeDeployError", err)
+	}
+	wantServices := []ServiceResult{
+		{Service: "db", Outcome: ServiceStarted},
+		{Service: "web", Outcome: ServiceUnhealthy, Reason: "restarting, restarted 4 times"},
+	}
+	if !reflect.DeepEqual(composeErr.Services, wantServices) {
+		t.Errorf("Services = %+v, want %+v", composeErr.Services, wantServices)
+	}
+	if !strings.Contains(err.Error(), "web unhealthy: restarting") {
+		t.Errorf("Error() = %q, want it to name the restarting service", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.WaitForHealthy(ctx, "demo", time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitForHealthy() of a cancelled context error = %v, want context.Canceled", err)
+	}
+}
+
+func TestWaitForHealthy_NoContainers(t *testing.T) {
+	client, _, _ := newStubComposeClient(t, "success")
+
+	err := client.WaitForHealthy(context.Background(), "demo", 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "has no containers") {
+		t.Errorf("WaitForHealthy() error = %v, want the project to have no containers", err)
+	}
+}
+
+func TestComposeHealth(t *testing.T) {
+	tests := []struct {
+		name       string
+		containers []ContainerDetails
+		wantReady  bool
+		wantFailed bool
+		wantReason string
+	}{
+		{name: "running without healthcheck", containers: []ContainerDetails{{Service: "web", State: "running"}}, wantReady: true},
+		{name: "unhealthy", containers: []ContainerDetails{{Service: "web", State: "running", Health: "unhealthy"}}, wantReason: "health check unhealthy"},
+		{name: "created", containers: []ContainerDetails{{Service: "web", State: "created"}}, wantReason: "container is created"},
+		{name: "dead", containers: []ContainerDetails{{Service: "web", State: "dead"}}, wantFailed: true, wantReason: "container is dead"},
+		{
+			name: "one replica not up",
+			containers: []ContainerDetails{
+				{Service: "web", State: "running"},
+				{Service: "web", State: "exited", ExitCode: 137},
+			},
+			wantFailed: true,
+			wantReason: "exited with code 137",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, ready, failed := composeHealth(tt.containers)
+			if ready != tt.wantReady || failed != tt.wantFailed {
+				t.Errorf("composeHealth() ready = %v, failed = %v, want %v, %v", ready, failed, tt.wantReady, tt.wantFailed)
+			}
+			if len(results) != 1 || results[0].Reason != tt.wantReason {
+				t.Errorf("composeHealth() = %+v, want web with reason %q", results, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package workloads
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogOptions select the logs GetComposeLogs streams
+type LogOptions struct {
+	// Services limits the logs to these services, every service of the project when empty
+	Services []string
+	// Tail is the number of lines per container from the end of the logs, 0 streams all of them
+	Tail int
+	// Since only streams the logs newer than a duration or timestamp, e.g. "10m" or
+	// "2025-01-02T15:04:05Z", empty for all of them
+	Since string
+	// Follow keeps streaming new logs until the context is done or the reader is closed
+	Follow bool
+	// Timestamps prefixes every line with its timestamp
+	Timestamps bool
+}
+
+// GetComposeLogs streams the logs of the services of a compose project as `docker compose logs`
+// prints them, one "service-1  | line" per line. The stream ends when the logs are read, or for a
+// followed stream when ctx is done or the reader is closed, which stops docker compose. A failing
+// docker compose is the error of the last read.
+func (c *DockerComposeCliClient) GetComposeLogs(ctx context.Context, projectName string, opts LogOptions) (io.ReadCloser, error) {
+	if strings.TrimSpace(projectName) == "" {
+		return nil, fmt.Errorf("project name cannot be empty")
+	}
+	if opts.Tail < 0 {
+		return nil, fmt.Errorf("tail cannot be negative")
+	}
+
+	args := []string{"compose", "-p", projectName, "logs", "--no-color"}
+	if opts.Tail > 0 {
+		args = append(args, "--tail", strconv.Itoa(opts.Tail))
+	}
+	if opts.Since != "" {
+		args = append(args, "--since", opts.Since)
+	}
+	if opts.Follow {
+		args = append(args, "--follow")
+	}
+	if opts.Timestamps {
+		args = append(args, "--timestamps")
+	}
+	args = append(args, opts.Services...)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, c.dockerBinary, args...)
+	// without -f the project is looked up by its name, not by a compose file of the directory
+	cmd.Dir = c.workingDir
+	cmd.Env = prepareDockerEnv(c.params, nil)
+	cmd.WaitDelay = time.Second
+
+	reader, writer := io.Pipe()
+	var stderr bytes.Buffer
+	cmd.Stdout = writer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to run docker compose logs: %w", err)
+	}
+
+	go func() {
+		err := cmd.Wait()
+		if err != nil && ctx.Err() == nil {
+			err = fmt.Errorf("docker compose logs failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+		} else {
+			// a stream stopped by the context or by closing the reader ends cleanly
+			err = nil
+		}
+		writer.CloseWithError(err)
+		cancel()
+	}()
+	return &composeLogs{PipeReader: reader, cancel: cancel}, nil
+}
+
+// composeLogs is the stream of GetComposeLogs, closing it stops docker compose
+type composeLogs struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (l *composeLogs) Close() error {
+	l.cancel()
+	return l.PipeReader.Close()
+}
+
+// GetComposeServiceLogs returns the logs of the services of a compose project by service, the lines
+// of all containers of a scaled service go together. Follow is ignored, the logs logged so far are
+// returned.
+func (c *DockerComposeCliClient) GetComposeServiceLogs(ctx context.Context, projectName string, opts LogOptions) (map[string][]string, error) {
+	opts.Follow = false
+	logs, err := c.GetComposeLogs(ctx, projectName, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer logs.Close()
+
+	serviceLogs := make(map[string][]string)
+	scanner := bufio.NewScanner(logs)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		service, line, ok := parseComposeLogLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		serviceLogs[service] = append(serviceLogs[service], line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return serviceLogs, nil
+}
+
+// parseComposeLogLine splits a "web-1  | line" line of docker compose logs into the service and
+// the line the container logged
+func parseComposeLogLine(text string) (string, string, bool) {
+	container, line, ok := strings.Cut(text, "|")
+	container = strings.TrimSpace(container)
+	if !ok || container == "" {
+		return "", "", false
+	}
+	// the containers of a service are numbered, web-1, web-2, ...
+	if i := strings.LastIndex(container, "-"); i > 0 {
+		if _, err := strconv.Atoi(container[i+1:]); err == nil {
+			container = container[:i]
+		}
+	}
+	return container, strings.TrimPrefix(line, " "), true
+}
@@ -0,0 +1,108 @@
+package workloads
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetComposeLogs(t *testing.T) {
+	client, _, callLog := newStubComposeClient(t, "logs")
+
+	logs, err := client.GetComposeLogs(context.Background(), "demo", LogOptions{Services: []string{"web"}, Tail: 50, Since: "10m"})
+	if err != nil {
+		t.Fatalf("GetComposeLogs() error = %v", err)
+	}
+	defer logs.Close()
+	content, err := io.ReadAll(logs)
+	if err != nil {
+		t.Fatalf("reading the logs failed: %v", err)
+	}
+	if want := "web-1  | listening on :8080\nweb-1  | panic: database unreachable\n"; string(content) != want {
+		t.Errorf("logs = %q, want %q", content, want)
+	}
+
+	calls := stubDockerCalls(t, callLog)
+	if want := "compose -p demo logs --no-color --tail 50 --since 10m web"; len(calls) != 1 || calls[0] != want {
+		t.Errorf("docker calls = %v, want %q", calls, want)
+	}
+
+	if _, err := client.GetComposeLogs(context.Background(), "demo", LogOptions{Tail: -1}); err == nil {
+		t.Error("GetComposeLogs() with a negative tail succeeded")
+	}
+}
+
+func TestGetComposeLogs_Failure(t *testing.T) {
+	client, _, _ := newStubComposeClient(t, "logs-failure")
+
+	logs, err := client.GetComposeLogs(context.Background(), "demo", LogOptions{Services: []string{"worker"}})
+	if err != nil {
+		t.Fatalf("GetComposeLogs() error = %v", err)
+	}
+	defer logs.Close()
+	_, err = io.ReadAll(logs)
+	if err == nil || !strings.Contains(err.Error(), "no such service: worker") {
+		t.Errorf("reading the logs error = %v, want the docker compose failure", err)
+	}
+}
+
+func TestGetComposeLogs_FollowStopsWithTheContext(t *testing.T) {
+	client, _, _ := newStubComposeClient(t, "logs")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logs, err := client.GetComposeLogs(ctx, "demo", LogOptions{Follow: true})
+	if err != nil {
+		t.Fatalf("GetComposeLogs() error = %v", err)
+	}
+	defer logs.Close()
+
+	scanner := bufio.NewScanner(logs)
+	if !scanner.Scan() || scanner.Text() != "web-1  | listening on :8080" {
+		t.Fatalf("first line = %q, want the first log line", scanner.Text())
+	}
+
+	cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(logs)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("a followed stream stopped by the context ends with %v, want a clean end", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the followed stream did not end with the context")
+	}
+}
+
+func TestGetComposeServiceLogs(t *testing.T) {
+	client, _, callLog := newStubComposeClient(t, "service-logs")
+
+	logs, err := client.GetComposeServiceLogs(context.Background(), "demo", LogOptions{Tail: 20, Follow: true})
+	if err != nil {
+		t.Fatalf("GetComposeServiceLogs() error = %v", err)
+	}
+	want := map[string][]string{
+		"web":         {"listening on :8080", "listening on :8080", "panic: database unreachable"},
+		"api-gateway": {"upstream web unreachable"},
+	}
+	if !reflect.DeepEqual(logs, want) {
+		t.Errorf("GetComposeServiceLogs() = %v, want %v", logs, want)
+	}
+	if calls := stubDockerCalls(t, callLog); calls[0] != "compose -p demo logs --no-color --tail 20" {
+		t.Errorf("docker calls = %v, the logs are not followed", calls)
+	}
+
+	client, _, _ = newStubComposeClient(t, "logs-failure")
+	if _, err := client.GetComposeServiceLogs(context.Background(), "demo", LogOptions{Services: []string{"worker"}}); err == nil ||
+		!strings.Contains(err.Error(), "no such service: worker") {
+		t.Errorf("GetComposeServiceLogs() error = %v, want the docker compose failure", err)
+	}
+}
@@ -0,0 +1,126 @@
+package workloads
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/margo/sandbox/shared-lib/file"
+)
+
+// composeProjectFile records, in the directory of a project under the working directory, the
+// compose files the project was last deployed with
+const composeProjectFile = ".compose-project.json"
+
+// defaultComposeFileNames are the names compose itself looks for, they find the files of projects
+// deployed before their files were recorded
+var defaultComposeFileNames = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+// composeProject are the compose files of a project
+type composeProject struct {
+	// Dir is the project directory, the one of the first file
+	Dir string `json:"projectDir"`
+	// Files are the absolute paths of the compose files, the later ones are overlays of the first
+	Files []string `json:"files"`
+}
+
+// WithComposeOverlays deploys the compose files on top of the main one, in order, like further -f
+// flags, e.g. docker-compose.prod.yaml. They are recorded with the project and used again to
+// remove, restart and inspect it.
+func WithComposeOverlays(overlayFiles ...string) ComposeDeployOption {
+	return func(opts *composeDeployOptions) {
+		opts.overlays = append(opts.overlays, overlayFiles...)
+	}
+}
+
+// newComposeProject returns the project of the compose files, every file must exist
+func newComposeProject(composeFiles []string) (composeProject, error) {
+	if len(composeFiles) == 0 {
+		return composeProject{}, fmt.Errorf("at least one compose file is required")
+	}
+	project := composeProject{Files: make([]string, 0, len(composeFiles))}
+	for _, composeFile := range composeFiles {
+		if _, err := os.Stat(composeFile); os.IsNotExist(err) {
+			return composeProject{}, fmt.Errorf("compose file does not exist: %s", composeFile)
+		}
+		absFile, err := filepath.Abs(composeFile)
+		if err != nil {
+			return composeProject{}, fmt.Errorf("failed to get absolute path: %w", err)
+		}
+		project.Files = append(project.Files, absFile)
+	}
+	project.Dir = filepath.Dir(project.Files[0])
+	return project, nil
+}
+
+// fileArgs are the -f flags of the compose files, the files of the project directory are named
+// relative to it
+func (p composeProject) fileArgs() []string {
+	args := make([]string, 0, 2*len(p.Files))
+	for _, composeFile := range p.Files {
+		name := composeFile
+		if filepath.Dir(composeFile) == p.Dir {
+			name = filepath.Base(composeFile)
+		}
+		args = append(args, "-f", name)
+	}
+	return args
+}
+
+func (c *DockerComposeCliClient) projectRecordPath(projectName string) string {
+	return filepath.Join(c.workingDir, projectName, composeProjectFile)
+}
+
+// recordProject remembers the compose files of a deployed project, RemoveCompose removes the
+// record with the project directory
+func (c *DockerComposeCliClient) recordProject(projectName string, project composeProject) error {
+	data, err := json.MarshalIndent(project, "", "  ")
+	if err != nil {
+		return err
+	}
+	recordPath := c.projectRecordPath(projectName)
+	if err := os.MkdirAll(filepath.Dir(recordPath), 0755); err != nil {
+		return err
+	}
+	return file.WriteFileAtomic(recordPath, data, 0644)
+}
+
+// lookupProject returns the compose files the project was deployed with, false when it is not
+// deployed. Projects deployed before their files were recorded are found by the default compose
+// file names in their directory.
+func (c *DockerComposeCliClient) lookupProject(projectName string) (composeProject, bool) {
+	if data, err := os.ReadFile(c.projectRecordPath(projectName)); err == nil {
+		var project composeProject
+		if err := json.Unmarshal(data, &project); err == nil && len(project.Files) > 0 {
+			return project, true
+		}
+		c.log.Warnw("Ignoring the unreadable compose project record", "project", projectName)
+	}
+
+	projectDir := filepath.Join(c.workingDir, projectName)
+	for _, name := range defaultComposeFileNames {
+		if project, err := newComposeProject([]string{filepath.Join(projectDir, name)}); err == nil {
+			return project, true
+		}
+	}
+	return composeProject{}, false
+}
+
+// projectFor returns the recorded files of the project when composeFile is empty or the main file
+// the project was deployed with, the project of composeFile alone otherwise
+func (c *DockerComposeCliClient) projectFor(projectName, composeFile string) (composeProject, error) {
+	recorded, ok := c.lookupProject(projectName)
+	if composeFile == "" {
+		if !ok {
+			return composeProject{}, fmt.Errorf("compose project %s is not deployed", projectName)
+		}
+		return recorded, nil
+	}
+	if ok {
+		if absFile, err := filepath.Abs(composeFile); err == nil && absFile == recorded.Files[0] {
+			return recorded, nil
+		}
+	}
+	return newComposeProject([]string{composeFile})
+}
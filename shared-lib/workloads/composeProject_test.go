@@ -0,0 +1,111 @@
+package workloads
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeComposeFiles writes compose files with the given names into a new directory and returns
+// their paths
+func writeComposeFiles(t *testing.T, names ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("services: {web: {image: nginx:1.25}}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// callsWith returns the docker calls containing fragment
+func callsWith(calls []string, fragment string) []string {
+	var matching []string
+	for _, call := range calls {
+		if strings.Contains(call, fragment) {
+			matching = append(matching, call)
+		}
+	}
+	return matching
+}
+
+func TestDeployCompose_RecordsNonDefaultNamesAndOverlays(t *testing.T) {
+	client, _, callLog := newStubComposeClient(t, "success")
+	ctx := context.Background()
+	files := writeComposeFiles(t, "compose.yml", "docker-compose.prod.yaml")
+
+	if err := client.DeployCompose(ctx, "shop", files, nil); err != nil {
+		t.Fatalf("DeployCompose() error = %v", err)
+	}
+	const fileArgs = "-f compose.yml -f docker-compose.prod.yaml -p shop"
+	if up := callsWith(stubDockerCalls(t, callLog), fileArgs+" up -d"); len(up) != 1 {
+		t.Errorf("compose up calls with both files = %v, want one", up)
+	}
+	if got := client.ProjectComposeFilePath("shop"); got != files[0] {
+		t.Errorf("ProjectComposeFilePath() = %q, want the deployed main file %q", got, files[0])
+	}
+
+	if _, err := client.GetComposeStatus(ctx, "", "shop"); err != nil {
+		t.Fatalf("GetComposeStatus() of the recorded files error = %v", err)
+	}
+	if err := client.RestartCompose(ctx, "shop"); err != nil {
+		t.Fatalf("RestartCompose() error = %v", err)
+	}
+	if err := client.RemoveCompose(ctx, "shop"); err != nil {
+		t.Fatalf("RemoveCompose() error = %v", err)
+	}
+
+	calls := stubDockerCalls(t, callLog)
+	for _, command := range []string{" ps --format json --all", " restart", " down --remove-orphans --volumes --rmi local"} {
+		if len(callsWith(calls, fileArgs+command)) == 0 {
+			t.Errorf("no docker call %q, calls: %v", fileArgs+command, calls)
+		}
+	}
+	if len(callsWith(calls, "rm -f")) != 0 {
+		t.Errorf("the containers were removed one by one, calls: %v", calls)
+	}
+	if _, err := os.Stat(client.projectRecordPath("shop")); !os.IsNotExist(err) {
+		t.Errorf("the project record is kept after the removal, stat error = %v", err)
+	}
+}
+
+func TestRemoveCompose_FindsUnrecordedProjectsByDefaultNames(t *testing.T) {
+	client, _, callLog := newStubComposeClient(t, "success")
+	projectDir := filepath.Join(client.workingDir, "legacy")
+	if err := os.MkdirAll(projectDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(projectDir, "docker-compose.yml"), []byte("services: {web: {image: nginx}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.RemoveCompose(context.Background(), "legacy"); err != nil {
+		t.Fatalf("RemoveCompose() error = %v", err)
+	}
+	if down := callsWith(stubDockerCalls(t, callLog), "-f docker-compose.yml -p legacy down"); len(down) != 1 {
+		t.Errorf("compose down calls = %v, want one with the file found in the project directory", down)
+	}
+}
+
+func TestDeployCompose_RequiresExistingFiles(t *testing.T) {
+	client, composeFile, _ := newStubComposeClient(t, "success")
+	ctx := context.Background()
+
+	if err := client.DeployCompose(ctx, "demo", nil, nil); err == nil {
+		t.Error("DeployCompose() without compose files succeeded")
+	}
+	missing := filepath.Join(t.TempDir(), "docker-compose.prod.yaml")
+	err := client.DeployCompose(ctx, "demo", []string{composeFile, missing}, nil)
+	if err == nil || !strings.Contains(err.Error(), "compose file does not exist: "+missing) {
+		t.Errorf("DeployCompose() with a missing overlay error = %v", err)
+	}
+	if _, found := client.lookupProject("other"); found {
+		t.Error("a project that was never deployed was found")
+	}
+}
@@ -0,0 +1,95 @@
+package workloads
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// registryLogoutTimeout bounds the logout after the pulls, it runs even when the deployment was cancelled
+const registryLogoutTimeout = 10 * time.Second
+
+// ComposeRegistryAuth are the credentials of a private registry the images of a compose project
+// are pulled from
+type ComposeRegistryAuth struct {
+	// Registry is the registry host as the image references name it, e.g. registry.example.com:5000
+	Registry  string
+	BasicAuth HelmRepoBasicAuthentication
+}
+
+// ComposeDeployOption configures DeployComposeStream
+type ComposeDeployOption func(*composeDeployOptions)
+
+type composeDeployOptions struct {
+	registryAuths []ComposeRegistryAuth
+	// overlays are compose files applied on top of the main one, see WithComposeOverlays
+	overlays []string
+}
+
+// WithRegistryAuth logs in to the registries before the images are pulled and out again once
+// they are, a failed login fails the deployment
+func WithRegistryAuth(auths ...ComposeRegistryAuth) ComposeDeployOption {
+	return func(opts *composeDeployOptions) {
+		opts.registryAuths = append(opts.registryAuths, auths...)
+	}
+}
+
+// loginRegistries runs docker login for every registry, the password is passed on stdin so it
+// never shows in the process list. The registries logged in to are returned, also on failure, so
+// that they can be logged out of.
+func (c *DockerComposeCliClient) loginRegistries(ctx context.Context, auths []ComposeRegistryAuth) ([]string, error) {
+	var loggedIn []string
+	for _, auth := range auths {
+		registry := strings.TrimSpace(auth.Registry)
+		if registry == "" {
+			return loggedIn, &ComposeDeployError{Class: ComposeFailurePull, Err: fmt.Errorf("registry credentials without a registry")}
+		}
+
+		cmd := exec.CommandContext(ctx, c.dockerBinary, "login", registry,
+			"--username", auth.BasicAuth.Username, "--password-stdin")
+		cmd.Env = prepareDockerEnv(c.params, nil)
+		cmd.Stdin = strings.NewReader(auth.BasicAuth.Password)
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		if err := cmd.Run(); err != nil {
+			message := redactEnvValues(strings.TrimSpace(output.String()), map[string]string{"password": auth.BasicAuth.Password})
+			c.log.Warnw("Login to the registry failed", "registry", registry, "username", auth.BasicAuth.Username, "output", message)
+			return loggedIn, &ComposeDeployError{
+				Class:  ComposeFailurePull,
+				Output: message,
+				Err: newComposeError(fmt.Errorf("docker login to %s failed: %w", registry, err),
+					[]string{fmt.Sprintf("login to registry %s failed: %s", registry, lastLine(message))}, ""),
+			}
+		}
+		c.log.Infow("Logged in to the registry", "registry", registry, "username", auth.BasicAuth.Username)
+		loggedIn = append(loggedIn, registry)
+	}
+	return loggedIn, nil
+}
+
+// logoutRegistries runs docker logout for every registry, failures are only logged
+func (c *DockerComposeCliClient) logoutRegistries(registries []string) {
+	for _, registry := range registries {
+		ctx, cancel := context.WithTimeout(context.Background(), registryLogoutTimeout)
+		_, err := c.runDocker(ctx, "logout", registry)
+		cancel()
+		if err != nil {
+			c.log.Warnw("Logout from the registry failed, its credentials stay stored", "registry", registry, "error", err)
+			continue
+		}
+		c.log.Debugw("Logged out of the registry", "registry", registry)
+	}
+}
+
+// lastLine is the last non empty line of the output
+func lastLine(output string) string {
+	lines := splitLines([]byte(output))
+	if len(lines) == 0 {
+		return ""
+	}
+	return lines[len(lines)-1]
+}
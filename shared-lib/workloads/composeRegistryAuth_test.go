@@ -0,0 +1,86 @@
+package workloads
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testRegistryAuth = ComposeRegistryAuth{
+	Registry:  "registry.local",
+	BasicAuth: HelmRepoBasicAuthentication{Username: "deployer", Password: "s3cret-token"},
+}
+
+func TestDeployComposeStream_RegistryAuth(t *testing.T) {
+	client, composeFile, callLog := newStubComposeClient(t, "success")
+
+	err := client.DeployComposeStream(context.Background(), "demo", composeFile, nil, nil, WithRegistryAuth(testRegistryAuth))
+	if err != nil {
+		t.Fatalf("DeployComposeStream() error = %v", err)
+	}
+
+	var commands []string
+	for _, call := range stubDockerCalls(t, callLog) {
+		if strings.Contains(call, testRegistryAuth.BasicAuth.Password) {
+			t.Errorf("the password is passed on the command line: %s", call)
+		}
+		fields := strings.Fields(call)
+		if fields[0] == "compose" {
+			commands = append(commands, strings.Join(fields[len(fields)-2:], " "))
+			continue
+		}
+		commands = append(commands, call)
+	}
+	// logged in for the pulls only
+	want := []string{
+		"config --services", "--remove-orphans --volumes",
+		"login registry.local --username deployer --password-stdin",
+		"pull db", "pull web",
+		"logout registry.local",
+		"-d --force-recreate", "json --all",
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("docker calls = %v, want %v", commands, want)
+	}
+
+	stdin, err := os.ReadFile(callLog + ".stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stdin) != testRegistryAuth.BasicAuth.Password {
+		t.Errorf("docker login read %q from stdin, want the password", stdin)
+	}
+}
+
+func TestDeployComposeStream_RegistryLoginFailure(t *testing.T) {
+	client, composeFile, callLog := newStubComposeClient(t, "login-failure")
+
+	err := client.DeployComposeStream(context.Background(), "demo", composeFile, nil, nil, WithRegistryAuth(testRegistryAuth))
+	var deployErr *ComposeDeployError
+	if !errors.As(err, &deployErr) {
+		t.Fatalf("DeployComposeStream() error = %v, want a *ComposeDeployError", err)
+	}
+	if deployErr.Class != ComposeFailurePull {
+		t.Errorf("Class = %s, want %s", deployErr.Class, ComposeFailurePull)
+	}
+	want := `IMAGE_PULL_FAILED: login to registry registry.local failed: Error response from daemon: Get "https://registry.local/v2/": unauthorized: incorrect username or password`
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+
+	for _, call := range stubDockerCalls(t, callLog) {
+		if strings.Contains(call, " pull ") || strings.HasPrefix(call, "logout") {
+			t.Errorf("nothing is pulled or logged out of after the failed login, got call %s", call)
+		}
+	}
+
+	client, composeFile, _ = newStubComposeClient(t, "success")
+	err = client.DeployComposeStream(context.Background(), "demo", composeFile, nil, nil,
+		WithRegistryAuth(ComposeRegistryAuth{BasicAuth: testRegistryAuth.BasicAuth}))
+	if err == nil || !strings.Contains(err.Error(), "registry credentials without a registry") {
+		t.Errorf("DeployComposeStream() error = %v, want the registry to be required", err)
+	}
+}
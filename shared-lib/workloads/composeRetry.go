@@ -0,0 +1,168 @@
+package workloads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Compose error types, what a failed docker CLI call is about as told by its output
+const (
+	// ComposeErrorNotFound is a missing image, container, service or compose file
+	ComposeErrorNotFound = "NotFound"
+	// ComposeErrorDaemonUnavailable means the docker daemon cannot be reached, the same call may
+	// succeed once it is back
+	ComposeErrorDaemonUnavailable = "DaemonUnavailable"
+	// ComposeErrorImagePull is a transient failure pulling an image, e.g. a registry timing out
+	ComposeErrorImagePull = "ImagePullFailure"
+	// ComposeErrorFileInvalid is a compose file that does not parse or validate
+	ComposeErrorFileInvalid = "ComposeFileInvalid"
+	ComposeErrorOther       = "Other"
+)
+
+// composeErrorPatterns are the lowercase fragments of the docker CLI output of every error type, in
+// the order they are matched
+var composeErrorPatterns = []struct {
+	errorType string
+	fragments []string
+}{
+	{ComposeErrorDaemonUnavailable, []string{
+		"cannot connect to the docker daemon",
+		"is the docker daemon running",
+		"error during connect",
+		"dial unix",
+	}},
+	{ComposeErrorFileInvalid, []string{
+		"yaml:",
+		"validating ",
+		"invalid compose project",
+		"additional property",
+		"additional properties",
+	}},
+	{ComposeErrorNotFound, []string{
+		"manifest unknown",
+		"repository does not exist",
+		"no such image",
+		"no such container",
+		"no such service",
+		"no configuration file provided",
+		"not found",
+	}},
+	{ComposeErrorImagePull, []string{
+		"i/o timeout",
+		"tls handshake timeout",
+		"connection reset by peer",
+		"unexpected eof",
+		"toomanyrequests",
+		"temporary failure in name resolution",
+		"net/http: request canceled",
+		"502 bad gateway",
+		"503 service unavailable",
+	}},
+}
+
+// classifyComposeOutput returns the error type of the output of a failed docker CLI call
+func classifyComposeOutput(output string) string {
+	output = strings.ToLower(output)
+	for _, pattern := range composeErrorPatterns {
+		for _, fragment := range pattern.fragments {
+			if strings.Contains(output, fragment) {
+				return pattern.errorType
+			}
+		}
+	}
+	return ComposeErrorOther
+}
+
+// ComposeError is returned when a docker CLI call fails, it keeps the error messages the CLI
+// reported apart from its output and tells what they are about
+type ComposeError struct {
+	// Type is one of the ComposeError* types
+	Type     string
+	Err      error
+	Messages []string
+	Stdout   string
+}
+
+// newComposeError classifies the failed call from its output
+func newComposeError(err error, messages []string, stdout string) *ComposeError {
+	output := strings.Join(append(append([]string{err.Error()}, messages...), stdout), "\n")
+	return &ComposeError{Type: classifyComposeOutput(output), Err: err, Messages: messages, Stdout: stdout}
+}
+
+func (e *ComposeError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, strings.TrimSpace(strings.Join(append(e.Messages, e.Stdout), "\n")))
+}
+
+func (e *ComposeError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether the same call may succeed later, which is the case when the daemon
+// cannot be reached or an image pull failed on the way
+func (e *ComposeError) Retryable() bool {
+	return e.Type == ComposeErrorDaemonUnavailable || e.Type == ComposeErrorImagePull
+}
+
+// ComposeErrorType returns the type of the ComposeError in the chain of err, "" when there is none
+func ComposeErrorType(err error) string {
+	var composeErr *ComposeError
+	if errors.As(err, &composeErr) {
+		return composeErr.Type
+	}
+	return ""
+}
+
+// IsDaemonUnavailable reports whether err is a docker CLI call that failed because the daemon
+// cannot be reached
+func IsDaemonUnavailable(err error) bool {
+	return ComposeErrorType(err) == ComposeErrorDaemonUnavailable
+}
+
+// ComposeRetryPolicy is how often the pull, up and down calls of a compose deployment are retried
+// when they fail with a retryable ComposeError
+type ComposeRetryPolicy struct {
+	// Attempts is the number of calls including the first one, 1 or less does not retry
+	Attempts int
+	// Delay is the wait before the first retry, it doubles for every further one
+	Delay time.Duration
+}
+
+// DefaultComposeRetryPolicy retries a call twice, after 2 and 4 seconds
+var DefaultComposeRetryPolicy = ComposeRetryPolicy{Attempts: 3, Delay: 2 * time.Second}
+
+// ComposeClientOption configures the DockerComposeCliClient
+type ComposeClientOption func(*DockerComposeCliClient)
+
+// WithComposeRetryPolicy replaces the DefaultComposeRetryPolicy of the client
+func WithComposeRetryPolicy(policy ComposeRetryPolicy) ComposeClientOption {
+	return func(c *DockerComposeCliClient) {
+		c.retry = policy
+	}
+}
+
+// withRetry runs call until it succeeds, fails with an error that is not retryable, the attempts
+// of the retry policy are used up or ctx is done. The last error is returned.
+func (c *DockerComposeCliClient) withRetry(ctx context.Context, operation, projectName string, envVars map[string]string, call func() error) error {
+	delay := c.retry.Delay
+	for attempt := 1; ; attempt++ {
+		err := call()
+		var composeErr *ComposeError
+		if err == nil || attempt >= c.retry.Attempts || !errors.As(err, &composeErr) || !composeErr.Retryable() {
+			return err
+		}
+
+		c.log.Warnw("Docker compose call failed, retrying", "operation", operation, "project", projectName,
+			"type", composeErr.Type, "attempt", attempt, "retryIn", delay, "error", redactEnvValues(err.Error(), envVars))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
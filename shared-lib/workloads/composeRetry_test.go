@@ -0,0 +1,87 @@
+package workloads
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestClassifyComposeOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?", ComposeErrorDaemonUnavailable},
+		{"error during connect: Get \"http://%2F%2F.%2Fpipe%2Fdocker_engine/v1.24/version\": open //./pipe/docker_engine", ComposeErrorDaemonUnavailable},
+		{"yaml: line 4: mapping values are not allowed in this context", ComposeErrorFileInvalid},
+		{"validating compose.yaml: services.web Additional property imgae is not allowed", ComposeErrorFileInvalid},
+		{"Error response from daemon: manifest for nginx:9.9 not found: manifest unknown", ComposeErrorNotFound},
+		{"no configuration file provided: not found", ComposeErrorNotFound},
+		{"Get \"https://registry-1.docker.io/v2/\": net/http: TLS handshake timeout", ComposeErrorImagePull},
+		{"read tcp 10.0.0.2:51234->104.18.1.1:443: i/o timeout", ComposeErrorImagePull},
+		{"Bind for 0.0.0.0:8080 failed: port is already allocated", ComposeErrorOther},
+	}
+	for _, tt := range tests {
+		if got := classifyComposeOutput(tt.output); got != tt.want {
+			t.Errorf("classifyComposeOutput(%q) = %s, want %s", tt.output, got, tt.want)
+		}
+	}
+}
+
+func countCalls(calls []string, fragment string) int {
+	count := 0
+	for _, call := range calls {
+		if strings.Contains(call, fragment) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestDeployComposeStream_RetriesDaemonUnavailable(t *testing.T) {
+	client, composeFile, callLog := newStubComposeClient(t, "daemon-unavailable")
+	WithComposeRetryPolicy(ComposeRetryPolicy{Attempts: 3, Delay: time.Millisecond})(client)
+
+	err := client.DeployComposeStream(context.Background(), "demo", composeFile, nil, nil)
+	if !IsDaemonUnavailable(err) {
+		t.Fatalf("DeployComposeStream() error = %v, want a daemon unavailable error", err)
+	}
+	var deployErr *ComposeDeployError
+	if !errors.As(err, &deployErr) || deployErr.Class != ComposeFailurePull {
+		t.Errorf("the failed pull is still reported as a *ComposeDeployError, got %v", err)
+	}
+	if pulls := countCalls(stubDockerCalls(t, callLog), " pull web"); pulls != 3 {
+		t.Errorf("pull calls = %d, want 3", pulls)
+	}
+}
+
+func TestDeployComposeStream_DoesNotRetryPermanentFailures(t *testing.T) {
+	client, composeFile, callLog := newStubComposeClient(t, "pull-failure")
+	WithComposeRetryPolicy(ComposeRetryPolicy{Attempts: 3, Delay: time.Millisecond})(client)
+
+	err := client.DeployComposeStream(context.Background(), "demo", composeFile, nil, nil)
+	if got := ComposeErrorType(err); got != ComposeErrorNotFound {
+		t.Errorf("ComposeErrorType() = %q, want %s", got, ComposeErrorNotFound)
+	}
+	if pulls := countCalls(stubDockerCalls(t, callLog), " pull db"); pulls != 1 {
+		t.Errorf("pull calls = %d, want 1", pulls)
+	}
+}
+
+func TestWithRetry_StopsWhenContextIsDone(t *testing.T) {
+	client := &DockerComposeCliClient{log: zap.NewNop().Sugar(), retry: ComposeRetryPolicy{Attempts: 5, Delay: time.Hour}}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := client.withRetry(ctx, "up", "demo", nil, func() error {
+		calls++
+		cancel()
+		return &ComposeError{Type: ComposeErrorDaemonUnavailable, Err: errors.New("exit status 1")}
+	})
+	if !IsDaemonUnavailable(err) || calls != 1 {
+		t.Errorf("withRetry() = %v after %d calls, want the first error after 1 call", err, calls)
+	}
+}
@@ -1,22 +1,30 @@
 package workloads
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/margo/sandbox/shared-lib/file"
+	"go.uber.org/zap"
 )
 
 type DockerComposeCliClient struct {
 	workingDir   string
 	dockerBinary string
 	params       DockerConnectivityParams
+	log          *zap.SugaredLogger
+	// retry is how the pull, up and down calls are retried, see WithComposeRetryPolicy
+	retry ComposeRetryPolicy
 }
 
 // CLI output structures for parsing
@@ -40,7 +48,14 @@ type Publisher struct {
 	Protocol      string `json:"Protocol"`
 }
 
-func NewDockerComposeCliClient(params DockerConnectivityParams, workingDir string) (*DockerComposeCliClient, error) {
+// NewDockerComposeCliClient creates a compose client working in workingDir. The output of the
+// docker commands is logged at debug level with the values of the compose variables masked, a nil
+// log discards everything. The pull, up and down calls are retried by the DefaultComposeRetryPolicy
+// unless an option replaces it.
+func NewDockerComposeCliClient(params DockerConnectivityParams, workingDir string, log *zap.SugaredLogger, opts ...ComposeClientOption) (*DockerComposeCliClient, error) {
+	if log == nil {
+		log = zap.NewNop().Sugar()
+	}
 	if workingDir == "" {
 		return nil, fmt.Errorf("working directory path should be a valid path, existing value was: %s", workingDir)
 	}
@@ -67,99 +82,294 @@ func NewDockerComposeCliClient(params DockerConnectivityParams, workingDir strin
 		return nil, fmt.Errorf("failed to create working directory: %w", err)
 	}
 
-	return &DockerComposeCliClient{
+	// Compose files whose download was interrupted by a crash are never used
+	if _, err := file.RemoveStaleTemps(workingDir); err != nil {
+		return nil, fmt.Errorf("failed to clean up working directory: %w", err)
+	}
+
+	client := &DockerComposeCliClient{
 		workingDir:   workingDir,
 		dockerBinary: dockerBinary,
 		params:       params,
-	}, nil
+		log:          log,
+		retry:        DefaultComposeRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client, nil
+}
+
+// DeployCompose deploys the compose project from its compose files, the first is the main file and
+// the others are overlays applied in order, see DeployComposeStream and WithComposeOverlays
+func (c *DockerComposeCliClient) DeployCompose(ctx context.Context, projectName string, composeFiles []string, envVars map[string]string) error {
+	if len(composeFiles) == 0 {
+		return fmt.Errorf("at least one compose file is required")
+	}
+	return c.DeployComposeStream(ctx, projectName, composeFiles[0], envVars, nil, WithComposeOverlays(composeFiles[1:]...))
+}
+
+// ComposeEvent is a single progress event as emitted by `docker compose --progress json`,
+// e.g. an image being pulled or a container being created or started.
+type ComposeEvent struct {
+	// ID names the resource the event is about, e.g. "Container web-1" or "Image nginx:latest"
+	ID string `json:"id,omitempty"`
+	// ParentID is set for sub-steps such as individual layers of an image pull
+	ParentID string `json:"parent_id,omitempty"`
+	// Text is the short progress state, e.g. "Pulling", "Creating", "Started"
+	Text    string `json:"text,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Level   string `json:"level,omitempty"`
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+	Percent int    `json:"percent,omitempty"`
 }
 
-func (c *DockerComposeCliClient) DeployCompose(ctx context.Context, projectName string, composeFile string, envVars map[string]string) error {
+// IsError reports whether compose flagged the event as an error
+func (e ComposeEvent) IsError() bool {
+	return strings.EqualFold(e.Level, "error") || strings.EqualFold(e.Text, "error")
+}
+
+// parseComposeEvent parses one line of compose json progress output, lines that are not
+// json (plain log output of older compose versions) are returned as text-only events
+func parseComposeEvent(line string) (ComposeEvent, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return ComposeEvent{}, false
+	}
+
+	var event ComposeEvent
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		return ComposeEvent{Text: line}, true
+	}
+	return event, true
+}
+
+// DeployComposeStream deploys the compose project and streams the progress events of the image
+// pulls and container start up to onEvent while they happen.
+//
+// The compose file is validated first, then the images of every service are pulled one service at
+// a time and the containers are brought up. Images of private registries are pulled after logging
+// in with the credentials of WithRegistryAuth. A failed pull fails the deployment, the containers
+// are not started with stale local images. A failure is returned as a *ComposeDeployError telling
+// which services failed to pull, to be created or to start.
+//
+// Once deployed, the compose files are recorded with the project, RemoveCompose, RestartCompose,
+// ScaleService and GetComposeStatus use them whatever the files are named.
+func (c *DockerComposeCliClient) DeployComposeStream(ctx context.Context, projectName string, composeFile string, envVars map[string]string, onEvent func(ComposeEvent), opts ...ComposeDeployOption) error {
 	if strings.TrimSpace(projectName) == "" {
 		return fmt.Errorf("project name cannot be empty")
 	}
 
-	fmt.Printf("Starting deployment for project: %s\n", projectName)
-	fmt.Printf("Using compose file: %s\n", composeFile)
+	options := &composeDeployOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	project, err := newComposeProject(append([]string{composeFile}, options.overlays...))
+	if err != nil {
+		return err
+	}
 
-	// Ensure compose file exists
-	if _, err := os.Stat(composeFile); os.IsNotExist(err) {
-		return fmt.Errorf("compose file does not exist: %s", composeFile)
+	if onEvent == nil {
+		onEvent = func(ComposeEvent) {}
 	}
 
-	// Extract directory and filename separately
-	projectDir := filepath.Dir(composeFile)
-	composeFileName := filepath.Base(composeFile)
+	services, err := c.composeServices(ctx, project, projectName, envVars)
+	if err != nil {
+		return err
+	}
 
-	fmt.Printf("Project directory: %s\n", projectDir)
-	fmt.Printf("Compose filename: %s\n", composeFileName)
+	c.cleanupExistingProject(ctx, projectName, project, envVars)
 
-	// Step 1: Force cleanup of existing containers
-	fmt.Printf("Cleaning up existing containers for project: %s\n", projectName)
+	if err := c.pullServices(ctx, project, projectName, services, envVars, onEvent, options.registryAuths); err != nil {
+		return err
+	}
 
-	// First try compose down with force removal
-	downCmd := exec.CommandContext(ctx, c.dockerBinary, "compose",
-		"-f", composeFileName,
-		"-p", projectName,
-		"down", "--remove-orphans", "--volumes")
+	if err := c.withRetry(ctx, "up", projectName, envVars, func() error {
+		return c.runComposeWithProgress(ctx, project.Dir, envVars, onEvent,
+			append(project.fileArgs(), "-p", projectName, "up", "-d", "--force-recreate")...)
+	}); err != nil {
+		return c.composeUpError(ctx, project, projectName, services, err)
+	}
+
+	status, err := c.composeStatus(ctx, project, projectName)
+	if err != nil {
+		return fmt.Errorf("deployment verification failed: %w", err)
+	}
+	if err := c.recordProject(projectName, project); err != nil {
+		// the project runs, without the record it is only found by the default compose file names
+		c.log.Warnw("Failed to record the compose files of the project", "project", projectName, "error", err)
+	}
 
-	downCmd.Dir = projectDir
-	downCmd.Env = prepareDockerEnv(c.params, envVars)
+	c.log.Infow("Compose project deployed", "project", projectName, "status", status.Status, "services", len(status.Services))
+	return nil
+}
 
-	downOutput, err := downCmd.CombinedOutput()
-	fmt.Printf("Down command output: %s\n", string(downOutput))
+// composeServices validates the compose file with the variables interpolated and returns the
+// names of its services
+func (c *DockerComposeCliClient) composeServices(ctx context.Context, project composeProject, projectName string, envVars map[string]string) ([]string, error) {
+	args := append(append([]string{"compose"}, project.fileArgs()...), "-p", projectName, "config", "--services")
+	cmd := exec.CommandContext(ctx, c.dockerBinary, args...)
+	cmd.Dir = project.Dir
+	cmd.Env = prepareDockerEnv(c.params, envVars)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
 	if err != nil {
-		fmt.Printf("Compose down failed: %v\n", err)
+		return nil, &ComposeDeployError{
+			Class:  ComposeFailureInvalid,
+			Output: stderr.String(),
+			Err:    newComposeError(err, splitLines(stderr.Bytes()), ""),
+		}
+	}
+	return splitLines(output), nil
+}
 
-		// If compose down fails, try to remove containers manually
-		if err := c.forceRemoveProjectContainers(ctx, projectName); err != nil {
-			fmt.Printf("Manual container removal failed: %v\n", err)
+// pullServices pulls the images of the services one service at a time, logged in to the
+// registries while it does. Every service is pulled before the failed ones are reported.
+func (c *DockerComposeCliClient) pullServices(ctx context.Context, project composeProject, projectName string, services []string, envVars map[string]string, onEvent func(ComposeEvent), auths []ComposeRegistryAuth) error {
+	loggedIn, err := c.loginRegistries(ctx, auths)
+	defer c.logoutRegistries(loggedIn)
+	if err != nil {
+		return err
+	}
+
+	var failed []ServiceResult
+	var output []string
+	var errs []error
+	for _, service := range services {
+		err := c.withRetry(ctx, "pull "+service, projectName, envVars, func() error {
+			return c.runComposeWithProgress(ctx, project.Dir, envVars, onEvent,
+				append(project.fileArgs(), "-p", projectName, "pull", service)...)
+		})
+		if err != nil {
+			message := redactEnvValues(err.Error(), envVars)
+			c.log.Warnw("Pull of the compose service failed", "project", projectName, "service", service, "error", message)
+			failed = append(failed, ServiceResult{Service: service, Outcome: ServicePullFailed, Reason: composeErrorReason(err)})
+			output = append(output, message)
+			errs = append(errs, err)
 		}
 	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &ComposeDeployError{
+		Class:    ComposeFailurePull,
+		Services: failed,
+		Output:   strings.Join(output, "\n"),
+		Err:      fmt.Errorf("failed to pull the images of %d services: %w", len(failed), errors.Join(errs...)),
+	}
+}
 
-	// Step 2: Pull latest images
-	fmt.Printf("Pulling latest images for project: %s\n", projectName)
-	pullCmd := exec.CommandContext(ctx, c.dockerBinary, "compose",
-		"-f", composeFileName,
-		"-p", projectName,
-		"pull")
+// composeUpError works out which services failed after compose up failed
+func (c *DockerComposeCliClient) composeUpError(ctx context.Context, project composeProject, projectName string, services []string, upErr error) error {
+	var messages []string
+	var commandErr *ComposeError
+	if errors.As(upErr, &commandErr) {
+		messages = commandErr.Messages
+	}
 
-	pullCmd.Dir = projectDir
-	pullCmd.Env = prepareDockerEnv(c.params, envVars)
+	var containers []ServiceStatus
+	if status, err := c.composeStatus(ctx, project, projectName); err == nil {
+		containers = status.Services
+	} else {
+		c.log.Warnw("Failed to inspect the containers after the failed start", "project", projectName, "error", err)
+	}
 
-	pullOutput, err := pullCmd.CombinedOutput()
-	fmt.Printf("Pull command output: %s\n", string(pullOutput))
-	if err != nil {
-		fmt.Printf("Pull command failed (continuing anyway): %v\n", err)
+	results := classifyComposeUp(projectName, services, containers, messages)
+	return &ComposeDeployError{
+		Class:    composeFailureClass(results),
+		Services: results,
+		Output:   upErr.Error(),
+		Err:      upErr,
 	}
+}
 
-	// Step 3: Start containers
-	fmt.Printf("Starting containers for project: %s\n", projectName)
-	upCmd := exec.CommandContext(ctx, c.dockerBinary, "compose",
-		"-f", composeFileName,
-		"-p", projectName,
-		"up", "-d", "--force-recreate")
+// composeErrorReason is the last error message compose reported, or the error itself
+func composeErrorReason(err error) string {
+	var commandErr *ComposeError
+	if errors.As(err, &commandErr) && len(commandErr.Messages) > 0 {
+		return conciseReason(commandErr.Messages[len(commandErr.Messages)-1])
+	}
+	return conciseReason(err.Error())
+}
 
-	upCmd.Dir = projectDir
-	upCmd.Env = prepareDockerEnv(c.params, envVars)
+// runComposeWithProgress runs a compose command with json progress output and hands every
+// event to onEvent. Compose writes its progress to stderr, stdout is kept for the error message.
+func (c *DockerComposeCliClient) runComposeWithProgress(ctx context.Context, projectDir string, envVars map[string]string, onEvent func(ComposeEvent), args ...string) error {
+	cmd := exec.CommandContext(ctx, c.dockerBinary, append([]string{"compose", "--progress", "json"}, args...)...)
+	cmd.Dir = projectDir
+	cmd.Env = prepareDockerEnv(c.params, envVars)
 
-	upOutput, err := upCmd.CombinedOutput()
-	fmt.Printf("Up command output: %s\n", string(upOutput))
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return fmt.Errorf("failed to start containers: %s", string(upOutput))
+		return fmt.Errorf("failed to attach to compose output: %w", err)
 	}
 
-	status, err := c.GetComposeStatus(ctx, composeFile, projectName)
-	if err != nil {
-		return fmt.Errorf("deployment verification failed: %w", err)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run compose: %w", err)
+	}
+
+	var errorTexts []string
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		event, ok := parseComposeEvent(scanner.Text())
+		if !ok {
+			continue
+		}
+		if event.IsError() || event.ID == "" {
+			errorTexts = append(errorTexts, strings.TrimSpace(event.ID+" "+event.Text+" "+event.Status))
+		}
+		onEvent(event)
 	}
 
-	fmt.Printf("Deployment successful. Status: %s, Services: %d\n", status.Status, len(status.Services))
+	if err := cmd.Wait(); err != nil {
+		return newComposeError(err, errorTexts, stdout.String())
+	}
 	return nil
 }
 
+// cleanupExistingProject brings down whatever is left of a previous deployment of the project,
+// falling back to removing the containers one by one when compose down fails
+func (c *DockerComposeCliClient) cleanupExistingProject(ctx context.Context, projectName string, project composeProject, envVars map[string]string) {
+	c.log.Infow("Cleaning up the existing containers of the compose project", "project", projectName)
+
+	// First try compose down with force removal
+	err := c.composeDown(ctx, projectName, project, envVars, "--remove-orphans", "--volumes")
+	if err != nil {
+		c.log.Warnw("Compose down failed, removing the containers one by one", "project", projectName, "error", err)
+
+		// If compose down fails, try to remove containers manually
+		if err := c.forceRemoveProjectContainers(ctx, projectName); err != nil {
+			c.log.Errorw("Manual container removal failed", "project", projectName, "error", err)
+		}
+	}
+}
+
+// composeDown runs compose down for the project with the retry policy of the client, a failure is
+// returned as a *ComposeError
+func (c *DockerComposeCliClient) composeDown(ctx context.Context, projectName string, project composeProject, envVars map[string]string, args ...string) error {
+	return c.withRetry(ctx, "down", projectName, envVars, func() error {
+		composeArgs := append(append([]string{"compose"}, project.fileArgs()...), "-p", projectName, "down")
+		cmd := exec.CommandContext(ctx, c.dockerBinary, append(composeArgs, args...)...)
+		cmd.Dir = project.Dir
+		cmd.Env = prepareDockerEnv(c.params, envVars)
+
+		output, err := cmd.CombinedOutput()
+		c.log.Debugw("Compose down output", "project", projectName, "output", redactEnvValues(string(output), envVars))
+		if err != nil {
+			return newComposeError(err, splitLines(output), "")
+		}
+		return nil
+	})
+}
+
 func (c *DockerComposeCliClient) forceRemoveProjectContainers(ctx context.Context, projectName string) error {
-    fmt.Printf("Force removing containers for project: %s\n", projectName)
+    c.log.Infow("Force removing the containers of the compose project", "project", projectName)
 
     // Use both label filter AND name filter to catch all containers
     listCmd := exec.CommandContext(ctx, c.dockerBinary, "ps", "-a",
@@ -175,7 +385,7 @@ func (c *DockerComposeCliClient) forceRemoveProjectContainers(ctx context.Contex
 
     lines := strings.Split(strings.TrimSpace(string(output)), "\n")
     if len(lines) == 1 && lines[0] == "" {
-        fmt.Printf("No containers found for project: %s\n", projectName)
+        c.log.Debugw("No containers found for the compose project", "project", projectName)
         return nil
     }
 
@@ -193,16 +403,16 @@ func (c *DockerComposeCliClient) forceRemoveProjectContainers(ctx context.Contex
         containerID := parts[0]
         containerName := parts[1]
         
-        fmt.Printf("Force removing container: %s (%s)\n", containerName, containerID)
+        c.log.Infow("Force removing container", "project", projectName, "container", containerName, "containerId", containerID)
         
         // Stop and remove container
         removeCmd := exec.CommandContext(ctx, c.dockerBinary, "rm", "-f", containerID)
         removeCmd.Env = prepareDockerEnv(c.params, nil)
 
         if removeOutput, err := removeCmd.CombinedOutput(); err != nil {
-            fmt.Printf("Failed to remove container %s: %v, output: %s\n", containerName, err, string(removeOutput))
+            c.log.Warnw("Failed to remove container", "project", projectName, "container", containerName, "error", err, "output", string(removeOutput))
         } else {
-            fmt.Printf("Successfully removed container: %s\n", containerName)
+            c.log.Debugw("Removed container", "project", projectName, "container", containerName)
         }
     }
 
@@ -225,7 +435,7 @@ func (c *DockerComposeCliClient) DeployComposeFromURL(ctx context.Context, proje
 		return fmt.Errorf("failed to fetch compose file: %w", err)
 	}
 
-	return c.DeployCompose(ctx, projectName, composeFile, envVars)
+	return c.DeployCompose(ctx, projectName, []string{composeFile}, envVars)
 }
 
 
@@ -236,30 +446,22 @@ func (c *DockerComposeCliClient) RemoveCompose(ctx context.Context, projectName
 	}
 
 	
-	// Find compose file for this project
-	composeFile := c.generateAbsProjectFilepath(projectName)
-    fmt.Printf("Attempting to remove compose project: %s\n", projectName)
-    fmt.Printf("Looking for compose file at: %s\n", composeFile)
-    
-	// Check if compose file exists
-	if _, err := os.Stat(composeFile); os.IsNotExist(err) {
-		fmt.Printf("Compose file not found, trying manual container removal\n")
+	// Find the compose files the project was deployed with
+	project, found := c.lookupProject(projectName)
+	if !found {
+		c.log.Infow("Compose file not found, removing the containers one by one", "project", projectName)
 		return c.forceRemoveProjectContainers(ctx, projectName)
 	}
+	c.log.Infow("Removing compose project", "project", projectName, "composeFiles", project.Files)
 
-	cmd := exec.CommandContext(ctx, c.dockerBinary, "compose",
-		"-f", filepath.Base(composeFile), // Use ONLY the filename
-		"-p", projectName,
-		"down", "--remove-orphans", "--volumes", "--rmi", "local")
-
-	cmd.Dir = filepath.Dir(composeFile) // Set working directory
-	cmd.Env = prepareDockerEnv(c.params, nil)
-
-	output, err := cmd.CombinedOutput()
-	fmt.Printf("Remove command output: %s\n", string(output))
-
+	err := c.composeDown(ctx, projectName, project, nil,
+		"--remove-orphans", "--volumes", "--rmi", "local")
+	if IsDaemonUnavailable(err) {
+		// removing the containers one by one needs the daemon just as well
+		return fmt.Errorf("compose down failed: %w", err)
+	}
 	if err != nil {
-        fmt.Printf("Compose down failed, trying manual removal: %v\n", err)
+        c.log.Warnw("Compose down failed, removing the containers one by one", "project", projectName, "error", err)
         if err := c.forceRemoveProjectContainers(ctx, projectName); err != nil {
             return fmt.Errorf("manual removal also failed: %w", err)
         }
@@ -268,7 +470,7 @@ func (c *DockerComposeCliClient) RemoveCompose(ctx context.Context, projectName
 	// Verify containers are actually removed
     if err := c.verifyContainersRemoved(ctx, projectName); err != nil {
 		// Try one more time with force removal if verification fails
-		fmt.Printf("Verification failed, attempting final cleanup: %v\n", err)
+		c.log.Warnw("Containers left after the removal, removing them one by one", "project", projectName, "error", err)
 		if finalErr := c.forceRemoveProjectContainers(ctx, projectName); finalErr != nil {
 			return fmt.Errorf("containers still running after all removal attempts: %w", err)
 		}
@@ -281,31 +483,27 @@ func (c *DockerComposeCliClient) RemoveCompose(ctx context.Context, projectName
     return nil
 }
 
+// GetComposeStatus returns the status of the containers of the project. An empty composeFile, or
+// the main file the project was deployed with, uses every compose file it was deployed with.
 func (c *DockerComposeCliClient) GetComposeStatus(ctx context.Context, composeFile string, projectName string) (*ComposeStatus, error) {
 	if strings.TrimSpace(projectName) == "" {
 		return nil, fmt.Errorf("project name cannot be empty")
 	}
 
-	// Verify compose file exists
-	if _, err := os.Stat(composeFile); os.IsNotExist(err) {
-		return nil, fmt.Errorf("compose file does not exist: %s", composeFile)
-	}
-
-	fmt.Printf("[DEBUG] composeFile: %s\n", composeFile)
-	fmt.Printf("[DEBUG] projectName: %s\n", projectName)
-	fmt.Printf("[DEBUG] dockerBinary: %s\n", c.dockerBinary)
-
-	// Use absolute path for compose file
-	absComposeFile, err := filepath.Abs(composeFile)
+	project, err := c.projectFor(projectName, composeFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+		return nil, err
 	}
-	cmd := exec.CommandContext(ctx, c.dockerBinary, "compose",
-		"-f", filepath.Base(absComposeFile), // Use just filename
-		"-p", projectName,
-		"ps", "--format", "json", "--all")
+	return c.composeStatus(ctx, project, projectName)
+}
+
+// composeStatus runs compose ps with the files of the project
+func (c *DockerComposeCliClient) composeStatus(ctx context.Context, project composeProject, projectName string) (*ComposeStatus, error) {
+	c.log.Debugw("Getting compose status", "project", projectName, "composeFiles", project.Files)
 
-	cmd.Dir = filepath.Dir(absComposeFile) // Set working directory
+	args := append(append([]string{"compose"}, project.fileArgs()...), "-p", projectName, "ps", "--format", "json", "--all")
+	cmd := exec.CommandContext(ctx, c.dockerBinary, args...)
+	cmd.Dir = project.Dir
 	cmd.Env = prepareDockerEnv(c.params, nil)
 
 	// Capture both stdout and stderr
@@ -314,7 +512,7 @@ func (c *DockerComposeCliClient) GetComposeStatus(ctx context.Context, composeFi
 		return nil, fmt.Errorf("failed to get compose status: %w, output: %s", err, string(output))
 	}
 
-	fmt.Printf("[DEBUG] Raw docker compose ps output: %s\n", string(output))
+	c.log.Debugw("Compose ps output", "project", projectName, "output", string(output))
 
 	// Handle empty output (no containers)
 	if len(strings.TrimSpace(string(output))) == 0 {
@@ -343,7 +541,7 @@ func (c *DockerComposeCliClient) GetComposeStatus(ctx context.Context, composeFi
 
 			var container ComposeContainer
 			if err := json.Unmarshal([]byte(line), &container); err != nil {
-				fmt.Printf("[DEBUG] Failed to parse line as JSON: %s, error: %v\n", line, err)
+				c.log.Debugw("Skipping a compose ps line that is not json", "project", projectName, "line", line, "error", err)
 				continue
 			}
 			containers = append(containers, container)
@@ -394,6 +592,8 @@ func (c *DockerComposeCliClient) GetComposeStatus(ctx context.Context, composeFi
 			Ports:       ports,
 			ContainerID: container.ID,
 			Health:      container.Health,
+			State:       strings.ToLower(container.State),
+			ExitCode:    container.ExitCode,
 		})
 	}
 
@@ -414,19 +614,89 @@ func (c *DockerComposeCliClient) GetComposeStatus(ctx context.Context, composeFi
 	}, nil
 }
 
-func (c *DockerComposeCliClient) RestartCompose(ctx context.Context, projectName string) error {
-    composeFile := c.generateAbsProjectFilepath(projectName)
+// inspectedContainer is the part of the docker inspect output read by GetComposeContainerDetails
+type inspectedContainer struct {
+	ID           string `json:"Id"`
+	Name         string `json:"Name"`
+	RestartCount int    `json:"RestartCount"`
+	State        struct {
+		Status   string `json:"Status"`
+		ExitCode int    `json:"ExitCode"`
+		Health   *struct {
+			Status string `json:"Status"`
+		} `json:"Health"`
+	} `json:"State"`
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
 
-    cmd := exec.CommandContext(ctx, c.dockerBinary, "compose",
-        "-f", filepath.Base(composeFile), // Use only filename
-        "-p", projectName,
-        "restart")
+// GetComposeContainerDetails inspects the containers of the compose project, including stopped
+// ones. Unlike compose ps it reports how often docker restarted each container.
+func (c *DockerComposeCliClient) GetComposeContainerDetails(ctx context.Context, projectName string) ([]ContainerDetails, error) {
+	if strings.TrimSpace(projectName) == "" {
+		return nil, fmt.Errorf("project name cannot be empty")
+	}
+
+	listCmd := exec.CommandContext(ctx, c.dockerBinary, "ps", "-a", "-q",
+		"--filter", "label=com.docker.compose.project="+projectName)
+	listCmd.Env = prepareDockerEnv(c.params, nil)
+
+	output, err := listCmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the containers of the compose project: %w", err)
+	}
+
+	containerIDs := strings.Fields(string(output))
+	if len(containerIDs) == 0 {
+		return []ContainerDetails{}, nil
+	}
+
+	inspectCmd := exec.CommandContext(ctx, c.dockerBinary, append([]string{"inspect"}, containerIDs...)...)
+	inspectCmd.Env = prepareDockerEnv(c.params, nil)
+
+	output, err = inspectCmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect the containers of the compose project: %w", err)
+	}
 
-    cmd.Dir = filepath.Dir(composeFile) // Set working directory
+	var inspected []inspectedContainer
+	if err := json.Unmarshal(output, &inspected); err != nil {
+		return nil, fmt.Errorf("failed to parse the docker inspect output: %w", err)
+	}
+
+	details := make([]ContainerDetails, 0, len(inspected))
+	for _, container := range inspected {
+		health := ""
+		if container.State.Health != nil {
+			health = container.State.Health.Status
+		}
+		details = append(details, ContainerDetails{
+			ID:           container.ID,
+			Name:         strings.TrimPrefix(container.Name, "/"),
+			Service:      container.Config.Labels["com.docker.compose.service"],
+			State:        strings.ToLower(container.State.Status),
+			Health:       health,
+			RestartCount: container.RestartCount,
+			ExitCode:     container.State.ExitCode,
+		})
+	}
+	return details, nil
+}
+
+func (c *DockerComposeCliClient) RestartCompose(ctx context.Context, projectName string) error {
+    project, err := c.projectFor(projectName, "")
+    if err != nil {
+        return err
+    }
+
+    args := append(append([]string{"compose"}, project.fileArgs()...), "-p", projectName, "restart")
+    cmd := exec.CommandContext(ctx, c.dockerBinary, args...)
+    cmd.Dir = project.Dir
     cmd.Env = prepareDockerEnv(c.params, nil)
 
     output, err := cmd.CombinedOutput()
-    fmt.Printf("Restart command output: %s\n", string(output))
+    c.log.Debugw("Compose restart output", "project", projectName, "output", string(output))
 
     if err != nil {
         return fmt.Errorf("failed to restart compose project: %s", string(output))
@@ -435,6 +705,69 @@ func (c *DockerComposeCliClient) RestartCompose(ctx context.Context, projectName
     return nil
 }
 
+// ScaleService runs replicas containers of a service of a deployed compose project, the running
+// containers are kept. A service scaled to 0 has its containers removed.
+func (c *DockerComposeCliClient) ScaleService(ctx context.Context, projectName, serviceName string, replicas int) error {
+	if strings.TrimSpace(projectName) == "" {
+		return fmt.Errorf("project name cannot be empty")
+	}
+	if strings.TrimSpace(serviceName) == "" {
+		return fmt.Errorf("service name cannot be empty")
+	}
+	if replicas < 0 {
+		return fmt.Errorf("replicas of service %s cannot be negative: %d", serviceName, replicas)
+	}
+
+	project, found := c.lookupProject(projectName)
+	if !found {
+		return fmt.Errorf("compose project %s is not deployed", projectName)
+	}
+
+	exists, err := c.serviceExists(ctx, project, projectName, serviceName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("service %s not found in compose project %s", serviceName, projectName)
+	}
+
+	c.log.Infow("Scaling compose service", "project", projectName, "service", serviceName, "replicas", replicas)
+	onEvent := func(event ComposeEvent) {
+		c.log.Debugw("Compose scale progress", "project", projectName, "id", event.ID, "status", event.Status, "text", event.Text)
+	}
+	if err := c.runComposeWithProgress(ctx, project.Dir, nil, onEvent,
+		append(project.fileArgs(), "-p", projectName, "up", "-d",
+			"--scale", fmt.Sprintf("%s=%d", serviceName, replicas), "--no-recreate")...); err != nil {
+		return fmt.Errorf("failed to scale service %s of compose project %s: %w", serviceName, projectName, err)
+	}
+	return nil
+}
+
+// serviceExists tells whether the project has containers of the service, or, for a service
+// scaled to 0, whether its compose file declares it
+func (c *DockerComposeCliClient) serviceExists(ctx context.Context, project composeProject, projectName, serviceName string) (bool, error) {
+	status, err := c.composeStatus(ctx, project, projectName)
+	if err != nil {
+		return false, fmt.Errorf("failed to get the status of compose project %s: %w", projectName, err)
+	}
+	for _, service := range status.Services {
+		if service.Name == serviceName {
+			return true, nil
+		}
+	}
+
+	services, err := c.composeServices(ctx, project, projectName, nil)
+	if err != nil {
+		return false, err
+	}
+	for _, service := range services {
+		if service == serviceName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (c *DockerComposeCliClient) verifyContainersRemoved(ctx context.Context, projectName string) error {
     // Check if any containers with this project name still exist
     listCmd := exec.CommandContext(ctx, c.dockerBinary, "ps", "-a",
@@ -458,7 +791,30 @@ func (c *DockerComposeCliClient) verifyContainersRemoved(ctx context.Context, pr
 
 
 func (c *DockerComposeCliClient) UpdateCompose(ctx context.Context, projectName string, composeFile string, envVars map[string]string) error {
-	return c.DeployCompose(ctx, projectName, composeFile, envVars)
+	return c.DeployCompose(ctx, projectName, []string{composeFile}, envVars)
+}
+
+// Ping checks that the docker daemon answers
+func (c *DockerComposeCliClient) Ping(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, c.dockerBinary, "version")
+	cmd.Env = prepareDockerEnv(c.params, nil)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("docker daemon not reachable: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// ComposeVersion returns the version of the docker compose v2 plugin, e.g. 2.39.2, an error when
+// only the legacy docker-compose or no compose at all is installed
+func (c *DockerComposeCliClient) ComposeVersion(ctx context.Context) (string, error) {
+	lines, err := c.runDocker(ctx, "compose", "version", "--short")
+	if err != nil {
+		return "", fmt.Errorf("docker compose v2 not available: %w", err)
+	}
+	if len(lines) == 0 {
+		return "", fmt.Errorf("docker compose v2 did not report its version")
+	}
+	return strings.TrimPrefix(lines[0], "v"), nil
 }
 
 func (c *DockerComposeCliClient) ComposeExists(ctx context.Context, composeFile string, projectName string) (bool, error) {
@@ -502,6 +858,39 @@ func prepareDockerEnv(params DockerConnectivityParams, envVars map[string]string
 	return env
 }
 
+// minRedactedLength is the length from which the values of the compose variables are masked in
+// the logs, masking shorter ones would garble unrelated output
+const minRedactedLength = 4
+
+// redactEnvValues masks the values of the compose variables in text, they may be secrets
+func redactEnvValues(text string, envVars map[string]string) string {
+	values := make([]string, 0, len(envVars))
+	for _, value := range envVars {
+		if len(value) >= minRedactedLength {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return text
+	}
+	// the longest values first, a value containing another one is masked whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, "***")
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// ProjectComposeFilePath returns the main compose file a project was deployed with, or where a
+// downloaded compose file of the project is kept when it is not deployed
+func (c *DockerComposeCliClient) ProjectComposeFilePath(projectName string) string {
+	if project, found := c.lookupProject(projectName); found {
+		return project.Files[0]
+	}
+	return c.generateAbsProjectFilepath(projectName)
+}
+
 func (c *DockerComposeCliClient) generateAbsProjectFilepath(projectName string) string {
 	filename := "docker-compose.yaml"
 
@@ -517,7 +906,7 @@ func (c *DockerComposeCliClient) fetchComposeFileFromURL(ctx context.Context, ur
 		OverwriteExist: true,
 		ResumeDownload: false,
 		ProgressCallback: func(downloaded, total int64) {
-			fmt.Printf("\nTotal: %d, Downloaded: %d", total, downloaded)
+			c.log.Debugw("Downloading compose file", "project", projectName, "downloaded", downloaded, "total", total)
 		},
 	})
 	if err != nil {
@@ -0,0 +1,250 @@
+package workloads
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/margo/sandbox/shared-lib/file"
+	"go.uber.org/zap"
+)
+
+func TestParseComposeEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		wantOk    bool
+		wantEvent ComposeEvent
+		wantError bool
+	}{
+		{
+			name:   "empty line",
+			line:   "   ",
+			wantOk: false,
+		},
+		{
+			name:      "pulling image",
+			line:      `{"id":"web","text":"Pulling"}`,
+			wantOk:    true,
+			wantEvent: ComposeEvent{ID: "web", Text: "Pulling"},
+		},
+		{
+			name:      "layer progress",
+			line:      `{"id":"a1b2c3","parent_id":"web","text":"Downloading","status":"[==>  ]","current":1024,"total":4096,"percent":25}`,
+			wantOk:    true,
+			wantEvent: ComposeEvent{ID: "a1b2c3", ParentID: "web", Text: "Downloading", Status: "[==>  ]", Current: 1024, Total: 4096, Percent: 25},
+		},
+		{
+			name:      "container started",
+			line:      `{"id":"Container demo-web-1","status":"Started","text":"Started"}`,
+			wantOk:    true,
+			wantEvent: ComposeEvent{ID: "Container demo-web-1", Status: "Started", Text: "Started"},
+		},
+		{
+			name:      "error event",
+			line:      `{"id":"Container demo-web-1","text":"Error","status":"port is already allocated","level":"error"}`,
+			wantOk:    true,
+			wantEvent: ComposeEvent{ID: "Container demo-web-1", Text: "Error", Status: "port is already allocated", Level: "error"},
+			wantError: true,
+		},
+		{
+			name:      "plain text output",
+			line:      "no such service: db",
+			wantOk:    true,
+			wantEvent: ComposeEvent{Text: "no such service: db"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := parseComposeEvent(tt.line)
+			if ok != tt.wantOk {
+				t.Fatalf("parseComposeEvent() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if event != tt.wantEvent {
+				t.Errorf("parseComposeEvent() = %+v, want %+v", event, tt.wantEvent)
+			}
+			if event.IsError() != tt.wantError {
+				t.Errorf("IsError() = %v, want %v", event.IsError(), tt.wantError)
+			}
+		})
+	}
+}
+
+func TestRedactEnvValues(t *testing.T) {
+	envVars := map[string]string{
+		"DB_PASSWORD":        "s3cr3t-pass",
+		"DB_PASSWORD_SUFFIX": "s3cr3t-pass-2",
+		"PORT":               "80",
+	}
+	output := "Container db  Error: auth with s3cr3t-pass-2 failed, retrying with s3cr3t-pass on port 80"
+	want := "Container db  Error: auth with *** failed, retrying with *** on port 80"
+	if got := redactEnvValues(output, envVars); got != want {
+		t.Errorf("redactEnvValues() = %q, want %q", got, want)
+	}
+	if got := redactEnvValues(output, nil); got != output {
+		t.Errorf("redactEnvValues() without variables = %q, want the output unchanged", got)
+	}
+}
+
+func TestFetchComposeFileFromURL_CrashKeepsPreviousFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("services: {next: {image: nginx}}"))
+	}))
+	defer server.Close()
+
+	client := &DockerComposeCliClient{workingDir: t.TempDir(), log: zap.NewNop().Sugar()}
+	composePath := client.generateAbsProjectFilepath("demo")
+	if err := os.MkdirAll(filepath.Dir(composePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(composePath, []byte("services: {good: {image: nginx}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var temps []string
+	restore := file.SetBeforeRenameHook(func(tempPath, finalPath string) error {
+		temps = append(temps, tempPath)
+		return errors.New("simulated crash")
+	})
+	defer restore()
+
+	if _, err := client.fetchComposeFileFromURL(context.Background(), server.URL, "demo"); err == nil {
+		t.Fatal("expected the interrupted download to fail")
+	}
+
+	content, err := os.ReadFile(composePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "services: {good: {image: nginx}}" {
+		t.Errorf("previous compose file was not kept, got %q", content)
+	}
+	if len(temps) != 1 {
+		t.Fatalf("expected one temp file, got %v", temps)
+	}
+	if _, err := os.Stat(temps[0]); !os.IsNotExist(err) {
+		t.Errorf("temp file %s was not cleaned up", temps[0])
+	}
+}
+
+func TestGetComposeContainerDetails(t *testing.T) {
+	client, _, callLog := newStubComposeClient(t, "container-details")
+
+	details, err := client.GetComposeContainerDetails(context.Background(), "demo")
+	if err != nil {
+		t.Fatalf("GetComposeContainerDetails() error = %v", err)
+	}
+	want := []ContainerDetails{
+		{ID: "1a2b3c", Name: "demo-db-1", Service: "db", State: "running", Health: "healthy"},
+		{ID: "4d5e6f", Name: "demo-web-1", Service: "web", State: "restarting", RestartCount: 4, ExitCode: 1},
+	}
+	if !reflect.DeepEqual(details, want) {
+		t.Errorf("GetComposeContainerDetails() = %+v, want %+v", details, want)
+	}
+
+	wantCalls := []string{"ps -a -q --filter label=com.docker.compose.project=demo", "inspect 1a2b3c 4d5e6f"}
+	if calls := stubDockerCalls(t, callLog); !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("docker calls = %v, want %v", calls, wantCalls)
+	}
+}
+
+func TestGetComposeContainerDetails_NoContainers(t *testing.T) {
+	client, _, callLog := newStubComposeClient(t, "success")
+
+	details, err := client.GetComposeContainerDetails(context.Background(), "demo")
+	if err != nil {
+		t.Fatalf("GetComposeContainerDetails() error = %v", err)
+	}
+	if len(details) != 0 {
+		t.Errorf("expected no containers, got %+v", details)
+	}
+	if calls := stubDockerCalls(t, callLog); len(calls) != 1 {
+		t.Errorf("nothing is inspected without containers, got calls %v", calls)
+	}
+}
+
+func TestComposeVersion(t *testing.T) {
+	client, _, _ := newStubComposeClient(t, "success")
+
+	version, err := client.ComposeVersion(context.Background())
+	if err != nil {
+		t.Fatalf("ComposeVersion() error = %v", err)
+	}
+	if version != "2.39.2" {
+		t.Errorf("ComposeVersion() = %q, want 2.39.2", version)
+	}
+
+	client, _, _ = newStubComposeClient(t, "healthy")
+	if _, err := client.ComposeVersion(context.Background()); err == nil {
+		t.Error("ComposeVersion() without a reported version succeeded")
+	}
+}
+
+func TestScaleService(t *testing.T) {
+	client, composeFile, callLog := newStubComposeClient(t, "scale")
+	ctx := context.Background()
+	if err := client.DeployComposeStream(ctx, "demo", composeFile, nil, nil); err != nil {
+		t.Fatalf("DeployComposeStream() error = %v", err)
+	}
+
+	if err := client.ScaleService(ctx, "demo", "web", 3); err != nil {
+		t.Fatalf("ScaleService() error = %v", err)
+	}
+	calls := stubDockerCalls(t, callLog)
+	wantCall := "compose --progress json -f docker-compose.yaml -p demo up -d --scale web=3 --no-recreate"
+	if got := calls[len(calls)-1]; got != wantCall {
+		t.Errorf("last docker call = %q, want %q", got, wantCall)
+	}
+
+	status, err := client.GetComposeStatus(ctx, composeFile, "demo")
+	if err != nil {
+		t.Fatalf("GetComposeStatus() error = %v", err)
+	}
+	running := 0
+	for _, service := range status.Services {
+		if service.Name == "web" && service.Status == "running" {
+			running++
+		}
+	}
+	if running != 3 {
+		t.Errorf("running web containers = %d, want 3", running)
+	}
+}
+
+func TestScaleService_Invalid(t *testing.T) {
+	client, composeFile, _ := newStubComposeClient(t, "scale")
+	ctx := context.Background()
+	if err := client.DeployComposeStream(ctx, "demo", composeFile, nil, nil); err != nil {
+		t.Fatalf("DeployComposeStream() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		project  string
+		service  string
+		replicas int
+		wantErr  string
+	}{
+		{name: "negative replicas", project: "demo", service: "web", replicas: -1, wantErr: "replicas of service web cannot be negative: -1"},
+		{name: "unknown service", project: "demo", service: "cache", replicas: 2, wantErr: "service cache not found in compose project demo"},
+		{name: "project not deployed", project: "other", service: "web", replicas: 2, wantErr: "compose project other is not deployed"},
+		{name: "no service", project: "demo", replicas: 2, wantErr: "service name cannot be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := client.ScaleService(ctx, tt.project, tt.service, tt.replicas)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("ScaleService() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
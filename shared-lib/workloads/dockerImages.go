@@ -0,0 +1,191 @@
+package workloads
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ImageInfo describes an image known to the docker engine
+type ImageInfo struct {
+	ID          string    `json:"id"`
+	RepoTags    []string  `json:"repoTags"`
+	RepoDigests []string  `json:"repoDigests"`
+	Created     time.Time `json:"created"`
+	// Size in bytes, layers shared with other images are counted in full
+	Size int64 `json:"size"`
+}
+
+// References reports whether the image is known under the given reference, either as one of its
+// tags, one of its digests or its id
+func (i ImageInfo) References(reference string) bool {
+	reference = NormalizeImageReference(reference)
+	if reference == "" {
+		return false
+	}
+	if i.ID == reference || strings.TrimPrefix(i.ID, "sha256:") == reference {
+		return true
+	}
+	for _, known := range append(append([]string{}, i.RepoTags...), i.RepoDigests...) {
+		if NormalizeImageReference(known) == reference {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeImageReference brings an image reference into the short form the docker engine uses for
+// tags, "docker.io/library/nginx" and "nginx" both become "nginx:latest"
+func NormalizeImageReference(reference string) string {
+	reference = strings.TrimSpace(reference)
+	if reference == "" || strings.HasPrefix(reference, "sha256:") {
+		return reference
+	}
+	reference = strings.TrimPrefix(reference, "docker.io/")
+	reference = strings.TrimPrefix(reference, "index.docker.io/")
+	reference = strings.TrimPrefix(reference, "library/")
+	if strings.Contains(reference, "@") {
+		return reference
+	}
+	// a ":" after the last "/" separates the tag, one before it belongs to a registry port
+	if !strings.Contains(reference[strings.LastIndex(reference, "/")+1:], ":") {
+		reference += ":latest"
+	}
+	return reference
+}
+
+// ComposeImages lists the images a compose project uses as written in its compose file, with the
+// variables of envVars interpolated like they are when the project is deployed
+func (c *DockerComposeCliClient) ComposeImages(ctx context.Context, composeFile string, projectName string, envVars map[string]string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, c.dockerBinary, "compose",
+		"-f", filepath.Base(composeFile),
+		"-p", projectName,
+		"config", "--images")
+	cmd.Dir = filepath.Dir(composeFile)
+	cmd.Env = prepareDockerEnv(c.params, envVars)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images of compose project %s: %w", projectName, err)
+	}
+	return splitLines(output), nil
+}
+
+// ListImages lists the images known to the docker engine
+func (c *DockerComposeCliClient) ListImages(ctx context.Context) ([]ImageInfo, error) {
+	ids, err := c.runDocker(ctx, "image", "ls", "-q", "--no-trunc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+	ids = uniqueStrings(ids)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	inspectArgs := append([]string{"image", "inspect", "--format", "{{json .}}"}, ids...)
+	lines, err := c.runDocker(ctx, inspectArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect images: %w", err)
+	}
+
+	images := make([]ImageInfo, 0, len(lines))
+	for _, line := range lines {
+		var inspected struct {
+			Id          string
+			RepoTags    []string
+			RepoDigests []string
+			Created     time.Time
+			Size        int64
+		}
+		if err := json.Unmarshal([]byte(line), &inspected); err != nil {
+			return nil, fmt.Errorf("failed to parse image details: %w", err)
+		}
+		images = append(images, ImageInfo{
+			ID:          inspected.Id,
+			RepoTags:    inspected.RepoTags,
+			RepoDigests: inspected.RepoDigests,
+			Created:     inspected.Created,
+			Size:        inspected.Size,
+		})
+	}
+	return images, nil
+}
+
+// ImagesInUse returns the ids of the images used by any container, running or not, whoever
+// created it
+func (c *DockerComposeCliClient) ImagesInUse(ctx context.Context) (map[string]bool, error) {
+	containers, err := c.runDocker(ctx, "ps", "-aq", "--no-trunc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	inUse := make(map[string]bool)
+	if len(containers) == 0 {
+		return inUse, nil
+	}
+
+	inspectArgs := append([]string{"container", "inspect", "--format", "{{.Image}}"}, containers...)
+	imageIds, err := c.runDocker(ctx, inspectArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect containers: %w", err)
+	}
+	for _, id := range imageIds {
+		inUse[id] = true
+	}
+	return inUse, nil
+}
+
+// RemoveImage removes an image reference, the engine refuses to remove images used by containers
+func (c *DockerComposeCliClient) RemoveImage(ctx context.Context, reference string) error {
+	if strings.TrimSpace(reference) == "" {
+		return fmt.Errorf("image reference cannot be empty")
+	}
+	if _, err := c.runDocker(ctx, "image", "rm", reference); err != nil {
+		return fmt.Errorf("failed to remove image %s: %w", reference, err)
+	}
+	return nil
+}
+
+// runDocker runs a docker command and returns the non empty lines of its output
+func (c *DockerComposeCliClient) runDocker(ctx context.Context, args ...string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, c.dockerBinary, args...)
+	cmd.Env = prepareDockerEnv(c.params, nil)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return splitLines(output), nil
+}
+
+func splitLines(output []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := values[:0]
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
@@ -3,10 +3,13 @@ package workloads
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	nethttp "net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"errors"
@@ -15,7 +18,6 @@ import (
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/cli"
-	"helm.sh/helm/v3/pkg/getter"
 	"helm.sh/helm/v3/pkg/registry"
 	"helm.sh/helm/v3/pkg/release"
 	"helm.sh/helm/v3/pkg/repo"
@@ -23,14 +25,82 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"oras.land/oras-go/v2/registry/remote/auth"
 )
 
+// Timeouts of the Helm actions when the caller passes none
+const (
+	DefaultHelmInstallTimeout   = 10 * time.Minute
+	DefaultHelmUninstallTimeout = 5 * time.Minute
+)
+
+// ParseHelmTimeout parses a component timeout such as "15m" or "1h30m", an empty value returns the
+// fallback. Invalid or negative durations are a HelmError of type ErrorTypeInvalidInput.
+func ParseHelmTimeout(value string, fallback time.Duration) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return fallback, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, &HelmError{
+			Type:    ErrorTypeInvalidInput,
+			Message: fmt.Sprintf("invalid timeout %q, expected a duration such as 15m", value),
+			Err:     err,
+		}
+	}
+	if timeout <= 0 {
+		return 0, &HelmError{
+			Type:    ErrorTypeInvalidInput,
+			Message: fmt.Sprintf("invalid timeout %q, it must be positive", value),
+		}
+	}
+	return timeout, nil
+}
+
+// orDefault returns the timeout, or the fallback when it is not set
+func orDefault(timeout, fallback time.Duration) time.Duration {
+	if timeout <= 0 {
+		return fallback
+	}
+	return timeout
+}
+
 // HelmClient represents a Helm client with common settings
 type HelmClient struct {
 	settings       *cli.EnvSettings
 	config         *action.Configuration
 	registryClient *registry.Client
 	kubeClient     kubernetes.Interface
+	// configs are the action configurations of the namespaces other than the settings' one
+	configsMu sync.Mutex
+	configs   map[string]*action.Configuration
+	// ociPlainHTTP overrides whether OCI charts are pulled over plain http, nil guesses it from the port
+	ociPlainHTTP *bool
+	// ociInsecureSkipTLSVerify accepts any certificate of OCI registries
+	ociInsecureSkipTLSVerify bool
+}
+
+// HelmClientOption configures a HelmClient
+type HelmClientOption func(*HelmClient)
+
+// WithOCIPlainHTTP pulls OCI charts over plain http when true and over https when false, whatever
+// the port of the registry. Without it plain http is used for registries on port 80, 8080 and 8081.
+// Over plain http the registry credentials travel unencrypted and the charts can be tampered with on
+// the way, only use it for registries on a trusted network, e.g. a lab registry on port 5000.
+func WithOCIPlainHTTP(plainHTTP bool) HelmClientOption {
+	return func(c *HelmClient) {
+		c.ociPlainHTTP = &plainHTTP
+	}
+}
+
+// WithOCIInsecureSkipTLSVerify accepts any certificate of OCI registries, e.g. a self-signed one.
+// The connection is encrypted but anyone on the way can pose as the registry and serve other charts,
+// only use it for registries on a trusted network.
+func WithOCIInsecureSkipTLSVerify(skip bool) HelmClientOption {
+	return func(c *HelmClient) {
+		c.ociInsecureSkipTLSVerify = skip
+	}
 }
 
 // HelmError represents typed Helm errors
@@ -56,10 +126,12 @@ const (
 	ErrorTypeRegistry     = "Registry"
 	ErrorTypeChart        = "Chart"
 	ErrorTypeRelease      = "Release"
+	// ErrorTypeNamespaceTerminating is a release targeting a namespace that is being deleted
+	ErrorTypeNamespaceTerminating = "NamespaceTerminating"
 )
 
 // NewHelmClient creates a new Helm client
-func NewHelmClient(kubeconfigPath string) (*HelmClient, error) {
+func NewHelmClient(kubeconfigPath string, opts ...HelmClientOption) (*HelmClient, error) {
 
 	settings := cli.New()
 	if kubeconfigPath != "" {
@@ -85,17 +157,21 @@ func NewHelmClient(kubeconfigPath string) (*HelmClient, error) {
 		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
 	}
 
-	return &HelmClient{
+	client := &HelmClient{
 		settings:       settings,
 		config:         config,
 		registryClient: registryClient,
 		kubeClient:     kubeClient,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client, nil
 }
 
 // createKubeClient creates a Kubernetes client
 func createKubeClient(kubeconfigPath string) (kubernetes.Interface, error) {
-   
+
 	var config *rest.Config
 	var err error
 
@@ -220,13 +296,9 @@ func (c *HelmClient) AddRepository(name, url string, auth HelmRepoAuth) error {
 		repoEntry.PassCredentialsAll = auth.CertAuth.PassCredentialsAll
 	}
 
-	repository, err := repo.NewChartRepository(&repoEntry, getter.All(c.settings))
+	repository, err := c.chartRepository(&repoEntry)
 	if err != nil {
-		return &HelmError{
-			Type:    ErrorTypeRegistry,
-			Message: "failed to create chart repository",
-			Err:     err,
-		}
+		return err
 	}
 
 	if _, err := repository.DownloadIndexFile(); err != nil {
@@ -258,8 +330,18 @@ func (c *HelmClient) AddRepository(name, url string, auth HelmRepoAuth) error {
 	return nil
 }
 
-// InstallChart installs a Helm chart with enhanced error handling
-func (c *HelmClient) InstallChart(ctx context.Context, releaseName, chart, namespace, revision string, wait bool, values map[string]interface{}) error {
+// InstallChart installs a Helm chart with enhanced error handling, a timeout of 0 waits
+// DefaultHelmInstallTimeout. An atomic install waits for the release and uninstalls it when it
+// fails, so no partially installed resources are left behind. With createNamespace a missing
+// namespace is created with the ManagedNamespaceLabels. The chart is an oci:// reference, a local
+// chart, a chart URL or a "repo/chart" reference to a repository added with AddRepository, whose
+// index is refreshed before the revision is looked up. A "latest" revision installs the newest one.
+func (c *HelmClient) InstallChart(ctx context.Context, releaseName, chart, namespace, revision string, wait, atomic, createNamespace bool, timeout time.Duration, values map[string]interface{}) error {
+	return c.installChart(ctx, releaseName, chart, namespace, revision, wait, atomic, createNamespace, timeout, values, nil)
+}
+
+// installChart installs the chart, an oci:// chart is pulled with the registry credentials
+func (c *HelmClient) installChart(ctx context.Context, releaseName, chart, namespace, revision string, wait, atomic, createNamespace bool, timeout time.Duration, values map[string]interface{}, auths []HelmRegistryAuth) error {
 	if err := validateInput(releaseName, chart); err != nil {
 		return err
 	}
@@ -267,27 +349,34 @@ func (c *HelmClient) InstallChart(ctx context.Context, releaseName, chart, names
 	if namespace == "" {
 		namespace = "default"
 	}
+	if createNamespace {
+		if err := c.EnsureNamespace(ctx, namespace, ManagedNamespaceLabels); err != nil {
+			return err
+		}
+	}
 
-	install := action.NewInstall(c.config)
+	config, err := c.actionConfig(namespace)
+	if err != nil {
+		return err
+	}
+
+	install := action.NewInstall(config)
 	install.ReleaseName = releaseName
 	install.Namespace = namespace
 	install.Version = revision
 	install.Wait = wait
-	install.Timeout = 10 * time.Minute
+	install.Atomic = atomic
+	install.Timeout = orDefault(timeout, DefaultHelmInstallTimeout)
 
 	// Check if it's an OCI reference
 	if strings.HasPrefix(chart, "oci://") {
-		return c.installChartFromOCI(ctx, install, chart, revision, values)
+		return c.installChartFromOCI(ctx, install, chart, revision, values, auths)
 	}
 
 	// Traditional chart installation
-	chartPath, err := install.ChartPathOptions.LocateChart(chart, c.settings)
+	chartPath, err := c.locateChart(&install.ChartPathOptions, chart)
 	if err != nil {
-		return &HelmError{
-			Type:    ErrorTypeChart,
-			Message: "failed to locate chart",
-			Err:     err,
-		}
+		return err
 	}
 
 	chartReq, err := loader.Load(chartPath)
@@ -313,25 +402,15 @@ func (c *HelmClient) InstallChart(ctx context.Context, releaseName, chart, names
 }
 
 // installChartFromOCI installs a chart from OCI registry
-func (c *HelmClient) installChartFromOCI(ctx context.Context, install *action.Install, chartRef, version string, values map[string]interface{}) error {
+func (c *HelmClient) installChartFromOCI(ctx context.Context, install *action.Install, chartRef, version string, values map[string]interface{}, auths []HelmRegistryAuth) error {
 	// Pull chart from OCI registry
-	// extract port from
-	port, err := http.ExtractPortFromURI(chartRef)
+	registryClient, err := c.ociRegistryClient(chartRef, auths)
 	if err != nil {
-		return &HelmError{
-			Type:    ErrorTypeRegistry,
-			Message: "invalid uri of the oci registry",
-			Err:     err,
-		}
-	}
-
-	// assuming that 80 port will be for plain http connections
-	if port == 80 || port == 8080 || port == 8081 {
-		registry.ClientOptPlainHTTP()(c.registryClient)
+		return err
 	}
 
 	chartRef = fmt.Sprintf("%s:%s", chartRef, version) // "ghcr.io/nginxinc/charts/nginx-ingress:0.0.0-edge"
-	result, err := c.registryClient.Pull(chartRef, registry.PullOptWithChart(true))
+	result, err := registryClient.Pull(chartRef, registry.PullOptWithChart(true))
 	if err != nil {
 		fmt.Println("installChartFromOCI", "err", err.Error())
 		return &HelmError{
@@ -374,19 +453,20 @@ func (c *HelmClient) InstallChartWithDryRun(ctx context.Context, releaseName, ch
 		namespace = "default"
 	}
 
-	install := action.NewInstall(c.config)
+	config, err := c.actionConfig(namespace)
+	if err != nil {
+		return "", err
+	}
+
+	install := action.NewInstall(config)
 	install.ReleaseName = releaseName
 	install.Namespace = namespace
 	install.Version = revision
 	install.DryRun = true
 
-	chartPath, err := install.ChartPathOptions.LocateChart(chart, c.settings)
+	chartPath, err := c.locateChart(&install.ChartPathOptions, chart)
 	if err != nil {
-		return "", &HelmError{
-			Type:    ErrorTypeChart,
-			Message: "failed to locate chart",
-			Err:     err,
-		}
+		return "", err
 	}
 
 	chartReq, err := loader.Load(chartPath)
@@ -410,8 +490,9 @@ func (c *HelmClient) InstallChartWithDryRun(ctx context.Context, releaseName, ch
 	return release.Manifest, nil
 }
 
-// UninstallChart uninstalls a Helm release with enhanced error handling
-func (c *HelmClient) UninstallChart(ctx context.Context, name, namespace string) error {
+// UninstallChart uninstalls a Helm release with enhanced error handling, a timeout of 0 waits
+// DefaultHelmUninstallTimeout
+func (c *HelmClient) UninstallChart(ctx context.Context, name, namespace string, timeout time.Duration) error {
 	if strings.TrimSpace(name) == "" {
 		return &HelmError{
 			Type:    ErrorTypeInvalidInput,
@@ -419,10 +500,15 @@ func (c *HelmClient) UninstallChart(ctx context.Context, name, namespace string)
 		}
 	}
 
-	uninstall := action.NewUninstall(c.config)
-	uninstall.Timeout = 5 * time.Minute
+	config, err := c.actionConfig(namespace)
+	if err != nil {
+		return err
+	}
+
+	uninstall := action.NewUninstall(config)
+	uninstall.Timeout = orDefault(timeout, DefaultHelmUninstallTimeout)
 
-	_, err := uninstall.Run(name)
+	_, err = uninstall.Run(name)
 	if err != nil {
 		return &HelmError{
 			Type:    ErrorTypeRelease,
@@ -435,8 +521,16 @@ func (c *HelmClient) UninstallChart(ctx context.Context, name, namespace string)
 	return nil
 }
 
-// UpdateChart upgrades a Helm release with enhanced error handling
-func (c *HelmClient) UpdateChart(ctx context.Context, name, chart, namespace string, values map[string]interface{}) error {
+// UpdateChart upgrades a Helm release with enhanced error handling, a timeout of 0 waits
+// DefaultHelmInstallTimeout. With wait the upgrade only succeeds once the resources of the release
+// are ready, like InstallChart. An atomic upgrade rolls the release back when it fails and deletes the
+// resources it created. createNamespace creates a missing namespace like InstallChart does.
+func (c *HelmClient) UpdateChart(ctx context.Context, name, chart, namespace string, wait, atomic, createNamespace bool, timeout time.Duration, values map[string]interface{}) error {
+	return c.updateChart(ctx, name, chart, namespace, wait, atomic, createNamespace, timeout, values, nil)
+}
+
+// updateChart upgrades the release, an oci:// chart is pulled with the registry credentials
+func (c *HelmClient) updateChart(ctx context.Context, name, chart, namespace string, wait, atomic, createNamespace bool, timeout time.Duration, values map[string]interface{}, auths []HelmRegistryAuth) error {
 	if err := validateInput(name, chart); err != nil {
 		return err
 	}
@@ -444,24 +538,33 @@ func (c *HelmClient) UpdateChart(ctx context.Context, name, chart, namespace str
 	if namespace == "" {
 		namespace = "default"
 	}
+	if createNamespace {
+		if err := c.EnsureNamespace(ctx, namespace, ManagedNamespaceLabels); err != nil {
+			return err
+		}
+	}
 
-	upgrade := action.NewUpgrade(c.config)
+	config, err := c.actionConfig(namespace)
+	if err != nil {
+		return err
+	}
+
+	upgrade := action.NewUpgrade(config)
 	upgrade.Namespace = namespace
-	upgrade.Timeout = 10 * time.Minute
+	upgrade.Wait = wait
+	upgrade.Atomic = atomic
+	upgrade.CleanupOnFail = atomic
+	upgrade.Timeout = orDefault(timeout, DefaultHelmInstallTimeout)
 
 	// Check if it's an OCI reference
 	if strings.HasPrefix(chart, "oci://") {
-		return c.updateChartFromOCI(ctx, upgrade, name, chart, values)
+		return c.updateChartFromOCI(ctx, config, upgrade, name, chart, values, auths)
 	}
 
 	// Traditional chart upgrade
-	chartPath, err := upgrade.ChartPathOptions.LocateChart(chart, c.settings)
+	chartPath, err := c.locateChart(&upgrade.ChartPathOptions, chart)
 	if err != nil {
-		return &HelmError{
-			Type:    ErrorTypeChart,
-			Message: "failed to locate chart",
-			Err:     err,
-		}
+		return err
 	}
 
 	chartReq, err := loader.Load(chartPath)
@@ -486,10 +589,67 @@ func (c *HelmClient) UpdateChart(ctx context.Context, name, chart, namespace str
 	return nil
 }
 
+// usePlainHTTP tells whether the chart is pulled over plain http. Unless WithOCIPlainHTTP says so,
+// registries on port 80, 8080 and 8081 are assumed to serve plain http.
+func (c *HelmClient) usePlainHTTP(chartRef string) (bool, error) {
+	port, err := http.ExtractPortFromURI(chartRef)
+	if err != nil {
+		return false, &HelmError{
+			Type:    ErrorTypeRegistry,
+			Message: "invalid uri of the oci registry",
+			Err:     err,
+		}
+	}
+	if c.ociPlainHTTP != nil {
+		return *c.ociPlainHTTP, nil
+	}
+	return port == 80 || port == 8080 || port == 8081, nil
+}
+
+// ociRegistryClient returns the registry client to pull the chart with. Pulls over plain http,
+// without verifying the certificate or with registry credentials get a client of their own, the
+// shared one stays secure and keeps its logins. The credentials are only held by the returned client.
+func (c *HelmClient) ociRegistryClient(chartRef string, auths []HelmRegistryAuth) (*registry.Client, error) {
+	plainHTTP, err := c.usePlainHTTP(chartRef)
+	if err != nil {
+		return nil, err
+	}
+	if !plainHTTP && !c.ociInsecureSkipTLSVerify && len(auths) == 0 {
+		return c.registryClient, nil
+	}
+
+	var opts []registry.ClientOption
+	if plainHTTP {
+		opts = append(opts, registry.ClientOptPlainHTTP())
+	}
+	transport := nethttp.DefaultTransport.(*nethttp.Transport).Clone()
+	if c.ociInsecureSkipTLSVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	httpClient := &nethttp.Client{Transport: transport}
+	opts = append(opts, registry.ClientOptHTTPClient(httpClient))
+	if len(auths) > 0 {
+		opts = append(opts, registry.ClientOptAuthorizer(auth.Client{
+			Client:     httpClient,
+			Credential: registryCredential(auths),
+			Cache:      auth.NewCache(),
+		}))
+	}
+	registryClient, err := registry.NewClient(opts...)
+	if err != nil {
+		return nil, &HelmError{
+			Type:    ErrorTypeRegistry,
+			Message: "failed to create registry client",
+			Err:     err,
+		}
+	}
+	return registryClient, nil
+}
+
 // updateChartFromOCI upgrades a chart from OCI registry
-func (c *HelmClient) updateChartFromOCI(ctx context.Context, upgrade *action.Upgrade, releaseName, chartRef string, values map[string]interface{}) error {
+func (c *HelmClient) updateChartFromOCI(ctx context.Context, config *action.Configuration, upgrade *action.Upgrade, releaseName, chartRef string, values map[string]interface{}, auths []HelmRegistryAuth) error {
 	// Get the current release to determine the version if not specified
-	status := action.NewStatus(c.config)
+	status := action.NewStatus(config)
 	currentRelease, err := status.Run(releaseName)
 	if err != nil {
 		return &HelmError{
@@ -508,10 +668,14 @@ func (c *HelmClient) updateChartFromOCI(ctx context.Context, upgrade *action.Upg
 	} else {
 		version = "latest"
 	}
+	registryClient, err := c.ociRegistryClient(chartRef, auths)
+	if err != nil {
+		return err
+	}
 	chartRef = fmt.Sprintf("%s:%s", chartRef, version)
 
 	// Pull chart from OCI registry
-	result, err := c.registryClient.Pull(chartRef, registry.PullOptWithChart(true))
+	result, err := registryClient.Pull(chartRef, registry.PullOptWithChart(true))
 	if err != nil {
 		fmt.Println("failed to pull chart", err.Error(), "chartref", chartRef, "releaseName", releaseName, "values", values)
 		return &HelmError{
@@ -556,6 +720,13 @@ type ReleaseStatus struct {
 	Description string                 `json:"description"`
 	Notes       string                 `json:"notes"`
 	Values      map[string]interface{} `json:"values"`
+	// Tests is the outcome of the test hooks, only set by RunReleaseTests
+	Tests []ReleaseTestResult `json:"tests,omitempty"`
+	// LastDeployed is when the current revision was deployed
+	LastDeployed time.Time `json:"last_deployed"`
+	// ChartName and ChartVersion are the chart Chart names as <name>-<version>
+	ChartName    string `json:"chart_name,omitempty"`
+	ChartVersion string `json:"chart_version,omitempty"`
 }
 
 // GetReleaseStatus retrieves the status of a Helm release
@@ -567,7 +738,12 @@ func (c *HelmClient) GetReleaseStatus(ctx context.Context, releaseName, namespac
 		}
 	}
 
-	status := action.NewStatus(c.config)
+	config, err := c.actionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	status := action.NewStatus(config)
 	release, err := status.Run(releaseName)
 	if err != nil {
 		if errors.Is(err, driver.ErrReleaseNotFound) {
@@ -592,17 +768,20 @@ func (c *HelmClient) GetReleaseStatus(ctx context.Context, releaseName, namespac
 	}
 
 	releaseStatus := &ReleaseStatus{
-		Name:        release.Name,
-		Namespace:   release.Namespace,
-		Status:      release.Info.Status,
-		Revision:    release.Version,
-		Description: release.Info.Description,
-		Notes:       release.Info.Notes,
-		Updated:     release.Info.LastDeployed.Format("2006-01-02 15:04:05"),
+		Name:         release.Name,
+		Namespace:    release.Namespace,
+		Status:       release.Info.Status,
+		Revision:     release.Version,
+		Description:  release.Info.Description,
+		Notes:        release.Info.Notes,
+		Updated:      release.Info.LastDeployed.Format("2006-01-02 15:04:05"),
+		LastDeployed: release.Info.LastDeployed.Time,
 	}
 
 	if release.Chart != nil && release.Chart.Metadata != nil {
 		releaseStatus.Chart = fmt.Sprintf("%s-%s", release.Chart.Metadata.Name, release.Chart.Metadata.Version)
+		releaseStatus.ChartName = release.Chart.Metadata.Name
+		releaseStatus.ChartVersion = release.Chart.Metadata.Version
 		releaseStatus.AppVersion = release.Chart.Metadata.AppVersion
 	}
 
@@ -617,7 +796,12 @@ func (c *HelmClient) GetReleaseStatus(ctx context.Context, releaseName, namespac
 
 // ListReleases lists all Helm releases with filtering options
 func (c *HelmClient) ListReleases(ctx context.Context, namespace string) ([]*ReleaseStatus, error) {
-	list := action.NewList(c.config)
+	config, err := c.actionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	list := action.NewList(config)
 
 	if namespace != "" {
 		list.AllNamespaces = false
@@ -658,7 +842,12 @@ func (c *HelmClient) ListReleases(ctx context.Context, namespace string) ([]*Rel
 
 // GetReleaseHistory gets the revision history for a release
 func (c *HelmClient) GetReleaseHistory(ctx context.Context, releaseName, namespace string) ([]*ReleaseStatus, error) {
-	history := action.NewHistory(c.config)
+	config, err := c.actionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	history := action.NewHistory(config)
 
 	releases, err := history.Run(releaseName)
 	if err != nil {
@@ -688,12 +877,132 @@ func (c *HelmClient) GetReleaseHistory(ctx context.Context, releaseName, namespa
 	return releaseHistory, nil
 }
 
+// GetReleaseValues returns the values the release was deployed with, the user-supplied ones or,
+// with allValues, those merged with the defaults of the chart. A missing release is a HelmError of
+// type ErrorTypeNotFound.
+func (c *HelmClient) GetReleaseValues(ctx context.Context, releaseName, namespace string, allValues bool) (map[string]interface{}, error) {
+	if strings.TrimSpace(releaseName) == "" {
+		return nil, &HelmError{
+			Type:    ErrorTypeInvalidInput,
+			Message: "release name cannot be empty",
+		}
+	}
+
+	config, err := c.actionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	getValues := action.NewGetValues(config)
+	getValues.AllValues = allValues
+	values, err := getValues.Run(releaseName)
+	if err != nil {
+		errorType := ErrorTypeOther
+		if errors.Is(err, driver.ErrReleaseNotFound) {
+			errorType = ErrorTypeNotFound
+		}
+		return nil, &HelmError{
+			Type:    errorType,
+			Message: fmt.Sprintf("failed to get values of release %s", releaseName),
+			Err:     err,
+		}
+	}
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	return values, nil
+}
+
+// GetLastSuccessfulRevision returns the latest revision of the release that was deployed
+// successfully, 0 when there is none, e.g. after a failed first install
+func (c *HelmClient) GetLastSuccessfulRevision(ctx context.Context, releaseName, namespace string) (int, error) {
+	history, err := c.GetReleaseHistory(ctx, releaseName, namespace)
+	if err != nil {
+		if errors.Is(err, driver.ErrReleaseNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	revision := 0
+	for _, status := range history {
+		// superseded revisions were deployed before a later one replaced them
+		if status.Status != release.StatusDeployed && status.Status != release.StatusSuperseded {
+			continue
+		}
+		if status.Revision > revision {
+			revision = status.Revision
+		}
+	}
+	return revision, nil
+}
+
+// RollbackRelease rolls the release back to the given revision, the resources created by a failed
+// rollback are deleted again
+func (c *HelmClient) RollbackRelease(ctx context.Context, releaseName string, revision int, namespace string) error {
+	if strings.TrimSpace(releaseName) == "" {
+		return &HelmError{
+			Type:    ErrorTypeInvalidInput,
+			Message: "release name cannot be empty",
+		}
+	}
+	if revision <= 0 {
+		return &HelmError{
+			Type:    ErrorTypeInvalidInput,
+			Message: fmt.Sprintf("invalid revision %d to roll back release %s to", revision, releaseName),
+		}
+	}
+
+	config, err := c.actionConfig(namespace)
+	if err != nil {
+		return err
+	}
+
+	rollback := action.NewRollback(config)
+	rollback.Version = revision
+	rollback.CleanupOnFail = true
+	rollback.Timeout = DefaultHelmInstallTimeout
+
+	if err := rollback.Run(releaseName); err != nil {
+		return &HelmError{
+			Type:    ErrorTypeRelease,
+			Message: fmt.Sprintf("failed to roll back release %s to revision %d", releaseName, revision),
+			Err:     err,
+		}
+	}
+
+	log.Printf("Successfully rolled back release %s to revision %d", releaseName, revision)
+	return nil
+}
+
+// Ping checks that the kubernetes api server answers
+func (c *HelmClient) Ping(ctx context.Context) error {
+	restClient := c.kubeClient.Discovery().RESTClient()
+	if restClient == nil {
+		_, err := c.kubeClient.Discovery().ServerVersion()
+		return err
+	}
+	if err := restClient.Get().AbsPath("/version").Do(ctx).Error(); err != nil {
+		return fmt.Errorf("kubernetes api server not reachable: %w", err)
+	}
+	return nil
+}
+
+// KubernetesVersion returns the version of the kubernetes api server, e.g. v1.33.2
+func (c *HelmClient) KubernetesVersion(ctx context.Context) (string, error) {
+	version, err := c.kubeClient.Discovery().ServerVersion()
+	if err != nil {
+		return "", fmt.Errorf("kubernetes api server not reachable: %w", err)
+	}
+	return version.GitVersion, nil
+}
+
 // ReleaseExists checks if a release exists
 func (c *HelmClient) ReleaseExists(ctx context.Context, releaseName, namespace string) (bool, error) {
 	_, err := c.GetReleaseStatus(ctx, releaseName, namespace)
 	if err != nil {
-		// If the error is "not found", return false without error
-		if fmt.Sprintf("%v", err) == fmt.Sprintf("failed to get status for release %s: release: not found", releaseName) {
+		var helmErr *HelmError
+		if errors.As(err, &helmErr) && helmErr.Type == ErrorTypeNotFound {
 			return false, nil
 		}
 		return false, err
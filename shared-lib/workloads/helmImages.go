@@ -0,0 +1,94 @@
+package workloads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+// podContainerFields are the pod spec fields listing containers whose images a release pulls
+var podContainerFields = map[string]bool{
+	"containers":          true,
+	"initContainers":      true,
+	"ephemeralContainers": true,
+}
+
+// ReleaseImages lists the container images referenced by the rendered manifest of a release,
+// sorted and without duplicates
+func (c *HelmClient) ReleaseImages(ctx context.Context, releaseName, namespace string) ([]string, error) {
+	if strings.TrimSpace(releaseName) == "" {
+		return nil, &HelmError{
+			Type:    ErrorTypeInvalidInput,
+			Message: "release name cannot be empty",
+		}
+	}
+
+	config, err := c.actionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := action.NewGet(config).Run(releaseName)
+	if err != nil {
+		errorType := ErrorTypeOther
+		if errors.Is(err, driver.ErrReleaseNotFound) {
+			errorType = ErrorTypeNotFound
+		}
+		return nil, &HelmError{
+			Type:    errorType,
+			Message: fmt.Sprintf("failed to get manifest of release %s", releaseName),
+			Err:     err,
+		}
+	}
+
+	return manifestImages(release.Manifest)
+}
+
+// manifestImages collects the images of every pod spec found in a multi document manifest
+func manifestImages(manifest string) ([]string, error) {
+	found := make(map[string]bool)
+	for name, document := range releaseutil.SplitManifests(manifest) {
+		var content interface{}
+		if err := yaml.Unmarshal([]byte(document), &content); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest %s: %w", name, err)
+		}
+		collectContainerImages(content, found)
+	}
+
+	images := make([]string, 0, len(found))
+	for image := range found {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+func collectContainerImages(node interface{}, found map[string]bool) {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if containers, ok := child.([]interface{}); ok && podContainerFields[key] {
+				for _, container := range containers {
+					if fields, ok := container.(map[string]interface{}); ok {
+						if image, ok := fields["image"].(string); ok && image != "" {
+							found[image] = true
+						}
+					}
+				}
+				continue
+			}
+			collectContainerImages(child, found)
+		}
+	case []interface{}:
+		for _, child := range value {
+			collectContainerImages(child, found)
+		}
+	}
+}
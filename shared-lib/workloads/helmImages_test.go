@@ -0,0 +1,93 @@
+package workloads
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestManifestImages(t *testing.T) {
+	manifest := `---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: migrate
+          image: registry.local:5000/app/migrate:1.2
+      containers:
+        - name: web
+          image: nginx:1.25
+        - name: sidecar
+          image: busybox
+---
+# Source: app/templates/cronjob.yaml
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: cleanup
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: cleanup
+              image: nginx:1.25
+---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  image: not-a-container-image
+`
+	images, err := manifestImages(manifest)
+	if err != nil {
+		t.Fatalf("manifestImages() error = %v", err)
+	}
+	want := []string{"busybox", "nginx:1.25", "registry.local:5000/app/migrate:1.2"}
+	if !reflect.DeepEqual(images, want) {
+		t.Fatalf("manifestImages() = %v, want %v", images, want)
+	}
+}
+
+func TestNormalizeImageReference(t *testing.T) {
+	tests := map[string]string{
+		"nginx":                               "nginx:latest",
+		"nginx:1.25":                          "nginx:1.25",
+		"docker.io/library/nginx:1.25":        "nginx:1.25",
+		"docker.io/grafana/grafana":           "grafana/grafana:latest",
+		"registry.local:5000/app/migrate":     "registry.local:5000/app/migrate:latest",
+		"registry.local:5000/app/migrate:1.2": "registry.local:5000/app/migrate:1.2",
+		"nginx@sha256:0123":                   "nginx@sha256:0123",
+		"sha256:0123":                         "sha256:0123",
+	}
+	for reference, want := range tests {
+		if got := NormalizeImageReference(reference); got != want {
+			t.Fatalf("NormalizeImageReference(%q) = %q, want %q", reference, got, want)
+		}
+	}
+}
+
+func TestImageInfoReferences(t *testing.T) {
+	image := ImageInfo{
+		ID:          "sha256:aaaa",
+		RepoTags:    []string{"nginx:latest", "registry.local:5000/web:1"},
+		RepoDigests: []string{"nginx@sha256:bbbb"},
+	}
+	for _, reference := range []string{"nginx", "docker.io/library/nginx:latest", "registry.local:5000/web:1", "nginx@sha256:bbbb", "sha256:aaaa"} {
+		if !image.References(reference) {
+			t.Fatalf("References(%q) = false, want true", reference)
+		}
+	}
+	for _, reference := range []string{"nginx:1.25", "registry.local:5000/web:2", ""} {
+		if image.References(reference) {
+			t.Fatalf("References(%q) = true, want false", reference)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package workloads
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// helm marks every resource it manages with this label and the release annotation below
+	helmManagedByLabelSelector = "app.kubernetes.io/managed-by=Helm"
+	helmReleaseNameAnnotation  = "meta.helm.sh/release-name"
+)
+
+// ReleaseJobsState summarizes the Kubernetes Jobs that belong to a Helm release
+type ReleaseJobsState struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	// FailureMessage describes why the first failed job failed
+	FailureMessage string `json:"failure_message,omitempty"`
+}
+
+// Completed reports whether the release has jobs and all of them completed successfully
+func (s *ReleaseJobsState) Completed() bool {
+	return s.Total > 0 && s.Succeeded == s.Total
+}
+
+// GetReleaseJobsState reports how far the Jobs created by a release are, this is what decides
+// whether a run-to-completion release (e.g. a database migration chart) is done.
+func (c *HelmClient) GetReleaseJobsState(ctx context.Context, releaseName, namespace string) (*ReleaseJobsState, error) {
+	if strings.TrimSpace(releaseName) == "" {
+		return nil, &HelmError{
+			Type:    ErrorTypeInvalidInput,
+			Message: "release name cannot be empty",
+		}
+	}
+
+	if namespace == "" {
+		namespace = c.settings.Namespace()
+	}
+
+	return getReleaseJobsState(ctx, c.kubeClient, releaseName, namespace)
+}
+
+func getReleaseJobsState(ctx context.Context, kubeClient kubernetes.Interface, releaseName, namespace string) (*ReleaseJobsState, error) {
+	jobs, err := kubeClient.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: helmManagedByLabelSelector,
+	})
+	if err != nil {
+		return nil, &HelmError{
+			Type:    ErrorTypeOther,
+			Message: fmt.Sprintf("failed to list jobs of release %s", releaseName),
+			Err:     err,
+		}
+	}
+
+	state := &ReleaseJobsState{}
+	for _, job := range jobs.Items {
+		if job.Annotations[helmReleaseNameAnnotation] != releaseName {
+			continue
+		}
+
+		state.Total++
+		if condition := jobCondition(job, batchv1.JobFailed); condition != nil {
+			state.Failed++
+			if state.FailureMessage == "" {
+				state.FailureMessage = fmt.Sprintf("job %s failed: %s", job.Name, condition.Message)
+			}
+			continue
+		}
+		if jobCondition(job, batchv1.JobComplete) != nil {
+			state.Succeeded++
+		}
+	}
+
+	return state, nil
+}
+
+// jobCondition returns the condition of the given type if it is set to true on the job
+func jobCondition(job batchv1.Job, conditionType batchv1.JobConditionType) *batchv1.JobCondition {
+	for i := range job.Status.Conditions {
+		condition := &job.Status.Conditions[i]
+		if condition.Type == conditionType && condition.Status == corev1.ConditionTrue {
+			return condition
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package workloads
+
+import (
+	"context"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newReleaseJob(name, releaseName string, conditions ...batchv1.JobConditionType) *batchv1.Job {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Labels:      map[string]string{"app.kubernetes.io/managed-by": "Helm"},
+			Annotations: map[string]string{helmReleaseNameAnnotation: releaseName},
+		},
+	}
+	for _, conditionType := range conditions {
+		job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+			Type:    conditionType,
+			Status:  corev1.ConditionTrue,
+			Message: "BackoffLimitExceeded",
+		})
+	}
+	return job
+}
+
+func TestGetReleaseJobsState(t *testing.T) {
+	tests := []struct {
+		name          string
+		jobs          []*batchv1.Job
+		wantState     ReleaseJobsState
+		wantCompleted bool
+	}{
+		{
+			name:      "no jobs",
+			wantState: ReleaseJobsState{},
+		},
+		{
+			name:      "job still running",
+			jobs:      []*batchv1.Job{newReleaseJob("migrate", "db-1234")},
+			wantState: ReleaseJobsState{Total: 1},
+		},
+		{
+			name:          "job completed",
+			jobs:          []*batchv1.Job{newReleaseJob("migrate", "db-1234", batchv1.JobComplete)},
+			wantState:     ReleaseJobsState{Total: 1, Succeeded: 1},
+			wantCompleted: true,
+		},
+		{
+			name: "job failed",
+			jobs: []*batchv1.Job{
+				newReleaseJob("migrate", "db-1234", batchv1.JobFailed),
+				newReleaseJob("seed", "db-1234", batchv1.JobComplete),
+			},
+			wantState: ReleaseJobsState{Total: 2, Succeeded: 1, Failed: 1, FailureMessage: "job migrate failed: BackoffLimitExceeded"},
+		},
+		{
+			name: "jobs of other releases are ignored",
+			jobs: []*batchv1.Job{
+				newReleaseJob("migrate", "db-1234", batchv1.JobComplete),
+				newReleaseJob("other", "web-5678", batchv1.JobFailed),
+			},
+			wantState:     ReleaseJobsState{Total: 1, Succeeded: 1},
+			wantCompleted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			for _, job := range tt.jobs {
+				if _, err := kubeClient.BatchV1().Jobs("default").Create(context.Background(), job, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			state, err := getReleaseJobsState(context.Background(), kubeClient, "db-1234", "default")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *state != tt.wantState {
+				t.Errorf("getReleaseJobsState() = %+v, want %+v", *state, tt.wantState)
+			}
+			if state.Completed() != tt.wantCompleted {
+				t.Errorf("Completed() = %v, want %v", state.Completed(), tt.wantCompleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package workloads
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/cli"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ManagedNamespaceLabels are set on the namespaces InstallChart and UpdateChart create
+var ManagedNamespaceLabels = map[string]string{"app.kubernetes.io/managed-by": "margo"}
+
+// EnsureNamespace creates the namespace with the given labels when it does not exist yet, an
+// existing namespace is left untouched. A namespace that is being deleted is a HelmError of type
+// ErrorTypeNamespaceTerminating, nothing can be installed to it until it is gone.
+func (c *HelmClient) EnsureNamespace(ctx context.Context, name string, labels map[string]string) error {
+	if strings.TrimSpace(name) == "" {
+		return &HelmError{
+			Type:    ErrorTypeInvalidInput,
+			Message: "namespace cannot be empty",
+		}
+	}
+	return ensureNamespace(ctx, c.kubeClient, name, labels)
+}
+
+func ensureNamespace(ctx context.Context, kubeClient kubernetes.Interface, name string, labels map[string]string) error {
+	existing, err := kubeClient.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		if existing.Status.Phase == corev1.NamespaceTerminating {
+			return &HelmError{
+				Type:    ErrorTypeNamespaceTerminating,
+				Message: fmt.Sprintf("namespace %s is being deleted, the release can be installed once it is gone", name),
+			}
+		}
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return &HelmError{
+			Type:    ErrorTypeOther,
+			Message: fmt.Sprintf("failed to get namespace %s", name),
+			Err:     err,
+		}
+	}
+
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+	}
+	_, err = kubeClient.CoreV1().Namespaces().Create(ctx, namespace, metav1.CreateOptions{})
+	// another release may have created it in the meantime
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return &HelmError{
+			Type:    ErrorTypeOther,
+			Message: fmt.Sprintf("failed to create namespace %s", name),
+			Err:     err,
+		}
+	}
+
+	log.Printf("Successfully created namespace: %s", name)
+	return nil
+}
+
+// actionConfig returns the action configuration of a namespace. Helm stores the releases in the
+// namespace they are installed to, so every namespace needs a configuration of its own; an empty
+// namespace is the namespace of the client settings.
+func (c *HelmClient) actionConfig(namespace string) (*action.Configuration, error) {
+	if namespace == "" || namespace == c.settings.Namespace() {
+		return c.config, nil
+	}
+
+	c.configsMu.Lock()
+	defer c.configsMu.Unlock()
+
+	if config, ok := c.configs[namespace]; ok {
+		return config, nil
+	}
+
+	settings := cli.New()
+	settings.KubeConfig = c.settings.KubeConfig
+	settings.SetNamespace(namespace)
+
+	config := new(action.Configuration)
+	if err := config.Init(settings.RESTClientGetter(), namespace, os.Getenv("HELM_DRIVER"), log.Printf); err != nil {
+		return nil, &HelmError{
+			Type:    ErrorTypeOther,
+			Message: fmt.Sprintf("failed to initialize helm configuration of namespace %s", namespace),
+			Err:     err,
+		}
+	}
+
+	if c.configs == nil {
+		c.configs = make(map[string]*action.Configuration)
+	}
+	c.configs[namespace] = config
+	return config, nil
+}
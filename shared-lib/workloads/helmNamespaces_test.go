@@ -0,0 +1,62 @@
+package workloads
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEnsureNamespace(t *testing.T) {
+	labels := map[string]string{"app.kubernetes.io/managed-by": "margo"}
+
+	t.Run("creates a missing namespace", func(t *testing.T) {
+		kubeClient := fake.NewSimpleClientset()
+		if err := ensureNamespace(context.Background(), kubeClient, "edge-apps", labels); err != nil {
+			t.Fatal(err)
+		}
+
+		namespace, err := kubeClient.CoreV1().Namespaces().Get(context.Background(), "edge-apps", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("namespace was not created: %v", err)
+		}
+		if namespace.Labels["app.kubernetes.io/managed-by"] != "margo" {
+			t.Errorf("namespace labels = %v, want %v", namespace.Labels, labels)
+		}
+	})
+
+	t.Run("keeps an existing namespace", func(t *testing.T) {
+		existing := &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: "edge-apps", Labels: map[string]string{"team": "ops"}},
+		}
+		kubeClient := fake.NewSimpleClientset(existing)
+		if err := ensureNamespace(context.Background(), kubeClient, "edge-apps", labels); err != nil {
+			t.Fatal(err)
+		}
+
+		namespace, err := kubeClient.CoreV1().Namespaces().Get(context.Background(), "edge-apps", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if namespace.Labels["team"] != "ops" || len(namespace.Labels) != 1 {
+			t.Errorf("namespace labels = %v, want the existing ones untouched", namespace.Labels)
+		}
+	})
+
+	t.Run("refuses a terminating namespace", func(t *testing.T) {
+		terminating := &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: "edge-apps"},
+			Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceTerminating},
+		}
+		kubeClient := fake.NewSimpleClientset(terminating)
+
+		err := ensureNamespace(context.Background(), kubeClient, "edge-apps", labels)
+		var helmErr *HelmError
+		if !errors.As(err, &helmErr) || helmErr.Type != ErrorTypeNamespaceTerminating {
+			t.Fatalf("ensureNamespace() error = %v, want a %s HelmError", err, ErrorTypeNamespaceTerminating)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package workloads
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// HelmRegistryAuth are the credentials of a private OCI registry a chart is pulled from
+type HelmRegistryAuth struct {
+	// Registry is the registry host as the chart reference names it, e.g. registry.example.com:5000,
+	// an oci:// reference to the registry is accepted as well
+	Registry  string
+	BasicAuth HelmRepoBasicAuthentication
+}
+
+// InstallChartWithAuth installs a chart like InstallChart does and pulls an oci:// chart with the
+// credentials of its registry. The credentials are only used by the registry client of this
+// install, neither the registry client of the HelmClient nor the stored registry logins change, so
+// that concurrent installs from different registries do not clobber each other's credentials.
+func (c *HelmClient) InstallChartWithAuth(ctx context.Context, releaseName, chart, namespace, revision string, wait, atomic, createNamespace bool, timeout time.Duration, values map[string]interface{}, auths []HelmRegistryAuth) error {
+	return c.installChart(ctx, releaseName, chart, namespace, revision, wait, atomic, createNamespace, timeout, values, auths)
+}
+
+// UpdateChartWithAuth upgrades a release like UpdateChart does and pulls an oci:// chart with the
+// credentials of its registry, scoped to this upgrade like InstallChartWithAuth does.
+func (c *HelmClient) UpdateChartWithAuth(ctx context.Context, name, chart, namespace string, wait, atomic, createNamespace bool, timeout time.Duration, values map[string]interface{}, auths []HelmRegistryAuth) error {
+	return c.updateChart(ctx, name, chart, namespace, wait, atomic, createNamespace, timeout, values, auths)
+}
+
+// registryCredential answers the credentials of the registry asked for, anonymous access for the
+// registries without credentials
+func registryCredential(auths []HelmRegistryAuth) auth.CredentialFunc {
+	credentials := make(map[string]auth.Credential, len(auths))
+	for _, a := range auths {
+		credentials[registryHost(a.Registry)] = auth.Credential{
+			Username: a.BasicAuth.Username,
+			Password: a.BasicAuth.Password,
+		}
+	}
+	return func(_ context.Context, hostport string) (auth.Credential, error) {
+		if cred, ok := credentials[hostport]; ok {
+			return cred, nil
+		}
+		return auth.EmptyCredential, nil
+	}
+}
+
+// registryHost is the host and port of a registry given as a host, an oci:// or an http(s):// reference
+func registryHost(registry string) string {
+	host := strings.TrimSpace(registry)
+	for _, scheme := range []string{"oci://", "https://", "http://"} {
+		host = strings.TrimPrefix(host, scheme)
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
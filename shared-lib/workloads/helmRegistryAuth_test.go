@@ -0,0 +1,101 @@
+package workloads
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+)
+
+// newAuthRegistry starts a registry that asks for basic auth and records the Authorization headers
+// it receives, it knows no charts
+func newAuthRegistry(t *testing.T) (host string, authorizations func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		mu.Lock()
+		received = append(received, authorization)
+		mu.Unlock()
+		if authorization == "" {
+			w.Header().Set("Www-Authenticate", `Basic realm="charts"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://"), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), received...)
+	}
+}
+
+func TestInstallChartWithAuth(t *testing.T) {
+	host, authorizations := newAuthRegistry(t)
+	client := newFakeHelmClient(&kubefake.FailingKubeClient{})
+	WithOCIPlainHTTP(true)(client)
+
+	auths := []HelmRegistryAuth{{Registry: host, BasicAuth: HelmRepoBasicAuthentication{Username: "deployer", Password: "s3cret"}}}
+	err := client.InstallChartWithAuth(context.Background(), "demo", "oci://"+host+"/charts/demo", "default", "1.0.0",
+		false, false, false, time.Minute, nil, auths)
+	var helmErr *HelmError
+	if !errors.As(err, &helmErr) || helmErr.Type != ErrorTypeRegistry {
+		t.Fatalf("InstallChartWithAuth() error = %v, want a %s HelmError for the missing chart", err, ErrorTypeRegistry)
+	}
+
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("deployer:s3cret"))
+	found := false
+	for _, authorization := range authorizations() {
+		found = found || authorization == want
+	}
+	if !found {
+		t.Errorf("registry received Authorization headers %q, want %q", authorizations(), want)
+	}
+	if client.registryClient != nil {
+		t.Error("the credentials are scoped to the install, the shared registry client is left alone")
+	}
+}
+
+func TestOCIRegistryClient_OtherRegistryCredentials(t *testing.T) {
+	host, authorizations := newAuthRegistry(t)
+	client := newFakeHelmClient(&kubefake.FailingKubeClient{})
+	WithOCIPlainHTTP(true)(client)
+
+	registryClient, err := client.ociRegistryClient("oci://"+host+"/charts/demo",
+		[]HelmRegistryAuth{{Registry: "oci://registry.other:5000/charts", BasicAuth: HelmRepoBasicAuthentication{Username: "deployer", Password: "s3cret"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registryClient.Pull(host + "/charts/demo:1.0.0"); err == nil {
+		t.Fatal("Pull() of a chart the registry does not know succeeded")
+	}
+	for _, authorization := range authorizations() {
+		if authorization != "" {
+			t.Errorf("the credentials of another registry were sent: %q", authorization)
+		}
+	}
+}
+
+func TestRegistryHost(t *testing.T) {
+	tests := map[string]string{
+		"registry.local:5000":                   "registry.local:5000",
+		"oci://registry.local:5000/charts/demo": "registry.local:5000",
+		"https://registry.local/charts":         "registry.local",
+		" ghcr.io ":                             "ghcr.io",
+	}
+	for registry, want := range tests {
+		if got := registryHost(registry); got != want {
+			t.Errorf("registryHost(%q) = %q, want %q", registry, got, want)
+		}
+	}
+}
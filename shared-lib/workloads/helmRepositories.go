@@ -0,0 +1,90 @@
+package workloads
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// latestChartVersion is the revision standing for the newest version of a chart
+const latestChartVersion = "latest"
+
+// locateChart returns the local path of a chart that is not an OCI reference: a chart directory or
+// archive, a chart URL, or a "repo/chart" reference to a repository added with AddRepository. The
+// index of that repository is downloaded again first, so the versions published since the
+// repository was added are found. With opts.RepoURL the chart is looked up in that repository
+// instead. A "latest" opts.Version picks the newest version.
+func (c *HelmClient) locateChart(opts *action.ChartPathOptions, chart string) (string, error) {
+	if strings.TrimSpace(opts.Version) == latestChartVersion {
+		opts.Version = ""
+	}
+
+	if opts.RepoURL == "" {
+		if err := c.refreshChartRepository(chart); err != nil {
+			return "", err
+		}
+	}
+
+	chartPath, err := opts.LocateChart(chart, c.settings)
+	if err != nil {
+		return "", &HelmError{
+			Type:    ErrorTypeChart,
+			Message: "failed to locate chart",
+			Err:     err,
+		}
+	}
+	return chartPath, nil
+}
+
+// refreshChartRepository downloads the index of the repository a "repo/chart" reference names.
+// Local charts, chart URLs and repositories that were not added are left to LocateChart.
+func (c *HelmClient) refreshChartRepository(chart string) error {
+	chart = strings.TrimSpace(chart)
+	repoName, _, found := strings.Cut(chart, "/")
+	if !found || repoName == "" || strings.Contains(chart, "://") {
+		return nil
+	}
+	if _, err := os.Stat(chart); err == nil {
+		return nil
+	}
+
+	repoFile, err := repo.LoadFile(c.settings.RepositoryConfig)
+	if err != nil {
+		return nil
+	}
+	entry := repoFile.Get(repoName)
+	if entry == nil {
+		return nil
+	}
+
+	repository, err := c.chartRepository(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := repository.DownloadIndexFile(); err != nil {
+		return &HelmError{
+			Type:    ErrorTypeRegistry,
+			Message: fmt.Sprintf("failed to refresh the index of repository %s", repoName),
+			Err:     err,
+		}
+	}
+	return nil
+}
+
+// chartRepository returns the repository of the entry, its index is cached where LocateChart reads it
+func (c *HelmClient) chartRepository(entry *repo.Entry) (*repo.ChartRepository, error) {
+	repository, err := repo.NewChartRepository(entry, getter.All(c.settings))
+	if err != nil {
+		return nil, &HelmError{
+			Type:    ErrorTypeRegistry,
+			Message: "failed to create chart repository",
+			Err:     err,
+		}
+	}
+	repository.CachePath = c.settings.RepositoryCache
+	return repository, nil
+}
@@ -0,0 +1,117 @@
+package workloads
+
+import (
+	"context"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// publishTestChart packages the chart of writeTestChart with the version into the repository
+// directory and indexes the repository again
+func publishTestChart(t *testing.T, repoDir, repoURL, version string) {
+	t.Helper()
+	chartDir := writeTestChart(t)
+	metadata := "apiVersion: v2\nname: failing\nversion: " + version + "\n"
+	if err := os.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte(metadata), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	chart, err := loader.Load(chartDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chartutil.Save(chart, repoDir); err != nil {
+		t.Fatal(err)
+	}
+	index, err := repo.IndexDirectory(repoDir, repoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.WriteFile(filepath.Join(repoDir, "index.yaml"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstallChart_FromRepository(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	server := httptest.NewServer(nethttp.FileServer(nethttp.Dir(repoDir)))
+	t.Cleanup(server.Close)
+
+	client := newFakeHelmClient(&kubefake.FailingKubeClient{})
+	helmHome := t.TempDir()
+	client.settings.RepositoryConfig = filepath.Join(helmHome, "repositories.yaml")
+	client.settings.RepositoryCache = filepath.Join(helmHome, "cache")
+
+	publishTestChart(t, repoDir, server.URL, "0.1.0")
+	if err := client.AddRepository("local", server.URL, HelmRepoAuth{}); err != nil {
+		t.Fatalf("AddRepository() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(client.settings.RepositoryCache, "local-index.yaml")); err != nil {
+		t.Errorf("AddRepository() did not cache the index where charts are looked up: %v", err)
+	}
+
+	// published after the repository was added, found without updating the repository by hand
+	publishTestChart(t, repoDir, server.URL, "0.2.0")
+
+	tests := []struct {
+		release   string
+		revision  string
+		wantChart string
+	}{
+		{release: "newest", revision: "latest", wantChart: "failing-0.2.0"},
+		{release: "unversioned", revision: "", wantChart: "failing-0.2.0"},
+		{release: "pinned", revision: "0.1.0", wantChart: "failing-0.1.0"},
+	}
+	for _, tt := range tests {
+		if err := client.InstallChart(ctx, tt.release, "local/failing", "default", tt.revision, false, false, false, time.Minute, nil); err != nil {
+			t.Fatalf("InstallChart(%s, revision %q) error = %v", tt.release, tt.revision, err)
+		}
+		status, err := client.GetReleaseStatus(ctx, tt.release, "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Chart != tt.wantChart {
+			t.Errorf("InstallChart(revision %q) installed %s, want %s", tt.revision, status.Chart, tt.wantChart)
+		}
+	}
+
+	if err := client.InstallChart(ctx, "missing", "local/failing", "default", "9.9.9", false, false, false, time.Minute, nil); err == nil {
+		t.Error("InstallChart() of an unpublished version succeeded")
+	}
+}
+
+func TestLocateChart_RepoURL(t *testing.T) {
+	repoDir := t.TempDir()
+	server := httptest.NewServer(nethttp.FileServer(nethttp.Dir(repoDir)))
+	t.Cleanup(server.Close)
+	publishTestChart(t, repoDir, server.URL, "0.1.0")
+	publishTestChart(t, repoDir, server.URL, "0.2.0")
+
+	client := newFakeHelmClient(&kubefake.FailingKubeClient{})
+	client.settings.RepositoryConfig = filepath.Join(t.TempDir(), "repositories.yaml")
+	client.settings.RepositoryCache = t.TempDir()
+
+	chartPath, err := client.locateChart(&action.ChartPathOptions{RepoURL: server.URL, Version: "0.1.0"}, "failing")
+	if err != nil {
+		t.Fatalf("locateChart() error = %v", err)
+	}
+	if !strings.HasSuffix(chartPath, "failing-0.1.0.tgz") {
+		t.Errorf("locateChart() = %s, want version 0.1.0 of the repository", chartPath)
+	}
+
+	// a repository that was never added is not refreshed, LocateChart reports it
+	if _, err := client.locateChart(&action.ChartPathOptions{}, "unknown/failing"); err == nil {
+		t.Error("locateChart() of a chart in an unknown repository succeeded")
+	}
+}
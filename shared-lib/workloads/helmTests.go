@@ -0,0 +1,169 @@
+package workloads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DefaultHelmTestTimeout is the timeout of the test hooks of a release when the caller passes none
+const DefaultHelmTestTimeout = 5 * time.Minute
+
+// ReleaseTestResult is the outcome of one test hook of a release
+type ReleaseTestResult struct {
+	Name        string            `json:"name"`
+	Kind        string            `json:"kind"`
+	Phase       release.HookPhase `json:"phase"`
+	StartedAt   time.Time         `json:"started_at,omitempty"`
+	CompletedAt time.Time         `json:"completed_at,omitempty"`
+}
+
+// ReleaseTestOption configures RunReleaseTests
+type ReleaseTestOption func(*releaseTestOptions)
+
+type releaseTestOptions struct {
+	logs io.Writer
+}
+
+// WithReleaseTestLogs writes the logs of the test pods to w once the tests ran, whether they passed
+// or not. Logs that cannot be read are noted in w and do not fail the tests.
+func WithReleaseTestLogs(w io.Writer) ReleaseTestOption {
+	return func(opts *releaseTestOptions) {
+		opts.logs = w
+	}
+}
+
+// RunReleaseTests runs the test hooks of a release like `helm test`. A release without test hooks
+// passes. Failing tests are a HelmError of type ErrorTypeRelease, the returned status still lists
+// the outcome of every test then.
+func (c *HelmClient) RunReleaseTests(ctx context.Context, releaseName, namespace string, timeout time.Duration, opts ...ReleaseTestOption) (*ReleaseStatus, error) {
+	if strings.TrimSpace(releaseName) == "" {
+		return nil, &HelmError{
+			Type:    ErrorTypeInvalidInput,
+			Message: "release name cannot be empty",
+		}
+	}
+	options := &releaseTestOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	config, err := c.actionConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace = c.settings.Namespace()
+	}
+
+	releaseTesting := action.NewReleaseTesting(config)
+	releaseTesting.Namespace = namespace
+	releaseTesting.Timeout = orDefault(timeout, DefaultHelmTestTimeout)
+
+	rel, runErr := releaseTesting.Run(releaseName)
+	if rel == nil {
+		errorType := ErrorTypeOther
+		if errors.Is(runErr, driver.ErrReleaseNotFound) {
+			errorType = ErrorTypeNotFound
+		}
+		return nil, &HelmError{
+			Type:    errorType,
+			Message: fmt.Sprintf("failed to run the tests of release %s", releaseName),
+			Err:     runErr,
+		}
+	}
+
+	status := &ReleaseStatus{
+		Name:      rel.Name,
+		Namespace: rel.Namespace,
+		Revision:  rel.Version,
+		Tests:     []ReleaseTestResult{},
+	}
+	if rel.Info != nil {
+		status.Status = rel.Info.Status
+		status.Description = rel.Info.Description
+		status.Updated = rel.Info.LastDeployed.Format("2006-01-02 15:04:05")
+	}
+	if rel.Chart != nil && rel.Chart.Metadata != nil {
+		status.Chart = fmt.Sprintf("%s-%s", rel.Chart.Metadata.Name, rel.Chart.Metadata.Version)
+		status.AppVersion = rel.Chart.Metadata.AppVersion
+	}
+
+	var failed []string
+	for _, hook := range testHooks(rel) {
+		status.Tests = append(status.Tests, ReleaseTestResult{
+			Name:        hook.Name,
+			Kind:        hook.Kind,
+			Phase:       hook.LastRun.Phase,
+			StartedAt:   hook.LastRun.StartedAt.Time,
+			CompletedAt: hook.LastRun.CompletedAt.Time,
+		})
+		if hook.LastRun.Phase == release.HookPhaseFailed {
+			failed = append(failed, hook.Name)
+		}
+	}
+
+	if options.logs != nil {
+		c.writeTestPodLogs(ctx, options.logs, namespace, status.Tests)
+	}
+
+	if runErr != nil {
+		message := fmt.Sprintf("tests of release %s failed", releaseName)
+		if len(failed) > 0 {
+			message = fmt.Sprintf("tests of release %s failed: %s", releaseName, strings.Join(failed, ", "))
+		}
+		return status, &HelmError{
+			Type:    ErrorTypeRelease,
+			Message: message,
+			Err:     runErr,
+		}
+	}
+	return status, nil
+}
+
+// testHooks returns the hooks of the release that run on helm test
+func testHooks(rel *release.Release) []*release.Hook {
+	var hooks []*release.Hook
+	for _, hook := range rel.Hooks {
+		for _, event := range hook.Events {
+			if event == release.HookTest {
+				hooks = append(hooks, hook)
+				break
+			}
+		}
+	}
+	return hooks
+}
+
+// writeTestPodLogs copies the logs of the test pods that ran to w
+func (c *HelmClient) writeTestPodLogs(ctx context.Context, w io.Writer, namespace string, tests []ReleaseTestResult) {
+	for _, test := range tests {
+		// tests not run have no pod, and only pods have logs
+		if test.Kind != "Pod" || test.Phase == "" || test.Phase == release.HookPhaseUnknown {
+			continue
+		}
+		logs, err := c.kubeClient.CoreV1().Pods(namespace).GetLogs(test.Name, &corev1.PodLogOptions{}).Stream(ctx)
+		if err != nil {
+			fmt.Fprintf(w, "POD LOGS: %s\nunable to get the logs: %v\n", test.Name, err)
+			continue
+		}
+		fmt.Fprintf(w, "POD LOGS: %s\n", test.Name)
+		_, err = io.Copy(w, logs)
+		logs.Close()
+		fmt.Fprintln(w)
+		if err != nil {
+			fmt.Fprintf(w, "unable to read the logs: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package workloads
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// writeTestChartWithTests adds a test hook pod to the chart of writeTestChart
+func writeTestChartWithTests(t *testing.T) string {
+	t.Helper()
+	dir := writeTestChart(t)
+	hook := "apiVersion: v1\nkind: Pod\nmetadata:\n  name: {{ .Release.Name }}-test-connection\n" +
+		"  annotations:\n    \"helm.sh/hook\": test\nspec:\n  containers:\n    - name: wget\n      image: busybox\n" +
+		"  restartPolicy: Never\n"
+	if err := os.WriteFile(filepath.Join(dir, "templates", "test-connection.yaml"), []byte(hook), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRunReleaseTests(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := &kubefake.FailingKubeClient{}
+	client := newFakeHelmClient(kubeClient)
+	client.kubeClient = fake.NewSimpleClientset()
+
+	var helmErr *HelmError
+	if _, err := client.RunReleaseTests(ctx, "failing", "default", time.Minute); !errors.As(err, &helmErr) || helmErr.Type != ErrorTypeNotFound {
+		t.Fatalf("RunReleaseTests() of a missing release error = %v, want a %s HelmError", err, ErrorTypeNotFound)
+	}
+
+	if err := client.InstallChart(ctx, "failing", writeTestChartWithTests(t), "default", "", false, false, false, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	status, err := client.RunReleaseTests(ctx, "failing", "default", time.Minute, WithReleaseTestLogs(&logs))
+	if err != nil {
+		t.Fatalf("RunReleaseTests() error = %v", err)
+	}
+	if len(status.Tests) != 1 || status.Tests[0].Name != "failing-test-connection" || status.Tests[0].Phase != release.HookPhaseSucceeded {
+		t.Errorf("RunReleaseTests() tests = %+v, want failing-test-connection succeeded", status.Tests)
+	}
+	if !strings.Contains(logs.String(), "POD LOGS: failing-test-connection\nfake logs") {
+		t.Errorf("RunReleaseTests() logs = %q, want the logs of the test pod", logs.String())
+	}
+
+	kubeClient.WatchUntilReadyError = errors.New("pod failing-test-connection failed")
+	status, err = client.RunReleaseTests(ctx, "failing", "default", time.Minute)
+	if !errors.As(err, &helmErr) || helmErr.Type != ErrorTypeRelease {
+		t.Fatalf("RunReleaseTests() of failing tests error = %v, want a %s HelmError", err, ErrorTypeRelease)
+	}
+	if !strings.Contains(err.Error(), "tests of release failing failed: failing-test-connection") {
+		t.Errorf("RunReleaseTests() error = %v, want the failed test named", err)
+	}
+	if status == nil || len(status.Tests) != 1 || status.Tests[0].Phase != release.HookPhaseFailed {
+		t.Errorf("RunReleaseTests() status of failing tests = %+v, want the failed test", status)
+	}
+}
+
+func TestRunReleaseTests_NoTestHooks(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeHelmClient(&kubefake.FailingKubeClient{WatchUntilReadyError: errors.New("no hook is watched")})
+
+	if err := client.InstallChart(ctx, "failing", writeTestChart(t), "default", "", false, false, false, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	status, err := client.RunReleaseTests(ctx, "failing", "default", 0, WithReleaseTestLogs(&logs))
+	if err != nil {
+		t.Fatalf("RunReleaseTests() of a release without tests error = %v, want a pass", err)
+	}
+	if len(status.Tests) != 0 || logs.Len() != 0 {
+		t.Errorf("RunReleaseTests() = %+v with logs %q, want no tests", status.Tests, logs.String())
+	}
+}
@@ -0,0 +1,280 @@
+package workloads
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// helmInstanceLabel is the label charts following the Kubernetes recommendations put on every
+// resource of a release, its value is the release name
+const helmInstanceLabel = "app.kubernetes.io/instance"
+
+// Reasons of waiting containers that will not get better by waiting
+const (
+	podReasonCrashLoopBackOff = "CrashLoopBackOff"
+	podReasonErrImagePull     = "ErrImagePull"
+	podReasonImagePullBackOff = "ImagePullBackOff"
+	podReasonInvalidImageName = "InvalidImageName"
+)
+
+// WorkloadStatus summarizes the deployments, statefulsets and pods of a Helm release, a release
+// can be deployed while none of its pods ever become ready
+type WorkloadStatus struct {
+	Workloads []WorkloadReadiness `json:"workloads,omitempty"`
+	// ReadyPods and TotalPods count the pods that are meant to keep running, pods that ran to
+	// completion and pods being deleted are left out
+	ReadyPods int `json:"ready_pods"`
+	TotalPods int `json:"total_pods"`
+	// PodPhases counts every pod of the release by phase, e.g. Running or Pending
+	PodPhases map[string]int `json:"pod_phases,omitempty"`
+	// CrashLooping and ImagePullErrors count the containers waiting for these reasons
+	CrashLooping    int `json:"crash_looping"`
+	ImagePullErrors int `json:"image_pull_errors"`
+	// FailureReason describes the first pod, by name, that is not ready
+	FailureReason string `json:"failure_reason,omitempty"`
+}
+
+// WorkloadReadiness is the number of ready replicas of a deployment or statefulset
+type WorkloadReadiness struct {
+	Kind          string `json:"kind"`
+	Name          string `json:"name"`
+	ReadyReplicas int32  `json:"ready_replicas"`
+	Replicas      int32  `json:"replicas"`
+}
+
+// Ready reports whether every replica of every workload and every pod of the release is ready, a
+// release without workloads is ready
+func (s *WorkloadStatus) Ready() bool {
+	for _, workload := range s.Workloads {
+		if workload.ReadyReplicas < workload.Replicas {
+			return false
+		}
+	}
+	return s.ReadyPods == s.TotalPods && !s.Failing()
+}
+
+// Failing reports whether pods of the release are crash looping or cannot pull their images
+func (s *WorkloadStatus) Failing() bool {
+	return s.CrashLooping > 0 || s.ImagePullErrors > 0
+}
+
+// String sums up the status, e.g. "1/3 pods ready, 2 crash looping: pod web-0 container web:
+// CrashLoopBackOff"
+func (s *WorkloadStatus) String() string {
+	summary := fmt.Sprintf("%d/%d pods ready", s.ReadyPods, s.TotalPods)
+	if s.CrashLooping > 0 {
+		summary += fmt.Sprintf(", %d crash looping", s.CrashLooping)
+	}
+	if s.ImagePullErrors > 0 {
+		summary += fmt.Sprintf(", %d failing to pull images", s.ImagePullErrors)
+	}
+	for _, workload := range s.Workloads {
+		if workload.ReadyReplicas < workload.Replicas {
+			summary += fmt.Sprintf(", %s %s has %d/%d ready replicas", workload.Kind, workload.Name, workload.ReadyReplicas, workload.Replicas)
+		}
+	}
+	if s.FailureReason != "" {
+		summary += ": " + s.FailureReason
+	}
+	return summary
+}
+
+// GetReleaseWorkloadStatus summarizes the readiness of the deployments, statefulsets and pods of a
+// release, found by the app.kubernetes.io/instance label
+func (c *HelmClient) GetReleaseWorkloadStatus(ctx context.Context, releaseName, namespace string) (*WorkloadStatus, error) {
+	if strings.TrimSpace(releaseName) == "" {
+		return nil, &HelmError{
+			Type:    ErrorTypeInvalidInput,
+			Message: "release name cannot be empty",
+		}
+	}
+
+	if namespace == "" {
+		namespace = c.settings.Namespace()
+	}
+
+	return getReleaseWorkloadStatus(ctx, c.kubeClient, releaseName, namespace)
+}
+
+func getReleaseWorkloadStatus(ctx context.Context, kubeClient kubernetes.Interface, releaseName, namespace string) (*WorkloadStatus, error) {
+	listOptions := metav1.ListOptions{LabelSelector: helmInstanceLabel + "=" + releaseName}
+	listFailed := func(kind string, err error) error {
+		return &HelmError{
+			Type:    ErrorTypeOther,
+			Message: fmt.Sprintf("failed to list the %s of release %s", kind, releaseName),
+			Err:     err,
+		}
+	}
+
+	status := &WorkloadStatus{PodPhases: map[string]int{}}
+
+	deployments, err := kubeClient.AppsV1().Deployments(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, listFailed("deployments", err)
+	}
+	for _, deployment := range deployments.Items {
+		status.Workloads = append(status.Workloads, WorkloadReadiness{
+			Kind:          "deployment",
+			Name:          deployment.Name,
+			ReadyReplicas: deployment.Status.ReadyReplicas,
+			Replicas:      desiredReplicas(deployment.Spec.Replicas),
+		})
+	}
+
+	statefulSets, err := kubeClient.AppsV1().StatefulSets(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, listFailed("statefulsets", err)
+	}
+	for _, statefulSet := range statefulSets.Items {
+		status.Workloads = append(status.Workloads, WorkloadReadiness{
+			Kind:          "statefulset",
+			Name:          statefulSet.Name,
+			ReadyReplicas: statefulSet.Status.ReadyReplicas,
+			Replicas:      desiredReplicas(statefulSet.Spec.Replicas),
+		})
+	}
+
+	pods, err := kubeClient.CoreV1().Pods(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, listFailed("pods", err)
+	}
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+	for _, pod := range pods.Items {
+		status.PodPhases[string(pod.Status.Phase)]++
+		if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded {
+			continue
+		}
+
+		status.TotalPods++
+		if podReady(pod) {
+			status.ReadyPods++
+			continue
+		}
+		reason := podFailureReason(pod, status)
+		if status.FailureReason == "" {
+			status.FailureReason = reason
+		}
+	}
+
+	return status, nil
+}
+
+// desiredReplicas is the number of replicas of a workload, Kubernetes defaults it to 1
+func desiredReplicas(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+func podReady(pod corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podFailureReason says why the pod is not ready and counts its crash looping and image pull
+// errors into status
+func podFailureReason(pod corev1.Pod, status *WorkloadStatus) string {
+	var reason string
+	containers := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, container := range containers {
+		waiting := container.State.Waiting
+		if waiting == nil || waiting.Reason == "" {
+			continue
+		}
+		switch waiting.Reason {
+		case podReasonCrashLoopBackOff:
+			status.CrashLooping++
+		case podReasonErrImagePull, podReasonImagePullBackOff, podReasonInvalidImageName:
+			status.ImagePullErrors++
+		}
+		if reason == "" {
+			reason = fmt.Sprintf("pod %s container %s: %s", pod.Name, container.Name, waiting.Reason)
+			if waiting.Message != "" {
+				reason += ": " + waiting.Message
+			}
+		}
+	}
+	if reason != "" {
+		return reason
+	}
+
+	if pod.Status.Phase == corev1.PodFailed {
+		return fmt.Sprintf("pod %s failed: %s", pod.Name, strings.TrimSpace(pod.Status.Reason+" "+pod.Status.Message))
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse {
+			return fmt.Sprintf("pod %s is not scheduled: %s", pod.Name, condition.Message)
+		}
+	}
+	return fmt.Sprintf("pod %s is not ready", pod.Name)
+}
+
+// PodImage is the image a container of a release runs, ImageID is the image the node resolved it
+// to, e.g. docker.io/library/nginx@sha256:... or docker-pullable://nginx@sha256:...
+type PodImage struct {
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	ImageID   string `json:"image_id,omitempty"`
+}
+
+// ReleasePodImages lists the images the containers of the live pods of a release run, found by the
+// app.kubernetes.io/instance label. Unlike the rendered manifest they tell the digests pulled.
+func (c *HelmClient) ReleasePodImages(ctx context.Context, releaseName, namespace string) ([]PodImage, error) {
+	if strings.TrimSpace(releaseName) == "" {
+		return nil, &HelmError{
+			Type:    ErrorTypeInvalidInput,
+			Message: "release name cannot be empty",
+		}
+	}
+
+	if namespace == "" {
+		namespace = c.settings.Namespace()
+	}
+
+	return releasePodImages(ctx, c.kubeClient, releaseName, namespace)
+}
+
+func releasePodImages(ctx context.Context, kubeClient kubernetes.Interface, releaseName, namespace string) ([]PodImage, error) {
+	pods, err := kubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: helmInstanceLabel + "=" + releaseName,
+	})
+	if err != nil {
+		return nil, &HelmError{
+			Type:    ErrorTypeOther,
+			Message: fmt.Sprintf("failed to list the pods of release %s", releaseName),
+			Err:     err,
+		}
+	}
+
+	var images []PodImage
+	for _, pod := range pods.Items {
+		statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, container := range statuses {
+			images = append(images, PodImage{
+				Pod:       pod.Name,
+				Container: container.Name,
+				Image:     container.Image,
+				ImageID:   container.ImageID,
+			})
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Pod != images[j].Pod {
+			return images[i].Pod < images[j].Pod
+		}
+		return images[i].Container < images[j].Container
+	})
+	return images, nil
+}
@@ -0,0 +1,169 @@
+package workloads
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func releaseObjectMeta(name, releaseName string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: "default",
+		Labels:    map[string]string{helmInstanceLabel: releaseName},
+	}
+}
+
+func newReleaseDeployment(name, releaseName string, replicas, ready int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: releaseObjectMeta(name, releaseName),
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status:     appsv1.DeploymentStatus{ReadyReplicas: ready},
+	}
+}
+
+func newReleasePod(name, releaseName string, phase corev1.PodPhase, ready bool, waitingReason string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: releaseObjectMeta(name, releaseName)}
+	pod.Status.Phase = phase
+	readyCondition := corev1.ConditionFalse
+	if ready {
+		readyCondition = corev1.ConditionTrue
+	}
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: readyCondition}}
+	if waitingReason != "" {
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "app",
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: waitingReason, Message: "back-off 5m0s"}},
+		}}
+	}
+	return pod
+}
+
+func TestGetReleaseWorkloadStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		objects     []runtime.Object
+		wantReady   bool
+		wantFailing bool
+		wantSummary string
+	}{
+		{
+			name:        "no workloads",
+			wantReady:   true,
+			wantSummary: "0/0 pods ready",
+		},
+		{
+			name: "every replica ready",
+			objects: []runtime.Object{
+				newReleaseDeployment("web", "shop-1234", 2, 2),
+				newReleasePod("web-a", "shop-1234", corev1.PodRunning, true, ""),
+				newReleasePod("web-b", "shop-1234", corev1.PodRunning, true, ""),
+				// completed pods, e.g. of a hook job, are left out
+				newReleasePod("migrate", "shop-1234", corev1.PodSucceeded, false, ""),
+				// the pods of other releases are ignored
+				newReleasePod("web-c", "blog-5678", corev1.PodPending, false, podReasonCrashLoopBackOff),
+			},
+			wantReady:   true,
+			wantSummary: "2/2 pods ready",
+		},
+		{
+			name: "crash looping pod",
+			objects: []runtime.Object{
+				newReleaseDeployment("web", "shop-1234", 2, 1),
+				newReleasePod("web-a", "shop-1234", corev1.PodRunning, true, ""),
+				newReleasePod("web-b", "shop-1234", corev1.PodRunning, false, podReasonCrashLoopBackOff),
+			},
+			wantFailing: true,
+			wantSummary: "1/2 pods ready, 1 crash looping, deployment web has 1/2 ready replicas: pod web-b container app: CrashLoopBackOff: back-off 5m0s",
+		},
+		{
+			name: "image pull error in a statefulset",
+			objects: []runtime.Object{
+				&appsv1.StatefulSet{ObjectMeta: releaseObjectMeta("db", "shop-1234")},
+				newReleasePod("db-0", "shop-1234", corev1.PodPending, false, podReasonImagePullBackOff),
+			},
+			wantFailing: true,
+			wantSummary: "0/1 pods ready, 1 failing to pull images, statefulset db has 0/1 ready replicas: pod db-0 container app: ImagePullBackOff: back-off 5m0s",
+		},
+		{
+			name: "pod still starting",
+			objects: []runtime.Object{
+				newReleasePod("web-a", "shop-1234", corev1.PodPending, false, ""),
+			},
+			wantSummary: "0/1 pods ready: pod web-a is not ready",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset(tt.objects...)
+
+			status, err := getReleaseWorkloadStatus(context.Background(), kubeClient, "shop-1234", "default")
+			if err != nil {
+				t.Fatalf("getReleaseWorkloadStatus() error = %v", err)
+			}
+			if status.Ready() != tt.wantReady {
+				t.Errorf("Ready() = %v, want %v", status.Ready(), tt.wantReady)
+			}
+			if status.Failing() != tt.wantFailing {
+				t.Errorf("Failing() = %v, want %v", status.Failing(), tt.wantFailing)
+			}
+			if status.String() != tt.wantSummary {
+				t.Errorf("String() = %q, want %q", status.String(), tt.wantSummary)
+			}
+		})
+	}
+}
+
+func TestGetReleaseWorkloadStatus_CountsPodPhases(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset(
+		newReleasePod("web-a", "shop-1234", corev1.PodRunning, true, ""),
+		newReleasePod("web-b", "shop-1234", corev1.PodPending, false, podReasonErrImagePull),
+		newReleasePod("migrate", "shop-1234", corev1.PodSucceeded, false, ""),
+	)
+
+	status, err := getReleaseWorkloadStatus(context.Background(), kubeClient, "shop-1234", "default")
+	if err != nil {
+		t.Fatalf("getReleaseWorkloadStatus() error = %v", err)
+	}
+	want := map[string]int{"Running": 1, "Pending": 1, "Succeeded": 1}
+	for phase, count := range want {
+		if status.PodPhases[phase] != count {
+			t.Errorf("PodPhases[%s] = %d, want %d", phase, status.PodPhases[phase], count)
+		}
+	}
+	if status.ReadyPods != 1 || status.TotalPods != 2 || status.ImagePullErrors != 1 {
+		t.Errorf("status = %+v, want 1/2 ready pods and 1 image pull error", status)
+	}
+}
+
+func TestReleasePodImages(t *testing.T) {
+	pod := newReleasePod("web-a", "shop-1234", corev1.PodRunning, true, "")
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{Name: "web", Image: "nginx:1.25", ImageID: "docker.io/library/nginx@sha256:0123"},
+		{Name: "agent", Image: "registry:5000/agent:v2"},
+	}
+	kubeClient := fake.NewSimpleClientset(pod, newReleasePod("blog-a", "blog-5678", corev1.PodRunning, true, ""))
+
+	images, err := releasePodImages(context.Background(), kubeClient, "shop-1234", "default")
+	if err != nil {
+		t.Fatalf("releasePodImages() error = %v", err)
+	}
+	want := []PodImage{
+		{Pod: "web-a", Container: "agent", Image: "registry:5000/agent:v2"},
+		{Pod: "web-a", Container: "web", Image: "nginx:1.25", ImageID: "docker.io/library/nginx@sha256:0123"},
+	}
+	if len(images) != len(want) {
+		t.Fatalf("releasePodImages() = %+v, want %+v", images, want)
+	}
+	for i := range want {
+		if images[i] != want[i] {
+			t.Errorf("images[%d] = %+v, want %+v", i, images[i], want[i])
+		}
+	}
+}
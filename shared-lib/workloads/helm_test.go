@@ -0,0 +1,293 @@
+package workloads
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+func TestParseHelmTimeout(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: DefaultHelmInstallTimeout},
+		{value: "  ", want: DefaultHelmInstallTimeout},
+		{value: "15m", want: 15 * time.Minute},
+		{value: "1h30m", want: 90 * time.Minute},
+		{value: "15", wantErr: true},
+		{value: "fifteen minutes", wantErr: true},
+		{value: "-5m", wantErr: true},
+		{value: "0s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseHelmTimeout(tt.value, DefaultHelmInstallTimeout)
+			if tt.wantErr {
+				var helmErr *HelmError
+				if !errors.As(err, &helmErr) || helmErr.Type != ErrorTypeInvalidInput {
+					t.Fatalf("ParseHelmTimeout(%q) error = %v, want an %s HelmError", tt.value, err, ErrorTypeInvalidInput)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseHelmTimeout(%q) error = %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseHelmTimeout(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+// newFakeHelmClient returns a client keeping its releases in memory, its Kubernetes calls fail with
+// the errors set on kubeClient
+func newFakeHelmClient(kubeClient *kubefake.FailingKubeClient) *HelmClient {
+	kubeClient.PrintingKubeClient = kubefake.PrintingKubeClient{Out: io.Discard}
+	config := &action.Configuration{
+		Releases:     storage.Init(driver.NewMemory()),
+		KubeClient:   kubeClient,
+		Capabilities: chartutil.DefaultCapabilities,
+		Log:          func(format string, v ...interface{}) {},
+	}
+	return &HelmClient{
+		settings: cli.New(),
+		config:   config,
+		configs:  map[string]*action.Configuration{"default": config},
+	}
+}
+
+// writeTestChart writes a chart with a single ConfigMap and returns its directory
+func writeTestChart(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "failing")
+	files := map[string]string{
+		"Chart.yaml":               "apiVersion: v2\nname: failing\nversion: 0.1.0\n",
+		"templates/configmap.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Release.Name }}\ndata:\n  key: value\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInstallChart_Atomic(t *testing.T) {
+	chart := writeTestChart(t)
+
+	tests := []struct {
+		name        string
+		atomic      bool
+		wantRelease bool
+	}{
+		{name: "atomic install leaves no release behind", atomic: true, wantRelease: false},
+		{name: "plain install keeps the failed release", atomic: false, wantRelease: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeHelmClient(&kubefake.FailingKubeClient{WaitError: errors.New("pods never became ready")})
+
+			err := client.InstallChart(context.Background(), "failing", chart, "default", "", true, tt.atomic, false, time.Minute, nil)
+			var helmErr *HelmError
+			if !errors.As(err, &helmErr) || helmErr.Type != ErrorTypeRelease {
+				t.Fatalf("InstallChart() error = %v, want a %s HelmError", err, ErrorTypeRelease)
+			}
+
+			releases, err := client.config.Releases.History("failing")
+			if err != nil && !errors.Is(err, driver.ErrReleaseNotFound) {
+				t.Fatal(err)
+			}
+			if got := len(releases) > 0; got != tt.wantRelease {
+				t.Errorf("release left behind = %v, want %v", got, tt.wantRelease)
+			}
+		})
+	}
+}
+
+func TestRollbackRelease_AfterFailedUpgrade(t *testing.T) {
+	chart := writeTestChart(t)
+	kubeClient := &kubefake.FailingKubeClient{}
+	client := newFakeHelmClient(kubeClient)
+	ctx := context.Background()
+
+	if revision, err := client.GetLastSuccessfulRevision(ctx, "failing", "default"); err != nil || revision != 0 {
+		t.Fatalf("GetLastSuccessfulRevision() of a missing release = %d, %v, want 0", revision, err)
+	}
+
+	if err := client.InstallChart(ctx, "failing", chart, "default", "", false, false, false, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+	kubeClient.UpdateError = errors.New("admission webhook denied the request")
+	if err := client.UpdateChart(ctx, "failing", chart, "default", false, false, false, time.Minute, nil); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+	kubeClient.UpdateError = nil
+
+	revision, err := client.GetLastSuccessfulRevision(ctx, "failing", "default")
+	if err != nil || revision != 1 {
+		t.Fatalf("GetLastSuccessfulRevision() = %d, %v, want the installed revision 1", revision, err)
+	}
+
+	if err := client.RollbackRelease(ctx, "failing", revision, "default"); err != nil {
+		t.Fatalf("RollbackRelease() error = %v", err)
+	}
+	status, err := client.GetReleaseStatus(ctx, "failing", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Revision != 3 || status.Status != release.StatusDeployed {
+		t.Errorf("release after the rollback = revision %d %s, want revision 3 deployed", status.Revision, status.Status)
+	}
+	if revision, _ := client.GetLastSuccessfulRevision(ctx, "failing", "default"); revision != 3 {
+		t.Errorf("GetLastSuccessfulRevision() after the rollback = %d, want 3", revision)
+	}
+
+	var helmErr *HelmError
+	if err := client.RollbackRelease(ctx, "failing", 0, "default"); !errors.As(err, &helmErr) || helmErr.Type != ErrorTypeInvalidInput {
+		t.Errorf("RollbackRelease() to revision 0 error = %v, want an %s HelmError", err, ErrorTypeInvalidInput)
+	}
+}
+
+func TestUpdateChart_Wait(t *testing.T) {
+	chart := writeTestChart(t)
+	kubeClient := &kubefake.FailingKubeClient{}
+	client := newFakeHelmClient(kubeClient)
+	ctx := context.Background()
+
+	if err := client.InstallChart(ctx, "waiting", chart, "default", "", false, false, false, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+	kubeClient.WaitError = errors.New("timed out waiting for the condition")
+
+	if err := client.UpdateChart(ctx, "waiting", chart, "default", false, false, false, time.Minute, nil); err != nil {
+		t.Fatalf("UpdateChart() without wait error = %v", err)
+	}
+	var helmErr *HelmError
+	if err := client.UpdateChart(ctx, "waiting", chart, "default", true, false, false, time.Minute, nil); !errors.As(err, &helmErr) {
+		t.Fatalf("UpdateChart() with wait error = %v, want the HelmError of the failed wait", err)
+	}
+}
+
+func TestReleaseExists(t *testing.T) {
+	client := newFakeHelmClient(&kubefake.FailingKubeClient{})
+	ctx := context.Background()
+
+	exists, err := client.ReleaseExists(ctx, "missing", "default")
+	if err != nil || exists {
+		t.Fatalf("ReleaseExists() of a missing release = %v, %v, want false, nil", exists, err)
+	}
+
+	if err := client.InstallChart(ctx, "failing", writeTestChart(t), "default", "", false, false, false, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := client.ReleaseExists(ctx, "failing", "default"); err != nil || !exists {
+		t.Errorf("ReleaseExists() of an installed release = %v, %v, want true, nil", exists, err)
+	}
+
+	var helmErr *HelmError
+	if _, err := client.ReleaseExists(ctx, "", "default"); !errors.As(err, &helmErr) || helmErr.Type != ErrorTypeInvalidInput {
+		t.Errorf("ReleaseExists() without a name error = %v, want an %s HelmError", err, ErrorTypeInvalidInput)
+	}
+}
+
+func TestOCIRegistryClient_PlainHTTP(t *testing.T) {
+	plain, secure := true, false
+	tests := []struct {
+		name      string
+		chartRef  string
+		plainHTTP *bool
+		want      bool
+	}{
+		{name: "port 80 guessed", chartRef: "http://registry.lab/charts/nginx", want: true},
+		{name: "https registry", chartRef: "oci://registry.lab/charts/nginx", want: false},
+		{name: "lab registry on port 5000 forced", chartRef: "oci://registry.lab:5000/charts/nginx", plainHTTP: &plain, want: true},
+		{name: "port 80 forced to https", chartRef: "http://registry.lab/charts/nginx", plainHTTP: &secure, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeHelmClient(&kubefake.FailingKubeClient{})
+			client.ociPlainHTTP = tt.plainHTTP
+
+			got, err := client.usePlainHTTP(tt.chartRef)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("usePlainHTTP(%s) = %v, want %v", tt.chartRef, got, tt.want)
+			}
+
+			registryClient, err := client.ociRegistryClient(tt.chartRef, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shared := registryClient == client.registryClient; shared == tt.want {
+				t.Errorf("ociRegistryClient(%s) shared client = %v, plain http pulls get a client of their own", tt.chartRef, shared)
+			}
+		})
+	}
+}
+
+func TestOCIRegistryClient_InsecureSkipTLSVerify(t *testing.T) {
+	client := newFakeHelmClient(&kubefake.FailingKubeClient{})
+	WithOCIInsecureSkipTLSVerify(true)(client)
+
+	registryClient, err := client.ociRegistryClient("oci://registry.lab:5000/charts/nginx", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registryClient == nil || registryClient == client.registryClient {
+		t.Error("pulls without verifying the certificate get a client of their own")
+	}
+}
+
+func TestGetReleaseValues(t *testing.T) {
+	dir := writeTestChart(t)
+	if err := os.WriteFile(filepath.Join(dir, "values.yaml"), []byte("replicas: 1\nimage: nginx\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := newFakeHelmClient(&kubefake.FailingKubeClient{})
+	ctx := context.Background()
+
+	var helmErr *HelmError
+	if _, err := client.GetReleaseValues(ctx, "failing", "default", false); !errors.As(err, &helmErr) || helmErr.Type != ErrorTypeNotFound {
+		t.Fatalf("GetReleaseValues() of a missing release error = %v, want a %s HelmError", err, ErrorTypeNotFound)
+	}
+
+	if err := client.InstallChart(ctx, "failing", dir, "default", "", false, false, false, time.Minute, map[string]interface{}{"replicas": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	userValues, err := client.GetReleaseValues(ctx, "failing", "default", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userValues) != 1 || userValues["replicas"] != 3 {
+		t.Errorf("user-supplied values = %v, want only replicas 3", userValues)
+	}
+
+	allValues, err := client.GetReleaseValues(ctx, "failing", "default", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allValues["image"] != "nginx" || allValues["replicas"] != 3 {
+		t.Errorf("merged values = %v, want the chart default image and replicas 3", allValues)
+	}
+}
@@ -0,0 +1,35 @@
+#!/bin/sh
+# Stub docker CLI for the compose deployment tests. Every command is answered from the files of the
+# scenario directory in $STUB_DOCKER_SCENARIO: <command>.stdout, <command>.stderr and <command>.exit,
+# commands without files succeed silently. The calls are appended to $STUB_DOCKER_LOG when set, what
+# docker login reads from stdin to $STUB_DOCKER_LOG.stdin.
+args="$*"
+case "$args" in
+	*" config --services"*) command=config ;;
+	*" config --hash "*) command=config-hash ;;
+	*" pull "*) command="pull-${args##* pull }" ;;
+	*" up -d --scale "*) command=scale ;;
+	*" up -d"*) command=up ;;
+	*" ps --format json --all"*) command=ps ;;
+	"ps -a -q --filter "*) command=ps-project ;;
+	"ps -a --filter "*) command=ps-hashes ;;
+	"inspect "*) command=inspect ;;
+	"login "*) command=login ;;
+	"logout "*) command=logout ;;
+	"compose version --short") command=version ;;
+	*" logs --no-color"*) command=logs ;;
+	*) command=other ;;
+esac
+
+scenario="$STUB_DOCKER_SCENARIO"
+[ -n "$STUB_DOCKER_LOG" ] && echo "$args" >> "$STUB_DOCKER_LOG"
+# once scaled, compose ps answers with ps.after-scale.stdout when the scenario has one
+[ "$command" = scale ] && [ -n "$STUB_DOCKER_LOG" ] && touch "$STUB_DOCKER_LOG.scaled"
+[ "$command" = ps ] && [ -f "$STUB_DOCKER_LOG.scaled" ] && [ -f "$scenario/ps.after-scale.stdout" ] && command=ps.after-scale
+[ "$command" = login ] && [ -n "$STUB_DOCKER_LOG" ] && cat >> "$STUB_DOCKER_LOG.stdin"
+[ -f "$scenario/$command.stdout" ] && cat "$scenario/$command.stdout"
+[ -f "$scenario/$command.stderr" ] && cat "$scenario/$command.stderr" >&2
+[ -f "$scenario/$command.exit" ] && exit "$(cat "$scenario/$command.exit")"
+# a followed log stream goes on until it is stopped
+[ "$command" = logs ] && case "$args" in *--follow*) exec sleep 30 ;; esac
+exit 0
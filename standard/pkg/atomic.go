@@ -0,0 +1,28 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// IsComponentAtomic reads the atomic property of a helm component. A failed install or upgrade of
+// an atomic component is rolled back, so the next attempt starts from a clean namespace. The
+// property is not part of the generated models yet, hence it is read from the raw component.
+func IsComponentAtomic(component sbi.AppDeploymentProfile_Components_Item) (bool, error) {
+	raw, err := component.MarshalJSON()
+	if err != nil {
+		return false, fmt.Errorf("failed to read the component, err: %w", err)
+	}
+
+	var props struct {
+		Properties struct {
+			Atomic *bool `json:"atomic"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(raw, &props); err != nil {
+		return false, fmt.Errorf("failed to parse the component properties, err: %w", err)
+	}
+	return props.Properties.Atomic != nil && *props.Properties.Atomic, nil
+}
@@ -0,0 +1,24 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// BundleSignature reads the detached signature of the bundle from a raw state manifest, empty when
+// the bundle is not signed. The signature, a JWS in compact serialization whose payload is the bundle
+// archive, is not part of the generated models yet, hence it is read from the raw manifest.
+func BundleSignature(manifest []byte) (string, error) {
+	var bundle struct {
+		Bundle *struct {
+			Signature *string `json:"signature"`
+		} `json:"bundle"`
+	}
+	if err := json.Unmarshal(manifest, &bundle); err != nil {
+		return "", fmt.Errorf("failed to parse the state manifest, err: %w", err)
+	}
+	if bundle.Bundle == nil || bundle.Bundle.Signature == nil {
+		return "", nil
+	}
+	return *bundle.Bundle.Signature, nil
+}
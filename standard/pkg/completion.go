@@ -0,0 +1,44 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// CompletionPolicy tells the device how to treat a component whose workload is expected to exit
+type CompletionPolicy string
+
+const (
+	// CompletionPolicyNone is the default, the component is expected to keep running
+	CompletionPolicyNone CompletionPolicy = ""
+	// CompletionPolicyOnceSuccessful marks a one-shot component (e.g. a database migration) that is
+	// done once its containers exit with code 0 or its Kubernetes Jobs complete
+	CompletionPolicyOnceSuccessful CompletionPolicy = "OnceSuccessful"
+)
+
+// GetComponentCompletionPolicy reads the completionPolicy property of a deployment profile component.
+// The property is not part of the generated models yet, hence it is read from the raw component.
+func GetComponentCompletionPolicy(component sbi.AppDeploymentProfile_Components_Item) (CompletionPolicy, error) {
+	raw, err := component.MarshalJSON()
+	if err != nil {
+		return CompletionPolicyNone, fmt.Errorf("failed to read the component, err: %w", err)
+	}
+
+	var props struct {
+		Properties struct {
+			CompletionPolicy CompletionPolicy `json:"completionPolicy"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(raw, &props); err != nil {
+		return CompletionPolicyNone, fmt.Errorf("failed to parse the component properties, err: %w", err)
+	}
+
+	switch props.Properties.CompletionPolicy {
+	case CompletionPolicyNone, CompletionPolicyOnceSuccessful:
+		return props.Properties.CompletionPolicy, nil
+	default:
+		return CompletionPolicyNone, fmt.Errorf("unsupported completionPolicy %q", props.Properties.CompletionPolicy)
+	}
+}
@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// AnnotationNamespace sets the Kubernetes namespace of every helm component of a deployment that
+// does not set its own namespace property
+const AnnotationNamespace = "app.margo.org/namespace"
+
+// GetComponentNamespace returns the Kubernetes namespace a helm component is installed to: the
+// namespace property of the component, else the AnnotationNamespace annotation of the deployment,
+// else empty for the default namespace. The property is not part of the generated models yet,
+// hence it is read from the raw component.
+func GetComponentNamespace(appDeployment sbi.AppDeploymentManifest, component sbi.AppDeploymentProfile_Components_Item) (string, error) {
+	raw, err := component.MarshalJSON()
+	if err != nil {
+		return "", fmt.Errorf("failed to read the component, err: %w", err)
+	}
+
+	var props struct {
+		Properties struct {
+			Namespace string `json:"namespace"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(raw, &props); err != nil {
+		return "", fmt.Errorf("failed to parse the component properties, err: %w", err)
+	}
+
+	namespace := strings.TrimSpace(props.Properties.Namespace)
+	if namespace == "" && appDeployment.Metadata.Annotations != nil {
+		namespace = strings.TrimSpace((*appDeployment.Metadata.Annotations)[AnnotationNamespace])
+	}
+	if namespace == "" {
+		return "", nil
+	}
+	if problems := validation.IsDNS1123Label(namespace); len(problems) > 0 {
+		return "", fmt.Errorf("invalid namespace %q: %s", namespace, strings.Join(problems, ", "))
+	}
+	return namespace, nil
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+)
+
+// RegistryAuth are the credentials of a private registry the images of a compose component or the
+// chart of a helm component are pulled from
+type RegistryAuth struct {
+	// Registry is the registry host as the image references name it, e.g. registry.example.com:5000
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	// PasswordRef names a password or token the device keeps in its own configuration, so that the
+	// manifest does not carry it, Password and PasswordRef are mutually exclusive
+	PasswordRef string `json:"passwordRef,omitempty"`
+}
+
+// GetComponentRegistryAuths reads the registryAuth property of a compose or helm component, the
+// credentials of the private registries its images or chart are pulled from. The property is not
+// part of the generated models yet, hence it is read from the raw component.
+func GetComponentRegistryAuths(component sbi.AppDeploymentProfile_Components_Item) ([]RegistryAuth, error) {
+	raw, err := component.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the component, err: %w", err)
+	}
+
+	var props struct {
+		Properties struct {
+			RegistryAuth []RegistryAuth `json:"registryAuth"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(raw, &props); err != nil {
+		return nil, fmt.Errorf("failed to parse the component properties, err: %w", err)
+	}
+
+	for i, auth := range props.Properties.RegistryAuth {
+		if strings.TrimSpace(auth.Registry) == "" {
+			return nil, fmt.Errorf("registryAuth[%d] has no registry", i)
+		}
+		if strings.TrimSpace(auth.Username) == "" {
+			return nil, fmt.Errorf("registryAuth[%d] of registry %s has no username", i, auth.Registry)
+		}
+		if auth.Password != "" && auth.PasswordRef != "" {
+			return nil, fmt.Errorf("registryAuth[%d] of registry %s sets both password and passwordRef", i, auth.Registry)
+		}
+	}
+	return props.Properties.RegistryAuth, nil
+}
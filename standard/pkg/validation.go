@@ -0,0 +1,185 @@
+package pkg
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/margo/sandbox/standard/generatedCode/wfm/sbi"
+	"gopkg.in/yaml.v2"
+)
+
+// deploymentIdPattern is the syntax of a deployment id: lower case letters, numbers and dashes,
+// starting with a letter or a number. The first 8 characters name the helm releases and compose
+// projects of the deployment, hence the minimum length.
+var deploymentIdPattern = regexp.MustCompile(`^[a-z0-9][-a-z0-9]{7,62}$`)
+
+// pointerSegmentPattern is the syntax of a segment of a parameter pointer like "image.tag"
+var pointerSegmentPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidationError is a problem of an application deployment
+type ValidationError struct {
+	// Field is the path of the offending field in the deployment, e.g. spec.deploymentProfile.type
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Message)
+}
+
+// ValidationErrors are all the problems of an application deployment
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidateAppDeploymentManifest checks what the runtimes need of a deployment before it is
+// deployed: the id of the deployment, the profile type, the name and the location of every
+// component and the targets of the parameters. All the problems are returned at once, nil means
+// the deployment is valid.
+func ValidateAppDeploymentManifest(deploymentId string, manifest *sbi.AppDeploymentManifest) ValidationErrors {
+	var errs ValidationErrors
+	if !deploymentIdPattern.MatchString(deploymentId) {
+		errs.add("deploymentId", "%q must be 8 to 63 lower case letters, numbers or '-', starting with a letter or a number", deploymentId)
+	}
+	if manifest == nil {
+		errs.add("spec", "is required")
+		return errs
+	}
+
+	profile := manifest.Spec.DeploymentProfile
+	field := "spec.deploymentProfile"
+	switch profile.Type {
+	case sbi.HelmV3, sbi.Compose:
+	case "":
+		errs.add(field+".type", "is required")
+	default:
+		errs.add(field+".type", "%q must be %s or %s", profile.Type, sbi.HelmV3, sbi.Compose)
+	}
+	if len(profile.Components) == 0 {
+		errs.add(field+".components", "needs at least one component")
+	}
+
+	components := map[string]bool{}
+	for i, component := range profile.Components {
+		componentField := fmt.Sprintf("%s.components[%d]", field, i)
+		name := validateComponent(&errs, componentField, profile.Type, component)
+		if name == "" {
+			errs.add(componentField+".name", "is required")
+		} else if components[name] {
+			errs.add(componentField+".name", "%q is declared more than once in the profile", name)
+		}
+		components[name] = true
+	}
+
+	if manifest.Spec.Parameters != nil {
+		validateDeploymentParameters(&errs, *manifest.Spec.Parameters, components)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// validateComponent checks the properties the runtime of the profile needs and returns the name of
+// the component
+func validateComponent(errs *ValidationErrors, field string, profileType sbi.AppDeploymentProfileType, component sbi.AppDeploymentProfile_Components_Item) string {
+	switch profileType {
+	case sbi.HelmV3:
+		helm, err := component.AsHelmApplicationDeploymentProfileComponent()
+		if err != nil {
+			errs.add(field, "is not a helm component: %v", err)
+			return ""
+		}
+		if strings.TrimSpace(helm.Properties.Repository) == "" {
+			errs.add(field+".properties.repository", "is required")
+		}
+		if helm.Properties.Revision != nil && strings.TrimSpace(*helm.Properties.Revision) == "" {
+			errs.add(field+".properties.revision", "must not be blank, leave it out for the latest revision")
+		}
+		return strings.TrimSpace(helm.Name)
+
+	case sbi.Compose:
+		compose, err := component.AsComposeApplicationDeploymentProfileComponent()
+		if err != nil {
+			errs.add(field, "is not a compose component: %v", err)
+			return ""
+		}
+		if location := strings.TrimSpace(compose.Properties.PackageLocation); location == "" {
+			errs.add(field+".properties.packageLocation", "is required")
+		} else if !isComposeLocation(location) {
+			errs.add(field+".properties.packageLocation", "must be an http(s) URL, an absolute path or inline compose YAML")
+		}
+		return strings.TrimSpace(compose.Name)
+
+	default:
+		helm, _ := component.AsHelmApplicationDeploymentProfileComponent()
+		return strings.TrimSpace(helm.Name)
+	}
+}
+
+// isComposeLocation reports whether the compose file can be read from the location: an http(s) URL,
+// a file on the device or the compose YAML itself
+func isComposeLocation(location string) bool {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		parsed, err := url.Parse(location)
+		return err == nil && parsed.Host != ""
+	}
+	if filepath.IsAbs(location) {
+		return true
+	}
+	var content map[string]interface{}
+	return yaml.Unmarshal([]byte(location), &content) == nil && content["services"] != nil
+}
+
+// validateDeploymentParameters checks that every parameter targets components of the profile
+// through pointers like "image.tag"
+func validateDeploymentParameters(errs *ValidationErrors, parameters sbi.AppDeploymentParams, components map[string]bool) {
+	for _, name := range slices.Sorted(maps.Keys(parameters)) {
+		field := "spec.parameters." + name
+		parameter := parameters[name]
+		if len(parameter.Targets) == 0 {
+			errs.add(field+".targets", "needs at least one target")
+		}
+		for i, target := range parameter.Targets {
+			targetField := fmt.Sprintf("%s.targets[%d]", field, i)
+			if target.Pointer == "" {
+				errs.add(targetField+".pointer", "is required")
+			} else if !validPointer(target.Pointer) {
+				errs.add(targetField+".pointer", "%q must be names of letters, numbers, '_' or '-' separated by '.'", target.Pointer)
+			}
+			if len(target.Components) == 0 {
+				errs.add(targetField+".components", "needs at least one component")
+			}
+			for j, component := range target.Components {
+				if !components[component] {
+					errs.add(fmt.Sprintf("%s.components[%d]", targetField, j), "%q is not a component of the deployment profile", component)
+				}
+			}
+		}
+	}
+}
+
+func validPointer(pointer string) bool {
+	for _, segment := range strings.Split(pointer, ".") {
+		if !pointerSegmentPattern.MatchString(segment) {
+			return false
+		}
+	}
+	return true
+}